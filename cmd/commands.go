@@ -0,0 +1,806 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/tajious/heimdall/internal/audit"
+	"github.com/tajious/heimdall/internal/blob"
+	"github.com/tajious/heimdall/internal/bootstrap"
+	"github.com/tajious/heimdall/internal/config"
+	"github.com/tajious/heimdall/internal/demo"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/loadtest"
+	"github.com/tajious/heimdall/internal/metrics"
+	"github.com/tajious/heimdall/internal/migrate"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/passwords"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/transfer"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+const maxMintCount = 100000
+
+// minPassphraseLength guards tenant archives, which carry password hashes
+// and signing keys, against trivially guessable passphrases.
+const minPassphraseLength = 12
+
+func runCommand(cfg *config.Config, store storage.Storage, secrets *vault.Vault, name string, args []string) error {
+	switch name {
+	case "mint-tokens":
+		return mintTokens(cfg, store, secrets, args)
+	case "apply":
+		return apply(cfg, store, secrets, args)
+	case "export-tenant":
+		return exportTenant(store, secrets, args)
+	case "import-tenant":
+		return importTenant(store, secrets, args)
+	case "verify-audit-log":
+		return verifyAuditLog(store, args)
+	case "reshard":
+		return reshard(store, args)
+	case "migrate-jwt-secret":
+		return migrateJWTSecret(cfg, store, secrets, args)
+	case "import-users":
+		return importUsers(cfg, store, args)
+	default:
+		return usageErrorf("unknown command %q", name)
+	}
+}
+
+func mintTokens(cfg *config.Config, store storage.Storage, secrets *vault.Vault, args []string) error {
+	fs := flag.NewFlagSet("mint-tokens", flag.ContinueOnError)
+	tenantID := fs.String("tenant", "", "tenant ID the tokens are issued for")
+	envName := fs.String("environment", "", "environment name (defaults to the tenant's default keys)")
+	count := fs.Int("count", 1, "number of tokens to mint")
+	role := fs.String("role", string(models.RoleUser), "role claim of the synthetic users")
+	scopes := fs.String("scopes", "", "comma-separated scopes claim")
+	ttl := fs.Duration("ttl", time.Hour, "token lifetime")
+	tokenType := fs.String("type", "", "token type claim: empty for access tokens, action or magic_link")
+	out := fs.String("out", "", "write tokens to this file instead of stdout")
+	output := outputFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *tenantID == "" {
+		return usageErrorf("-tenant is required")
+	}
+	switch models.TokenType(*tokenType) {
+	case models.TokenAccess, models.TokenAction, models.TokenMagicLink:
+	default:
+		return usageErrorf("unknown token type %q", *tokenType)
+	}
+	if *count < 1 || *count > maxMintCount {
+		return usageErrorf("-count must be between 1 and %d", maxMintCount)
+	}
+
+	ctx := storage.Unscoped(context.Background())
+	tenant, err := store.GetTenant(ctx, *tenantID)
+	if err != nil {
+		return err
+	}
+
+	var env *models.Environment
+	if *envName != "" {
+		found, err := store.GetEnvironmentByName(ctx, *tenantID, *envName)
+		if err != nil {
+			return err
+		}
+		env = found
+	}
+
+	var scopeList []string
+	if *scopes != "" {
+		scopeList = strings.Split(*scopes, ",")
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	buf := bufio.NewWriter(w)
+	defer buf.Flush()
+
+	resolver, err := newKeyResolver(cfg, store, secrets)
+	if err != nil {
+		return err
+	}
+	// The table format streams one token per line; the others need the
+	// whole list to print one document.
+	var tokens []string
+	now := time.Now()
+	for i := 0; i < *count; i++ {
+		claims := &models.Claims{
+			UserID:    "synthetic-" + uuid.NewString(),
+			TenantID:  *tenantID,
+			Role:      models.Role(*role),
+			Scopes:    scopeList,
+			Synthetic: true,
+			Type:      models.TokenType(*tokenType),
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(now.Add(*ttl)),
+				IssuedAt:  jwt.NewNumericDate(now),
+				NotBefore: jwt.NewNumericDate(now),
+			},
+		}
+		if env != nil {
+			claims.EnvironmentID = env.ID
+		}
+
+		token, err := resolver.Sign(ctx, claims, tenant, env)
+		if err != nil {
+			return err
+		}
+		if *output != outputTable {
+			tokens = append(tokens, token)
+			continue
+		}
+		if _, err := fmt.Fprintln(buf, token); err != nil {
+			return err
+		}
+	}
+
+	if *output == outputTable {
+		return nil
+	}
+	return output.render(buf, mintedTokens{Tokens: tokens}, nil)
+}
+
+type mintedTokens struct {
+	Tokens []string `json:"tokens" yaml:"tokens"`
+}
+
+func apply(cfg *config.Config, store storage.Storage, secrets *vault.Vault, args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	path := fs.String("f", "", "bootstrap file to apply")
+	output := outputFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *path == "" {
+		return usageErrorf("-f is required")
+	}
+
+	hasher := passwords.NewHasher(cfg.Server.PasswordWorkers, cfg.Server.PasswordQueueTimeout, metrics.Default)
+	return applyBootstrap(storage.Unscoped(context.Background()), store, hasher, secrets, *path, *output)
+}
+
+type appliedChange struct {
+	Kind   string `json:"kind" yaml:"kind"`
+	ID     string `json:"id" yaml:"id"`
+	Action string `json:"action" yaml:"action"`
+	APIKey string `json:"api_key,omitempty" yaml:"api_key,omitempty"`
+}
+
+// applyBootstrap applies a bootstrap file and prints the API keys it
+// created, which are shown only once. The table format prints only those,
+// one "ID<tab>key" line each, as it always has.
+func applyBootstrap(ctx context.Context, store storage.Storage, hasher *passwords.Hasher, secrets *vault.Vault, path string, output outputFormat) error {
+	file, err := bootstrap.Load(path)
+	if err != nil {
+		return err
+	}
+
+	changes, err := bootstrap.NewApplier(store, hasher, secrets).Apply(ctx, file)
+	applied := struct {
+		Changes []appliedChange `json:"changes" yaml:"changes"`
+	}{Changes: []appliedChange{}}
+	for _, change := range changes {
+		log.Printf("bootstrap: %s %s %s", change.Kind, change.ID, change.Action)
+		applied.Changes = append(applied.Changes, appliedChange{
+			Kind:   change.Kind,
+			ID:     change.ID,
+			Action: string(change.Action),
+			APIKey: change.APIKey,
+		})
+	}
+	if renderErr := output.render(os.Stdout, applied, func(w io.Writer) error {
+		for _, change := range applied.Changes {
+			if change.APIKey != "" {
+				fmt.Fprintf(w, "%s\t%s\n", change.ID, change.APIKey)
+			}
+		}
+		return nil
+	}); err == nil {
+		err = renderErr
+	}
+	return err
+}
+
+// seedDemo seeds the demo tenant and prints how to sign in to it.
+func seedDemo(ctx context.Context, store storage.Storage, hasher *passwords.Hasher, secrets *vault.Vault) error {
+	accounts, err := demo.Seed(ctx, store, hasher, secrets)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Demo mode: data is kept in memory and the credentials below are public, never expose this instance")
+	fmt.Printf("Demo tenant %q, staging environment API key %s\n", demo.TenantID, demo.APIKey)
+	for _, account := range accounts {
+		fmt.Printf("  %-10s %-8s %s\n", account.Role, account.Username, account.Password)
+	}
+	return nil
+}
+
+func exportTenant(store storage.Storage, secrets *vault.Vault, args []string) error {
+	fs := flag.NewFlagSet("export-tenant", flag.ContinueOnError)
+	tenantID := fs.String("tenant", "", "tenant ID to export")
+	out := fs.String("out", "", "archive file to write")
+	output := outputFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *tenantID == "" || *out == "" {
+		return usageErrorf("-tenant and -out are required")
+	}
+	passphrase, err := archivePassphrase()
+	if err != nil {
+		return err
+	}
+
+	archive, err := transfer.Export(storage.Unscoped(context.Background()), store, secrets, *tenantID)
+	if err != nil {
+		return err
+	}
+	sealed, err := transfer.Seal(archive, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, sealed, 0o600); err != nil {
+		return err
+	}
+
+	exported := struct {
+		Tenant         string `json:"tenant" yaml:"tenant"`
+		File           string `json:"file" yaml:"file"`
+		Environments   int    `json:"environments" yaml:"environments"`
+		Users          int    `json:"users" yaml:"users"`
+		PolicyVersions int    `json:"policy_versions" yaml:"policy_versions"`
+		AccessPolicies int    `json:"access_policies" yaml:"access_policies"`
+	}{*tenantID, *out, len(archive.Environments), len(archive.Users), len(archive.PolicyVersions), len(archive.AccessPolicies)}
+	return output.render(os.Stdout, exported, func(w io.Writer) error {
+		fmt.Fprintf(w, "TENANT\tFILE\tENVIRONMENTS\tUSERS\tPOLICY VERSIONS\tACCESS POLICIES\n")
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n", exported.Tenant, exported.File, exported.Environments, exported.Users, exported.PolicyVersions, exported.AccessPolicies)
+		return nil
+	})
+}
+
+func importTenant(store storage.Storage, secrets *vault.Vault, args []string) error {
+	fs := flag.NewFlagSet("import-tenant", flag.ContinueOnError)
+	path := fs.String("f", "", "archive file to import")
+	output := outputFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *path == "" {
+		return usageErrorf("-f is required")
+	}
+	passphrase, err := archivePassphrase()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(*path)
+	if err != nil {
+		return err
+	}
+	archive, err := transfer.Open(data, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := transfer.Import(storage.Unscoped(context.Background()), store, secrets, archive); err != nil {
+		return err
+	}
+
+	imported := struct {
+		Tenant     string    `json:"tenant" yaml:"tenant"`
+		ExportedAt time.Time `json:"exported_at" yaml:"exported_at"`
+	}{archive.Tenant.ID, archive.ExportedAt.UTC()}
+	return output.render(os.Stdout, imported, func(w io.Writer) error {
+		fmt.Fprintf(w, "TENANT\tEXPORTED AT\n%s\t%s\n", imported.Tenant, imported.ExportedAt.Format(time.RFC3339))
+		return nil
+	})
+}
+
+// verifyAuditLog checks a tenant's audit log hash chain and fails when it is
+// broken, so it can run from cron or CI.
+func verifyAuditLog(store storage.Storage, args []string) error {
+	fs := flag.NewFlagSet("verify-audit-log", flag.ContinueOnError)
+	tenantID := fs.String("tenant", "", "tenant ID whose audit log to verify")
+	output := outputFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *tenantID == "" {
+		return usageErrorf("-tenant is required")
+	}
+
+	report, err := audit.Verify(storage.Unscoped(context.Background()), store, *tenantID)
+	if err != nil {
+		return err
+	}
+	if err := output.render(os.Stdout, report, func(w io.Writer) error {
+		fmt.Fprintf(w, "TENANT\tVALID\tENTRIES\tANCHOR\tFIRST\tLAST\tHEAD HASH\n")
+		fmt.Fprintf(w, "%s\t%t\t%d\t%d\t%d\t%d\t%s\n", report.TenantID, report.Valid, report.Entries, report.AnchorSequence, report.FirstSequence, report.LastSequence, report.HeadHash)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if !report.Valid {
+		return checkFailedf("chain broken at sequence %d: %s", report.BrokenAt, report.Problem)
+	}
+	return nil
+}
+
+// reshard moves every tenant of the default region to the shard its ID
+// hashes to, after shards were added to DB_SHARDS.
+func reshard(store storage.Storage, args []string) error {
+	fs := flag.NewFlagSet("reshard", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "list the moves without making them")
+	output := outputFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	routed, ok := store.(*storage.RoutedStorage)
+	if !ok || routed.Shards() < 2 {
+		return errors.New("reshard needs DB_SHARDS")
+	}
+
+	ctx := storage.Unscoped(context.Background())
+	const pageSize = 100
+	result := struct {
+		DryRun bool         `json:"dry_run" yaml:"dry_run"`
+		Moves  []tenantMove `json:"moves" yaml:"moves"`
+	}{DryRun: *dryRun, Moves: []tenantMove{}}
+	for page := 1; ; page++ {
+		tenants, total, err := store.ListTenants(ctx, page, pageSize)
+		if err != nil {
+			return err
+		}
+		for _, tenant := range tenants {
+			if tenant.Region != "" {
+				continue
+			}
+			target := storage.ShardFor(tenant.ID, routed.Shards())
+			if target == tenant.Shard {
+				continue
+			}
+			log.Printf("reshard: tenant %s from shard %d to shard %d", tenant.ID, tenant.Shard, target)
+			result.Moves = append(result.Moves, tenantMove{Tenant: tenant.ID, From: tenant.Shard, To: target})
+			if *dryRun {
+				continue
+			}
+			if err := routed.MoveTenant(ctx, tenant.ID, target); err != nil {
+				return fmt.Errorf("move tenant %s: %w", tenant.ID, err)
+			}
+		}
+		if int64(page*pageSize) >= total {
+			break
+		}
+	}
+
+	return output.render(os.Stdout, result, func(w io.Writer) error {
+		fmt.Fprintf(w, "TENANT\tFROM SHARD\tTO SHARD\n")
+		for _, move := range result.Moves {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", move.Tenant, move.From, move.To)
+		}
+		return nil
+	})
+}
+
+type tenantMove struct {
+	Tenant string `json:"tenant" yaml:"tenant"`
+	From   int    `json:"from" yaml:"from"`
+	To     int    `json:"to" yaml:"to"`
+}
+
+// migrateJWTSecret gives every tenant without one a token signing key, so
+// its tokens stop being signed with the global JWT_SECRET, and suggests the
+// JWT_LEGACY_SECRET_CUTOFF after which the tokens signed before expire.
+func migrateJWTSecret(cfg *config.Config, store storage.Storage, secrets *vault.Vault, args []string) error {
+	fs := flag.NewFlagSet("migrate-jwt-secret", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "count the tenants to migrate without migrating them")
+	output := outputFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	ctx := storage.Unscoped(context.Background())
+	const pageSize = 100
+	migrated, tenantCount := 0, 0
+	// lifetime is the longest an access token of a migrated tenant lives,
+	// which a registered client may set above the default.
+	lifetime := cfg.JWT.AccessExpiration
+	for page := 1; ; page++ {
+		tenants, total, err := store.ListTenants(ctx, page, pageSize)
+		if err != nil {
+			return err
+		}
+		for _, tenant := range tenants {
+			tenantCount++
+			if tenant.Config.TokenSigningKey != "" {
+				continue
+			}
+			migrated++
+			if *dryRun {
+				continue
+			}
+			tenantCtx := storage.WithTenant(ctx, tenant.ID)
+			clients, err := store.ListClients(tenantCtx, tenant.ID)
+			if err != nil {
+				return fmt.Errorf("tenant %s: %w", tenant.ID, err)
+			}
+			for _, client := range clients {
+				lifetime = max(lifetime, time.Duration(client.AccessTokenLifetime)*time.Second)
+			}
+			if tenant.Config.TokenSigningKey, err = keys.NewTenantKey(tenantCtx, secrets, tenant.ID); err != nil {
+				return fmt.Errorf("tenant %s: %w", tenant.ID, err)
+			}
+			tenant.Config.UpdatedAt = time.Now()
+			if err := store.UpdateTenantConfig(tenantCtx, &tenant.Config); err != nil {
+				return fmt.Errorf("tenant %s: %w", tenant.ID, err)
+			}
+			log.Printf("migrate-jwt-secret: tenant %s now signs with its own key (%d of %d)", tenant.ID, tenantCount, total)
+		}
+		if int64(page*pageSize) >= total {
+			break
+		}
+	}
+
+	// LegacyCutoff is when the last token signed with the global secret
+	// expires, the value to set JWT_LEGACY_SECRET_CUTOFF to.
+	result := struct {
+		DryRun       bool   `json:"dry_run" yaml:"dry_run"`
+		Tenants      int    `json:"tenants" yaml:"tenants"`
+		Migrated     int    `json:"migrated" yaml:"migrated"`
+		LegacyCutoff string `json:"legacy_cutoff,omitempty" yaml:"legacy_cutoff,omitempty"`
+	}{DryRun: *dryRun, Tenants: tenantCount, Migrated: migrated}
+	if !*dryRun && migrated > 0 {
+		result.LegacyCutoff = time.Now().Add(lifetime).UTC().Format(time.RFC3339)
+		log.Printf("migrate-jwt-secret: tokens signed with the global secret expire by %s; set JWT_LEGACY_SECRET_CUTOFF=%s to refuse them from then on", result.LegacyCutoff, result.LegacyCutoff)
+	}
+	return output.render(os.Stdout, result, func(w io.Writer) error {
+		label := "MIGRATED"
+		if *dryRun {
+			label = "TO MIGRATE"
+		}
+		fmt.Fprintf(w, "TENANTS\t%s\tLEGACY CUTOFF\n", label)
+		fmt.Fprintf(w, "%d\t%d\t%s\n", result.Tenants, result.Migrated, orDash(result.LegacyCutoff))
+		return nil
+	})
+}
+
+// importUsers creates the users of an Auth0, Keycloak, or Firebase export in
+// a tenant. Their password hashes are verified as they are on the first
+// login, and replaced with bcrypt hashes then. An export too large to copy
+// onto the host is staged in the blob store and deleted once imported.
+func importUsers(cfg *config.Config, store storage.Storage, args []string) error {
+	fs := flag.NewFlagSet("import-users", flag.ContinueOnError)
+	tenantID := fs.String("tenant", "", "tenant ID to import the users into")
+	envName := fs.String("environment", "", "environment whose user pool to import into (defaults to the tenant's)")
+	format := fs.String("format", "", "export format: auth0, keycloak, or firebase")
+	path := fs.String("f", "", "export file to import")
+	staged := fs.String("staged", "", "name of an export staged in the blob store under "+stagedImportsPrefix+", instead of -f")
+	signerKey := fs.String("firebase-signer-key", "", "base64 signer key of the Firebase project's password hash parameters")
+	saltSeparator := fs.String("firebase-salt-separator", "", "base64 salt separator of the Firebase project")
+	rounds := fs.Int("firebase-rounds", 8, "rounds of the Firebase project")
+	memCost := fs.Int("firebase-mem-cost", 14, "mem cost of the Firebase project")
+	output := outputFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *tenantID == "" || *format == "" || (*path == "") == (*staged == "") {
+		return usageErrorf("-tenant, -format, and one of -f or -staged are required")
+	}
+	var opts migrate.Options
+	if *signerKey != "" {
+		key, err := base64.StdEncoding.DecodeString(*signerKey)
+		if err != nil {
+			return usageErrorf("-firebase-signer-key: %w", err)
+		}
+		separator, err := base64.StdEncoding.DecodeString(*saltSeparator)
+		if err != nil {
+			return usageErrorf("-firebase-salt-separator: %w", err)
+		}
+		opts.Firebase = passwords.FirebaseScryptParams{SignerKey: key, SaltSeparator: separator, Rounds: *rounds, MemCost: *memCost}
+	}
+
+	var blobs blob.Store
+	var export io.Reader
+	source := *path
+	if *staged != "" {
+		source = stagedImportsPrefix + *staged
+		if !validStagedName(*staged) {
+			return usageErrorf("-staged: invalid name %q", *staged)
+		}
+		var err error
+		if blobs, err = openBlobStore(cfg); err != nil {
+			return err
+		}
+		if blobs == nil {
+			return usageErrorf("-staged needs BLOB_STORE")
+		}
+		data, err := blobs.Get(context.Background(), source)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", source, err)
+		}
+		export = bytes.NewReader(data)
+	} else {
+		f, err := os.Open(*path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		export = bufio.NewReader(f)
+	}
+	accounts, err := migrate.Read(migrate.Format(*format), export, opts)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", source, err)
+	}
+
+	ctx := storage.Unscoped(context.Background())
+	tenant, err := store.GetTenant(ctx, *tenantID)
+	if err != nil {
+		return err
+	}
+	var envID string
+	if *envName != "" {
+		env, err := store.GetEnvironmentByName(ctx, *tenantID, *envName)
+		if err != nil {
+			return err
+		}
+		envID = env.ID
+	}
+
+	// The import is followed as a job, so admins can watch it through the
+	// API while it runs.
+	now := time.Now()
+	job := &models.Job{
+		TenantID:  tenant.ID,
+		Kind:      models.JobImportUsers,
+		Status:    models.JobRunning,
+		Total:     int64(len(accounts)),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := store.CreateJob(ctx, job); err != nil {
+		log.Printf("import-users: failed to create the import job: %v", err)
+		job = nil
+	} else {
+		log.Printf("import-users: running as job %s", job.ID)
+	}
+	progress := func(done int) {
+		if job == nil {
+			return
+		}
+		job.Advance(int64(done))
+		if err := store.UpdateJob(ctx, job); err != nil {
+			log.Printf("import-users: failed to update job %s: %v", job.ID, err)
+		}
+	}
+
+	result, err := migrate.Import(ctx, store, tenant, envID, accounts, progress)
+	if job != nil {
+		done := len(accounts)
+		if result != nil && err != nil {
+			done = result.Created + result.Existing + len(result.Skipped)
+		}
+		job.Advance(int64(done))
+		job.Finish(err, fmt.Sprintf("Import failed after %d of %d accounts", done, len(accounts)))
+		if updateErr := store.UpdateJob(ctx, job); updateErr != nil {
+			log.Printf("import-users: failed to update job %s: %v", job.ID, updateErr)
+		}
+	}
+	if result == nil {
+		return err
+	}
+	if err == nil && blobs != nil {
+		if err := blobs.Delete(ctx, source); err != nil {
+			log.Printf("import-users: failed to delete %s: %v", source, err)
+		}
+	}
+	for _, skipped := range result.Skipped {
+		log.Printf("import-users: skipped %s: %s", skipped.SourceID, skipped.Reason)
+	}
+	if renderErr := output.render(os.Stdout, result, func(w io.Writer) error {
+		fmt.Fprintf(w, "CREATED\tEXISTING\tSKIPPED\n%d\t%d\t%d\n", result.Created, result.Existing, len(result.Skipped))
+		return nil
+	}); err == nil {
+		err = renderErr
+	}
+	return err
+}
+
+// stagedImportsPrefix is where exports are staged in the blob store for
+// import-users.
+const stagedImportsPrefix = "imports/"
+
+// validStagedName keeps -staged under stagedImportsPrefix.
+func validStagedName(name string) bool {
+	return name == path.Clean(name) && !strings.HasPrefix(name, "/") && !strings.HasPrefix(name, "..")
+}
+
+// encryptValue reads a secret from stdin and prints it sealed under the
+// master key, ready to paste into the environment or a .env file.
+func encryptValue(args []string) error {
+	fs := flag.NewFlagSet("encrypt-value", flag.ContinueOnError)
+	output := outputFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	key, err := config.LoadMasterKey()
+	if err != nil {
+		return err
+	}
+	value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if value = strings.TrimRight(value, "\r\n"); value == "" {
+		return usageErrorf("pass the value to encrypt on stdin")
+	}
+
+	encrypted, err := config.Encrypt(key, value)
+	if err != nil {
+		return err
+	}
+	return output.render(os.Stdout, struct {
+		Value string `json:"value" yaml:"value"`
+	}{encrypted}, func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, encrypted)
+		return err
+	})
+}
+
+func runLoadTest(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	target := fs.String("target", "http://localhost:8080", "base URL of the instance to drive")
+	tenantID := fs.String("tenant", "", "tenant ID to log in to")
+	envName := fs.String("environment", "", "environment whose user pool to log in to (defaults to the tenant's)")
+	clientID := fs.String("client-id", "", "OAuth client to request tokens for")
+	username := fs.String("username", "", "user to log in as, with the password in LOADTEST_PASSWORD")
+	usersPath := fs.String("users", "", "file of username:password lines to log in as, instead of -username")
+	concurrency := fs.Int("concurrency", 10, "virtual users running operations in parallel")
+	duration := fs.Duration("duration", time.Minute, "how long to run")
+	rate := fs.Float64("rate", 0, "operations per second over all virtual users, 0 for as fast as possible")
+	mixFlag := fs.String("mix", "login=1,validate=8,refresh=1", "relative weight of each operation")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of a single request")
+	maxErrorRate := fs.Float64("max-error-rate", 100, "fail when more than this percent of the operations failed")
+	output := outputFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *tenantID == "" {
+		return usageErrorf("-tenant is required")
+	}
+	mix, err := loadtest.ParseMix(*mixFlag)
+	if err != nil {
+		return usageErrorf("-mix: %w", err)
+	}
+	users, err := loadTestUsers(*username, *usersPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	log.Printf("loadtest: driving %s with %d virtual users for %s", *target, *concurrency, *duration)
+	report, err := loadtest.Run(ctx, loadtest.Config{
+		Target:      *target,
+		TenantID:    *tenantID,
+		Environment: *envName,
+		ClientID:    *clientID,
+		Users:       users,
+		Concurrency: *concurrency,
+		Duration:    *duration,
+		Rate:        *rate,
+		Mix:         mix,
+		Timeout:     *timeout,
+	})
+	if err != nil {
+		return err
+	}
+	summary := report.Summary()
+	if err := output.render(os.Stdout, summary, report.Write); err != nil {
+		return err
+	}
+
+	total, failed := 0, 0
+	for _, op := range summary.Operations {
+		total += op.Count
+		failed += op.Errors
+	}
+	if total == 0 {
+		return checkFailedf("no operation completed")
+	}
+	if errorRate := 100 * float64(failed) / float64(total); errorRate > *maxErrorRate {
+		return checkFailedf("%.2f%% of the operations failed, above -max-error-rate %.2f%%", errorRate, *maxErrorRate)
+	}
+	return nil
+}
+
+// loadTestUsers reads the credentials to log in with. Passwords come from
+// the environment or a file so they stay out of shell history and process
+// listings.
+func loadTestUsers(username, path string) ([]loadtest.Credentials, error) {
+	if path == "" {
+		password := os.Getenv("LOADTEST_PASSWORD")
+		if username == "" || password == "" {
+			return nil, usageErrorf("pass -users, or -username with LOADTEST_PASSWORD set")
+		}
+		return []loadtest.Credentials{{Username: username, Password: password}}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var users []loadtest.Credentials
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, password, ok := strings.Cut(text, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:password", path, line)
+		}
+		users = append(users, loadtest.Credentials{Username: name, Password: password})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s has no users", path)
+	}
+	return users, nil
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// archivePassphrase reads the archive passphrase from the environment so it
+// stays out of shell history and process listings.
+func archivePassphrase() (string, error) {
+	passphrase := os.Getenv("TENANT_ARCHIVE_PASSPHRASE")
+	if len(passphrase) < minPassphraseLength {
+		return "", usageErrorf("TENANT_ARCHIVE_PASSPHRASE must be at least %d characters", minPassphraseLength)
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/tajious/heimdall/internal/config"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/pkg/heimdalltest"
+)
+
+// The conformance command runs the rate limit store and storage suites
+// against the in-memory backends and whichever shared backends it is pointed
+// at, using the same connection settings as the server.
+func main() {
+	stores := flag.String("stores", "memory", "comma-separated rate limit stores to check: memory, redis, memcached, dynamodb")
+	backends := flag.String("storage", "memory,sharded", "comma-separated storage backends to check: memory, sharded, postgres")
+	flag.Parse()
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	failed := false
+	for _, name := range strings.Split(*stores, ",") {
+		name = strings.TrimSpace(name)
+		store, err := openStore(cfg, name)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		if !run(name, store) {
+			failed = true
+		}
+	}
+	for _, name := range strings.Split(*backends, ",") {
+		name = strings.TrimSpace(name)
+		store, err := openStorage(cfg, name)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		if !runStorage(name, store) {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// run checks the cases concurrently, since several of them wait out a
+// window.
+func run(name string, store heimdalltest.RateLimitStore) bool {
+	cases := heimdalltest.RateLimitStoreCases()
+	errs := make([]error, len(cases))
+
+	var wg sync.WaitGroup
+	for i, c := range cases {
+		wg.Add(1)
+		go func(i int, c heimdalltest.RateLimitCase) {
+			defer wg.Done()
+			errs[i] = c.Run(context.Background(), store)
+		}(i, c)
+	}
+	wg.Wait()
+
+	passed := true
+	for i, c := range cases {
+		if errs[i] != nil {
+			fmt.Printf("FAIL ratelimit/%s/%s: %v\n", name, c.Name, errs[i])
+			passed = false
+			continue
+		}
+		fmt.Printf("ok   ratelimit/%s/%s\n", name, c.Name)
+	}
+	return passed
+}
+
+// runStorage checks the cases one at a time: the in-memory backend is not
+// safe for concurrent use.
+func runStorage(name string, store storage.Storage) bool {
+	passed := true
+	for _, c := range heimdalltest.StorageCases() {
+		if err := c.Run(context.Background(), store); err != nil {
+			fmt.Printf("FAIL storage/%s/%s: %v\n", name, c.Name, err)
+			passed = false
+			continue
+		}
+		fmt.Printf("ok   storage/%s/%s\n", name, c.Name)
+	}
+	return passed
+}
+
+// openStorage opens a backend for the storage suite. The suite leaves its
+// tenants behind, so point postgres at a scratch database.
+func openStorage(cfg *config.Config, name string) (storage.Storage, error) {
+	switch name {
+	case "memory":
+		return storage.NewInMemoryStorage(), nil
+	case "sharded":
+		// Tenants hash across three in-memory shards.
+		return storage.NewRoutedStorage(storage.NewInMemoryStorage(), nil, []storage.Storage{storage.NewInMemoryStorage(), storage.NewInMemoryStorage()}), nil
+	case "postgres":
+		return storage.NewPostgresStorage(storage.BuildDSN(cfg.Database), storage.PostgresOptionsFrom(cfg.Database))
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", name)
+	}
+}
+
+func openStore(cfg *config.Config, name string) (heimdalltest.RateLimitStore, error) {
+	switch name {
+	case "memory":
+		return middleware.NewMemoryStore(), nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Host + ":" + cfg.Redis.Port,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		})
+		return middleware.NewRedisStore(client), client.Ping(context.Background()).Err()
+	case "memcached":
+		store := middleware.NewMemcachedStore(cfg.Server.RateLimitStore.MemcachedAddr, 2*time.Second)
+		return store, store.Ping(context.Background())
+	case "dynamodb":
+		dynamo := cfg.Server.RateLimitStore.DynamoDB
+		store, err := middleware.NewDynamoDBStore(middleware.DynamoDBConfig{
+			Table:           dynamo.Table,
+			Region:          dynamo.Region,
+			Endpoint:        dynamo.Endpoint,
+			AccessKeyID:     dynamo.AccessKeyID,
+			SecretAccessKey: dynamo.SecretAccessKey,
+			SessionToken:    dynamo.SessionToken,
+		}, 2*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return store, store.Ping(context.Background())
+	default:
+		return nil, fmt.Errorf("unknown store %q", name)
+	}
+}
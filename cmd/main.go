@@ -1,67 +1,805 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/compress"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+	"github.com/redis/go-redis/v9"
 	"github.com/tajious/heimdall/internal/api/handlers"
 	"github.com/tajious/heimdall/internal/api/router"
+	"github.com/tajious/heimdall/internal/api/versioning"
+	"github.com/tajious/heimdall/internal/authn"
+	"github.com/tajious/heimdall/internal/authz"
+	"github.com/tajious/heimdall/internal/blob"
+	"github.com/tajious/heimdall/internal/breaker"
+	"github.com/tajious/heimdall/internal/chaos"
 	"github.com/tajious/heimdall/internal/config"
+	"github.com/tajious/heimdall/internal/coordination"
+	"github.com/tajious/heimdall/internal/digest"
+	"github.com/tajious/heimdall/internal/domains"
+	"github.com/tajious/heimdall/internal/events"
+	"github.com/tajious/heimdall/internal/exports"
+	"github.com/tajious/heimdall/internal/hooks"
+	"github.com/tajious/heimdall/internal/jobs"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/metrics"
 	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/notify"
+	"github.com/tajious/heimdall/internal/offboarding"
+	"github.com/tajious/heimdall/internal/passwords"
+	"github.com/tajious/heimdall/internal/plugins"
+	"github.com/tajious/heimdall/internal/redact"
+	"github.com/tajious/heimdall/internal/retention"
+	"github.com/tajious/heimdall/internal/retry"
+	"github.com/tajious/heimdall/internal/search"
 	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/vault"
+	"github.com/tajious/heimdall/internal/warmup"
 )
 
 func main() {
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		fail("Failed to load configuration", unavailable(err))
 	}
 
-	var store storage.Storage
-	if cfg.Server.Environment == "development" {
-		log.Println("Using in-memory storage for development")
-		store = storage.NewInMemoryStorage()
-	} else {
-		log.Println("Using PostgreSQL storage for production")
-		dsn := storage.BuildDSN(cfg.Database)
-		store, err = storage.NewPostgresStorage(dsn)
-		if err != nil {
-			log.Fatalf("Failed to initialize storage: %v", err)
+	args := os.Args[1:]
+	allowInsecure := false
+flags:
+	for len(args) > 0 {
+		switch args[0] {
+		case "--demo", "-demo":
+			cfg.Server.Environment = "demo"
+		case "--allow-insecure", "-allow-insecure":
+			allowInsecure = true
+		default:
+			break flags
+		}
+		args = args[1:]
+	}
+
+	// These commands prepare a configuration or drive another instance, so
+	// they run before it is checked and never touch storage.
+	if len(args) > 0 && (args[0] == "setup" || args[0] == "encrypt-value" || args[0] == "loadtest") {
+		run := runSetup
+		switch args[0] {
+		case "encrypt-value":
+			run = encryptValue
+		case "loadtest":
+			run = runLoadTest
+		}
+		if err := run(args[1:]); err != nil {
+			fail(args[0], err)
+		}
+		return
+	}
+
+	if cfg.JWT.Secret == "" && cfg.Server.InMemory() {
+		// Tokens die with the in-memory data anyway, so a random secret
+		// costs nothing and never ships a guessable default.
+		if cfg.JWT.Secret, err = keys.GenerateSecret(32); err != nil {
+			log.Fatalf("Failed to generate JWT secret: %v", err)
+		}
+		log.Println("JWT_SECRET is not set, signing tokens with a random secret until restart")
+	}
+
+	if cfg.JWT.Secret == "" {
+		log.Fatal("JWT_SECRET is required outside development, run `heimdall setup` to generate a config")
+	}
+
+	if problems := cfg.Insecure(); len(problems) > 0 {
+		if !allowInsecure {
+			log.Fatalf("Refusing to start with an insecure production configuration:\n  %s\nFix it or pass --allow-insecure", strings.Join(problems, "\n  "))
 		}
+		for _, problem := range problems {
+			log.Printf("WARNING: insecure configuration allowed: %s", problem)
+		}
+	}
+
+	// Commands run against the dependencies as they are.
+	var faults *chaos.Injector
+	if len(args) == 0 {
+		if faults, err = openChaos(cfg); err != nil {
+			log.Fatalf("Refusing to start: %v", err)
+		}
+	}
+
+	store, err := openStorage(cfg, faults)
+	if err != nil {
+		fail("Failed to initialize storage", unavailable(err))
+	}
+
+	secrets, err := openVault(store)
+	if err != nil {
+		fail("Failed to set up tenant encryption", unavailable(err))
+	}
+
+	// Commands index the users they write as well.
+	var userIndex search.UserIndex
+	if cfg.Search.OpenSearchURL != "" {
+		log.Println("Using OpenSearch for user search")
+		userIndex = search.NewOpenSearch(
+			cfg.Search.OpenSearchURL,
+			cfg.Search.OpenSearchIndex,
+			cfg.Search.OpenSearchUsername,
+			cfg.Search.OpenSearchPassword,
+		)
+		search.IndexWrites(store, userIndex)
+	}
+
+	if len(args) > 0 {
+		if err := runCommand(cfg, store, secrets, args[0], args[1:]); err != nil {
+			fail(args[0], err)
+		}
+		return
 	}
 
 	app := fiber.New(fiber.Config{
 		AppName: "Heimdall",
 	})
 
+	redactRoutes, err := redact.ParseRoutes(cfg.Server.Logging.RedactRoutes)
+	if err != nil {
+		log.Fatalf("Invalid LOG_REDACT_ROUTES: %v", err)
+	}
+	requestLogger := middleware.RequestLogger(cfg.Server.Logging.Level == "debug",
+		redact.New(cfg.Server.Logging.RedactFields, cfg.Server.Logging.MaskFields, redactRoutes))
+
 	app.Use(cors.New())
-	app.Use(logger.New())
+	app.Use(requestid.New(requestid.Config{ContextKey: storage.RequestIDKey{}}))
+	app.Use(requestLogger)
+	app.Use(compress.New())
+	if faults != nil {
+		app.Use(faults.Middleware())
+	}
+	app.Use(middleware.ClientCertificates(cfg.Server.ClientCertHeader))
+
+	adminApp := app
+	if cfg.Server.AdminPort != "" {
+		adminApp = fiber.New(fiber.Config{
+			AppName: "Heimdall Admin",
+		})
+		adminApp.Use(requestid.New(requestid.Config{ContextKey: storage.RequestIDKey{}}))
+		adminApp.Use(requestLogger)
+		adminApp.Use(compress.New())
+		if faults != nil {
+			adminApp.Use(faults.Middleware())
+		}
+	}
+
+	keyResolver, err := newKeyResolver(cfg, store, secrets)
+	if err != nil {
+		log.Fatalf("Failed to set up token signing: %v", err)
+	}
+
+	hasher := passwords.NewHasher(cfg.Server.PasswordWorkers, cfg.Server.PasswordQueueTimeout, metrics.Default)
+
+	// Startup work and background jobs act for every tenant.
+	ctx := storage.Unscoped(context.Background())
+
+	if cfg.Server.BootstrapFile != "" && cfg.Server.ReadOnly {
+		log.Println("Skipping bootstrap file on a read-only instance")
+	} else if cfg.Server.BootstrapFile != "" {
+		if err := applyBootstrap(ctx, store, hasher, secrets, cfg.Server.BootstrapFile, outputTable); err != nil {
+			log.Fatalf("Failed to apply bootstrap file: %v", err)
+		}
+	}
 
-	authHandler := handlers.NewAuthHandler(store, cfg.JWT.Secret, cfg.JWT.AccessExpiration)
-	tenantHandler := handlers.NewTenantHandler(store)
-	authMiddleware := middleware.NewAuthMiddleware(cfg.JWT.Secret)
-	rateLimiter := middleware.NewRateLimiter(middleware.NewMemoryStore(), true)
+	if cfg.Server.Environment == "demo" {
+		if err := seedDemo(ctx, store, hasher, secrets); err != nil {
+			log.Fatalf("Failed to seed demo data: %v", err)
+		}
+	}
+
+	if cfg.Server.PreloadTenants {
+		// A failed preload only leaves caches to fill on demand.
+		start := time.Now()
+		warmed, err := warmup.Tenants(ctx, store, keyResolver, cfg.Server.PreloadTop)
+		if err != nil {
+			log.Printf("Tenant preload stopped after %d tenants: %v", warmed, err)
+		} else {
+			log.Printf("Preloaded %d tenants in %s", warmed, time.Since(start).Round(time.Millisecond))
+		}
+	}
+
+	// Users written before the index was set up are indexed in the
+	// background, leaving search incomplete rather than delaying startup.
+	if userIndex != nil && !cfg.Server.ReadOnly {
+		go func() {
+			start := time.Now()
+			indexed, err := search.Backfill(ctx, store, userIndex)
+			if err != nil {
+				log.Printf("User index backfill stopped after %d users: %v", indexed, err)
+			} else if indexed > 0 {
+				log.Printf("Indexed %d users missing from the user index in %s", indexed, time.Since(start).Round(time.Millisecond))
+			}
+		}()
+	}
+
+	authzEngine := authz.NewEngine(store, cfg.Authz.DecisionCacheTTL, metrics.Default)
+
+	authenticators := authn.NewRegistry()
+	authenticators.Register(models.UsernamePassword, authn.NewPasswordAuthenticator(store, hasher))
+	authenticators.Register(models.Delegated, authn.NewDelegatedAuthenticator(authn.NewProvisioner(store, authzEngine), secrets))
+	authenticators.Register(models.ClientCertificate, authn.NewClientCertificateAuthenticator(store))
+
+	var breaches passwords.BreachChecker
+	if cfg.Server.PwnedPasswordsURL != "" {
+		breaches = passwords.NewPwnedPasswords(cfg.Server.PwnedPasswordsURL)
+	}
+
+	// In-process login plugins are registered here with loginHooks.Register;
+	// they run for every tenant before the tenant's own webhooks.
+	loginHooks := hooks.NewRegistry(cfg.Server.LoginHookTimeout, secrets)
+	var pluginRuntime *plugins.Runtime
+	if cfg.Server.WASMPlugins.Enabled {
+		pluginRuntime = plugins.NewRuntime(context.Background(), store, plugins.Limits{
+			MaxModuleSize: cfg.Server.WASMPlugins.MaxModuleSize,
+			MaxMemory:     cfg.Server.WASMPlugins.MaxMemory,
+		})
+		defer pluginRuntime.Close(context.Background())
+		loginHooks.RegisterTenantHooks(pluginRuntime)
+	}
+
+	redisClient, err := openRedis(cfg, faults)
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis: %v", err)
+	}
+	var consumedTokens middleware.ConsumedTokenStore = middleware.NewMemoryConsumedTokens()
+	if redisClient != nil {
+		consumedTokens = middleware.NewRedisConsumedTokens(redisClient)
+	} else if !cfg.Server.InMemory() {
+		log.Println("Redis is not used, one-time tokens and signed requests can be replayed once against each instance")
+	}
+	oneTimeTokens := middleware.NewOneTimeTokens(store, consumedTokens)
+
+	eventBroker := events.NewBroker()
+	if redisClient != nil {
+		relay := events.NewRedisRelay(redisClient, eventsChannel)
+		eventBroker.UseRelay(relay)
+		go relay.Listen(context.Background(), eventBroker)
+	} else if !cfg.Server.InMemory() {
+		log.Println("Redis is not used, live event streams only carry the events of the instance serving them")
+	}
+
+	blobs, err := openBlobStore(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open the blob store: %v", err)
+	}
+
+	authHandler := handlers.NewAuthHandler(store, keyResolver, oneTimeTokens, hasher, breaches, authenticators, loginHooks, userIndex, eventBroker, cfg.JWT.AccessExpiration)
+	tenantHandler := handlers.NewTenantHandler(store, secrets, keyResolver)
+	environmentHandler := handlers.NewEnvironmentHandler(store, secrets)
+	policyHandler := handlers.NewPolicyHandler(store)
+	accessPolicyHandler := handlers.NewAccessPolicyHandler(store, authzEngine)
+	signedRequests := middleware.NewSignedRequests(store, secrets, consumedTokens, cfg.Server.SignatureWindow)
+	authMiddleware := middleware.NewAuthMiddleware(keyResolver, signedRequests)
+	authorizer := middleware.NewAuthorizer(authzEngine)
+	auditHandler := handlers.NewAuditHandler(store)
+	auditor := middleware.NewAuditor(store, eventBroker)
+	tenantResolver := middleware.NewTenantResolver(store, cfg.Server.TenantBaseDomain)
+	rateLimitStore, err := openRateLimitStore(cfg, redisClient)
+	if err != nil {
+		log.Fatalf("Failed to initialize rate limit store: %v", err)
+	}
+	degradation := cfg.Server.Degradation
+	databaseBreaker := breaker.New("database", "token validation answers from the last copy of each tenant, other requests fail",
+		degradation.FailureThreshold, degradation.Cooldown, metrics.Default)
+	authHandler.DegradeWith(databaseBreaker)
+	var rateLimitBreaker *breaker.Breaker
+	if !cfg.Server.InMemory() {
+		rateLimitBreaker = breaker.New(cfg.Server.RateLimitStore.Backend, "rate limits are counted in memory, per instance",
+			degradation.FailureThreshold, degradation.Cooldown, metrics.Default)
+		rateLimitStore = middleware.NewFallbackStore(rateLimitStore, rateLimitBreaker, metrics.Default)
+	}
+	var publisher coordination.Publisher = coordination.Local{}
+	if redisClient != nil {
+		publisher = coordination.NewRedisBus(redisClient, operatorChannel)
+	} else if !cfg.Server.InMemory() {
+		log.Println("Redis is not used, kill switch and maintenance mode changes stay on the instance that receives them")
+	}
+	penaltyMode, err := middleware.ParsePenaltyMode(cfg.Server.AbusePenalty.Mode)
+	if err != nil {
+		log.Fatalf("Invalid ABUSE_PENALTY_MODE: %v", err)
+	}
+	rateLimiter := middleware.NewRateLimiter(rateLimitStore, true, middleware.AbusePenaltyConfig{
+		Mode:         penaltyMode,
+		Strikes:      cfg.Server.AbusePenalty.Strikes,
+		StrikeWindow: cfg.Server.AbusePenalty.StrikeWindow,
+		TTL:          cfg.Server.AbusePenalty.TTL,
+		TarpitDelay:  cfg.Server.AbusePenalty.TarpitDelay,
+	})
+	rateLimitHandler := handlers.NewRateLimitHandler(rateLimitStore, rateLimiter)
+	healthHandler := handlers.NewHealthHandler(store)
+	healthHandler.Watch(databaseBreaker, rateLimitBreaker)
+	diagnosticsHandler := handlers.NewDiagnosticsHandler(store, rateLimitStore)
+
+	killSwitches := middleware.NewKillSwitches()
+	engaged, err := middleware.ParseKillSwitches(cfg.Server.KillSwitches)
+	if err != nil {
+		log.Fatalf("Invalid KILL_SWITCHES: %v", err)
+	}
+	for _, sw := range engaged {
+		killSwitches.Engage(sw.Name, sw.Reason)
+		log.Printf("Kill switch %s engaged at startup", sw.Name)
+	}
+	killSwitchHandler := handlers.NewKillSwitchHandler(killSwitches, publisher)
+
+	maintenance := middleware.NewMaintenance()
+	switch {
+	case cfg.Server.ReadOnly:
+		maintenance.EnableReadOnly()
+		log.Println("Starting as a read-only instance")
+	case cfg.Server.MaintenanceMode:
+		maintenance.Enable("")
+		log.Println("Starting in maintenance mode")
+	}
+	maintenanceHandler := handlers.NewMaintenanceHandler(maintenance, publisher)
+
+	if cfg.Archive.Passphrase != "" && len(cfg.Archive.Passphrase) < minPassphraseLength {
+		log.Fatalf("TENANT_ARCHIVE_PASSPHRASE must be at least %d characters", minPassphraseLength)
+	}
+	offboarder := offboarding.NewOffboarder(store, secrets, blobs, cfg.Archive.Passphrase, cfg.Retention.TenantArchives)
+	offboardingHandler := handlers.NewOffboardingHandler(offboarder)
+	exportRunner := exports.NewRunner(store, blobs)
+	exportHandler := handlers.NewExportHandler(store, blobs, userIndex, cfg.Server.ExportURLTTL)
+	jobHandler := handlers.NewJobHandler(store, blobs, cfg.Server.ExportURLTTL)
+	pluginHandler := handlers.NewPluginHandler(store, pluginRuntime)
+	domainHandler := handlers.NewDomainHandler(store, domains.NewVerifier(nil))
+	signingKeyHandler := handlers.NewSigningKeyHandler(store, secrets)
+
+	if bus, ok := publisher.(*coordination.RedisBus); ok {
+		go bus.Listen(context.Background(), func(event coordination.Event) {
+			applyOperatorEvent(event, killSwitches, maintenance)
+		})
+	}
+
+	priorities, err := middleware.ParsePriorities(cfg.Server.LoadShedding.Priorities)
+	if err != nil {
+		log.Fatalf("Invalid LOAD_SHED_PRIORITIES: %v", err)
+	}
+	loadShedder := middleware.NewLoadShedder(middleware.LoadSheddingConfig{
+		Enabled:        cfg.Server.LoadShedding.Enabled,
+		MinConcurrency: cfg.Server.LoadShedding.MinConcurrency,
+		MaxConcurrency: cfg.Server.LoadShedding.MaxConcurrency,
+		TargetLatency:  cfg.Server.LoadShedding.TargetLatency,
+		Priorities:     priorities,
+	}, metrics.Default)
+
+	retentionManager := retention.NewManager(metrics.Default)
+	// Redis expires rate limit counters on its own.
+	if purger, ok := rateLimitStore.(retention.Purger); ok {
+		retentionManager.Register(retention.DataRateLimits, cfg.Retention.RateLimits, purger)
+	}
+	retentionManager.Register(retention.DataAuditLogs, cfg.Retention.AuditLogs, retention.PurgerFunc(store.PurgeAuditLogs))
+	// Redis expires consumed one-time tokens on its own.
+	if purger, ok := consumedTokens.(retention.Purger); ok {
+		retentionManager.Register(retention.DataOneTimeTokens, cfg.Retention.OneTimeTokens, purger)
+	}
+	retentionManager.Register(retention.DataDeviceAuthorizations, cfg.Retention.OneTimeTokens, retention.PurgerFunc(store.PurgeDeviceAuthorizations))
+	retentionManager.Register(retention.DataSessions, cfg.Retention.Sessions, retention.PurgerFunc(store.PurgeSSOSessions))
+	retentionManager.Register(retention.DataJobs, cfg.Retention.Jobs, retention.PurgerFunc(store.PurgeJobs))
+	if blobs != nil {
+		retentionManager.Register(retention.DataTenantArchives, cfg.Retention.TenantArchives, offboarder)
+		retentionManager.Register(retention.DataExports, cfg.Retention.Jobs, exportRunner)
+	}
+
+	scheduler := jobs.NewScheduler()
+	scheduler.Register("database-probe", degradation.ProbeInterval, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, degradation.ProbeInterval)
+		defer cancel()
+		databaseBreaker.Record(store.Ping(ctx))
+		return nil
+	})
+	// Purging is left to the primary, whose deletes reach the replica.
+	if !cfg.Server.ReadOnly {
+		scheduler.Register("retention", cfg.Retention.Interval, retentionManager.Run)
+		scheduler.Register("reencrypt", cfg.Server.ReencryptInterval, secrets.ReencryptRetired)
+		scheduler.Register("digests", cfg.Server.DigestInterval, digest.NewSender(store, newNotifier(cfg)).Run)
+		if blobs != nil {
+			scheduler.Register("exports", cfg.Server.ExportInterval, exportRunner.Run)
+		}
+	}
+	scheduler.Start(ctx)
+	defer scheduler.Stop()
 
 	apiRouter := router.NewRouter(
 		app,
+		adminApp,
 		authHandler,
 		tenantHandler,
+		environmentHandler,
+		policyHandler,
+		accessPolicyHandler,
+		auditHandler,
+		rateLimitHandler,
+		healthHandler,
+		diagnosticsHandler,
+		killSwitchHandler,
+		maintenanceHandler,
+		offboardingHandler,
+		exportHandler,
+		jobHandler,
+		pluginHandler,
+		domainHandler,
+		signingKeyHandler,
+		handlers.NewEventHandler(eventBroker),
+		handlers.NewClientHandler(store, secrets, keyResolver),
 		authMiddleware,
+		auditor,
+		authorizer,
+		tenantResolver,
 		rateLimiter,
+		loadShedder,
+		killSwitches,
+		maintenance,
+		middleware.NewLoginLatency(cfg.Server.SlowLoginThreshold, metrics.Default),
+		cfg.Server.OperatorToken,
+		apiVersions(cfg),
 	)
 
-	apiRouter.SetupRoutes()
+	if err := apiRouter.SetupRoutes(); err != nil {
+		log.Fatalf("Failed to set up routes: %v", err)
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3000"
 	}
 
+	if adminApp != app {
+		go func() {
+			log.Printf("Admin server starting on port %s", cfg.Server.AdminPort)
+			if err := adminApp.Listen(":" + cfg.Server.AdminPort); err != nil {
+				log.Fatalf("Failed to start admin server: %v", err)
+			}
+		}()
+	}
+
+	if cfg.Server.TLSCertFile != "" && cfg.Server.TLSKeyFile != "" {
+		ln, err := listenTLS(":"+port, cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+		log.Printf("Server starting on port %s with TLS", port)
+		if err := app.Listener(ln); err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+		return
+	}
+
 	log.Printf("Server starting on port %s", port)
 	if err := app.Listen(":" + port); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// listenTLS asks for, but does not require, a client certificate: only
+// tenants using client certificate authentication verify one, against their
+// own CAs.
+func listenTLS(addr, certFile, keyFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequestClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}), nil
+}
+
+// newKeyResolver signs tokens with the algorithm JWT_ALGORITHM names.
+func newKeyResolver(cfg *config.Config, store storage.Storage, secrets *vault.Vault) (*keys.Resolver, error) {
+	resolver := keys.NewResolver(cfg.JWT.Secret, store, secrets, cfg.JWT.KeyCacheTTL, metrics.Default)
+	resolver.SetLeeway(cfg.JWT.ClockSkew)
+	resolver.SetLegacySecretCutoff(cfg.JWT.LegacySecretCutoff)
+	switch cfg.JWT.Algorithm {
+	case "HS256":
+		return resolver, nil
+	case keys.AlgorithmEdDSA:
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALGORITHM %q, use HS256 or EdDSA", cfg.JWT.Algorithm)
+	}
+
+	var key ed25519.PrivateKey
+	var err error
+	switch {
+	case cfg.JWT.Ed25519KeyFile != "":
+		key, err = keys.LoadEd25519PrivateKey(cfg.JWT.Ed25519KeyFile)
+	case cfg.Server.InMemory():
+		log.Println("JWT_ED25519_KEY_FILE is not set, signing tokens with a random Ed25519 key until restart")
+		key, err = keys.GenerateEd25519PrivateKey()
+	default:
+		return nil, errors.New("JWT_ALGORITHM=EdDSA requires JWT_ED25519_KEY_FILE")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Ed25519 key: %w", err)
+	}
+	resolver.UseEd25519(key)
+	return resolver, nil
+}
+
+// openStorage connects to the databases, injecting faults into their calls
+// unless faults is nil.
+func openStorage(cfg *config.Config, faults *chaos.Injector) (storage.Storage, error) {
+	if cfg.Server.InMemory() {
+		// In-memory users, tenants, and rate limit counters are private to
+		// each replica, so refuse to run where replicas are the norm.
+		if orchestrator := coordination.DetectOrchestrator(); orchestrator != "" && !cfg.Server.AllowInMemoryReplicas {
+			return nil, fmt.Errorf("in-memory storage is unsafe under %s, where replicas would diverge; set ENVIRONMENT=production or ALLOW_IN_MEMORY_REPLICAS=true for a single replica", orchestrator)
+		}
+		log.Printf("Using in-memory storage for %s", cfg.Server.Environment)
+		return storage.NewInMemoryStorage(), nil
+	}
+
+	log.Println("Using PostgreSQL storage for production")
+	opts := storage.PostgresOptionsFrom(cfg.Database)
+	if opts.RowLevelSecurity {
+		log.Println("Enforcing tenant isolation with PostgreSQL row level security")
+	}
+	store, err := openPostgres(cfg, "PostgreSQL", storage.BuildDSN(cfg.Database), opts, faults)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Database.Regions) == 0 && len(cfg.Database.Shards) == 0 {
+		return store, nil
+	}
+
+	regions := make(map[string]storage.Storage, len(cfg.Database.Regions))
+	for name, dsn := range cfg.Database.Regions {
+		log.Printf("Keeping the data of tenants in region %s in its own database", name)
+		region, err := openPostgres(cfg, "PostgreSQL region "+name, dsn, opts, faults)
+		if err != nil {
+			return nil, err
+		}
+		regions[name] = region
+	}
+	shards := make([]storage.Storage, len(cfg.Database.Shards))
+	for i, dsn := range cfg.Database.Shards {
+		shard, err := openPostgres(cfg, fmt.Sprintf("PostgreSQL shard %d", i+1), dsn, opts, faults)
+		if err != nil {
+			return nil, err
+		}
+		shards[i] = shard
+	}
+	if len(shards) > 0 {
+		log.Printf("Spreading tenants over %d database shards", len(shards)+1)
+	}
+	return storage.NewRoutedStorage(store, regions, shards), nil
+}
+
+func openPostgres(cfg *config.Config, name, dsn string, opts storage.PostgresOptions, faults *chaos.Injector) (*storage.PostgresStorage, error) {
+	var store *storage.PostgresStorage
+	err := retry.Do(context.Background(), name, cfg.Server.StartupMaxWait, func(ctx context.Context) error {
+		var err error
+		if cfg.Server.ReadOnly {
+			store, err = storage.NewPostgresReplicaStorage(dsn, opts)
+		} else {
+			store, err = storage.NewPostgresStorage(dsn, opts)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Use(storage.NewDataChanges(cfg.Server.Logging.RedactFields, cfg.Server.Logging.MaskFields)); err != nil {
+		return nil, err
+	}
+	if cfg.Database.SlowQueryThreshold > 0 {
+		if err := store.Use(storage.NewSlowQueries(cfg.Database.SlowQueryThreshold, metrics.Default)); err != nil {
+			return nil, err
+		}
+	}
+	// Faults are injected once the schema is migrated, so startup is not
+	// rehearsing anything.
+	if faults != nil && faults.Targets(chaos.TargetStorage) {
+		if err := store.Use(faults.GORMPlugin()); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// openChaos returns the fault injector of chaos mode, nil unless it is
+// enabled. It refuses to run in production.
+func openChaos(cfg *config.Config) (*chaos.Injector, error) {
+	settings := cfg.Server.Chaos
+	if !settings.Enabled {
+		return nil, nil
+	}
+	if cfg.Server.Environment == "production" {
+		return nil, errors.New("CHAOS_ENABLED is set in production")
+	}
+
+	scope := "every request and background job"
+	if settings.OptIn {
+		scope = "requests sending " + chaos.Header
+	}
+	log.Printf("WARNING: chaos mode injects faults into %s calls of %s: %.1f%% errors, %s latency on %.1f%%",
+		strings.Join(settings.Targets, " and "), scope, settings.ErrorPercent, settings.Latency, settings.LatencyPercent)
+	return chaos.New(chaos.Config{
+		Targets:        settings.Targets,
+		ErrorPercent:   settings.ErrorPercent,
+		Latency:        settings.Latency,
+		LatencyPercent: settings.LatencyPercent,
+		OptIn:          settings.OptIn,
+	}, metrics.Default), nil
+}
+
+// openVault seals tenant secrets with per-tenant data keys wrapped by the
+// configuration master key. Without a master key secrets are stored as given.
+func openVault(store storage.Storage) (*vault.Vault, error) {
+	masterKey, err := config.LoadMasterKey()
+	if errors.Is(err, config.ErrNoMasterKey) {
+		log.Println("No master key is configured, tenant secrets are stored unencrypted")
+		return vault.New(store, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return vault.New(store, masterKey)
+}
+
+// openRateLimitStore picks the rate limit store RATE_LIMIT_STORE names,
+// waiting for it like it waits for Postgres and Redis.
+// newNotifier emails notifications through the configured mail server, or
+// logs them when there is none.
+func newNotifier(cfg *config.Config) notify.Notifier {
+	if cfg.SMTP.Host == "" {
+		return notify.Log{}
+	}
+	return notify.NewSMTP(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.From)
+}
+
+func openRateLimitStore(cfg *config.Config, redisClient *redis.Client) (middleware.RateLimitStore, error) {
+	if cfg.Server.InMemory() {
+		return middleware.NewMemoryStore(), nil
+	}
+
+	var store interface {
+		middleware.RateLimitStore
+		Ping(ctx context.Context) error
+	}
+	switch backend := cfg.Server.RateLimitStore.Backend; backend {
+	case "redis":
+		return middleware.NewRedisStore(redisClient), nil
+	case "memcached":
+		store = middleware.NewMemcachedStore(cfg.Server.RateLimitStore.MemcachedAddr, rateLimitStoreTimeout)
+	case "dynamodb":
+		dynamo := cfg.Server.RateLimitStore.DynamoDB
+		var err error
+		store, err = middleware.NewDynamoDBStore(middleware.DynamoDBConfig{
+			Table:           dynamo.Table,
+			Region:          dynamo.Region,
+			Endpoint:        dynamo.Endpoint,
+			AccessKeyID:     dynamo.AccessKeyID,
+			SecretAccessKey: dynamo.SecretAccessKey,
+			SessionToken:    dynamo.SessionToken,
+		}, rateLimitStoreTimeout)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_STORE %q", backend)
+	}
+
+	log.Printf("Using %s for rate limit counters", cfg.Server.RateLimitStore.Backend)
+	err := retry.Do(context.Background(), cfg.Server.RateLimitStore.Backend, cfg.Server.StartupMaxWait, store.Ping)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// rateLimitStoreTimeout bounds a single call to memcached or DynamoDB, so a
+// slow store cannot hold up every request.
+const rateLimitStoreTimeout = 2 * time.Second
+
+// openBlobStore opens the blob store BLOB_STORE names for exports, tenant
+// archives, and staged imports, nil when there is none.
+func openBlobStore(cfg *config.Config) (blob.Store, error) {
+	store, err := blob.Open(blob.Config{
+		Driver:          cfg.Blob.Driver,
+		Dir:             cfg.Blob.Dir,
+		Prefix:          cfg.Blob.Prefix,
+		Bucket:          cfg.Blob.Bucket,
+		Region:          cfg.Blob.Region,
+		Endpoint:        cfg.Blob.Endpoint,
+		AccessKeyID:     cfg.Blob.AccessKeyID,
+		SecretAccessKey: cfg.Blob.SecretAccessKey,
+		SessionToken:    cfg.Blob.SessionToken,
+	}, blobStoreTimeout)
+	if store != nil {
+		log.Printf("Using %s for blobs", cfg.Blob.Driver)
+	}
+	return store, err
+}
+
+// blobStoreTimeout bounds a single call to the blob store.
+const blobStoreTimeout = time.Minute
+
+// operatorChannel is the Redis pub/sub channel that carries kill switch and
+// maintenance mode changes between instances.
+const operatorChannel = "heimdall:operator"
+
+// eventsChannel is the Redis pub/sub channel that carries security events
+// between instances for live event streams.
+const eventsChannel = "heimdall:events"
+
+// openRedis connects to Redis unless all state is kept in memory or rate
+// limit counters live elsewhere, in which case it returns nil.
+func openRedis(cfg *config.Config, faults *chaos.Injector) (*redis.Client, error) {
+	if cfg.Server.InMemory() || cfg.Server.RateLimitStore.Backend != "redis" {
+		return nil, nil
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Host + ":" + cfg.Redis.Port,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	})
+	err := retry.Do(context.Background(), "Redis", cfg.Server.StartupMaxWait, func(ctx context.Context) error {
+		return client.Ping(ctx).Err()
+	})
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	if faults != nil && faults.Targets(chaos.TargetRedis) {
+		client.AddHook(faults.RedisHook())
+	}
+	return client, nil
+}
+
+// applyOperatorEvent mirrors an operator change made on another instance.
+func applyOperatorEvent(event coordination.Event, killSwitches *middleware.KillSwitches, maintenance *middleware.Maintenance) {
+	switch event.Type {
+	case coordination.EventKillSwitch:
+		if !event.Active {
+			killSwitches.Release(event.Name)
+		} else if _, err := killSwitches.Engage(event.Name, event.Reason); err != nil {
+			log.Printf("coordination: %v", err)
+			return
+		}
+	case coordination.EventMaintenance:
+		if event.Active {
+			maintenance.Enable(event.Reason)
+		} else {
+			maintenance.Disable()
+		}
+	default:
+		return
+	}
+	log.Printf("coordination: applied %s change from instance %s", event.Type, event.Origin)
+}
+
+// apiVersions lists the published API versions, oldest first.
+func apiVersions(cfg *config.Config) []versioning.Version {
+	v1 := versioning.Version{Name: "v1", Successor: "v2"}
+	var err error
+	if v1.DeprecatedAt, err = versioning.ParseDate(cfg.Server.APIV1DeprecatedAt); err != nil {
+		log.Fatalf("Invalid API_V1_DEPRECATED_AT: %v", err)
+	}
+	if v1.SunsetAt, err = versioning.ParseDate(cfg.Server.APIV1SunsetAt); err != nil {
+		log.Fatalf("Invalid API_V1_SUNSET_AT: %v", err)
+	}
+	return []versioning.Version{v1, {Name: "v2"}}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/tajious/heimdall/internal/storage"
+	"gopkg.in/yaml.v3"
+)
+
+// Exit codes of the commands. Scripts rely on them, so they never change
+// meaning.
+const (
+	exitOK          = 0
+	exitFailure     = 1 // anything not listed below
+	exitUsage       = 2 // unknown command, bad flags, or missing arguments
+	exitNotFound    = 3 // the tenant, environment, or user does not exist
+	exitCheckFailed = 4 // a check ran and failed, such as a broken audit chain
+	exitUnavailable = 5 // configuration, storage, or encryption could not be set up
+)
+
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &exitError{code: exitUsage, err: fmt.Errorf(format, args...)}
+}
+
+func checkFailedf(format string, args ...interface{}) error {
+	return &exitError{code: exitCheckFailed, err: fmt.Errorf(format, args...)}
+}
+
+func unavailable(err error) error {
+	return &exitError{code: exitUnavailable, err: err}
+}
+
+func exitCode(err error) int {
+	var exit *exitError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &exit):
+		return exit.code
+	case errors.Is(err, storage.ErrTenantNotFound), errors.Is(err, storage.ErrEnvironmentNotFound), errors.Is(err, storage.ErrUserNotFound):
+		return exitNotFound
+	default:
+		return exitFailure
+	}
+}
+
+// fail logs err and exits with its code. A -h flag already printed the
+// usage, so it exits quietly.
+func fail(prefix string, err error) {
+	if !errors.Is(err, flag.ErrHelp) {
+		log.Printf("%s: %v", prefix, err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// parseFlags parses args, reporting bad flags as usage errors.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &exitError{code: exitUsage, err: err}
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf("unexpected argument %q", fs.Arg(0))
+	}
+	return nil
+}
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// outputFormat is the format a command prints its result in. Progress is
+// logged to stderr in every format, so stdout only ever carries the result.
+type outputFormat string
+
+func (f *outputFormat) String() string {
+	return string(*f)
+}
+
+func (f *outputFormat) Set(value string) error {
+	switch value {
+	case outputTable, outputJSON, outputYAML:
+		*f = outputFormat(value)
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q, want table, json, or yaml", value)
+	}
+}
+
+func outputFlag(fs *flag.FlagSet) *outputFormat {
+	format := outputFormat(outputTable)
+	fs.Var(&format, "output", "result format: table, json, or yaml")
+	fs.Var(&format, "o", "shorthand for -output")
+	return &format
+}
+
+// render prints result to w, through table for the table format.
+func (f outputFormat) render(w io.Writer, result interface{}, table func(w io.Writer) error) error {
+	switch f {
+	case outputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	case outputYAML:
+		data, err := yaml.Marshal(result)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	default:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		if err := table(tw); err != nil {
+			return err
+		}
+		return tw.Flush()
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/tajious/heimdall/internal/bootstrap"
+	"github.com/tajious/heimdall/internal/config"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/metrics"
+	"github.com/tajious/heimdall/internal/passwords"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+	"gopkg.in/yaml.v3"
+)
+
+// minAdminPasswordLength is stricter than bootstrap files require: the
+// wizard creates the first admin of a fresh installation.
+const minAdminPasswordLength = 12
+
+type setting struct {
+	name  string
+	value string
+}
+
+// runSetup is the first-run wizard. It writes a config file with freshly
+// generated secrets and a bootstrap file declaring the first tenant and its
+// admin, then migrates the database and applies the bootstrap file right
+// away outside development.
+func runSetup(args []string) error {
+	fs := flag.NewFlagSet("setup", flag.ContinueOnError)
+	out := fs.String("out", ".env", "config file to write")
+	bootstrapOut := fs.String("bootstrap", "heimdall.bootstrap.yaml", "bootstrap file to write")
+	force := fs.Bool("force", false, "overwrite existing files")
+	nonInteractive := fs.Bool("non-interactive", false, "take every answer from its environment variable or default instead of prompting")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if !*force {
+		for _, path := range []string{*out, *bootstrapOut} {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists, pass -force to overwrite it", path)
+			}
+		}
+	}
+
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout, nonInteractive: *nonInteractive}
+
+	environment := p.ask("ENVIRONMENT", "Environment (development, production)", "production")
+	if environment != "development" && environment != "production" {
+		return usageErrorf("unknown environment %q", environment)
+	}
+
+	jwtSecret, err := keys.GenerateSecret(32)
+	if err != nil {
+		return err
+	}
+	operatorToken, err := keys.GenerateSecret(24)
+	if err != nil {
+		return err
+	}
+	settings := []setting{
+		{"ENVIRONMENT", environment},
+		{"PORT", p.ask("PORT", "Port", "8080")},
+		{"JWT_SECRET", jwtSecret},
+		{"OPERATOR_TOKEN", operatorToken},
+		{"BOOTSTRAP_FILE", *bootstrapOut},
+	}
+	if environment == "production" {
+		settings = append(settings,
+			setting{"DB_HOST", p.ask("DB_HOST", "PostgreSQL host", "localhost")},
+			setting{"DB_PORT", p.ask("DB_PORT", "PostgreSQL port", "5432")},
+			setting{"DB_USER", p.ask("DB_USER", "PostgreSQL user", "heimdall")},
+			setting{"DB_PASSWORD", p.ask("DB_PASSWORD", "PostgreSQL password", "")},
+			setting{"DB_NAME", p.ask("DB_NAME", "PostgreSQL database", "heimdall")},
+			setting{"DB_SSL_MODE", p.ask("DB_SSL_MODE", "PostgreSQL SSL mode", "require")},
+			setting{"REDIS_HOST", p.ask("REDIS_HOST", "Redis host", "localhost")},
+			setting{"REDIS_PORT", p.ask("REDIS_PORT", "Redis port", "6379")},
+			setting{"REDIS_PASSWORD", p.ask("REDIS_PASSWORD", "Redis password", "")},
+		)
+	}
+
+	tenant := bootstrap.Tenant{
+		ID:   p.ask("SETUP_TENANT_ID", "First tenant ID", "system"),
+		Name: p.ask("SETUP_TENANT_NAME", "First tenant name", "System"),
+	}
+	admin := bootstrap.Admin{Username: p.ask("SETUP_ADMIN_USERNAME", "Admin username", "admin")}
+	password := p.ask("SETUP_ADMIN_PASSWORD", "Admin password", "")
+	if len(password) < minAdminPasswordLength {
+		return usageErrorf("the admin password must be at least %d characters", minAdminPasswordLength)
+	}
+	if admin.PasswordHash, err = passwords.NewHasher(0, 0, metrics.Default).Hash(context.Background(), password); err != nil {
+		return err
+	}
+	tenant.Admins = []bootstrap.Admin{admin}
+	file := &bootstrap.File{Tenants: []bootstrap.Tenant{tenant}}
+	if err := validation.ValidateStruct(file); err != nil {
+		return err
+	}
+
+	// The bootstrap file holds the admin's password hash rather than the
+	// password, so it can be kept next to the config.
+	data, err := yaml.Marshal(file)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*bootstrapOut, data, 0o600); err != nil {
+		return err
+	}
+	if err := writeSettings(*out, settings); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s and %s\n", *out, *bootstrapOut)
+
+	if environment == "development" {
+		fmt.Println("Development keeps its data in memory; the admin is created every time the server starts.")
+		return nil
+	}
+
+	for _, s := range settings {
+		os.Setenv(s.name, s.value)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	store, err := openStorage(cfg, nil)
+	if err != nil {
+		return fmt.Errorf("migrate database: %w", err)
+	}
+	secrets, err := openVault(store)
+	if err != nil {
+		return err
+	}
+	if err := applyBootstrap(storage.Unscoped(context.Background()), store, passwords.NewHasher(0, 0, metrics.Default), secrets, *bootstrapOut, outputTable); err != nil {
+		return err
+	}
+	log.Printf("Setup complete, sign in to tenant %s as %s", tenant.ID, admin.Username)
+	return nil
+}
+
+func writeSettings(path string, settings []setting) error {
+	var b strings.Builder
+	b.WriteString("# Written by heimdall setup. Keep this file secret.\n")
+	for _, s := range settings {
+		fmt.Fprintf(&b, "%s=%s\n", s.name, quoteSetting(s.value))
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o600)
+}
+
+// quoteSetting quotes values a .env parser would otherwise split or expand.
+func quoteSetting(value string) string {
+	if !strings.ContainsAny(value, " #\"'$\\") {
+		return value
+	}
+	if !strings.Contains(value, "'") {
+		return "'" + value + "'"
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`).Replace(value) + `"`
+}
+
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	// nonInteractive takes the answers from the environment, for scripts
+	// and CI where nobody is there to type them.
+	nonInteractive bool
+}
+
+// ask prompts for a value, returning fallback for an empty answer. Without
+// -non-interactive the value of the environment variable name is the answer.
+func (p *prompter) ask(name, question, fallback string) string {
+	if p.nonInteractive {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+		return fallback
+	}
+	if fallback != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, fallback)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	answer, err := p.in.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fallback
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return fallback
+	}
+	return answer
+}
@@ -0,0 +1,29 @@
+package admin
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/filesystem"
+)
+
+//go:embed static
+var assets embed.FS
+
+// Handler serves the embedded admin single-page app. Unknown paths fall back
+// to index.html so client-side routes survive a reload.
+func Handler() fiber.Handler {
+	root, err := fs.Sub(assets, "static")
+	if err != nil {
+		panic(err)
+	}
+
+	return filesystem.New(filesystem.Config{
+		Root:         http.FS(root),
+		Index:        "index.html",
+		NotFoundFile: "index.html",
+		MaxAge:       300,
+	})
+}
@@ -0,0 +1,291 @@
+'use strict';
+
+const api = '/api/v1';
+const sections = ['login', 'tenants', 'users', 'audit', 'rate-limits'];
+const state = {
+  token: sessionStorage.getItem('heimdall.token'),
+  tenantId: sessionStorage.getItem('heimdall.tenant'),
+  tenantPage: 1,
+  userPage: 1,
+  auditPage: 1,
+  editingUser: null,
+};
+
+const $ = (selector) => document.querySelector(selector);
+
+function showError(message) {
+  const el = $('#error');
+  el.textContent = message || '';
+  el.hidden = !message;
+}
+
+async function request(method, path, body) {
+  const headers = { 'Content-Type': 'application/json' };
+  if (state.token) {
+    headers.Authorization = 'Bearer ' + state.token;
+  }
+  const response = await fetch(api + path, {
+    method,
+    headers,
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  if (response.status === 401 && state.token) {
+    logout();
+  }
+  if (response.status === 204) {
+    return null;
+  }
+  const data = await response.json().catch(() => ({}));
+  if (!response.ok) {
+    throw new Error(data.error || response.statusText);
+  }
+  return data;
+}
+
+function formValues(form) {
+  return Object.fromEntries(new FormData(form).entries());
+}
+
+function cell(row, value) {
+  const td = document.createElement('td');
+  td.textContent = value === undefined || value === null ? '' : value;
+  row.appendChild(td);
+  return td;
+}
+
+function actionCell(row, label, handler) {
+  const td = document.createElement('td');
+  const button = document.createElement('button');
+  button.type = 'button';
+  button.className = 'link';
+  button.textContent = label;
+  button.addEventListener('click', handler);
+  td.appendChild(button);
+  row.appendChild(td);
+}
+
+function renderPager(el, page, totalPages, onChange) {
+  el.replaceChildren();
+  if (page > 1) {
+    const prev = document.createElement('button');
+    prev.type = 'button';
+    prev.textContent = 'Previous';
+    prev.addEventListener('click', () => onChange(page - 1));
+    el.appendChild(prev);
+  }
+  const label = document.createElement('span');
+  label.textContent = `Page ${page} of ${Math.max(totalPages, 1)}`;
+  el.appendChild(label);
+  if (page < totalPages) {
+    const next = document.createElement('button');
+    next.type = 'button';
+    next.textContent = 'Next';
+    next.addEventListener('click', () => onChange(page + 1));
+    el.appendChild(next);
+  }
+}
+
+function formatTime(value) {
+  return value && !value.startsWith('0001') ? new Date(value).toLocaleString() : '';
+}
+
+// Tenants
+
+async function loadTenants(page = state.tenantPage) {
+  state.tenantPage = page;
+  const data = await request('GET', `/tenants?page=${page}&page_size=20`);
+  const body = $('#tenant-table tbody');
+  body.replaceChildren();
+  for (const tenant of data.tenants) {
+    const row = document.createElement('tr');
+    cell(row, tenant.id);
+    cell(row, tenant.name);
+    cell(row, tenant.status);
+    cell(row, tenant.config && tenant.config.auth_method);
+    actionCell(row, 'Configure', () => editConfig(tenant.id));
+    body.appendChild(row);
+  }
+  renderPager($('#tenant-pager'), data.page, data.total_pages, loadTenants);
+}
+
+async function editConfig(tenantId) {
+  const tenant = await request('GET', `/tenants/${encodeURIComponent(tenantId)}`);
+  const config = tenant.config || {};
+  const editable = {
+    auth_method: config.auth_method,
+    jwt_duration: config.jwt_duration,
+    rate_limit_ip: config.rate_limit_ip,
+    rate_limit_user: config.rate_limit_user,
+    rate_limit_window: config.rate_limit_window,
+    attribute_schema: config.attribute_schema || [],
+    provisioning: config.provisioning,
+    mapping_rules: config.mapping_rules || [],
+  };
+  $('#config-tenant').textContent = tenant.name;
+  $('#config-form').dataset.tenant = tenant.id;
+  $('#config-form').elements.config.value = JSON.stringify(editable, null, 2);
+  $('#tenant-config').hidden = false;
+}
+
+async function saveConfig(event) {
+  event.preventDefault();
+  const form = event.target;
+  const config = JSON.parse(form.elements.config.value);
+  await request('PUT', `/tenants/${encodeURIComponent(form.dataset.tenant)}/config`, config);
+  await loadTenants();
+}
+
+async function createTenant(event) {
+  event.preventDefault();
+  const values = formValues(event.target);
+  for (const key of ['jwt_duration', 'rate_limit_ip', 'rate_limit_user', 'rate_limit_window']) {
+    values[key] = Number(values[key]);
+  }
+  await request('POST', '/tenants', values);
+  event.target.reset();
+  await loadTenants(1);
+}
+
+// Users
+
+async function loadUsers(page = state.userPage) {
+  state.userPage = page;
+  const params = new URLSearchParams(formValues($('#user-search')));
+  params.set('page', page);
+  params.set('page_size', 20);
+  const data = await request('GET', `/tenants/${encodeURIComponent(state.tenantId)}/users?${params}`);
+  const body = $('#user-table tbody');
+  body.replaceChildren();
+  for (const user of data.users) {
+    const row = document.createElement('tr');
+    cell(row, user.username);
+    cell(row, user.role);
+    cell(row, '').appendChild(document.createElement('code')).textContent = JSON.stringify(user.attributes || {});
+    cell(row, formatTime(user.last_login));
+    actionCell(row, 'Edit', () => editUser(user));
+    body.appendChild(row);
+  }
+  renderPager($('#user-pager'), data.page, data.total_pages, loadUsers);
+}
+
+function editUser(user) {
+  state.editingUser = user;
+  $('#edit-username').textContent = user.username;
+  $('#attributes-form').elements.attribute_values.value = JSON.stringify(user.attributes || {}, null, 2);
+  $('#user-edit').hidden = false;
+}
+
+async function saveAttributes(event) {
+  event.preventDefault();
+  const attributes = JSON.parse(event.target.elements.attribute_values.value);
+  const user = state.editingUser;
+  await request('PATCH', `/tenants/${encodeURIComponent(state.tenantId)}/users/${encodeURIComponent(user.id)}/attributes`, { attributes });
+  $('#user-edit').hidden = true;
+  await loadUsers();
+}
+
+// Audit log
+
+async function loadAudit(page = state.auditPage) {
+  state.auditPage = page;
+  const params = new URLSearchParams(formValues($('#audit-filter')));
+  params.set('page', page);
+  params.set('page_size', 50);
+  const data = await request('GET', `/tenants/${encodeURIComponent(state.tenantId)}/audit-logs?${params}`);
+  const body = $('#audit-table tbody');
+  body.replaceChildren();
+  for (const entry of data.audit_logs) {
+    const row = document.createElement('tr');
+    cell(row, formatTime(entry.created_at));
+    cell(row, entry.actor_id);
+    cell(row, entry.action);
+    cell(row, entry.resource);
+    cell(row, entry.status);
+    cell(row, entry.ip);
+    body.appendChild(row);
+  }
+  renderPager($('#audit-pager'), data.page, Math.ceil(data.total / data.page_size), loadAudit);
+}
+
+// Rate limits
+
+async function inspectRateLimits(event) {
+  if (event) {
+    event.preventDefault();
+  }
+  const params = new URLSearchParams(formValues($('#rate-limit-form')));
+  const data = await request('GET', `/tenants/${encodeURIComponent(state.tenantId)}/rate-limits?${params}`);
+  $('#rate-limit-result').textContent = JSON.stringify(data, null, 2);
+}
+
+// Session and navigation
+
+async function login(event) {
+  event.preventDefault();
+  const values = formValues(event.target);
+  const data = await request('POST', `/${encodeURIComponent(values.tenant_id)}/login`, {
+    username: values.username,
+    password: values.password,
+  });
+  if (data.user.role !== 'admin') {
+    throw new Error('An admin account is required');
+  }
+  state.token = data.token;
+  state.tenantId = values.tenant_id;
+  sessionStorage.setItem('heimdall.token', state.token);
+  sessionStorage.setItem('heimdall.tenant', state.tenantId);
+  location.hash = '#tenants';
+  route();
+}
+
+function logout() {
+  state.token = null;
+  state.tenantId = null;
+  sessionStorage.removeItem('heimdall.token');
+  sessionStorage.removeItem('heimdall.tenant');
+  location.hash = '';
+  route();
+}
+
+const loaders = {
+  tenants: () => loadTenants(),
+  users: () => loadUsers(),
+  audit: () => loadAudit(),
+  'rate-limits': () => inspectRateLimits(),
+};
+
+function route() {
+  showError('');
+  let current = location.hash.slice(1) || 'tenants';
+  if (!state.token) {
+    current = 'login';
+  }
+  for (const id of sections) {
+    $('#' + id).hidden = id !== current;
+  }
+  $('#nav').hidden = !state.token;
+  for (const link of document.querySelectorAll('nav a')) {
+    link.classList.toggle('active', link.getAttribute('href') === '#' + current);
+  }
+  if (loaders[current]) {
+    loaders[current]().catch((err) => showError(err.message));
+  }
+}
+
+function bind(selector, handler) {
+  $(selector).addEventListener('submit', (event) => {
+    showError('');
+    handler(event).catch((err) => showError(err.message));
+  });
+}
+
+bind('#login-form', login);
+bind('#tenant-create', createTenant);
+bind('#config-form', saveConfig);
+bind('#user-search', (event) => { event.preventDefault(); return loadUsers(1); });
+bind('#attributes-form', saveAttributes);
+bind('#audit-filter', (event) => { event.preventDefault(); return loadAudit(1); });
+bind('#rate-limit-form', inspectRateLimits);
+$('#logout').addEventListener('click', logout);
+window.addEventListener('hashchange', route);
+route();
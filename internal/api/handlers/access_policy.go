@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/authz"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+type AccessPolicyHandler struct {
+	storage storage.Storage
+	engine  *authz.Engine
+}
+
+func NewAccessPolicyHandler(storage storage.Storage, engine *authz.Engine) *AccessPolicyHandler {
+	return &AccessPolicyHandler{
+		storage: storage,
+		engine:  engine,
+	}
+}
+
+type CreateAccessPolicyRequest struct {
+	ID         string                   `json:"id" validate:"omitempty,resource_id"`
+	Name       string                   `json:"name" validate:"required,max=100"`
+	Statements []models.AccessStatement `json:"statements" validate:"required,min=1,dive"`
+}
+
+func (h *AccessPolicyHandler) CreateAccessPolicy(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	var req CreateAccessPolicyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	existing, err := h.storage.ListAccessPolicies(c.Context(), tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch access policies",
+		})
+	}
+	for _, policy := range existing {
+		if req.ID != "" && policy.ID == req.ID && policy.Name == req.Name && reflect.DeepEqual(policy.Statements, req.Statements) {
+			return c.JSON(policy)
+		}
+		if policy.Name == req.Name || (req.ID != "" && policy.ID == req.ID) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Access policy already exists",
+			})
+		}
+	}
+
+	policy := &models.AccessPolicy{
+		ID:         req.ID,
+		TenantID:   tenant.ID,
+		Name:       req.Name,
+		Statements: req.Statements,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+
+	if err := h.storage.CreateAccessPolicy(c.Context(), policy); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create access policy",
+		})
+	}
+
+	h.engine.InvalidateTenant(tenant.ID)
+
+	return c.Status(fiber.StatusCreated).JSON(policy)
+}
+
+func (h *AccessPolicyHandler) ListAccessPolicies(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	policies, err := h.storage.ListAccessPolicies(c.Context(), tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch access policies",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"policies": policies,
+	})
+}
+
+func (h *AccessPolicyHandler) GetAccessPolicy(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	policy, err := h.storage.GetAccessPolicy(c.Context(), tenant.ID, c.Params("policy_id"))
+	if err == storage.ErrAccessPolicyNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Access policy not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch access policy",
+		})
+	}
+
+	return c.JSON(policy)
+}
+
+func (h *AccessPolicyHandler) DeleteAccessPolicy(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	err := h.storage.DeleteAccessPolicy(c.Context(), tenant.ID, c.Params("policy_id"))
+	if err == storage.ErrAccessPolicyNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Access policy not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete access policy",
+		})
+	}
+
+	h.engine.InvalidateTenant(tenant.ID)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Authorize answers an access decision for a resource server. The caller
+// authenticates with an environment API key, which also selects the tenant.
+func (h *AccessPolicyHandler) Authorize(c *fiber.Ctx) error {
+	if middleware.EnvironmentFromContext(c) == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "API key is required",
+		})
+	}
+	tenant := middleware.TenantFromContext(c)
+
+	var req models.AuthorizeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	decision, err := h.engine.Authorize(c.Context(), tenant.ID, req)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to evaluate access policies",
+		})
+	}
+
+	return respond(c, decision)
+}
+
+// AuthorizeBatch answers many access decisions for one subject in a single
+// call, authenticated like Authorize.
+func (h *AccessPolicyHandler) AuthorizeBatch(c *fiber.Ctx) error {
+	if middleware.EnvironmentFromContext(c) == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "API key is required",
+		})
+	}
+	tenant := middleware.TenantFromContext(c)
+
+	var req models.AuthorizeBatchRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return h.decide(c, tenant.ID, req.Subject, req.Checks)
+}
+
+type PermissionsRequest struct {
+	Checks []models.AuthorizeCheck `json:"checks" validate:"required,min=1,max=100,dive"`
+}
+
+// Permissions evaluates checks for the subject of the bearer token, so UIs can
+// render permission-aware screens in one round trip.
+func (h *AccessPolicyHandler) Permissions(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*models.Claims)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User not found in context",
+		})
+	}
+
+	var req PermissionsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return h.decide(c, claims.TenantID, models.AuthorizeSubject{ID: claims.UserID, Role: claims.Role}, req.Checks)
+}
+
+func (h *AccessPolicyHandler) decide(c *fiber.Ctx, tenantID string, subject models.AuthorizeSubject, checks []models.AuthorizeCheck) error {
+	reqs := make([]models.AuthorizeRequest, len(checks))
+	for i, check := range checks {
+		reqs[i] = models.AuthorizeRequest{
+			Subject:  subject,
+			Action:   check.Action,
+			Resource: check.Resource,
+		}
+	}
+
+	decisions, err := h.engine.AuthorizeBatch(storage.WithTenant(c.Context(), tenantID), tenantID, reqs)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to evaluate access policies",
+		})
+	}
+
+	for i := range decisions {
+		decisions[i].Action = checks[i].Action
+		decisions[i].Resource = checks[i].Resource
+	}
+
+	return respond(c, fiber.Map{
+		"decisions": decisions,
+	})
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/tajious/heimdall/internal/audit"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+type AuditHandler struct {
+	storage storage.Storage
+}
+
+func NewAuditHandler(storage storage.Storage) *AuditHandler {
+	return &AuditHandler{
+		storage: storage,
+	}
+}
+
+type ListAuditLogsRequest struct {
+	Page     int    `query:"page" validate:"min=1"`
+	PageSize int    `query:"page_size" validate:"min=1,max=100"`
+	ActorID  string `query:"actor_id"`
+	Action   string `query:"action"`
+}
+
+func (h *AuditHandler) ListAuditLogs(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	var req ListAuditLogsRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid query parameters",
+		})
+	}
+
+	if req.Page == 0 {
+		req.Page = 1
+	}
+	if req.PageSize == 0 {
+		req.PageSize = 20
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	entries, total, err := h.storage.ListAuditLogs(c.Context(), storage.AuditLogFilter{
+		TenantID: tenant.ID,
+		ActorID:  req.ActorID,
+		Action:   req.Action,
+		Page:     req.Page,
+		PageSize: req.PageSize,
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch audit logs",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"audit_logs": entries,
+		"total":      total,
+		"page":       req.Page,
+		"page_size":  req.PageSize,
+	})
+}
+
+type ExportAuditLogsRequest struct {
+	ActorID string `query:"actor_id"`
+	Action  string `query:"action"`
+}
+
+// ExportAuditLogs streams the tenant's audit log as NDJSON, newest first, as
+// it stood when the export started.
+func (h *AuditHandler) ExportAuditLogs(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	var req ExportAuditLogsRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid query parameters",
+		})
+	}
+
+	filter := storage.AuditLogFilter{
+		TenantID: tenant.ID,
+		ActorID:  utils.CopyString(req.ActorID),
+		Action:   utils.CopyString(req.Action),
+		Until:    time.Now(),
+		PageSize: exportPageSize,
+	}
+	return streamNDJSON(c, func(ctx context.Context, page int) ([]*models.AuditLog, error) {
+		filter.Page = page
+		entries, _, err := h.storage.ListAuditLogs(ctx, filter)
+		return entries, err
+	})
+}
+
+// ListDataChanges returns the rows the request of an audit entry wrote.
+func (h *AuditHandler) ListDataChanges(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	changes, err := h.storage.ListDataChanges(c.Context(), tenant.ID, c.Params("audit_log_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch data changes",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"changes": changes,
+	})
+}
+
+// VerifyAuditLogs checks the hash chain of the tenant's audit log.
+func (h *AuditHandler) VerifyAuditLogs(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	report, err := audit.Verify(c.Context(), h.storage, tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify audit logs",
+		})
+	}
+
+	return c.JSON(report)
+}
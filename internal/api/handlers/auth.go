@@ -2,31 +2,74 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/tajious/heimdall/internal/authn"
+	"github.com/tajious/heimdall/internal/breaker"
+	"github.com/tajious/heimdall/internal/domains"
+	"github.com/tajious/heimdall/internal/events"
+	"github.com/tajious/heimdall/internal/hooks"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/metrics"
+	"github.com/tajious/heimdall/internal/middleware"
 	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/passwords"
+	"github.com/tajious/heimdall/internal/search"
 	"github.com/tajious/heimdall/internal/storage"
 	"github.com/tajious/heimdall/internal/validation"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthHandler struct {
-	storage     storage.Storage
-	jwtSecret   string
-	jwtDuration time.Duration
+	storage        storage.Storage
+	keys           *keys.Resolver
+	oneTime        *middleware.OneTimeTokens
+	hasher         *passwords.Hasher
+	breaches       passwords.BreachChecker
+	authenticators *authn.Registry
+	loginHooks     *hooks.Registry
+	userIndex      search.UserIndex
+	events         *events.Broker
+	jwtDuration    time.Duration
+
+	database *breaker.Breaker
+	tenants  *tenantSnapshots
 }
 
-func NewAuthHandler(storage storage.Storage, jwtSecret string, jwtDuration time.Duration) *AuthHandler {
+func NewAuthHandler(storage storage.Storage, keys *keys.Resolver, oneTime *middleware.OneTimeTokens, hasher *passwords.Hasher, breaches passwords.BreachChecker, authenticators *authn.Registry, loginHooks *hooks.Registry, userIndex search.UserIndex, broker *events.Broker, jwtDuration time.Duration) *AuthHandler {
 	return &AuthHandler{
-		storage:     storage,
-		jwtSecret:   jwtSecret,
-		jwtDuration: jwtDuration,
+		storage:        storage,
+		keys:           keys,
+		oneTime:        oneTime,
+		hasher:         hasher,
+		breaches:       breaches,
+		authenticators: authenticators,
+		loginHooks:     loginHooks,
+		userIndex:      userIndex,
+		events:         broker,
+		jwtDuration:    jwtDuration,
+		tenants:        newTenantSnapshots(),
 	}
 }
 
+// DegradeWith makes token validation skip the database while database is
+// open, answering from the tenants it last read instead.
+func (h *AuthHandler) DegradeWith(database *breaker.Breaker) {
+	h.database = database
+}
+
 func (h *AuthHandler) Login(c *fiber.Ctx) error {
+	timeline := metrics.TimelineFrom(c.Context())
+
+	start := time.Now()
 	var req models.LoginRequest
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -39,83 +82,783 @@ func (h *AuthHandler) Login(c *fiber.Ctx) error {
 			"error": err.Error(),
 		})
 	}
+	timeline.Observe(metrics.StageBodyParse, start)
 
-	tenantID := c.Params("tenant_id")
-	if tenantID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Tenant ID is required",
-		})
+	tenant := middleware.TenantFromContext(c)
+	env := middleware.EnvironmentFromContext(c)
+
+	client, err := h.requestingClient(c, tenant.ID, req.ClientID, models.GrantPassword)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	environmentID := ""
+	if env != nil {
+		environmentID = env.ID
 	}
 
-	tenant, err := h.storage.GetTenant(c.Context(), tenantID)
+	authenticator, err := h.authenticators.Get(tenant.Config.AuthMethod)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid tenant",
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Unsupported authentication method",
 		})
 	}
 
-	user, authErr := h.authenticateWithUsernamePassword(c.Context(), req)
+	event := &hooks.Event{
+		Stage:         models.PreLogin,
+		EnvironmentID: environmentID,
+		Username:      req.Username,
+		Email:         req.Email,
+		Phone:         req.Phone,
+		RemoteIP:      c.IP(),
+	}
+	if _, err := h.runLoginHooks(c.Context(), tenant, event); err != nil {
+		return errorResponse(c, err)
+	}
+
+	user, authErr := authenticator.Authenticate(c.Context(), tenant, authn.Credentials{
+		Username:      req.Username,
+		Email:         req.Email,
+		Password:      req.Password,
+		Phone:         req.Phone,
+		EnvironmentID: environmentID,
+		RemoteIP:      c.IP(),
+		Certificates:  middleware.ClientCertificatesFromContext(c),
+	})
+	if errors.Is(authErr, authn.ErrDelegateUnavailable) || errors.Is(authErr, authn.ErrDelegateMisconfigured) {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Authentication provider unavailable",
+		})
+	}
+	if errors.Is(authErr, authn.ErrClientCertMisconfigured) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Client certificate authentication is misconfigured",
+		})
+	}
+	if errors.Is(authErr, authn.ErrProvisioningRejected) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": authErr.Error(),
+		})
+	}
+	if errors.Is(authErr, passwords.ErrQueueTimeout) {
+		c.Set(fiber.HeaderRetryAfter, "1")
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Server is busy, retry later",
+		})
+	}
 	if authErr != nil {
+		h.recordLogin(c, events.LoginFailed, tenant.ID, "", loginIdentifier(&req))
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid credentials",
 		})
 	}
 
-	if user.TenantID != tenantID {
+	if user.TenantID != tenant.ID {
+		h.recordLogin(c, events.LoginFailed, tenant.ID, "", loginIdentifier(&req))
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid tenant",
 		})
 	}
 
-	token, err := h.generateToken(user)
+	if user.IsSuspended() {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "User is suspended",
+		})
+	}
+
+	pending, err := h.pendingPolicies(c, tenant.ID, user.ID, req.AcceptedPolicies)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check policy acceptance",
+		})
+	}
+
+	if len(pending) > 0 {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error":    "Policy acceptance required",
+			"policies": pending,
+		})
+	}
+
+	event.Stage = models.PostLogin
+	event.User = user
+	claims, err := h.runLoginHooks(c.Context(), tenant, event)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	if len(claims) > 0 {
+		merged := make(map[string]interface{}, len(user.Claims)+len(claims))
+		for name, value := range user.Claims {
+			merged[name] = value
+		}
+		for name, value := range claims {
+			merged[name] = value
+		}
+		user.Claims = merged
+	}
+
+	start = time.Now()
+	token, err := h.generateToken(c.Context(), tenant, user, env, client, nil)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate token",
 		})
 	}
+	timeline.Observe(metrics.StageTokenSign, start)
 
+	start = time.Now()
 	if err := h.storage.UpdateUserLastLogin(c.Context(), user.ID); err != nil {
 		c.Locals("error", err)
 	}
+	timeline.Observe(metrics.StageDBWrite, start)
+
+	// Without an SSO session the user merely signs in again elsewhere.
+	if err := h.startSSOSession(c, tenant, user, client); err != nil {
+		c.Locals("error", err)
+	}
 
-	return c.JSON(models.LoginResponse{
+	h.recordLogin(c, events.LoginSucceeded, tenant.ID, user.ID, user.Username)
+	return loginResponse(c, tenant, models.LoginResponse{
 		Token:     token,
-		ExpiresIn: int(tenant.Config.JWTDuration),
+		ExpiresIn: expiresIn(tenant, client),
 		User:      *user,
 	})
 }
 
-func (h *AuthHandler) authenticateWithUsernamePassword(ctx context.Context, req models.LoginRequest) (*models.User, error) {
-	if req.Username == "" || req.Password == "" {
-		return nil, storage.ErrInvalidCredentials
+// loginResponse sends resp in the shape the tenant's clients expect.
+func loginResponse(c *fiber.Ctx, tenant *models.Tenant, resp models.LoginResponse) error {
+	if tenant.Config.TokenResponse == nil {
+		return c.JSON(resp)
+	}
+	return c.JSON(tenant.Config.TokenResponse.Shape(resp))
+}
+
+// recordLogin tells the tenant's live event subscribers about a login. A
+// failed login is written to the audit log as well, so that digests can
+// report spikes of them.
+func (h *AuthHandler) recordLogin(c *fiber.Ctx, eventType events.Type, tenantID, userID, username string) {
+	event := events.New(eventType, tenantID)
+	event.ActorID = userID
+	event.Username = utils.CopyString(username)
+	event.IP = utils.CopyString(c.IP())
+
+	if eventType == events.LoginFailed && !middleware.ReadOnly(c) {
+		entry := &models.AuditLog{
+			TenantID:  tenantID,
+			Action:    c.Method() + " " + c.Route().Path,
+			Resource:  utils.CopyString(c.Path()),
+			Status:    fiber.StatusUnauthorized,
+			IP:        event.IP,
+			EventType: eventType.ID,
+			Category:  string(eventType.Category),
+			Severity:  string(eventType.Severity),
+			CreatedAt: event.Time,
+		}
+		if err := h.storage.CreateAuditLog(c.Context(), entry); err != nil {
+			log.Printf("Failed to write audit log: %v", err)
+		}
+	}
+	h.events.Publish(c.Context(), event)
+}
+
+// loginIdentifier is the identifier a login was attempted with.
+func loginIdentifier(req *models.LoginRequest) string {
+	switch {
+	case req.Username != "":
+		return req.Username
+	case req.Email != "":
+		return req.Email
+	default:
+		return req.Phone
+	}
+}
+
+// runLoginHooks runs the hooks of the event's stage and returns the claims
+// they add, or a *fiber.Error when the login must stop.
+func (h *AuthHandler) runLoginHooks(ctx context.Context, tenant *models.Tenant, event *hooks.Event) (map[string]interface{}, error) {
+	outcome, err := h.loginHooks.Run(ctx, tenant, event)
+	if err != nil {
+		log.Printf("Refusing login for tenant %s: %v", tenant.ID, err)
+		return nil, fiber.NewError(fiber.StatusBadGateway, "Login hook unavailable")
+	}
+	if outcome.Denied {
+		reason := outcome.Reason
+		if reason == "" {
+			reason = "Login denied"
+		}
+		return nil, fiber.NewError(fiber.StatusForbidden, reason)
+	}
+	return outcome.Claims, nil
+}
+
+func (h *AuthHandler) Register(c *fiber.Ctx) error {
+	var req models.RegisterRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	tenant := middleware.TenantFromContext(c)
+	env := middleware.EnvironmentFromContext(c)
+
+	environmentID := ""
+	if env != nil {
+		environmentID = env.ID
+	}
+
+	if err := validation.ValidateFields(tenant.Config.AttributeSchema, req.Attributes); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":  "Invalid registration fields",
+			"fields": err,
+		})
+	}
+
+	if min := tenant.Config.MinPasswordScore; min > 0 {
+		strength := passwords.EstimateStrength(req.Password, req.Username, req.Email)
+		if strength.Score < min {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":    "Password is too weak",
+				"strength": strength,
+			})
+		}
+	}
+
+	if h.passwordBreached(c.Context(), tenant, req.Password) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Password appears in a known data breach, choose another one",
+		})
+	}
+
+	username := validation.NormalizeUsername(tenant.Config.UsernamePolicy, req.Username)
+	if validation.IsReservedUsername(tenant.Config.UsernamePolicy, username) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Username is reserved",
+		})
+	}
+
+	email := strings.ToLower(req.Email)
+	emailOnly := tenant.Config.AcceptsIdentifier(models.IdentifierEmail) && !tenant.Config.AcceptsIdentifier(models.IdentifierUsername)
+	if email == "" && (emailOnly || tenant.Config.RestrictEmailDomains) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Email is required",
+		})
+	}
+
+	allowed, err := domains.Allowed(c.Context(), h.storage, tenant, email)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check email domain",
+		})
+	}
+	if !allowed {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Email domain is not allowed for this tenant",
+		})
+	}
+
+	conflict := ""
+	if _, err := h.storage.GetPoolUserByUsername(c.Context(), tenant.ID, environmentID, username); err == nil {
+		conflict = "Username already taken"
+	}
+	if conflict == "" && email != "" {
+		if _, err := h.storage.GetPoolUserByEmail(c.Context(), tenant.ID, environmentID, email); err == nil {
+			conflict = "Email already registered"
+		}
+	}
+	if conflict == "" {
+		field, err := h.findAttributeConflict(c.Context(), tenant, "", req.Attributes)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to check attribute uniqueness",
+			})
+		}
+		if field != "" {
+			conflict = "Attribute " + field + " is already in use"
+		}
+	}
+	if conflict != "" && !tenant.Config.EnumerationProtection {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": conflict,
+		})
+	}
+
+	// Conflicting registrations still hash the password when enumeration
+	// protection is on, so they take as long as successful ones.
+	hash, err := h.hasher.Hash(c.Context(), req.Password)
+	if err == passwords.ErrQueueTimeout {
+		c.Set(fiber.HeaderRetryAfter, "1")
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Server is busy, retry later",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to hash password",
+		})
+	}
+	if conflict != "" {
+		return registrationAccepted(c)
+	}
+
+	user := &models.User{
+		TenantID:      tenant.ID,
+		EnvironmentID: environmentID,
+		Username:      username,
+		Email:         email,
+		Password:      hash,
+		Phone:         req.Phone,
+		Role:          models.RoleUser,
+		Status:        models.UserActive,
+		Attributes:    req.Attributes,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+
+	if err := h.storage.CreateUser(c.Context(), user); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create user",
+		})
+	}
+
+	if tenant.Config.EnumerationProtection {
+		return registrationAccepted(c)
+	}
+	return c.Status(fiber.StatusCreated).JSON(user)
+}
+
+// PasswordStrength scores a candidate password against the tenant's minimum
+// so clients can give feedback before registering.
+func (h *AuthHandler) PasswordStrength(c *fiber.Ctx) error {
+	var req models.PasswordStrengthRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	tenant := middleware.TenantFromContext(c)
+	strength := passwords.EstimateStrength(req.Password, req.Username, req.Email)
+	return c.JSON(fiber.Map{
+		"score":         strength.Score,
+		"guesses_log10": strength.GuessesLog10,
+		"warning":       strength.Warning,
+		"suggestions":   strength.Suggestions,
+		"min_score":     tenant.Config.MinPasswordScore,
+		"acceptable":    strength.Score >= tenant.Config.MinPasswordScore,
+	})
+}
+
+// passwordBreached reports whether the tenant rejects password as breached.
+// Lookups that fail let the password through rather than block registration
+// while the breach service is unreachable.
+func (h *AuthHandler) passwordBreached(ctx context.Context, tenant *models.Tenant, password string) bool {
+	if !tenant.Config.RejectBreachedPasswords || h.breaches == nil {
+		return false
+	}
+	breached, err := h.breaches.Breached(ctx, password)
+	if err != nil {
+		log.Printf("Breached password check failed for tenant %s: %v", tenant.ID, err)
+		return false
+	}
+	return breached
+}
+
+// registrationAccepted is the answer to every registration of a tenant with
+// enumeration protection, whether or not an account was created.
+func registrationAccepted(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "Registration received",
+	})
+}
+
+type UpdateUserAttributesRequest struct {
+	Attributes map[string]interface{} `json:"attributes" validate:"required"`
+}
+
+func (h *AuthHandler) UpdateUserAttributes(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	user, err := h.storage.GetUser(c.Context(), c.Params("user_id"))
+	if err != nil || user.TenantID != tenant.ID {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	var req UpdateUserAttributesRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	attributes := mergeAttributes(user.Attributes, req.Attributes)
+	if err := validation.ValidateFields(tenant.Config.AttributeSchema, attributes); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":  "Invalid attributes",
+			"fields": err,
+		})
+	}
+
+	if field, err := h.findAttributeConflict(c.Context(), tenant, user.ID, req.Attributes); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check attribute uniqueness",
+		})
+	} else if field != "" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Attribute " + field + " is already in use",
+		})
+	}
+
+	user.Attributes = attributes
+	user.UpdatedAt = time.Now()
+
+	if err := h.storage.UpdateUser(c.Context(), user); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update user",
+		})
+	}
+
+	return c.JSON(user)
+}
+
+// BatchUpdateUsersRequest changes several users at once. Each item names a
+// user and the fields to change; nil fields keep the current value and
+// attributes are merged as in UpdateUserAttributes. An empty admin_scopes
+// list makes an admin a full admin again.
+type BatchUpdateUsersRequest struct {
+	Users []BatchUserUpdate `json:"users" validate:"required,min=1,max=100,dive"`
+}
+
+type BatchUserUpdate struct {
+	ID     string             `json:"id" validate:"required"`
+	Role   *models.Role       `json:"role" validate:"omitempty,oneof=admin user read_only"`
+	Status *models.UserStatus `json:"status" validate:"omitempty,oneof=active suspended"`
+	// AdminScopes narrows an admin to some of the admin scopes.
+	AdminScopes *[]models.AdminScope   `json:"admin_scopes" validate:"omitempty,dive,oneof=users:manage config:manage audit:view"`
+	Attributes  map[string]interface{} `json:"attributes"`
+}
+
+type BatchUserResult struct {
+	ID     string       `json:"id"`
+	OK     bool         `json:"ok"`
+	Error  string       `json:"error,omitempty"`
+	Fields interface{}  `json:"fields,omitempty"`
+	User   *models.User `json:"user,omitempty"`
+}
+
+// BatchUpdateUsers applies every update in one transaction. When any item is
+// rejected nothing is saved, and the results say which items failed and why.
+func (h *AuthHandler) BatchUpdateUsers(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+	claims := c.Locals("user").(*models.Claims)
+
+	var req BatchUpdateUsersRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	results := make([]BatchUserResult, len(req.Users))
+	users := make([]*models.User, 0, len(req.Users))
+	seen := make(map[string]bool, len(req.Users))
+	failed := false
+	for i, item := range req.Users {
+		result, user := h.prepareUserUpdate(c.Context(), tenant, claims, item, seen)
+		results[i] = result
+		if !result.OK {
+			failed = true
+			continue
+		}
+		users = append(users, user)
+	}
+
+	if failed {
+		for i := range results {
+			results[i].User = nil
+		}
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error":   "No users were updated",
+			"results": results,
+		})
+	}
+
+	if err := h.storage.UpdateUsers(c.Context(), users); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update users",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"updated": len(users),
+		"results": results,
+	})
+}
+
+func (h *AuthHandler) prepareUserUpdate(ctx context.Context, tenant *models.Tenant, claims *models.Claims, item BatchUserUpdate, seen map[string]bool) (BatchUserResult, *models.User) {
+	result := BatchUserResult{ID: item.ID}
+	if seen[item.ID] {
+		result.Error = "User is listed more than once"
+		return result, nil
+	}
+	seen[item.ID] = true
+
+	if item.Role == nil && item.Status == nil && item.AdminScopes == nil && len(item.Attributes) == 0 {
+		result.Error = "No changes given"
+		return result, nil
+	}
+
+	current, err := h.storage.GetUser(ctx, item.ID)
+	if err != nil || current.TenantID != tenant.ID {
+		result.Error = "User not found"
+		return result, nil
+	}
+
+	// Admins must not lock themselves out from a multi-select action.
+	if current.ID == claims.UserID && (item.Role != nil && *item.Role != current.Role || item.Status != nil && *item.Status != current.Status || item.AdminScopes != nil) {
+		result.Error = "You cannot change your own role, status, or admin scopes"
+		return result, nil
+	}
+
+	// Scoped admins could otherwise grant themselves, through another
+	// account, the powers they were denied.
+	if len(claims.AdminScopes) > 0 && (current.Role == models.RoleAdmin || item.Role != nil && *item.Role == models.RoleAdmin || item.AdminScopes != nil) {
+		result.Error = "Only full admins can change admins or admin scopes"
+		return result, nil
+	}
+
+	user := *current
+	if item.Role != nil {
+		user.Role = *item.Role
+	}
+	if item.Status != nil {
+		user.Status = *item.Status
+	}
+	if item.AdminScopes != nil {
+		user.AdminScopes = slices.Compact(slices.Sorted(slices.Values(*item.AdminScopes)))
+	}
+	if user.Role != models.RoleAdmin {
+		if item.AdminScopes != nil && len(*item.AdminScopes) > 0 {
+			result.Error = "Admin scopes require the admin role"
+			return result, nil
+		}
+		user.AdminScopes = nil
+	}
+	if len(item.Attributes) > 0 {
+		user.Attributes = mergeAttributes(current.Attributes, item.Attributes)
+		if err := validation.ValidateFields(tenant.Config.AttributeSchema, user.Attributes); err != nil {
+			result.Error = "Invalid attributes"
+			result.Fields = err
+			return result, nil
+		}
+		if field, err := h.findAttributeConflict(ctx, tenant, user.ID, item.Attributes); err != nil {
+			result.Error = "Failed to check attribute uniqueness"
+			return result, nil
+		} else if field != "" {
+			result.Error = "Attribute " + field + " is already in use"
+			return result, nil
+		}
+	}
+	user.UpdatedAt = time.Now()
+
+	result.OK = true
+	result.User = &user
+	return result, &user
+}
+
+// mergeAttributes applies changes on top of current; a nil value removes the
+// attribute.
+func mergeAttributes(current, changes map[string]interface{}) map[string]interface{} {
+	attributes := make(map[string]interface{}, len(current)+len(changes))
+	for name, value := range current {
+		attributes[name] = value
+	}
+	for name, value := range changes {
+		if value == nil {
+			delete(attributes, name)
+			continue
+		}
+		attributes[name] = value
+	}
+	return attributes
+}
+
+func (h *AuthHandler) findAttributeConflict(ctx context.Context, tenant *models.Tenant, userID string, attributes map[string]interface{}) (string, error) {
+	for _, rule := range tenant.Config.AttributeSchema {
+		value, ok := attributes[rule.Name]
+		if !rule.Unique || !ok || value == nil {
+			continue
+		}
+
+		existing, err := h.storage.FindUserByAttribute(ctx, tenant.ID, rule.Name, value)
+		if err == storage.ErrUserNotFound {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if existing.ID != userID {
+			return rule.Name, nil
+		}
 	}
+	return "", nil
+}
 
-	user, err := h.storage.GetUserByUsername(ctx, req.Username)
+func (h *AuthHandler) pendingPolicies(c *fiber.Ctx, tenantID, userID string, acceptedIDs []string) ([]*models.PolicyVersion, error) {
+	current, err := h.storage.CurrentPolicyVersions(c.Context(), tenantID)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		return nil, storage.ErrInvalidCredentials
+	accepted := make(map[string]bool, len(acceptedIDs))
+	for _, id := range acceptedIDs {
+		accepted[id] = true
 	}
 
-	return user, nil
+	pending := []*models.PolicyVersion{}
+	for _, policy := range current {
+		if !policy.Required {
+			continue
+		}
+
+		ok, err := h.storage.HasAcceptedPolicy(c.Context(), userID, policy.ID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			continue
+		}
+
+		if !accepted[policy.ID] {
+			pending = append(pending, policy)
+			continue
+		}
+
+		if err := h.storage.CreatePolicyAcceptance(c.Context(), &models.PolicyAcceptance{
+			TenantID:        tenantID,
+			UserID:          userID,
+			PolicyVersionID: policy.ID,
+			Version:         policy.Version,
+			IP:              c.IP(),
+			AcceptedAt:      time.Now(),
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return pending, nil
 }
 
-func (h *AuthHandler) generateToken(user *models.User) (string, error) {
+// generateToken issues a token to user, following the token policy of
+// client when the token is for a registered client, and encrypted for it
+// when the client asks.
+func (h *AuthHandler) generateToken(ctx context.Context, tenant *models.Tenant, user *models.User, env *models.Environment, client *models.Client, scopes []string) (string, error) {
+	lifetime := h.jwtDuration
+	if client != nil && client.AccessTokenLifetime > 0 {
+		lifetime = time.Duration(client.AccessTokenLifetime) * time.Second
+	}
 	claims := models.Claims{
-		UserID:   user.ID,
-		TenantID: user.TenantID,
-		Role:     user.Role,
+		UserID:        user.ID,
+		TenantID:      user.TenantID,
+		EnvironmentID: user.EnvironmentID,
+		Role:          user.Role,
+		AdminScopes:   user.AdminScopes,
+		Scopes:        scopes,
+		Attributes:    user.Claims,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(h.jwtDuration)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(lifetime)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
 	}
+	if tenant.Config.PrivacyMode {
+		claims.StripIdentifiers(user)
+	}
+	if client != nil {
+		client.Restrict(&claims)
+	}
+
+	token, err := h.keys.Sign(ctx, &claims, tenant, env)
+	if err != nil || client == nil || !client.EncryptTokens {
+		return token, err
+	}
+	return h.keys.Encrypt(ctx, token, client)
+}
+
+// expiresIn is the lifetime, in seconds, reported with tokens issued to
+// client.
+func expiresIn(tenant *models.Tenant, client *models.Client) int {
+	if client != nil && client.AccessTokenLifetime > 0 {
+		return client.AccessTokenLifetime
+	}
+	return int(tenant.Config.JWTDuration)
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(h.jwtSecret))
+// requestingClient returns the registered client a request names, refusing
+// unknown clients and clients not allowed grant. A request naming no client
+// gets none, and tokens that follow the tenant's policy.
+func (h *AuthHandler) requestingClient(c *fiber.Ctx, tenantID, clientID string, grant models.GrantType) (*models.Client, error) {
+	if clientID == "" {
+		return nil, nil
+	}
+	client, err := h.registeredClient(c, tenantID, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Unknown client")
+	}
+	if grant != "" && !client.AllowsGrant(grant) {
+		return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Client is not allowed the %s grant", grant))
+	}
+	return client, nil
+}
+
+// registeredClient returns the tenant's client with clientID, or nil when
+// the tenant has not registered it.
+func (h *AuthHandler) registeredClient(c *fiber.Ctx, tenantID, clientID string) (*models.Client, error) {
+	client, err := h.storage.GetClient(c.Context(), tenantID, clientID)
+	if errors.Is(err, storage.ErrClientNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		c.Locals("error", err)
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch client")
+	}
+	return client, nil
+}
+
+// JWKS publishes the public keys tokens can be verified with, so relying
+// parties need not call ValidateToken for every request.
+func (h *AuthHandler) JWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(h.keys.JWKS())
 }
 
 func (h *AuthHandler) ValidateToken(c *fiber.Ctx) error {
@@ -131,9 +874,7 @@ func (h *AuthHandler) ValidateToken(c *fiber.Ctx) error {
 		tokenString = authHeader[7:]
 	}
 
-	token, err := jwt.ParseWithClaims(tokenString, &models.Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(h.jwtSecret), nil
-	})
+	token, err := h.keys.Parse(c.Context(), tokenString, &models.Claims{})
 
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
@@ -148,36 +889,126 @@ func (h *AuthHandler) ValidateToken(c *fiber.Ctx) error {
 		})
 	}
 
-	user, err := h.storage.GetUserByUsername(c.Context(), claims.UserID)
+	if err := h.oneTime.Check(c.Context(), claims); err != nil {
+		return h.oneTime.Reject(c, err)
+	}
+
+	if h.database.Degraded() {
+		if handled, err := h.validateDegraded(c, claims); handled {
+			return err
+		}
+	}
+
+	ctx := storage.WithTenant(c.Context(), claims.TenantID)
+	user, err := h.storage.GetUser(ctx, claims.UserID)
+	// A token only stands for a user of the tenant and pool it names.
+	if err == nil && (user.TenantID != claims.TenantID || user.EnvironmentID != claims.EnvironmentID) {
+		err = storage.ErrUserNotFound
+	}
+	if err != nil && err != storage.ErrUserNotFound {
+		if handled, err := h.validateDegraded(c, claims); handled {
+			return err
+		}
+	}
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "User not found",
 		})
 	}
+	if user.IsSuspended() {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User is suspended",
+		})
+	}
 
-	tenant, err := h.storage.GetTenant(c.Context(), claims.TenantID)
+	tenant, err := h.storage.GetTenant(ctx, claims.TenantID)
+	if err != nil && err != storage.ErrTenantNotFound {
+		if handled, err := h.validateDegraded(c, claims); handled {
+			return err
+		}
+	}
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid tenant",
 		})
 	}
+	h.tenants.put(tenant)
 
-	return c.JSON(fiber.Map{
+	validated := fiber.Map{
+		"id":       user.ID,
+		"username": user.Username,
+		"role":     user.Role,
+	}
+	if tenant.Config.PrivacyMode {
+		delete(validated, "username")
+	}
+
+	response := fiber.Map{
 		"valid": true,
-		"user": fiber.Map{
-			"id":       user.ID,
-			"username": user.Username,
-			"role":     user.Role,
-		},
+		"user":  validated,
 		"tenant": fiber.Map{
 			"id":     tenant.ID,
 			"name":   tenant.Name,
 			"config": tenant.Config,
 		},
-		"expires_at": claims.ExpiresAt,
+		"expires_at": expiresAt(claims),
+	}
+	// Action and magic link tokens are only accepted here, so the service
+	// that minted one checks it stands for the action it expects.
+	if claims.Type != models.TokenAccess {
+		response["token_type"] = claims.Type
+	}
+	return respond(c, response)
+}
+
+// validateDegraded answers a token validation while the database cannot be
+// read: against the tenant as last read when there is a copy of it, or from
+// the verified token alone during maintenance. It reports false when it
+// could do neither. Users suspended since are not noticed.
+func (h *AuthHandler) validateDegraded(c *fiber.Ctx, claims *models.Claims) (bool, error) {
+	tenant := h.tenants.get(claims.TenantID)
+	if tenant == nil && !middleware.InMaintenance(c) {
+		return false, nil
+	}
+	if tenant != nil && tenant.IsSuspended() {
+		return true, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid tenant",
+		})
+	}
+	return true, validatedFromClaims(c, claims, tenant)
+}
+
+// validatedFromClaims answers a token validation from the verified token
+// and, if there is a copy of it, the tenant as last read, for when the
+// database is unavailable.
+func validatedFromClaims(c *fiber.Ctx, claims *models.Claims, tenant *models.Tenant) error {
+	validatedTenant := fiber.Map{
+		"id": claims.TenantID,
+	}
+	if tenant != nil {
+		validatedTenant["name"] = tenant.Name
+		validatedTenant["config"] = tenant.Config
+	}
+	return respond(c, fiber.Map{
+		"valid": true,
+		"user": fiber.Map{
+			"id":   claims.UserID,
+			"role": claims.Role,
+		},
+		"tenant":     validatedTenant,
+		"expires_at": expiresAt(claims),
+		"degraded":   true,
 	})
 }
 
+// expiresAt reports the token expiry in Unix seconds, nil if it never expires.
+func expiresAt(claims *models.Claims) interface{} {
+	if claims.ExpiresAt == nil {
+		return nil
+	}
+	return claims.ExpiresAt.Unix()
+}
+
 type ListUsersRequest struct {
 	Page     int    `query:"page" validate:"min=1"`
 	PageSize int    `query:"page_size" validate:"min=1,max=100"`
@@ -196,31 +1027,7 @@ type ListUsersResponse struct {
 }
 
 func (h *AuthHandler) ListUsers(c *fiber.Ctx) error {
-	tenantID := c.Params("tenant_id")
-	if tenantID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Tenant ID is required",
-		})
-	}
-
-	if _, err := h.storage.GetTenant(c.Context(), tenantID); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Tenant not found",
-		})
-	}
-
-	userTenantID := c.Locals("tenant_id").(string)
-	if userTenantID == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "User tenant ID not found",
-		})
-	}
-
-	if userTenantID != tenantID {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": "Access denied to this tenant",
-		})
-	}
+	tenant := middleware.TenantFromContext(c)
 
 	var req ListUsersRequest
 	if err := c.QueryParser(&req); err != nil {
@@ -248,21 +1055,15 @@ func (h *AuthHandler) ListUsers(c *fiber.Ctx) error {
 		})
 	}
 
-	query := h.storage.GetDB().Model(&models.User{}).Where("tenant_id = ?", tenantID)
-
-	if req.Search != "" {
-		searchPattern := "%" + req.Search + "%"
-		query = query.Where("username LIKE ? OR phone LIKE ?", searchPattern, searchPattern)
-	}
-
-	if req.Role != "" {
-		query = query.Where("role = ?", req.Role)
+	filter, err := userFilter(c, h.userIndex, tenant, req)
+	if err != nil {
+		return errorResponse(c, err)
 	}
 
-	var total int64
-	if err := query.Count(&total).Error; err != nil {
+	users, total, err := h.storage.ListUsers(c.Context(), filter)
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to count users",
+			"error": "Failed to fetch users",
 		})
 	}
 
@@ -271,29 +1072,114 @@ func (h *AuthHandler) ListUsers(c *fiber.Ctx) error {
 		totalPages++
 	}
 
-	sortField := req.SortBy
-	if sortField == "created_at" {
-		sortField = "created_at"
-	} else if sortField == "last_login" {
-		sortField = "last_login"
-	}
-	query = query.Order(sortField + " " + req.SortDir)
+	return c.JSON(ListUsersResponse{
+		Users:      users,
+		Total:      total,
+		Page:       req.Page,
+		PageSize:   req.PageSize,
+		TotalPages: totalPages,
+	})
+}
 
-	offset := (req.Page - 1) * req.PageSize
-	query = query.Offset(offset).Limit(req.PageSize)
+// ExportUsers streams every user matching the ListUsers filters as NDJSON,
+// one user per line, oldest first unless sort_by and sort_dir say otherwise.
+func (h *AuthHandler) ExportUsers(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
 
-	var users []models.User
-	if err := query.Find(&users).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch users",
+	req := ListUsersRequest{SortBy: "created_at", SortDir: "asc"}
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid query parameters",
 		})
 	}
+	req.Page, req.PageSize = 1, 1
 
-	return c.JSON(ListUsersResponse{
-		Users:      users,
-		Total:      total,
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	filter, err := userFilter(c, h.userIndex, tenant, req)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	filter.PageSize = exportPageSize
+
+	return streamNDJSON(c, func(ctx context.Context, page int) ([]models.User, error) {
+		filter.Page = page
+		users, _, err := h.storage.ListUsers(ctx, filter)
+		return users, err
+	})
+}
+
+// userFilter builds the storage filter for a user listing. The strings it
+// holds are copied, so the filter outlives the request.
+func userFilter(c *fiber.Ctx, userIndex search.UserIndex, tenant *models.Tenant, req ListUsersRequest) (storage.UserFilter, error) {
+	attributeFilter, err := parseAttributeFilter(c, tenant.Config.AttributeSchema)
+	if err != nil {
+		return storage.UserFilter{}, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	filter := storage.UserFilter{
+		TenantID:   tenant.ID,
+		Search:     utils.CopyString(req.Search),
+		Role:       utils.CopyString(req.Role),
+		Attributes: attributeFilter,
+		SortBy:     utils.CopyString(req.SortBy),
+		SortDir:    utils.CopyString(req.SortDir),
 		Page:       req.Page,
 		PageSize:   req.PageSize,
-		TotalPages: totalPages,
+	}
+
+	if req.Search != "" && userIndex != nil {
+		ids, err := userIndex.SearchUserIDs(c.Context(), tenant.ID, req.Search)
+		if err != nil {
+			return storage.UserFilter{}, fiber.NewError(fiber.StatusInternalServerError, "Failed to search users")
+		}
+		filter.Search = ""
+		filter.IDs = ids
+	}
+
+	return filter, nil
+}
+
+func parseAttributeFilter(c *fiber.Ctx, schema []models.FieldRule) (map[string]interface{}, error) {
+	filter := make(map[string]interface{})
+
+	var parseErr error
+	c.Context().QueryArgs().VisitAll(func(key, value []byte) {
+		name, ok := strings.CutPrefix(string(key), "attr.")
+		if !ok || parseErr != nil {
+			return
+		}
+
+		rule, known := models.FindFieldRule(schema, name)
+		if !known {
+			parseErr = fmt.Errorf("unknown attribute %q", name)
+			return
+		}
+
+		raw := string(value)
+		switch rule.Type {
+		case models.FieldNumber:
+			n, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				parseErr = fmt.Errorf("attribute %q must be a number", name)
+				return
+			}
+			filter[name] = n
+		case models.FieldBoolean:
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				parseErr = fmt.Errorf("attribute %q must be a boolean", name)
+				return
+			}
+			filter[name] = b
+		default:
+			filter[name] = raw
+		}
 	})
+
+	return filter, parseErr
 }
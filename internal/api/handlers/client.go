@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+type ClientHandler struct {
+	storage storage.Storage
+	secrets *vault.Vault
+	keys    *keys.Resolver
+}
+
+func NewClientHandler(storage storage.Storage, secrets *vault.Vault, keys *keys.Resolver) *ClientHandler {
+	return &ClientHandler{
+		storage: storage,
+		secrets: secrets,
+		keys:    keys,
+	}
+}
+
+// ClientRequest describes a client, both when it is registered and when it
+// is replaced.
+type ClientRequest struct {
+	Name         string   `json:"name" validate:"required,max=100"`
+	RedirectURIs []string `json:"redirect_uris" validate:"max=20"`
+	// PostLogoutRedirectURIs and BackchannelLogoutURI take part in the
+	// logout of the tenant's SSO sessions.
+	PostLogoutRedirectURIs []string           `json:"post_logout_redirect_uris" validate:"max=20"`
+	BackchannelLogoutURI   string             `json:"backchannel_logout_uri" validate:"omitempty,url"`
+	GrantTypes             []models.GrantType `json:"grant_types" validate:"required,min=1,dive,oneof=password authorization_code refresh_token client_credentials urn:ietf:params:oauth:grant-type:device_code"`
+	// AccessTokenLifetime is at most a day and RefreshTokenLifetime at most
+	// a year, both in seconds.
+	AccessTokenLifetime  int      `json:"access_token_lifetime" validate:"min=0,max=86400"`
+	RefreshTokenLifetime int      `json:"refresh_token_lifetime" validate:"min=0,max=31536000"`
+	AllowedOrigins       []string `json:"allowed_origins" validate:"max=50"`
+	AllowedScopes        []string `json:"allowed_scopes" validate:"max=100,dive,required,max=255"`
+	OmitClaims           []string `json:"omit_claims" validate:"dive,oneof=attrs admin_scopes"`
+	AttributeClaims      []string `json:"attribute_claims" validate:"max=50,dive,required"`
+	EncryptTokens        bool     `json:"encrypt_tokens"`
+}
+
+type CreateClientRequest struct {
+	ID string `json:"id" validate:"omitempty,resource_id"`
+	ClientRequest
+}
+
+func (h *ClientHandler) CreateClient(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	var req CreateClientRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	now := time.Now()
+	client := &models.Client{
+		ID:        req.ID,
+		TenantID:  tenant.ID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := req.apply(client); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := h.ensureEncryptionKey(c.Context(), client); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create client",
+		})
+	}
+
+	err := h.storage.CreateClient(c.Context(), client)
+	if errors.Is(err, storage.ErrConflict) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Client already exists",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create client",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(client)
+}
+
+func (h *ClientHandler) ListClients(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	clients, err := h.storage.ListClients(c.Context(), tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch clients",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"clients": clients,
+	})
+}
+
+func (h *ClientHandler) GetClient(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	client, err := h.storage.GetClient(c.Context(), tenant.ID, c.Params("client_id"))
+	if errors.Is(err, storage.ErrClientNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Client not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch client",
+		})
+	}
+
+	return c.JSON(client)
+}
+
+// UpdateClient replaces everything about a client but its ID.
+func (h *ClientHandler) UpdateClient(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	var req ClientRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	client, err := h.storage.GetClient(c.Context(), tenant.ID, c.Params("client_id"))
+	if errors.Is(err, storage.ErrClientNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Client not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch client",
+		})
+	}
+
+	updated := *client
+	if err := req.apply(&updated); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := h.ensureEncryptionKey(c.Context(), &updated); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update client",
+		})
+	}
+	updated.UpdatedAt = time.Now()
+
+	err = h.storage.UpdateClient(c.Context(), &updated)
+	if errors.Is(err, storage.ErrConflict) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Client already exists",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update client",
+		})
+	}
+
+	return c.JSON(&updated)
+}
+
+// GetEncryptionKey hands out, as a JWK, the key the client's tokens are
+// encrypted with, for the audience that has to decrypt them.
+func (h *ClientHandler) GetEncryptionKey(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	client, err := h.storage.GetClient(c.Context(), tenant.ID, c.Params("client_id"))
+	if errors.Is(err, storage.ErrClientNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Client not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch client",
+		})
+	}
+	if !client.EncryptTokens {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Client does not encrypt its tokens",
+		})
+	}
+
+	jwk, err := h.keys.EncryptionJWK(c.Context(), client)
+	if err != nil {
+		c.Locals("error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch encryption key",
+		})
+	}
+	return c.JSON(jwk)
+}
+
+func (h *ClientHandler) DeleteClient(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	err := h.storage.DeleteClient(c.Context(), tenant.ID, c.Params("client_id"))
+	if errors.Is(err, storage.ErrClientNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Client not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete client",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// apply copies the request onto client, checking what the validator
+// cannot: redirect URIs are absolute and without fragments, origins are web
+// origins, and clients that sign users in through a browser redirect have
+// somewhere to redirect to.
+func (r *ClientRequest) apply(client *models.Client) error {
+	for _, uri := range slices.Concat(r.RedirectURIs, r.PostLogoutRedirectURIs) {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme == "" || u.Fragment != "" || u.Host == "" && u.Opaque == "" && u.Path == "" {
+			return fmt.Errorf("%q is not an absolute redirect URI without a fragment", uri)
+		}
+	}
+	if slices.Contains(r.GrantTypes, models.GrantAuthorizationCode) && len(r.RedirectURIs) == 0 {
+		return errors.New("the authorization_code grant needs at least one redirect URI")
+	}
+	origins, err := webOrigins(r.AllowedOrigins)
+	if err != nil {
+		return err
+	}
+
+	client.Name = r.Name
+	client.RedirectURIs = orEmpty(r.RedirectURIs)
+	client.PostLogoutRedirectURIs = orEmpty(r.PostLogoutRedirectURIs)
+	client.BackchannelLogoutURI = r.BackchannelLogoutURI
+	client.GrantTypes = slices.Compact(slices.Sorted(slices.Values(r.GrantTypes)))
+	client.AccessTokenLifetime = r.AccessTokenLifetime
+	client.RefreshTokenLifetime = r.RefreshTokenLifetime
+	client.AllowedOrigins = origins
+	client.AllowedScopes = orEmpty(r.AllowedScopes)
+	client.OmitClaims = orEmpty(r.OmitClaims)
+	client.AttributeClaims = orEmpty(r.AttributeClaims)
+	client.EncryptTokens = r.EncryptTokens
+	return nil
+}
+
+// ensureEncryptionKey gives a client that encrypts its tokens a key, once.
+// The key is kept when encryption is turned off, so turning it back on does
+// not strand the audience with a stale key.
+func (h *ClientHandler) ensureEncryptionKey(ctx context.Context, client *models.Client) error {
+	if !client.EncryptTokens || client.EncryptionKey != "" {
+		return nil
+	}
+	key, err := keys.NewEncryptionKey(ctx, h.secrets, client.TenantID)
+	if err != nil {
+		return err
+	}
+	client.EncryptionKey = key
+	return nil
+}
+
+// orEmpty lists nothing as [] rather than null.
+func orEmpty(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
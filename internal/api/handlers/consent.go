@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+// ListConsents shows the signed-in user the clients they have let act on
+// their behalf, and with which scopes.
+func (h *AuthHandler) ListConsents(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+	claims := c.Locals("user").(*models.Claims)
+
+	grants, err := h.storage.ListConsentGrants(c.Context(), tenant.ID, claims.UserID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch consents",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"consents": grants,
+	})
+}
+
+// RevokeConsent withdraws the signed-in user's consent to a client, or only
+// the space-separated scopes of the scope query parameter. The client has to
+// ask for consent again before it gets another token with them; tokens
+// already issued stay valid until they expire.
+func (h *AuthHandler) RevokeConsent(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+	claims := c.Locals("user").(*models.Claims)
+	clientID := c.Params("client_id")
+
+	revoked := strings.Fields(c.Query("scope"))
+	var err error
+	if len(revoked) == 0 {
+		err = h.storage.DeleteConsentGrant(c.Context(), tenant.ID, claims.UserID, clientID)
+	} else {
+		err = h.revokeScopes(c, tenant.ID, claims.UserID, clientID, revoked)
+	}
+	if errors.Is(err, storage.ErrConsentGrantNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Consent not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke consent",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *AuthHandler) revokeScopes(c *fiber.Ctx, tenantID, userID, clientID string, revoked []string) error {
+	grant, err := h.storage.GetConsentGrant(c.Context(), tenantID, userID, clientID)
+	if err != nil {
+		return err
+	}
+	grant.Scopes = slices.DeleteFunc(grant.Scopes, func(scope string) bool {
+		return slices.Contains(revoked, scope)
+	})
+	grant.UpdatedAt = time.Now()
+	return h.storage.SaveConsentGrant(c.Context(), grant)
+}
+
+// grantConsent adds scopes to what the user has let the client do.
+func (h *AuthHandler) grantConsent(c *fiber.Ctx, tenantID, userID, clientID string, scopes []string) error {
+	now := time.Now()
+	grant, err := h.storage.GetConsentGrant(c.Context(), tenantID, userID, clientID)
+	if errors.Is(err, storage.ErrConsentGrantNotFound) {
+		grant = &models.ConsentGrant{
+			TenantID:  tenantID,
+			UserID:    userID,
+			ClientID:  clientID,
+			Scopes:    []string{},
+			CreatedAt: now,
+		}
+	} else if err != nil {
+		return err
+	}
+	grant.Scopes = append(grant.Scopes, grant.Missing(scopes)...)
+	grant.UpdatedAt = now
+	return h.storage.SaveConsentGrant(c.Context(), grant)
+}
+
+// consentedScopes splits scopes into those the user has already let the
+// client have and those they have not.
+func (h *AuthHandler) consentedScopes(c *fiber.Ctx, tenantID, userID, clientID string, scopes []string) (granted, missing []string, err error) {
+	grant, err := h.storage.GetConsentGrant(c.Context(), tenantID, userID, clientID)
+	if errors.Is(err, storage.ErrConsentGrantNotFound) {
+		return []string{}, scopes, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	missing = grant.Missing(scopes)
+	granted = []string{}
+	for _, scope := range scopes {
+		if !slices.Contains(missing, scope) && !slices.Contains(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	return granted, missing, nil
+}
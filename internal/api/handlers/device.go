@@ -0,0 +1,413 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+// The device authorization grant (RFC 8628) with the lifetime and polling
+// interval the RFC suggests.
+const (
+	deviceGrantType    = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeTTL      = 10 * time.Minute
+	devicePollInterval = 5
+	deviceSlowDown     = 5
+)
+
+// userCodeAlphabet has no vowels, so codes never spell words, and none of
+// the letters people mistake for digits.
+const (
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+type DeviceCodeRequest struct {
+	ClientID string `json:"client_id" form:"client_id" validate:"required,max=255"`
+	Scope    string `json:"scope" form:"scope" validate:"max=1024"`
+}
+
+type DeviceTokenRequest struct {
+	GrantType  string `json:"grant_type" form:"grant_type" validate:"required"`
+	DeviceCode string `json:"device_code" form:"device_code" validate:"required"`
+	ClientID   string `json:"client_id" form:"client_id" validate:"required"`
+}
+
+type VerifyDeviceRequest struct {
+	UserCode string `json:"user_code" validate:"required"`
+	Approve  *bool  `json:"approve" validate:"required"`
+}
+
+// DeviceCode starts a device login. The device shows the user code and
+// verification URI to the user, then polls DeviceToken with the device code.
+func (h *AuthHandler) DeviceCode(c *fiber.Ctx) error {
+	var req DeviceCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	tenant := middleware.TenantFromContext(c)
+	// Users have nowhere to enter the code until the tenant says where.
+	if tenant.Config.DeviceVerificationURI == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Feature not enabled for tenant",
+		})
+	}
+
+	// Devices of clients the tenant has not registered only sign in when
+	// the tenant allows them, and get tokens that follow its policy.
+	scopes := strings.Fields(req.Scope)
+	client, err := h.registeredClient(c, tenant.ID, req.ClientID)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	if client == nil && !tenant.Config.AllowUnregisteredDeviceClients {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Unknown client",
+		})
+	}
+	if client != nil {
+		if !client.AllowsGrant(models.GrantDeviceCode) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Client is not allowed the device code grant",
+			})
+		}
+		if disallowed := client.DisallowedScopes(scopes); len(disallowed) > 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Client may not ask for scopes: " + strings.Join(disallowed, " "),
+			})
+		}
+	}
+
+	deviceCode, err := keys.GenerateSecret(32)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate device code",
+		})
+	}
+
+	auth := &models.DeviceAuthorization{
+		TenantID:       tenant.ID,
+		DeviceCodeHash: hashDeviceCode(deviceCode),
+		ClientID:       req.ClientID,
+		Scopes:         scopes,
+		Status:         models.DevicePending,
+		Interval:       devicePollInterval,
+		ExpiresAt:      time.Now().Add(deviceCodeTTL),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+	// A user code is short enough to collide with a live one now and then.
+	for attempt := 0; attempt < 3; attempt++ {
+		auth.ID = ""
+		auth.UserCode, err = generateUserCode()
+		if err == nil {
+			err = h.storage.CreateDeviceAuthorization(c.Context(), auth)
+		}
+		if !errors.Is(err, storage.ErrConflict) {
+			break
+		}
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start device authorization",
+		})
+	}
+
+	userCode := formatUserCode(auth.UserCode)
+	return c.JSON(fiber.Map{
+		"device_code":               deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          tenant.Config.DeviceVerificationURI,
+		"verification_uri_complete": verificationURIComplete(tenant.Config.DeviceVerificationURI, userCode),
+		"expires_in":                int(deviceCodeTTL.Seconds()),
+		"interval":                  devicePollInterval,
+	})
+}
+
+// DeviceToken answers a device polling for its token, in the OAuth error
+// format until the user has approved it.
+func (h *AuthHandler) DeviceToken(c *fiber.Ctx) error {
+	var req DeviceTokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return deviceError(c, "invalid_request", "Invalid request body")
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return deviceError(c, "invalid_request", err.Error())
+	}
+
+	if req.GrantType != deviceGrantType {
+		return deviceError(c, "unsupported_grant_type", "grant_type must be "+deviceGrantType)
+	}
+
+	tenant := middleware.TenantFromContext(c)
+	auth, err := h.storage.GetDeviceAuthorizationByDeviceCode(c.Context(), tenant.ID, hashDeviceCode(req.DeviceCode))
+	if errors.Is(err, storage.ErrDeviceAuthorizationNotFound) || err == nil && auth.ClientID != req.ClientID {
+		return deviceError(c, "invalid_grant", "Unknown device code")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load device authorization",
+		})
+	}
+
+	if auth.Expired() {
+		return deviceError(c, "expired_token", "The device code has expired")
+	}
+
+	if auth.Status == models.DeviceDenied {
+		if err := h.storage.DeleteDeviceAuthorization(c.Context(), tenant.ID, auth.ID); err != nil {
+			c.Locals("error", err)
+		}
+		return deviceError(c, "access_denied", "The user denied the device")
+	}
+
+	now := time.Now()
+	polledTooSoon := auth.LastPolledAt != nil && now.Sub(*auth.LastPolledAt) < time.Duration(auth.Interval)*time.Second
+	if auth.Status == models.DevicePending || polledTooSoon {
+		code, description := "authorization_pending", "The user has not approved the device yet"
+		if polledTooSoon {
+			auth.Interval += deviceSlowDown
+			code, description = "slow_down", "Poll less often"
+		}
+		auth.LastPolledAt = &now
+		auth.UpdatedAt = now
+		if err := h.storage.UpdateDeviceAuthorization(c.Context(), auth); err != nil {
+			c.Locals("error", err)
+		}
+		return deviceError(c, code, description)
+	}
+
+	// The user may have withdrawn their consent since approving the device.
+	grant, err := h.storage.GetConsentGrant(c.Context(), tenant.ID, auth.UserID, auth.ClientID)
+	if errors.Is(err, storage.ErrConsentGrantNotFound) || err == nil && len(grant.Missing(auth.Scopes)) > 0 {
+		if err := h.storage.DeleteDeviceAuthorization(c.Context(), tenant.ID, auth.ID); err != nil {
+			c.Locals("error", err)
+		}
+		return deviceError(c, "access_denied", "The user revoked their consent")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load consent",
+		})
+	}
+
+	// Only the poll that deletes the authorization gets the token.
+	if err := h.storage.DeleteDeviceAuthorization(c.Context(), tenant.ID, auth.ID); err != nil {
+		if errors.Is(err, storage.ErrDeviceAuthorizationNotFound) {
+			return deviceError(c, "invalid_grant", "Unknown device code")
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to complete device authorization",
+		})
+	}
+
+	user, err := h.storage.GetUser(c.Context(), auth.UserID)
+	if err != nil || user.TenantID != tenant.ID || user.IsSuspended() {
+		return deviceError(c, "access_denied", "The approving user can no longer sign in")
+	}
+
+	var env *models.Environment
+	if user.EnvironmentID != "" {
+		env, err = h.storage.GetEnvironment(c.Context(), user.EnvironmentID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to generate token",
+			})
+		}
+	}
+
+	client, err := h.registeredClient(c, tenant.ID, auth.ClientID)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	token, err := h.generateToken(c.Context(), tenant, user, env, client, auth.Scopes)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate token",
+		})
+	}
+
+	if err := h.storage.UpdateUserLastLogin(c.Context(), user.ID); err != nil {
+		c.Locals("error", err)
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	response := fiber.Map{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   expiresIn(tenant, client),
+	}
+	if len(auth.Scopes) > 0 {
+		response["scope"] = strings.Join(auth.Scopes, " ")
+	}
+	return c.JSON(response)
+}
+
+// GetDeviceAuthorization shows the signed-in user what a user code would
+// let in, before they approve it. The consent screen asks about new_scopes,
+// which the user has not let the client have before.
+func (h *AuthHandler) GetDeviceAuthorization(c *fiber.Ctx) error {
+	auth, err := h.pendingDeviceAuthorization(c, c.Query("user_code"))
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	claims := c.Locals("user").(*models.Claims)
+	granted, missing, err := h.consentedScopes(c, auth.TenantID, claims.UserID, auth.ClientID, auth.Scopes)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load consent",
+		})
+	}
+	if missing == nil {
+		missing = []string{}
+	}
+
+	return c.JSON(fiber.Map{
+		"user_code":      formatUserCode(auth.UserCode),
+		"client_id":      auth.ClientID,
+		"scopes":         auth.Scopes,
+		"granted_scopes": granted,
+		"new_scopes":     missing,
+		"expires_at":     auth.ExpiresAt,
+	})
+}
+
+// VerifyDevice lets the signed-in user approve or deny a device, which is
+// then signed in as them. Approving records the user's consent to the
+// client having the scopes it asked for.
+func (h *AuthHandler) VerifyDevice(c *fiber.Ctx) error {
+	var req VerifyDeviceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	auth, err := h.pendingDeviceAuthorization(c, req.UserCode)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	claims := c.Locals("user").(*models.Claims)
+	auth.Status = models.DeviceDenied
+	if *req.Approve {
+		if err := h.grantConsent(c, auth.TenantID, claims.UserID, auth.ClientID, auth.Scopes); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to record consent",
+			})
+		}
+		auth.Status = models.DeviceApproved
+		auth.UserID = claims.UserID
+	}
+	auth.UpdatedAt = time.Now()
+
+	if err := h.storage.UpdateDeviceAuthorization(c.Context(), auth); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update device authorization",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":   "Device " + string(auth.Status),
+		"client_id": auth.ClientID,
+	})
+}
+
+// pendingDeviceAuthorization finds the live, undecided authorization of the
+// request's tenant with userCode, as the user typed it.
+func (h *AuthHandler) pendingDeviceAuthorization(c *fiber.Ctx, userCode string) (*models.DeviceAuthorization, error) {
+	tenant := middleware.TenantFromContext(c)
+	auth, err := h.storage.GetDeviceAuthorizationByUserCode(c.Context(), tenant.ID, normalizeUserCode(userCode))
+	if errors.Is(err, storage.ErrDeviceAuthorizationNotFound) || err == nil && (auth.Expired() || auth.Status != models.DevicePending) {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Unknown or expired user code")
+	}
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to load device authorization")
+	}
+	return auth, nil
+}
+
+// deviceError answers in the format of RFC 6749 section 5.2, which device
+// clients branch on.
+func deviceError(c *fiber.Ctx, code, description string) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func hashDeviceCode(deviceCode string) string {
+	sum := sha256.Sum256([]byte(deviceCode))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// formatUserCode splits the code in two halves, which are easier to read
+// off a screen and type.
+func formatUserCode(code string) string {
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// normalizeUserCode forgives the case, dashes, and spaces users type.
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+func verificationURIComplete(verificationURI, userCode string) string {
+	u, err := url.Parse(verificationURI)
+	if err != nil {
+		return verificationURI
+	}
+	query := u.Query()
+	query.Set("user_code", userCode)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
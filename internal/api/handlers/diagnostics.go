@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"database/sql"
+	"runtime"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+type DiagnosticsHandler struct {
+	storage        storage.Storage
+	rateLimitStore middleware.RateLimitStore
+	startedAt      time.Time
+}
+
+func NewDiagnosticsHandler(storage storage.Storage, rateLimitStore middleware.RateLimitStore) *DiagnosticsHandler {
+	return &DiagnosticsHandler{
+		storage:        storage,
+		rateLimitStore: rateLimitStore,
+		startedAt:      time.Now(),
+	}
+}
+
+// Runtime reports goroutine, GC, and heap statistics along with the sizes
+// of the database pool and the in-memory rate limit counters.
+func (h *DiagnosticsHandler) Runtime(c *fiber.Ctx) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := fiber.Map{
+		"uptime_seconds": int64(time.Since(h.startedAt).Seconds()),
+		"go_version":     runtime.Version(),
+		"goroutines":     runtime.NumGoroutine(),
+		"gomaxprocs":     runtime.GOMAXPROCS(0),
+		"memory": fiber.Map{
+			"alloc_bytes":       mem.Alloc,
+			"total_alloc_bytes": mem.TotalAlloc,
+			"sys_bytes":         mem.Sys,
+			"heap_alloc_bytes":  mem.HeapAlloc,
+			"heap_inuse_bytes":  mem.HeapInuse,
+			"heap_idle_bytes":   mem.HeapIdle,
+			"heap_objects":      mem.HeapObjects,
+			"stack_inuse_bytes": mem.StackInuse,
+		},
+		"gc": fiber.Map{
+			"num_gc":          mem.NumGC,
+			"num_forced_gc":   mem.NumForcedGC,
+			"pause_total_ns":  mem.PauseTotalNs,
+			"last_pause_ns":   mem.PauseNs[(mem.NumGC+255)%256],
+			"last_gc":         time.Unix(0, int64(mem.LastGC)),
+			"next_gc_bytes":   mem.NextGC,
+			"gc_cpu_fraction": mem.GCCPUFraction,
+		},
+	}
+
+	if pooled, ok := h.storage.(interface{ DBStats() sql.DBStats }); ok {
+		pool := pooled.DBStats()
+		stats["db_pool"] = fiber.Map{
+			"max_open":      pool.MaxOpenConnections,
+			"open":          pool.OpenConnections,
+			"in_use":        pool.InUse,
+			"idle":          pool.Idle,
+			"wait_count":    pool.WaitCount,
+			"wait_duration": pool.WaitDuration.String(),
+		}
+	}
+
+	if counted, ok := h.rateLimitStore.(interface{ Len() int }); ok {
+		stats["rate_limit_counters"] = counted.Len()
+	}
+
+	return c.JSON(stats)
+}
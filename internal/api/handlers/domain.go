@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/domains"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+type DomainHandler struct {
+	storage  storage.Storage
+	verifier *domains.Verifier
+}
+
+func NewDomainHandler(storage storage.Storage, verifier *domains.Verifier) *DomainHandler {
+	return &DomainHandler{
+		storage:  storage,
+		verifier: verifier,
+	}
+}
+
+type ClaimDomainRequest struct {
+	Domain string `json:"domain" validate:"required,fqdn"`
+}
+
+// DomainClaimResponse is a claim with the TXT record that proves it.
+type DomainClaimResponse struct {
+	*models.DomainClaim
+	Record ChallengeRecord `json:"record"`
+}
+
+type ChallengeRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func newDomainClaimResponse(claim *models.DomainClaim) DomainClaimResponse {
+	return DomainClaimResponse{
+		DomainClaim: claim,
+		Record: ChallengeRecord{
+			Name:  domains.ChallengeName(claim.Domain),
+			Type:  "TXT",
+			Value: domains.ChallengeValue(claim.Token),
+		},
+	}
+}
+
+func (h *DomainHandler) ClaimDomain(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	var req ClaimDomainRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	req.Domain = domains.Normalize(req.Domain)
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	token, err := keys.GenerateSecret(16)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate verification token",
+		})
+	}
+
+	claim := &models.DomainClaim{
+		TenantID:  tenant.ID,
+		Domain:    req.Domain,
+		Token:     token,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := h.storage.CreateDomainClaim(c.Context(), claim); err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Domain already claimed by this tenant",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(newDomainClaimResponse(claim))
+}
+
+func (h *DomainHandler) ListDomains(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	claims, err := h.storage.ListDomainClaims(c.Context(), tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch domains",
+		})
+	}
+
+	responses := make([]DomainClaimResponse, 0, len(claims))
+	for _, claim := range claims {
+		responses = append(responses, newDomainClaimResponse(claim))
+	}
+	return c.JSON(fiber.Map{
+		"domains": responses,
+	})
+}
+
+// VerifyDomain looks up the claim's TXT record and marks the claim verified
+// when it is published. A domain can only be verified by one tenant at a time.
+func (h *DomainHandler) VerifyDomain(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	claim, err := h.storage.GetDomainClaim(c.Context(), tenant.ID, c.Params("domain_id"))
+	if errors.Is(err, storage.ErrDomainClaimNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Domain not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch domain",
+		})
+	}
+	if claim.Verified() {
+		return c.JSON(newDomainClaimResponse(claim))
+	}
+
+	owner, err := h.storage.FindVerifiedDomain(c.Context(), claim.Domain)
+	if err == nil && owner.TenantID != tenant.ID {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Domain is verified by another tenant",
+		})
+	}
+	if err != nil && !errors.Is(err, storage.ErrDomainClaimNotFound) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch domain",
+		})
+	}
+
+	if err := h.verifier.Verify(c.Context(), claim); err != nil {
+		if errors.Is(err, domains.ErrChallengeNotFound) {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error":  "Verification record not found",
+				"record": newDomainClaimResponse(claim).Record,
+			})
+		}
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "DNS lookup failed",
+		})
+	}
+
+	now := time.Now()
+	claim.VerifiedAt = &now
+	claim.UpdatedAt = now
+	if err := h.storage.UpdateDomainClaim(c.Context(), claim); err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Domain is verified by another tenant",
+		})
+	}
+
+	return c.JSON(newDomainClaimResponse(claim))
+}
+
+func (h *DomainHandler) DeleteDomain(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	err := h.storage.DeleteDomainClaim(c.Context(), tenant.ID, c.Params("domain_id"))
+	if errors.Is(err, storage.ErrDomainClaimNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Domain not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete domain",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// DiscoverTenant tells a login page which tenant an email address belongs
+// to, by the tenant that verified its domain.
+func (h *DomainHandler) DiscoverTenant(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	return c.JSON(fiber.Map{
+		"tenant_id":   tenant.ID,
+		"tenant_name": tenant.Name,
+	})
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+type EnvironmentHandler struct {
+	storage storage.Storage
+	secrets *vault.Vault
+}
+
+func NewEnvironmentHandler(storage storage.Storage, secrets *vault.Vault) *EnvironmentHandler {
+	return &EnvironmentHandler{
+		storage: storage,
+		secrets: secrets,
+	}
+}
+
+type CreateEnvironmentRequest struct {
+	ID              string `json:"id" validate:"omitempty,resource_id"`
+	Name            string `json:"name" validate:"required,alphanum,min=2,max=32"`
+	RateLimitIP     int    `json:"rate_limit_ip" validate:"required,min=1"`
+	RateLimitUser   int    `json:"rate_limit_user" validate:"required,min=1"`
+	RateLimitWindow int    `json:"rate_limit_window" validate:"required,min=1"`
+}
+
+type CreateEnvironmentResponse struct {
+	Environment *models.Environment `json:"environment"`
+	APIKey      string              `json:"api_key,omitempty"`
+}
+
+func sameEnvironmentDefinition(env *models.Environment, req CreateEnvironmentRequest) bool {
+	return env.Name == req.Name &&
+		env.RateLimitIP == req.RateLimitIP &&
+		env.RateLimitUser == req.RateLimitUser &&
+		env.RateLimitWindow == req.RateLimitWindow
+}
+
+func (h *EnvironmentHandler) CreateEnvironment(c *fiber.Ctx) error {
+	tenantID := middleware.TenantFromContext(c).ID
+
+	var req CreateEnvironmentRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if req.ID != "" {
+		existing, err := h.storage.GetEnvironment(c.Context(), req.ID)
+		if err == nil {
+			if existing.TenantID != tenantID || !sameEnvironmentDefinition(existing, req) {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": "Environment already exists with a different definition",
+				})
+			}
+			// The API key is only revealed by the create that generated it.
+			return c.JSON(CreateEnvironmentResponse{
+				Environment: existing,
+			})
+		}
+		if err != storage.ErrEnvironmentNotFound {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to fetch environment",
+			})
+		}
+	}
+
+	if _, err := h.storage.GetEnvironmentByName(c.Context(), tenantID, req.Name); err == nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Environment already exists",
+		})
+	}
+
+	secret, err := keys.NewEnvironmentKey(c.Context(), h.secrets, tenantID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate signing key",
+		})
+	}
+
+	apiKey, apiKeyPrefix, err := keys.GenerateAPIKey(req.Name)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate API key",
+		})
+	}
+
+	env := &models.Environment{
+		ID:              req.ID,
+		TenantID:        tenantID,
+		Name:            req.Name,
+		APIKeyHash:      keys.HashAPIKey(apiKey),
+		APIKeyPrefix:    apiKeyPrefix,
+		SigningKey:      secret,
+		RateLimitIP:     req.RateLimitIP,
+		RateLimitUser:   req.RateLimitUser,
+		RateLimitWindow: req.RateLimitWindow,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+
+	if err := h.storage.CreateEnvironment(c.Context(), env); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create environment",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(CreateEnvironmentResponse{
+		Environment: env,
+		APIKey:      apiKey,
+	})
+}
+
+func (h *EnvironmentHandler) ListEnvironments(c *fiber.Ctx) error {
+	tenantID := middleware.TenantFromContext(c).ID
+
+	envs, err := h.storage.ListEnvironments(c.Context(), tenantID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch environments",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"environments": envs,
+	})
+}
+
+func (h *EnvironmentHandler) GetEnvironment(c *fiber.Ctx) error {
+	env, err := h.environment(c)
+	if err != nil {
+		return environmentError(c, err)
+	}
+	return c.JSON(env)
+}
+
+// GetAPIKey describes the environment's API key. Only a hash is stored, so the
+// key itself cannot be returned.
+func (h *EnvironmentHandler) GetAPIKey(c *fiber.Ctx) error {
+	env, err := h.environment(c)
+	if err != nil {
+		return environmentError(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"environment_id": env.ID,
+		"prefix":         env.APIKeyPrefix,
+		"created_at":     env.CreatedAt,
+	})
+}
+
+func (h *EnvironmentHandler) environment(c *fiber.Ctx) (*models.Environment, error) {
+	env, err := h.storage.GetEnvironment(c.Context(), c.Params("environment_id"))
+	if err != nil {
+		return nil, err
+	}
+	if env.TenantID != middleware.TenantFromContext(c).ID {
+		return nil, storage.ErrEnvironmentNotFound
+	}
+	return env, nil
+}
+
+func environmentError(c *fiber.Ctx, err error) error {
+	if err == storage.ErrEnvironmentNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Environment not found",
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Failed to fetch environment",
+	})
+}
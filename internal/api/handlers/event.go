@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/events"
+	"github.com/tajious/heimdall/internal/middleware"
+)
+
+// keepaliveInterval keeps proxies from closing an idle event stream.
+const keepaliveInterval = 15 * time.Second
+
+type EventHandler struct {
+	broker *events.Broker
+}
+
+func NewEventHandler(broker *events.Broker) *EventHandler {
+	return &EventHandler{
+		broker: broker,
+	}
+}
+
+type StreamEventsRequest struct {
+	Types string `query:"types"`
+}
+
+// StreamEvents pushes the tenant's security events as Server-Sent Events
+// until the client goes away. When the client reads too slowly, events are
+// dropped and a "dropped" event tells how many were lost so far.
+func (h *EventHandler) StreamEvents(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	var req StreamEventsRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid query parameters",
+		})
+	}
+	var types []string
+	for _, t := range strings.Split(req.Types, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if _, ok := events.Default.Lookup(t); !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Unknown event type %q", t),
+			})
+		}
+		types = append(types, t)
+	}
+
+	sub, err := h.broker.Subscribe(tenant.ID, types)
+	if errors.Is(err, events.ErrTooManySubscribers) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Too many event streams open for the tenant",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to subscribe to events",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set("X-Accel-Buffering", "no")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer h.broker.Unsubscribe(sub)
+
+		keepalive := time.NewTicker(keepaliveInterval)
+		defer keepalive.Stop()
+
+		// Flushing right away sends the headers, so the client knows the
+		// stream is open before the first event.
+		fmt.Fprint(w, ": subscribed\n\n")
+		if err := w.Flush(); err != nil {
+			return
+		}
+
+		var reported int64
+		for {
+			select {
+			case event := <-sub.C:
+				data, err := json.Marshal(event)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+			}
+			if dropped := sub.Dropped(); dropped > reported {
+				reported = dropped
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+			}
+			// A failed flush means the client went away.
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/tajious/heimdall/internal/blob"
+	"github.com/tajious/heimdall/internal/exports"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/search"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+type ExportHandler struct {
+	storage   storage.Storage
+	blobs     blob.Store
+	userIndex search.UserIndex
+	urlTTL    time.Duration
+}
+
+// NewExportHandler queues exports that the job runner writes to blobs, and
+// hands out download URLs lasting urlTTL. Exports are disabled when blobs
+// is nil.
+func NewExportHandler(storage storage.Storage, blobs blob.Store, userIndex search.UserIndex, urlTTL time.Duration) *ExportHandler {
+	return &ExportHandler{
+		storage:   storage,
+		blobs:     blobs,
+		userIndex: userIndex,
+		urlTTL:    urlTTL,
+	}
+}
+
+// RequestUserExport queues an export of every user matching the ListUsers
+// filters, oldest first unless sort_by and sort_dir say otherwise.
+func (h *ExportHandler) RequestUserExport(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	req := ListUsersRequest{SortBy: "created_at", SortDir: "asc"}
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid query parameters",
+		})
+	}
+	req.Page, req.PageSize = 1, 1
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	filter, err := userFilter(c, h.userIndex, tenant, req)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return h.enqueue(c, tenant, models.JobExportUsers, filter)
+}
+
+// RequestAuditLogExport queues an export of the tenant's audit log, newest
+// first, as it stands now.
+func (h *ExportHandler) RequestAuditLogExport(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	var req ExportAuditLogsRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid query parameters",
+		})
+	}
+
+	return h.enqueue(c, tenant, models.JobExportAuditLogs, storage.AuditLogFilter{
+		TenantID: tenant.ID,
+		ActorID:  utils.CopyString(req.ActorID),
+		Action:   utils.CopyString(req.Action),
+		Until:    time.Now(),
+	})
+}
+
+func (h *ExportHandler) enqueue(c *fiber.Ctx, tenant *models.Tenant, kind models.JobKind, filter any) error {
+	if h.blobs == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "No blob store is configured",
+		})
+	}
+
+	var requestedBy string
+	if claims, ok := c.Locals("user").(*models.Claims); ok {
+		requestedBy = claims.UserID
+	}
+	job, err := exports.Enqueue(c.Context(), h.storage, tenant.ID, kind, filter, requestedBy)
+	if errors.Is(err, exports.ErrInProgress) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "An export is already in progress",
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to queue the %s export of tenant %s: %v", kind, tenant.ID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to queue export",
+		})
+	}
+
+	c.Location(c.Path() + "/" + job.ID)
+	return c.Status(fiber.StatusAccepted).JSON(JobResponse{Job: job})
+}
+
+func (h *ExportHandler) ListUserExports(c *fiber.Ctx) error {
+	return h.list(c, models.JobExportUsers)
+}
+
+func (h *ExportHandler) ListAuditLogExports(c *fiber.Ctx) error {
+	return h.list(c, models.JobExportAuditLogs)
+}
+
+// list returns the tenant's exports of kind, newest first, without their
+// download URLs.
+func (h *ExportHandler) list(c *fiber.Ctx, kind models.JobKind) error {
+	tenant := middleware.TenantFromContext(c)
+
+	jobs, err := h.storage.ListJobs(c.Context(), tenant.ID, kind)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch exports",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"exports": jobs,
+	})
+}
+
+func (h *ExportHandler) GetUserExport(c *fiber.Ctx) error {
+	return h.get(c, models.JobExportUsers)
+}
+
+func (h *ExportHandler) GetAuditLogExport(c *fiber.Ctx) error {
+	return h.get(c, models.JobExportAuditLogs)
+}
+
+// get returns the status of an export, for polling, with a download URL
+// once it succeeded.
+func (h *ExportHandler) get(c *fiber.Ctx, kind models.JobKind) error {
+	tenant := middleware.TenantFromContext(c)
+
+	job, err := h.storage.GetJob(c.Context(), tenant.ID, c.Params("export_id"))
+	if errors.Is(err, storage.ErrJobNotFound) || (err == nil && job.Kind != kind) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Export not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch export",
+		})
+	}
+
+	return jobResponse(c, h.blobs, h.urlTTL, job)
+}
+
+// DownloadBlob serves the URLs signed by stores that have the API serve
+// their blobs. The signature is the only credential.
+func (h *ExportHandler) DownloadBlob(c *fiber.Ctx) error {
+	reader, ok := h.blobs.(blob.SignedReader)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Not found",
+		})
+	}
+
+	query, err := url.ParseQuery(string(c.Request().URI().QueryString()))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid query parameters",
+		})
+	}
+	data, err := reader.ReadSigned(c.Context(), c.Params("*"), query)
+	switch {
+	case err == nil:
+	case errors.Is(err, blob.ErrInvalidSignature):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Download URL is invalid or expired",
+		})
+	case errors.Is(err, blob.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Not found",
+		})
+	default:
+		log.Printf("Failed to read a signed blob: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read blob",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, mimeNDJSON)
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+path.Base(c.Params("*"))+`"`)
+	return c.Send(data)
+}
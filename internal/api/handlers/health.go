@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/breaker"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+type HealthHandler struct {
+	storage  storage.Storage
+	database *breaker.Breaker
+	breakers []*breaker.Breaker
+}
+
+func NewHealthHandler(storage storage.Storage) *HealthHandler {
+	return &HealthHandler{
+		storage: storage,
+	}
+}
+
+// Watch feeds readiness checks into the database breaker, and reports its
+// state and that of the other dependencies' breakers.
+func (h *HealthHandler) Watch(database *breaker.Breaker, others ...*breaker.Breaker) {
+	h.database = database
+	h.breakers = append([]*breaker.Breaker{database}, others...)
+}
+
+// Live reports that the process is up and serving requests.
+func (h *HealthHandler) Live(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status": "ok",
+	})
+}
+
+// Ready reports whether the storage backend is reachable, and the state of
+// every dependency with a degraded mode. The instance stays ready while a
+// dependency other than the database is degraded.
+func (h *HealthHandler) Ready(c *fiber.Ctx) error {
+	err := h.storage.Ping(c.Context())
+	h.database.Record(err)
+
+	status := "ok"
+	dependencies := fiber.Map{}
+	for _, b := range h.breakers {
+		if b == nil {
+			continue
+		}
+		state := b.State()
+		dependency := fiber.Map{"state": state}
+		if state != breaker.Closed {
+			status = "degraded"
+			dependency["fallback"] = b.Fallback()
+		}
+		dependencies[b.Name()] = dependency
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"status":       "unavailable",
+			"error":        "Database unreachable",
+			"dependencies": dependencies,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":       status,
+		"dependencies": dependencies,
+	})
+}
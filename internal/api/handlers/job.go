@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/blob"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+type JobHandler struct {
+	storage storage.Storage
+	blobs   blob.Store
+	urlTTL  time.Duration
+}
+
+// NewJobHandler hands out download URLs lasting urlTTL for the exports
+// written to blobs.
+func NewJobHandler(storage storage.Storage, blobs blob.Store, urlTTL time.Duration) *JobHandler {
+	return &JobHandler{
+		storage: storage,
+		blobs:   blobs,
+		urlTTL:  urlTTL,
+	}
+}
+
+// JobResponse is a job with, once an export succeeded, the URL to download
+// it from.
+type JobResponse struct {
+	*models.Job
+	DownloadURL       string     `json:"download_url,omitempty"`
+	DownloadExpiresAt *time.Time `json:"download_expires_at,omitempty"`
+}
+
+// GetJob returns a job of the caller's tenant, whatever operation started
+// it. Admins only see the jobs their admin scopes cover.
+func (h *JobHandler) GetJob(c *fiber.Ctx) error {
+	claims := c.Locals("user").(*models.Claims)
+
+	ctx := storage.WithTenant(c.Context(), claims.TenantID)
+	job, err := h.storage.GetJob(ctx, claims.TenantID, c.Params("job_id"))
+	if errors.Is(err, storage.ErrJobNotFound) || (err == nil && !claims.HasAdminScope(job.Kind.AdminScope())) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Job not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch job",
+		})
+	}
+
+	return jobResponse(c, h.blobs, h.urlTTL, job)
+}
+
+// jobResponse answers with job, signing a fresh download URL when it is an
+// export that succeeded.
+func jobResponse(c *fiber.Ctx, blobs blob.Store, urlTTL time.Duration, job *models.Job) error {
+	response := JobResponse{Job: job}
+	if job.Status != models.JobSucceeded || job.Key == "" {
+		return c.JSON(response)
+	}
+
+	signer, ok := blobs.(blob.URLSigner)
+	if !ok {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "The blob store cannot sign download URLs",
+		})
+	}
+	expiresAt := time.Now().Add(urlTTL).UTC()
+	downloadURL, err := signer.SignedURL(job.Key, urlTTL)
+	if err != nil {
+		log.Printf("Failed to sign the download URL of job %s: %v", job.ID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to sign download URL",
+		})
+	}
+	if strings.HasPrefix(downloadURL, blob.LocalURLPath) {
+		downloadURL = c.BaseURL() + downloadURL
+	}
+	response.DownloadURL = downloadURL
+	response.DownloadExpiresAt = &expiresAt
+	return c.JSON(response)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/tajious/heimdall/internal/coordination"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+type KillSwitchHandler struct {
+	switches  *middleware.KillSwitches
+	publisher coordination.Publisher
+}
+
+func NewKillSwitchHandler(switches *middleware.KillSwitches, publisher coordination.Publisher) *KillSwitchHandler {
+	return &KillSwitchHandler{
+		switches:  switches,
+		publisher: publisher,
+	}
+}
+
+func (h *KillSwitchHandler) ListKillSwitches(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"kill_switches": h.switches.List(),
+	})
+}
+
+type EngageKillSwitchRequest struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+func (h *KillSwitchHandler) EngageKillSwitch(c *fiber.Ctx) error {
+	var req EngageKillSwitchRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	sw, err := h.switches.Engage(utils.CopyString(c.Params("name")), req.Reason)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	log.Printf("Kill switch %s engaged: %s", sw.Name, sw.Reason)
+	h.broadcast(coordination.Event{
+		Type:   coordination.EventKillSwitch,
+		Name:   sw.Name,
+		Reason: sw.Reason,
+		Active: true,
+	})
+	return c.JSON(sw)
+}
+
+func (h *KillSwitchHandler) ReleaseKillSwitch(c *fiber.Ctx) error {
+	name := utils.CopyString(c.Params("name"))
+	if !h.switches.Release(name) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Kill switch not engaged",
+		})
+	}
+
+	log.Printf("Kill switch %s released", name)
+	h.broadcast(coordination.Event{
+		Type: coordination.EventKillSwitch,
+		Name: name,
+	})
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// broadcast shares a change with the other instances. The local change
+// stands even if that fails.
+func (h *KillSwitchHandler) broadcast(event coordination.Event) {
+	if err := h.publisher.Publish(context.Background(), event); err != nil {
+		log.Printf("Failed to broadcast kill switch %s: %v", event.Name, err)
+	}
+}
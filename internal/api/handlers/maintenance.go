@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/coordination"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+type MaintenanceHandler struct {
+	maintenance *middleware.Maintenance
+	publisher   coordination.Publisher
+}
+
+func NewMaintenanceHandler(maintenance *middleware.Maintenance, publisher coordination.Publisher) *MaintenanceHandler {
+	return &MaintenanceHandler{
+		maintenance: maintenance,
+		publisher:   publisher,
+	}
+}
+
+func (h *MaintenanceHandler) GetMaintenance(c *fiber.Ctx) error {
+	return c.JSON(h.maintenance.Status())
+}
+
+type EnableMaintenanceRequest struct {
+	Reason string `json:"reason" validate:"max=500"`
+}
+
+func (h *MaintenanceHandler) EnableMaintenance(c *fiber.Ctx) error {
+	var req EnableMaintenanceRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	status := h.maintenance.Enable(req.Reason)
+	if status.ReadOnly {
+		return c.JSON(status)
+	}
+	log.Printf("Maintenance mode enabled: %s", req.Reason)
+	h.broadcast(coordination.Event{
+		Type:   coordination.EventMaintenance,
+		Reason: req.Reason,
+		Active: true,
+	})
+	return c.JSON(status)
+}
+
+func (h *MaintenanceHandler) DisableMaintenance(c *fiber.Ctx) error {
+	if !h.maintenance.Disable() {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Read-only instances cannot leave maintenance mode",
+		})
+	}
+	log.Println("Maintenance mode disabled")
+	h.broadcast(coordination.Event{
+		Type: coordination.EventMaintenance,
+	})
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *MaintenanceHandler) broadcast(event coordination.Event) {
+	if err := h.publisher.Publish(context.Background(), event); err != nil {
+		log.Printf("Failed to broadcast maintenance mode change: %v", err)
+	}
+}
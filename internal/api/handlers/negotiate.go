@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const mimeMsgpack = "application/x-msgpack"
+
+// respond writes body as MessagePack when the client asks for it and as JSON
+// otherwise. MessagePack documents use the JSON field names, so internal
+// callers can switch encodings without changing how they read responses.
+func respond(c *fiber.Ctx, body interface{}) error {
+	c.Vary(fiber.HeaderAccept)
+	if c.Accepts(fiber.MIMEApplicationJSON, mimeMsgpack) != mimeMsgpack {
+		return c.JSON(body)
+	}
+
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+	enc.Reset(c.Response().BodyWriter())
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	c.Set(fiber.HeaderContentType, mimeMsgpack)
+	return enc.Encode(body)
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/offboarding"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+type OffboardingHandler struct {
+	offboarder *offboarding.Offboarder
+}
+
+func NewOffboardingHandler(offboarder *offboarding.Offboarder) *OffboardingHandler {
+	return &OffboardingHandler{offboarder: offboarder}
+}
+
+// DeleteTenant deletes a tenant and all of its data, archiving it first
+// when archive=true.
+func (h *OffboardingHandler) DeleteTenant(c *fiber.Ctx) error {
+	tenantID := c.Params("tenant_id")
+	archive := c.QueryBool("archive")
+
+	result, err := h.offboarder.Delete(c.Context(), tenantID, archive)
+	switch {
+	case err == nil:
+		return c.JSON(result)
+	case errors.Is(err, storage.ErrTenantNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Tenant not found",
+		})
+	case errors.Is(err, offboarding.ErrArchivingDisabled):
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Tenant archives are not configured",
+		})
+	default:
+		log.Printf("Failed to delete tenant %s: %v", tenantID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete tenant",
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/plugins"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+type PluginHandler struct {
+	storage storage.Storage
+	runtime *plugins.Runtime
+}
+
+// NewPluginHandler serves tenant WASM plugin deployment. A nil runtime means
+// plugins are disabled on this deployment.
+func NewPluginHandler(storage storage.Storage, runtime *plugins.Runtime) *PluginHandler {
+	return &PluginHandler{
+		storage: storage,
+		runtime: runtime,
+	}
+}
+
+// UploadPluginRequest carries a new version of a plugin. Module is the WASM
+// binary, base64 encoded in JSON.
+type UploadPluginRequest struct {
+	Name          string                   `json:"name" validate:"required,resource_id"`
+	Module        []byte                   `json:"module" validate:"required"`
+	TimeoutMS     int                      `json:"timeout_ms" validate:"min=0,max=5000"`
+	FailurePolicy models.HookFailurePolicy `json:"failure_policy" validate:"omitempty,oneof=open closed"`
+	Activate      bool                     `json:"activate"`
+}
+
+func (h *PluginHandler) UploadPlugin(c *fiber.Ctx) error {
+	if h.runtime == nil {
+		return pluginsDisabled(c)
+	}
+	tenant := middleware.TenantFromContext(c)
+
+	var req UploadPluginRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	stages, err := h.runtime.Inspect(c.Context(), req.Module)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	existing, err := h.storage.ListPluginModules(c.Context(), tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch plugins",
+		})
+	}
+	version := 1
+	for _, module := range existing {
+		if module.Name == req.Name && module.Version >= version {
+			version = module.Version + 1
+		}
+	}
+
+	failurePolicy := req.FailurePolicy
+	if failurePolicy == "" {
+		failurePolicy = models.FailOpen
+	}
+	sum := sha256.Sum256(req.Module)
+	module := &models.PluginModule{
+		TenantID:      tenant.ID,
+		Name:          req.Name,
+		Version:       version,
+		Stages:        stages,
+		SHA256:        hex.EncodeToString(sum[:]),
+		Size:          len(req.Module),
+		Module:        req.Module,
+		TimeoutMS:     req.TimeoutMS,
+		FailurePolicy: failurePolicy,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+
+	if err := h.storage.CreatePluginModule(c.Context(), module); err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Failed to store plugin version, retry the upload",
+		})
+	}
+
+	if req.Activate {
+		if err := h.storage.SetPluginModuleActive(c.Context(), tenant.ID, module.ID, true); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Plugin stored but not activated",
+			})
+		}
+		module.Active = true
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(module)
+}
+
+func (h *PluginHandler) ListPlugins(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	modules, err := h.storage.ListPluginModules(c.Context(), tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch plugins",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"plugins": modules,
+		"enabled": h.runtime != nil,
+	})
+}
+
+// ActivatePlugin makes a version the live one of its plugin. Activating an
+// older version rolls the plugin back.
+func (h *PluginHandler) ActivatePlugin(c *fiber.Ctx) error {
+	if h.runtime == nil {
+		return pluginsDisabled(c)
+	}
+	return h.setActive(c, true)
+}
+
+func (h *PluginHandler) DeactivatePlugin(c *fiber.Ctx) error {
+	return h.setActive(c, false)
+}
+
+func (h *PluginHandler) setActive(c *fiber.Ctx, active bool) error {
+	tenant := middleware.TenantFromContext(c)
+	id := c.Params("plugin_id")
+
+	err := h.storage.SetPluginModuleActive(c.Context(), tenant.ID, id, active)
+	if errors.Is(err, storage.ErrPluginModuleNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Plugin not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update plugin",
+		})
+	}
+
+	if !active && h.runtime != nil {
+		h.runtime.Forget(c.Context(), id)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func pluginsDisabled(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{
+		"error": "WASM plugins are disabled on this deployment",
+	})
+}
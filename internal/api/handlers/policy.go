@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+type PolicyHandler struct {
+	storage storage.Storage
+}
+
+func NewPolicyHandler(storage storage.Storage) *PolicyHandler {
+	return &PolicyHandler{
+		storage: storage,
+	}
+}
+
+type CreatePolicyVersionRequest struct {
+	ID          string            `json:"id" validate:"omitempty,resource_id"`
+	Kind        models.PolicyKind `json:"kind" validate:"required,oneof=terms_of_service privacy_policy"`
+	Version     string            `json:"version" validate:"required,max=50"`
+	URL         string            `json:"url" validate:"omitempty,url"`
+	Required    bool              `json:"required"`
+	PublishedAt *time.Time        `json:"published_at"`
+}
+
+func (h *PolicyHandler) CreatePolicyVersion(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	var req CreatePolicyVersionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	existing, err := h.storage.ListPolicyVersions(c.Context(), tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch policy versions",
+		})
+	}
+	for _, policy := range existing {
+		sameVersion := policy.Kind == req.Kind && policy.Version == req.Version
+		if req.ID != "" && policy.ID == req.ID && sameVersion && policy.URL == req.URL && policy.Required == req.Required {
+			return c.JSON(policy)
+		}
+		if sameVersion || (req.ID != "" && policy.ID == req.ID) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Policy version already exists",
+			})
+		}
+	}
+
+	publishedAt := time.Now()
+	if req.PublishedAt != nil {
+		publishedAt = *req.PublishedAt
+	}
+
+	policy := &models.PolicyVersion{
+		ID:          req.ID,
+		TenantID:    tenant.ID,
+		Kind:        req.Kind,
+		Version:     req.Version,
+		URL:         req.URL,
+		Required:    req.Required,
+		PublishedAt: publishedAt,
+		CreatedAt:   time.Now(),
+	}
+
+	if err := h.storage.CreatePolicyVersion(c.Context(), policy); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create policy version",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(policy)
+}
+
+func (h *PolicyHandler) ListPolicyVersions(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	policies, err := h.storage.ListPolicyVersions(c.Context(), tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch policy versions",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"policies": policies,
+	})
+}
+
+func (h *PolicyHandler) CurrentPolicyVersions(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	policies, err := h.storage.CurrentPolicyVersions(c.Context(), tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch policy versions",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"policies": policies,
+	})
+}
+
+func (h *PolicyHandler) GetPolicyVersion(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	policy, err := h.storage.GetPolicyVersion(c.Context(), c.Params("policy_id"))
+	if err != nil || policy.TenantID != tenant.ID {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Policy version not found",
+		})
+	}
+
+	return c.JSON(policy)
+}
+
+func (h *PolicyHandler) AcceptPolicyVersion(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+	claims := c.Locals("user").(*models.Claims)
+
+	policy, err := h.storage.GetPolicyVersion(c.Context(), c.Params("policy_id"))
+	if err != nil || policy.TenantID != tenant.ID {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Policy version not found",
+		})
+	}
+
+	acceptance := &models.PolicyAcceptance{
+		TenantID:        tenant.ID,
+		UserID:          claims.UserID,
+		PolicyVersionID: policy.ID,
+		Version:         policy.Version,
+		IP:              c.IP(),
+		AcceptedAt:      time.Now(),
+	}
+
+	if err := h.storage.CreatePolicyAcceptance(c.Context(), acceptance); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record policy acceptance",
+		})
+	}
+
+	return c.JSON(acceptance)
+}
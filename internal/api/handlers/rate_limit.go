@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+type RateLimitHandler struct {
+	store       middleware.RateLimitStore
+	rateLimiter *middleware.RateLimiter
+}
+
+func NewRateLimitHandler(store middleware.RateLimitStore, rateLimiter *middleware.RateLimiter) *RateLimitHandler {
+	return &RateLimitHandler{
+		store:       store,
+		rateLimiter: rateLimiter,
+	}
+}
+
+// InspectRateLimits reports the tenant's configured limits, its API quota
+// usage, and the current counters for the given ip and user_id query
+// parameters, including whether the ip is penalized as abusive.
+func (h *RateLimitHandler) InspectRateLimits(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	quota, err := h.store.GetCount(c.Context(), middleware.TenantQuotaKey(tenant.ID))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read rate limit counters",
+		})
+	}
+	usage := fiber.Map{
+		"tenant": quota,
+	}
+	if ip := c.Query("ip"); ip != "" {
+		count, err := h.store.GetCount(c.Context(), middleware.RateLimitIPKey(ip))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to read rate limit counters",
+			})
+		}
+		usage["ip"] = count
+
+		strikes, err := h.store.GetCount(c.Context(), middleware.RateLimitStrikeKey(ip))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to read rate limit counters",
+			})
+		}
+		penalty, err := h.rateLimiter.Penalty(c.Context(), ip)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to read rate limit counters",
+			})
+		}
+		usage["ip_strikes"] = strikes
+		usage["ip_penalty"] = penalty
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		count, err := h.store.GetCount(c.Context(), middleware.RateLimitUserKey(userID))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to read rate limit counters",
+			})
+		}
+		usage["user"] = count
+	}
+
+	return c.JSON(fiber.Map{
+		"limits": fiber.Map{
+			"rate_limit_ip":     tenant.Config.RateLimitIP,
+			"rate_limit_user":   tenant.Config.RateLimitUser,
+			"rate_limit_window": tenant.Config.RateLimitWindow,
+			"api_quota":         tenant.Config.APIQuota,
+		},
+		"usage": usage,
+	})
+}
+
+// maxSimulatedDuration bounds how far a simulation looks ahead.
+const maxSimulatedDuration = 24 * time.Hour
+
+// SimulateRateLimitsRequest describes hypothetical traffic, and optionally
+// limits to try instead of the tenant's.
+type SimulateRateLimitsRequest struct {
+	// Rate is in requests per second.
+	Rate            float64 `json:"rate" validate:"required,gt=0,max=10000"`
+	DurationSeconds int     `json:"duration_seconds" validate:"omitempty,min=1,max=86400"`
+	IP              string  `json:"ip" validate:"omitempty,ip"`
+	UserID          string  `json:"user_id"`
+	// FromCurrent starts from the live counters of the tenant, ip, and
+	// user instead of empty ones.
+	FromCurrent     bool `json:"from_current"`
+	RateLimitIP     *int `json:"rate_limit_ip" validate:"omitempty,min=1"`
+	RateLimitUser   *int `json:"rate_limit_user" validate:"omitempty,min=1"`
+	RateLimitWindow *int `json:"rate_limit_window" validate:"omitempty,min=1"`
+	APIQuota        *int `json:"api_quota" validate:"omitempty,min=0"`
+}
+
+// SimulateRateLimits replays a steady request rate from one IP, and user
+// when given, against the tenant's limits or the ones in the request, and
+// reports whether and when they would trip. Nothing is counted for real.
+func (h *RateLimitHandler) SimulateRateLimits(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	var req SimulateRateLimitsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ipLimit := orConfigured(req.RateLimitIP, tenant.Config.RateLimitIP)
+	userLimit := orConfigured(req.RateLimitUser, tenant.Config.RateLimitUser)
+	window := time.Duration(orConfigured(req.RateLimitWindow, tenant.Config.RateLimitWindow)) * time.Second
+	quota := orConfigured(req.APIQuota, tenant.Config.APIQuota)
+	duration := time.Duration(req.DurationSeconds) * time.Second
+	if duration == 0 {
+		// Long enough to see a counter run out and reset.
+		duration = min(max(3*window, 5*time.Minute), maxSimulatedDuration)
+	}
+	if middleware.SimulationTooLarge(req.Rate, duration) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Simulation too large, lower the rate or the duration",
+		})
+	}
+
+	// The limits in the order requests meet them: the tenant quota, then
+	// the IP, then the user of authenticated requests.
+	var limits []middleware.SimulatedLimit
+	if quota > 0 {
+		limits = append(limits, middleware.SimulatedLimit{Name: "tenant_quota", Limit: quota, Window: time.Minute})
+	}
+	limits = append(limits, middleware.SimulatedLimit{Name: "ip", Limit: ipLimit, Window: window})
+	if req.UserID != "" {
+		limits = append(limits, middleware.SimulatedLimit{Name: "user", Limit: userLimit, Window: window})
+	}
+
+	penalized := false
+	if req.FromCurrent {
+		keys := map[string]string{
+			"tenant_quota": middleware.TenantQuotaKey(tenant.ID),
+			"ip":           middleware.RateLimitIPKey(req.IP),
+			"user":         middleware.RateLimitUserKey(req.UserID),
+		}
+		for i := range limits {
+			if limits[i].Name == "ip" && req.IP == "" {
+				continue
+			}
+			count, err := h.store.GetCount(c.Context(), keys[limits[i].Name])
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to read rate limit counters",
+				})
+			}
+			limits[i].Count = count
+		}
+		if req.IP != "" {
+			penalty, err := h.rateLimiter.Penalty(c.Context(), req.IP)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to read rate limit counters",
+				})
+			}
+			penalized = penalty != middleware.PenaltyOff
+		}
+	}
+
+	result := h.rateLimiter.Simulate(req.Rate, duration, limits, "ip", penalized)
+	return c.JSON(fiber.Map{
+		"enforced":   h.rateLimiter.Enabled(),
+		"simulation": result,
+	})
+}
+
+func orConfigured(override *int, configured int) int {
+	if override != nil {
+		return *override
+	}
+	return configured
+}
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+const (
+	// maxSigningKeys bounds the keys a tenant holds at once, counting
+	// rotated keys until they expire.
+	maxSigningKeys = 10
+
+	defaultRotationGrace = 24 * time.Hour
+)
+
+type SigningKeyHandler struct {
+	storage storage.Storage
+	secrets *vault.Vault
+}
+
+func NewSigningKeyHandler(storage storage.Storage, secrets *vault.Vault) *SigningKeyHandler {
+	return &SigningKeyHandler{
+		storage: storage,
+		secrets: secrets,
+	}
+}
+
+type CreateSigningKeyRequest struct {
+	Name        string              `json:"name" validate:"required,min=2,max=64"`
+	AdminScopes []models.AdminScope `json:"admin_scopes" validate:"omitempty,dive,oneof=users:manage config:manage audit:view"`
+}
+
+type RotateSigningKeyRequest struct {
+	// GraceSeconds is how long the rotated key stays valid, 24 hours by
+	// default and at most 30 days.
+	GraceSeconds *int `json:"grace_seconds" validate:"omitempty,min=0,max=2592000"`
+}
+
+// SigningKeyResponse carries the secret of a key that was just created; it
+// cannot be read back later.
+type SigningKeyResponse struct {
+	SigningKey *models.SigningKey `json:"signing_key"`
+	Secret     string             `json:"secret"`
+}
+
+func (h *SigningKeyHandler) CreateSigningKey(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	var req CreateSigningKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if !fullAdmin(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only full admins can manage signing keys",
+		})
+	}
+	live, err := h.liveKeys(c, tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch signing keys",
+		})
+	}
+	if live >= maxSigningKeys {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Too many signing keys, delete an unused one first",
+		})
+	}
+
+	key := &models.SigningKey{
+		TenantID:    tenant.ID,
+		Name:        req.Name,
+		AdminScopes: slices.Compact(slices.Sorted(slices.Values(req.AdminScopes))),
+	}
+	return h.issue(c, key)
+}
+
+func (h *SigningKeyHandler) ListSigningKeys(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	signingKeys, err := h.storage.ListSigningKeys(c.Context(), tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch signing keys",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"signing_keys": signingKeys,
+	})
+}
+
+// RotateSigningKey issues a successor to a key with the same name and
+// scopes, and lets the key expire after a grace period so its callers can
+// switch over without downtime.
+func (h *SigningKeyHandler) RotateSigningKey(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	var req RotateSigningKeyRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if !fullAdmin(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only full admins can manage signing keys",
+		})
+	}
+
+	current, err := h.storage.GetSigningKey(c.Context(), tenant.ID, c.Params("key_id"))
+	if errors.Is(err, storage.ErrSigningKeyNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Signing key not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch signing key",
+		})
+	}
+	if current.ExpiresAt != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Signing key has already been rotated",
+		})
+	}
+	live, err := h.liveKeys(c, tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch signing keys",
+		})
+	}
+	if live >= maxSigningKeys {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Too many signing keys, delete an unused one first",
+		})
+	}
+
+	grace := defaultRotationGrace
+	if req.GraceSeconds != nil {
+		grace = time.Duration(*req.GraceSeconds) * time.Second
+	}
+	expiresAt := time.Now().Add(grace)
+	current.ExpiresAt = &expiresAt
+	current.UpdatedAt = time.Now()
+	if err := h.storage.UpdateSigningKey(c.Context(), current); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rotate signing key",
+		})
+	}
+
+	successor := &models.SigningKey{
+		TenantID:    tenant.ID,
+		Name:        current.Name,
+		AdminScopes: current.AdminScopes,
+	}
+	return h.issue(c, successor)
+}
+
+func (h *SigningKeyHandler) DeleteSigningKey(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	if !fullAdmin(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only full admins can manage signing keys",
+		})
+	}
+
+	err := h.storage.DeleteSigningKey(c.Context(), tenant.ID, c.Params("key_id"))
+	if errors.Is(err, storage.ErrSigningKeyNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Signing key not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete signing key",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// fullAdmin keeps scoped admins from minting keys that hold the scopes they
+// were denied.
+func fullAdmin(c *fiber.Ctx) bool {
+	claims, _ := c.Locals("user").(*models.Claims)
+	return claims != nil && len(claims.AdminScopes) == 0
+}
+
+// liveKeys counts the tenant's keys that have not expired.
+func (h *SigningKeyHandler) liveKeys(c *fiber.Ctx, tenantID string) (int, error) {
+	existing, err := h.storage.ListSigningKeys(c.Context(), tenantID)
+	if err != nil {
+		return 0, err
+	}
+	live := 0
+	for _, key := range existing {
+		if !key.Expired() {
+			live++
+		}
+	}
+	return live, nil
+}
+
+// issue stores key with a new secret and answers with both.
+func (h *SigningKeyHandler) issue(c *fiber.Ctx, key *models.SigningKey) error {
+	secret, err := keys.GenerateSecret(32)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate signing key",
+		})
+	}
+
+	key.Secret, err = h.secrets.Seal(c.Context(), key.TenantID, secret)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to encrypt signing key",
+		})
+	}
+	key.CreatedAt = time.Now()
+	key.UpdatedAt = time.Now()
+	if err := h.storage.CreateSigningKey(c.Context(), key); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create signing key",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(SigningKeyResponse{
+		SigningKey: key,
+		Secret:     secret,
+	})
+}
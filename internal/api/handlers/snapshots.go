@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"sync"
+
+	"github.com/tajious/heimdall/internal/models"
+)
+
+// tenantSnapshots keeps the last copy of each tenant a token validation
+// read, to validate tokens against while the database is down.
+type tenantSnapshots struct {
+	mu      sync.RWMutex
+	tenants map[string]*models.Tenant
+}
+
+func newTenantSnapshots() *tenantSnapshots {
+	return &tenantSnapshots{tenants: make(map[string]*models.Tenant)}
+}
+
+func (s *tenantSnapshots) put(tenant *models.Tenant) {
+	s.mu.Lock()
+	s.tenants[tenant.ID] = tenant
+	s.mu.Unlock()
+}
+
+func (s *tenantSnapshots) get(tenantID string) *models.Tenant {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tenants[tenantID]
+}
@@ -0,0 +1,374 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+// ssoCookiePrefix names the SSO session cookie, followed by the tenant ID so
+// the sessions of tenants served from one host stay apart.
+const ssoCookiePrefix = "heimdall_sso_"
+
+func ssoCookieName(tenantID string) string {
+	return ssoCookiePrefix + tenantID
+}
+
+// startSSOSession signs the user in to the tenant's other applications as
+// well, when the tenant has SSO sessions on. The cookie is host-only, so it
+// is sent back to the tenant's auth domain alone, and SameSite=None, so the
+// applications can send it from their own origins.
+func (h *AuthHandler) startSSOSession(c *fiber.Ctx, tenant *models.Tenant, user *models.User, client *models.Client) error {
+	if tenant.Config.SSO == nil {
+		return nil
+	}
+
+	secret, err := keys.GenerateSecret(32)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	session := &models.SSOSession{
+		TenantID:      tenant.ID,
+		TokenHash:     keys.HashAPIKey(secret),
+		UserID:        user.ID,
+		EnvironmentID: user.EnvironmentID,
+		ExpiresAt:     now.Add(time.Duration(tenant.Config.SSO.SessionLifetime) * time.Minute),
+		CreatedAt:     now,
+	}
+	if client != nil {
+		session.ClientIDs = []string{client.ID}
+	}
+	if err := h.storage.CreateSSOSession(c.Context(), session); err != nil {
+		return err
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     ssoCookieName(tenant.ID),
+		Value:    secret,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteNoneMode,
+	})
+	return nil
+}
+
+type SSOTokenRequest struct {
+	ClientID string `json:"client_id"`
+}
+
+// SSOToken issues a token to any of the tenant's applications for the SSO
+// session its browser holds, without asking for credentials. An application
+// that names its client_id gets a token following the client's policy.
+func (h *AuthHandler) SSOToken(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+	if err := allowSSOOrigin(c, tenant); err != nil {
+		return errorResponse(c, err)
+	}
+
+	var req SSOTokenRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+	client, err := h.requestingClient(c, tenant.ID, req.ClientID, "")
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	session, err := h.ssoSession(c, tenant)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	user, err := h.storage.GetUser(c.Context(), session.UserID)
+	if err != nil || user.TenantID != tenant.ID || user.IsSuspended() {
+		h.endSSOSession(c, tenant, session)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "SSO session is no longer valid",
+		})
+	}
+
+	var env *models.Environment
+	if session.EnvironmentID != "" {
+		env, err = h.storage.GetEnvironment(c.Context(), session.EnvironmentID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to generate token",
+			})
+		}
+	}
+
+	token, err := h.generateToken(c.Context(), tenant, user, env, client, nil)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate token",
+		})
+	}
+	if client != nil {
+		if err := h.storage.AddSSOSessionClient(c.Context(), tenant.ID, session.ID, client.ID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to update SSO session",
+			})
+		}
+	}
+
+	return loginResponse(c, tenant, models.LoginResponse{
+		Token:     token,
+		ExpiresIn: expiresIn(tenant, client),
+		User:      *user,
+	})
+}
+
+// EndSSOSession signs the browser out of the tenant's applications, and
+// tells the clients issued tokens through the session. Tokens already issued
+// stay valid until they expire.
+func (h *AuthHandler) EndSSOSession(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+	if err := allowSSOOrigin(c, tenant); err != nil {
+		return errorResponse(c, err)
+	}
+
+	session, err := h.ssoSession(c, tenant)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	if h.endSSOSession(c, tenant, session) {
+		h.notifyLogout(tenant, session)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Logout is the end-session endpoint an application sends the browser to
+// for signing the user out. It ends the SSO session like EndSSOSession, then
+// sends the browser back to post_logout_redirect_uri, with state, when the
+// URI is registered for client_id. A browser already signed out is sent back
+// all the same.
+func (h *AuthHandler) Logout(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+	if err := allowSSOOrigin(c, tenant); err != nil {
+		return errorResponse(c, err)
+	}
+
+	redirect := c.Query("post_logout_redirect_uri")
+	if redirect != "" {
+		client, err := h.registeredClient(c, tenant.ID, c.Query("client_id"))
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		if client == nil || !slices.Contains(client.PostLogoutRedirectURIs, redirect) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "post_logout_redirect_uri is not registered for the client",
+			})
+		}
+	}
+
+	session, err := h.ssoSession(c, tenant)
+	var fiberErr *fiber.Error
+	switch {
+	case err == nil:
+		if h.endSSOSession(c, tenant, session) {
+			h.notifyLogout(tenant, session)
+		}
+	case !errors.As(err, &fiberErr) || fiberErr.Code != fiber.StatusUnauthorized:
+		return errorResponse(c, err)
+	}
+
+	if redirect == "" {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+	target, err := url.Parse(redirect)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid post_logout_redirect_uri",
+		})
+	}
+	if state := c.Query("state"); state != "" {
+		query := target.Query()
+		query.Set("state", state)
+		target.RawQuery = query.Encode()
+	}
+	return c.Redirect(target.String(), fiber.StatusFound)
+}
+
+// ssoSession returns the live SSO session of the request's cookie. A
+// cookie of a session that is gone is cleared.
+func (h *AuthHandler) ssoSession(c *fiber.Ctx, tenant *models.Tenant) (*models.SSOSession, error) {
+	secret := c.Cookies(ssoCookieName(tenant.ID))
+	if secret == "" {
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "No SSO session")
+	}
+
+	session, err := h.storage.GetSSOSessionByTokenHash(c.Context(), tenant.ID, keys.HashAPIKey(secret))
+	if errors.Is(err, storage.ErrSSOSessionNotFound) {
+		clearSSOCookie(c, tenant)
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "No SSO session")
+	}
+	if err != nil {
+		c.Locals("error", err)
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch SSO session")
+	}
+	if session.Expired() {
+		h.endSSOSession(c, tenant, session)
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "SSO session has expired")
+	}
+	return session, nil
+}
+
+// endSSOSession deletes session and clears its cookie. It reports whether
+// this request ended the session, rather than finding it gone.
+func (h *AuthHandler) endSSOSession(c *fiber.Ctx, tenant *models.Tenant, session *models.SSOSession) bool {
+	err := h.storage.DeleteSSOSession(c.Context(), tenant.ID, session.ID)
+	if err != nil && !errors.Is(err, storage.ErrSSOSessionNotFound) {
+		c.Locals("error", err)
+	}
+	clearSSOCookie(c, tenant)
+	return err == nil
+}
+
+func clearSSOCookie(c *fiber.Ctx, tenant *models.Tenant) {
+	c.Cookie(&fiber.Cookie{
+		Name:     ssoCookieName(tenant.ID),
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteNoneMode,
+	})
+}
+
+// allowSSOOrigin refuses SSO requests of tenants without SSO sessions, and
+// browser requests from origins the tenant has not allowed, which could
+// otherwise take tokens for whoever is signed in. Allowed origins may read
+// the response with the cookie sent along.
+func allowSSOOrigin(c *fiber.Ctx, tenant *models.Tenant) error {
+	if tenant.Config.SSO == nil {
+		return fiber.NewError(fiber.StatusNotFound, "SSO sessions are not enabled for this tenant")
+	}
+
+	origin := c.Get(fiber.HeaderOrigin)
+	if origin == "" {
+		return nil
+	}
+	if !slices.Contains(tenant.Config.SSO.AllowedOrigins, origin) {
+		return fiber.NewError(fiber.StatusForbidden, "Origin is not allowed to use SSO sessions")
+	}
+	c.Set(fiber.HeaderAccessControlAllowOrigin, origin)
+	c.Set(fiber.HeaderAccessControlAllowCredentials, "true")
+	c.Vary(fiber.HeaderOrigin)
+	return nil
+}
+
+// webOrigins normalizes origins to scheme://host[:port], refusing anything
+// with a path, query, or credentials.
+func webOrigins(origins []string) ([]string, error) {
+	normalized := make([]string, 0, len(origins))
+	for _, origin := range origins {
+		u, err := url.Parse(strings.TrimSuffix(origin, "/"))
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" ||
+			u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return nil, fmt.Errorf("%q is not a web origin such as https://app.example.com", origin)
+		}
+		normalized = append(normalized, strings.ToLower(u.Scheme+"://"+u.Host))
+	}
+	return normalized, nil
+}
+
+// backchannelLogoutEvent marks logout tokens, as OpenID Connect Back-Channel
+// Logout names the event.
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// logoutTokenLifetime is how long a logout token may be checked after it is
+// sent.
+const logoutTokenLifetime = 2 * time.Minute
+
+var backchannelClient = &http.Client{
+	Timeout: 5 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// notifyLogout posts a logout token to the back-channel logout URI of each
+// client issued tokens through session. It runs in the background, so a
+// client that is down does not hold up signing out; failures are logged.
+func (h *AuthHandler) notifyLogout(tenant *models.Tenant, session *models.SSOSession) {
+	if len(session.ClientIDs) == 0 {
+		return
+	}
+	ctx := storage.WithTenant(context.Background(), tenant.ID)
+	go func() {
+		for _, clientID := range session.ClientIDs {
+			client, err := h.storage.GetClient(ctx, tenant.ID, clientID)
+			if errors.Is(err, storage.ErrClientNotFound) {
+				continue
+			}
+			if err == nil && client.BackchannelLogoutURI == "" {
+				continue
+			}
+			if err == nil {
+				err = h.postLogoutToken(ctx, tenant, session, client)
+			}
+			if err != nil {
+				log.Printf("Back-channel logout of client %s of tenant %s failed: %v", clientID, tenant.ID, err)
+			}
+		}
+	}()
+}
+
+// postLogoutToken sends client a logout token for session, signed like the
+// tenant's other tokens.
+func (h *AuthHandler) postLogoutToken(ctx context.Context, tenant *models.Tenant, session *models.SSOSession, client *models.Client) error {
+	now := time.Now()
+	claims := &models.Claims{
+		UserID:    session.UserID,
+		TenantID:  tenant.ID,
+		Type:      models.TokenLogout,
+		SessionID: session.ID,
+		Events:    map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   session.UserID,
+			Audience:  []string{client.ID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(logoutTokenLifetime)),
+		},
+	}
+	token, err := h.keys.Sign(ctx, claims, tenant, nil)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"logout_token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.BackchannelLogoutURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	resp, err := backchannelClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
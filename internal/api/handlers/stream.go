@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+const (
+	mimeNDJSON = "application/x-ndjson"
+	// exportPageSize is how many records an export fetches per query.
+	exportPageSize = 1000
+)
+
+// streamNDJSON answers with one JSON document per line, fetching pages of
+// records until one comes back short. The response is written after the
+// handler returns, so fetch must not touch the request context; the context
+// it is given carries the request's tenant scope instead. A failure midway
+// ends the stream with an {"error": ...} line.
+func streamNDJSON[T any](c *fiber.Ctx, fetch func(ctx context.Context, page int) ([]T, error)) error {
+	ctx := storage.WithTenant(context.Background(), storage.ScopedTenant(c.Context()))
+	c.Set(fiber.HeaderContentType, mimeNDJSON)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		enc := json.NewEncoder(w)
+		for page := 1; ; page++ {
+			records, err := fetch(ctx, page)
+			if err != nil {
+				log.Printf("Export stopped at page %d: %v", page, err)
+				enc.Encode(fiber.Map{"error": "Export failed"})
+				w.Flush()
+				return
+			}
+			for _, record := range records {
+				if err := enc.Encode(record); err != nil {
+					return
+				}
+			}
+			// A failed flush means the client went away.
+			if err := w.Flush(); err != nil || len(records) < exportPageSize {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// errorResponse answers a request with the status and message of a
+// *fiber.Error, or with a bare 500 for any other error.
+func errorResponse(c *fiber.Ctx, err error) error {
+	var fe *fiber.Error
+	if !errors.As(err, &fe) {
+		fe = fiber.ErrInternalServerError
+	}
+	return c.Status(fe.Code).JSON(fiber.Map{
+		"error": fe.Message,
+	})
+}
@@ -1,32 +1,46 @@
 package handlers
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"log"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/authn"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/middleware"
 	"github.com/tajious/heimdall/internal/models"
 	"github.com/tajious/heimdall/internal/storage"
 	"github.com/tajious/heimdall/internal/validation"
+	"github.com/tajious/heimdall/internal/vault"
 )
 
 type TenantHandler struct {
 	storage storage.Storage
+	secrets *vault.Vault
+	keys    *keys.Resolver
 }
 
-func NewTenantHandler(storage storage.Storage) *TenantHandler {
+func NewTenantHandler(storage storage.Storage, secrets *vault.Vault, keys *keys.Resolver) *TenantHandler {
 	return &TenantHandler{
 		storage: storage,
+		secrets: secrets,
+		keys:    keys,
 	}
 }
 
 type CreateTenantRequest struct {
+	ID              string            `json:"id" validate:"omitempty,resource_id"`
 	Name            string            `json:"name" validate:"required,min=3,max=50"`
 	Description     string            `json:"description" validate:"max=500"`
-	AuthMethod      models.AuthMethod `json:"auth_method" validate:"required,oneof=username_password"`
+	AuthMethod      models.AuthMethod `json:"auth_method" validate:"required,oneof=username_password delegated client_certificate"`
 	JWTDuration     int               `json:"jwt_duration" validate:"required,min=1"`
 	RateLimitIP     int               `json:"rate_limit_ip" validate:"required,min=1"`
 	RateLimitUser   int               `json:"rate_limit_user" validate:"required,min=1"`
 	RateLimitWindow int               `json:"rate_limit_window" validate:"required,min=1"`
+	Region          string            `json:"region" validate:"max=64"`
 }
 
 func (h *TenantHandler) CreateTenant(c *fiber.Ctx) error {
@@ -43,8 +57,34 @@ func (h *TenantHandler) CreateTenant(c *fiber.Ctx) error {
 		})
 	}
 
+	if !storage.KnowsRegion(h.storage, req.Region) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Unknown region " + req.Region,
+		})
+	}
+
+	if req.ID != "" {
+		existing, err := h.storage.GetTenant(storage.WithTenant(c.Context(), req.ID), req.ID)
+		if err == nil {
+			if !sameTenantDefinition(existing, req) {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": "Tenant already exists with a different definition",
+				})
+			}
+			return c.JSON(existing)
+		}
+		if err != storage.ErrTenantNotFound {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to fetch tenant",
+			})
+		}
+	}
+
 	tenant := &models.Tenant{
-		Name: req.Name,
+		ID:     req.ID,
+		Name:   req.Name,
+		Status: models.TenantActive,
+		Region: req.Region,
 		Config: models.TenantConfig{
 			AuthMethod:      req.AuthMethod,
 			JWTDuration:     req.JWTDuration,
@@ -62,31 +102,90 @@ func (h *TenantHandler) CreateTenant(c *fiber.Ctx) error {
 		})
 	}
 
+	// The token signing key is sealed once the tenant exists, like its
+	// other secrets.
+	if err := h.setTokenSigningKey(storage.WithTenant(c.Context(), tenant.ID), tenant); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate token signing key",
+		})
+	}
+
 	return c.Status(fiber.StatusCreated).JSON(tenant)
 }
 
+// sameTenantDefinition reports whether a repeated create matches the tenant
+// as it was created, which makes creates with a client-supplied ID idempotent.
+func sameTenantDefinition(tenant *models.Tenant, req CreateTenantRequest) bool {
+	return tenant.Name == req.Name &&
+		tenant.Region == req.Region &&
+		tenant.Config.AuthMethod == req.AuthMethod &&
+		tenant.Config.JWTDuration == req.JWTDuration &&
+		tenant.Config.RateLimitIP == req.RateLimitIP &&
+		tenant.Config.RateLimitUser == req.RateLimitUser &&
+		tenant.Config.RateLimitWindow == req.RateLimitWindow
+}
+
 type UpdateTenantConfigRequest struct {
-	AuthMethod      models.AuthMethod `json:"auth_method" validate:"required,oneof=username_password"`
-	JWTDuration     int               `json:"jwt_duration" validate:"required,min=1"`
-	RateLimitIP     int               `json:"rate_limit_ip" validate:"required,min=1"`
-	RateLimitUser   int               `json:"rate_limit_user" validate:"required,min=1"`
-	RateLimitWindow int               `json:"rate_limit_window" validate:"required,min=1"`
+	AuthMethod                     models.AuthMethod           `json:"auth_method" validate:"required,oneof=username_password delegated client_certificate"`
+	JWTDuration                    int                         `json:"jwt_duration" validate:"required,min=1"`
+	RateLimitIP                    int                         `json:"rate_limit_ip" validate:"required,min=1"`
+	RateLimitUser                  int                         `json:"rate_limit_user" validate:"required,min=1"`
+	RateLimitWindow                int                         `json:"rate_limit_window" validate:"required,min=1"`
+	AttributeSchema                []models.FieldRule          `json:"attribute_schema"`
+	RegistrationFields             []models.FieldRule          `json:"registration_fields"` // former name of attribute_schema
+	DelegatedAuth                  *DelegatedAuthRequest       `json:"delegated_auth"`
+	ClientCertAuth                 *models.ClientCertConfig    `json:"client_cert_auth"`
+	Provisioning                   *models.ProvisioningConfig  `json:"provisioning"`
+	MappingRules                   []models.MappingRule        `json:"mapping_rules"`
+	Features                       map[string]bool             `json:"features"`
+	LoginIdentifiers               []models.LoginIdentifier    `json:"login_identifiers" validate:"omitempty,dive,oneof=username email phone"`
+	UsernamePolicy                 *models.UsernamePolicy      `json:"username_policy"`
+	EnumerationProtection          *bool                       `json:"enumeration_protection"`
+	PrivacyMode                    *bool                       `json:"privacy_mode"`
+	RejectBreachedPasswords        *bool                       `json:"reject_breached_passwords"`
+	MinPasswordScore               *int                        `json:"min_password_score" validate:"omitempty,min=0,max=4"`
+	APIQuota                       *int                        `json:"api_quota" validate:"omitempty,min=0"`
+	RestrictEmailDomains           *bool                       `json:"restrict_email_domains"`
+	LoginHooks                     *LoginHooksRequest          `json:"login_hooks"`
+	OneTimeTokenTypes              []models.TokenType          `json:"one_time_token_types" validate:"omitempty,dive,oneof=action magic_link"`
+	TokenAlgorithm                 *string                     `json:"token_algorithm" validate:"omitempty,oneof=HS256 EdDSA"`
+	DeviceVerificationURI          *string                     `json:"device_verification_uri" validate:"omitempty,url,startswith=https://"`
+	AllowUnregisteredDeviceClients *bool                       `json:"allow_unregistered_device_clients"`
+	Digest                         *DigestRequest              `json:"digest"`
+	SSO                            *SSORequest                 `json:"sso"`
+	TokenResponse                  *models.TokenResponseConfig `json:"token_response"`
 }
 
-func (h *TenantHandler) UpdateTenantConfig(c *fiber.Ctx) error {
-	tenantID := c.Params("tenant_id")
-	if tenantID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Tenant ID is required",
-		})
-	}
+// DigestRequest sets the tenant's digest emails; the "off" schedule stops
+// them.
+type DigestRequest struct {
+	Schedule   string   `json:"schedule" validate:"required,oneof=off daily weekly"`
+	Hour       int      `json:"hour" validate:"min=0,max=23"`
+	Recipients []string `json:"recipients" validate:"required_unless=Schedule off,max=20,dive,email"`
+}
 
-	tenant, err := h.storage.GetTenant(c.Context(), tenantID)
-	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Tenant not found",
-		})
-	}
+// SSORequest sets the tenant's SSO sessions; a zero lifetime turns them
+// off.
+type SSORequest struct {
+	SessionLifetime int      `json:"session_lifetime" validate:"min=0,max=43200"`
+	AllowedOrigins  []string `json:"allowed_origins" validate:"max=50,dive,url"`
+}
+
+// LoginHooksRequest replaces the tenant's login webhooks; an empty list
+// removes them.
+type LoginHooksRequest struct {
+	Secret string             `json:"secret" validate:"required,min=32"`
+	Hooks  []models.LoginHook `json:"hooks" validate:"max=5,dive"`
+}
+
+type DelegatedAuthRequest struct {
+	URL       string `json:"url" validate:"required,url,startswith=https://"`
+	Secret    string `json:"secret" validate:"required,min=32"`
+	TimeoutMS int    `json:"timeout_ms" validate:"min=0,max=30000"`
+}
+
+func (h *TenantHandler) UpdateTenantConfig(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
 
 	var req UpdateTenantConfigRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -106,6 +205,173 @@ func (h *TenantHandler) UpdateTenantConfig(c *fiber.Ctx) error {
 	tenant.Config.RateLimitIP = req.RateLimitIP
 	tenant.Config.RateLimitUser = req.RateLimitUser
 	tenant.Config.RateLimitWindow = req.RateLimitWindow
+	if req.AttributeSchema == nil {
+		req.AttributeSchema = req.RegistrationFields
+	}
+	if req.AttributeSchema != nil {
+		if err := validation.ValidateFieldRules(req.AttributeSchema); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		tenant.Config.AttributeSchema = req.AttributeSchema
+	}
+	if req.DelegatedAuth != nil {
+		tenant.Config.DelegatedAuth = &models.DelegatedAuthConfig{
+			URL:       req.DelegatedAuth.URL,
+			TimeoutMS: req.DelegatedAuth.TimeoutMS,
+		}
+		secret, err := h.secrets.Seal(c.Context(), tenant.ID, req.DelegatedAuth.Secret)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to encrypt delegated auth secret",
+			})
+		}
+		tenant.Config.DelegatedAuthSecret = secret
+	}
+	if req.ClientCertAuth != nil {
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(req.ClientCertAuth.CACertificates)) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "client_cert_auth.ca_certificates holds no PEM certificate",
+			})
+		}
+		tenant.Config.ClientCertAuth = req.ClientCertAuth
+	}
+	if req.Provisioning != nil {
+		tenant.Config.Provisioning = req.Provisioning
+	}
+	if req.MappingRules != nil {
+		if err := validation.ValidateMappingRules(req.MappingRules); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		tenant.Config.MappingRules = req.MappingRules
+	}
+	if req.EnumerationProtection != nil {
+		tenant.Config.EnumerationProtection = *req.EnumerationProtection
+	}
+	if req.PrivacyMode != nil {
+		tenant.Config.PrivacyMode = *req.PrivacyMode
+	}
+	if req.RejectBreachedPasswords != nil {
+		tenant.Config.RejectBreachedPasswords = *req.RejectBreachedPasswords
+	}
+	if req.MinPasswordScore != nil {
+		tenant.Config.MinPasswordScore = *req.MinPasswordScore
+	}
+	if req.APIQuota != nil {
+		tenant.Config.APIQuota = *req.APIQuota
+	}
+	if req.LoginHooks != nil {
+		tenant.Config.LoginHooks = req.LoginHooks.Hooks
+		secret, err := h.secrets.Seal(c.Context(), tenant.ID, req.LoginHooks.Secret)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to encrypt login hook secret",
+			})
+		}
+		tenant.Config.LoginHookSecret = secret
+	}
+	if req.RestrictEmailDomains != nil {
+		tenant.Config.RestrictEmailDomains = *req.RestrictEmailDomains
+	}
+	if req.UsernamePolicy != nil {
+		tenant.Config.UsernamePolicy = req.UsernamePolicy
+	}
+	if req.LoginIdentifiers != nil {
+		tenant.Config.LoginIdentifiers = req.LoginIdentifiers
+	}
+	if req.OneTimeTokenTypes != nil {
+		tenant.Config.OneTimeTokenTypes = req.OneTimeTokenTypes
+	}
+	if req.TokenAlgorithm != nil {
+		if *req.TokenAlgorithm == keys.AlgorithmEdDSA && !h.keys.Ed25519Enabled() {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "EdDSA is not enabled on this deployment",
+			})
+		}
+		tenant.Config.TokenAlgorithm = ""
+		if *req.TokenAlgorithm == keys.AlgorithmEdDSA {
+			tenant.Config.TokenAlgorithm = keys.AlgorithmEdDSA
+		}
+	}
+	if req.DeviceVerificationURI != nil {
+		tenant.Config.DeviceVerificationURI = *req.DeviceVerificationURI
+	}
+	if req.AllowUnregisteredDeviceClients != nil {
+		tenant.Config.AllowUnregisteredDeviceClients = *req.AllowUnregisteredDeviceClients
+	}
+	if req.Digest != nil {
+		tenant.Config.Digest = nil
+		if req.Digest.Schedule != "off" {
+			tenant.Config.Digest = &models.DigestConfig{
+				Schedule:   models.DigestSchedule(req.Digest.Schedule),
+				Hour:       req.Digest.Hour,
+				Recipients: req.Digest.Recipients,
+			}
+		}
+	}
+	if req.SSO != nil {
+		tenant.Config.SSO = nil
+		if req.SSO.SessionLifetime > 0 {
+			origins, err := webOrigins(req.SSO.AllowedOrigins)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			tenant.Config.SSO = &models.SSOConfig{
+				SessionLifetime: req.SSO.SessionLifetime,
+				AllowedOrigins:  origins,
+			}
+		}
+	}
+	if req.TokenResponse != nil {
+		if err := validation.ValidateTokenResponse(req.TokenResponse); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		tenant.Config.TokenResponse = req.TokenResponse
+		if len(req.TokenResponse.Rename) == 0 && len(req.TokenResponse.Extra) == 0 {
+			tenant.Config.TokenResponse = nil
+		}
+	}
+	if req.Features != nil {
+		for name := range req.Features {
+			if !models.IsKnownFeature(name) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "unknown feature " + name,
+				})
+			}
+		}
+		tenant.Config.Features = req.Features
+	}
+	if p := tenant.Config.Provisioning; p != nil {
+		for from, to := range p.AttributeMapping {
+			if _, ok := models.FindFieldRule(tenant.Config.AttributeSchema, to); !ok {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "provisioning maps " + from + " to unknown attribute " + to,
+				})
+			}
+		}
+	}
+	if tenant.Config.AuthMethod == models.Delegated && tenant.Config.DelegatedAuth == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "delegated_auth is required for the delegated auth method",
+		})
+	}
+	if tenant.Config.AuthMethod == models.ClientCertificate && tenant.Config.ClientCertAuth == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "client_cert_auth is required for the client_certificate auth method",
+		})
+	}
+	if tenant.Config.FeatureEnabled(models.FeatureDeviceFlow) && tenant.Config.DeviceVerificationURI == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "device_verification_uri is required for " + string(models.FeatureDeviceFlow),
+		})
+	}
 	tenant.Config.UpdatedAt = time.Now()
 
 	if err := h.storage.UpdateTenantConfig(c.Context(), &tenant.Config); err != nil {
@@ -120,6 +386,41 @@ func (h *TenantHandler) UpdateTenantConfig(c *fiber.Ctx) error {
 	})
 }
 
+type TestMappingRulesRequest struct {
+	Rules      []models.MappingRule   `json:"rules"`
+	Attributes map[string]interface{} `json:"attributes" validate:"required"`
+}
+
+// TestMappingRules evaluates mapping rules against sample identity
+// attributes. The tenant's stored rules are used unless rules are supplied.
+func (h *TenantHandler) TestMappingRules(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	var req TestMappingRulesRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	rules := req.Rules
+	if rules == nil {
+		rules = tenant.Config.MappingRules
+	} else if err := validation.ValidateMappingRules(rules); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(authn.EvaluateMappingRules(rules, req.Attributes))
+}
+
 type ListTenantsRequest struct {
 	Page     int `query:"page" validate:"min=1"`
 	PageSize int `query:"page_size" validate:"min=1,max=100"`
@@ -154,12 +455,29 @@ func (h *TenantHandler) ListTenants(c *fiber.Ctx) error {
 		})
 	}
 
-	tenants, total, err := h.storage.ListTenants(c.Context(), req.Page, req.PageSize)
-	if err != nil {
+	claims, ok := c.Locals("user").(*models.Claims)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User not found in context",
+		})
+	}
+
+	// Callers only read their own tenant, as GET /tenants/:tenant_id lets
+	// them, so the list holds at most that one.
+	tenants := []*models.Tenant{}
+	tenant, err := h.storage.GetTenant(storage.WithTenant(c.Context(), claims.TenantID), claims.TenantID)
+	if err != nil && !errors.Is(err, storage.ErrTenantNotFound) {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to fetch tenants",
 		})
 	}
+	var total int64
+	if err == nil && !tenant.IsSuspended() {
+		total = 1
+		if req.Page == 1 {
+			tenants = append(tenants, tenant)
+		}
+	}
 
 	totalPages := int(total) / req.PageSize
 	if int(total)%req.PageSize > 0 {
@@ -176,24 +494,99 @@ func (h *TenantHandler) ListTenants(c *fiber.Ctx) error {
 }
 
 func (h *TenantHandler) GetTenant(c *fiber.Ctx) error {
-	tenantID := c.Params("tenant_id")
-	if tenantID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Tenant ID is required",
+	return c.JSON(middleware.TenantFromContext(c))
+}
+
+func (h *TenantHandler) GetTenantConfig(c *fiber.Ctx) error {
+	return c.JSON(middleware.TenantFromContext(c).Config)
+}
+
+func (h *TenantHandler) ListEncryptionKeys(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	tenantKeys, err := h.secrets.Keys(c.Context(), tenant.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch encryption keys",
 		})
 	}
 
-	tenant, err := h.storage.GetTenant(c.Context(), tenantID)
+	return c.JSON(fiber.Map{
+		"enabled":         h.secrets.Enabled(),
+		"encryption_keys": tenantKeys,
+	})
+}
+
+// RotateEncryptionKey makes a new data key the one the tenant's secrets are
+// sealed with. Secrets sealed with the older key are sealed again in the
+// background, which drops the older key once done.
+func (h *TenantHandler) RotateEncryptionKey(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	key, err := h.secrets.Rotate(c.Context(), tenant.ID)
+	if errors.Is(err, vault.ErrDisabled) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Tenant encryption is not enabled on this server",
+		})
+	}
+	if errors.Is(err, storage.ErrConflict) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The encryption key is already being rotated",
+		})
+	}
 	if err != nil {
-		if err == storage.ErrTenantNotFound {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Tenant not found",
-			})
-		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch tenant",
+			"error": "Failed to rotate encryption key",
 		})
 	}
 
-	return c.JSON(tenant)
+	// The rotation is done; the job only follows the re-encryption, which
+	// runs for retired keys without it too.
+	now := time.Now()
+	job := &models.Job{
+		TenantID:  tenant.ID,
+		Kind:      models.JobReencrypt,
+		Status:    models.JobPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if claims, ok := c.Locals("user").(*models.Claims); ok {
+		job.RequestedBy = claims.UserID
+	}
+	response := fiber.Map{
+		"encryption_key": key,
+	}
+	if err := h.storage.CreateJob(c.Context(), job); err != nil {
+		log.Printf("Failed to queue the re-encryption job of tenant %s: %v", tenant.ID, err)
+	} else {
+		response["job"] = job
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(response)
+}
+
+// RotateTokenSigningKey gives the tenant a new token signing key. Tokens
+// signed with the previous key stop verifying: at once on this instance, and
+// once JWT_KEY_CACHE_TTL_SECONDS passes on the others.
+func (h *TenantHandler) RotateTokenSigningKey(c *fiber.Ctx) error {
+	tenant := middleware.TenantFromContext(c)
+
+	if err := h.setTokenSigningKey(c.Context(), tenant); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rotate token signing key",
+		})
+	}
+	h.keys.ForgetTenant(tenant.ID)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *TenantHandler) setTokenSigningKey(ctx context.Context, tenant *models.Tenant) error {
+	key, err := keys.NewTenantKey(ctx, h.secrets, tenant.ID)
+	if err != nil {
+		return err
+	}
+	tenant.Config.TokenSigningKey = key
+	tenant.Config.UpdatedAt = time.Now()
+	return h.storage.UpdateTenantConfig(ctx, &tenant.Config)
 }
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+// Problem codes the token debugger adds to those of keys.Diagnosis.
+const (
+	problemTenantNotFound = "tenant_not_found"
+	problemUserNotFound   = "user_not_found"
+	problemUserSuspended  = "user_suspended"
+)
+
+type DebugTokenRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// DebugToken explains a token of the caller's tenant to an admin: its header
+// and claims, the key that verifies it, and every reason token validation
+// refuses it. It never consumes one-time tokens.
+func (h *AuthHandler) DebugToken(c *fiber.Ctx) error {
+	caller, ok := c.Locals("user").(*models.Claims)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User not found in context",
+		})
+	}
+
+	var req DebugTokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if err := validation.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ctx := storage.WithTenant(c.Context(), caller.TenantID)
+	token := strings.TrimPrefix(strings.TrimSpace(req.Token), "Bearer ")
+	diagnosis := h.keys.Explain(ctx, token)
+	// Decoding a token needs no key, but which key verifies it and whether
+	// its user exists are only the business of its own tenant.
+	if diagnosis.TenantID != "" && diagnosis.TenantID != caller.TenantID {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Token belongs to another tenant",
+		})
+	}
+	if diagnosis.Parsed != nil {
+		if err := h.explainSubject(ctx, diagnosis); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to look up the token's tenant or user",
+			})
+		}
+	}
+
+	return c.JSON(diagnosis)
+}
+
+// explainSubject adds the checks token validation makes past the signature:
+// the tenant and the user the token was issued for.
+func (h *AuthHandler) explainSubject(ctx context.Context, diagnosis *keys.Diagnosis) error {
+	claims := diagnosis.Parsed
+	tenant, err := h.storage.GetTenant(ctx, claims.TenantID)
+	switch {
+	case errors.Is(err, storage.ErrTenantNotFound):
+		diagnosis.AddProblem(problemTenantNotFound, "tenant "+claims.TenantID+" does not exist")
+	case err != nil:
+		return err
+	case tenant.Config.IsOneTime(claims.Type):
+		diagnosis.Notes = append(diagnosis.Notes, "this "+string(claims.Type)+" token is one-time: it validates once, and is refused from then on")
+	}
+
+	// A user of another tenant is reported as missing, so the debugger does
+	// not tell which user IDs exist elsewhere.
+	user, err := h.storage.GetUser(ctx, claims.UserID)
+	if err == nil && user.TenantID != claims.TenantID {
+		err = storage.ErrUserNotFound
+	}
+	switch {
+	case errors.Is(err, storage.ErrUserNotFound):
+		message := "user " + claims.UserID + " does not exist"
+		if claims.Synthetic {
+			message = "the token is synthetic, minted for a user that does not exist"
+		}
+		diagnosis.AddProblem(problemUserNotFound, message)
+	case err != nil:
+		return err
+	case user.IsSuspended():
+		diagnosis.AddProblem(problemUserSuspended, "user "+claims.UserID+" is suspended")
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package router
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/api/versioning"
+	"github.com/tajious/heimdall/internal/models"
+)
+
+// routePolicy is the role, and for admin routes the admin scope, a route
+// requires.
+type routePolicy struct {
+	roles []models.Role
+	scope models.AdminScope
+}
+
+var (
+	anyRole     = routePolicy{roles: []models.Role{models.RoleAdmin, models.RoleUser, models.RoleReadOnly}}
+	anyAdmin    = routePolicy{roles: []models.Role{models.RoleAdmin}}
+	usersAdmin  = adminWith(models.AdminScopeUsers)
+	configAdmin = adminWith(models.AdminScopeConfig)
+	auditAdmin  = adminWith(models.AdminScopeAudit)
+)
+
+func adminWith(scope models.AdminScope) routePolicy {
+	return routePolicy{roles: []models.Role{models.RoleAdmin}, scope: scope}
+}
+
+// routeRoles lists the roles, and the admin scope, allowed to call each
+// authenticated route. Access policies and tenant membership are checked on
+// top of it. Every authenticated route needs an entry: SetupRoutes fails
+// otherwise, so a new endpoint is never open to every role by accident.
+var routeRoles = map[string]routePolicy{
+	"GET /me":                                                      anyRole,
+	"POST /me/permissions":                                         anyRole,
+	"GET /tenants/:tenant_id/device/verify":                        anyRole,
+	"POST /tenants/:tenant_id/device/verify":                       anyRole,
+	"GET /tenants/:tenant_id/consents":                             anyRole,
+	"DELETE /tenants/:tenant_id/consents/:client_id":               anyRole,
+	"GET /tenants":                                                 anyRole,
+	"GET /tenants/:tenant_id":                                      anyRole,
+	"GET /tenants/:tenant_id/config":                               anyRole,
+	"PUT /tenants/:tenant_id/config":                               configAdmin,
+	"POST /tenants/:tenant_id/mapping-rules/test":                  configAdmin,
+	"GET /tenants/:tenant_id/users":                                anyRole,
+	"GET /tenants/:tenant_id/users/export":                         usersAdmin,
+	"POST /tenants/:tenant_id/users/exports":                       usersAdmin,
+	"GET /tenants/:tenant_id/users/exports":                        usersAdmin,
+	"GET /tenants/:tenant_id/users/exports/:export_id":             usersAdmin,
+	"PATCH /tenants/:tenant_id/users/:user_id/attributes":          usersAdmin,
+	"PATCH /tenants/:tenant_id/users\\:batch":                      usersAdmin,
+	"POST /tenants/:tenant_id/environments":                        configAdmin,
+	"GET /tenants/:tenant_id/environments":                         anyRole,
+	"GET /tenants/:tenant_id/environments/:environment_id":         anyRole,
+	"GET /tenants/:tenant_id/environments/:environment_id/api-key": configAdmin,
+	"POST /tenants/:tenant_id/policies":                            configAdmin,
+	"GET /tenants/:tenant_id/policies":                             anyRole,
+	"GET /tenants/:tenant_id/policies/:policy_id":                  anyRole,
+	"POST /tenants/:tenant_id/policies/:policy_id/accept":          anyRole,
+	"GET /tenants/:tenant_id/audit-logs":                           auditAdmin,
+	"GET /tenants/:tenant_id/audit-logs/export":                    auditAdmin,
+	"POST /tenants/:tenant_id/audit-logs/exports":                  auditAdmin,
+	"GET /tenants/:tenant_id/audit-logs/exports":                   auditAdmin,
+	"GET /tenants/:tenant_id/audit-logs/exports/:export_id":        auditAdmin,
+	"GET /tenants/:tenant_id/audit-logs/verify":                    auditAdmin,
+	"GET /tenants/:tenant_id/audit-logs/:audit_log_id/changes":     auditAdmin,
+	"GET /tenants/:tenant_id/events/stream":                        auditAdmin,
+	"GET /jobs/:job_id":                                            anyAdmin,
+	"POST /tenants/:tenant_id/plugins":                             configAdmin,
+	"GET /tenants/:tenant_id/plugins":                              configAdmin,
+	"PUT /tenants/:tenant_id/plugins/:plugin_id/active":            configAdmin,
+	"DELETE /tenants/:tenant_id/plugins/:plugin_id/active":         configAdmin,
+	"POST /tenants/:tenant_id/domains":                             configAdmin,
+	"GET /tenants/:tenant_id/domains":                              configAdmin,
+	"POST /tenants/:tenant_id/domains/:domain_id/verify":           configAdmin,
+	"DELETE /tenants/:tenant_id/domains/:domain_id":                configAdmin,
+	"GET /tenants/:tenant_id/encryption-keys":                      configAdmin,
+	"POST /tenants/:tenant_id/encryption-keys/rotate":              configAdmin,
+	"POST /tenants/:tenant_id/token-signing-key/rotate":            configAdmin,
+	"POST /tenants/:tenant_id/signing-keys":                        configAdmin,
+	"GET /tenants/:tenant_id/signing-keys":                         configAdmin,
+	"POST /tenants/:tenant_id/signing-keys/:key_id/rotate":         configAdmin,
+	"DELETE /tenants/:tenant_id/signing-keys/:key_id":              configAdmin,
+	"POST /tenants/:tenant_id/clients":                             configAdmin,
+	"GET /tenants/:tenant_id/clients":                              configAdmin,
+	"GET /tenants/:tenant_id/clients/:client_id":                   configAdmin,
+	"PUT /tenants/:tenant_id/clients/:client_id":                   configAdmin,
+	"DELETE /tenants/:tenant_id/clients/:client_id":                configAdmin,
+	"GET /tenants/:tenant_id/clients/:client_id/encryption-key":    configAdmin,
+	"GET /tenants/:tenant_id/rate-limits":                          configAdmin,
+	"POST /tenants/:tenant_id/rate-limits/simulate":                configAdmin,
+	"POST /debug/token":                                            configAdmin,
+	"POST /tenants/:tenant_id/access-policies":                     configAdmin,
+	"GET /tenants/:tenant_id/access-policies":                      configAdmin,
+	"GET /tenants/:tenant_id/access-policies/:policy_id":           configAdmin,
+	"DELETE /tenants/:tenant_id/access-policies/:policy_id":        configAdmin,
+}
+
+// apiVersion registers the routes of one API version and records them in its
+// OpenAPI document.
+type apiVersion struct {
+	router *Router
+	spec   *versioning.Spec
+}
+
+func (a *apiVersion) public(group fiber.Router, method, path string, handlers ...fiber.Handler) {
+	a.spec.Add(method, path, false)
+	group.Add(method, path, handlers...)
+}
+
+// protect registers an authenticated route behind the role and admin scope
+// checks from routeRoles.
+func (a *apiVersion) protect(group fiber.Router, method, path string, handlers ...fiber.Handler) {
+	key := method + " " + path
+	policy, ok := routeRoles[key]
+	if !ok {
+		if !slices.Contains(a.router.unlisted, key) {
+			a.router.unlisted = append(a.router.unlisted, key)
+		}
+		return
+	}
+	a.router.listed[key] = true
+	a.spec.Add(method, path, true)
+	checks := []fiber.Handler{a.router.authMiddleware.RequireRole(policy.roles...)}
+	if policy.scope != "" {
+		checks = append(checks, a.router.authMiddleware.RequireAdminScope(policy.scope))
+	}
+	group.Add(method, path, append(checks, handlers...)...)
+}
+
+// checkRouteRoles reports authenticated routes missing from routeRoles and
+// entries that match no route.
+func (r *Router) checkRouteRoles() error {
+	var stale []string
+	for key := range routeRoles {
+		if !r.listed[key] {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(stale)
+
+	switch {
+	case len(r.unlisted) > 0:
+		return fmt.Errorf("routes without a role policy: %s", strings.Join(r.unlisted, ", "))
+	case len(stale) > 0:
+		return fmt.Errorf("role policies without a route: %s", strings.Join(stale, ", "))
+	}
+	return nil
+}
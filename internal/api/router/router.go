@@ -4,50 +4,300 @@ import (
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/pprof"
+	"github.com/tajious/heimdall/internal/admin"
 	"github.com/tajious/heimdall/internal/api/handlers"
+	"github.com/tajious/heimdall/internal/api/versioning"
+	"github.com/tajious/heimdall/internal/blob"
+	"github.com/tajious/heimdall/internal/metrics"
 	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
 )
 
 type Router struct {
-	app            *fiber.App
-	authHandler    *handlers.AuthHandler
-	tenantHandler  *handlers.TenantHandler
-	authMiddleware *middleware.AuthMiddleware
-	rateLimiter    *middleware.RateLimiter
+	app                 *fiber.App
+	adminApp            *fiber.App
+	authHandler         *handlers.AuthHandler
+	tenantHandler       *handlers.TenantHandler
+	environmentHandler  *handlers.EnvironmentHandler
+	policyHandler       *handlers.PolicyHandler
+	accessPolicyHandler *handlers.AccessPolicyHandler
+	auditHandler        *handlers.AuditHandler
+	rateLimitHandler    *handlers.RateLimitHandler
+	healthHandler       *handlers.HealthHandler
+	diagnosticsHandler  *handlers.DiagnosticsHandler
+	killSwitchHandler   *handlers.KillSwitchHandler
+	maintenanceHandler  *handlers.MaintenanceHandler
+	offboardingHandler  *handlers.OffboardingHandler
+	exportHandler       *handlers.ExportHandler
+	jobHandler          *handlers.JobHandler
+	pluginHandler       *handlers.PluginHandler
+	domainHandler       *handlers.DomainHandler
+	signingKeyHandler   *handlers.SigningKeyHandler
+	eventHandler        *handlers.EventHandler
+	clientHandler       *handlers.ClientHandler
+	authMiddleware      *middleware.AuthMiddleware
+	auditor             *middleware.Auditor
+	authorizer          *middleware.Authorizer
+	tenantResolver      *middleware.TenantResolver
+	rateLimiter         *middleware.RateLimiter
+	loadShedder         *middleware.LoadShedder
+	killSwitches        *middleware.KillSwitches
+	maintenance         *middleware.Maintenance
+	loginLatency        *middleware.LoginLatency
+	operatorToken       string
+	versions            []versioning.Version
+
+	listed   map[string]bool
+	unlisted []string
 }
 
+// NewRouter wires the public API onto app and the management plane onto
+// adminApp. Pass the same app twice to serve everything from one listener.
 func NewRouter(
 	app *fiber.App,
+	adminApp *fiber.App,
 	authHandler *handlers.AuthHandler,
 	tenantHandler *handlers.TenantHandler,
+	environmentHandler *handlers.EnvironmentHandler,
+	policyHandler *handlers.PolicyHandler,
+	accessPolicyHandler *handlers.AccessPolicyHandler,
+	auditHandler *handlers.AuditHandler,
+	rateLimitHandler *handlers.RateLimitHandler,
+	healthHandler *handlers.HealthHandler,
+	diagnosticsHandler *handlers.DiagnosticsHandler,
+	killSwitchHandler *handlers.KillSwitchHandler,
+	maintenanceHandler *handlers.MaintenanceHandler,
+	offboardingHandler *handlers.OffboardingHandler,
+	exportHandler *handlers.ExportHandler,
+	jobHandler *handlers.JobHandler,
+	pluginHandler *handlers.PluginHandler,
+	domainHandler *handlers.DomainHandler,
+	signingKeyHandler *handlers.SigningKeyHandler,
+	eventHandler *handlers.EventHandler,
+	clientHandler *handlers.ClientHandler,
 	authMiddleware *middleware.AuthMiddleware,
+	auditor *middleware.Auditor,
+	authorizer *middleware.Authorizer,
+	tenantResolver *middleware.TenantResolver,
 	rateLimiter *middleware.RateLimiter,
+	loadShedder *middleware.LoadShedder,
+	killSwitches *middleware.KillSwitches,
+	maintenance *middleware.Maintenance,
+	loginLatency *middleware.LoginLatency,
+	operatorToken string,
+	versions []versioning.Version,
 ) *Router {
 	return &Router{
-		app:            app,
-		authHandler:    authHandler,
-		tenantHandler:  tenantHandler,
-		authMiddleware: authMiddleware,
-		rateLimiter:    rateLimiter,
+		app:                 app,
+		adminApp:            adminApp,
+		authHandler:         authHandler,
+		tenantHandler:       tenantHandler,
+		environmentHandler:  environmentHandler,
+		policyHandler:       policyHandler,
+		accessPolicyHandler: accessPolicyHandler,
+		auditHandler:        auditHandler,
+		rateLimitHandler:    rateLimitHandler,
+		healthHandler:       healthHandler,
+		diagnosticsHandler:  diagnosticsHandler,
+		killSwitchHandler:   killSwitchHandler,
+		maintenanceHandler:  maintenanceHandler,
+		offboardingHandler:  offboardingHandler,
+		exportHandler:       exportHandler,
+		jobHandler:          jobHandler,
+		pluginHandler:       pluginHandler,
+		domainHandler:       domainHandler,
+		signingKeyHandler:   signingKeyHandler,
+		eventHandler:        eventHandler,
+		clientHandler:       clientHandler,
+		authMiddleware:      authMiddleware,
+		auditor:             auditor,
+		authorizer:          authorizer,
+		tenantResolver:      tenantResolver,
+		rateLimiter:         rateLimiter,
+		loadShedder:         loadShedder,
+		killSwitches:        killSwitches,
+		maintenance:         maintenance,
+		loginLatency:        loginLatency,
+		operatorToken:       operatorToken,
+		versions:            versions,
+		listed:              make(map[string]bool),
 	}
 }
 
-func (r *Router) SetupRoutes() {
-	r.app.Post("/api/v1/tenants", r.tenantHandler.CreateTenant)
-	r.app.Post("/api/v1/:tenant_id/login", r.rateLimiter.RateLimit(middleware.RateLimitConfig{
+// SetupRoutes registers every route, once per API version. It fails when an
+// authenticated route has no entry in routeRoles.
+func (r *Router) SetupRoutes() error {
+	// Token validation and authorization checks only read, so they keep
+	// working during maintenance, as do the operator endpoints that end it.
+	exempt := []string{"/operator/"}
+	for _, v := range r.versions {
+		exempt = append(exempt,
+			v.Prefix()+"/validate-token",
+			v.Prefix()+"/authorize",
+			v.Prefix()+"/authorize/batch",
+			v.Prefix()+"/me/permissions",
+		)
+	}
+	paused := r.maintenance.Guard(exempt...)
+	r.app.Use(paused)
+
+	mgmt := r.adminApp
+	if mgmt != r.app {
+		mgmt.Use(paused)
+	}
+	mgmt.Get("/metrics", metrics.Handler(metrics.Default))
+	mgmt.Get("/healthz", r.healthHandler.Live)
+	mgmt.Get("/readyz", r.healthHandler.Ready)
+	mgmt.Use("/admin", admin.Handler())
+
+	operator := middleware.RequireOperator(r.operatorToken)
+	debug := mgmt.Group("/debug", operator)
+	debug.Get("/runtime", r.diagnosticsHandler.Runtime)
+	debug.Use(pprof.New())
+	mgmt.Get("/operator/kill-switches", operator, r.killSwitchHandler.ListKillSwitches)
+	mgmt.Put("/operator/kill-switches/:name", operator, r.killSwitchHandler.EngageKillSwitch)
+	mgmt.Delete("/operator/kill-switches/:name", operator, r.killSwitchHandler.ReleaseKillSwitch)
+	mgmt.Get("/operator/maintenance", operator, r.maintenanceHandler.GetMaintenance)
+	mgmt.Put("/operator/maintenance", operator, r.maintenanceHandler.EnableMaintenance)
+	mgmt.Delete("/operator/maintenance", operator, r.maintenanceHandler.DisableMaintenance)
+	mgmt.Delete("/operator/tenants/:tenant_id", operator, r.offboardingHandler.DeleteTenant)
+	// Export download URLs point at the listener the export was polled on.
+	mgmt.Get(blob.LocalURLPath+"*", r.exportHandler.DownloadBlob)
+
+	r.app.Get("/.well-known/jwks.json", r.authHandler.JWKS)
+	for _, v := range r.versions {
+		r.setupAPI(v, mgmt)
+	}
+
+	return r.checkRouteRoles()
+}
+
+// setupAPI registers the API under the prefix of version v. Every version
+// currently publishes the same routes backed by the same handlers.
+func (r *Router) setupAPI(v versioning.Version, mgmt *fiber.App) {
+	authGroup := r.loadShedder.Limit("auth", middleware.PriorityCritical)
+	managementGroup := r.loadShedder.Limit("management", middleware.PriorityNormal)
+	listingGroup := r.loadShedder.Limit("listing", middleware.PriorityLow)
+
+	loginLimit := r.rateLimiter.RateLimit(middleware.RateLimitConfig{
 		Enabled: true,
 		Limit:   5,
 		Window:  time.Minute,
-	}), r.authHandler.Login)
-	r.app.Post("/api/v1/validate-token", r.authHandler.ValidateToken)
+	})
+	tenant := r.tenantResolver.Resolve()
+	byEmail := r.tenantResolver.ResolveByEmail()
+	quota := r.rateLimiter.TenantQuota()
+	member := r.tenantResolver.RequireMember()
+	tenantAccount := middleware.RequireTenantAccount()
+	can := r.authorizer.Require
+	kill := r.killSwitches.Guard
+	killMethod := r.killSwitches.GuardAuthMethod()
+	timed := r.loginLatency.Track()
+
+	spec := versioning.NewSpec("Heimdall API", v)
+	api := &apiVersion{router: r, spec: spec}
 
-	protected := r.app.Group("/api/v1", r.authMiddleware.Authenticate())
-	protected.Get("/me", func(c *fiber.Ctx) error {
+	r.app.Use(v.Prefix(), v.Headers())
+	if mgmt != r.app {
+		mgmt.Use(v.Prefix(), v.Headers())
+	}
+	public := r.app.Group(v.Prefix())
+	management := mgmt.Group(v.Prefix())
+
+	public.Get("/openapi.json", spec.Handler())
+	api.public(management, fiber.MethodPost, "/tenants", managementGroup, r.tenantHandler.CreateTenant)
+	api.public(public, fiber.MethodPost, "/:tenant_id/login", authGroup, kill(middleware.KillLogin), timed, tenant, quota, killMethod, loginLimit, r.authHandler.Login)
+	api.public(public, fiber.MethodPost, "/:tenant_id/:environment/login", authGroup, kill(middleware.KillLogin), timed, tenant, quota, killMethod, loginLimit, r.authHandler.Login)
+	api.public(public, fiber.MethodPost, "/:tenant_id/register", authGroup, kill(middleware.KillRegister), tenant, quota, killMethod, loginLimit, r.authHandler.Register)
+	api.public(public, fiber.MethodPost, "/:tenant_id/:environment/register", authGroup, kill(middleware.KillRegister), tenant, quota, killMethod, loginLimit, r.authHandler.Register)
+	api.public(public, fiber.MethodPost, "/register", authGroup, kill(middleware.KillRegister), byEmail, quota, killMethod, loginLimit, r.authHandler.Register)
+	api.public(public, fiber.MethodPost, "/discover", authGroup, byEmail, quota, loginLimit, r.domainHandler.DiscoverTenant)
+	api.public(public, fiber.MethodGet, "/:tenant_id/policies", listingGroup, tenant, quota, r.policyHandler.CurrentPolicyVersions)
+	api.public(public, fiber.MethodPost, "/:tenant_id/password/strength", authGroup, tenant, quota, r.authHandler.PasswordStrength)
+	deviceFlow := middleware.RequireFeature(models.FeatureDeviceFlow)
+	api.public(public, fiber.MethodPost, "/:tenant_id/device/code", authGroup, tenant, quota, deviceFlow, loginLimit, r.authHandler.DeviceCode)
+	api.public(public, fiber.MethodPost, "/:tenant_id/device/token", authGroup, tenant, quota, deviceFlow, r.authHandler.DeviceToken)
+	api.public(public, fiber.MethodPost, "/:tenant_id/sso/token", authGroup, kill(middleware.KillLogin), tenant, quota, loginLimit, r.authHandler.SSOToken)
+	api.public(public, fiber.MethodDelete, "/:tenant_id/sso/session", authGroup, tenant, quota, r.authHandler.EndSSOSession)
+	api.public(public, fiber.MethodGet, "/:tenant_id/sso/logout", authGroup, tenant, quota, r.authHandler.Logout)
+	api.public(public, fiber.MethodPost, "/validate-token", authGroup, kill(middleware.KillValidateToken), r.authHandler.ValidateToken)
+	api.public(public, fiber.MethodPost, "/authorize", authGroup, kill(middleware.KillAuthorize), tenant, quota, r.accessPolicyHandler.Authorize)
+	api.public(public, fiber.MethodPost, "/authorize/batch", authGroup, kill(middleware.KillAuthorize), tenant, quota, r.accessPolicyHandler.AuthorizeBatch)
+
+	protected := r.app.Group(v.Prefix(), r.authMiddleware.Authenticate(), r.auditor.Record())
+	managed := protected
+	if mgmt != r.app {
+		// The admin UI signs in against the listener it is served from.
+		management.Post("/:tenant_id/login", authGroup, kill(middleware.KillLogin), timed, tenant, quota, killMethod, loginLimit, r.authHandler.Login)
+		managed = mgmt.Group(v.Prefix(), r.authMiddleware.Authenticate(), r.auditor.Record())
+	}
+	api.protect(protected, fiber.MethodGet, "/me", authGroup, func(c *fiber.Ctx) error {
 		user := c.Locals("user")
 		return c.JSON(user)
 	})
-	protected.Put("/tenants/:tenant_id/config", r.tenantHandler.UpdateTenantConfig)
-	protected.Get("/tenants/:tenant_id/users", r.authHandler.ListUsers)
-	protected.Get("/tenants", r.tenantHandler.ListTenants)
-	protected.Get("/tenants/:tenant_id", r.tenantHandler.GetTenant)
+	api.protect(protected, fiber.MethodPost, "/me/permissions", authGroup, r.accessPolicyHandler.Permissions)
+	api.protect(protected, fiber.MethodGet, "/tenants/:tenant_id/device/verify", authGroup, tenant, quota, member, deviceFlow, loginLimit, r.authHandler.GetDeviceAuthorization)
+	api.protect(protected, fiber.MethodPost, "/tenants/:tenant_id/device/verify", authGroup, tenant, quota, member, deviceFlow, loginLimit, r.authHandler.VerifyDevice)
+	api.protect(protected, fiber.MethodGet, "/tenants/:tenant_id/consents", listingGroup, tenant, quota, member, r.authHandler.ListConsents)
+	api.protect(protected, fiber.MethodDelete, "/tenants/:tenant_id/consents/:client_id", authGroup, tenant, quota, member, r.authHandler.RevokeConsent)
+	api.protect(managed, fiber.MethodPut, "/tenants/:tenant_id/config", managementGroup, tenantAccount, tenant, quota, member, can("tenants:update_config"), r.tenantHandler.UpdateTenantConfig)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/mapping-rules/test", managementGroup, tenantAccount, tenant, quota, member, can("mapping_rules:test"), r.tenantHandler.TestMappingRules)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/users", listingGroup, tenantAccount, tenant, quota, member, can("users:list"), r.authHandler.ListUsers)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/users/export", listingGroup, tenantAccount, tenant, quota, member, can("users:list"), r.authHandler.ExportUsers)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/users/exports", managementGroup, tenantAccount, tenant, quota, member, can("users:list"), r.exportHandler.RequestUserExport)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/users/exports", listingGroup, tenantAccount, tenant, quota, member, can("users:list"), r.exportHandler.ListUserExports)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/users/exports/:export_id", listingGroup, tenantAccount, tenant, quota, member, can("users:list"), r.exportHandler.GetUserExport)
+	api.protect(managed, fiber.MethodPatch, "/tenants/:tenant_id/users/:user_id/attributes", managementGroup, tenantAccount, tenant, quota, member, can("users:update_attributes"), r.authHandler.UpdateUserAttributes)
+	api.protect(managed, fiber.MethodPatch, "/tenants/:tenant_id/users\\:batch", managementGroup, tenantAccount, tenant, quota, member, can("users:batch_update"), r.authHandler.BatchUpdateUsers)
+	api.protect(managed, fiber.MethodGet, "/tenants", listingGroup, tenantAccount, r.tenantHandler.ListTenants)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id", listingGroup, tenantAccount, tenant, quota, member, r.tenantHandler.GetTenant)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/config", listingGroup, tenantAccount, tenant, quota, member, r.tenantHandler.GetTenantConfig)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/environments", managementGroup, tenantAccount, tenant, quota, member, can("environments:create"), r.environmentHandler.CreateEnvironment)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/environments", listingGroup, tenantAccount, tenant, quota, member, can("environments:list"), r.environmentHandler.ListEnvironments)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/environments/:environment_id", listingGroup, tenantAccount, tenant, quota, member, can("environments:get"), r.environmentHandler.GetEnvironment)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/environments/:environment_id/api-key", listingGroup, tenantAccount, tenant, quota, member, can("environments:get"), r.environmentHandler.GetAPIKey)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/policies", managementGroup, tenantAccount, tenant, quota, member, can("policies:create"), r.policyHandler.CreatePolicyVersion)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/policies", listingGroup, tenantAccount, tenant, quota, member, can("policies:list"), r.policyHandler.ListPolicyVersions)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/policies/:policy_id", listingGroup, tenantAccount, tenant, quota, member, can("policies:get"), r.policyHandler.GetPolicyVersion)
+	api.protect(protected, fiber.MethodPost, "/tenants/:tenant_id/policies/:policy_id/accept", managementGroup, tenant, quota, member, can("policies:accept"), r.policyHandler.AcceptPolicyVersion)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/audit-logs", listingGroup, tenantAccount, tenant, quota, member, can("audit_logs:list"), r.auditHandler.ListAuditLogs)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/audit-logs/export", listingGroup, tenantAccount, tenant, quota, member, can("audit_logs:list"), r.auditHandler.ExportAuditLogs)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/audit-logs/exports", managementGroup, tenantAccount, tenant, quota, member, can("audit_logs:list"), r.exportHandler.RequestAuditLogExport)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/audit-logs/exports", listingGroup, tenantAccount, tenant, quota, member, can("audit_logs:list"), r.exportHandler.ListAuditLogExports)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/audit-logs/exports/:export_id", listingGroup, tenantAccount, tenant, quota, member, can("audit_logs:list"), r.exportHandler.GetAuditLogExport)
+	api.protect(managed, fiber.MethodGet, "/jobs/:job_id", listingGroup, tenantAccount, r.jobHandler.GetJob)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/events/stream", listingGroup, tenantAccount, tenant, quota, member, can("events:stream"), r.eventHandler.StreamEvents)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/audit-logs/verify", listingGroup, tenantAccount, tenant, quota, member, can("audit_logs:verify"), r.auditHandler.VerifyAuditLogs)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/audit-logs/:audit_log_id/changes", listingGroup, tenantAccount, tenant, quota, member, can("audit_logs:list"), r.auditHandler.ListDataChanges)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/plugins", managementGroup, tenantAccount, tenant, quota, member, can("plugins:deploy"), r.pluginHandler.UploadPlugin)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/plugins", listingGroup, tenantAccount, tenant, quota, member, can("plugins:list"), r.pluginHandler.ListPlugins)
+	api.protect(managed, fiber.MethodPut, "/tenants/:tenant_id/plugins/:plugin_id/active", managementGroup, tenantAccount, tenant, quota, member, can("plugins:deploy"), r.pluginHandler.ActivatePlugin)
+	api.protect(managed, fiber.MethodDelete, "/tenants/:tenant_id/plugins/:plugin_id/active", managementGroup, tenantAccount, tenant, quota, member, can("plugins:deploy"), r.pluginHandler.DeactivatePlugin)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/domains", managementGroup, tenantAccount, tenant, quota, member, can("domains:claim"), r.domainHandler.ClaimDomain)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/domains", listingGroup, tenantAccount, tenant, quota, member, can("domains:list"), r.domainHandler.ListDomains)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/domains/:domain_id/verify", managementGroup, tenantAccount, tenant, quota, member, can("domains:claim"), r.domainHandler.VerifyDomain)
+	api.protect(managed, fiber.MethodDelete, "/tenants/:tenant_id/domains/:domain_id", managementGroup, tenantAccount, tenant, quota, member, can("domains:claim"), r.domainHandler.DeleteDomain)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/encryption-keys", listingGroup, tenantAccount, tenant, quota, member, can("encryption_keys:list"), r.tenantHandler.ListEncryptionKeys)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/encryption-keys/rotate", managementGroup, tenantAccount, tenant, quota, member, can("encryption_keys:rotate"), r.tenantHandler.RotateEncryptionKey)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/token-signing-key/rotate", managementGroup, tenantAccount, tenant, quota, member, can("token_signing_key:rotate"), r.tenantHandler.RotateTokenSigningKey)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/signing-keys", managementGroup, tenantAccount, tenant, quota, member, can("signing_keys:manage"), r.signingKeyHandler.CreateSigningKey)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/signing-keys", listingGroup, tenantAccount, tenant, quota, member, can("signing_keys:list"), r.signingKeyHandler.ListSigningKeys)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/signing-keys/:key_id/rotate", managementGroup, tenantAccount, tenant, quota, member, can("signing_keys:manage"), r.signingKeyHandler.RotateSigningKey)
+	api.protect(managed, fiber.MethodDelete, "/tenants/:tenant_id/signing-keys/:key_id", managementGroup, tenantAccount, tenant, quota, member, can("signing_keys:manage"), r.signingKeyHandler.DeleteSigningKey)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/clients", managementGroup, tenantAccount, tenant, quota, member, can("clients:manage"), r.clientHandler.CreateClient)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/clients", listingGroup, tenantAccount, tenant, quota, member, can("clients:list"), r.clientHandler.ListClients)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/clients/:client_id", listingGroup, tenantAccount, tenant, quota, member, can("clients:list"), r.clientHandler.GetClient)
+	api.protect(managed, fiber.MethodPut, "/tenants/:tenant_id/clients/:client_id", managementGroup, tenantAccount, tenant, quota, member, can("clients:manage"), r.clientHandler.UpdateClient)
+	api.protect(managed, fiber.MethodDelete, "/tenants/:tenant_id/clients/:client_id", managementGroup, tenantAccount, tenant, quota, member, can("clients:manage"), r.clientHandler.DeleteClient)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/clients/:client_id/encryption-key", listingGroup, tenantAccount, tenant, quota, member, can("clients:manage"), r.clientHandler.GetEncryptionKey)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/rate-limits", listingGroup, tenantAccount, tenant, quota, member, can("rate_limits:inspect"), r.rateLimitHandler.InspectRateLimits)
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/rate-limits/simulate", managementGroup, tenantAccount, tenant, quota, member, can("rate_limits:simulate"), r.rateLimitHandler.SimulateRateLimits)
+	api.protect(managed, fiber.MethodPost, "/debug/token", managementGroup, tenantAccount, r.authHandler.DebugToken)
+	// Access policy management is deliberately not subject to access policies,
+	// so a tenant admin cannot lock themselves out.
+	api.protect(managed, fiber.MethodPost, "/tenants/:tenant_id/access-policies", managementGroup, tenantAccount, tenant, quota, member, r.accessPolicyHandler.CreateAccessPolicy)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/access-policies", listingGroup, tenantAccount, tenant, quota, member, r.accessPolicyHandler.ListAccessPolicies)
+	api.protect(managed, fiber.MethodGet, "/tenants/:tenant_id/access-policies/:policy_id", listingGroup, tenantAccount, tenant, quota, member, r.accessPolicyHandler.GetAccessPolicy)
+	api.protect(managed, fiber.MethodDelete, "/tenants/:tenant_id/access-policies/:policy_id", managementGroup, tenantAccount, tenant, quota, member, r.accessPolicyHandler.DeleteAccessPolicy)
 }
@@ -0,0 +1,363 @@
+package router_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/vault"
+	"github.com/tajious/heimdall/pkg/heimdalltest"
+)
+
+const password = "a long enough password"
+
+var tenantConfig = map[string]interface{}{
+	"auth_method":       "username_password",
+	"jwt_duration":      3600,
+	"rate_limit_ip":     100,
+	"rate_limit_user":   50,
+	"rate_limit_window": 60,
+}
+
+func TestCrossTenantAccessIsDenied(t *testing.T) {
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme")
+	srv.Tenant("globex")
+	alice := srv.User(acme.ID, "alice", password, models.RoleUser)
+	intruder := srv.Client().WithToken(srv.Tokens.For(srv.User("globex", "root", password, models.RoleAdmin)))
+
+	tests := []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{http.MethodGet, "/api/v1/tenants/acme", nil},
+		{http.MethodGet, "/api/v1/tenants/acme/config", nil},
+		{http.MethodPut, "/api/v1/tenants/acme/config", tenantConfig},
+		{http.MethodGet, "/api/v1/tenants/acme/users", nil},
+		{http.MethodPatch, "/api/v1/tenants/acme/users/" + alice.ID + "/attributes", map[string]interface{}{"attributes": map[string]interface{}{}}},
+		{http.MethodPatch, "/api/v1/tenants/acme/users:batch", map[string]interface{}{"users": []interface{}{}}},
+		{http.MethodPost, "/api/v1/tenants/acme/environments", map[string]interface{}{"name": "prod"}},
+		{http.MethodGet, "/api/v1/tenants/acme/environments", nil},
+		{http.MethodGet, "/api/v1/tenants/acme/audit-logs", nil},
+		{http.MethodGet, "/api/v1/tenants/acme/clients", nil},
+		{http.MethodGet, "/api/v1/tenants/acme/signing-keys", nil},
+		{http.MethodPost, "/api/v1/tenants/acme/encryption-keys/rotate", nil},
+		{http.MethodGet, "/api/v1/tenants/acme/access-policies", nil},
+		{http.MethodGet, "/api/v2/tenants/acme/config", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			intruder.Do(tt.method, tt.path, tt.body).Expect(http.StatusForbidden)
+		})
+	}
+}
+
+func TestReadOnlyCannotMutate(t *testing.T) {
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme")
+	alice := srv.User(acme.ID, "alice", password, models.RoleUser)
+	reader := srv.Client().WithToken(srv.Tokens.For(srv.User(acme.ID, "reader", password, models.RoleReadOnly)))
+
+	tests := []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{http.MethodPut, "/api/v1/tenants/acme/config", tenantConfig},
+		{http.MethodPost, "/api/v1/tenants/acme/mapping-rules/test", map[string]interface{}{}},
+		{http.MethodPatch, "/api/v1/tenants/acme/users/" + alice.ID + "/attributes", map[string]interface{}{"attributes": map[string]interface{}{}}},
+		{http.MethodPatch, "/api/v1/tenants/acme/users:batch", map[string]interface{}{"users": []interface{}{}}},
+		{http.MethodPost, "/api/v1/tenants/acme/environments", map[string]interface{}{"name": "prod"}},
+		{http.MethodGet, "/api/v1/tenants/acme/environments/prod/api-key", nil},
+		{http.MethodPost, "/api/v1/tenants/acme/policies", map[string]interface{}{}},
+		{http.MethodPost, "/api/v1/tenants/acme/plugins", nil},
+		{http.MethodPost, "/api/v1/tenants/acme/domains", map[string]interface{}{"domain": "acme.example"}},
+		{http.MethodPost, "/api/v1/tenants/acme/encryption-keys/rotate", nil},
+		{http.MethodPost, "/api/v1/tenants/acme/signing-keys", map[string]interface{}{}},
+		{http.MethodPost, "/api/v1/tenants/acme/clients", map[string]interface{}{}},
+		{http.MethodPost, "/api/v1/tenants/acme/access-policies", map[string]interface{}{}},
+		{http.MethodPut, "/api/v2/tenants/acme/config", tenantConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			reader.Do(tt.method, tt.path, tt.body).Expect(http.StatusForbidden)
+		})
+	}
+
+	// Reads stay open to read_only members of the tenant.
+	reader.Get("/api/v1/tenants/acme").Expect(http.StatusOK)
+	reader.Get("/api/v1/tenants/acme/config").Expect(http.StatusOK)
+}
+
+func TestAdminUpdatesOwnTenantConfig(t *testing.T) {
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme")
+	admin := srv.Client().WithToken(srv.Tokens.For(srv.User(acme.ID, "root", password, models.RoleAdmin)))
+
+	admin.Put("/api/v1/tenants/acme/config", tenantConfig).Expect(http.StatusOK)
+}
+
+func TestOneTimeTokensOnlyValidate(t *testing.T) {
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme")
+	alice := srv.User(acme.ID, "alice", password, models.RoleAdmin)
+	magicLink := srv.Client().WithToken(srv.Tokens.Sign(&models.Claims{
+		UserID:   alice.ID,
+		TenantID: acme.ID,
+		Role:     alice.Role,
+		Type:     models.TokenMagicLink,
+	}, nil))
+
+	magicLink.Get("/api/v1/me").Expect(http.StatusUnauthorized)
+	magicLink.Get("/api/v1/tenants/acme").Expect(http.StatusUnauthorized)
+
+	var validated struct {
+		Valid     bool             `json:"valid"`
+		TokenType models.TokenType `json:"token_type"`
+	}
+	magicLink.Post("/api/v1/validate-token", nil).Expect(http.StatusOK).JSON(&validated)
+	if !validated.Valid || validated.TokenType != models.TokenMagicLink {
+		t.Fatalf("validate-token = %+v, want a valid magic_link token", validated)
+	}
+}
+
+func TestValidateTokenChecksTheTokensUser(t *testing.T) {
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme")
+	srv.Tenant("globex")
+	srv.User(acme.ID, "alice", password, models.RoleUser)
+	bob := srv.User("globex", "bob", password, models.RoleUser)
+
+	var resp models.LoginResponse
+	srv.Client().Post("/api/v1/acme/login", map[string]string{"username": "alice", "password": password}).Expect(http.StatusOK).JSON(&resp)
+	srv.Client().WithToken(resp.Token).Post("/api/v1/validate-token", nil).Expect(http.StatusOK)
+
+	// bob is no user of acme, whatever acme's key signs.
+	forged := srv.Tokens.Sign(&models.Claims{UserID: bob.ID, TenantID: acme.ID, Role: models.RoleUser}, nil)
+	srv.Client().WithToken(forged).Post("/api/v1/validate-token", nil).Expect(http.StatusUnauthorized)
+}
+
+func TestRotatedTokenSigningKeyRefusesOldTokens(t *testing.T) {
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme")
+	admin := srv.Client().WithToken(srv.Tokens.For(srv.User(acme.ID, "root", password, models.RoleAdmin)))
+	srv.User(acme.ID, "alice", password, models.RoleUser)
+
+	login := func() *heimdalltest.Client {
+		var resp models.LoginResponse
+		srv.Client().Post("/api/v1/acme/login", map[string]string{"username": "alice", "password": password}).Expect(http.StatusOK).JSON(&resp)
+		return srv.Client().WithToken(resp.Token)
+	}
+
+	admin.Post("/api/v1/tenants/acme/token-signing-key/rotate", nil).Expect(http.StatusNoContent)
+	alice := login()
+	alice.Get("/api/v1/me").Expect(http.StatusOK)
+
+	admin.Post("/api/v1/tenants/acme/token-signing-key/rotate", nil).Expect(http.StatusNoContent)
+	alice.Get("/api/v1/me").Expect(http.StatusUnauthorized)
+	login().Get("/api/v1/me").Expect(http.StatusOK)
+}
+
+func TestLogoutEndsSessionAndNotifiesClients(t *testing.T) {
+	logoutTokens := make(chan string, 1)
+	backchannel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logoutTokens <- r.PostFormValue("logout_token")
+	}))
+	defer backchannel.Close()
+
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme", func(config *models.TenantConfig) {
+		config.SSO = &models.SSOConfig{SessionLifetime: 60}
+	})
+	admin := srv.Client().WithToken(srv.Tokens.For(srv.User(acme.ID, "root", password, models.RoleAdmin)))
+	srv.User(acme.ID, "alice", password, models.RoleUser)
+	admin.Post("/api/v1/tenants/acme/clients", map[string]interface{}{
+		"id":                        "portal",
+		"name":                      "Portal",
+		"grant_types":               []string{"password"},
+		"post_logout_redirect_uris": []string{"https://portal.example/signed-out"},
+		"backchannel_logout_uri":    backchannel.URL,
+	}).Expect(http.StatusCreated)
+
+	login := srv.Client().Post("/api/v1/acme/login", map[string]string{"username": "alice", "password": password, "client_id": "portal"}).Expect(http.StatusOK)
+	cookie, _, _ := strings.Cut(login.Header.Get("Set-Cookie"), ";")
+	browser := srv.Client().WithHeader("Cookie", cookie)
+
+	browser.Get("/api/v1/acme/sso/logout?client_id=portal&post_logout_redirect_uri=https://evil.example/").Expect(http.StatusBadRequest)
+	resp := browser.Get("/api/v1/acme/sso/logout?client_id=portal&post_logout_redirect_uri=https://portal.example/signed-out&state=xyz").Expect(http.StatusFound)
+	if location := resp.Header.Get("Location"); location != "https://portal.example/signed-out?state=xyz" {
+		t.Fatalf("Location = %q, want the registered URI with the state", location)
+	}
+	browser.Post("/api/v1/acme/sso/token", nil).Expect(http.StatusUnauthorized)
+
+	select {
+	case token := <-logoutTokens:
+		var claims models.Claims
+		if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+			t.Fatalf("logout token: %v", err)
+		}
+		if claims.Type != models.TokenLogout || claims.SessionID == "" || len(claims.Audience) != 1 || claims.Audience[0] != "portal" {
+			t.Fatalf("logout token claims = %+v, want a logout token for portal naming the session", claims)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client was not sent a logout token")
+	}
+}
+
+func TestClientEncryptionKeysAreSealed(t *testing.T) {
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme")
+	admin := srv.Client().WithToken(srv.Tokens.For(srv.User(acme.ID, "root", password, models.RoleAdmin)))
+	srv.User(acme.ID, "alice", password, models.RoleUser)
+	admin.Post("/api/v1/tenants/acme/clients", map[string]interface{}{
+		"id":             "portal",
+		"name":           "Portal",
+		"grant_types":    []string{"password"},
+		"encrypt_tokens": true,
+	}).Expect(http.StatusCreated)
+
+	client, err := srv.Storage.GetClient(storage.WithTenant(context.Background(), acme.ID), acme.ID, "portal")
+	if err != nil {
+		t.Fatalf("GetClient: %v", err)
+	}
+	if !strings.HasPrefix(client.EncryptionKey, vault.Prefix) {
+		t.Fatalf("EncryptionKey = %q, want it sealed", client.EncryptionKey)
+	}
+
+	admin.Get("/api/v1/tenants/acme/clients/portal/encryption-key").Expect(http.StatusOK)
+	var resp models.LoginResponse
+	srv.Client().Post("/api/v1/acme/login", map[string]string{"username": "alice", "password": password, "client_id": "portal"}).Expect(http.StatusOK).JSON(&resp)
+	if parts := strings.Count(resp.Token, ".") + 1; parts != 5 {
+		t.Fatalf("token has %d parts, want an encrypted token", parts)
+	}
+}
+
+func TestDebugTokenHidesOtherTenantsUsers(t *testing.T) {
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme")
+	srv.Tenant("globex")
+	admin := srv.Client().WithToken(srv.Tokens.For(srv.User(acme.ID, "root", password, models.RoleAdmin)))
+	bob := srv.User("globex", "bob", password, models.RoleUser)
+
+	var diagnosis struct {
+		Problems []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"problems"`
+	}
+	token := srv.Tokens.Sign(&models.Claims{UserID: bob.ID, TenantID: acme.ID, Role: models.RoleUser, Type: models.TokenAccess}, nil)
+	admin.Post("/api/v1/debug/token", map[string]string{"token": token}).Expect(http.StatusOK).JSON(&diagnosis)
+	if len(diagnosis.Problems) != 1 || diagnosis.Problems[0].Message != "user "+bob.ID+" does not exist" {
+		t.Fatalf("problems = %+v, want the user reported as missing", diagnosis.Problems)
+	}
+}
+
+func TestEnvironmentAdminsCannotManageTheTenant(t *testing.T) {
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme")
+	admin := srv.Client().WithToken(srv.Tokens.For(srv.User(acme.ID, "root", password, models.RoleAdmin)))
+	var created struct {
+		Environment models.Environment `json:"environment"`
+	}
+	admin.Post("/api/v1/tenants/acme/environments", map[string]interface{}{"name": "dev", "rate_limit_ip": 100, "rate_limit_user": 50, "rate_limit_window": 60}).Expect(http.StatusCreated).JSON(&created)
+	env, err := srv.Storage.GetEnvironment(storage.WithTenant(context.Background(), acme.ID), created.Environment.ID)
+	if err != nil {
+		t.Fatalf("GetEnvironment: %v", err)
+	}
+	devAdmin := srv.Client().WithToken(srv.Tokens.Sign(&models.Claims{UserID: "dev-root", TenantID: acme.ID, Role: models.RoleAdmin}, env))
+
+	tests := []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{http.MethodGet, "/api/v1/tenants/acme", nil},
+		{http.MethodPut, "/api/v1/tenants/acme/config", tenantConfig},
+		{http.MethodGet, "/api/v1/tenants/acme/users", nil},
+		{http.MethodGet, "/api/v1/tenants/acme/users/export", nil},
+		{http.MethodGet, "/api/v1/tenants/acme/environments", nil},
+		{http.MethodPost, "/api/v1/tenants/acme/token-signing-key/rotate", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			devAdmin.Do(tt.method, tt.path, tt.body).Expect(http.StatusForbidden)
+		})
+	}
+
+	// Their own account stays theirs to manage.
+	devAdmin.Get("/api/v1/tenants/acme/consents").Expect(http.StatusOK)
+}
+
+func TestEnvironmentSigningKeysAreSealed(t *testing.T) {
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme")
+	admin := srv.Client().WithToken(srv.Tokens.For(srv.User(acme.ID, "root", password, models.RoleAdmin)))
+	var created struct {
+		Environment models.Environment `json:"environment"`
+	}
+	admin.Post("/api/v1/tenants/acme/environments", map[string]interface{}{"name": "dev", "rate_limit_ip": 100, "rate_limit_user": 50, "rate_limit_window": 60}).Expect(http.StatusCreated).JSON(&created)
+
+	env, err := srv.Storage.GetEnvironment(storage.WithTenant(context.Background(), acme.ID), created.Environment.ID)
+	if err != nil {
+		t.Fatalf("GetEnvironment: %v", err)
+	}
+	if !strings.HasPrefix(env.SigningKey, vault.Prefix) {
+		t.Fatalf("SigningKey = %q, want it sealed", env.SigningKey)
+	}
+
+	token := srv.Tokens.Sign(&models.Claims{UserID: "dev-alice", TenantID: acme.ID, Role: models.RoleUser}, env)
+	srv.Client().WithToken(token).Get("/api/v1/me").Expect(http.StatusOK)
+}
+
+func TestEdDSAIsRefusedUnlessTheDeploymentEnablesIt(t *testing.T) {
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme")
+	admin := srv.Client().WithToken(srv.Tokens.For(srv.User(acme.ID, "root", password, models.RoleAdmin)))
+
+	config := map[string]interface{}{"token_algorithm": "EdDSA"}
+	for key, value := range tenantConfig {
+		config[key] = value
+	}
+	admin.Put("/api/v1/tenants/acme/config", config).Expect(http.StatusBadRequest)
+}
+
+func TestListTenantsOnlyShowsTheCallersTenant(t *testing.T) {
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme")
+	srv.Tenant("globex")
+	alice := srv.Client().WithToken(srv.Tokens.For(srv.User(acme.ID, "alice", password, models.RoleUser)))
+
+	var list struct {
+		Tenants []models.Tenant `json:"tenants"`
+		Total   int64           `json:"total"`
+	}
+	alice.Get("/api/v1/tenants").Expect(http.StatusOK).JSON(&list)
+	if list.Total != 1 || len(list.Tenants) != 1 || list.Tenants[0].ID != acme.ID {
+		t.Fatalf("tenants = %+v, want only acme", list)
+	}
+}
+
+func TestDeviceCodeRequiresARegisteredClient(t *testing.T) {
+	srv := heimdalltest.NewServer(t)
+	acme := srv.Tenant("acme", func(config *models.TenantConfig) {
+		config.Features = map[string]bool{string(models.FeatureDeviceFlow): true}
+		config.DeviceVerificationURI = "https://acme.example/device"
+	})
+	admin := srv.Client().WithToken(srv.Tokens.For(srv.User(acme.ID, "root", password, models.RoleAdmin)))
+
+	srv.Client().Post("/api/v1/acme/device/code", map[string]string{"client_id": "tv"}).Expect(http.StatusBadRequest)
+
+	admin.Post("/api/v1/tenants/acme/clients", map[string]interface{}{
+		"id":          "tv",
+		"name":        "TV",
+		"grant_types": []models.GrantType{models.GrantDeviceCode},
+	}).Expect(http.StatusCreated)
+	srv.Client().Post("/api/v1/acme/device/code", map[string]string{"client_id": "tv"}).Expect(http.StatusOK)
+}
@@ -0,0 +1,123 @@
+package versioning
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Spec collects the routes of one version as they are registered and serves
+// them as an OpenAPI 3 document. It describes paths, parameters, and
+// authentication; request and response bodies are documented in the README.
+type Spec struct {
+	version Version
+	title   string
+
+	mu         sync.RWMutex
+	operations []operation
+}
+
+type operation struct {
+	method        string
+	path          string
+	authenticated bool
+}
+
+func NewSpec(title string, version Version) *Spec {
+	return &Spec{
+		title:   title,
+		version: version,
+	}
+}
+
+// Add records a route, with path relative to the version prefix.
+func (s *Spec) Add(method, path string, authenticated bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.operations = append(s.operations, operation{
+		method:        method,
+		path:          path,
+		authenticated: authenticated,
+	})
+}
+
+func (s *Spec) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(s.Document())
+	}
+}
+
+// Document renders the OpenAPI document.
+func (s *Spec) Document() fiber.Map {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	paths := fiber.Map{}
+	for _, op := range s.operations {
+		path, params := openAPIPath(op.path)
+		item, ok := paths[path].(fiber.Map)
+		if !ok {
+			item = fiber.Map{}
+			paths[path] = item
+		}
+
+		entry := fiber.Map{
+			"operationId": strings.ToLower(op.method) + strings.ReplaceAll(path, "/", "_"),
+			"responses": fiber.Map{
+				"default": fiber.Map{"description": "See the API documentation"},
+			},
+		}
+		if len(params) > 0 {
+			parameters := make([]fiber.Map, 0, len(params))
+			for _, name := range params {
+				parameters = append(parameters, fiber.Map{
+					"name":     name,
+					"in":       "path",
+					"required": true,
+					"schema":   fiber.Map{"type": "string"},
+				})
+			}
+			entry["parameters"] = parameters
+		}
+		if op.authenticated {
+			entry["security"] = []fiber.Map{{"bearerAuth": []string{}}}
+		}
+		if s.version.Deprecated() {
+			entry["deprecated"] = true
+		}
+		item[strings.ToLower(op.method)] = entry
+	}
+
+	return fiber.Map{
+		"openapi": "3.0.3",
+		"info": fiber.Map{
+			"title":   s.title,
+			"version": s.version.Name,
+		},
+		"servers": []fiber.Map{{"url": s.version.Prefix()}},
+		"paths":   paths,
+		"components": fiber.Map{
+			"securitySchemes": fiber.Map{
+				"bearerAuth": fiber.Map{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+// openAPIPath turns Fiber's :param segments into OpenAPI {param} templates
+// and unescapes literal colons such as users\:batch.
+func openAPIPath(path string) (string, []string) {
+	segments := strings.Split(path, "/")
+	var params []string
+	for i, segment := range segments {
+		if name, ok := strings.CutPrefix(segment, ":"); ok {
+			segments[i] = "{" + name + "}"
+			params = append(params, name)
+			continue
+		}
+		segments[i] = strings.ReplaceAll(segment, `\:`, ":")
+	}
+	return strings.Join(segments, "/"), params
+}
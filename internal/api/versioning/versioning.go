@@ -0,0 +1,59 @@
+package versioning
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Version is one published surface of the API, served under /api/<Name>.
+// Versions share handlers and services; they differ only in which routes
+// they register.
+type Version struct {
+	Name string
+	// DeprecatedAt and SunsetAt, when set, are announced on every response
+	// of the version with the Deprecation (RFC 9745) and Sunset (RFC 8594)
+	// headers.
+	DeprecatedAt *time.Time
+	SunsetAt     *time.Time
+	// Successor names the version clients should move to.
+	Successor string
+}
+
+func (v Version) Prefix() string {
+	return "/api/" + v.Name
+}
+
+func (v Version) Deprecated() bool {
+	return v.DeprecatedAt != nil
+}
+
+// Headers announces the deprecation and sunset of the version.
+func (v Version) Headers() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if v.DeprecatedAt != nil {
+			c.Set("Deprecation", fmt.Sprintf("@%d", v.DeprecatedAt.Unix()))
+			if v.Successor != "" {
+				c.Append(fiber.HeaderLink, fmt.Sprintf(`</api/%s>; rel="successor-version"`, v.Successor))
+			}
+		}
+		if v.SunsetAt != nil {
+			c.Set("Sunset", v.SunsetAt.UTC().Format(http.TimeFormat))
+		}
+		return c.Next()
+	}
+}
+
+// ParseDate parses an optional YYYY-MM-DD date, returning nil for "".
+func ParseDate(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
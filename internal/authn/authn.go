@@ -0,0 +1,61 @@
+package authn
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"sync"
+
+	"github.com/tajious/heimdall/internal/models"
+)
+
+var (
+	ErrUnsupportedMethod = errors.New("unsupported authentication method")
+)
+
+type Credentials struct {
+	Username      string
+	Email         string
+	Password      string
+	Phone         string
+	EnvironmentID string
+	RemoteIP      string
+	// Certificates is the chain the client presented over TLS, leaf first.
+	Certificates []*x509.Certificate
+}
+
+type Authenticator interface {
+	Authenticate(ctx context.Context, tenant *models.Tenant, credentials Credentials) (*models.User, error)
+}
+
+type Registry struct {
+	mu             sync.RWMutex
+	authenticators map[models.AuthMethod]Authenticator
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		authenticators: make(map[models.AuthMethod]Authenticator),
+	}
+}
+
+func (r *Registry) Register(method models.AuthMethod, authenticator Authenticator) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.authenticators[method] = authenticator
+}
+
+func (r *Registry) Get(method models.AuthMethod) (Authenticator, error) {
+	if method == "" {
+		method = models.UsernamePassword
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	authenticator, ok := r.authenticators[method]
+	if !ok {
+		return nil, ErrUnsupportedMethod
+	}
+	return authenticator, nil
+}
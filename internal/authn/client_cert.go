@@ -0,0 +1,110 @@
+package authn
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"strings"
+
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+var ErrClientCertMisconfigured = errors.New("client certificate authentication is not configured")
+
+type ClientCertificateAuthenticator struct {
+	storage storage.Storage
+}
+
+func NewClientCertificateAuthenticator(storage storage.Storage) *ClientCertificateAuthenticator {
+	return &ClientCertificateAuthenticator{storage: storage}
+}
+
+// Authenticate verifies the presented chain against the tenant's CAs and
+// resolves its leaf to a user. The request body carries no credentials.
+func (a *ClientCertificateAuthenticator) Authenticate(ctx context.Context, tenant *models.Tenant, credentials Credentials) (*models.User, error) {
+	cfg := tenant.Config.ClientCertAuth
+	if cfg == nil {
+		return nil, ErrClientCertMisconfigured
+	}
+
+	if len(credentials.Certificates) == 0 {
+		return nil, storage.ErrInvalidCredentials
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(cfg.CACertificates)) {
+		return nil, ErrClientCertMisconfigured
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range credentials.Certificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	leaf := credentials.Certificates[0]
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, storage.ErrInvalidCredentials
+	}
+
+	identity := certificateIdentity(leaf, cfg.MapBy)
+	if identity == "" {
+		return nil, storage.ErrInvalidCredentials
+	}
+
+	var user *models.User
+	var err error
+	if cfg.MapBy == models.CertSANEmail {
+		identity = strings.ToLower(identity)
+		user, err = a.storage.GetPoolUserByEmail(ctx, tenant.ID, credentials.EnvironmentID, identity)
+	} else {
+		identity = validation.NormalizeUsername(tenant.Config.UsernamePolicy, identity)
+		user, err = a.storage.GetPoolUserByUsername(ctx, tenant.ID, credentials.EnvironmentID, identity)
+	}
+	if err == storage.ErrUserNotFound {
+		if cfg.ServiceAccountRole == "" {
+			return nil, storage.ErrInvalidCredentials
+		}
+		return serviceAccount(tenant, credentials.EnvironmentID, identity, cfg.ServiceAccountRole), nil
+	}
+	return user, err
+}
+
+// certificateIdentity returns the value of the certificate field mapBy
+// names, the first one for SANs, or "" when the certificate has none.
+func certificateIdentity(cert *x509.Certificate, mapBy string) string {
+	switch mapBy {
+	case models.CertSubjectCN:
+		return cert.Subject.CommonName
+	case models.CertSANEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case models.CertSANDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case models.CertSANURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// serviceAccount is the transient user a certificate without a matching
+// user signs in as, in the way of delegated logins without provisioning.
+func serviceAccount(tenant *models.Tenant, environmentID, identity string, role models.Role) *models.User {
+	return &models.User{
+		ID:            "cert:" + identity,
+		TenantID:      tenant.ID,
+		EnvironmentID: environmentID,
+		Username:      identity,
+		Role:          role,
+		Status:        models.UserActive,
+	}
+}
@@ -0,0 +1,157 @@
+package authn
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+const (
+	defaultDelegatedTimeout = 5 * time.Second
+	maxDelegatedResponse    = 64 << 10
+)
+
+var (
+	ErrDelegateUnavailable   = errors.New("delegated authentication endpoint unavailable")
+	ErrDelegateMisconfigured = errors.New("delegated authentication is not configured")
+)
+
+type DelegatedAuthenticator struct {
+	provisioner *Provisioner
+	secrets     *vault.Vault
+	client      *http.Client
+}
+
+func NewDelegatedAuthenticator(provisioner *Provisioner, secrets *vault.Vault) *DelegatedAuthenticator {
+	return &DelegatedAuthenticator{
+		provisioner: provisioner,
+		secrets:     secrets,
+		client: &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+type delegatedRequest struct {
+	TenantID      string `json:"tenant_id"`
+	EnvironmentID string `json:"environment_id,omitempty"`
+	Username      string `json:"username"`
+	Email         string `json:"email,omitempty"`
+	Password      string `json:"password"`
+	Phone         string `json:"phone,omitempty"`
+	RemoteIP      string `json:"remote_ip"`
+}
+
+type delegatedResponse struct {
+	Subject    string                 `json:"subject"`
+	Username   string                 `json:"username"`
+	Email      string                 `json:"email"`
+	Phone      string                 `json:"phone"`
+	Role       models.Role            `json:"role"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+func (a *DelegatedAuthenticator) Authenticate(ctx context.Context, tenant *models.Tenant, credentials Credentials) (*models.User, error) {
+	cfg := tenant.Config.DelegatedAuth
+	if cfg == nil || tenant.Config.DelegatedAuthSecret == "" {
+		return nil, ErrDelegateMisconfigured
+	}
+
+	if credentials.Username == "" || credentials.Password == "" {
+		return nil, storage.ErrInvalidCredentials
+	}
+
+	secret, err := a.secrets.Open(ctx, tenant.ID, tenant.Config.DelegatedAuthSecret)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDelegateMisconfigured, err)
+	}
+
+	body, err := json.Marshal(delegatedRequest{
+		TenantID:      tenant.ID,
+		EnvironmentID: credentials.EnvironmentID,
+		Username:      credentials.Username,
+		Email:         credentials.Email,
+		Password:      credentials.Password,
+		Phone:         credentials.Phone,
+		RemoteIP:      credentials.RemoteIP,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := defaultDelegatedTimeout
+	if cfg.TimeoutMS > 0 {
+		timeout = time.Duration(cfg.TimeoutMS) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Heimdall-Timestamp", timestamp)
+	req.Header.Set("X-Heimdall-Signature", Sign(secret, timestamp, body))
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDelegateUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, storage.ErrInvalidCredentials
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: status %d", ErrDelegateUnavailable, resp.StatusCode)
+	}
+
+	var result delegatedResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxDelegatedResponse)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("%w: invalid response: %v", ErrDelegateUnavailable, err)
+	}
+	if result.Subject == "" {
+		return nil, fmt.Errorf("%w: response without subject", ErrDelegateUnavailable)
+	}
+
+	username := result.Username
+	if username == "" {
+		username = credentials.Username
+	}
+
+	return a.provisioner.Resolve(ctx, tenant, ExternalIdentity{
+		Subject:       result.Subject,
+		Username:      username,
+		Email:         result.Email,
+		Phone:         result.Phone,
+		Role:          result.Role,
+		EnvironmentID: credentials.EnvironmentID,
+		Attributes:    result.Attributes,
+	})
+}
+
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
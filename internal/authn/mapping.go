@@ -0,0 +1,51 @@
+package authn
+
+import (
+	"fmt"
+
+	"github.com/tajious/heimdall/internal/models"
+)
+
+// EvaluateMappingRules applies rules in order. The first matching set_role
+// rule decides the role; every matching copy_claim rule contributes a claim.
+func EvaluateMappingRules(rules []models.MappingRule, attributes map[string]interface{}) models.MappingResult {
+	var result models.MappingResult
+	for _, rule := range rules {
+		value, ok := attributes[rule.Attribute]
+		if !ok || value == nil || !matches(value, rule.Equals) {
+			continue
+		}
+
+		switch rule.Action {
+		case models.MappingSetRole:
+			if result.Role == "" {
+				result.Role = rule.Role
+			}
+		case models.MappingCopyClaim:
+			claim := rule.Claim
+			if claim == "" {
+				claim = rule.Attribute
+			}
+			if result.Claims == nil {
+				result.Claims = make(map[string]interface{})
+			}
+			result.Claims[claim] = value
+		}
+	}
+	return result
+}
+
+func matches(value interface{}, expected string) bool {
+	if expected == "" {
+		return true
+	}
+	if list, ok := value.([]interface{}); ok {
+		for _, item := range list {
+			if fmt.Sprint(item) == expected {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprint(value) == expected
+}
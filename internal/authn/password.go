@@ -0,0 +1,103 @@
+package authn
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/tajious/heimdall/internal/metrics"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/passwords"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+type PasswordAuthenticator struct {
+	storage storage.Storage
+	hasher  *passwords.Hasher
+}
+
+func NewPasswordAuthenticator(storage storage.Storage, hasher *passwords.Hasher) *PasswordAuthenticator {
+	return &PasswordAuthenticator{
+		storage: storage,
+		hasher:  hasher,
+	}
+}
+
+func (a *PasswordAuthenticator) Authenticate(ctx context.Context, tenant *models.Tenant, credentials Credentials) (*models.User, error) {
+	if credentials.Password == "" {
+		return nil, storage.ErrInvalidCredentials
+	}
+
+	timeline := metrics.TimelineFrom(ctx)
+	user, err := a.lookup(ctx, tenant, credentials)
+	if err == storage.ErrUserNotFound && tenant.Config.EnumerationProtection {
+		start := time.Now()
+		err := a.hasher.CompareDummy(ctx, credentials.Password)
+		timeline.Observe(metrics.StageHashVerify, start)
+		if err != passwords.ErrMismatch {
+			return nil, err
+		}
+		return nil, storage.ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	err = a.hasher.Compare(ctx, user.Password, credentials.Password)
+	timeline.Observe(metrics.StageHashVerify, start)
+	if err != nil {
+		if err == passwords.ErrMismatch {
+			return nil, storage.ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	if passwords.NeedsRehash(user.Password) {
+		a.rehash(ctx, user, credentials.Password)
+	}
+	return user, nil
+}
+
+// rehash replaces the hash an imported user brought from another provider
+// with a bcrypt hash, now that their password is known. The login goes
+// ahead if it fails, and the next one tries again.
+func (a *PasswordAuthenticator) rehash(ctx context.Context, user *models.User, password string) {
+	hash, err := a.hasher.Hash(ctx, password)
+	if err != nil {
+		log.Printf("Rehashing password of user %s failed: %v", user.ID, err)
+		return
+	}
+	upgraded := *user
+	upgraded.Password = hash
+	upgraded.UpdatedAt = time.Now()
+	if err := a.storage.UpdateUser(ctx, &upgraded); err != nil {
+		log.Printf("Rehashing password of user %s failed: %v", user.ID, err)
+		return
+	}
+	user.Password = hash
+}
+
+// lookup finds the user by the first identifier supplied among those the
+// tenant accepts.
+func (a *PasswordAuthenticator) lookup(ctx context.Context, tenant *models.Tenant, credentials Credentials) (*models.User, error) {
+	switch {
+	case credentials.Username != "" && tenant.Config.AcceptsIdentifier(models.IdentifierUsername):
+		username := validation.NormalizeUsername(tenant.Config.UsernamePolicy, credentials.Username)
+		return a.storage.GetPoolUserByUsername(ctx, tenant.ID, credentials.EnvironmentID, username)
+	case credentials.Email != "" && tenant.Config.AcceptsIdentifier(models.IdentifierEmail):
+		return a.storage.GetPoolUserByEmail(ctx, tenant.ID, credentials.EnvironmentID, strings.ToLower(credentials.Email))
+	case credentials.Phone != "" && tenant.Config.AcceptsIdentifier(models.IdentifierPhone):
+		user, err := a.storage.GetUserByPhone(ctx, credentials.Phone)
+		if err != nil {
+			return nil, err
+		}
+		if user.TenantID != tenant.ID || user.EnvironmentID != credentials.EnvironmentID {
+			return nil, storage.ErrUserNotFound
+		}
+		return user, nil
+	}
+	return nil, storage.ErrInvalidCredentials
+}
@@ -0,0 +1,184 @@
+package authn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tajious/heimdall/internal/domains"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+var (
+	ErrProvisioningRejected = errors.New("user provisioning rejected")
+)
+
+// ExternalIdentity is a user asserted by an external identity provider.
+type ExternalIdentity struct {
+	Subject       string
+	Username      string
+	Email         string
+	Phone         string
+	Role          models.Role
+	EnvironmentID string
+	Attributes    map[string]interface{}
+}
+
+// SubjectInvalidator is notified when a user's role changes so cached
+// authorization decisions for that user can be dropped.
+type SubjectInvalidator interface {
+	InvalidateSubject(tenantID, subjectID string)
+}
+
+type Provisioner struct {
+	storage     storage.Storage
+	invalidator SubjectInvalidator
+}
+
+func NewProvisioner(storage storage.Storage, invalidator SubjectInvalidator) *Provisioner {
+	return &Provisioner{
+		storage:     storage,
+		invalidator: invalidator,
+	}
+}
+
+// Resolve returns the local user for an external identity, with the tenant's
+// mapping rules applied. Unknown users are created when the tenant enables
+// provisioning, otherwise a transient user carrying the provider's claims is
+// returned.
+func (p *Provisioner) Resolve(ctx context.Context, tenant *models.Tenant, identity ExternalIdentity) (*models.User, error) {
+	mapped := EvaluateMappingRules(tenant.Config.MappingRules, identity.Attributes)
+
+	user, err := p.resolve(ctx, tenant, identity, mapped.Role)
+	if err != nil {
+		return nil, err
+	}
+	user.Claims = mapped.Claims
+	return user, nil
+}
+
+func (p *Provisioner) resolve(ctx context.Context, tenant *models.Tenant, identity ExternalIdentity, mappedRole models.Role) (*models.User, error) {
+	user, err := p.storage.GetPoolUserByUsername(ctx, tenant.ID, identity.EnvironmentID, identity.Username)
+	if err == nil {
+		if mappedRole != "" && user.Role != mappedRole {
+			user.Role = mappedRole
+			if err := p.storage.UpdateUser(ctx, user); err != nil {
+				return nil, err
+			}
+			p.invalidator.InvalidateSubject(tenant.ID, user.ID)
+		}
+		return user, nil
+	}
+	if err != storage.ErrUserNotFound {
+		return nil, err
+	}
+
+	cfg := tenant.Config.Provisioning
+	if cfg == nil || !cfg.Enabled {
+		if mappedRole != "" {
+			identity.Role = mappedRole
+		}
+		return transientUser(tenant, identity), nil
+	}
+
+	email := strings.ToLower(identity.Email)
+	allowed, err := domains.Allowed(ctx, p.storage, tenant, email)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, fmt.Errorf("%w: email domain is not allowed for this tenant", ErrProvisioningRejected)
+	}
+
+	attributes := mapAttributes(cfg.AttributeMapping, identity.Attributes)
+	if err := validation.ValidateFields(tenant.Config.AttributeSchema, attributes); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProvisioningRejected, err)
+	}
+	if err := p.checkUnique(ctx, tenant, attributes); err != nil {
+		return nil, err
+	}
+
+	role := mappedRole
+	if role == "" {
+		role = cfg.DefaultRole
+	}
+	if role == "" {
+		role = models.RoleUser
+	}
+
+	user = &models.User{
+		TenantID:      tenant.ID,
+		EnvironmentID: identity.EnvironmentID,
+		Username:      identity.Username,
+		Email:         email,
+		Phone:         identity.Phone,
+		Role:          role,
+		Status:        models.UserActive,
+		Attributes:    attributes,
+	}
+	if err := p.storage.CreateUser(ctx, user); err != nil {
+		// A concurrent login may have provisioned the same user first.
+		if existing, lookupErr := p.storage.GetPoolUserByUsername(ctx, tenant.ID, identity.EnvironmentID, identity.Username); lookupErr == nil {
+			return existing, nil
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+func (p *Provisioner) checkUnique(ctx context.Context, tenant *models.Tenant, attributes map[string]interface{}) error {
+	for _, rule := range tenant.Config.AttributeSchema {
+		value, ok := attributes[rule.Name]
+		if !rule.Unique || !ok {
+			continue
+		}
+		_, err := p.storage.FindUserByAttribute(ctx, tenant.ID, rule.Name, value)
+		if err == storage.ErrUserNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: attribute %q is already in use", ErrProvisioningRejected, rule.Name)
+	}
+	return nil
+}
+
+func mapAttributes(mapping map[string]string, external map[string]interface{}) map[string]interface{} {
+	if len(mapping) == 0 {
+		return nil
+	}
+
+	attributes := make(map[string]interface{})
+	for from, to := range mapping {
+		if value, ok := external[from]; ok && value != nil {
+			attributes[to] = value
+		}
+	}
+	if len(attributes) == 0 {
+		return nil
+	}
+	return attributes
+}
+
+func transientUser(tenant *models.Tenant, identity ExternalIdentity) *models.User {
+	role := identity.Role
+	if role != models.RoleAdmin && role != models.RoleUser && role != models.RoleReadOnly {
+		role = models.RoleUser
+	}
+
+	return &models.User{
+		ID:            "external:" + identity.Subject,
+		TenantID:      tenant.ID,
+		EnvironmentID: identity.EnvironmentID,
+		Username:      identity.Username,
+		Email:         strings.ToLower(identity.Email),
+		Phone:         identity.Phone,
+		Role:          role,
+		Status:        models.UserActive,
+		Attributes:    identity.Attributes,
+	}
+}
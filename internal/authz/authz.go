@@ -0,0 +1,145 @@
+package authz
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/tajious/heimdall/internal/metrics"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+// Engine evaluates tenant access policies. Decisions follow deny-by-default
+// semantics: a matching forbid statement always wins, otherwise at least one
+// permit statement must match.
+type Engine struct {
+	storage storage.Storage
+	cache   *decisionCache
+}
+
+func NewEngine(storage storage.Storage, cacheTTL time.Duration, registry *metrics.Registry) *Engine {
+	return &Engine{
+		storage: storage,
+		cache:   newDecisionCache(cacheTTL, registry),
+	}
+}
+
+func (e *Engine) Policies(ctx context.Context, tenantID string) ([]*models.AccessPolicy, error) {
+	return e.storage.ListAccessPolicies(ctx, tenantID)
+}
+
+func (e *Engine) Authorize(ctx context.Context, tenantID string, req models.AuthorizeRequest) (models.AuthorizeDecision, error) {
+	decisions, err := e.AuthorizeBatch(ctx, tenantID, []models.AuthorizeRequest{req})
+	if err != nil {
+		return models.AuthorizeDecision{}, err
+	}
+	return decisions[0], nil
+}
+
+// AuthorizeBatch decides every request, loading the tenant's policies at most
+// once and serving repeated checks from the decision cache.
+func (e *Engine) AuthorizeBatch(ctx context.Context, tenantID string, reqs []models.AuthorizeRequest) ([]models.AuthorizeDecision, error) {
+	decisions := make([]models.AuthorizeDecision, len(reqs))
+
+	var policies []*models.AccessPolicy
+	loaded := false
+	for i, req := range reqs {
+		if decision, ok := e.cache.get(tenantID, req); ok {
+			decisions[i] = decision
+			continue
+		}
+
+		if !loaded {
+			var err error
+			if policies, err = e.Policies(ctx, tenantID); err != nil {
+				return nil, err
+			}
+			loaded = true
+		}
+
+		decisions[i] = Evaluate(policies, req)
+		e.cache.put(tenantID, req, decisions[i])
+	}
+	return decisions, nil
+}
+
+// InvalidateTenant drops cached decisions after the tenant's policies change.
+func (e *Engine) InvalidateTenant(tenantID string) {
+	e.cache.invalidateTenant(tenantID)
+}
+
+// InvalidateSubject drops cached decisions after a user's role changes.
+func (e *Engine) InvalidateSubject(tenantID, subjectID string) {
+	e.cache.invalidateSubject(tenantID, subjectID)
+}
+
+func Evaluate(policies []*models.AccessPolicy, req models.AuthorizeRequest) models.AuthorizeDecision {
+	decision := models.AuthorizeDecision{Reason: "no permit statement matched"}
+	for _, policy := range policies {
+		for _, statement := range policy.Statements {
+			if !statementMatches(statement, req) {
+				continue
+			}
+			if statement.Effect == models.EffectForbid {
+				return models.AuthorizeDecision{Reason: "forbidden by policy " + policy.Name}
+			}
+			if !decision.Allowed {
+				decision = models.AuthorizeDecision{Allowed: true, Reason: "permitted by policy " + policy.Name}
+			}
+		}
+	}
+	return decision
+}
+
+func statementMatches(statement models.AccessStatement, req models.AuthorizeRequest) bool {
+	if len(statement.Roles) > 0 && !containsRole(statement.Roles, req.Subject.Role) {
+		return false
+	}
+	if len(statement.Subjects) > 0 && !matchAny(statement.Subjects, req.Subject.ID) {
+		return false
+	}
+	return matchAny(statement.Actions, req.Action) && matchAny(statement.Resources, req.Resource)
+}
+
+func containsRole(roles []models.Role, role models.Role) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if Match(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether value matches pattern, where "*" matches any run of
+// characters including separators.
+func Match(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return len(value) >= len(last) && strings.HasSuffix(value, last)
+}
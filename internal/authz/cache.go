@@ -0,0 +1,101 @@
+package authz
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tajious/heimdall/internal/metrics"
+	"github.com/tajious/heimdall/internal/models"
+)
+
+type decisionEntry struct {
+	decision  models.AuthorizeDecision
+	expiresAt time.Time
+}
+
+// decisionCache memoizes decisions per subject. Invalidation bumps a
+// generation counter for the tenant or subject, which is part of every key, so
+// stale entries become unreachable immediately and are swept once expired.
+type decisionCache struct {
+	ttl time.Duration
+
+	mu          sync.Mutex
+	entries     map[string]decisionEntry
+	generations map[string]uint64
+	lastSweep   time.Time
+
+	lookups *metrics.CounterVec
+}
+
+func newDecisionCache(ttl time.Duration, registry *metrics.Registry) *decisionCache {
+	return &decisionCache{
+		ttl:         ttl,
+		entries:     make(map[string]decisionEntry),
+		generations: make(map[string]uint64),
+		lastSweep:   time.Now(),
+		lookups:     registry.Counter("heimdall_authz_decision_cache_lookups_total", "Authorization decision cache lookups.", "result"),
+	}
+}
+
+func (c *decisionCache) key(tenantID string, req models.AuthorizeRequest) string {
+	subject := tenantID + "\x00" + req.Subject.ID
+	return strings.Join([]string{
+		tenantID,
+		strconv.FormatUint(c.generations[tenantID], 10),
+		req.Subject.ID,
+		strconv.FormatUint(c.generations[subject], 10),
+		string(req.Subject.Role),
+		req.Action,
+		req.Resource,
+	}, "\x00")
+}
+
+func (c *decisionCache) get(tenantID string, req models.AuthorizeRequest) (models.AuthorizeDecision, bool) {
+	if c.ttl <= 0 {
+		return models.AuthorizeDecision{}, false
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[c.key(tenantID, req)]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		c.lookups.WithLabels("hit").Inc()
+		return entry.decision, true
+	}
+	c.lookups.WithLabels("miss").Inc()
+	return models.AuthorizeDecision{}, false
+}
+
+func (c *decisionCache) put(tenantID string, req models.AuthorizeRequest, decision models.AuthorizeDecision) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastSweep) > c.ttl {
+		for key, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, key)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[c.key(tenantID, req)] = decisionEntry{decision: decision, expiresAt: now.Add(c.ttl)}
+}
+
+func (c *decisionCache) invalidateTenant(tenantID string) {
+	c.mu.Lock()
+	c.generations[tenantID]++
+	c.mu.Unlock()
+}
+
+func (c *decisionCache) invalidateSubject(tenantID, subjectID string) {
+	c.mu.Lock()
+	c.generations[tenantID+"\x00"+subjectID]++
+	c.mu.Unlock()
+}
@@ -0,0 +1,129 @@
+// Package blob keeps files outside the database: background exports, the
+// archives of deleted tenants, and user exports staged for import. A
+// deployment keeps them on local disk, in S3, or in Google Cloud Storage.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+type Object struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Store is where blobs are kept. Keys are slash-separated paths.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	// List returns the blobs whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Delete removes the blob at key; a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Config selects the driver of a deployment: disk, s3, or gcs. Prefix is
+// put before every key, so deployments can share a bucket.
+type Config struct {
+	Driver string
+	Dir    string
+	Prefix string
+
+	Bucket          string
+	Region          string
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Open opens the store config describes, nil when Driver is empty.
+func Open(config Config, timeout time.Duration) (Store, error) {
+	var store Store
+	var err error
+	switch config.Driver {
+	case "":
+		return nil, nil
+	case "disk":
+		store, err = NewDiskStore(config.Dir)
+	case "s3":
+		store, err = NewS3Store(S3Config{
+			Bucket:          config.Bucket,
+			Region:          config.Region,
+			Endpoint:        config.Endpoint,
+			AccessKeyID:     config.AccessKeyID,
+			SecretAccessKey: config.SecretAccessKey,
+			SessionToken:    config.SessionToken,
+		}, timeout)
+	case "gcs":
+		store, err = NewGCSStore(GCSConfig{
+			Bucket:    config.Bucket,
+			Endpoint:  config.Endpoint,
+			AccessID:  config.AccessKeyID,
+			SecretKey: config.SecretAccessKey,
+		}, timeout)
+	default:
+		return nil, fmt.Errorf("unknown blob store driver %q", config.Driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.Prefix != "" {
+		store = prefixed{store: store, prefix: strings.TrimSuffix(config.Prefix, "/") + "/"}
+	}
+	return store, nil
+}
+
+// PurgeOlder deletes the blobs under prefix last modified before olderThan,
+// returning how many it deleted.
+func PurgeOlder(ctx context.Context, store Store, prefix string, olderThan time.Time) (int64, error) {
+	objects, err := store.List(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	var purged int64
+	for _, object := range objects {
+		if !object.Modified.Before(olderThan) {
+			continue
+		}
+		if err := store.Delete(ctx, object.Key); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// prefixed keeps the blobs of a store under a prefix, which callers never
+// see in keys.
+type prefixed struct {
+	store  Store
+	prefix string
+}
+
+func (p prefixed) Put(ctx context.Context, key string, data []byte) error {
+	return p.store.Put(ctx, p.prefix+key, data)
+}
+
+func (p prefixed) Get(ctx context.Context, key string) ([]byte, error) {
+	return p.store.Get(ctx, p.prefix+key)
+}
+
+func (p prefixed) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects, err := p.store.List(ctx, p.prefix+prefix)
+	for i := range objects {
+		objects[i].Key = strings.TrimPrefix(objects[i].Key, p.prefix)
+	}
+	return objects, err
+}
+
+func (p prefixed) Delete(ctx context.Context, key string) error {
+	return p.store.Delete(ctx, p.prefix+key)
+}
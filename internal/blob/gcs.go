@@ -0,0 +1,37 @@
+package blob
+
+import (
+	"errors"
+	"time"
+)
+
+// GCSConfig points a store at a Google Cloud Storage bucket, with the HMAC
+// key of a service account.
+type GCSConfig struct {
+	Bucket    string
+	Endpoint  string
+	AccessID  string
+	SecretKey string
+}
+
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// NewGCSStore talks to the bucket through the XML API of Cloud Storage,
+// which takes the requests S3Store sends when they are signed with an HMAC
+// key for the auto region.
+func NewGCSStore(config GCSConfig, timeout time.Duration) (*S3Store, error) {
+	if config.AccessID == "" || config.SecretKey == "" {
+		return nil, errors.New("gcs: an HMAC key is required")
+	}
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = gcsEndpoint
+	}
+	return NewS3Store(S3Config{
+		Bucket:          config.Bucket,
+		Region:          "auto",
+		Endpoint:        endpoint,
+		AccessKeyID:     config.AccessID,
+		SecretAccessKey: config.SecretKey,
+	}, timeout)
+}
@@ -0,0 +1,84 @@
+package blob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// LocalURLPath is where the API serves the blobs of stores that cannot hand
+// out URLs of their own, such as DiskStore.
+const LocalURLPath = "/blobs/"
+
+var ErrInvalidSignature = errors.New("blob URL signature is invalid or expired")
+
+// URLSigner is a store that hands out URLs downloading a blob without
+// credentials until they expire. URLs starting with LocalURLPath are
+// relative to the API and served by a SignedReader.
+type URLSigner interface {
+	SignedURL(key string, ttl time.Duration) (string, error)
+}
+
+// SignedReader reads the blob a URL signed by the store points at, given
+// the key and query of the URL.
+type SignedReader interface {
+	ReadSigned(ctx context.Context, key string, query url.Values) ([]byte, error)
+}
+
+func (s *DiskStore) SignedURL(key string, ttl time.Duration) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	query := url.Values{
+		"expires":   {expires},
+		"signature": {s.signature(key, expires)},
+	}
+	return LocalURLPath + key + "?" + query.Encode(), nil
+}
+
+func (s *DiskStore) ReadSigned(ctx context.Context, key string, query url.Values) ([]byte, error) {
+	expires := query.Get("expires")
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	expected, _ := hex.DecodeString(s.signature(key, expires))
+	if !hmac.Equal(signature, expected) {
+		return nil, ErrInvalidSignature
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return nil, ErrInvalidSignature
+	}
+	return s.Get(ctx, key)
+}
+
+func (s *DiskStore) signature(key, expires string) string {
+	mac := hmac.New(sha256.New, s.urlKey)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignedURL signs the prefixed key. The URL carries the full key, so
+// ReadSigned hands it to the store untouched.
+func (p prefixed) SignedURL(key string, ttl time.Duration) (string, error) {
+	signer, ok := p.store.(URLSigner)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	return signer.SignedURL(p.prefix+key, ttl)
+}
+
+func (p prefixed) ReadSigned(ctx context.Context, key string, query url.Values) ([]byte, error) {
+	reader, ok := p.store.(SignedReader)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return reader.ReadSigned(ctx, key, query)
+}
@@ -0,0 +1,401 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/passwords"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+	"github.com/tajious/heimdall/internal/vault"
+	"gopkg.in/yaml.v3"
+)
+
+// File is the declarative description of tenants, their environments, and
+// admin users. Values may reference environment variables as ${NAME} so
+// secrets can come from the deployment rather than the file.
+type File struct {
+	Tenants []Tenant `yaml:"tenants" validate:"dive"`
+}
+
+type Tenant struct {
+	ID              string            `yaml:"id" validate:"required,resource_id"`
+	Name            string            `yaml:"name" validate:"required,min=3,max=50"`
+	AuthMethod      models.AuthMethod `yaml:"auth_method,omitempty" validate:"omitempty,oneof=username_password delegated client_certificate"`
+	JWTDuration     int               `yaml:"jwt_duration,omitempty" validate:"min=0"`
+	RateLimitIP     int               `yaml:"rate_limit_ip,omitempty" validate:"min=0"`
+	RateLimitUser   int               `yaml:"rate_limit_user,omitempty" validate:"min=0"`
+	RateLimitWindow int               `yaml:"rate_limit_window,omitempty" validate:"min=0"`
+	Environments    []Environment     `yaml:"environments,omitempty" validate:"dive"`
+	Admins          []Admin           `yaml:"admins,omitempty" validate:"dive"`
+}
+
+type Environment struct {
+	ID              string `yaml:"id" validate:"omitempty,resource_id"`
+	Name            string `yaml:"name" validate:"required,alphanum,min=2,max=32"`
+	RateLimitIP     int    `yaml:"rate_limit_ip,omitempty" validate:"min=0"`
+	RateLimitUser   int    `yaml:"rate_limit_user,omitempty" validate:"min=0"`
+	RateLimitWindow int    `yaml:"rate_limit_window,omitempty" validate:"min=0"`
+	APIKey          string `yaml:"api_key,omitempty" validate:"omitempty,min=24"`
+}
+
+type Admin struct {
+	Username     string `yaml:"username" validate:"required,min=3,max=64"`
+	Password     string `yaml:"password,omitempty" validate:"omitempty,min=8,max=72"`
+	PasswordHash string `yaml:"password_hash,omitempty" validate:"required_without=Password"`
+	Environment  string `yaml:"environment,omitempty"`
+}
+
+type Action string
+
+const (
+	Created   Action = "created"
+	Updated   Action = "updated"
+	Unchanged Action = "unchanged"
+)
+
+// Change reports what applying the file did to one resource. APIKey is only
+// set for environments whose key was generated during this apply.
+type Change struct {
+	Kind   string
+	ID     string
+	Action Action
+	APIKey string
+}
+
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file File
+	if err := yaml.Unmarshal([]byte(expandEnv(string(data))), &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := validation.ValidateStruct(file); err != nil {
+		return nil, fmt.Errorf("validate %s: %w", path, err)
+	}
+	return &file, nil
+}
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${NAME} references only, so bcrypt hashes, which are
+// full of bare dollar signs, survive.
+func expandEnv(data string) string {
+	return envReference.ReplaceAllStringFunc(data, func(ref string) string {
+		return os.Getenv(ref[2 : len(ref)-1])
+	})
+}
+
+type Applier struct {
+	storage storage.Storage
+	hasher  *passwords.Hasher
+	secrets *vault.Vault
+}
+
+func NewApplier(storage storage.Storage, hasher *passwords.Hasher, secrets *vault.Vault) *Applier {
+	return &Applier{
+		storage: storage,
+		hasher:  hasher,
+		secrets: secrets,
+	}
+}
+
+// Apply converges storage to the file. Resources missing from the file are
+// left alone, so applying is safe to repeat on every start.
+func (a *Applier) Apply(ctx context.Context, file *File) ([]Change, error) {
+	var changes []Change
+	for _, spec := range file.Tenants {
+		tenant, change, err := a.applyTenant(ctx, spec)
+		if err != nil {
+			return changes, fmt.Errorf("tenant %s: %w", spec.ID, err)
+		}
+		changes = append(changes, change)
+
+		envIDs := make(map[string]string, len(spec.Environments))
+		for _, envSpec := range spec.Environments {
+			env, change, err := a.applyEnvironment(ctx, tenant, envSpec)
+			if err != nil {
+				return changes, fmt.Errorf("tenant %s environment %s: %w", spec.ID, envSpec.Name, err)
+			}
+			envIDs[env.Name] = env.ID
+			changes = append(changes, change)
+		}
+
+		for _, adminSpec := range spec.Admins {
+			envID := ""
+			if adminSpec.Environment != "" {
+				env, err := a.storage.GetEnvironmentByName(ctx, tenant.ID, adminSpec.Environment)
+				if err != nil {
+					return changes, fmt.Errorf("tenant %s admin %s: %w", spec.ID, adminSpec.Username, err)
+				}
+				envID = env.ID
+			}
+
+			change, err := a.applyAdmin(ctx, tenant, envID, adminSpec)
+			if err != nil {
+				return changes, fmt.Errorf("tenant %s admin %s: %w", spec.ID, adminSpec.Username, err)
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+func (a *Applier) applyTenant(ctx context.Context, spec Tenant) (*models.Tenant, Change, error) {
+	change := Change{Kind: "tenant", ID: spec.ID}
+
+	tenant, err := a.storage.GetTenant(ctx, spec.ID)
+	if err == storage.ErrTenantNotFound {
+		config := models.DefaultConfig(spec.ID)
+		applyTenantConfig(config, spec)
+		config.CreatedAt = time.Now()
+		config.UpdatedAt = time.Now()
+
+		tenant = &models.Tenant{
+			ID:        spec.ID,
+			Name:      spec.Name,
+			Status:    models.TenantActive,
+			Config:    *config,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		if err := a.storage.CreateTenant(ctx, tenant); err != nil {
+			return nil, change, err
+		}
+		// The token signing key is sealed once the tenant exists, so that
+		// its data key is stored in the tenant's region.
+		if tenant.Config.TokenSigningKey, err = keys.NewTenantKey(ctx, a.secrets, tenant.ID); err != nil {
+			return nil, change, err
+		}
+		if err := a.storage.UpdateTenantConfig(ctx, &tenant.Config); err != nil {
+			return nil, change, err
+		}
+		change.Action = Created
+		return tenant, change, nil
+	}
+	if err != nil {
+		return nil, change, err
+	}
+
+	change.Action = Unchanged
+	if tenant.Name != spec.Name {
+		tenant.Name = spec.Name
+		tenant.UpdatedAt = time.Now()
+		if err := a.storage.UpdateTenant(ctx, tenant); err != nil {
+			return nil, change, err
+		}
+		change.Action = Updated
+	}
+
+	config := tenant.Config
+	applyTenantConfig(&config, spec)
+	if !sameSettings(config, tenant.Config) {
+		config.UpdatedAt = time.Now()
+		if err := a.storage.UpdateTenantConfig(ctx, &config); err != nil {
+			return nil, change, err
+		}
+		tenant.Config = config
+		change.Action = Updated
+	}
+	return tenant, change, nil
+}
+
+// applyTenantConfig overwrites the settings the file specifies; zero values
+// keep the current (or default) setting.
+func applyTenantConfig(config *models.TenantConfig, spec Tenant) {
+	if spec.AuthMethod != "" {
+		config.AuthMethod = spec.AuthMethod
+	}
+	if spec.JWTDuration > 0 {
+		config.JWTDuration = spec.JWTDuration
+	}
+	if spec.RateLimitIP > 0 {
+		config.RateLimitIP = spec.RateLimitIP
+	}
+	if spec.RateLimitUser > 0 {
+		config.RateLimitUser = spec.RateLimitUser
+	}
+	if spec.RateLimitWindow > 0 {
+		config.RateLimitWindow = spec.RateLimitWindow
+	}
+}
+
+func sameSettings(a, b models.TenantConfig) bool {
+	return a.AuthMethod == b.AuthMethod &&
+		a.JWTDuration == b.JWTDuration &&
+		a.RateLimitIP == b.RateLimitIP &&
+		a.RateLimitUser == b.RateLimitUser &&
+		a.RateLimitWindow == b.RateLimitWindow
+}
+
+func (a *Applier) applyEnvironment(ctx context.Context, tenant *models.Tenant, spec Environment) (*models.Environment, Change, error) {
+	change := Change{Kind: "environment"}
+
+	env, err := a.findEnvironment(ctx, tenant, spec)
+	if err == storage.ErrEnvironmentNotFound {
+		signingKey, err := keys.NewEnvironmentKey(ctx, a.secrets, tenant.ID)
+		if err != nil {
+			return nil, change, err
+		}
+
+		apiKey := spec.APIKey
+		if apiKey == "" {
+			if apiKey, _, err = keys.GenerateAPIKey(spec.Name); err != nil {
+				return nil, change, err
+			}
+			change.APIKey = apiKey
+		}
+
+		env = &models.Environment{
+			ID:              spec.ID,
+			TenantID:        tenant.ID,
+			Name:            spec.Name,
+			APIKeyHash:      keys.HashAPIKey(apiKey),
+			APIKeyPrefix:    keys.APIKeyPrefix(apiKey),
+			SigningKey:      signingKey,
+			RateLimitIP:     orDefault(spec.RateLimitIP, tenant.Config.RateLimitIP),
+			RateLimitUser:   orDefault(spec.RateLimitUser, tenant.Config.RateLimitUser),
+			RateLimitWindow: orDefault(spec.RateLimitWindow, tenant.Config.RateLimitWindow),
+			CreatedAt:       time.Now(),
+			UpdatedAt:       time.Now(),
+		}
+		if err := a.storage.CreateEnvironment(ctx, env); err != nil {
+			return nil, change, err
+		}
+		change.ID = env.ID
+		change.Action = Created
+		return env, change, nil
+	}
+	if err != nil {
+		return nil, change, err
+	}
+
+	change.ID = env.ID
+	updated := *env
+	updated.Name = spec.Name
+	updated.RateLimitIP = orDefault(spec.RateLimitIP, env.RateLimitIP)
+	updated.RateLimitUser = orDefault(spec.RateLimitUser, env.RateLimitUser)
+	updated.RateLimitWindow = orDefault(spec.RateLimitWindow, env.RateLimitWindow)
+	if spec.APIKey != "" {
+		updated.APIKeyHash = keys.HashAPIKey(spec.APIKey)
+		updated.APIKeyPrefix = keys.APIKeyPrefix(spec.APIKey)
+	}
+
+	if updated == *env {
+		change.Action = Unchanged
+		return env, change, nil
+	}
+
+	updated.UpdatedAt = time.Now()
+	if err := a.storage.UpdateEnvironment(ctx, &updated); err != nil {
+		return nil, change, err
+	}
+	change.Action = Updated
+	return &updated, change, nil
+}
+
+func (a *Applier) findEnvironment(ctx context.Context, tenant *models.Tenant, spec Environment) (*models.Environment, error) {
+	if spec.ID == "" {
+		return a.storage.GetEnvironmentByName(ctx, tenant.ID, spec.Name)
+	}
+
+	env, err := a.storage.GetEnvironment(ctx, spec.ID)
+	if err != nil {
+		return nil, err
+	}
+	if env.TenantID != tenant.ID {
+		return nil, fmt.Errorf("environment ID %s belongs to another tenant", spec.ID)
+	}
+	return env, nil
+}
+
+func (a *Applier) applyAdmin(ctx context.Context, tenant *models.Tenant, envID string, spec Admin) (Change, error) {
+	change := Change{Kind: "admin"}
+
+	// Admins declared by the operator may use reserved names, but are
+	// normalized like any other user so they can log in.
+	username := validation.NormalizeUsername(tenant.Config.UsernamePolicy, spec.Username)
+	user, err := a.storage.GetPoolUserByUsername(ctx, tenant.ID, envID, username)
+	if err == storage.ErrUserNotFound {
+		hash, err := a.passwordHash(ctx, spec)
+		if err != nil {
+			return change, err
+		}
+
+		user = &models.User{
+			TenantID:      tenant.ID,
+			EnvironmentID: envID,
+			Username:      username,
+			Password:      hash,
+			Role:          models.RoleAdmin,
+			Status:        models.UserActive,
+			CreatedAt:     time.Now(),
+			UpdatedAt:     time.Now(),
+		}
+		if err := a.storage.CreateUser(ctx, user); err != nil {
+			return change, err
+		}
+		change.ID = user.ID
+		change.Action = Created
+		return change, nil
+	}
+	if err != nil {
+		return change, err
+	}
+
+	change.ID = user.ID
+	change.Action = Unchanged
+
+	dirty := false
+	if user.Role != models.RoleAdmin {
+		user.Role = models.RoleAdmin
+		dirty = true
+	}
+	if spec.PasswordHash != "" && user.Password != spec.PasswordHash {
+		user.Password = spec.PasswordHash
+		dirty = true
+	}
+	if spec.PasswordHash == "" {
+		err := a.hasher.Compare(ctx, user.Password, spec.Password)
+		if err == passwords.ErrMismatch {
+			if user.Password, err = a.hasher.Hash(ctx, spec.Password); err != nil {
+				return change, err
+			}
+			dirty = true
+		} else if err != nil {
+			return change, err
+		}
+	}
+
+	if !dirty {
+		return change, nil
+	}
+	user.UpdatedAt = time.Now()
+	if err := a.storage.UpdateUser(ctx, user); err != nil {
+		return change, err
+	}
+	change.Action = Updated
+	return change, nil
+}
+
+func (a *Applier) passwordHash(ctx context.Context, spec Admin) (string, error) {
+	if spec.PasswordHash != "" {
+		return spec.PasswordHash, nil
+	}
+	return a.hasher.Hash(ctx, spec.Password)
+}
+
+func orDefault(value, fallback int) int {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,140 @@
+// Package breaker trips when a dependency keeps failing, so requests take
+// their degraded path at once instead of waiting on it, and lets a single
+// call probe the dependency again once a cooldown has passed.
+package breaker
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tajious/heimdall/internal/metrics"
+)
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+type State string
+
+const (
+	Closed   State = "closed"
+	Open     State = "open"
+	HalfOpen State = "half_open"
+)
+
+// Breaker guards one dependency. Fallback describes, for /readyz, what the
+// service does instead while the breaker is not closed. A nil Breaker is
+// always closed.
+type Breaker struct {
+	name      string
+	fallback  string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+
+	degraded *metrics.Gauge
+}
+
+// New returns a closed breaker that opens after threshold consecutive
+// failures and stays open for cooldown.
+func New(name, fallback string, threshold int, cooldown time.Duration, registry *metrics.Registry) *Breaker {
+	degraded := registry.Gauge("heimdall_dependency_degraded", "Whether a dependency's breaker is open and its degraded behavior is in use.", "dependency").WithLabels(name)
+	degraded.Set(0)
+	return &Breaker{
+		name:      name,
+		fallback:  fallback,
+		threshold: max(threshold, 1),
+		cooldown:  cooldown,
+		state:     Closed,
+		degraded:  degraded,
+	}
+}
+
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+func (b *Breaker) Fallback() string {
+	return b.fallback
+}
+
+// State reports the breaker's state; an open breaker whose cooldown has
+// passed is reported half open, as its next call probes the dependency.
+func (b *Breaker) State() State {
+	if b == nil {
+		return Closed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open && time.Since(b.openedAt) >= b.cooldown {
+		return HalfOpen
+	}
+	return b.state
+}
+
+// Degraded reports whether the dependency is treated as down.
+func (b *Breaker) Degraded() bool {
+	return b.State() != Closed
+}
+
+// Allow reports whether a call may go to the dependency: always while the
+// breaker is closed, and otherwise for a single probe per cooldown.
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Closed {
+		return true
+	}
+	if time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.state, b.openedAt = HalfOpen, time.Now()
+	return true
+}
+
+// Record counts the outcome of a call to the dependency.
+func (b *Breaker) Record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.state != Closed {
+			log.Printf("%s recovered, leaving degraded mode", b.name)
+			b.degraded.Set(0)
+		}
+		b.state, b.failures = Closed, 0
+		return
+	}
+
+	b.failures++
+	if b.state == Closed && b.failures < b.threshold {
+		return
+	}
+	if b.state == Closed {
+		log.Printf("%s failed %d times in a row, degrading: %s (last error: %v)", b.name, b.failures, b.fallback, err)
+		b.degraded.Set(1)
+	}
+	b.state, b.openedAt = Open, time.Now()
+}
+
+// Do calls fn unless the breaker is open, and records its outcome.
+func (b *Breaker) Do(fn func() error) error {
+	if !b.Allow() {
+		return ErrOpen
+	}
+	err := fn()
+	b.Record(err)
+	return err
+}
@@ -0,0 +1,97 @@
+// Package chaos injects latency and errors into storage and Redis calls, so
+// operators can rehearse in staging how logins and token validation behave
+// while their dependencies are slow or failing. It must never run in
+// production.
+package chaos
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/metrics"
+)
+
+const (
+	TargetStorage = "storage"
+	TargetRedis   = "redis"
+)
+
+// Header opts a request into fault injection when Config.OptIn is set.
+const Header = "X-Heimdall-Chaos"
+
+var ErrInjected = errors.New("chaos: injected fault")
+
+// Config sets how often calls are slowed down or failed, in percent of the
+// calls to each target. With OptIn only the calls made for requests sending
+// Header are touched, leaving other traffic and background jobs alone.
+type Config struct {
+	Targets        []string
+	ErrorPercent   float64
+	Latency        time.Duration
+	LatencyPercent float64
+	OptIn          bool
+}
+
+// RequestKey marks, in the fiber locals, a request that opted in.
+type RequestKey struct{}
+
+type Injector struct {
+	cfg     Config
+	targets map[string]bool
+	faults  *metrics.CounterVec
+}
+
+func New(cfg Config, registry *metrics.Registry) *Injector {
+	targets := make(map[string]bool, len(cfg.Targets))
+	for _, target := range cfg.Targets {
+		targets[target] = true
+	}
+	return &Injector{
+		cfg:     cfg,
+		targets: targets,
+		faults:  registry.Counter("heimdall_chaos_faults_total", "Faults injected into dependency calls by chaos mode.", "target", "fault"),
+	}
+}
+
+// Targets reports whether faults are injected into target.
+func (i *Injector) Targets(target string) bool {
+	return i.targets[target]
+}
+
+// Middleware marks the requests that opt in with Header.
+func (i *Injector) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if i.cfg.OptIn && c.Get(Header) != "" {
+			c.Locals(RequestKey{}, true)
+		}
+		return c.Next()
+	}
+}
+
+// Inject delays a call to target and decides whether it fails, returning
+// ErrInjected when it does.
+func (i *Injector) Inject(ctx context.Context, target string) error {
+	if !i.targets[target] {
+		return nil
+	}
+	if optedIn, _ := ctx.Value(RequestKey{}).(bool); i.cfg.OptIn && !optedIn {
+		return nil
+	}
+
+	if i.cfg.Latency > 0 && rand.Float64()*100 < i.cfg.LatencyPercent {
+		i.faults.WithLabels(target, "latency").Inc()
+		select {
+		case <-time.After(i.cfg.Latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if rand.Float64()*100 < i.cfg.ErrorPercent {
+		i.faults.WithLabels(target, "error").Inc()
+		return ErrInjected
+	}
+	return nil
+}
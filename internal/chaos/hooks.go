@@ -0,0 +1,83 @@
+package chaos
+
+import (
+	"context"
+	"net"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// RedisHook injects faults into the commands and pipelines of a Redis
+// client, before they are sent.
+func (i *Injector) RedisHook() redis.Hook {
+	return redisHook{injector: i}
+}
+
+type redisHook struct {
+	injector *Injector
+}
+
+func (h redisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (h redisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := h.injector.Inject(ctx, TargetRedis); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h redisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if err := h.injector.Inject(ctx, TargetRedis); err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// GORMPlugin injects faults into every query and write GORM runs, before
+// it reaches the database.
+func (i *Injector) GORMPlugin() gorm.Plugin {
+	return gormPlugin{injector: i}
+}
+
+type gormPlugin struct {
+	injector *Injector
+}
+
+func (p gormPlugin) Name() string {
+	return "chaos"
+}
+
+func (p gormPlugin) Initialize(db *gorm.DB) error {
+	inject := func(tx *gorm.DB) {
+		if err := p.injector.Inject(tx.Statement.Context, TargetStorage); err != nil {
+			tx.AddError(err)
+		}
+	}
+	callbacks := db.Callback()
+	for _, err := range []error{
+		callbacks.Create().Before("gorm:create").Register("chaos:create", inject),
+		callbacks.Query().Before("gorm:query").Register("chaos:query", inject),
+		callbacks.Update().Before("gorm:update").Register("chaos:update", inject),
+		callbacks.Delete().Before("gorm:delete").Register("chaos:delete", inject),
+		callbacks.Row().Before("gorm:row").Register("chaos:row", inject),
+		callbacks.Raw().Before("gorm:raw").Register("chaos:raw", inject),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
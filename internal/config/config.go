@@ -1,24 +1,197 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	Redis    RedisConfig
-	JWT      JWTConfig
+	Server    ServerConfig
+	Database  DatabaseConfig
+	Redis     RedisConfig
+	JWT       JWTConfig
+	Retention RetentionConfig
+	Search    SearchConfig
+	Authz     AuthzConfig
+	SMTP      SMTPConfig
+	Blob      BlobConfig
+	Archive   ArchiveConfig
 }
 
 type ServerConfig struct {
-	Port        string
-	Environment string
-	RateLimit   RateLimitConfig
+	Port             string
+	Environment      string
+	TenantBaseDomain string
+
+	// AdminPort, when set, moves the management plane (tenant CRUD, metrics,
+	// health, admin UI) onto its own listener so it can be firewalled off.
+	AdminPort string
+
+	// TLSCertFile and TLSKeyFile, when both set, serve the API over TLS and
+	// ask clients for a certificate, which tenants using client certificate
+	// authentication verify at login.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// ClientCertHeader names the header a TLS-terminating proxy forwards the
+	// client certificate chain in. Only set it when every request comes
+	// through the proxy.
+	ClientCertHeader string
+
+	// SignatureWindow is how far the signing time of a signed request may be
+	// from the server's clock.
+	SignatureWindow time.Duration
+
+	// ReencryptInterval is how often secrets sealed with a rotated tenant
+	// data key are sealed again with the tenant's active one.
+	ReencryptInterval time.Duration
+
+	// DigestInterval is how often the tenants' digest emails are checked
+	// for being due.
+	DigestInterval time.Duration
+
+	// ExportInterval is how often queued exports are looked for, and
+	// ExportURLTTL how long the download URL of an export lasts.
+	ExportInterval time.Duration
+	ExportURLTTL   time.Duration
+
+	// PreloadTenants warms the caches for tenants at startup, for the
+	// PreloadTop most active of them or all of them when it is zero.
+	PreloadTenants bool
+	PreloadTop     int
+
+	// OperatorToken guards the runtime diagnostics endpoints. They are
+	// disabled while it is empty.
+	OperatorToken string
+
+	// KillSwitches lists switches engaged at startup, as accepted by
+	// middleware.ParseKillSwitches.
+	KillSwitches string
+
+	MaintenanceMode bool
+
+	// ReadOnly runs a disaster recovery standby against a replica database:
+	// reads are served, writes are rejected, and nothing is migrated or purged.
+	ReadOnly bool
+
+	// AllowInMemoryReplicas skips the refusal to run in-memory storage under
+	// a container orchestrator, where replicas would diverge.
+	AllowInMemoryReplicas bool
+
+	// APIV1DeprecatedAt and APIV1SunsetAt (YYYY-MM-DD) announce the retirement
+	// of /api/v1 in favour of /api/v2.
+	APIV1DeprecatedAt string
+	APIV1SunsetAt     string
+
+	RateLimit      RateLimitConfig
+	RateLimitStore RateLimitStoreConfig
+	AbusePenalty   AbusePenaltyConfig
+	LoadShedding   LoadSheddingConfig
+	Degradation    DegradationConfig
+	Chaos          ChaosConfig
+	Logging        LoggingConfig
+
+	PasswordWorkers      int
+	PasswordQueueTimeout time.Duration
+	// PwnedPasswordsURL is the HaveIBeenPwned range API used by tenants that
+	// reject breached passwords; empty disables the check.
+	PwnedPasswordsURL string
+
+	// LoginHookTimeout bounds login hooks that do not set their own timeout.
+	LoginHookTimeout time.Duration
+	WASMPlugins      WASMPluginsConfig
+
+	// SlowLoginThreshold logs the stage breakdown of logins taking at least
+	// this long; zero disables the log.
+	SlowLoginThreshold time.Duration
+
+	BootstrapFile string
+
+	// StartupMaxWait bounds how long startup keeps retrying Postgres and Redis
+	// before giving up.
+	StartupMaxWait time.Duration
+}
+
+// WASMPluginsConfig lets tenants deploy sandboxed WASM login plugins, each
+// limited to MaxModuleSize bytes of code and MaxMemory bytes of memory.
+type WASMPluginsConfig struct {
+	Enabled       bool
+	MaxModuleSize int
+	MaxMemory     int
+}
+
+// AbusePenaltyConfig controls what happens to an IP that keeps hitting the
+// login limits: Mode is off, tarpit or block.
+type AbusePenaltyConfig struct {
+	Mode         string
+	Strikes      int
+	StrikeWindow time.Duration
+	TTL          time.Duration
+	TarpitDelay  time.Duration
+}
+
+// RateLimitStoreConfig selects where production keeps rate limit counters:
+// redis, memcached, or dynamodb. Development always keeps them in memory.
+type RateLimitStoreConfig struct {
+	Backend       string
+	MemcachedAddr string
+	DynamoDB      DynamoDBConfig
+}
+
+type DynamoDBConfig struct {
+	Table           string
+	Region          string
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+type LoadSheddingConfig struct {
+	Enabled        bool
+	MinConcurrency int
+	MaxConcurrency int
+	TargetLatency  time.Duration
+	Priorities     string
+}
+
+// DegradationConfig controls when a failing dependency is given up on for
+// its degraded mode: after FailureThreshold failures in a row, for Cooldown
+// before it is tried again. The database is pinged every ProbeInterval.
+type DegradationConfig struct {
+	FailureThreshold int
+	Cooldown         time.Duration
+	ProbeInterval    time.Duration
+}
+
+// ChaosConfig injects latency and errors into a share of the calls to the
+// Targets, storage and redis, to rehearse outages in staging. With OptIn
+// only requests sending the X-Heimdall-Chaos header are affected.
+type ChaosConfig struct {
+	Enabled        bool
+	Targets        []string
+	ErrorPercent   float64
+	Latency        time.Duration
+	LatencyPercent float64
+	OptIn          bool
+}
+
+// LoggingConfig controls the request log. At the debug Level request bodies
+// are logged too, with secrets and the RedactFields dropped, phone numbers
+// and the MaskFields masked, and RedactRoutes applied as accepted by
+// redact.ParseRoutes.
+type LoggingConfig struct {
+	Level        string
+	RedactFields []string
+	MaskFields   []string
+	RedactRoutes string
 }
 
 type DatabaseConfig struct {
@@ -29,6 +202,32 @@ type DatabaseConfig struct {
 	Password string
 	DBName   string
 	SSLMode  string
+
+	// RowLevelSecurity has Postgres enforce tenant isolation on every query
+	// a tenant's request makes, on top of the storage layer's filters.
+	RowLevelSecurity bool
+
+	// PrepareStatements has GORM prepare each distinct query once per
+	// connection. QueryExecMode and StatementCacheCapacity are handed to pgx
+	// as default_query_exec_mode and statement_cache_capacity; empty and 0
+	// keep the pgx defaults.
+	PrepareStatements      bool
+	QueryExecMode          string
+	StatementCacheCapacity int
+
+	// SlowQueryThreshold logs the queries taking at least this long; zero
+	// disables the log and the query metrics.
+	SlowQueryThreshold time.Duration
+
+	// Regions maps region names to the connection URLs of the databases
+	// keeping the data of the tenants in each, for data residency. Tenants
+	// outside any region stay in the main database.
+	Regions map[string]string
+
+	// Shards are the connection URLs of the databases, besides the main
+	// one, the tenants outside any region are spread over by the hash of
+	// their ID.
+	Shards []string
 }
 
 type RedisConfig struct {
@@ -41,6 +240,74 @@ type RedisConfig struct {
 type JWTConfig struct {
 	Secret           string
 	AccessExpiration time.Duration
+	KeyCacheTTL      time.Duration
+
+	// ClockSkew is the leeway allowed on a token's exp, nbf, and iat.
+	ClockSkew time.Duration
+
+	// Algorithm is HS256, signing with Secret and the tenant and environment
+	// keys, or EdDSA, which also signs the tokens of tenants that opt in
+	// with the Ed25519 key in Ed25519KeyFile.
+	Algorithm      string
+	Ed25519KeyFile string
+
+	// LegacySecretCutoff, when set, is when tokens signed with Secret
+	// instead of a tenant or environment key stop being accepted.
+	LegacySecretCutoff time.Time
+}
+
+type RetentionConfig struct {
+	Interval      time.Duration
+	Sessions      time.Duration
+	OneTimeTokens time.Duration
+	AuditLogs     time.Duration
+	RateLimits    time.Duration
+
+	// TenantArchives is how long the archives of deleted tenants are kept.
+	TenantArchives time.Duration
+	// Jobs is how long jobs, and the exports they wrote, are kept.
+	Jobs time.Duration
+}
+
+// BlobConfig selects where this deployment keeps background exports, tenant
+// archives, and staged imports: disk, under Dir; s3, in Bucket; or gcs, in
+// Bucket with a service account HMAC key. Empty disables them.
+type BlobConfig struct {
+	Driver          string
+	Dir             string
+	Prefix          string
+	Bucket          string
+	Region          string
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// ArchiveConfig seals the archives of deleted tenants kept in the blob store.
+type ArchiveConfig struct {
+	Passphrase string
+}
+
+type SearchConfig struct {
+	OpenSearchURL      string
+	OpenSearchIndex    string
+	OpenSearchUsername string
+	OpenSearchPassword string
+}
+
+// SMTPConfig is the mail server notifications are sent through. With no
+// Host, notifications are only logged.
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+type AuthzConfig struct {
+	DecisionCacheTTL time.Duration
 }
 
 type RateLimitConfig struct {
@@ -50,24 +317,149 @@ type RateLimitConfig struct {
 }
 
 func Load() (*Config, error) {
-	if err := godotenv.Load(); err != nil {
+	// The .env file is optional, so the demo runs with no setup at all.
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return nil, err
 	}
 
+	statementCacheCapacity, _ := strconv.Atoi(getEnv("DB_STATEMENT_CACHE_CAPACITY", "0"))
+	slowQueryThreshold, _ := strconv.Atoi(getEnv("DB_SLOW_QUERY_THRESHOLD_MS", "200"))
 	redisDB, _ := strconv.Atoi(getEnv("REDIS_DB", "0"))
 	rateLimit, _ := strconv.Atoi(getEnv("RATE_LIMIT", "100"))
 	rateLimitWindow, _ := strconv.Atoi(getEnv("RATE_LIMIT_WINDOW", "60"))
 	jwtExpiration, _ := strconv.Atoi(getEnv("JWT_EXPIRATION_MINUTES", "60"))
+	jwtKeyCacheTTL, _ := strconv.Atoi(getEnv("JWT_KEY_CACHE_TTL_SECONDS", "300"))
+	jwtClockSkew, _ := strconv.Atoi(getEnv("JWT_CLOCK_SKEW_SECONDS", "30"))
+	abuseStrikes, _ := strconv.Atoi(getEnv("ABUSE_STRIKES", "20"))
+	abuseStrikeWindow, _ := strconv.Atoi(getEnv("ABUSE_STRIKE_WINDOW_SECONDS", "600"))
+	abusePenaltyTTL, _ := strconv.Atoi(getEnv("ABUSE_PENALTY_TTL_MINUTES", "60"))
+	abuseTarpitDelay, _ := strconv.Atoi(getEnv("ABUSE_TARPIT_DELAY_MS", "3000"))
+	loadShedMin, _ := strconv.Atoi(getEnv("LOAD_SHED_MIN_CONCURRENCY", "10"))
+	loadShedMax, _ := strconv.Atoi(getEnv("LOAD_SHED_MAX_CONCURRENCY", "500"))
+	loadShedTarget, _ := strconv.Atoi(getEnv("LOAD_SHED_TARGET_LATENCY_MS", "250"))
+	degradeThreshold, _ := strconv.Atoi(getEnv("DEGRADE_FAILURE_THRESHOLD", "5"))
+	degradeCooldown, _ := strconv.Atoi(getEnv("DEGRADE_COOLDOWN_SECONDS", "10"))
+	dbProbeInterval, _ := strconv.Atoi(getEnv("DB_PROBE_INTERVAL_SECONDS", "5"))
+	chaosErrorPercent, _ := strconv.ParseFloat(getEnv("CHAOS_ERROR_PERCENT", "0"), 64)
+	chaosLatency, _ := strconv.Atoi(getEnv("CHAOS_LATENCY_MS", "0"))
+	chaosLatencyPercent, _ := strconv.ParseFloat(getEnv("CHAOS_LATENCY_PERCENT", "0"), 64)
+	passwordWorkers, _ := strconv.Atoi(getEnv("PASSWORD_HASH_WORKERS", "0"))
+	passwordQueueTimeout, _ := strconv.Atoi(getEnv("PASSWORD_HASH_QUEUE_TIMEOUT_MS", "2000"))
+	retentionInterval, _ := strconv.Atoi(getEnv("RETENTION_INTERVAL_MINUTES", "60"))
+	retentionSessions, _ := strconv.Atoi(getEnv("RETENTION_SESSIONS_HOURS", "24"))
+	retentionOneTimeTokens, _ := strconv.Atoi(getEnv("RETENTION_ONE_TIME_TOKENS_HOURS", "24"))
+	retentionAuditLogs, _ := strconv.Atoi(getEnv("RETENTION_AUDIT_LOGS_HOURS", "2160"))
+	retentionRateLimits, _ := strconv.Atoi(getEnv("RETENTION_RATE_LIMITS_HOURS", "0"))
+	retentionTenantArchives, _ := strconv.Atoi(getEnv("RETENTION_TENANT_ARCHIVES_HOURS", "2160"))
+	retentionJobs, _ := strconv.Atoi(getEnv("RETENTION_JOBS_HOURS", "168"))
+	authzDecisionCacheTTL, _ := strconv.Atoi(getEnv("AUTHZ_DECISION_CACHE_TTL_SECONDS", "30"))
+	startupMaxWait, _ := strconv.Atoi(getEnv("STARTUP_MAX_WAIT_SECONDS", "60"))
+	loginHookTimeout, _ := strconv.Atoi(getEnv("LOGIN_HOOK_TIMEOUT_MS", "2000"))
+	slowLoginThreshold, _ := strconv.Atoi(getEnv("SLOW_LOGIN_THRESHOLD_MS", "1000"))
+	wasmMaxSize, _ := strconv.Atoi(getEnv("WASM_PLUGIN_MAX_SIZE_KB", "1024"))
+	wasmMaxMemory, _ := strconv.Atoi(getEnv("WASM_PLUGIN_MAX_MEMORY_MB", "16"))
+	signatureWindow, _ := strconv.Atoi(getEnv("REQUEST_SIGNATURE_WINDOW_SECONDS", "300"))
+	regions, err := parseRegions(getEnv("DB_REGIONS", ""))
+	if err != nil {
+		return nil, err
+	}
+	preloadTenants, preloadTop, err := parsePreload(getEnv("PRELOAD_TENANTS", ""))
+	if err != nil {
+		return nil, err
+	}
+	legacySecretCutoff, err := parseCutoff(getEnv("JWT_LEGACY_SECRET_CUTOFF", ""))
+	if err != nil {
+		return nil, err
+	}
+	reencryptInterval, _ := strconv.Atoi(getEnv("TENANT_KEY_REENCRYPT_INTERVAL_MINUTES", "5"))
+	digestInterval, _ := strconv.Atoi(getEnv("DIGEST_INTERVAL_MINUTES", "15"))
+	exportInterval, _ := strconv.Atoi(getEnv("EXPORT_INTERVAL_SECONDS", "5"))
+	exportURLTTL, _ := strconv.Atoi(getEnv("EXPORT_URL_TTL_MINUTES", "15"))
 
-	return &Config{
+	cfg := &Config{
 		Server: ServerConfig{
-			Port:        getEnv("PORT", "8080"),
-			Environment: getEnv("ENVIRONMENT", "development"),
+			Port:                  getEnv("PORT", "8080"),
+			Environment:           getEnv("ENVIRONMENT", "development"),
+			TenantBaseDomain:      getEnv("TENANT_BASE_DOMAIN", ""),
+			AdminPort:             getEnv("ADMIN_PORT", ""),
+			TLSCertFile:           getEnv("TLS_CERT_FILE", ""),
+			TLSKeyFile:            getEnv("TLS_KEY_FILE", ""),
+			ClientCertHeader:      getEnv("CLIENT_CERT_HEADER", ""),
+			SignatureWindow:       time.Duration(signatureWindow) * time.Second,
+			ReencryptInterval:     time.Duration(reencryptInterval) * time.Minute,
+			DigestInterval:        time.Duration(digestInterval) * time.Minute,
+			ExportInterval:        time.Duration(exportInterval) * time.Second,
+			ExportURLTTL:          time.Duration(exportURLTTL) * time.Minute,
+			PreloadTenants:        preloadTenants,
+			PreloadTop:            preloadTop,
+			OperatorToken:         getEnv("OPERATOR_TOKEN", ""),
+			KillSwitches:          getEnv("KILL_SWITCHES", ""),
+			MaintenanceMode:       getEnv("MAINTENANCE_MODE", "false") == "true",
+			AllowInMemoryReplicas: getEnv("ALLOW_IN_MEMORY_REPLICAS", "false") == "true",
+			APIV1DeprecatedAt:     getEnv("API_V1_DEPRECATED_AT", ""),
+			APIV1SunsetAt:         getEnv("API_V1_SUNSET_AT", ""),
 			RateLimit: RateLimitConfig{
 				Enabled: getEnv("RATE_LIMIT_ENABLED", "true") == "true",
 				Limit:   rateLimit,
 				Window:  time.Duration(rateLimitWindow) * time.Second,
 			},
+			RateLimitStore: RateLimitStoreConfig{
+				Backend:       getEnv("RATE_LIMIT_STORE", "redis"),
+				MemcachedAddr: getEnv("MEMCACHED_ADDR", "localhost:11211"),
+				DynamoDB: DynamoDBConfig{
+					Table:           getEnv("DYNAMODB_TABLE", "heimdall-rate-limits"),
+					Region:          getEnv("AWS_REGION", ""),
+					Endpoint:        getEnv("DYNAMODB_ENDPOINT", ""),
+					AccessKeyID:     getEnv("AWS_ACCESS_KEY_ID", ""),
+					SecretAccessKey: getEnv("AWS_SECRET_ACCESS_KEY", ""),
+					SessionToken:    getEnv("AWS_SESSION_TOKEN", ""),
+				},
+			},
+			AbusePenalty: AbusePenaltyConfig{
+				Mode:         getEnv("ABUSE_PENALTY_MODE", "off"),
+				Strikes:      abuseStrikes,
+				StrikeWindow: time.Duration(abuseStrikeWindow) * time.Second,
+				TTL:          time.Duration(abusePenaltyTTL) * time.Minute,
+				TarpitDelay:  time.Duration(abuseTarpitDelay) * time.Millisecond,
+			},
+			LoadShedding: LoadSheddingConfig{
+				Enabled:        getEnv("LOAD_SHED_ENABLED", "false") == "true",
+				MinConcurrency: loadShedMin,
+				MaxConcurrency: loadShedMax,
+				TargetLatency:  time.Duration(loadShedTarget) * time.Millisecond,
+				Priorities:     getEnv("LOAD_SHED_PRIORITIES", ""),
+			},
+			Degradation: DegradationConfig{
+				FailureThreshold: degradeThreshold,
+				Cooldown:         time.Duration(degradeCooldown) * time.Second,
+				ProbeInterval:    time.Duration(dbProbeInterval) * time.Second,
+			},
+			Chaos: ChaosConfig{
+				Enabled:        getEnv("CHAOS_ENABLED", "false") == "true",
+				Targets:        strings.Split(getEnv("CHAOS_TARGETS", "storage,redis"), ","),
+				ErrorPercent:   chaosErrorPercent,
+				Latency:        time.Duration(chaosLatency) * time.Millisecond,
+				LatencyPercent: chaosLatencyPercent,
+				OptIn:          getEnv("CHAOS_OPT_IN", "true") == "true",
+			},
+			Logging: LoggingConfig{
+				Level:        getEnv("LOG_LEVEL", "info"),
+				RedactFields: splitList(getEnv("LOG_REDACT_FIELDS", "")),
+				MaskFields:   splitList(getEnv("LOG_MASK_FIELDS", "")),
+				RedactRoutes: getEnv("LOG_REDACT_ROUTES", ""),
+			},
+			PasswordWorkers:      passwordWorkers,
+			PasswordQueueTimeout: time.Duration(passwordQueueTimeout) * time.Millisecond,
+			PwnedPasswordsURL:    getEnv("PWNED_PASSWORDS_URL", "https://api.pwnedpasswords.com"),
+			LoginHookTimeout:     time.Duration(loginHookTimeout) * time.Millisecond,
+			SlowLoginThreshold:   time.Duration(slowLoginThreshold) * time.Millisecond,
+			WASMPlugins: WASMPluginsConfig{
+				Enabled:       getEnv("WASM_PLUGINS_ENABLED", "false") == "true",
+				MaxModuleSize: wasmMaxSize << 10,
+				MaxMemory:     wasmMaxMemory << 20,
+			},
+			BootstrapFile:  getEnv("BOOTSTRAP_FILE", ""),
+			StartupMaxWait: time.Duration(startupMaxWait) * time.Second,
 		},
 		Database: DatabaseConfig{
 			Driver:   getEnv("DB_DRIVER", "postgres"),
@@ -77,6 +469,17 @@ func Load() (*Config, error) {
 			Password: getEnv("DB_PASSWORD", "postgres"),
 			DBName:   getEnv("DB_NAME", "heimdall"),
 			SSLMode:  getEnv("DB_SSL_MODE", "disable"),
+
+			RowLevelSecurity: getEnv("DB_ROW_LEVEL_SECURITY", "false") == "true",
+
+			PrepareStatements:      getEnv("DB_PREPARE_STATEMENTS", "true") == "true",
+			QueryExecMode:          getEnv("DB_QUERY_EXEC_MODE", ""),
+			StatementCacheCapacity: statementCacheCapacity,
+
+			SlowQueryThreshold: time.Duration(slowQueryThreshold) * time.Millisecond,
+
+			Regions: regions,
+			Shards:  splitList(getEnv("DB_SHARDS", "")),
 		},
 		Redis: RedisConfig{
 			Host:     getEnv("REDIS_HOST", "localhost"),
@@ -85,10 +488,155 @@ func Load() (*Config, error) {
 			DB:       redisDB,
 		},
 		JWT: JWTConfig{
-			Secret:           getEnv("JWT_SECRET", "your-secret-key"),
+			Secret:           getEnv("JWT_SECRET", ""),
 			AccessExpiration: time.Duration(jwtExpiration) * time.Hour * 24,
+			KeyCacheTTL:      time.Duration(jwtKeyCacheTTL) * time.Second,
+			ClockSkew:        time.Duration(jwtClockSkew) * time.Second,
+			Algorithm:        getEnv("JWT_ALGORITHM", "HS256"),
+			Ed25519KeyFile:   getEnv("JWT_ED25519_KEY_FILE", ""),
+
+			LegacySecretCutoff: legacySecretCutoff,
+		},
+		Retention: RetentionConfig{
+			Interval:      time.Duration(retentionInterval) * time.Minute,
+			Sessions:      time.Duration(retentionSessions) * time.Hour,
+			OneTimeTokens: time.Duration(retentionOneTimeTokens) * time.Hour,
+			AuditLogs:     time.Duration(retentionAuditLogs) * time.Hour,
+			RateLimits:    time.Duration(retentionRateLimits) * time.Hour,
+
+			TenantArchives: time.Duration(retentionTenantArchives) * time.Hour,
+			Jobs:           time.Duration(retentionJobs) * time.Hour,
+		},
+		Search: SearchConfig{
+			OpenSearchURL:      getEnv("OPENSEARCH_URL", ""),
+			OpenSearchIndex:    getEnv("OPENSEARCH_INDEX", "heimdall-users"),
+			OpenSearchUsername: getEnv("OPENSEARCH_USERNAME", ""),
+			OpenSearchPassword: getEnv("OPENSEARCH_PASSWORD", ""),
+		},
+		Authz: AuthzConfig{
+			DecisionCacheTTL: time.Duration(authzDecisionCacheTTL) * time.Second,
+		},
+		SMTP: SMTPConfig{
+			Host:     getEnv("SMTP_HOST", ""),
+			Port:     getEnv("SMTP_PORT", "587"),
+			Username: getEnv("SMTP_USERNAME", ""),
+			Password: getEnv("SMTP_PASSWORD", ""),
+			From:     getEnv("SMTP_FROM", "heimdall@localhost"),
 		},
-	}, nil
+		Blob: loadBlobConfig(),
+		Archive: ArchiveConfig{
+			Passphrase: getEnv("TENANT_ARCHIVE_PASSPHRASE", ""),
+		},
+	}
+	if err := cfg.decryptSecrets(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseRegions reads DB_REGIONS, a comma-separated list of name=URL pairs
+// such as eu=postgres://heimdall@eu-db/heimdall.
+func parseRegions(value string) (map[string]string, error) {
+	regions := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, url, ok := strings.Cut(pair, "=")
+		name, url = strings.TrimSpace(name), strings.TrimSpace(url)
+		if !ok || name == "" || url == "" {
+			return nil, fmt.Errorf("DB_REGIONS: %q is not a name=URL pair", pair)
+		}
+		if _, exists := regions[name]; exists {
+			return nil, fmt.Errorf("DB_REGIONS: region %s is listed twice", name)
+		}
+		regions[name] = url
+	}
+	return regions, nil
+}
+
+// parsePreload reads PRELOAD_TENANTS: empty to preload nothing, "all", or
+// how many of the most active tenants to preload.
+func parsePreload(value string) (bool, int, error) {
+	switch value = strings.TrimSpace(value); value {
+	case "":
+		return false, 0, nil
+	case "all":
+		return true, 0, nil
+	}
+	top, err := strconv.Atoi(value)
+	if err != nil || top <= 0 {
+		return false, 0, fmt.Errorf("PRELOAD_TENANTS: %q is neither all nor a positive number of tenants", value)
+	}
+	return true, top, nil
+}
+
+// parseCutoff reads JWT_LEGACY_SECRET_CUTOFF, an RFC 3339 time or a date
+// taken as midnight UTC.
+func parseCutoff(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if cutoff, err := time.Parse(time.RFC3339, value); err == nil {
+		return cutoff, nil
+	}
+	cutoff, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("JWT_LEGACY_SECRET_CUTOFF: %q is neither an RFC 3339 time nor a date", value)
+	}
+	return cutoff, nil
+}
+
+// InMemory reports whether the environment keeps all state in memory: the
+// development environment, and the demo, which also seeds sample data.
+func (c *ServerConfig) InMemory() bool {
+	return c.Environment == "development" || c.Environment == "demo"
+}
+
+// loadBlobConfig reads the BLOB_* variables, falling back to the ARCHIVE_*
+// ones deployments set when the blob store only kept tenant archives.
+func loadBlobConfig() BlobConfig {
+	driver := getEnvOr("BLOB_STORE", "ARCHIVE_STORE", "")
+	if driver == "file" {
+		driver = "disk"
+	}
+	// Archives used to be kept at ARCHIVE_PREFIX + tenant, and are now kept
+	// under tenant-archives/ of the blob store, so the old default prefix
+	// maps to none.
+	prefix, ok := os.LookupEnv("BLOB_PREFIX")
+	if !ok {
+		prefix = strings.TrimSuffix(strings.TrimSuffix(getEnv("ARCHIVE_PREFIX", ""), "/"), "tenant-archives")
+	}
+	return BlobConfig{
+		Driver:          driver,
+		Dir:             getEnvOr("BLOB_DIR", "ARCHIVE_DIR", "./data/blobs"),
+		Prefix:          prefix,
+		Bucket:          getEnvOr("BLOB_BUCKET", "ARCHIVE_S3_BUCKET", ""),
+		Region:          getEnvOr("BLOB_REGION", "ARCHIVE_S3_REGION", ""),
+		Endpoint:        getEnvOr("BLOB_ENDPOINT", "ARCHIVE_S3_ENDPOINT", ""),
+		AccessKeyID:     getEnvOr("BLOB_ACCESS_KEY_ID", "ARCHIVE_S3_ACCESS_KEY_ID", ""),
+		SecretAccessKey: getEnvOr("BLOB_SECRET_ACCESS_KEY", "ARCHIVE_S3_SECRET_ACCESS_KEY", ""),
+		SessionToken:    getEnvOr("BLOB_SESSION_TOKEN", "ARCHIVE_S3_SESSION_TOKEN", ""),
+	}
+}
+
+// getEnvOr reads key, or oldKey, the name key replaced, when key is unset.
+func getEnvOr(key, oldKey, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return getEnv(oldKey, defaultValue)
 }
 
 func getEnv(key, defaultValue string) string {
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// EncryptedPrefix marks a value sealed with AES-256-GCM under the master
+// key, laid out as base64(nonce | ciphertext).
+const EncryptedPrefix = "enc:AES256:"
+
+const masterKeySize = 32
+
+var ErrNoMasterKey = errors.New("encrypted configuration values need CONFIG_MASTER_KEY_FILE or CONFIG_MASTER_KEY_COMMAND")
+
+// LoadMasterKey reads the hex-encoded master key from CONFIG_MASTER_KEY_FILE,
+// or from the output of CONFIG_MASTER_KEY_COMMAND, which lets a KMS or a
+// secret manager hand out the key without it ever touching the disk.
+func LoadMasterKey() ([]byte, error) {
+	var encoded []byte
+	if path := os.Getenv("CONFIG_MASTER_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read master key: %w", err)
+		}
+		encoded = data
+	} else if command := os.Getenv("CONFIG_MASTER_KEY_COMMAND"); command != "" {
+		out, err := exec.Command("sh", "-c", command).Output()
+		if err != nil {
+			return nil, fmt.Errorf("run master key command: %w", err)
+		}
+		encoded = out
+	} else {
+		return nil, ErrNoMasterKey
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != masterKeySize {
+		return nil, fmt.Errorf("the master key must be %d hex-encoded bytes", masterKeySize)
+	}
+	return key, nil
+}
+
+// Encrypt seals value under key for use in the environment or a .env file.
+func Encrypt(key []byte, value string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return EncryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt.
+func Decrypt(key []byte, value string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, EncryptedPrefix))
+	if err != nil {
+		return "", errors.New("malformed encrypted value")
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("encrypted value cannot be decrypted: wrong master key or corrupted value")
+	}
+	return string(plain), nil
+}
+
+// decryptSecrets replaces encrypted secrets with their plaintext. The master
+// key is only loaded when at least one value is encrypted.
+func (c *Config) decryptSecrets() error {
+	secrets := map[string]*string{
+		"JWT_SECRET":            &c.JWT.Secret,
+		"OPERATOR_TOKEN":        &c.Server.OperatorToken,
+		"DB_PASSWORD":           &c.Database.Password,
+		"REDIS_PASSWORD":        &c.Redis.Password,
+		"OPENSEARCH_PASSWORD":   &c.Search.OpenSearchPassword,
+		"AWS_SECRET_ACCESS_KEY": &c.Server.RateLimitStore.DynamoDB.SecretAccessKey,
+		"SMTP_PASSWORD":         &c.SMTP.Password,
+
+		"BLOB_SECRET_ACCESS_KEY":    &c.Blob.SecretAccessKey,
+		"TENANT_ARCHIVE_PASSPHRASE": &c.Archive.Passphrase,
+	}
+	// Each region URL may be sealed on its own.
+	regionURLs := make(map[string]*string, len(c.Database.Regions))
+	for name, url := range c.Database.Regions {
+		url := url
+		regionURLs[name] = &url
+		secrets["DB_REGIONS "+name] = &url
+	}
+	defer func() {
+		for name, url := range regionURLs {
+			c.Database.Regions[name] = *url
+		}
+	}()
+	for i := range c.Database.Shards {
+		secrets[fmt.Sprintf("DB_SHARDS %d", i+1)] = &c.Database.Shards[i]
+	}
+
+	var key []byte
+	for name, value := range secrets {
+		if !strings.HasPrefix(*value, EncryptedPrefix) {
+			continue
+		}
+		if key == nil {
+			var err error
+			if key, err = LoadMasterKey(); err != nil {
+				return err
+			}
+		}
+		plain, err := Decrypt(key, *value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*value = plain
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
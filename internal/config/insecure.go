@@ -0,0 +1,51 @@
+package config
+
+import (
+	"net"
+	"strings"
+)
+
+// MinJWTSecretLength is the shortest JWT secret accepted in production. It
+// matches the 32 random bytes `heimdall setup` generates, hex encoded.
+const MinJWTSecretLength = 32
+
+// knownSecrets are placeholders from documentation and earlier defaults.
+var knownSecrets = map[string]bool{
+	"your-secret-key": true,
+	"secret":          true,
+	"changeme":        true,
+}
+
+// Insecure lists the settings that make a production deployment unsafe: a
+// guessable JWT secret, an unencrypted connection to a remote database, and
+// rate limiting turned off. It reports nothing outside production.
+func (c *Config) Insecure() []string {
+	if c.Server.Environment != "production" {
+		return nil
+	}
+
+	var problems []string
+	switch {
+	case knownSecrets[c.JWT.Secret]:
+		problems = append(problems, "JWT_SECRET is a published placeholder")
+	case len(c.JWT.Secret) < MinJWTSecretLength:
+		problems = append(problems, "JWT_SECRET is shorter than 32 characters")
+	}
+	if c.Database.SSLMode == "disable" && !isLocalHost(c.Database.Host) {
+		problems = append(problems, "DB_SSL_MODE=disable sends database traffic to "+c.Database.Host+" unencrypted")
+	}
+	if !c.Server.RateLimit.Enabled {
+		problems = append(problems, "RATE_LIMIT_ENABLED=false leaves login open to brute force")
+	}
+	return problems
+}
+
+// isLocalHost reports whether host is the loopback interface or a Unix
+// socket directory, where traffic never leaves the machine.
+func isLocalHost(host string) bool {
+	if host == "localhost" || strings.HasPrefix(host, "/") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
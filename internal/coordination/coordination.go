@@ -0,0 +1,107 @@
+package coordination
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+type EventType string
+
+const (
+	EventKillSwitch  EventType = "kill_switch"
+	EventMaintenance EventType = "maintenance"
+)
+
+// Event describes a change of operator state made on one instance.
+type Event struct {
+	Type   EventType `json:"type"`
+	Name   string    `json:"name,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Active bool      `json:"active"`
+	Origin string    `json:"origin"`
+}
+
+// Publisher broadcasts operator state changes to the other instances.
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// Local is the Publisher of a single instance deployment.
+type Local struct{}
+
+func (Local) Publish(ctx context.Context, event Event) error {
+	return nil
+}
+
+// RedisBus shares operator state changes between instances over Redis
+// pub/sub. Delivery is best effort: instances that are down when a change is
+// published do not see it.
+type RedisBus struct {
+	client   *redis.Client
+	channel  string
+	instance string
+}
+
+func NewRedisBus(client *redis.Client, channel string) *RedisBus {
+	return &RedisBus{
+		client:   client,
+		channel:  channel,
+		instance: uuid.NewString(),
+	}
+}
+
+func (b *RedisBus) Publish(ctx context.Context, event Event) error {
+	event.Origin = b.instance
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, b.channel, payload).Err()
+}
+
+// Listen applies events published by other instances until ctx is done.
+func (b *RedisBus) Listen(ctx context.Context, apply func(Event)) {
+	sub := b.client.Subscribe(ctx, b.channel)
+	defer sub.Close()
+
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			var event Event
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.Printf("coordination: ignoring malformed event: %v", err)
+				continue
+			}
+			if event.Origin == b.instance {
+				continue
+			}
+			apply(event)
+		}
+	}
+}
+
+// DetectOrchestrator names the container orchestrator the process runs
+// under, or returns "" when none is detected. Orchestrated deployments are
+// usually replicated, which in-memory state cannot support.
+func DetectOrchestrator() string {
+	switch {
+	case os.Getenv("KUBERNETES_SERVICE_HOST") != "":
+		return "Kubernetes"
+	case os.Getenv("NOMAD_ALLOC_ID") != "":
+		return "Nomad"
+	case os.Getenv("ECS_CONTAINER_METADATA_URI_V4") != "" || os.Getenv("ECS_CONTAINER_METADATA_URI") != "":
+		return "ECS"
+	}
+	return ""
+}
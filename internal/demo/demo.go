@@ -0,0 +1,87 @@
+package demo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tajious/heimdall/internal/bootstrap"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/passwords"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+// The demo data uses fixed, published credentials. It is only ever seeded
+// into in-memory storage.
+const (
+	TenantID      = "demo"
+	AdminUsername = "admin"
+	AdminPassword = "demo-admin-password"
+	UserPassword  = "demo-user-password"
+	APIKey        = "hk_staging_demo0000000000000000000000"
+)
+
+// Account is a seeded user and its password.
+type Account struct {
+	Username string
+	Password string
+	Role     models.Role
+}
+
+var users = []Account{
+	{Username: "alice", Password: UserPassword, Role: models.RoleUser},
+	{Username: "bob", Password: UserPassword, Role: models.RoleUser},
+	{Username: "carol", Password: UserPassword, Role: models.RoleReadOnly},
+}
+
+func file() *bootstrap.File {
+	return &bootstrap.File{
+		Tenants: []bootstrap.Tenant{{
+			ID:   TenantID,
+			Name: "Demo Company",
+			Environments: []bootstrap.Environment{
+				{Name: "staging", APIKey: APIKey},
+			},
+			Admins: []bootstrap.Admin{
+				{Username: AdminUsername, Password: AdminPassword},
+			},
+		}},
+	}
+}
+
+// Seed creates the demo tenant with a staging environment, an admin, and a
+// few users, and returns the accounts it can be explored with.
+func Seed(ctx context.Context, store storage.Storage, hasher *passwords.Hasher, secrets *vault.Vault) ([]Account, error) {
+	if _, err := bootstrap.NewApplier(store, hasher, secrets).Apply(ctx, file()); err != nil {
+		return nil, err
+	}
+
+	accounts := []Account{{Username: AdminUsername, Password: AdminPassword, Role: models.RoleAdmin}}
+	for _, account := range users {
+		if _, err := store.GetPoolUserByUsername(ctx, TenantID, "", account.Username); err == nil {
+			accounts = append(accounts, account)
+			continue
+		}
+
+		hash, err := hasher.Hash(ctx, account.Password)
+		if err != nil {
+			return nil, err
+		}
+		user := &models.User{
+			TenantID:  TenantID,
+			Username:  account.Username,
+			Email:     account.Username + "@demo.example",
+			Password:  hash,
+			Role:      account.Role,
+			Status:    models.UserActive,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		if err := store.CreateUser(ctx, user); err != nil {
+			return nil, fmt.Errorf("user %s: %w", account.Username, err)
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
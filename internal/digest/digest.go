@@ -0,0 +1,227 @@
+// Package digest emails tenant admins a periodic summary of their tenant:
+// the users who signed up, the failed logins, and the configuration
+// changes made through the API.
+package digest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tajious/heimdall/internal/events"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/notify"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+const (
+	tenantPageSize = 100
+	// maxChanges bounds the configuration changes a digest lists; the rest
+	// are only counted.
+	maxChanges = 20
+	// Failed logins are a spike when there are at least spikeMinimum of
+	// them and spikeFactor times as many as in the period before.
+	spikeMinimum = 20
+	spikeFactor  = 3
+)
+
+// Summary is what a digest reports for one period.
+type Summary struct {
+	TenantID             string
+	TenantName           string
+	Schedule             models.DigestSchedule
+	Start                time.Time
+	End                  time.Time
+	NewUsers             int64
+	FailedLogins         int64
+	PreviousFailedLogins int64
+	ChangeCount          int64
+	Changes              []*models.AuditLog
+}
+
+// Spike reports whether failed logins rose sharply over the period before.
+func (s *Summary) Spike() bool {
+	return s.FailedLogins >= spikeMinimum && s.FailedLogins >= spikeFactor*s.PreviousFailedLogins
+}
+
+// Summarize gathers the tenant's digest for the period from start to end.
+func Summarize(ctx context.Context, store storage.Storage, tenant *models.Tenant, start, end time.Time) (*Summary, error) {
+	summary := &Summary{
+		TenantID:   tenant.ID,
+		TenantName: tenant.Name,
+		Start:      start,
+		End:        end,
+	}
+	if tenant.Config.Digest != nil {
+		summary.Schedule = tenant.Config.Digest.Schedule
+	}
+
+	// Users are counted from start and from end, since the filter has no
+	// upper bound.
+	_, sinceStart, err := store.ListUsers(ctx, storage.UserFilter{TenantID: tenant.ID, CreatedSince: start, Page: 1, PageSize: 1})
+	if err != nil {
+		return nil, fmt.Errorf("count new users: %w", err)
+	}
+	_, sinceEnd, err := store.ListUsers(ctx, storage.UserFilter{TenantID: tenant.ID, CreatedSince: end, Page: 1, PageSize: 1})
+	if err != nil {
+		return nil, fmt.Errorf("count new users: %w", err)
+	}
+	summary.NewUsers = sinceStart - sinceEnd
+
+	if summary.FailedLogins, err = countAudited(ctx, store, tenant.ID, events.LoginFailed, start, end); err != nil {
+		return nil, err
+	}
+	if summary.PreviousFailedLogins, err = countAudited(ctx, store, tenant.ID, events.LoginFailed, start.Add(-end.Sub(start)), start); err != nil {
+		return nil, err
+	}
+
+	changes, total, err := store.ListAuditLogs(ctx, storage.AuditLogFilter{
+		TenantID:  tenant.ID,
+		EventType: events.ChangeApplied.ID,
+		Since:     start,
+		Until:     end.Add(-time.Microsecond),
+		Page:      1,
+		PageSize:  maxChanges,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list configuration changes: %w", err)
+	}
+	summary.ChangeCount = total
+	summary.Changes = changes
+	return summary, nil
+}
+
+// countAudited counts the tenant's audit log entries of the event type
+// recorded from start up to end.
+func countAudited(ctx context.Context, store storage.AuditLogRepo, tenantID string, eventType events.Type, start, end time.Time) (int64, error) {
+	_, total, err := store.ListAuditLogs(ctx, storage.AuditLogFilter{
+		TenantID:  tenantID,
+		EventType: eventType.ID,
+		Since:     start,
+		Until:     end.Add(-time.Microsecond),
+		Page:      1,
+		PageSize:  1,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("count %s: %w", eventType.ID, err)
+	}
+	return total, nil
+}
+
+// Message renders the summary as a notification to recipients.
+func (s *Summary) Message(recipients []string) notify.Message {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Activity of tenant %s (%s) from %s to %s UTC.\n\n",
+		s.TenantName, s.TenantID, s.Start.Format("2006-01-02 15:04"), s.End.Format("2006-01-02 15:04"))
+	fmt.Fprintf(&b, "New users: %d\n", s.NewUsers)
+	fmt.Fprintf(&b, "Failed logins: %d (previous period: %d)\n", s.FailedLogins, s.PreviousFailedLogins)
+	if s.Spike() {
+		b.WriteString("  Failed logins spiked; check for credential stuffing.\n")
+	}
+	fmt.Fprintf(&b, "Configuration changes: %d\n", s.ChangeCount)
+	for _, change := range s.Changes {
+		actor := change.ActorID
+		if actor == "" {
+			actor = "operator"
+		}
+		fmt.Fprintf(&b, "  %s  %s by %s\n", change.CreatedAt.UTC().Format("2006-01-02 15:04"), change.Action, actor)
+	}
+	if more := s.ChangeCount - int64(len(s.Changes)); more > 0 {
+		fmt.Fprintf(&b, "  and %d more; see the audit log.\n", more)
+	}
+
+	subject := fmt.Sprintf("Heimdall %s digest for %s", s.Schedule, s.TenantName)
+	if s.Spike() {
+		subject += ": failed login spike"
+	}
+	return notify.Message{To: recipients, Subject: subject, Body: b.String()}
+}
+
+// Sender sends the digests that are due. Each digest is recorded before it
+// is sent, so that of several instances running the job only one sends it.
+type Sender struct {
+	storage  storage.Storage
+	notifier notify.Notifier
+
+	// sent remembers the last period sent or found sent per tenant, sparing
+	// the database an insert bound to conflict on every run.
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+func NewSender(store storage.Storage, notifier notify.Notifier) *Sender {
+	return &Sender{
+		storage:  store,
+		notifier: notifier,
+		sent:     make(map[string]time.Time),
+	}
+}
+
+// Run sends every digest due now, for the job scheduler.
+func (s *Sender) Run(ctx context.Context) error {
+	now := time.Now()
+
+	var errs []error
+	for page := 1; ; page++ {
+		tenants, total, err := s.storage.ListTenants(ctx, page, tenantPageSize)
+		if err != nil {
+			return err
+		}
+		for _, tenant := range tenants {
+			if tenant.Config.Digest == nil || tenant.IsSuspended() {
+				continue
+			}
+			if err := s.send(storage.WithTenant(ctx, tenant.ID), tenant, now); err != nil {
+				errs = append(errs, fmt.Errorf("digest of tenant %s: %w", tenant.ID, err))
+			}
+		}
+		if int64(page*tenantPageSize) >= total {
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Sender) send(ctx context.Context, tenant *models.Tenant, now time.Time) error {
+	start, end := tenant.Config.Digest.LastPeriod(now)
+
+	s.mu.Lock()
+	done := s.sent[tenant.ID].Equal(end)
+	s.mu.Unlock()
+	if done {
+		return nil
+	}
+
+	delivery := &models.DigestDelivery{TenantID: tenant.ID, PeriodEnd: end, CreatedAt: now}
+	err := s.storage.CreateDigestDelivery(ctx, delivery)
+	if errors.Is(err, storage.ErrConflict) {
+		s.markSent(tenant.ID, end)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	summary, err := Summarize(ctx, s.storage, tenant, start, end)
+	if err == nil {
+		err = s.notifier.Notify(ctx, summary.Message(tenant.Config.Digest.Recipients))
+	}
+	if err != nil {
+		// Releasing the period lets the next run try again.
+		if deleteErr := s.storage.DeleteDigestDelivery(ctx, tenant.ID, delivery.ID); deleteErr != nil {
+			return errors.Join(err, deleteErr)
+		}
+		return err
+	}
+	s.markSent(tenant.ID, end)
+	return nil
+}
+
+func (s *Sender) markSent(tenantID string, end time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent[tenantID] = end
+}
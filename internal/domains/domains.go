@@ -0,0 +1,104 @@
+package domains
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+// A tenant proves it owns a domain by publishing the claim's token in a TXT
+// record:
+//
+//	_heimdall-challenge.example.com. TXT "heimdall-verification=<token>"
+
+const (
+	challengePrefix = "_heimdall-challenge."
+	valuePrefix     = "heimdall-verification="
+)
+
+var ErrChallengeNotFound = errors.New("verification record not found")
+
+// TXTResolver looks up TXT records; *net.Resolver satisfies it.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type Verifier struct {
+	resolver TXTResolver
+}
+
+// NewVerifier returns a verifier using resolver, or the system resolver when
+// it is nil.
+func NewVerifier(resolver TXTResolver) *Verifier {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Verifier{resolver: resolver}
+}
+
+// Verify checks that the claim's challenge record is published.
+func (v *Verifier) Verify(ctx context.Context, claim *models.DomainClaim) error {
+	records, err := v.resolver.LookupTXT(ctx, ChallengeName(claim.Domain))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return ErrChallengeNotFound
+		}
+		return fmt.Errorf("looking up %s: %w", ChallengeName(claim.Domain), err)
+	}
+	want := ChallengeValue(claim.Token)
+	for _, record := range records {
+		if strings.TrimSpace(record) == want {
+			return nil
+		}
+	}
+	return ErrChallengeNotFound
+}
+
+func ChallengeName(domain string) string {
+	return challengePrefix + domain
+}
+
+func ChallengeValue(token string) string {
+	return valuePrefix + token
+}
+
+// Normalize lowercases a domain and drops a trailing dot.
+func Normalize(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// FromEmail returns the normalized domain of an email address, or "" when it
+// has none.
+func FromEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return Normalize(email[at+1:])
+}
+
+// Allowed reports whether a tenant that restricts email domains accepts
+// email for a new user. Tenants that do not restrict accept anything.
+func Allowed(ctx context.Context, store storage.Storage, tenant *models.Tenant, email string) (bool, error) {
+	if !tenant.Config.RestrictEmailDomains {
+		return true, nil
+	}
+	domain := FromEmail(email)
+	if domain == "" {
+		return false, nil
+	}
+	claim, err := store.FindVerifiedDomain(ctx, domain)
+	if errors.Is(err, storage.ErrDomainClaimNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return claim.TenantID == tenant.ID, nil
+}
@@ -0,0 +1,210 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// subscriptionBuffer is how many events a subscriber may fall behind before
+// further events are dropped for it.
+const subscriptionBuffer = 64
+
+// ErrTooManySubscribers is returned when a tenant already has
+// MaxSubscribers live subscriptions.
+var ErrTooManySubscribers = errors.New("too many event subscribers for the tenant")
+
+// MaxSubscribers bounds the live subscriptions of one tenant on an instance.
+const MaxSubscribers = 20
+
+// Event is a security event as delivered to live subscribers.
+type Event struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"event_type"`
+	Category Category  `json:"category"`
+	Severity Severity  `json:"severity"`
+	TenantID string    `json:"tenant_id"`
+	ActorID  string    `json:"actor_id,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Action   string    `json:"action,omitempty"`
+	Resource string    `json:"resource,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// New returns an event of type t for the tenant, stamped now.
+func New(t Type, tenantID string) *Event {
+	return &Event{
+		ID:       uuid.NewString(),
+		Type:     t.ID,
+		Category: t.Category,
+		Severity: t.Severity,
+		TenantID: tenantID,
+		Time:     time.Now().UTC(),
+	}
+}
+
+// Subscription receives the events of one tenant on C. A subscriber that
+// falls behind loses events rather than slowing down the requests that
+// publish them; Dropped counts the events it lost.
+type Subscription struct {
+	C <-chan *Event
+
+	c        chan *Event
+	tenantID string
+	types    map[string]bool
+	dropped  atomic.Int64
+}
+
+// Dropped returns how many events were dropped because C was full.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+func (s *Subscription) wants(event *Event) bool {
+	return event.TenantID == s.tenantID && (len(s.types) == 0 || s.types[event.Type])
+}
+
+// Broker fans published events out to the subscribers of their tenant. With
+// a relay it shares them with the other instances, so a subscriber sees the
+// events of every instance.
+type Broker struct {
+	mu    sync.RWMutex
+	subs  map[*Subscription]struct{}
+	relay *RedisRelay
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[*Subscription]struct{})}
+}
+
+// UseRelay shares events with the other instances through relay.
+func (b *Broker) UseRelay(relay *RedisRelay) {
+	b.relay = relay
+}
+
+// Subscribe returns a subscription to the tenant's events of the given
+// types, or of every type when none are given.
+func (b *Broker) Subscribe(tenantID string, types []string) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	count := 0
+	for sub := range b.subs {
+		if sub.tenantID == tenantID {
+			count++
+		}
+	}
+	if count >= MaxSubscribers {
+		return nil, ErrTooManySubscribers
+	}
+
+	c := make(chan *Event, subscriptionBuffer)
+	sub := &Subscription{C: c, c: c, tenantID: tenantID}
+	if len(types) > 0 {
+		sub.types = make(map[string]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+	b.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, sub)
+}
+
+// Publish delivers event to the local subscribers and, with a relay, to
+// those of the other instances. It never blocks on a subscriber.
+func (b *Broker) Publish(ctx context.Context, event *Event) {
+	b.deliver(event)
+	if b.relay != nil {
+		if err := b.relay.publish(ctx, event); err != nil {
+			log.Printf("events: failed to relay %s: %v", event.Type, err)
+		}
+	}
+}
+
+func (b *Broker) deliver(event *Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subs {
+		if !sub.wants(event) {
+			continue
+		}
+		select {
+		case sub.c <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// RedisRelay shares events between instances over Redis pub/sub. Like the
+// operator bus, delivery is best effort.
+type RedisRelay struct {
+	client   *redis.Client
+	channel  string
+	instance string
+}
+
+func NewRedisRelay(client *redis.Client, channel string) *RedisRelay {
+	return &RedisRelay{
+		client:   client,
+		channel:  channel,
+		instance: uuid.NewString(),
+	}
+}
+
+type relayed struct {
+	Event  *Event `json:"event"`
+	Origin string `json:"origin"`
+}
+
+func (r *RedisRelay) publish(ctx context.Context, event *Event) error {
+	payload, err := json.Marshal(relayed{Event: event, Origin: r.instance})
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, r.channel, payload).Err()
+}
+
+// Listen delivers the events other instances publish to broker's local
+// subscribers until ctx is done.
+func (r *RedisRelay) Listen(ctx context.Context, broker *Broker) {
+	sub := r.client.Subscribe(ctx, r.channel)
+	defer sub.Close()
+
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			var message relayed
+			if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil || message.Event == nil {
+				log.Printf("events: ignoring malformed relayed event: %v", err)
+				continue
+			}
+			if message.Origin == r.instance {
+				continue
+			}
+			broker.deliver(message.Event)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package events holds the taxonomy security events are classified with.
+// Every event Heimdall emits, whether as an audit log entry or a login hook
+// payload, names a registered type, so a SIEM can route and alert on the
+// type, category, and severity without parsing routes or messages.
+package events
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type Category string
+
+const (
+	CategoryAuthentication Category = "authentication"
+	CategoryAuthorization  Category = "authorization"
+	CategoryConfiguration  Category = "configuration"
+	CategoryAnomaly        Category = "anomaly"
+)
+
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityLow      Severity = "low"
+	SeverityMedium   Severity = "medium"
+	SeverityHigh     Severity = "high"
+	SeverityCritical Severity = "critical"
+)
+
+// Syslog returns the RFC 5424 severity level the severity maps to.
+func (s Severity) Syslog() int {
+	switch s {
+	case SeverityCritical:
+		return 2
+	case SeverityHigh:
+		return 3
+	case SeverityMedium:
+		return 4
+	case SeverityLow:
+		return 5
+	default:
+		return 6
+	}
+}
+
+// Type is a kind of security event. Its ID is matched on by SIEM rules, so
+// a registered type is never renamed or reclassified; a new one is
+// registered instead.
+type Type struct {
+	ID       string   `json:"id"`
+	Category Category `json:"category"`
+	Severity Severity `json:"severity"`
+}
+
+// Registry holds the event types, refusing a second registration of an ID
+// with a different classification.
+type Registry struct {
+	mu    sync.RWMutex
+	types map[string]Type
+}
+
+func NewRegistry() *Registry {
+	return &Registry{types: make(map[string]Type)}
+}
+
+// Register adds t and returns it, for use in a package-level var. It panics
+// when the ID is already registered differently, which can only be a
+// programming error.
+func (r *Registry) Register(t Type) Type {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.types[t.ID]; ok && existing != t {
+		panic(fmt.Sprintf("events: %s registered as %s/%s and %s/%s", t.ID, existing.Category, existing.Severity, t.Category, t.Severity))
+	}
+	r.types[t.ID] = t
+	return t
+}
+
+func (r *Registry) Lookup(id string) (Type, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t, ok := r.types[id]
+	return t, ok
+}
+
+// Types returns every registered type, sorted by ID.
+func (r *Registry) Types() []Type {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	types := make([]Type, 0, len(r.types))
+	for _, t := range r.types {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].ID < types[j].ID
+	})
+	return types
+}
+
+var Default = NewRegistry()
+
+var (
+	LoginStarted   = Default.Register(Type{ID: "authentication.login.started", Category: CategoryAuthentication, Severity: SeverityInfo})
+	LoginSucceeded = Default.Register(Type{ID: "authentication.login.succeeded", Category: CategoryAuthentication, Severity: SeverityInfo})
+	LoginFailed    = Default.Register(Type{ID: "authentication.login.failed", Category: CategoryAuthentication, Severity: SeverityLow})
+
+	RequestDenied = Default.Register(Type{ID: "authorization.request.denied", Category: CategoryAuthorization, Severity: SeverityMedium})
+
+	ChangeApplied  = Default.Register(Type{ID: "configuration.change.applied", Category: CategoryConfiguration, Severity: SeverityLow})
+	ChangeRejected = Default.Register(Type{ID: "configuration.change.rejected", Category: CategoryConfiguration, Severity: SeverityInfo})
+	ChangeFailed   = Default.Register(Type{ID: "configuration.change.failed", Category: CategoryConfiguration, Severity: SeverityMedium})
+
+	RateLimited = Default.Register(Type{ID: "anomaly.request.rate_limited", Category: CategoryAnomaly, Severity: SeverityMedium})
+)
+
+// ForRequest classifies an audited state-changing request by its response
+// status.
+func ForRequest(status int) Type {
+	switch {
+	case status == 401 || status == 403:
+		return RequestDenied
+	case status == 429:
+		return RateLimited
+	case status >= 500:
+		return ChangeFailed
+	case status >= 400:
+		return ChangeRejected
+	default:
+		return ChangeApplied
+	}
+}
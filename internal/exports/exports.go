@@ -0,0 +1,194 @@
+// Package exports writes large exports to the blob store in the background.
+// A request queues a job, the runner claims it and writes the export as
+// NDJSON, and the client downloads it through a signed URL once it is done.
+package exports
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tajious/heimdall/internal/blob"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+// Prefix is where exports are kept in the blob store.
+const Prefix = "exports/"
+
+const (
+	pageSize = 1000
+	// staleAfter is how long a running job may go without progress before
+	// another runner takes it over, as when its instance stopped.
+	staleAfter = 5 * time.Minute
+)
+
+// kinds are the jobs the runner claims.
+var kinds = []models.JobKind{models.JobExportUsers, models.JobExportAuditLogs}
+
+var ErrInProgress = errors.New("an export of this kind is already in progress")
+
+// Enqueue queues an export of kind with filter, a storage.UserFilter or
+// storage.AuditLogFilter. A tenant runs one export of each kind at a time.
+func Enqueue(ctx context.Context, store storage.Storage, tenantID string, kind models.JobKind, filter any, requestedBy string) (*models.Job, error) {
+	jobs, err := store.ListJobs(ctx, tenantID, kind)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if !job.Done() {
+			return nil, ErrInProgress
+		}
+	}
+
+	encoded, err := json.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	job := &models.Job{
+		TenantID:    tenantID,
+		Kind:        kind,
+		Status:      models.JobPending,
+		Input:       string(encoded),
+		RequestedBy: requestedBy,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := store.CreateJob(ctx, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+type Runner struct {
+	store storage.Storage
+	blobs blob.Store
+}
+
+func NewRunner(store storage.Storage, blobs blob.Store) *Runner {
+	return &Runner{
+		store: store,
+		blobs: blobs,
+	}
+}
+
+// Run works through the queued jobs until none is left. A failed export
+// fails its job, not the run.
+func (r *Runner) Run(ctx context.Context) error {
+	for {
+		job, err := r.store.ClaimJob(ctx, kinds, time.Now().Add(-staleAfter))
+		if errors.Is(err, storage.ErrJobNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = r.export(ctx, job)
+		if err != nil {
+			log.Printf("Export %s of tenant %s failed: %v", job.ID, job.TenantID, err)
+		}
+		job.Finish(err, "Export failed")
+		if err := r.store.UpdateJob(ctx, job); err != nil {
+			return err
+		}
+	}
+}
+
+// export writes the records of the job to the blob store, saving its
+// progress after every page so that the job is not taken for stale.
+func (r *Runner) export(ctx context.Context, job *models.Job) error {
+	fetch, err := r.fetcher(job)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	var processed int64
+	for page := 1; ; page++ {
+		records, total, err := fetch(ctx, page)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+		processed += int64(len(records))
+		job.Total = total
+		job.Advance(processed)
+		if err := r.store.UpdateJob(ctx, job); err != nil {
+			return err
+		}
+		if len(records) < pageSize {
+			break
+		}
+	}
+
+	key := Key(job)
+	if err := r.blobs.Put(ctx, key, buf.Bytes()); err != nil {
+		return fmt.Errorf("upload export: %w", err)
+	}
+	job.Key = key
+	job.Size = int64(buf.Len())
+	return nil
+}
+
+// fetcher returns what pages through the records of the job, with how many
+// there are in all.
+func (r *Runner) fetcher(job *models.Job) (func(ctx context.Context, page int) ([]any, int64, error), error) {
+	switch job.Kind {
+	case models.JobExportUsers:
+		var filter storage.UserFilter
+		if err := json.Unmarshal([]byte(job.Input), &filter); err != nil {
+			return nil, fmt.Errorf("decode filter: %w", err)
+		}
+		filter.TenantID = job.TenantID
+		filter.PageSize = pageSize
+		return func(ctx context.Context, page int) ([]any, int64, error) {
+			filter.Page = page
+			users, total, err := r.store.ListUsers(ctx, filter)
+			return records(users), total, err
+		}, nil
+	case models.JobExportAuditLogs:
+		var filter storage.AuditLogFilter
+		if err := json.Unmarshal([]byte(job.Input), &filter); err != nil {
+			return nil, fmt.Errorf("decode filter: %w", err)
+		}
+		filter.TenantID = job.TenantID
+		filter.PageSize = pageSize
+		return func(ctx context.Context, page int) ([]any, int64, error) {
+			filter.Page = page
+			entries, total, err := r.store.ListAuditLogs(ctx, filter)
+			return records(entries), total, err
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown export kind %q", job.Kind)
+	}
+}
+
+func records[T any](page []T) []any {
+	out := make([]any, len(page))
+	for i := range page {
+		out[i] = page[i]
+	}
+	return out
+}
+
+// Key is where the export of a job is kept.
+func Key(job *models.Job) string {
+	return Prefix + job.TenantID + "/" + job.ID + ".ndjson"
+}
+
+// Purge deletes the exports written before olderThan, for the retention
+// manager. Their jobs are purged with the rest.
+func (r *Runner) Purge(ctx context.Context, olderThan time.Time) (int64, error) {
+	return blob.PurgeOlder(ctx, r.blobs, Prefix, olderThan)
+}
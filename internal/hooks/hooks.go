@@ -0,0 +1,197 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tajious/heimdall/internal/events"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+const defaultTimeout = 2 * time.Second
+
+// ErrHookFailed is returned when a hook with the closed failure policy errors
+// or times out.
+var ErrHookFailed = errors.New("login hook failed")
+
+// Event describes the login a hook is called for. User is only set after the
+// credentials were verified, at the post-login stage. Run classifies it
+// with the event type of its stage.
+type Event struct {
+	Type          string                `json:"event_type"`
+	Category      events.Category       `json:"category"`
+	Severity      events.Severity       `json:"severity"`
+	Stage         models.LoginHookStage `json:"stage"`
+	TenantID      string                `json:"tenant_id"`
+	EnvironmentID string                `json:"environment_id,omitempty"`
+	Username      string                `json:"username,omitempty"`
+	Email         string                `json:"email,omitempty"`
+	Phone         string                `json:"phone,omitempty"`
+	RemoteIP      string                `json:"remote_ip"`
+	User          *models.User          `json:"user,omitempty"`
+}
+
+// Result is a hook's answer. A nil result lets the login through unchanged.
+// Claims are only honored at the post-login stage and end up in the token's
+// attrs claim.
+type Result struct {
+	Deny   bool                   `json:"deny"`
+	Reason string                 `json:"reason,omitempty"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+type Hook interface {
+	Run(ctx context.Context, event *Event) (*Result, error)
+}
+
+// HookFunc adapts a function to the Hook interface.
+type HookFunc func(ctx context.Context, event *Event) (*Result, error)
+
+func (f HookFunc) Run(ctx context.Context, event *Event) (*Result, error) {
+	return f(ctx, event)
+}
+
+// Plugin is a named hook with its own timeout and failure policy. Plugins
+// registered at startup run for every tenant; TenantHooks sources supply the
+// ones a tenant deployed.
+type Plugin struct {
+	Name          string
+	Stage         models.LoginHookStage
+	Hook          Hook
+	Timeout       time.Duration
+	FailurePolicy models.HookFailurePolicy
+}
+
+// TenantHooks supplies hooks a tenant deployed itself, such as WASM plugins.
+type TenantHooks interface {
+	TenantHooks(ctx context.Context, tenant *models.Tenant, stage models.LoginHookStage) ([]Plugin, error)
+}
+
+// Outcome is the combined answer of every hook of a stage.
+type Outcome struct {
+	Denied bool
+	Reason string
+	Claims map[string]interface{}
+}
+
+type Registry struct {
+	plugins  []Plugin
+	tenants  []TenantHooks
+	webhooks *webhookCaller
+	secrets  *vault.Vault
+	timeout  time.Duration
+}
+
+// NewRegistry returns a registry that gives hooks without their own timeout
+// the given one. Webhook secrets are opened with secrets.
+func NewRegistry(timeout time.Duration, secrets *vault.Vault) *Registry {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Registry{
+		webhooks: newWebhookCaller(),
+		secrets:  secrets,
+		timeout:  timeout,
+	}
+}
+
+func (r *Registry) Register(plugin Plugin) {
+	r.plugins = append(r.plugins, plugin)
+}
+
+// RegisterTenantHooks adds a source of tenant-deployed hooks. They run after
+// the in-process plugins and before the tenant webhooks.
+func (r *Registry) RegisterTenantHooks(source TenantHooks) {
+	r.tenants = append(r.tenants, source)
+}
+
+// Run calls the plugins, the tenant-deployed hooks, and then the tenant
+// webhooks of the event's stage in order. The first hook to deny ends the
+// run; claims from later hooks override those of earlier ones.
+func (r *Registry) Run(ctx context.Context, tenant *models.Tenant, event *Event) (Outcome, error) {
+	event.TenantID = tenant.ID
+	eventType := events.LoginStarted
+	if event.Stage == models.PostLogin {
+		eventType = events.LoginSucceeded
+	}
+	event.Type, event.Category, event.Severity = eventType.ID, eventType.Category, eventType.Severity
+
+	var outcome Outcome
+	apply := func(name string, timeout time.Duration, policy models.HookFailurePolicy, hook Hook) (bool, error) {
+		if timeout <= 0 {
+			timeout = r.timeout
+		}
+		hookCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		result, err := hook.Run(hookCtx, event)
+		if err != nil {
+			if policy == models.FailClosed {
+				return true, fmt.Errorf("%w: %s: %v", ErrHookFailed, name, err)
+			}
+			log.Printf("Login hook %s failed, continuing: %v", name, err)
+			return false, nil
+		}
+		if result == nil {
+			return false, nil
+		}
+		if result.Deny {
+			outcome.Denied = true
+			outcome.Reason = result.Reason
+			return true, nil
+		}
+		if event.Stage == models.PostLogin && len(result.Claims) > 0 {
+			if outcome.Claims == nil {
+				outcome.Claims = make(map[string]interface{}, len(result.Claims))
+			}
+			for name, value := range result.Claims {
+				outcome.Claims[name] = value
+			}
+		}
+		return false, nil
+	}
+
+	for _, plugin := range r.plugins {
+		if plugin.Stage != event.Stage {
+			continue
+		}
+		if stop, err := apply(plugin.Name, plugin.Timeout, plugin.FailurePolicy, plugin.Hook); stop {
+			return outcome, err
+		}
+	}
+
+	for _, source := range r.tenants {
+		deployed, err := source.TenantHooks(ctx, tenant, event.Stage)
+		if err != nil {
+			return outcome, fmt.Errorf("%w: loading tenant hooks: %v", ErrHookFailed, err)
+		}
+		for _, plugin := range deployed {
+			if stop, err := apply(plugin.Name, plugin.Timeout, plugin.FailurePolicy, plugin.Hook); stop {
+				return outcome, err
+			}
+		}
+	}
+
+	secret, secretErr := r.secrets.Open(ctx, tenant.ID, tenant.Config.LoginHookSecret)
+	for _, webhook := range tenant.Config.LoginHooks {
+		if webhook.Stage != event.Stage {
+			continue
+		}
+		var hook Hook = r.webhooks.hook(webhook, secret)
+		if secretErr != nil {
+			hook = HookFunc(func(ctx context.Context, event *Event) (*Result, error) {
+				return nil, fmt.Errorf("opening the login hook secret: %w", secretErr)
+			})
+		}
+		timeout := time.Duration(webhook.TimeoutMS) * time.Millisecond
+		if stop, err := apply(webhook.URL, timeout, webhook.FailurePolicy, hook); stop {
+			return outcome, err
+		}
+	}
+
+	return outcome, nil
+}
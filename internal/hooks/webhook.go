@@ -0,0 +1,73 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tajious/heimdall/internal/authn"
+	"github.com/tajious/heimdall/internal/models"
+)
+
+const maxWebhookResponse = 64 << 10
+
+type webhookCaller struct {
+	client *http.Client
+}
+
+func newWebhookCaller() *webhookCaller {
+	return &webhookCaller{
+		client: &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// hook posts the event to a tenant webhook, signed like delegated
+// authentication requests. A 204 lets the login through unchanged and a 200
+// carries a Result.
+func (w *webhookCaller) hook(config models.LoginHook, secret string) Hook {
+	return HookFunc(func(ctx context.Context, event *Event) (*Result, error) {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Heimdall-Timestamp", timestamp)
+		req.Header.Set("X-Heimdall-Signature", authn.Sign(secret, timestamp, body))
+
+		resp, err := w.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusNoContent:
+			return nil, nil
+		case http.StatusOK:
+		default:
+			return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+
+		var result Result
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxWebhookResponse)).Decode(&result); err != nil {
+			return nil, fmt.Errorf("invalid response: %v", err)
+		}
+		return &result, nil
+	})
+}
@@ -0,0 +1,185 @@
+package keys_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/metrics"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/passwords"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+const benchmarkPassword = "correct horse battery staple"
+
+// fixture is a tenant with a user and an environment, kept in memory so the
+// benchmarks run without Postgres or Redis.
+type fixture struct {
+	store    *storage.InMemoryStorage
+	resolver *keys.Resolver
+	hasher   *passwords.Hasher
+	env      *models.Environment
+	user     *models.User
+}
+
+func newFixture(b *testing.B) *fixture {
+	b.Helper()
+
+	ctx := context.Background()
+	registry := metrics.NewRegistry()
+	store := storage.NewInMemoryStorage()
+	hasher := passwords.NewHasher(0, 0, registry)
+
+	hash, err := hasher.Hash(ctx, benchmarkPassword)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	env := &models.Environment{TenantID: "bench-tenant", Name: "bench", SigningKey: "bench-environment-key"}
+	if err := store.CreateEnvironment(ctx, env); err != nil {
+		b.Fatal(err)
+	}
+
+	user := &models.User{TenantID: "bench-tenant", Username: "bench", Password: hash, Role: models.RoleUser}
+	if err := store.CreateUser(ctx, user); err != nil {
+		b.Fatal(err)
+	}
+
+	secrets, err := vault.New(store, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return &fixture{
+		store:    store,
+		resolver: keys.NewResolver("bench-secret", store, secrets, time.Minute, registry),
+		hasher:   hasher,
+		env:      env,
+		user:     user,
+	}
+}
+
+func (f *fixture) claims(env *models.Environment) *models.Claims {
+	now := time.Now()
+	claims := &models.Claims{
+		UserID:   f.user.ID,
+		TenantID: f.user.TenantID,
+		Role:     f.user.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+	if env != nil {
+		claims.EnvironmentID = env.ID
+	}
+	return claims
+}
+
+func BenchmarkLogin(b *testing.B) {
+	f := newFixture(b)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		user, err := f.store.GetPoolUserByUsername(ctx, "bench-tenant", "", "bench")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := f.hasher.Compare(ctx, user.Password, benchmarkPassword); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := f.resolver.Sign(context.Background(), f.claims(nil), nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTokenSign(b *testing.B) {
+	f := newFixture(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.resolver.Sign(context.Background(), f.claims(nil), nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// useEdDSA switches the fixture to Ed25519 signing, for comparison with
+// the HMAC benchmarks, and returns the tenant that opted into it.
+func (f *fixture) useEdDSA(b *testing.B) *models.Tenant {
+	b.Helper()
+
+	key, err := keys.GenerateEd25519PrivateKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	f.resolver.UseEd25519(key)
+	return &models.Tenant{ID: f.user.TenantID, Config: models.TenantConfig{TokenAlgorithm: keys.AlgorithmEdDSA}}
+}
+
+func BenchmarkTokenSignEdDSA(b *testing.B) {
+	f := newFixture(b)
+	tenant := f.useEdDSA(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.resolver.Sign(context.Background(), f.claims(nil), tenant, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTokenValidateEdDSA(b *testing.B) {
+	f := newFixture(b)
+	tenant := f.useEdDSA(b)
+
+	token, err := f.resolver.Sign(context.Background(), f.claims(nil), tenant, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	keyfunc := f.resolver.Keyfunc(context.Background())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := jwt.ParseWithClaims(token, &models.Claims{}, keyfunc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTokenValidate(b *testing.B) {
+	benchmarkValidate(b, false)
+}
+
+func BenchmarkTokenValidateEnvironment(b *testing.B) {
+	benchmarkValidate(b, true)
+}
+
+func benchmarkValidate(b *testing.B, withEnvironment bool) {
+	f := newFixture(b)
+
+	var env *models.Environment
+	if withEnvironment {
+		env = f.env
+	}
+
+	token, err := f.resolver.Sign(context.Background(), f.claims(env), nil, env)
+	if err != nil {
+		b.Fatal(err)
+	}
+	keyfunc := f.resolver.Keyfunc(context.Background())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := jwt.ParseWithClaims(token, &models.Claims{}, keyfunc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tajious/heimdall/internal/metrics"
+	"github.com/tajious/heimdall/internal/storage"
+	"golang.org/x/sync/singleflight"
+)
+
+type verificationKey struct {
+	tenantID string
+	key      interface{}
+}
+
+type cacheEntry struct {
+	value     verificationKey
+	expiresAt time.Time
+}
+
+type keyCache struct {
+	ttl   time.Duration
+	group singleflight.Group
+
+	mu      sync.RWMutex
+	entries map[string]cacheEntry
+
+	lookups *metrics.CounterVec
+}
+
+func newKeyCache(ttl time.Duration, registry *metrics.Registry) *keyCache {
+	return &keyCache{
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry),
+		lookups: registry.Counter("heimdall_key_cache_lookups_total", "Verification key cache lookups.", "result"),
+	}
+}
+
+func (c *keyCache) get(ctx context.Context, id string, load func(ctx context.Context) (verificationKey, error)) (verificationKey, error) {
+	if c.ttl <= 0 {
+		return load(ctx)
+	}
+
+	c.mu.RLock()
+	entry, ok := c.entries[id]
+	c.mu.RUnlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		c.lookups.WithLabels("hit").Inc()
+		return entry.value, nil
+	}
+	c.lookups.WithLabels("miss").Inc()
+
+	value, err, _ := c.group.Do(id, func() (interface{}, error) {
+		loaded, err := load(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		c.entries[id] = cacheEntry{value: loaded, expiresAt: time.Now().Add(c.ttl)}
+		c.mu.Unlock()
+		return loaded, nil
+	})
+	if err != nil {
+		// An expired key still verifies the tokens it signed while the
+		// database is down, but not once it is known to be gone.
+		if ok && !gone(err) {
+			c.lookups.WithLabels("stale").Inc()
+			return entry.value, nil
+		}
+		return verificationKey{}, err
+	}
+
+	return value.(verificationKey), nil
+}
+
+// gone reports whether err says a key no longer exists, rather than that it
+// could not be loaded.
+func gone(err error) bool {
+	return errors.Is(err, storage.ErrEnvironmentNotFound) || errors.Is(err, storage.ErrTenantNotFound) ||
+		errors.Is(err, storage.ErrClientNotFound) || errors.Is(err, ErrNoTenantKey) || errors.Is(err, ErrNoEncryptionKey)
+}
+
+// put caches value for id as if it had just been loaded.
+func (c *keyCache) put(id string, value verificationKey) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	c.entries[id] = cacheEntry{value: value, expiresAt: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+}
+
+// forget drops the cached value for id.
+func (c *keyCache) forget(id string) {
+	c.mu.Lock()
+	delete(c.entries, id)
+	c.mu.Unlock()
+}
@@ -0,0 +1,206 @@
+package keys
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+// Problem codes of a Diagnosis.
+const (
+	ProblemMalformed           = "malformed"
+	ProblemDecryption          = "decryption_failed"
+	ProblemAudience            = "wrong_audience"
+	ProblemAlgorithm           = "unexpected_algorithm"
+	ProblemKeyUnavailable      = "key_unavailable"
+	ProblemEnvironmentMismatch = "environment_mismatch"
+	ProblemLegacySecretRetired = "legacy_secret_retired"
+	ProblemSignature           = "bad_signature"
+	ProblemExpired             = "expired"
+	ProblemNotYetValid         = "not_yet_valid"
+	ProblemIssuedInFuture      = "issued_in_future"
+)
+
+// Keys a token can be verified with.
+const (
+	KeyEnvironment = "environment"
+	KeyTenant      = "tenant"
+	KeyGlobal      = "global"
+	KeyEd25519     = "ed25519"
+)
+
+type Problem struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Diagnosis explains a token: what it carries, which key verifies it, and
+// every reason it does not verify.
+type Diagnosis struct {
+	Encrypted bool `json:"encrypted"`
+	// ClientID is the client an encrypted token was encrypted for.
+	ClientID string                 `json:"client_id,omitempty"`
+	Header   map[string]interface{} `json:"header,omitempty"`
+	Claims   map[string]interface{} `json:"claims,omitempty"`
+	// Key is one of the Key constants, and KeyID the environment, tenant,
+	// or kid it belongs to.
+	Key      string    `json:"key,omitempty"`
+	KeyID    string    `json:"key_id,omitempty"`
+	Valid    bool      `json:"valid"`
+	Problems []Problem `json:"problems"`
+	Notes    []string  `json:"notes,omitempty"`
+
+	// TenantID is the tenant the token claims, or an encrypted token was
+	// encrypted for, and Parsed its claims once decoded.
+	TenantID string         `json:"-"`
+	Parsed   *models.Claims `json:"-"`
+}
+
+// AddProblem records a reason the token does not validate.
+func (d *Diagnosis) AddProblem(code, message string) {
+	d.Problems = append(d.Problems, Problem{Code: code, Message: message})
+	d.Valid = false
+}
+
+func (d *Diagnosis) problem(code, format string, args ...interface{}) {
+	d.AddProblem(code, fmt.Sprintf(format, args...))
+}
+
+// Explain verifies tokenString the way Parse does, but carries on past the
+// first failure to report all of them. It never fails itself: a token that
+// cannot even be decoded is reported as malformed.
+func (r *Resolver) Explain(ctx context.Context, tokenString string) *Diagnosis {
+	d := &Diagnosis{Problems: []Problem{}}
+	defer func() { d.Valid = len(d.Problems) == 0 }()
+
+	signed := tokenString
+	var clientTenantID string
+	if IsEncrypted(tokenString) {
+		d.Encrypted = true
+		var err error
+		if signed, clientTenantID, d.ClientID, err = r.decrypt(ctx, tokenString); err != nil {
+			d.TenantID = jweTenant(tokenString)
+			d.problem(ProblemDecryption, "the token is encrypted and could not be decrypted: %v", err)
+			return d
+		}
+		d.TenantID = clientTenantID
+	}
+
+	header := jwt.MapClaims{}
+	token, _, err := jwt.NewParser().ParseUnverified(signed, header)
+	if err != nil {
+		d.problem(ProblemMalformed, "the token cannot be decoded: %v", err)
+		return d
+	}
+	claims := &models.Claims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(signed, claims); err != nil {
+		d.problem(ProblemMalformed, "the claims do not have the expected types: %v", err)
+		return d
+	}
+	d.Header, d.Claims, d.Parsed = token.Header, header, claims
+	if d.TenantID == "" {
+		d.TenantID = claims.TenantID
+	}
+	d.Key, d.KeyID = describeKey(token, claims)
+
+	if d.Encrypted {
+		if err := checkAudience(claims, clientTenantID, d.ClientID); err != nil {
+			d.problem(ProblemAudience, "the token was encrypted for client %s of tenant %s, but names another audience or tenant", d.ClientID, clientTenantID)
+		}
+	}
+
+	_, err = jwt.ParseWithClaims(signed, &models.Claims{}, r.Keyfunc(ctx), jwt.WithoutClaimsValidation())
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrUnexpectedAlgorithm):
+		d.problem(ProblemAlgorithm, "the token is signed with %v, which this instance does not verify", token.Header["alg"])
+	case errors.Is(err, ErrEnvironmentMismatch):
+		d.problem(ProblemEnvironmentMismatch, "environment %s does not belong to tenant %s", claims.EnvironmentID, claims.TenantID)
+	case errors.Is(err, ErrLegacySecretRetired):
+		d.problem(ProblemLegacySecretRetired, "the token is signed with the global secret, which stopped being accepted at %s", r.legacyCutoff.UTC().Format(time.RFC3339))
+	case errors.Is(err, storage.ErrEnvironmentNotFound):
+		d.problem(ProblemKeyUnavailable, "environment %s does not exist", claims.EnvironmentID)
+	case errors.Is(err, storage.ErrTenantNotFound):
+		d.problem(ProblemKeyUnavailable, "tenant %s does not exist", claims.TenantID)
+	case errors.Is(err, ErrNoTenantKey):
+		d.problem(ProblemKeyUnavailable, "the token names the tenant key, but tenant %s has no token signing key", claims.TenantID)
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		d.problem(ProblemSignature, "the signature does not match %s: the token was signed with another key, or altered", keyName(d.Key, d.KeyID))
+	default:
+		d.problem(ProblemKeyUnavailable, "the verification key could not be loaded: %v", err)
+	}
+
+	r.explainTimes(d, claims)
+	return d
+}
+
+// describeKey names the key Keyfunc picks for the token.
+func describeKey(token *jwt.Token, claims *models.Claims) (string, string) {
+	kid, _ := token.Header["kid"].(string)
+	switch {
+	case token.Method == jwt.SigningMethodEdDSA:
+		return KeyEd25519, kid
+	case claims.EnvironmentID != "":
+		return KeyEnvironment, claims.EnvironmentID
+	case kid == TenantKeyID:
+		return KeyTenant, claims.TenantID
+	default:
+		return KeyGlobal, ""
+	}
+}
+
+func keyName(key, id string) string {
+	switch key {
+	case KeyEnvironment:
+		return "the signing key of environment " + id
+	case KeyTenant:
+		return "the token signing key of tenant " + id
+	case KeyEd25519:
+		return "the Ed25519 key"
+	default:
+		return "the global secret"
+	}
+}
+
+// explainTimes checks exp, nbf, and iat with the leeway, as Parse does.
+func (r *Resolver) explainTimes(d *Diagnosis, claims *models.Claims) {
+	err := jwt.NewValidator(jwt.WithLeeway(r.leeway), jwt.WithIssuedAt()).Validate(claims)
+	if err == nil {
+		return
+	}
+	now := time.Now()
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		d.problem(ProblemExpired, "the token expired at %s, %s ago (leeway %s)",
+			claims.ExpiresAt.UTC().Format(time.RFC3339), now.Sub(claims.ExpiresAt.Time).Round(time.Second), r.leeway)
+	}
+	if errors.Is(err, jwt.ErrTokenNotValidYet) {
+		d.problem(ProblemNotYetValid, "the token is not valid before %s, %s from now (leeway %s)",
+			claims.NotBefore.UTC().Format(time.RFC3339), claims.NotBefore.Sub(now).Round(time.Second), r.leeway)
+	}
+	if errors.Is(err, jwt.ErrTokenUsedBeforeIssued) {
+		d.problem(ProblemIssuedInFuture, "the token was issued at %s, %s from now: the issuer's clock is ahead (leeway %s)",
+			claims.IssuedAt.UTC().Format(time.RFC3339), claims.IssuedAt.Sub(now).Round(time.Second), r.leeway)
+	}
+}
+
+// jweTenant reads the tenant an encrypted token was encrypted for from its
+// header, without decrypting it.
+func jweTenant(token string) string {
+	header, err := jwt.NewParser().DecodeSegment(strings.SplitN(token, ".", 2)[0])
+	if err != nil {
+		return ""
+	}
+	var decoded jweHeader
+	if err := json.Unmarshal(header, &decoded); err != nil {
+		return ""
+	}
+	tenantID, _, _ := strings.Cut(decoded.KeyID, "/")
+	return tenantID
+}
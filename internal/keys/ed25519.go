@@ -0,0 +1,99 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// AlgorithmEdDSA signs the tokens of tenants that opt in with an Ed25519
+// key; the default, HS256, signs them with the HMAC secrets.
+const AlgorithmEdDSA = "EdDSA"
+
+// JWK is a public key as published in the JWKS document.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// JWKS is the document relying parties verify tokens against.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// LoadEd25519PrivateKey reads a PEM-encoded PKCS #8 Ed25519 private key, as
+// written by `openssl genpkey -algorithm ed25519`.
+func LoadEd25519PrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an Ed25519 key, got %T", parsed)
+	}
+	return key, nil
+}
+
+// GenerateEd25519PrivateKey returns a new random Ed25519 key.
+func GenerateEd25519PrivateKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+// UseEd25519 has the resolver sign with key the tokens of tenants whose
+// token_algorithm is EdDSA. Environment tokens keep their environment's key,
+// and other tenants their token signing key.
+func (r *Resolver) UseEd25519(key ed25519.PrivateKey) {
+	r.edKey = key
+	r.edPublic = key.Public().(ed25519.PublicKey)
+	r.edKeyID = thumbprint(r.edPublic)
+}
+
+// Ed25519Enabled reports whether UseEd25519 was called, so tenants can opt
+// into EdDSA.
+func (r *Resolver) Ed25519Enabled() bool {
+	return r.edKey != nil
+}
+
+// JWKS publishes the Ed25519 public key. It is empty while only HMAC
+// secrets, which cannot be published, sign tokens.
+func (r *Resolver) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	if r.edKey != nil {
+		jwks.Keys = append(jwks.Keys, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(r.edPublic),
+			KeyID:     r.edKeyID,
+			Use:       "sig",
+			Algorithm: AlgorithmEdDSA,
+		})
+	}
+	return jwks
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint of key, used as its key ID.
+func thumbprint(key ed25519.PublicKey) string {
+	canonical := `{"crv":"Ed25519","kty":"OKP","x":"` + base64.RawURLEncoding.EncodeToString(key) + `"}`
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
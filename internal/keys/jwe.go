@@ -0,0 +1,206 @@
+package keys
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+// Tokens issued to a client that encrypts its tokens are signed as usual and
+// then wrapped in a compact JWE, encrypted directly with the client's key.
+// The kid names the tenant and the client, so whoever holds the key of that
+// audience, and Heimdall, can open the token.
+const (
+	EncryptionAlgorithm = "dir"
+	ContentEncryption   = "A256GCM"
+)
+
+var (
+	ErrNoEncryptionKey     = errors.New("client has no token encryption key")
+	ErrMalformedEncryption = errors.New("token is not a compact JWE Heimdall can decrypt")
+	ErrAudienceMismatch    = errors.New("encrypted token is not for the audience of its key")
+)
+
+type jweHeader struct {
+	Algorithm   string `json:"alg"`
+	Encryption  string `json:"enc"`
+	ContentType string `json:"cty"`
+	KeyID       string `json:"kid"`
+}
+
+// EncryptionKeyID is the kid of the tokens encrypted for client.
+func EncryptionKeyID(client *models.Client) string {
+	return client.TenantID + "/" + client.ID
+}
+
+// NewEncryptionKey returns a new token encryption key for a client of the
+// tenant, sealed with the tenant's data key.
+func NewEncryptionKey(ctx context.Context, secrets *vault.Vault, tenantID string) (string, error) {
+	key, err := GenerateSecret(32)
+	if err != nil {
+		return "", err
+	}
+	return secrets.Seal(ctx, tenantID, key)
+}
+
+// EncryptionJWK is the key of client as a JSON Web Key, for handing to the
+// audience that decrypts the client's tokens.
+func (r *Resolver) EncryptionJWK(ctx context.Context, client *models.Client) (map[string]string, error) {
+	key, err := r.encryptionKey(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"kty": "oct",
+		"use": "enc",
+		"alg": EncryptionAlgorithm,
+		"kid": EncryptionKeyID(client),
+		"k":   base64.RawURLEncoding.EncodeToString(key),
+	}, nil
+}
+
+// IsEncrypted reports whether token is a compact JWE rather than a JWS.
+func IsEncrypted(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+// Encrypt wraps the signed token in a JWE for client.
+func (r *Resolver) Encrypt(ctx context.Context, token string, client *models.Client) (string, error) {
+	key, err := r.encryptionKey(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(jweHeader{
+		Algorithm:   EncryptionAlgorithm,
+		Encryption:  ContentEncryption,
+		ContentType: "JWT",
+		KeyID:       EncryptionKeyID(client),
+	})
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	protected := base64.RawURLEncoding.EncodeToString(header)
+	sealed := aead.Seal(nil, nonce, []byte(token), []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+	return strings.Join([]string{
+		protected,
+		"",
+		base64.RawURLEncoding.EncodeToString(nonce),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// decrypt opens an encrypted token, returning the signed token inside and
+// the tenant and client it was encrypted for.
+func (r *Resolver) decrypt(ctx context.Context, token string) (signed, tenantID, clientID string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 || parts[1] != "" {
+		return "", "", "", ErrMalformedEncryption
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", "", ErrMalformedEncryption
+	}
+	var header jweHeader
+	if err := json.Unmarshal(raw, &header); err != nil || header.Algorithm != EncryptionAlgorithm || header.Encryption != ContentEncryption {
+		return "", "", "", ErrMalformedEncryption
+	}
+	tenantID, clientID, ok := strings.Cut(header.KeyID, "/")
+	if !ok {
+		return "", "", "", ErrMalformedEncryption
+	}
+
+	key, err := r.cache.get(ctx, "client:"+header.KeyID, r.loadClientKey(tenantID, clientID))
+	if err != nil {
+		return "", "", "", err
+	}
+	aead, err := newAEAD(key.key.([]byte))
+	if err != nil {
+		return "", "", "", err
+	}
+	nonce, nonceErr := base64.RawURLEncoding.DecodeString(parts[2])
+	ciphertext, ciphertextErr := base64.RawURLEncoding.DecodeString(parts[3])
+	tag, tagErr := base64.RawURLEncoding.DecodeString(parts[4])
+	if errors.Join(nonceErr, ciphertextErr, tagErr) != nil || len(nonce) != aead.NonceSize() || len(tag) != aead.Overhead() {
+		return "", "", "", ErrMalformedEncryption
+	}
+	plaintext, err := aead.Open(nil, nonce, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", "", "", ErrMalformedEncryption
+	}
+	return string(plaintext), tenantID, clientID, nil
+}
+
+func (r *Resolver) loadClientKey(tenantID, clientID string) func(ctx context.Context) (verificationKey, error) {
+	return func(ctx context.Context) (verificationKey, error) {
+		client, err := r.storage.GetClient(storage.WithTenant(ctx, tenantID), tenantID, clientID)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		if !client.EncryptTokens {
+			return verificationKey{}, ErrNoEncryptionKey
+		}
+		key, err := r.encryptionKey(ctx, client)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		return verificationKey{
+			tenantID: client.TenantID,
+			key:      key,
+		}, nil
+	}
+}
+
+// checkAudience refuses a decrypted token whose claims belong to another
+// tenant or client than the key it was encrypted with.
+func checkAudience(claims *models.Claims, tenantID, clientID string) error {
+	if claims.TenantID != tenantID || !slices.Contains(claims.Audience, clientID) {
+		return ErrAudienceMismatch
+	}
+	return nil
+}
+
+// encryptionKey opens the token encryption key of client.
+func (r *Resolver) encryptionKey(ctx context.Context, client *models.Client) ([]byte, error) {
+	if client.EncryptionKey == "" {
+		return nil, ErrNoEncryptionKey
+	}
+	encoded, err := r.secrets.Open(ctx, client.TenantID, client.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("token encryption key is not 32 hex-encoded bytes")
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,247 @@
+package keys
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/tajious/heimdall/internal/metrics"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+var (
+	ErrEnvironmentMismatch = errors.New("environment does not belong to token tenant")
+	ErrUnexpectedAlgorithm = errors.New("token is signed with an unexpected algorithm")
+)
+
+// DefaultLeeway is how far a token's exp, nbf, and iat may be off before it
+// is refused, absorbing clock skew between issuer and validator.
+const DefaultLeeway = 30 * time.Second
+
+type Resolver struct {
+	secret  string
+	storage storage.Storage
+	secrets *vault.Vault
+	cache   *keyCache
+	leeway  time.Duration
+
+	// legacyCutoff, when set, is when tokens signed with the global secret
+	// stop verifying.
+	legacyCutoff  time.Time
+	verifications *metrics.CounterVec
+
+	edKey    ed25519.PrivateKey
+	edPublic ed25519.PublicKey
+	edKeyID  string
+}
+
+func NewResolver(secret string, storage storage.Storage, secrets *vault.Vault, cacheTTL time.Duration, registry *metrics.Registry) *Resolver {
+	return &Resolver{
+		secret:  secret,
+		storage: storage,
+		secrets: secrets,
+		cache:   newKeyCache(cacheTTL, registry),
+		leeway:  DefaultLeeway,
+
+		verifications: registry.Counter("heimdall_token_verifications_total", "HMAC tokens verified without an environment, by the key that signed them.", "key"),
+	}
+}
+
+// SetLeeway replaces DefaultLeeway; zero checks token times strictly.
+func (r *Resolver) SetLeeway(leeway time.Duration) {
+	r.leeway = leeway
+}
+
+// Parse verifies tokenString into claims, checking its signature with
+// Keyfunc and its times with the leeway. Encrypted tokens are decrypted
+// first, and must be for the client whose key opened them.
+func (r *Resolver) Parse(ctx context.Context, tokenString string, claims *models.Claims) (*jwt.Token, error) {
+	if !IsEncrypted(tokenString) {
+		return jwt.ParseWithClaims(tokenString, claims, r.Keyfunc(ctx), jwt.WithLeeway(r.leeway), jwt.WithIssuedAt())
+	}
+
+	signed, tenantID, clientID, err := r.decrypt(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	token, err := jwt.ParseWithClaims(signed, claims, r.Keyfunc(ctx), jwt.WithLeeway(r.leeway), jwt.WithIssuedAt())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAudience(claims, tenantID, clientID); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Sign signs claims, giving the token a random jti unless the caller set
+// one. Tokens are signed with the key of env, else with the Ed25519 key for
+// a tenant that opted into EdDSA, else with the token signing key of
+// tenant, else with the global secret.
+func (r *Resolver) Sign(ctx context.Context, claims *models.Claims, tenant *models.Tenant, env *models.Environment) (string, error) {
+	if claims.ID == "" {
+		claims.ID = uuid.NewString()
+	}
+	if env == nil && tenant != nil && tenant.Config.TokenAlgorithm == AlgorithmEdDSA && r.edKey != nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+		token.Header["kid"] = r.edKeyID
+		return token.SignedString(r.edKey)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if env == nil && tenant != nil && tenant.Config.TokenSigningKey != "" {
+		key, err := r.openTenantKey(ctx, tenant)
+		if err != nil {
+			return "", err
+		}
+		token.Header["kid"] = TenantKeyID
+		return token.SignedString(key)
+	}
+	if env != nil {
+		key, err := r.openEnvironmentKey(ctx, env)
+		if err != nil {
+			return "", err
+		}
+		return token.SignedString(key)
+	}
+	return token.SignedString([]byte(r.secret))
+}
+
+// Keyfunc verifies HMAC tokens against the key of their environment, their
+// tenant, or the global secret, and EdDSA tokens against the Ed25519 public
+// key once UseEd25519 is set. Environment tokens are only ever HMAC tokens,
+// and must name an environment of their tenant.
+func (r *Resolver) Keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+		case *jwt.SigningMethodEd25519:
+			if r.edKey == nil {
+				return nil, ErrUnexpectedAlgorithm
+			}
+		default:
+			return nil, ErrUnexpectedAlgorithm
+		}
+
+		claims, ok := token.Claims.(*models.Claims)
+		if !ok || claims.EnvironmentID == "" {
+			if token.Method == jwt.SigningMethodEdDSA {
+				return r.edPublic, nil
+			}
+			if ok && token.Header["kid"] == TenantKeyID {
+				return r.tenantKey(ctx, claims.TenantID)
+			}
+			return r.globalSecret()
+		}
+
+		if token.Method == jwt.SigningMethodEdDSA {
+			return nil, ErrUnexpectedAlgorithm
+		}
+		key, err := r.cache.get(ctx, claims.EnvironmentID, r.loadEnvironmentKey(claims.EnvironmentID))
+		if err != nil {
+			return nil, err
+		}
+
+		if key.tenantID != claims.TenantID {
+			return nil, ErrEnvironmentMismatch
+		}
+		return key.key, nil
+	}
+}
+
+func (r *Resolver) loadEnvironmentKey(environmentID string) func(ctx context.Context) (verificationKey, error) {
+	return func(ctx context.Context) (verificationKey, error) {
+		// The token names its environment before it is verified, so the
+		// environment is looked up across tenants.
+		env, err := r.storage.GetEnvironment(storage.Unscoped(ctx), environmentID)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		key, err := r.openEnvironmentKey(ctx, env)
+		if err != nil {
+			return verificationKey{}, err
+		}
+
+		return verificationKey{
+			tenantID: env.TenantID,
+			key:      key,
+		}, nil
+	}
+}
+
+// Preload caches the verification key of env, so the first token of the
+// environment is verified without a database read.
+func (r *Resolver) Preload(ctx context.Context, env *models.Environment) error {
+	key, err := r.openEnvironmentKey(ctx, env)
+	if err != nil {
+		return err
+	}
+	r.cache.put(env.ID, verificationKey{
+		tenantID: env.TenantID,
+		key:      key,
+	})
+	return nil
+}
+
+// NewEnvironmentKey returns a new signing key for an environment of the
+// tenant, sealed with the tenant's data key.
+func NewEnvironmentKey(ctx context.Context, secrets *vault.Vault, tenantID string) (string, error) {
+	key, err := GenerateSecret(32)
+	if err != nil {
+		return "", err
+	}
+	return secrets.Seal(ctx, tenantID, key)
+}
+
+// openEnvironmentKey returns the signing key of env in clear.
+func (r *Resolver) openEnvironmentKey(ctx context.Context, env *models.Environment) ([]byte, error) {
+	key, err := r.secrets.Open(ctx, env.TenantID, env.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(key), nil
+}
+
+func GenerateSecret(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// apiKeyPrefixLength is how many random characters of an API key are kept in
+// clear text so operators can tell keys apart.
+const apiKeyPrefixLength = 6
+
+// GenerateAPIKey returns a new environment API key and its displayable prefix.
+func GenerateAPIKey(envName string) (string, string, error) {
+	secret, err := GenerateSecret(24)
+	if err != nil {
+		return "", "", err
+	}
+	apiKey := "hk_" + envName + "_" + secret
+	return apiKey, APIKeyPrefix(apiKey), nil
+}
+
+// APIKeyPrefix returns the part of an API key that is safe to display.
+func APIKeyPrefix(apiKey string) string {
+	i := strings.LastIndex(apiKey, "_") + 1
+	if i+apiKeyPrefixLength > len(apiKey) {
+		return apiKey[:i]
+	}
+	return apiKey[:i+apiKeyPrefixLength]
+}
+
+func HashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,70 @@
+package keys
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+const (
+	// SignatureScheme opens the Authorization header of a signed request:
+	// "HMAC-SHA256 Credential=<key id>, Signature=<hex>".
+	SignatureScheme = "HMAC-SHA256"
+	// DateHeader carries the unix time a request was signed at.
+	DateHeader = "X-Heimdall-Date"
+)
+
+// SignRequest returns the hex HMAC-SHA256 of a request under secret. The
+// string signed is the scheme, timestamp, method, path, canonical query, and
+// hex SHA-256 of the body, one per line.
+func SignRequest(secret, timestamp, method, path, rawQuery string, body []byte) string {
+	bodySum := sha256.Sum256(body)
+	stringToSign := strings.Join([]string{
+		SignatureScheme,
+		timestamp,
+		strings.ToUpper(method),
+		path,
+		CanonicalQuery(rawQuery),
+		hex.EncodeToString(bodySum[:]),
+	}, "\n")
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CanonicalQuery sorts a query string by parameter name, so that clients
+// need not send parameters in the order they were signed in.
+func CanonicalQuery(rawQuery string) string {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	return values.Encode()
+}
+
+// FormatSignature returns the Authorization header of a request signed with
+// keyID.
+func FormatSignature(keyID, signature string) string {
+	return SignatureScheme + " Credential=" + keyID + ", Signature=" + signature
+}
+
+// ParseSignature reads back an Authorization header made by FormatSignature.
+func ParseSignature(header string) (keyID, signature string, ok bool) {
+	params, found := strings.CutPrefix(header, SignatureScheme+" ")
+	if !found {
+		return "", "", false
+	}
+	for _, param := range strings.Split(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch name {
+		case "Credential":
+			keyID = value
+		case "Signature":
+			signature = value
+		}
+	}
+	return keyID, signature, keyID != "" && signature != ""
+}
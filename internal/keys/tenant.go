@@ -0,0 +1,103 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+// TenantKeyID is the kid header of HMAC tokens signed with a tenant's token
+// signing key. Tokens without it were signed with the global secret.
+const TenantKeyID = "tenant"
+
+var (
+	ErrLegacySecretRetired = errors.New("tokens signed with the global secret are no longer accepted")
+	ErrNoTenantKey         = errors.New("tenant has no token signing key")
+)
+
+// SetLegacySecretCutoff has tokens signed with the global secret, rather
+// than a tenant or environment key, refused from cutoff on. Until then both
+// verify, so tokens issued before tenants got their own keys stay valid
+// until they expire.
+func (r *Resolver) SetLegacySecretCutoff(cutoff time.Time) {
+	r.legacyCutoff = cutoff
+}
+
+func (r *Resolver) globalSecret() (interface{}, error) {
+	if !r.legacyCutoff.IsZero() && !time.Now().Before(r.legacyCutoff) {
+		return nil, ErrLegacySecretRetired
+	}
+	r.verifications.WithLabels("global").Inc()
+	return []byte(r.secret), nil
+}
+
+// NewTenantKey returns a new token signing key for the tenant, sealed with
+// its data key. The tenant must exist first, so that its data key is stored
+// in the tenant's region.
+func NewTenantKey(ctx context.Context, secrets *vault.Vault, tenantID string) (string, error) {
+	key, err := GenerateSecret(32)
+	if err != nil {
+		return "", err
+	}
+	return secrets.Seal(ctx, tenantID, key)
+}
+
+// tenantKey returns the token signing key of the tenant, cached alongside
+// the environment keys.
+func (r *Resolver) tenantKey(ctx context.Context, tenantID string) (interface{}, error) {
+	key, err := r.cache.get(ctx, tenantCacheKey(tenantID), func(ctx context.Context) (verificationKey, error) {
+		tenant, err := r.storage.GetTenant(storage.WithTenant(ctx, tenantID), tenantID)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		key, err := r.openTenantKey(ctx, tenant)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		return verificationKey{tenantID: tenant.ID, key: key}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.verifications.WithLabels("tenant").Inc()
+	return key.key, nil
+}
+
+// openTenantKey returns the token signing key of tenant in clear.
+func (r *Resolver) openTenantKey(ctx context.Context, tenant *models.Tenant) ([]byte, error) {
+	if tenant.Config.TokenSigningKey == "" {
+		return nil, ErrNoTenantKey
+	}
+	key, err := r.secrets.Open(ctx, tenant.ID, tenant.Config.TokenSigningKey)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(key), nil
+}
+
+// PreloadTenant caches the token signing key of tenant, if it has one.
+func (r *Resolver) PreloadTenant(ctx context.Context, tenant *models.Tenant) error {
+	if tenant.Config.TokenSigningKey == "" {
+		return nil
+	}
+	key, err := r.openTenantKey(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	r.cache.put(tenantCacheKey(tenant.ID), verificationKey{tenantID: tenant.ID, key: key})
+	return nil
+}
+
+// ForgetTenant drops the cached token signing key of the tenant once it is
+// rotated, so that tokens signed with the new key verify at once.
+func (r *Resolver) ForgetTenant(tenantID string) {
+	r.cache.forget(tenantCacheKey(tenantID))
+}
+
+func tenantCacheKey(tenantID string) string {
+	return "tenant:" + tenantID
+}
@@ -0,0 +1,199 @@
+// Package loadtest drives a mix of logins, token validations, and token
+// refreshes against a running instance through the client SDK, and reports
+// their latency and errors.
+package loadtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tajious/heimdall/pkg/client"
+)
+
+type Operation string
+
+const (
+	OpLogin    Operation = "login"
+	OpValidate Operation = "validate"
+	// OpRefresh gets a fresh token for the SSO session of the virtual
+	// user's last login, as refresh tokens are not issued.
+	OpRefresh Operation = "refresh"
+)
+
+var operations = []Operation{OpLogin, OpValidate, OpRefresh}
+
+// Mix weighs how often each operation is picked.
+type Mix map[Operation]int
+
+// ParseMix reads a mix such as login=1,validate=8,refresh=1.
+func ParseMix(s string) (Mix, error) {
+	mix := make(Mix)
+	for _, entry := range strings.Split(s, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		n, err := strconv.Atoi(weight)
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("mix entry %q is not operation=weight", entry)
+		}
+		op := Operation(name)
+		if op != OpLogin && op != OpValidate && op != OpRefresh {
+			return nil, fmt.Errorf("unknown operation %q", name)
+		}
+		mix[op] = n
+	}
+	total := 0
+	for _, n := range mix {
+		total += n
+	}
+	if total == 0 {
+		return nil, errors.New("mix has no operation with a positive weight")
+	}
+	return mix, nil
+}
+
+func (m Mix) pick() Operation {
+	total := 0
+	for _, n := range m {
+		total += n
+	}
+	roll := rand.IntN(total)
+	for _, op := range operations {
+		if roll < m[op] {
+			return op
+		}
+		roll -= m[op]
+	}
+	return OpValidate
+}
+
+type Credentials struct {
+	Username string
+	Password string
+}
+
+type Config struct {
+	Target      string
+	TenantID    string
+	Environment string
+	ClientID    string
+	// Users are spread over the virtual users in turn.
+	Users       []Credentials
+	Concurrency int
+	Duration    time.Duration
+	// Rate caps the operations per second over all virtual users; zero
+	// runs them back to back.
+	Rate    float64
+	Mix     Mix
+	Timeout time.Duration
+}
+
+// Run drives the mix until the duration is over or ctx is done. Every
+// virtual user logs in first, so that it has a token to validate and a
+// session to refresh; those logins count towards the report.
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if len(cfg.Users) == 0 {
+		return nil, errors.New("no users to log in as")
+	}
+	if cfg.Concurrency < 1 {
+		return nil, errors.New("concurrency must be at least 1")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	var ticks <-chan time.Time
+	if cfg.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	report := newReport()
+	transport := &http.Transport{MaxIdleConnsPerHost: cfg.Concurrency}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func(user Credentials) {
+			defer wg.Done()
+			vu := &virtualUser{
+				cfg:    cfg,
+				user:   user,
+				client: client.New(cfg.Target, &http.Client{Transport: transport, Timeout: cfg.Timeout}),
+				report: report,
+			}
+			vu.run(ctx, ticks)
+		}(cfg.Users[i%len(cfg.Users)])
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(start)
+	return report, nil
+}
+
+type virtualUser struct {
+	cfg    Config
+	user   Credentials
+	client *client.Client
+	report *Report
+	token  string
+}
+
+func (vu *virtualUser) run(ctx context.Context, ticks <-chan time.Time) {
+	op := OpLogin
+	for ctx.Err() == nil {
+		if ticks != nil {
+			select {
+			case <-ticks:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if vu.token == "" {
+			op = OpLogin
+		}
+		start := time.Now()
+		err := vu.do(ctx, op)
+		// Calls cut short by the end of the run are not the target's fault.
+		if ctx.Err() != nil {
+			return
+		}
+		vu.report.record(op, time.Since(start), err)
+		op = vu.cfg.Mix.pick()
+	}
+}
+
+func (vu *virtualUser) do(ctx context.Context, op Operation) error {
+	switch op {
+	case OpLogin:
+		token, err := vu.client.Login(ctx, vu.cfg.TenantID, vu.cfg.Environment, client.LoginRequest{
+			Username: vu.user.Username,
+			Password: vu.user.Password,
+			ClientID: vu.cfg.ClientID,
+		})
+		if err != nil {
+			return err
+		}
+		vu.token = token.Token
+	case OpValidate:
+		validation, err := vu.client.ValidateToken(ctx, vu.token)
+		if err != nil {
+			return err
+		}
+		if !validation.Valid {
+			return errors.New("token reported invalid")
+		}
+	case OpRefresh:
+		token, err := vu.client.SSOToken(ctx, vu.cfg.TenantID, vu.cfg.ClientID)
+		if err != nil {
+			return err
+		}
+		vu.token = token.Token
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package loadtest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tajious/heimdall/pkg/client"
+)
+
+// buckets are the upper bounds of the latency histogram.
+var buckets = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second,
+}
+
+// Report holds the outcome of every operation of a run.
+type Report struct {
+	Elapsed time.Duration
+
+	mu    sync.Mutex
+	stats map[Operation]*Stats
+}
+
+type Stats struct {
+	Count  int
+	Errors int
+	// Outcomes counts the errors by HTTP status, or "transport" when no
+	// response came back.
+	Outcomes  map[string]int
+	Histogram []int
+	latencies []time.Duration
+}
+
+func newReport() *Report {
+	return &Report{stats: make(map[Operation]*Stats)}
+}
+
+func (r *Report) record(op Operation, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.stats[op]
+	if !ok {
+		s = &Stats{Outcomes: make(map[string]int), Histogram: make([]int, len(buckets)+1)}
+		r.stats[op] = s
+	}
+	s.Count++
+	s.latencies = append(s.latencies, latency)
+	s.Histogram[sort.Search(len(buckets), func(i int) bool { return latency <= buckets[i] })]++
+	if err == nil {
+		return
+	}
+	s.Errors++
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) {
+		s.Outcomes[strconv.Itoa(apiErr.StatusCode)]++
+	} else {
+		s.Outcomes["transport"]++
+	}
+}
+
+// Stats returns the statistics of op, nil if it never ran.
+func (r *Report) Stats(op Operation) *Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats[op]
+}
+
+// ErrorRate is the share of operations that failed.
+func (s *Stats) ErrorRate() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Count)
+}
+
+// Percentile returns the latency under which p percent of the operations
+// completed.
+func (s *Stats) Percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[min(len(sorted)-1, int(p/100*float64(len(sorted))))]
+}
+
+// Summary is the report in a shape to print as JSON or YAML, with
+// latencies in milliseconds.
+type Summary struct {
+	ElapsedSeconds float64            `json:"elapsed_seconds" yaml:"elapsed_seconds"`
+	Operations     []OperationSummary `json:"operations" yaml:"operations"`
+}
+
+type OperationSummary struct {
+	Operation      Operation      `json:"operation" yaml:"operation"`
+	Count          int            `json:"count" yaml:"count"`
+	Rate           float64        `json:"rate" yaml:"rate"`
+	Errors         int            `json:"errors" yaml:"errors"`
+	ErrorRate      float64        `json:"error_rate" yaml:"error_rate"`
+	P50            float64        `json:"p50_ms" yaml:"p50_ms"`
+	P90            float64        `json:"p90_ms" yaml:"p90_ms"`
+	P99            float64        `json:"p99_ms" yaml:"p99_ms"`
+	Max            float64        `json:"max_ms" yaml:"max_ms"`
+	ErrorsByStatus map[string]int `json:"errors_by_status" yaml:"errors_by_status"`
+	Histogram      []Bucket       `json:"histogram" yaml:"histogram"`
+}
+
+// Bucket counts the operations slower than the previous bucket and at most
+// as slow as LE, a duration such as 250ms or +Inf.
+type Bucket struct {
+	LE    string `json:"le" yaml:"le"`
+	Count int    `json:"count" yaml:"count"`
+}
+
+func (r *Report) Summary() Summary {
+	summary := Summary{ElapsedSeconds: r.Elapsed.Seconds(), Operations: []OperationSummary{}}
+	for _, op := range operations {
+		s := r.Stats(op)
+		if s == nil {
+			continue
+		}
+		histogram := make([]Bucket, len(s.Histogram))
+		for i, n := range s.Histogram {
+			histogram[i] = Bucket{LE: "+Inf", Count: n}
+			if i < len(buckets) {
+				histogram[i].LE = buckets[i].String()
+			}
+		}
+		summary.Operations = append(summary.Operations, OperationSummary{
+			Operation:      op,
+			Count:          s.Count,
+			Rate:           float64(s.Count) / r.Elapsed.Seconds(),
+			Errors:         s.Errors,
+			ErrorRate:      s.ErrorRate(),
+			P50:            milliseconds(s.Percentile(50)),
+			P90:            milliseconds(s.Percentile(90)),
+			P99:            milliseconds(s.Percentile(99)),
+			Max:            milliseconds(s.Percentile(100)),
+			ErrorsByStatus: s.Outcomes,
+			Histogram:      histogram,
+		})
+	}
+	return summary
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Write prints a summary per operation followed by its latency histogram.
+func (r *Report) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "OPERATION\tCOUNT\tRATE/S\tERRORS\tERROR RATE\tP50\tP90\tP99\tMAX\tERRORS BY STATUS\n")
+	for _, op := range operations {
+		s := r.Stats(op)
+		if s == nil {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%d\t%.2f%%\t%s\t%s\t%s\t%s\t%s\n", op, s.Count, float64(s.Count)/r.Elapsed.Seconds(),
+			s.Errors, 100*s.ErrorRate(), round(s.Percentile(50)), round(s.Percentile(90)), round(s.Percentile(99)), round(s.Percentile(100)), outcomes(s.Outcomes))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, op := range operations {
+		s := r.Stats(op)
+		if s == nil {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s latency\n", op)
+		for i, n := range s.Histogram {
+			if n == 0 {
+				continue
+			}
+			bound := "+Inf"
+			if i < len(buckets) {
+				bound = buckets[i].String()
+			}
+			fmt.Fprintf(w, "  <= %-7s %8d %6.2f%%\n", bound, n, 100*float64(n)/float64(s.Count))
+		}
+	}
+	return nil
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(100 * time.Microsecond)
+}
+
+func outcomes(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "-"
+	}
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := ""
+	for i, key := range keys {
+		if i > 0 {
+			out += " "
+		}
+		out += fmt.Sprintf("%s=%d", key, counts[key])
+	}
+	return out
+}
@@ -0,0 +1,321 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var Default = NewRegistry()
+
+type metricKind string
+
+const (
+	kindCounter metricKind = "counter"
+	kindGauge   metricKind = "gauge"
+	kindSummary metricKind = "summary"
+)
+
+// Summaries report quantiles over their latest summaryWindow observations,
+// so they follow current behavior rather than all-time history.
+const summaryWindow = 1024
+
+var summaryQuantiles = []float64{0.5, 0.95, 0.99}
+
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]*vec
+}
+
+type vec struct {
+	name       string
+	help       string
+	kind       metricKind
+	labelNames []string
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+
+	mu    sync.Mutex
+	value float64
+
+	// Summaries only: value is the sum of every observation, count their
+	// number, and samples a ring of the latest ones.
+	count   uint64
+	samples []float64
+	next    int
+}
+
+type CounterVec struct {
+	vec *vec
+}
+
+type Counter struct {
+	series *series
+}
+
+type GaugeVec struct {
+	vec *vec
+}
+
+type Gauge struct {
+	series *series
+}
+
+type SummaryVec struct {
+	vec *vec
+}
+
+type Summary struct {
+	series *series
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]*vec),
+	}
+}
+
+func (r *Registry) Counter(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{vec: r.register(name, help, kindCounter, labelNames)}
+}
+
+func (r *Registry) Gauge(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{vec: r.register(name, help, kindGauge, labelNames)}
+}
+
+func (r *Registry) Summary(name, help string, labelNames ...string) *SummaryVec {
+	return &SummaryVec{vec: r.register(name, help, kindSummary, labelNames)}
+}
+
+func (r *Registry) register(name, help string, kind metricKind, labelNames []string) *vec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.metrics[name]; ok {
+		if existing.kind != kind || len(existing.labelNames) != len(labelNames) {
+			panic(fmt.Sprintf("metrics: %s registered twice with different shapes", name))
+		}
+		return existing
+	}
+
+	v := &vec{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+	r.metrics[name] = v
+	return v
+}
+
+func (v *vec) with(labelValues []string) *series {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok = v.series[key]; ok {
+		return s
+	}
+	s = &series{labelValues: append([]string(nil), labelValues...)}
+	v.series[key] = s
+	return s
+}
+
+func (c *CounterVec) WithLabels(labelValues ...string) *Counter {
+	return &Counter{series: c.vec.with(labelValues)}
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.series.add(delta)
+}
+
+func (g *GaugeVec) WithLabels(labelValues ...string) *Gauge {
+	return &Gauge{series: g.vec.with(labelValues)}
+}
+
+func (g *Gauge) Set(value float64) {
+	g.series.mu.Lock()
+	g.series.value = value
+	g.series.mu.Unlock()
+}
+
+func (g *Gauge) Inc() {
+	g.series.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.series.add(-1)
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.series.add(delta)
+}
+
+func (v *SummaryVec) WithLabels(labelValues ...string) *Summary {
+	return &Summary{series: v.vec.with(labelValues)}
+}
+
+func (s *Summary) Observe(value float64) {
+	s.series.mu.Lock()
+	defer s.series.mu.Unlock()
+
+	s.series.value += value
+	s.series.count++
+	if len(s.series.samples) < summaryWindow {
+		s.series.samples = append(s.series.samples, value)
+		return
+	}
+	s.series.samples[s.series.next] = value
+	s.series.next = (s.series.next + 1) % summaryWindow
+}
+
+// Quantile returns the q-quantile of the recent observations, or 0 before
+// the first.
+func (s *Summary) Quantile(q float64) float64 {
+	return s.series.quantiles([]float64{q})[0]
+}
+
+func (s *series) quantiles(qs []float64) []float64 {
+	s.mu.Lock()
+	sorted := append([]float64(nil), s.samples...)
+	s.mu.Unlock()
+	sort.Float64s(sorted)
+
+	values := make([]float64, len(qs))
+	if len(sorted) == 0 {
+		return values
+	}
+	for i, q := range qs {
+		values[i] = sorted[int(math.Ceil(q*float64(len(sorted))))-1]
+	}
+	return values
+}
+
+func (s *series) add(delta float64) {
+	s.mu.Lock()
+	s.value += delta
+	s.mu.Unlock()
+}
+
+func (s *series) load() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.value
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		r.mu.RLock()
+		v := r.metrics[name]
+		r.mu.RUnlock()
+		v.write(&b)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (v *vec) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", v.name, v.kind)
+
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	all := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		all = append(all, v.series[key])
+	}
+	v.mu.RUnlock()
+
+	for _, s := range all {
+		if v.kind == kindSummary {
+			v.writeSummary(b, s)
+			continue
+		}
+		fmt.Fprintf(b, "%s%s %s\n", v.name, formatLabels(v.labelNames, s.labelValues), formatValue(s.load()))
+	}
+}
+
+func (v *vec) writeSummary(b *strings.Builder, s *series) {
+	names := append(append([]string(nil), v.labelNames...), "quantile")
+	for i, value := range s.quantiles(summaryQuantiles) {
+		values := append(append([]string(nil), s.labelValues...), formatValue(summaryQuantiles[i]))
+		fmt.Fprintf(b, "%s%s %s\n", v.name, formatLabels(names, values), formatValue(value))
+	}
+
+	s.mu.Lock()
+	sum, count := s.value, s.count
+	s.mu.Unlock()
+	labels := formatLabels(v.labelNames, s.labelValues)
+	fmt.Fprintf(b, "%s_sum%s %s\n", v.name, labels, formatValue(sum))
+	fmt.Fprintf(b, "%s_count%s %d\n", v.name, labels, count)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", value)
+}
+
+func Handler(registry *Registry) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4")
+		_, err := registry.WriteTo(c)
+		return err
+	}
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The stages of a login, each observed by the code that runs it.
+const (
+	StageBodyParse  = "body_parse"
+	StageTenantLoad = "tenant_load"
+	StageHashVerify = "hash_verify"
+	StageTokenSign  = "token_sign"
+	StageDBWrite    = "db_write"
+)
+
+// Stage is one timed step of a request.
+type Stage struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Timeline collects the stages of a request as the code handling it passes
+// through them. A nil Timeline ignores observations, so code shared with
+// untimed requests can observe unconditionally.
+type Timeline struct {
+	mu     sync.Mutex
+	stages []Stage
+}
+
+type timelineKey struct{}
+
+// StartTimeline attaches a new Timeline to the request. Handlers and
+// anything they pass c.Context() to find it with TimelineFrom.
+func StartTimeline(c *fiber.Ctx) *Timeline {
+	timeline := &Timeline{}
+	c.Locals(timelineKey{}, timeline)
+	return timeline
+}
+
+// TimelineFrom returns the Timeline of the request ctx belongs to, or nil.
+func TimelineFrom(ctx context.Context) *Timeline {
+	timeline, _ := ctx.Value(timelineKey{}).(*Timeline)
+	return timeline
+}
+
+// Observe records that stage ran from start until now. A stage observed
+// twice adds up.
+func (t *Timeline) Observe(stage string, start time.Time) {
+	if t == nil {
+		return
+	}
+	elapsed := time.Since(start)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.stages {
+		if t.stages[i].Name == stage {
+			t.stages[i].Duration += elapsed
+			return
+		}
+	}
+	t.stages = append(t.stages, Stage{Name: stage, Duration: elapsed})
+}
+
+// Stages returns the stages observed so far, in the order they first ran.
+func (t *Timeline) Stages() []Stage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Stage(nil), t.stages...)
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/tajious/heimdall/internal/events"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+type Auditor struct {
+	storage storage.Storage
+	events  *events.Broker
+}
+
+func NewAuditor(storage storage.Storage, broker *events.Broker) *Auditor {
+	return &Auditor{
+		storage: storage,
+		events:  broker,
+	}
+}
+
+// Record writes an audit log entry for every state-changing request once the
+// handler has run, including rejected ones, along with the rows the request
+// wrote.
+func (a *Auditor) Record() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		switch c.Method() {
+		case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+			return c.Next()
+		}
+		recorder := storage.NewChangeRecorder()
+		c.Locals(storage.ChangeRecorderKey{}, recorder)
+
+		err := c.Next()
+
+		if ReadOnly(c) {
+			return err
+		}
+
+		status := c.Response().StatusCode()
+		eventType := events.ForRequest(status)
+		entry := &models.AuditLog{
+			Action:    c.Method() + " " + c.Route().Path,
+			Resource:  utils.CopyString(c.Path()),
+			Status:    status,
+			IP:        utils.CopyString(c.IP()),
+			EventType: eventType.ID,
+			Category:  string(eventType.Category),
+			Severity:  string(eventType.Severity),
+			CreatedAt: time.Now(),
+			Changes:   recorder.Changes(),
+		}
+		if claims, ok := c.Locals("user").(*models.Claims); ok {
+			entry.ActorID = claims.UserID
+			entry.TenantID = claims.TenantID
+		}
+		if tenant := TenantFromContext(c); tenant != nil {
+			entry.TenantID = tenant.ID
+		}
+
+		// Entries outside any tenant, such as rejected operator calls, are
+		// written unscoped.
+		ctx := storage.Unscoped(c.Context())
+		if entry.TenantID != "" {
+			ctx = storage.WithTenant(c.Context(), entry.TenantID)
+		}
+		if auditErr := a.storage.CreateAuditLog(ctx, entry); auditErr != nil {
+			log.Printf("Failed to write audit log: %v", auditErr)
+		}
+
+		event := events.New(eventType, entry.TenantID)
+		event.ActorID = entry.ActorID
+		event.Action = entry.Action
+		event.Resource = entry.Resource
+		event.Status = entry.Status
+		event.IP = entry.IP
+		a.events.Publish(c.Context(), event)
+		return err
+	}
+}
@@ -4,17 +4,19 @@ import (
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/tajious/heimdall/internal/keys"
 	"github.com/tajious/heimdall/internal/models"
 )
 
 type AuthMiddleware struct {
-	secret string
+	keys   *keys.Resolver
+	signed *SignedRequests
 }
 
-func NewAuthMiddleware(secret string) *AuthMiddleware {
+func NewAuthMiddleware(keys *keys.Resolver, signed *SignedRequests) *AuthMiddleware {
 	return &AuthMiddleware{
-		secret: secret,
+		keys:   keys,
+		signed: signed,
 	}
 }
 
@@ -27,6 +29,15 @@ func (m *AuthMiddleware) Authenticate() fiber.Handler {
 			})
 		}
 
+		if strings.HasPrefix(authHeader, keys.SignatureScheme+" ") {
+			claims, err := m.signed.Verify(c)
+			if err != nil {
+				return m.signed.Reject(c, err)
+			}
+			c.Locals("user", claims)
+			return c.Next()
+		}
+
 		parts := strings.Split(authHeader, " ")
 		if len(parts) != 2 || parts[0] != "Bearer" {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
@@ -37,9 +48,7 @@ func (m *AuthMiddleware) Authenticate() fiber.Handler {
 		tokenString := parts[1]
 		claims := &models.Claims{}
 
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(m.secret), nil
-		})
+		token, err := m.keys.Parse(c.Context(), tokenString, claims)
 
 		if err != nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
@@ -53,6 +62,14 @@ func (m *AuthMiddleware) Authenticate() fiber.Handler {
 			})
 		}
 
+		// Action and magic link tokens stand for a single action, checked
+		// through /validate-token, and never grant access to the API.
+		if claims.Type != models.TokenAccess {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid token",
+			})
+		}
+
 		c.Locals("user", claims)
 		return c.Next()
 	}
@@ -78,3 +95,24 @@ func (m *AuthMiddleware) RequireRole(roles ...models.Role) fiber.Handler {
 		})
 	}
 }
+
+// RequireAdminScope lets through admins holding scope. Admins without any
+// scopes hold them all; other roles are left to RequireRole.
+func (m *AuthMiddleware) RequireAdminScope(scope models.AdminScope) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, ok := c.Locals("user").(*models.Claims)
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "User not found in context",
+			})
+		}
+
+		if user.Role != models.RoleAdmin || user.HasAdminScope(scope) {
+			return c.Next()
+		}
+
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Admin scope " + string(scope) + " required",
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/authz"
+	"github.com/tajious/heimdall/internal/models"
+)
+
+type Authorizer struct {
+	engine *authz.Engine
+}
+
+func NewAuthorizer(engine *authz.Engine) *Authorizer {
+	return &Authorizer{
+		engine: engine,
+	}
+}
+
+// Require enforces the tenant's access policies for action on the request
+// path (relative to /api/v1/). Tenants without access policies keep the
+// role-based checks only.
+func (a *Authorizer) Require(action string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, ok := c.Locals("user").(*models.Claims)
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "User not found in context",
+			})
+		}
+
+		tenant := TenantFromContext(c)
+		policies, err := a.engine.Policies(c.Context(), tenant.ID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to load access policies",
+			})
+		}
+		if len(policies) == 0 {
+			return c.Next()
+		}
+
+		decision := authz.Evaluate(policies, models.AuthorizeRequest{
+			Subject:  models.AuthorizeSubject{ID: user.UserID, Role: user.Role},
+			Action:   action,
+			Resource: resourcePath(c.Path()),
+		})
+		if !decision.Allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error":  "Access denied by policy",
+				"reason": decision.Reason,
+			})
+		}
+		return c.Next()
+	}
+}
+
+// resourcePath strips the API version prefix from path, so access policies
+// apply alike to every version.
+func resourcePath(path string) string {
+	rest, ok := strings.CutPrefix(path, "/api/")
+	if !ok {
+		return path
+	}
+	if _, resource, ok := strings.Cut(rest, "/"); ok {
+		return resource
+	}
+	return rest
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ClientCertificates makes the certificate chain the client presented
+// available to handlers through ClientCertificatesFromContext. The chain
+// comes from the TLS connection when the server terminates TLS itself.
+// Behind a TLS-terminating proxy, it comes from header, holding the URL
+// escaped PEM chain as nginx's $ssl_client_escaped_cert does. The header is
+// ignored when empty; when set, the server must only be reachable through
+// the proxy, and the proxy must overwrite the header on every request.
+func ClientCertificates(header string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if state := c.Context().TLSConnectionState(); state != nil && len(state.PeerCertificates) > 0 {
+			c.Locals("client_certificates", state.PeerCertificates)
+		} else if header != "" {
+			if certs := parseForwardedCertificates(c.Get(header)); len(certs) > 0 {
+				c.Locals("client_certificates", certs)
+			}
+		}
+		return c.Next()
+	}
+}
+
+func ClientCertificatesFromContext(c *fiber.Ctx) []*x509.Certificate {
+	certs, _ := c.Locals("client_certificates").([]*x509.Certificate)
+	return certs
+}
+
+// parseForwardedCertificates decodes a forwarded chain, leaf first. A chain
+// that does not parse is treated as absent.
+func parseForwardedCertificates(value string) []*x509.Certificate {
+	if value == "" {
+		return nil
+	}
+	data, err := url.QueryUnescape(value)
+	if err != nil {
+		return nil
+	}
+
+	var certs []*x509.Certificate
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tajious/heimdall/internal/awssig"
+)
+
+// DynamoDBConfig points DynamoDBStore at a table whose partition key is the
+// string attribute "key". Enabling TTL on the "expires_at" attribute lets
+// DynamoDB delete stale counters; until it does they are ignored.
+type DynamoDBConfig struct {
+	Table    string
+	Region   string
+	Endpoint string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// DynamoDBStore keeps rate limit counters in DynamoDB, talking to its JSON
+// API directly. Like RedisStore, every increment pushes the expiry of the
+// counter a full window out.
+type DynamoDBStore struct {
+	config   DynamoDBConfig
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewDynamoDBStore(config DynamoDBConfig, timeout time.Duration) (*DynamoDBStore, error) {
+	if config.Table == "" || config.Region == "" {
+		return nil, errors.New("dynamodb: table and region are required")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("dynamodb: AWS credentials are required")
+	}
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = "https://dynamodb." + config.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb: invalid endpoint: %w", err)
+	}
+	return &DynamoDBStore{
+		config:   config,
+		endpoint: u,
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+type dynamoValue struct {
+	S string `json:"S,omitempty"`
+	N string `json:"N,omitempty"`
+}
+
+type dynamoItem map[string]dynamoValue
+
+// Ping checks that the table exists and the credentials can reach it.
+func (s *DynamoDBStore) Ping(ctx context.Context) error {
+	return s.call(ctx, "DescribeTable", map[string]interface{}{"TableName": s.config.Table}, nil)
+}
+
+func (s *DynamoDBStore) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
+	// An expired counter DynamoDB has not deleted yet fails the condition
+	// and is replaced; losing that race to another instance sends us back
+	// to incrementing the fresh counter.
+	for attempt := 0; attempt < 3; attempt++ {
+		now := time.Now()
+		// TTL attributes hold whole seconds; rounding up never cuts a
+		// window short.
+		expires := strconv.FormatInt(now.Add(window+time.Second-1).Unix(), 10)
+
+		var out struct {
+			Attributes dynamoItem `json:"Attributes"`
+		}
+		err := s.call(ctx, "UpdateItem", map[string]interface{}{
+			"TableName":                s.config.Table,
+			"Key":                      dynamoItem{"key": {S: key}},
+			"UpdateExpression":         "SET #count = if_not_exists(#count, :zero) + :one, #expires = :expires",
+			"ConditionExpression":      "attribute_not_exists(#expires) OR #expires > :now",
+			"ExpressionAttributeNames": map[string]string{"#count": "count", "#expires": "expires_at"},
+			"ExpressionAttributeValues": dynamoItem{
+				":zero":    {N: "0"},
+				":one":     {N: "1"},
+				":expires": {N: expires},
+				":now":     {N: strconv.FormatInt(now.Unix(), 10)},
+			},
+			"ReturnValues": "UPDATED_NEW",
+		}, &out)
+		if err == nil {
+			return strconv.Atoi(out.Attributes["count"].N)
+		}
+		if !errors.Is(err, errConditionFailed) {
+			return 0, err
+		}
+
+		err = s.call(ctx, "PutItem", map[string]interface{}{
+			"TableName":                s.config.Table,
+			"Item":                     dynamoItem{"key": {S: key}, "count": {N: "1"}, "expires_at": {N: expires}},
+			"ConditionExpression":      "#expires <= :now",
+			"ExpressionAttributeNames": map[string]string{"#expires": "expires_at"},
+			"ExpressionAttributeValues": dynamoItem{
+				":now": {N: strconv.FormatInt(now.Unix(), 10)},
+			},
+		}, nil)
+		if err == nil {
+			return 1, nil
+		}
+		if !errors.Is(err, errConditionFailed) {
+			return 0, err
+		}
+	}
+	return 0, errors.New("dynamodb: counter kept changing underneath the increment")
+}
+
+func (s *DynamoDBStore) GetCount(ctx context.Context, key string) (int, error) {
+	var out struct {
+		Item dynamoItem `json:"Item"`
+	}
+	err := s.call(ctx, "GetItem", map[string]interface{}{
+		"TableName":      s.config.Table,
+		"Key":            dynamoItem{"key": {S: key}},
+		"ConsistentRead": true,
+	}, &out)
+	if err != nil {
+		return 0, err
+	}
+	if out.Item == nil {
+		return 0, nil
+	}
+	expires, _ := strconv.ParseInt(out.Item["expires_at"].N, 10, 64)
+	if expires <= time.Now().Unix() {
+		return 0, nil
+	}
+	return strconv.Atoi(out.Item["count"].N)
+}
+
+var errConditionFailed = errors.New("dynamodb: conditional check failed")
+
+func (s *DynamoDBStore) call(ctx context.Context, operation string, in interface{}, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+operation)
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("dynamodb: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("dynamodb: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &apiErr)
+		if strings.HasSuffix(apiErr.Type, "#ConditionalCheckFailedException") {
+			return errConditionFailed
+		}
+		return fmt.Errorf("dynamodb: %s failed with %d: %s %s", operation, resp.StatusCode, apiErr.Type, apiErr.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// sign adds an AWS Signature Version 4 to req.
+func (s *DynamoDBStore) sign(req *http.Request, body []byte, now time.Time) {
+	awssig.Sign(req, body, awssig.Credentials{
+		AccessKeyID:     s.config.AccessKeyID,
+		SecretAccessKey: s.config.SecretAccessKey,
+		SessionToken:    s.config.SessionToken,
+	}, s.config.Region, "dynamodb", now)
+}
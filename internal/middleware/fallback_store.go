@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/tajious/heimdall/internal/breaker"
+	"github.com/tajious/heimdall/internal/metrics"
+)
+
+// FallbackStore keeps rate limiting on while the shared counter store is
+// down: once its breaker opens, counters are kept in memory instead, per
+// instance, until a probe finds the store back. Limits are then enforced
+// per instance rather than across the cluster, which lets through up to one
+// limit per instance but never turns rate limiting off.
+type FallbackStore struct {
+	primary  RateLimitStore
+	local    *MemoryStore
+	breaker  *breaker.Breaker
+	fallback *metrics.CounterVec
+}
+
+func NewFallbackStore(primary RateLimitStore, b *breaker.Breaker, registry *metrics.Registry) *FallbackStore {
+	return &FallbackStore{
+		primary:  primary,
+		local:    NewMemoryStore(),
+		breaker:  b,
+		fallback: registry.Counter("heimdall_rate_limit_fallback_total", "Rate limit counter operations served from memory while the shared store is down.", "operation"),
+	}
+}
+
+func (s *FallbackStore) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
+	var count int
+	err := s.breaker.Do(func() (err error) {
+		count, err = s.primary.Increment(ctx, key, window)
+		return err
+	})
+	if err == nil {
+		return count, nil
+	}
+	s.fallback.WithLabels("increment").Inc()
+	return s.local.Increment(ctx, key, window)
+}
+
+func (s *FallbackStore) GetCount(ctx context.Context, key string) (int, error) {
+	var count int
+	err := s.breaker.Do(func() (err error) {
+		count, err = s.primary.GetCount(ctx, key)
+		return err
+	})
+	if err == nil {
+		return count, nil
+	}
+	s.fallback.WithLabels("get").Inc()
+	return s.local.GetCount(ctx, key)
+}
+
+// Purge drops the in-memory counters left over from an outage; the shared
+// store expires its own.
+func (s *FallbackStore) Purge(ctx context.Context, olderThan time.Time) (int64, error) {
+	return s.local.Purge(ctx, olderThan)
+}
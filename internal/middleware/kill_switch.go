@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/models"
+)
+
+// Kill switch names. Endpoint switches disable a route for every tenant;
+// auth method switches reject logins and registrations of tenants using
+// that method.
+const (
+	KillLogin             = "endpoint:login"
+	KillRegister          = "endpoint:register"
+	KillValidateToken     = "endpoint:validate_token"
+	KillAuthorize         = "endpoint:authorize"
+	KillAuthMethodPrefix  = "auth_method:"
+	KillUsernamePassword  = KillAuthMethodPrefix + string(models.UsernamePassword)
+	KillDelegated         = KillAuthMethodPrefix + string(models.Delegated)
+	KillClientCertificate = KillAuthMethodPrefix + string(models.ClientCertificate)
+)
+
+var killSwitchNames = []string{
+	KillLogin,
+	KillRegister,
+	KillValidateToken,
+	KillAuthorize,
+	KillUsernamePassword,
+	KillDelegated,
+	KillClientCertificate,
+}
+
+type KillSwitch struct {
+	Name      string    `json:"name"`
+	Reason    string    `json:"reason"`
+	EngagedAt time.Time `json:"engaged_at"`
+}
+
+// KillSwitches holds the operator-controlled switches of this instance.
+type KillSwitches struct {
+	mu       sync.RWMutex
+	switches map[string]KillSwitch
+}
+
+func NewKillSwitches() *KillSwitches {
+	return &KillSwitches{
+		switches: make(map[string]KillSwitch),
+	}
+}
+
+func IsKnownKillSwitch(name string) bool {
+	for _, known := range killSwitchNames {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseKillSwitches parses a semicolon separated list of name=reason pairs,
+// e.g. "auth_method:delegated=IdP compromised;endpoint:register". The reason
+// is optional.
+func ParseKillSwitches(value string) ([]KillSwitch, error) {
+	var switches []KillSwitch
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, reason, _ := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !IsKnownKillSwitch(name) {
+			return nil, fmt.Errorf("unknown kill switch %q", name)
+		}
+		switches = append(switches, KillSwitch{
+			Name:   name,
+			Reason: strings.TrimSpace(reason),
+		})
+	}
+	return switches, nil
+}
+
+func (k *KillSwitches) Engage(name, reason string) (KillSwitch, error) {
+	if !IsKnownKillSwitch(name) {
+		return KillSwitch{}, fmt.Errorf("unknown kill switch %q", name)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	sw := KillSwitch{
+		Name:      name,
+		Reason:    reason,
+		EngagedAt: time.Now(),
+	}
+	k.switches[name] = sw
+	return sw, nil
+}
+
+// Release turns a switch off again, reporting whether it was engaged.
+func (k *KillSwitches) Release(name string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	_, ok := k.switches[name]
+	delete(k.switches, name)
+	return ok
+}
+
+func (k *KillSwitches) List() []KillSwitch {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	switches := make([]KillSwitch, 0, len(k.switches))
+	for _, sw := range k.switches {
+		switches = append(switches, sw)
+	}
+	sort.Slice(switches, func(i, j int) bool {
+		return switches[i].Name < switches[j].Name
+	})
+	return switches
+}
+
+func (k *KillSwitches) engaged(name string) (KillSwitch, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	sw, ok := k.switches[name]
+	return sw, ok
+}
+
+// Guard rejects requests while the named switch is engaged.
+func (k *KillSwitches) Guard(name string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if sw, ok := k.engaged(name); ok {
+			return killed(c, sw)
+		}
+		return c.Next()
+	}
+}
+
+// GuardAuthMethod rejects requests while the switch for the resolved
+// tenant's auth method is engaged.
+func (k *KillSwitches) GuardAuthMethod() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if tenant := TenantFromContext(c); tenant != nil {
+			if sw, ok := k.engaged(KillAuthMethodPrefix + string(tenant.Config.AuthMethod)); ok {
+				return killed(c, sw)
+			}
+		}
+		return c.Next()
+	}
+}
+
+func killed(c *fiber.Ctx, sw KillSwitch) error {
+	reason := sw.Reason
+	if reason == "" {
+		reason = "Disabled by the operator"
+	}
+	return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+		"error":       "Temporarily disabled",
+		"kill_switch": sw.Name,
+		"reason":      reason,
+	})
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/metrics"
+)
+
+// LoginLatency times logins stage by stage, reporting p50/p95/p99 per stage
+// and logging the breakdown of any login slower than the threshold.
+type LoginLatency struct {
+	slowThreshold time.Duration
+
+	stages *metrics.SummaryVec
+	total  *metrics.Summary
+}
+
+// NewLoginLatency logs logins taking slowThreshold or longer; zero turns
+// the log off but keeps the metrics.
+func NewLoginLatency(slowThreshold time.Duration, registry *metrics.Registry) *LoginLatency {
+	return &LoginLatency{
+		slowThreshold: slowThreshold,
+		stages:        registry.Summary("heimdall_login_stage_seconds", "Time logins spend in each stage.", "stage"),
+		total:         registry.Summary("heimdall_login_duration_seconds", "Time from the start of a login to its response.").WithLabels(),
+	}
+}
+
+// Track goes in front of the login handler and the middleware whose time
+// counts towards the login.
+func (l *LoginLatency) Track() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		timeline := metrics.StartTimeline(c)
+
+		err := c.Next()
+
+		total := time.Since(start)
+		stages := timeline.Stages()
+		l.total.Observe(total.Seconds())
+		for _, stage := range stages {
+			l.stages.WithLabels(stage.Name).Observe(stage.Duration.Seconds())
+		}
+		if l.slowThreshold > 0 && total >= l.slowThreshold {
+			l.logSlow(c, err, total, stages)
+		}
+		return err
+	}
+}
+
+// logSlow writes the breakdown as one JSON object, so log pipelines can
+// index the stages. Time outside every stage is reported as "other".
+func (l *LoginLatency) logSlow(c *fiber.Ctx, err error, total time.Duration, stages []metrics.Stage) {
+	status := c.Response().StatusCode()
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		status = fiberErr.Code
+	} else if err != nil {
+		status = fiber.StatusInternalServerError
+	}
+
+	breakdown := make(map[string]float64, len(stages)+1)
+	other := total
+	for _, stage := range stages {
+		breakdown[stage.Name] = milliseconds(stage.Duration)
+		other -= stage.Duration
+	}
+	breakdown["other"] = milliseconds(other)
+
+	entry := map[string]interface{}{
+		"path":      c.Path(),
+		"status":    status,
+		"total_ms":  milliseconds(total),
+		"stages_ms": breakdown,
+	}
+	if tenant := TenantFromContext(c); tenant != nil {
+		entry["tenant_id"] = tenant.ID
+	}
+	data, _ := json.Marshal(entry)
+	log.Printf("Slow login: %s", data)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,208 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memcachedMaxRelative is the longest expiry memcached takes as a relative
+// number of seconds; larger values are read as a Unix timestamp.
+const memcachedMaxRelative = 30 * 24 * time.Hour
+
+const memcachedPoolSize = 16
+
+// MemcachedStore keeps rate limit counters in memcached over its text
+// protocol. Like RedisStore, every increment pushes the expiry of the
+// counter a full window out.
+type MemcachedStore struct {
+	addr    string
+	timeout time.Duration
+	pool    chan *memcachedConn
+}
+
+type memcachedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func NewMemcachedStore(addr string, timeout time.Duration) *MemcachedStore {
+	return &MemcachedStore{
+		addr:    addr,
+		timeout: timeout,
+		pool:    make(chan *memcachedConn, memcachedPoolSize),
+	}
+}
+
+// Ping checks that memcached answers.
+func (s *MemcachedStore) Ping(ctx context.Context) error {
+	_, err := s.roundTrip(ctx, "version\r\n")
+	return err
+}
+
+func (s *MemcachedStore) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
+	key = memcachedKey(key)
+	expiry := memcachedExpiry(window)
+
+	// A failed add means another instance created the counter between our
+	// incr and add, so the second incr finds it.
+	for attempt := 0; attempt < 2; attempt++ {
+		reply, err := s.roundTrip(ctx, fmt.Sprintf("incr %s 1\r\n", key))
+		if err != nil {
+			return 0, err
+		}
+		if reply != "NOT_FOUND" {
+			count, err := strconv.Atoi(reply)
+			if err != nil {
+				return 0, fmt.Errorf("memcached: unexpected reply to incr: %q", reply)
+			}
+			if _, err := s.roundTrip(ctx, fmt.Sprintf("touch %s %d\r\n", key, expiry)); err != nil {
+				return 0, err
+			}
+			return count, nil
+		}
+
+		reply, err = s.roundTrip(ctx, fmt.Sprintf("add %s 0 %d 1\r\n1\r\n", key, expiry))
+		if err != nil {
+			return 0, err
+		}
+		if reply == "STORED" {
+			return 1, nil
+		}
+	}
+	return 0, errors.New("memcached: counter could not be created")
+}
+
+func (s *MemcachedStore) GetCount(ctx context.Context, key string) (int, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := func() (int, error) {
+		if _, err := fmt.Fprintf(conn, "get %s\r\n", memcachedKey(key)); err != nil {
+			return 0, err
+		}
+		line, err := readMemcachedLine(conn.r)
+		if err != nil {
+			return 0, err
+		}
+		if line == "END" {
+			return 0, nil
+		}
+		// VALUE <key> <flags> <bytes>
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[0] != "VALUE" {
+			return 0, fmt.Errorf("memcached: unexpected reply to get: %q", line)
+		}
+		value, err := readMemcachedLine(conn.r)
+		if err != nil {
+			return 0, err
+		}
+		if end, err := readMemcachedLine(conn.r); err != nil || end != "END" {
+			return 0, fmt.Errorf("memcached: unterminated reply to get")
+		}
+		return strconv.Atoi(strings.TrimSpace(value))
+	}()
+	s.release(conn, err)
+	return count, err
+}
+
+// roundTrip sends a command and returns its one-line reply. Replies that
+// signal a protocol or server error are returned as errors.
+func (s *MemcachedStore) roundTrip(ctx context.Context, command string) (string, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	reply, err := func() (string, error) {
+		if _, err := conn.Write([]byte(command)); err != nil {
+			return "", err
+		}
+		return readMemcachedLine(conn.r)
+	}()
+	if err == nil && (reply == "ERROR" || strings.HasPrefix(reply, "CLIENT_ERROR") || strings.HasPrefix(reply, "SERVER_ERROR")) {
+		err = fmt.Errorf("memcached: %s", reply)
+	}
+	s.release(conn, err)
+	return reply, err
+}
+
+func (s *MemcachedStore) conn(ctx context.Context) (*memcachedConn, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(s.timeout)
+	}
+
+	var conn *memcachedConn
+	select {
+	case conn = <-s.pool:
+	default:
+		dialer := net.Dialer{Deadline: deadline}
+		c, err := dialer.DialContext(ctx, "tcp", s.addr)
+		if err != nil {
+			return nil, fmt.Errorf("memcached: %w", err)
+		}
+		conn = &memcachedConn{Conn: c, r: bufio.NewReader(c)}
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// release returns a healthy connection to the pool. A connection that saw
+// an error may hold half a reply, so it is closed instead.
+func (s *MemcachedStore) release(conn *memcachedConn, err error) {
+	if err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case s.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func readMemcachedLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("memcached: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// memcachedKey hashes keys memcached would refuse: longer than 250 bytes or
+// holding whitespace or control characters.
+func memcachedKey(key string) string {
+	valid := len(key) <= 250
+	for i := 0; valid && i < len(key); i++ {
+		valid = key[i] > ' ' && key[i] != 0x7f
+	}
+	if valid {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "rate_limit:sha256:" + hex.EncodeToString(sum[:])
+}
+
+func memcachedExpiry(window time.Duration) int64 {
+	if window > memcachedMaxRelative {
+		return time.Now().Add(window).Unix()
+	}
+	seconds := int64((window + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
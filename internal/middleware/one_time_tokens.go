@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+var (
+	ErrTokenConsumed      = errors.New("token has already been used")
+	ErrTokenNotReplayable = errors.New("one-time token has no jti or expiry")
+)
+
+// ConsumedTokenStore remembers the jti of every one-time token validated
+// until the token expires.
+type ConsumedTokenStore interface {
+	// Consume marks jti consumed and reports whether it was not already.
+	Consume(ctx context.Context, jti string, expiresAt time.Time) (bool, error)
+}
+
+// RedisConsumedTokens shares consumed tokens between instances, so a token
+// cannot be replayed against another one.
+type RedisConsumedTokens struct {
+	client *redis.Client
+}
+
+func NewRedisConsumedTokens(client *redis.Client) *RedisConsumedTokens {
+	return &RedisConsumedTokens{client: client}
+}
+
+func (s *RedisConsumedTokens) Consume(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	return s.client.SetNX(ctx, "heimdall:jti:"+jti, 1, consumedTTL(expiresAt)).Result()
+}
+
+// MemoryConsumedTokens keeps consumed tokens on the instance until the
+// retention run purges them once their tokens expired.
+type MemoryConsumedTokens struct {
+	mu       sync.Mutex
+	consumed map[string]time.Time
+}
+
+func NewMemoryConsumedTokens() *MemoryConsumedTokens {
+	return &MemoryConsumedTokens{
+		consumed: make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryConsumedTokens) Consume(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if expiry, ok := s.consumed[jti]; ok && time.Now().Before(expiry) {
+		return false, nil
+	}
+	s.consumed[jti] = time.Now().Add(consumedTTL(expiresAt))
+	return true, nil
+}
+
+// Purge forgets the tokens that expired before olderThan.
+func (s *MemoryConsumedTokens) Purge(ctx context.Context, olderThan time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged int64
+	for jti, expiry := range s.consumed {
+		if expiry.Before(olderThan) {
+			delete(s.consumed, jti)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// consumedTTL keeps a jti for as long as its token would validate, and a
+// second longer so that clock drift cannot reopen it.
+func consumedTTL(expiresAt time.Time) time.Duration {
+	return time.Until(expiresAt) + time.Second
+}
+
+// OneTimeTokens refuses a second validation of the token types a tenant
+// marks one-time. Access tokens pass through without a lookup.
+type OneTimeTokens struct {
+	storage storage.Storage
+	store   ConsumedTokenStore
+}
+
+func NewOneTimeTokens(storage storage.Storage, store ConsumedTokenStore) *OneTimeTokens {
+	return &OneTimeTokens{
+		storage: storage,
+		store:   store,
+	}
+}
+
+// Check consumes claims if its tenant treats its type as one-time, failing
+// with ErrTokenConsumed if it was consumed before.
+func (o *OneTimeTokens) Check(ctx context.Context, claims *models.Claims) error {
+	if claims.Type == models.TokenAccess {
+		return nil
+	}
+
+	tenant, err := o.storage.GetTenant(storage.WithTenant(ctx, claims.TenantID), claims.TenantID)
+	if err != nil {
+		return err
+	}
+	if !tenant.Config.IsOneTime(claims.Type) {
+		return nil
+	}
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return ErrTokenNotReplayable
+	}
+
+	fresh, err := o.store.Consume(ctx, claims.TenantID+":"+claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrTokenConsumed
+	}
+	return nil
+}
+
+// Reject answers a request whose token failed Check.
+func (o *OneTimeTokens) Reject(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, ErrTokenConsumed):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Token has already been used",
+		})
+	case errors.Is(err, ErrTokenNotReplayable), errors.Is(err, storage.ErrTenantNotFound):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid token",
+		})
+	default:
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Token reuse cannot be checked right now",
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"time"
+)
+
+// maxSimulatedRequests bounds the work of one simulation.
+const maxSimulatedRequests = 1000000
+
+// SimulatedLimit is a limit to replay requests against. Count is what its
+// counter already holds when the simulation starts.
+type SimulatedLimit struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+	Count  int
+}
+
+type LimitOutcome struct {
+	Name           string   `json:"name"`
+	Limit          int      `json:"limit"`
+	WindowSeconds  float64  `json:"window_seconds"`
+	Counted        int      `json:"counted"`
+	Refused        int      `json:"refused"`
+	FirstRefusalAt *float64 `json:"first_refusal_seconds,omitempty"`
+}
+
+type SimulationResult struct {
+	Rate            float64        `json:"rate"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Requests        int            `json:"requests"`
+	Accepted        int            `json:"accepted"`
+	Refused         int            `json:"refused"`
+	Trips           bool           `json:"trips"`
+	FirstRefusalAt  *float64       `json:"first_refusal_seconds,omitempty"`
+	Limits          []LimitOutcome `json:"limits"`
+	// Penalty is set when the IP would be penalized as abusive, from
+	// PenalizedAt seconds in; Penalized counts the requests refused or
+	// held meanwhile.
+	Penalty     PenaltyMode `json:"penalty,omitempty"`
+	PenalizedAt *float64    `json:"penalized_seconds,omitempty"`
+	Penalized   int         `json:"penalized,omitempty"`
+}
+
+// SimulationTooLarge reports whether rate over duration asks for more
+// requests than one simulation replays.
+func SimulationTooLarge(rate float64, duration time.Duration) bool {
+	return rate*duration.Seconds() > maxSimulatedRequests
+}
+
+// Simulate replays requests arriving at a steady rate for duration against
+// limits, checked in order, counting the way the rate limiter does: a
+// refused request is not counted, and every counted one pushes its
+// counter's expiry a full window out. Refusals by the limit named ipLimit
+// are strikes towards the abuse penalty; penalized says whether the IP is
+// already penalized. Nothing is written to the store.
+func (r *RateLimiter) Simulate(rate float64, duration time.Duration, limits []SimulatedLimit, ipLimit string, penalized bool) *SimulationResult {
+	result := &SimulationResult{
+		Rate:            rate,
+		DurationSeconds: duration.Seconds(),
+		Limits:          make([]LimitOutcome, len(limits)),
+	}
+	expires := make([]time.Duration, len(limits))
+	counts := make([]int, len(limits))
+	for i, limit := range limits {
+		result.Limits[i] = LimitOutcome{
+			Name:          limit.Name,
+			Limit:         limit.Limit,
+			WindowSeconds: limit.Window.Seconds(),
+		}
+		// A live counter's expiry is not known; assume a full window.
+		counts[i] = limit.Count
+		expires[i] = limit.Window
+	}
+
+	var strikes int
+	var strikesExpire, penaltyEnds time.Duration
+	if penalized && r.abuse.Mode != PenaltyOff {
+		result.Penalty = r.abuse.Mode
+		result.PenalizedAt = seconds(0)
+		penaltyEnds = r.abuse.TTL
+	}
+
+	interval := time.Duration(float64(time.Second) / rate)
+	for now := time.Duration(0); now < duration; now += interval {
+		result.Requests++
+		refused := false
+		for i, limit := range limits {
+			// The penalty is checked where the IP limit is, after the
+			// limits before it counted the request.
+			if limit.Name == ipLimit && now < penaltyEnds {
+				result.Penalized++
+				if r.abuse.Mode == PenaltyBlock {
+					refused = true
+					break
+				}
+			}
+			if now >= expires[i] {
+				counts[i] = 0
+			}
+			if counts[i] >= limit.Limit {
+				outcome := &result.Limits[i]
+				outcome.Refused++
+				if outcome.FirstRefusalAt == nil {
+					outcome.FirstRefusalAt = seconds(now)
+				}
+				if limit.Name == ipLimit {
+					r.simulateStrike(result, now, &strikes, &strikesExpire, &penaltyEnds)
+				}
+				refused = true
+				break
+			}
+			counts[i]++
+			expires[i] = now + limit.Window
+			result.Limits[i].Counted++
+		}
+		if refused {
+			result.refuse(now)
+			continue
+		}
+		result.Accepted++
+	}
+	return result
+}
+
+// simulateStrike counts a refusal by the IP limit the way strike does.
+func (r *RateLimiter) simulateStrike(result *SimulationResult, now time.Duration, strikes *int, strikesExpire, penaltyEnds *time.Duration) {
+	if r.abuse.Mode == PenaltyOff {
+		return
+	}
+	if now >= *strikesExpire {
+		*strikes = 0
+	}
+	*strikes++
+	*strikesExpire = now + r.abuse.StrikeWindow
+	if *strikes != r.abuse.Strikes {
+		return
+	}
+	*penaltyEnds = now + r.abuse.TTL
+	if result.PenalizedAt == nil {
+		result.Penalty = r.abuse.Mode
+		result.PenalizedAt = seconds(now)
+	}
+}
+
+func (s *SimulationResult) refuse(at time.Duration) {
+	s.Refused++
+	s.Trips = true
+	if s.FirstRefusalAt == nil {
+		s.FirstRefusalAt = seconds(at)
+	}
+}
+
+func seconds(d time.Duration) *float64 {
+	s := d.Seconds()
+	return &s
+}
+
+// Enabled reports whether rate limits are enforced at all.
+func (r *RateLimiter) Enabled() bool {
+	return r.enabled
+}
@@ -3,6 +3,7 @@ package middleware
 import (
 	"context"
 	"fmt"
+	"log"
 	"sync"
 	"time"
 
@@ -75,14 +76,13 @@ func (s *MemoryStore) Increment(ctx context.Context, key string, window time.Dur
 
 	entry, exists := s.store[key]
 	if !exists {
-		entry = &RateLimitEntry{
-			Count:     0,
-			ExpiresAt: now.Add(window),
-		}
+		entry = &RateLimitEntry{}
 		s.store[key] = entry
 	}
 
+	// Like Redis, every hit pushes the expiry a full window out.
 	entry.Count++
+	entry.ExpiresAt = now.Add(window)
 	return entry.Count, nil
 }
 
@@ -102,9 +102,33 @@ func (s *MemoryStore) GetCount(ctx context.Context, key string) (int, error) {
 	return entry.Count, nil
 }
 
+func (s *MemoryStore) Purge(ctx context.Context, olderThan time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged int64
+	for k, entry := range s.store {
+		if entry.ExpiresAt.Before(olderThan) {
+			delete(s.store, k)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// Len reports how many counters are held in memory.
+func (s *MemoryStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.store)
+}
+
 type RateLimiter struct {
 	store   RateLimitStore
 	enabled bool
+	abuse   AbusePenaltyConfig
 }
 
 type RateLimitConfig struct {
@@ -113,19 +137,50 @@ type RateLimitConfig struct {
 	Window  time.Duration
 }
 
-func NewRateLimiter(store RateLimitStore, enabled bool) *RateLimiter {
+type PenaltyMode string
+
+const (
+	PenaltyOff    PenaltyMode = "off"
+	PenaltyTarpit PenaltyMode = "tarpit"
+	PenaltyBlock  PenaltyMode = "block"
+)
+
+func ParsePenaltyMode(s string) (PenaltyMode, error) {
+	switch mode := PenaltyMode(s); mode {
+	case "", PenaltyOff:
+		return PenaltyOff, nil
+	case PenaltyTarpit, PenaltyBlock:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown penalty mode %q", s)
+}
+
+// AbusePenaltyConfig marks an IP as abusive once it has been refused by a
+// rate limit Strikes times within StrikeWindow. For the next TTL its requests
+// are either held for TarpitDelay before being served or refused outright.
+type AbusePenaltyConfig struct {
+	Mode         PenaltyMode
+	Strikes      int
+	StrikeWindow time.Duration
+	TTL          time.Duration
+	TarpitDelay  time.Duration
+}
+
+func NewRateLimiter(store RateLimitStore, enabled bool, abuse AbusePenaltyConfig) *RateLimiter {
 	return &RateLimiter{
 		store:   store,
 		enabled: enabled,
+		abuse:   abuse,
 	}
 }
 
+// RateLimit limits requests per IP and per user to config, or to the limits
+// of the request's environment when it has one.
 func (r *RateLimiter) RateLimit(config RateLimitConfig) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		if !r.enabled || !config.Enabled {
 			return c.Next()
 		}
-
 		ip := c.IP()
 		if ip == "" {
 			ip = c.Context().RemoteIP().String()
@@ -136,19 +191,35 @@ func (r *RateLimiter) RateLimit(config RateLimitConfig) fiber.Handler {
 			userID = claims.UserID
 		}
 
-		ipKey := fmt.Sprintf("rate_limit:ip:%s", ip)
-		userKey := fmt.Sprintf("rate_limit:user:%s", userID)
+		ipConfig, userConfig := config, config
+		ipKey, userKey := RateLimitIPKey(ip), RateLimitUserKey(userID)
+		if env := EnvironmentFromContext(c); env != nil {
+			ipConfig, userConfig = EnvironmentRateLimits(env)
+			ipKey, userKey = EnvironmentRateLimitIPKey(env, ip), EnvironmentRateLimitUserKey(env, userID)
+		}
+
+		switch penalty, _ := r.Penalty(c.Context(), ip); penalty {
+		case PenaltyBlock:
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Requests from this IP are blocked",
+			})
+		case PenaltyTarpit:
+			time.Sleep(r.abuse.TarpitDelay)
+		}
 
-		if err := r.checkRateLimit(c.Context(), ipKey, config); err != nil {
+		if err := r.checkRateLimit(c.Context(), ipKey, ipConfig); err != nil {
+			r.strike(c.Context(), ip)
 			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
 				"error": "Too many requests from this IP",
+				"code":  "ip_rate_limited",
 			})
 		}
 
 		if userID != "" {
-			if err := r.checkRateLimit(c.Context(), userKey, config); err != nil {
+			if err := r.checkRateLimit(c.Context(), userKey, userConfig); err != nil {
 				return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
 					"error": "Too many requests from this user",
+					"code":  "user_rate_limited",
 				})
 			}
 		}
@@ -157,6 +228,100 @@ func (r *RateLimiter) RateLimit(config RateLimitConfig) fiber.Handler {
 	}
 }
 
+// TenantQuota enforces the resolved tenant's API quota, counted per minute
+// across every endpoint and kept apart from the login protection limits.
+// Tenants without a quota are not counted.
+func (r *RateLimiter) TenantQuota() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenant := TenantFromContext(c)
+		if !r.enabled || tenant == nil || tenant.Config.APIQuota <= 0 {
+			return c.Next()
+		}
+
+		err := r.checkRateLimit(c.Context(), TenantQuotaKey(tenant.ID), RateLimitConfig{
+			Limit:  tenant.Config.APIQuota,
+			Window: time.Minute,
+		})
+		if err != nil {
+			c.Set(fiber.HeaderRetryAfter, "60")
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": "Tenant API quota exceeded",
+				"code":  "tenant_quota_exceeded",
+			})
+		}
+
+		return c.Next()
+	}
+}
+
+// EnvironmentRateLimits returns the per-IP and per-user limits of env.
+func EnvironmentRateLimits(env *models.Environment) (ip, user RateLimitConfig) {
+	window := time.Duration(env.RateLimitWindow) * time.Second
+	ip = RateLimitConfig{Enabled: true, Limit: env.RateLimitIP, Window: window}
+	user = RateLimitConfig{Enabled: true, Limit: env.RateLimitUser, Window: window}
+	return ip, user
+}
+
+func RateLimitIPKey(ip string) string {
+	return fmt.Sprintf("rate_limit:ip:%s", ip)
+}
+
+func RateLimitUserKey(userID string) string {
+	return fmt.Sprintf("rate_limit:user:%s", userID)
+}
+
+// EnvironmentRateLimitIPKey and EnvironmentRateLimitUserKey count the
+// requests to env apart from those to the tenant's other environments, so
+// that each environment's limits are independent.
+func EnvironmentRateLimitIPKey(env *models.Environment, ip string) string {
+	return fmt.Sprintf("rate_limit:env:%s:%s:ip:%s", env.TenantID, env.ID, ip)
+}
+
+func EnvironmentRateLimitUserKey(env *models.Environment, userID string) string {
+	return fmt.Sprintf("rate_limit:env:%s:%s:user:%s", env.TenantID, env.ID, userID)
+}
+
+func TenantQuotaKey(tenantID string) string {
+	return fmt.Sprintf("quota:tenant:%s", tenantID)
+}
+
+func RateLimitStrikeKey(ip string) string {
+	return fmt.Sprintf("rate_limit:strikes:%s", ip)
+}
+
+func RateLimitPenaltyKey(ip string) string {
+	return fmt.Sprintf("rate_limit:penalty:%s", ip)
+}
+
+// Penalty reports the penalty currently applied to ip, PenaltyOff if none.
+func (r *RateLimiter) Penalty(ctx context.Context, ip string) (PenaltyMode, error) {
+	if r.abuse.Mode == PenaltyOff {
+		return PenaltyOff, nil
+	}
+	count, err := r.store.GetCount(ctx, RateLimitPenaltyKey(ip))
+	if err != nil || count == 0 {
+		return PenaltyOff, err
+	}
+	return r.abuse.Mode, nil
+}
+
+// strike records a refused request and penalizes ip when it reaches the
+// configured number of strikes.
+func (r *RateLimiter) strike(ctx context.Context, ip string) {
+	if r.abuse.Mode == PenaltyOff {
+		return
+	}
+	strikes, err := r.store.Increment(ctx, RateLimitStrikeKey(ip), r.abuse.StrikeWindow)
+	if err != nil || strikes != r.abuse.Strikes {
+		return
+	}
+	if _, err := r.store.Increment(ctx, RateLimitPenaltyKey(ip), r.abuse.TTL); err != nil {
+		log.Printf("Failed to penalize abusive IP %s: %v", ip, err)
+		return
+	}
+	log.Printf("IP %s penalized (%s) for %s after %d refused requests", ip, r.abuse.Mode, r.abuse.TTL, strikes)
+}
+
 func (r *RateLimiter) checkRateLimit(ctx context.Context, key string, config RateLimitConfig) error {
 	count, err := r.store.GetCount(ctx, key)
 	if err != nil {
@@ -0,0 +1,26 @@
+package middleware_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tajious/heimdall/internal/middleware"
+)
+
+func BenchmarkRateLimitCheck(b *testing.B) {
+	store := middleware.NewMemoryStore()
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("rate_limit:ip:10.0.%d.%d", (i/256)%256, i%256)
+		if _, err := store.GetCount(ctx, key); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := store.Increment(ctx, key, time.Minute); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
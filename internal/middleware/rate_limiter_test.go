@@ -0,0 +1,72 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/pkg/heimdalltest"
+)
+
+func TestMemoryStoreConformance(t *testing.T) {
+	heimdalltest.RunRateLimitStoreSuite(t, func(t *testing.T) heimdalltest.RateLimitStore {
+		return middleware.NewMemoryStore()
+	})
+}
+
+// TestRedisStoreConformance runs against the Redis at
+// HEIMDALL_TEST_REDIS_ADDR, such as one started with
+// `docker run --rm -p 6379:6379 redis:7`, and is skipped without it.
+func TestRedisStoreConformance(t *testing.T) {
+	addr := os.Getenv("HEIMDALL_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("HEIMDALL_TEST_REDIS_ADDR is not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Fatalf("connect to Redis at %s: %v", addr, err)
+	}
+
+	heimdalltest.RunRateLimitStoreSuite(t, func(t *testing.T) heimdalltest.RateLimitStore {
+		return middleware.NewRedisStore(client)
+	})
+}
+
+func TestEnvironmentRateLimitsAreIndependent(t *testing.T) {
+	envs := map[string]*models.Environment{
+		"dev":  {ID: "dev", TenantID: "acme", Name: "dev", RateLimitIP: 1, RateLimitUser: 1, RateLimitWindow: 60},
+		"prod": {ID: "prod", TenantID: "acme", Name: "prod", RateLimitIP: 1, RateLimitUser: 1, RateLimitWindow: 60},
+	}
+	limiter := middleware.NewRateLimiter(middleware.NewMemoryStore(), true, middleware.AbusePenaltyConfig{})
+	app := fiber.New()
+	app.Post("/:environment/login", func(c *fiber.Ctx) error {
+		c.Locals("environment", envs[c.Params("environment")])
+		return c.Next()
+	}, limiter.RateLimit(middleware.RateLimitConfig{Enabled: true, Limit: 100, Window: time.Minute}), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	login := func(env string) int {
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodPost, "/"+env+"/login", nil))
+		if err != nil {
+			t.Fatalf("login to %s: %v", env, err)
+		}
+		return resp.StatusCode
+	}
+	if status := login("dev"); status != fiber.StatusOK {
+		t.Fatalf("first dev login = %d, want 200", status)
+	}
+	if status := login("dev"); status != fiber.StatusTooManyRequests {
+		t.Fatalf("second dev login = %d, want 429", status)
+	}
+	if status := login("prod"); status != fiber.StatusOK {
+		t.Fatalf("prod login = %d, want 200: dev traffic used up its limit", status)
+	}
+}
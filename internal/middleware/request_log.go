@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/tajious/heimdall/internal/redact"
+)
+
+// RequestLogger logs every request. With debug the request body is logged
+// too, once redactor has dropped what must never reach the logs, so no
+// handler has to care.
+func RequestLogger(debug bool, redactor *redact.Redactor) fiber.Handler {
+	if !debug {
+		return logger.New()
+	}
+	return logger.New(logger.Config{
+		Format: "${time} | ${status} | ${latency} | ${ip} | ${method} | ${path} | ${error} | ${body}\n",
+		CustomTags: map[string]logger.LogFunc{
+			logger.TagBody: func(output logger.Buffer, c *fiber.Ctx, _ *logger.Data, _ string) (int, error) {
+				return output.WriteString(redactor.Body(c.Method(), c.Route().Path, c.Get(fiber.HeaderContentType), c.Body()))
+			},
+		},
+	})
+}
@@ -0,0 +1,220 @@
+package middleware
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/domains"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/metrics"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+type TenantResolver struct {
+	storage    storage.Storage
+	baseDomain string
+}
+
+func NewTenantResolver(storage storage.Storage, baseDomain string) *TenantResolver {
+	return &TenantResolver{
+		storage:    storage,
+		baseDomain: strings.TrimPrefix(baseDomain, "."),
+	}
+}
+
+func (r *TenantResolver) Resolve() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		var env *models.Environment
+
+		tenantID := c.Params("tenant_id")
+		if tenantID == "" {
+			tenantID = r.tenantFromHost(c.Hostname())
+		}
+
+		if apiKey := c.Get("X-API-Key"); apiKey != "" {
+			found, err := r.storage.GetEnvironmentByAPIKeyHash(c.Context(), keys.HashAPIKey(apiKey))
+			if err != nil || (tenantID != "" && found.TenantID != tenantID) {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "Invalid API key",
+				})
+			}
+			env = found
+			tenantID = found.TenantID
+		}
+
+		if tenantID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Tenant ID is required",
+			})
+		}
+
+		return r.enter(c, start, tenantID, env)
+	}
+}
+
+// ResolveByEmail routes requests that name no tenant to the tenant that
+// verified the domain of the email address in the JSON body.
+func (r *TenantResolver) ResolveByEmail() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		var body struct {
+			Email string `json:"email"`
+		}
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+
+		domain := domains.FromEmail(body.Email)
+		if domain == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Email is required",
+			})
+		}
+
+		claim, err := r.storage.FindVerifiedDomain(c.Context(), domain)
+		if err != nil {
+			if err == storage.ErrDomainClaimNotFound {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "No tenant has claimed this email domain",
+				})
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to fetch domain claim",
+			})
+		}
+
+		return r.enter(c, start, claim.TenantID, nil)
+	}
+}
+
+// enter loads the tenant and environment of the request into its locals and
+// continues, unless the tenant cannot take requests. The time since start
+// counts as loading the tenant.
+func (r *TenantResolver) enter(c *fiber.Ctx, start time.Time, tenantID string, env *models.Environment) error {
+	tenant, err := r.storage.GetTenant(storage.WithTenant(c.Context(), tenantID), tenantID)
+	if err != nil {
+		if err == storage.ErrTenantNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Tenant not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch tenant",
+		})
+	}
+
+	if tenant.IsSuspended() {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Tenant is suspended",
+		})
+	}
+
+	// Storage calls made with the request context are now scoped to the
+	// tenant, which row level security enforces.
+	c.Locals(storage.TenantScopeKey{}, tenant.ID)
+
+	if name := c.Params("environment"); name != "" && env == nil {
+		env, err = r.storage.GetEnvironmentByName(c.Context(), tenant.ID, name)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Environment not found",
+			})
+		}
+	}
+
+	c.Locals("tenant", tenant)
+	if env != nil {
+		c.Locals("environment", env)
+	}
+	metrics.TimelineFrom(c.Context()).Observe(metrics.StageTenantLoad, start)
+
+	return c.Next()
+}
+
+func (r *TenantResolver) RequireMember() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims, ok := c.Locals("user").(*models.Claims)
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "User not found in context",
+			})
+		}
+
+		tenant := TenantFromContext(c)
+		if tenant == nil || claims.TenantID != tenant.ID {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Access denied to this tenant",
+			})
+		}
+
+		return c.Next()
+	}
+}
+
+// RequireTenantAccount refuses the users of environment pools. A pool is
+// isolated to its environment, so its users, admins included, cannot manage
+// the tenant as a whole: its config, its other pools, or its keys.
+func RequireTenantAccount() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims, ok := c.Locals("user").(*models.Claims)
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "User not found in context",
+			})
+		}
+		if claims.EnvironmentID != "" {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Environment accounts cannot manage the tenant",
+			})
+		}
+		return c.Next()
+	}
+}
+
+func (r *TenantResolver) tenantFromHost(host string) string {
+	if r.baseDomain == "" {
+		return ""
+	}
+
+	suffix := "." + r.baseDomain
+	if !strings.HasSuffix(host, suffix) {
+		return ""
+	}
+
+	return strings.TrimSuffix(host, suffix)
+}
+
+func TenantFromContext(c *fiber.Ctx) *models.Tenant {
+	tenant, _ := c.Locals("tenant").(*models.Tenant)
+	return tenant
+}
+
+// FeatureEnabled reports whether the feature is enabled for the request's
+// tenant.
+func FeatureEnabled(c *fiber.Ctx, feature models.Feature) bool {
+	tenant := TenantFromContext(c)
+	return tenant != nil && tenant.Config.FeatureEnabled(feature)
+}
+
+// RequireFeature hides a route from tenants that do not have the feature
+// enabled.
+func RequireFeature(feature models.Feature) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !FeatureEnabled(c, feature) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Feature not enabled for tenant",
+			})
+		}
+		return c.Next()
+	}
+}
+
+func EnvironmentFromContext(c *fiber.Ctx) *models.Environment {
+	env, _ := c.Locals("environment").(*models.Environment)
+	return env
+}
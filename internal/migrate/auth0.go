@@ -0,0 +1,174 @@
+package migrate
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/tajious/heimdall/internal/passwords"
+)
+
+// auth0User is a line of an Auth0 bulk user export, which is newline
+// delimited JSON. Password hashes are only in the exports Auth0 support
+// hands out, as passwordHash, or in files written for Auth0's own import,
+// as custom_password_hash.
+type auth0User struct {
+	UserID string `json:"user_id"`
+	OID    struct {
+		Value string `json:"$oid"`
+	} `json:"_id"`
+	Username           string                 `json:"username"`
+	Email              string                 `json:"email"`
+	PhoneNumber        string                 `json:"phone_number"`
+	Name               string                 `json:"name"`
+	Blocked            bool                   `json:"blocked"`
+	PasswordHash       string                 `json:"passwordHash"`
+	CustomPasswordHash *auth0CustomHash       `json:"custom_password_hash"`
+	UserMetadata       map[string]interface{} `json:"user_metadata"`
+}
+
+type auth0CustomHash struct {
+	Algorithm string       `json:"algorithm"`
+	Hash      auth0Encoded `json:"hash"`
+	Salt      *struct {
+		auth0Encoded
+		Position string `json:"position"`
+	} `json:"salt"`
+	Cost            int `json:"cost"`
+	BlockSize       int `json:"blockSize"`
+	Parallelization int `json:"parallelization"`
+}
+
+// auth0Encoded is a value in the encoding Auth0's import format names:
+// base64, hex, or utf8.
+type auth0Encoded struct {
+	Value    string `json:"value"`
+	Encoding string `json:"encoding"`
+}
+
+func (e auth0Encoded) decode() ([]byte, error) {
+	switch e.Encoding {
+	case "hex":
+		return hex.DecodeString(e.Value)
+	case "base64":
+		return decodeBase64(e.Value)
+	default:
+		return []byte(e.Value), nil
+	}
+}
+
+func readAuth0(r io.Reader) ([]Account, error) {
+	var accounts []Account
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var user auth0User
+		if err := json.Unmarshal([]byte(text), &user); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		hash, err := auth0Hash(user)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		attributes := user.UserMetadata
+		if user.Name != "" {
+			if attributes == nil {
+				attributes = make(map[string]interface{})
+			}
+			attributes["name"] = user.Name
+		}
+		accounts = append(accounts, Account{
+			SourceID:     firstNonEmpty(user.UserID, user.OID.Value),
+			Username:     firstNonEmpty(user.Username, user.Email, user.PhoneNumber),
+			Email:        user.Email,
+			Phone:        user.PhoneNumber,
+			Disabled:     user.Blocked,
+			PasswordHash: hash,
+			Attributes:   attributes,
+		})
+	}
+	return accounts, scanner.Err()
+}
+
+// auth0Hash carries over bcrypt and MD5-crypt hashes as they are, PBKDF2
+// hashes in the PHC string format Auth0 takes them in, and salted SHA-1 and
+// scrypt hashes.
+func auth0Hash(user auth0User) (string, error) {
+	custom := user.CustomPasswordHash
+	if custom == nil {
+		return user.PasswordHash, nil
+	}
+	switch custom.Algorithm {
+	case "bcrypt", "md5-crypt":
+		return custom.Hash.Value, nil
+	case "pbkdf2":
+		return phcPBKDF2(custom.Hash.Value)
+	}
+
+	key, err := custom.Hash.decode()
+	if err != nil {
+		return "", fmt.Errorf("malformed %s hash: %w", custom.Algorithm, err)
+	}
+	var salt []byte
+	if custom.Salt != nil {
+		if custom.Salt.Position == "suffix" {
+			return "", fmt.Errorf("%s hashes with a salt suffix are not supported", custom.Algorithm)
+		}
+		if salt, err = custom.Salt.decode(); err != nil {
+			return "", fmt.Errorf("malformed %s salt: %w", custom.Algorithm, err)
+		}
+	}
+	switch custom.Algorithm {
+	case "sha1":
+		return passwords.SHA1Hash(salt, key)
+	case "scrypt":
+		cost := custom.Cost
+		if cost == 0 {
+			cost = 16384
+		}
+		if cost&(cost-1) != 0 {
+			return "", errors.New("scrypt cost must be a power of two")
+		}
+		return passwords.ScryptHash(bits.TrailingZeros(uint(cost)), orDefault(custom.BlockSize, 8), orDefault(custom.Parallelization, 1), salt, key)
+	default:
+		return "", fmt.Errorf("%w: %s", passwords.ErrUnknownScheme, custom.Algorithm)
+	}
+}
+
+func orDefault(value, fallback int) int {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// phcPBKDF2 reads $pbkdf2-<digest>$i=<iterations>,l=<length>$<salt>$<key>.
+func phcPBKDF2(phc string) (string, error) {
+	fields := strings.Split(strings.TrimPrefix(phc, "$"), "$")
+	if len(fields) != 4 {
+		return "", fmt.Errorf("malformed pbkdf2 hash")
+	}
+	iterations := 0
+	for _, param := range strings.Split(fields[1], ",") {
+		if value, ok := strings.CutPrefix(param, "i="); ok {
+			iterations, _ = strconv.Atoi(value)
+		}
+	}
+	salt, saltErr := decodeBase64(fields[2])
+	key, keyErr := decodeBase64(fields[3])
+	if saltErr != nil || keyErr != nil {
+		return "", fmt.Errorf("malformed pbkdf2 hash")
+	}
+	return passwords.PBKDF2Hash(fields[0], iterations, salt, key)
+}
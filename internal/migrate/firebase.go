@@ -0,0 +1,66 @@
+package migrate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tajious/heimdall/internal/passwords"
+)
+
+// firebaseExport is the JSON written by firebase auth:export.
+type firebaseExport struct {
+	Users []firebaseUser `json:"users"`
+}
+
+type firebaseUser struct {
+	LocalID      string `json:"localId"`
+	Email        string `json:"email"`
+	PhoneNumber  string `json:"phoneNumber"`
+	DisplayName  string `json:"displayName"`
+	Disabled     bool   `json:"disabled"`
+	PasswordHash string `json:"passwordHash"`
+	Salt         string `json:"salt"`
+}
+
+func readFirebase(r io.Reader, params passwords.FirebaseScryptParams) ([]Account, error) {
+	var export firebaseExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, err
+	}
+
+	accounts := make([]Account, 0, len(export.Users))
+	for _, user := range export.Users {
+		var hash string
+		if user.PasswordHash != "" {
+			if len(params.SignerKey) == 0 {
+				return nil, errors.New("the export has password hashes, pass the project's hash parameters")
+			}
+			salt, saltErr := decodeBase64(user.Salt)
+			key, keyErr := decodeBase64(user.PasswordHash)
+			if saltErr != nil || keyErr != nil {
+				return nil, fmt.Errorf("user %s: malformed password hash", user.LocalID)
+			}
+			var err error
+			if hash, err = passwords.FirebaseScryptHash(params, salt, key); err != nil {
+				return nil, err
+			}
+		}
+
+		var attributes map[string]interface{}
+		if user.DisplayName != "" {
+			attributes = map[string]interface{}{"name": user.DisplayName}
+		}
+		accounts = append(accounts, Account{
+			SourceID:     user.LocalID,
+			Username:     firstNonEmpty(user.Email, user.PhoneNumber),
+			Email:        user.Email,
+			Phone:        user.PhoneNumber,
+			Disabled:     user.Disabled,
+			PasswordHash: hash,
+			Attributes:   attributes,
+		})
+	}
+	return accounts, nil
+}
@@ -0,0 +1,116 @@
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/tajious/heimdall/internal/passwords"
+)
+
+// keycloakRealm is a realm export with its users, as written by kc.sh
+// export --users realm_file.
+type keycloakRealm struct {
+	Users []keycloakUser `json:"users"`
+}
+
+type keycloakUser struct {
+	ID          string               `json:"id"`
+	Username    string               `json:"username"`
+	Email       string               `json:"email"`
+	FirstName   string               `json:"firstName"`
+	LastName    string               `json:"lastName"`
+	Enabled     bool                 `json:"enabled"`
+	Attributes  map[string][]string  `json:"attributes"`
+	Credentials []keycloakCredential `json:"credentials"`
+}
+
+// keycloakCredential keeps the hash and the parameters it was made with as
+// JSON documents in strings.
+type keycloakCredential struct {
+	Type           string `json:"type"`
+	SecretData     string `json:"secretData"`
+	CredentialData string `json:"credentialData"`
+}
+
+type keycloakSecretData struct {
+	Value string `json:"value"`
+	Salt  string `json:"salt"`
+}
+
+type keycloakCredentialData struct {
+	HashIterations int    `json:"hashIterations"`
+	Algorithm      string `json:"algorithm"`
+}
+
+var keycloakSchemes = map[string]string{
+	"pbkdf2":        passwords.SchemePBKDF2SHA1,
+	"pbkdf2-sha256": passwords.SchemePBKDF2SHA256,
+	"pbkdf2-sha512": passwords.SchemePBKDF2SHA512,
+}
+
+func readKeycloak(r io.Reader) ([]Account, error) {
+	var realm keycloakRealm
+	if err := json.NewDecoder(r).Decode(&realm); err != nil {
+		return nil, err
+	}
+
+	accounts := make([]Account, 0, len(realm.Users))
+	for _, user := range realm.Users {
+		hash, err := keycloakHash(user.Credentials)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.ID, err)
+		}
+
+		attributes := make(map[string]interface{}, len(user.Attributes)+2)
+		for name, values := range user.Attributes {
+			if len(values) == 1 {
+				attributes[name] = values[0]
+			} else {
+				attributes[name] = values
+			}
+		}
+		if user.FirstName != "" {
+			attributes["given_name"] = user.FirstName
+		}
+		if user.LastName != "" {
+			attributes["family_name"] = user.LastName
+		}
+		accounts = append(accounts, Account{
+			SourceID:     user.ID,
+			Username:     firstNonEmpty(user.Username, user.Email),
+			Email:        user.Email,
+			Disabled:     !user.Enabled,
+			PasswordHash: hash,
+			Attributes:   attributes,
+		})
+	}
+	return accounts, nil
+}
+
+func keycloakHash(credentials []keycloakCredential) (string, error) {
+	for _, credential := range credentials {
+		if credential.Type != "password" {
+			continue
+		}
+		var secret keycloakSecretData
+		var params keycloakCredentialData
+		if err := json.Unmarshal([]byte(credential.SecretData), &secret); err != nil {
+			return "", fmt.Errorf("secretData: %w", err)
+		}
+		if err := json.Unmarshal([]byte(credential.CredentialData), &params); err != nil {
+			return "", fmt.Errorf("credentialData: %w", err)
+		}
+		scheme, ok := keycloakSchemes[params.Algorithm]
+		if !ok {
+			return "", fmt.Errorf("%w: %s", passwords.ErrUnknownScheme, params.Algorithm)
+		}
+		salt, saltErr := decodeBase64(secret.Salt)
+		key, keyErr := decodeBase64(secret.Value)
+		if saltErr != nil || keyErr != nil {
+			return "", fmt.Errorf("malformed %s hash", params.Algorithm)
+		}
+		return passwords.PBKDF2Hash(scheme, params.HashIterations, salt, key)
+	}
+	return "", nil
+}
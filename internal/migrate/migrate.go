@@ -0,0 +1,159 @@
+// Package migrate reads the user exports of other identity providers, Auth0,
+// Keycloak, and Firebase, and creates their users in a tenant. Password
+// hashes are carried over in the provider's scheme and replaced with bcrypt
+// hashes as users log in.
+package migrate
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/passwords"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/validation"
+)
+
+type Format string
+
+const (
+	FormatAuth0    Format = "auth0"
+	FormatKeycloak Format = "keycloak"
+	FormatFirebase Format = "firebase"
+)
+
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// Account is a user read from an export. PasswordHash is empty for users
+// who never had a password, such as those of social logins, and is
+// otherwise in a scheme the passwords package verifies.
+type Account struct {
+	SourceID     string
+	Username     string
+	Email        string
+	Phone        string
+	Disabled     bool
+	PasswordHash string
+	Attributes   map[string]interface{}
+}
+
+// Options are what a format needs beyond the export itself.
+type Options struct {
+	// Firebase keeps the hash parameters of a project out of its export.
+	Firebase passwords.FirebaseScryptParams
+}
+
+// Read parses an export of format.
+func Read(format Format, r io.Reader, opts Options) ([]Account, error) {
+	switch format {
+	case FormatAuth0:
+		return readAuth0(r)
+	case FormatKeycloak:
+		return readKeycloak(r)
+	case FormatFirebase:
+		return readFirebase(r, opts.Firebase)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+	}
+}
+
+// Result counts what Import did with the accounts of an export.
+type Result struct {
+	Created  int       `json:"created" yaml:"created"`
+	Existing int       `json:"existing" yaml:"existing"`
+	Skipped  []Skipped `json:"skipped" yaml:"skipped"`
+}
+
+type Skipped struct {
+	SourceID string `json:"source_id" yaml:"source_id"`
+	Reason   string `json:"reason" yaml:"reason"`
+}
+
+// progressEvery is how many accounts Import goes through between progress
+// reports.
+const progressEvery = 100
+
+// Import creates a user in the tenant's pool for every account whose
+// username is not taken yet. Users that exist are left alone, so an import
+// interrupted midway can be run again. progress, when set, is told how many
+// accounts were done every so often.
+func Import(ctx context.Context, store storage.Storage, tenant *models.Tenant, environmentID string, accounts []Account, progress func(done int)) (*Result, error) {
+	result := &Result{Skipped: []Skipped{}}
+	for i, account := range accounts {
+		if progress != nil && i > 0 && i%progressEvery == 0 {
+			progress(i)
+		}
+		username := validation.NormalizeUsername(tenant.Config.UsernamePolicy, account.Username)
+		if username == "" {
+			result.Skipped = append(result.Skipped, Skipped{SourceID: account.SourceID, Reason: "no username, email, or phone"})
+			continue
+		}
+
+		_, err := store.GetPoolUserByUsername(ctx, tenant.ID, environmentID, username)
+		if err == nil {
+			result.Existing++
+			continue
+		}
+		if err != storage.ErrUserNotFound {
+			return result, err
+		}
+
+		status := models.UserActive
+		if account.Disabled {
+			status = models.UserSuspended
+		}
+		attributes := account.Attributes
+		if account.SourceID != "" {
+			if attributes == nil {
+				attributes = make(map[string]interface{})
+			}
+			attributes["imported_id"] = account.SourceID
+		}
+		user := &models.User{
+			TenantID:      tenant.ID,
+			EnvironmentID: environmentID,
+			Username:      username,
+			Email:         strings.ToLower(account.Email),
+			Phone:         account.Phone,
+			Password:      account.PasswordHash,
+			Role:          models.RoleUser,
+			Status:        status,
+			Attributes:    attributes,
+			CreatedAt:     time.Now(),
+			UpdatedAt:     time.Now(),
+		}
+		if err := store.CreateUser(ctx, user); err != nil {
+			result.Skipped = append(result.Skipped, Skipped{SourceID: account.SourceID, Reason: err.Error()})
+			continue
+		}
+		result.Created++
+	}
+	return result, nil
+}
+
+// decodeBase64 accepts the standard and URL-safe alphabets, padded or not,
+// as exports differ in which they use.
+func decodeBase64(s string) ([]byte, error) {
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if data, err := encoding.DecodeString(s); err == nil {
+			return data, nil
+		}
+	}
+	return nil, errors.New("invalid base64")
+}
+
+// firstNonEmpty picks the identifier a user logs in with when the export
+// has no username of its own.
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"time"
+)
+
+type PolicyEffect string
+
+const (
+	EffectPermit PolicyEffect = "permit"
+	EffectForbid PolicyEffect = "forbid"
+)
+
+// AccessStatement grants or denies actions on resources. Empty Roles and
+// Subjects match every principal; actions and resources accept "*" wildcards.
+type AccessStatement struct {
+	Effect    PolicyEffect `json:"effect" validate:"required,oneof=permit forbid"`
+	Roles     []Role       `json:"roles,omitempty" validate:"dive,oneof=admin user read_only"`
+	Subjects  []string     `json:"subjects,omitempty"`
+	Actions   []string     `json:"actions" validate:"required,min=1,dive,required"`
+	Resources []string     `json:"resources" validate:"required,min=1,dive,required"`
+}
+
+type AccessPolicy struct {
+	ID         string            `json:"id" gorm:"primaryKey"`
+	TenantID   string            `json:"tenant_id" gorm:"not null;uniqueIndex:idx_access_policies_tenant_name"`
+	Name       string            `json:"name" gorm:"not null;uniqueIndex:idx_access_policies_tenant_name"`
+	Statements []AccessStatement `json:"statements" gorm:"type:jsonb;serializer:json"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+type AuthorizeSubject struct {
+	ID   string `json:"id" validate:"required"`
+	Role Role   `json:"role" validate:"required,oneof=admin user read_only"`
+}
+
+type AuthorizeRequest struct {
+	Subject  AuthorizeSubject `json:"subject"`
+	Action   string           `json:"action" validate:"required"`
+	Resource string           `json:"resource" validate:"required"`
+}
+
+type AuthorizeCheck struct {
+	Action   string `json:"action" validate:"required"`
+	Resource string `json:"resource" validate:"required"`
+}
+
+type AuthorizeBatchRequest struct {
+	Subject AuthorizeSubject `json:"subject"`
+	Checks  []AuthorizeCheck `json:"checks" validate:"required,min=1,max=100,dive"`
+}
+
+type AuthorizeDecision struct {
+	Action   string `json:"action,omitempty"`
+	Resource string `json:"resource,omitempty"`
+	Allowed  bool   `json:"allowed"`
+	Reason   string `json:"reason"`
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditLog records a state-changing request made through the API, or a
+// failed login.
+//
+// The entries of a tenant form a hash chain: each one carries the hash of
+// the entry before it, so editing or deleting an entry in the middle of the
+// log breaks every hash after it.
+type AuditLog struct {
+	ID       string `json:"id" gorm:"primaryKey"`
+	TenantID string `json:"tenant_id" gorm:"index:idx_audit_logs_tenant_created;index:idx_audit_logs_chain"`
+	ActorID  string `json:"actor_id" gorm:"index"`
+	Action   string `json:"action" gorm:"not null"`
+	Resource string `json:"resource" gorm:"not null"`
+	Status   int    `json:"status"`
+	IP       string `json:"ip"`
+	// EventType, Category, and Severity classify the entry with the
+	// taxonomy of the events package.
+	EventType string    `json:"event_type" gorm:"index"`
+	Category  string    `json:"category"`
+	Severity  string    `json:"severity"`
+	CreatedAt time.Time `json:"created_at" gorm:"index:idx_audit_logs_tenant_created"`
+	// Sequence numbers the tenant's entries from 1. Entries recorded before
+	// chaining was introduced have none.
+	Sequence int64  `json:"sequence" gorm:"not null;default:0;index:idx_audit_logs_chain"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+	// ChainVersion is the AuditChainVersion the entry was hashed with.
+	// Entries recorded before versions were introduced are version 1.
+	ChainVersion int `json:"chain_version" gorm:"not null;default:1"`
+
+	// Changes are the rows the request wrote, saved with the entry.
+	Changes []DataChange `json:"-" gorm:"-"`
+}
+
+// AuditChainVersion is the ChainVersion new entries are hashed with.
+// Version 1 leaves out EventType, Category, and Severity; version 2 adds them
+// and the version itself.
+const AuditChainVersion = 2
+
+// ChainHash is the hex SHA-256 over the entry's fields and PrevHash, the
+// fields its ChainVersion covers. The creation time counts in microseconds,
+// the precision PostgreSQL keeps.
+func (e *AuditLog) ChainHash() string {
+	fields := []string{
+		e.PrevHash,
+		strconv.FormatInt(e.Sequence, 10),
+		e.ID,
+		e.TenantID,
+		e.ActorID,
+		e.Action,
+		e.Resource,
+		strconv.Itoa(e.Status),
+		e.IP,
+	}
+	if e.ChainVersion >= 2 {
+		fields = append(fields, strconv.Itoa(e.ChainVersion), e.EventType, e.Category, e.Severity)
+	}
+	fields = append(fields, strconv.FormatInt(e.CreatedAt.UnixMicro(), 10))
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditChainAnchor is where the retained part of a tenant's audit chain
+// starts: the sequence and hash of the last entry retention purged from it.
+// A chain nothing was purged from starts after the zero anchor.
+type AuditChainAnchor struct {
+	TenantID  string    `json:"tenant_id" gorm:"primaryKey"`
+	Sequence  int64     `json:"sequence"`
+	Hash      string    `json:"hash"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DataChange is a row an audited request created, updated, or deleted. The
+// changes written in one database transaction share its TxID.
+type DataChange struct {
+	ID         string `json:"id" gorm:"primaryKey"`
+	AuditLogID string `json:"audit_log_id" gorm:"index"`
+	TenantID   string `json:"tenant_id" gorm:"index"`
+	TxID       int64  `json:"tx_id"`
+	// Operation is create, update, or delete.
+	Operation string `json:"operation"`
+	Table     string `json:"table" gorm:"column:table_name"`
+	// Values are the columns written, as JSON, with secrets redacted, and
+	// Conditions the WHERE clause selecting the updated or deleted rows.
+	Values       string    `json:"values,omitempty"`
+	Conditions   string    `json:"conditions,omitempty"`
+	RowsAffected int64     `json:"rows_affected"`
+	CreatedAt    time.Time `json:"created_at" gorm:"index"`
+}
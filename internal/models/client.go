@@ -0,0 +1,103 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+// GrantType is an OAuth grant a client may use to get tokens.
+type GrantType string
+
+// Claims a client can have left out of its tokens.
+const (
+	ClaimAttributes  = "attrs"
+	ClaimAdminScopes = "admin_scopes"
+)
+
+const (
+	GrantPassword          GrantType = "password"
+	GrantAuthorizationCode GrantType = "authorization_code"
+	GrantRefreshToken      GrantType = "refresh_token"
+	GrantClientCredentials GrantType = "client_credentials"
+	GrantDeviceCode        GrantType = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// Client is an application of a tenant that users sign in to. Its ID is the
+// client_id it identifies itself with and the audience of the tokens it is
+// issued, which follow the client's token policy rather than the tenant's.
+type Client struct {
+	ID       string `json:"id" gorm:"primaryKey"`
+	TenantID string `json:"tenant_id" gorm:"not null;uniqueIndex:idx_clients_tenant_name"`
+	Name     string `json:"name" gorm:"not null;uniqueIndex:idx_clients_tenant_name"`
+	// RedirectURIs are the exact URIs users may be sent back to after
+	// signing in, and PostLogoutRedirectURIs after signing out.
+	RedirectURIs           []string `json:"redirect_uris" gorm:"type:jsonb;serializer:json"`
+	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris" gorm:"type:jsonb;serializer:json"`
+	// BackchannelLogoutURI receives a logout token when an SSO session the
+	// client was issued tokens through ends.
+	BackchannelLogoutURI string      `json:"backchannel_logout_uri,omitempty"`
+	GrantTypes           []GrantType `json:"grant_types" gorm:"type:jsonb;serializer:json"`
+	// AccessTokenLifetime and RefreshTokenLifetime are in seconds; zero
+	// keeps the tenant's.
+	AccessTokenLifetime  int `json:"access_token_lifetime"`
+	RefreshTokenLifetime int `json:"refresh_token_lifetime"`
+	// AllowedOrigins are the web origins the client may call the API from
+	// in a browser.
+	AllowedOrigins []string `json:"allowed_origins" gorm:"type:jsonb;serializer:json"`
+	// AllowedScopes are the scopes the client may ask for; it may ask for
+	// any when empty.
+	AllowedScopes []string `json:"allowed_scopes" gorm:"type:jsonb;serializer:json"`
+	// OmitClaims are the claims, out of ClaimAttributes and
+	// ClaimAdminScopes, left out of the client's tokens.
+	OmitClaims []string `json:"omit_claims" gorm:"type:jsonb;serializer:json"`
+	// AttributeClaims, when set, are the only attribute claims the client's
+	// tokens carry.
+	AttributeClaims []string `json:"attribute_claims" gorm:"type:jsonb;serializer:json"`
+	// EncryptTokens wraps the client's tokens in a JWE, encrypted with
+	// EncryptionKey, for clients whose tokens carry sensitive claims.
+	EncryptTokens bool      `json:"encrypt_tokens" gorm:"not null;default:false"`
+	EncryptionKey string    `json:"-"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func (c *Client) AllowsGrant(grant GrantType) bool {
+	return slices.Contains(c.GrantTypes, grant)
+}
+
+// DisallowedScopes returns the scopes, out of scopes, the client may not
+// ask for.
+func (c *Client) DisallowedScopes(scopes []string) []string {
+	if len(c.AllowedScopes) == 0 {
+		return nil
+	}
+	var disallowed []string
+	for _, scope := range scopes {
+		if !slices.Contains(c.AllowedScopes, scope) {
+			disallowed = append(disallowed, scope)
+		}
+	}
+	return disallowed
+}
+
+// Restrict applies the client's token policy to the claims of a token
+// issued to it.
+func (c *Client) Restrict(claims *Claims) {
+	claims.Audience = []string{c.ID}
+	if slices.Contains(c.OmitClaims, ClaimAdminScopes) {
+		claims.AdminScopes = nil
+	}
+	if slices.Contains(c.OmitClaims, ClaimAttributes) {
+		claims.Attributes = nil
+		return
+	}
+	if len(c.AttributeClaims) > 0 && claims.Attributes != nil {
+		kept := make(map[string]interface{}, len(c.AttributeClaims))
+		for _, name := range c.AttributeClaims {
+			if value, ok := claims.Attributes[name]; ok {
+				kept[name] = value
+			}
+		}
+		claims.Attributes = kept
+	}
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+// ConsentGrant records the scopes a user has let a client act on their
+// behalf with, so they are asked again only for scopes the client has not
+// been granted before.
+type ConsentGrant struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	TenantID  string    `json:"tenant_id" gorm:"not null;uniqueIndex:idx_consent_grants_user_client"`
+	UserID    string    `json:"user_id" gorm:"not null;uniqueIndex:idx_consent_grants_user_client"`
+	ClientID  string    `json:"client_id" gorm:"not null;uniqueIndex:idx_consent_grants_user_client"`
+	Scopes    []string  `json:"scopes" gorm:"type:jsonb;serializer:json"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Missing returns the scopes, out of scopes, the grant does not cover.
+func (g *ConsentGrant) Missing(scopes []string) []string {
+	var missing []string
+	for _, scope := range scopes {
+		if !slices.Contains(g.Scopes, scope) && !slices.Contains(missing, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
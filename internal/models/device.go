@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+)
+
+type DeviceAuthorizationStatus string
+
+const (
+	DevicePending  DeviceAuthorizationStatus = "pending"
+	DeviceApproved DeviceAuthorizationStatus = "approved"
+	DeviceDenied   DeviceAuthorizationStatus = "denied"
+)
+
+// DeviceAuthorization is a login started on a device without a keyboard or
+// browser (RFC 8628). The device polls with its device code while the user
+// approves the user code from another device where they are signed in.
+type DeviceAuthorization struct {
+	ID       string `json:"id" gorm:"primaryKey"`
+	TenantID string `json:"tenant_id" gorm:"not null;uniqueIndex:idx_device_authorizations_user_code"`
+	// DeviceCodeHash is the SHA-256 of the device code, which is as good as
+	// a password until the authorization expires.
+	DeviceCodeHash string                    `json:"-" gorm:"not null;uniqueIndex"`
+	UserCode       string                    `json:"user_code" gorm:"not null;uniqueIndex:idx_device_authorizations_user_code"`
+	ClientID       string                    `json:"client_id" gorm:"not null"`
+	Scopes         []string                  `json:"scopes,omitempty" gorm:"type:jsonb;serializer:json"`
+	Status         DeviceAuthorizationStatus `json:"status" gorm:"not null"`
+	UserID         string                    `json:"user_id,omitempty"`
+	// Interval is how many seconds the device must wait between polls; it
+	// grows each time the device polls too fast.
+	Interval     int        `json:"interval" gorm:"not null"`
+	LastPolledAt *time.Time `json:"last_polled_at,omitempty"`
+	ExpiresAt    time.Time  `json:"expires_at" gorm:"not null;index"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+func (d *DeviceAuthorization) Expired() bool {
+	return !time.Now().Before(d.ExpiresAt)
+}
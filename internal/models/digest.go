@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+type DigestSchedule string
+
+const (
+	DigestDaily  DigestSchedule = "daily"
+	DigestWeekly DigestSchedule = "weekly"
+)
+
+// DigestConfig opts a tenant into digest emails summarizing its new users,
+// failed logins, and configuration changes. A digest covers the period
+// ending at Hour o'clock UTC, on Mondays for weekly digests.
+type DigestConfig struct {
+	Schedule   DigestSchedule `json:"schedule" validate:"required,oneof=daily weekly"`
+	Hour       int            `json:"hour" validate:"min=0,max=23"`
+	Recipients []string       `json:"recipients" validate:"required,min=1,max=20,dive,email"`
+}
+
+// LastPeriod returns the latest period a digest is due for at now.
+func (c *DigestConfig) LastPeriod(now time.Time) (start, end time.Time) {
+	now = now.UTC()
+	end = time.Date(now.Year(), now.Month(), now.Day(), c.Hour, 0, 0, 0, time.UTC)
+	if end.After(now) {
+		end = end.AddDate(0, 0, -1)
+	}
+	if c.Schedule == DigestWeekly {
+		end = end.AddDate(0, 0, -((int(end.Weekday()) + 6) % 7))
+		return end.AddDate(0, 0, -7), end
+	}
+	return end.AddDate(0, 0, -1), end
+}
+
+// DigestDelivery records that the tenant's digest for the period ending at
+// PeriodEnd was sent. The period is unique per tenant, so of several
+// instances running the digest job only the one that records it sends it.
+type DigestDelivery struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	TenantID  string    `json:"tenant_id" gorm:"not null;uniqueIndex:idx_digest_deliveries_period"`
+	PeriodEnd time.Time `json:"period_end" gorm:"not null;uniqueIndex:idx_digest_deliveries_period"`
+	CreatedAt time.Time `json:"created_at"`
+}
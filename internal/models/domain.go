@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// DomainClaim is a tenant's claim on an email domain. Any number of tenants
+// may claim a domain, but only one can prove ownership through DNS; from then
+// on the domain routes registrations to that tenant.
+type DomainClaim struct {
+	ID         string     `json:"id" gorm:"primaryKey"`
+	TenantID   string     `json:"tenant_id" gorm:"not null;uniqueIndex:idx_domain_claims_tenant_domain"`
+	Domain     string     `json:"domain" gorm:"not null;uniqueIndex:idx_domain_claims_tenant_domain;uniqueIndex:idx_domain_claims_verified,where:verified_at IS NOT NULL"`
+	Token      string     `json:"token" gorm:"not null"`
+	VerifiedAt *time.Time `json:"verified_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+func (d *DomainClaim) Verified() bool {
+	return d.VerifiedAt != nil
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+)
+
+type Environment struct {
+	ID              string    `json:"id" gorm:"primaryKey"`
+	TenantID        string    `json:"tenant_id" gorm:"not null;uniqueIndex:idx_environments_tenant_name"`
+	Name            string    `json:"name" gorm:"not null;uniqueIndex:idx_environments_tenant_name"`
+	APIKeyHash      string    `json:"-" gorm:"not null;uniqueIndex"`
+	APIKeyPrefix    string    `json:"api_key_prefix" gorm:"not null;default:''"`
+	SigningKey      string    `json:"-" gorm:"not null"`
+	RateLimitIP     int       `json:"rate_limit_ip" gorm:"not null"`
+	RateLimitUser   int       `json:"rate_limit_user" gorm:"not null"`
+	RateLimitWindow int       `json:"rate_limit_window" gorm:"not null"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
@@ -0,0 +1,36 @@
+package models
+
+// Feature names a capability that can be rolled out per tenant.
+type Feature string
+
+const (
+	FeatureMFA       Feature = "enable_mfa"
+	FeatureMagicLink Feature = "enable_magic_link"
+	FeatureWebhooks  Feature = "enable_webhooks"
+	// FeatureDeviceFlow lets devices without a browser sign users in with
+	// the device authorization grant.
+	FeatureDeviceFlow Feature = "enable_device_flow"
+)
+
+// KnownFeatures lists the flags a tenant configuration may set.
+var KnownFeatures = []Feature{
+	FeatureMFA,
+	FeatureMagicLink,
+	FeatureWebhooks,
+	FeatureDeviceFlow,
+}
+
+func IsKnownFeature(name string) bool {
+	for _, feature := range KnownFeatures {
+		if string(feature) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FeatureEnabled reports whether the tenant has the feature switched on.
+// Unset flags are off.
+func (c *TenantConfig) FeatureEnabled(feature Feature) bool {
+	return c.Features[string(feature)]
+}
@@ -0,0 +1,31 @@
+package models
+
+type FieldType string
+
+const (
+	FieldString  FieldType = "string"
+	FieldNumber  FieldType = "number"
+	FieldBoolean FieldType = "boolean"
+	FieldDate    FieldType = "date"
+	FieldCountry FieldType = "country"
+)
+
+type FieldRule struct {
+	Name      string    `json:"name" validate:"required,max=64"`
+	Type      FieldType `json:"type" validate:"required,oneof=string number boolean date country"`
+	Required  bool      `json:"required"`
+	Unique    bool      `json:"unique"`
+	MinAge    int       `json:"min_age,omitempty" validate:"min=0,max=150"`
+	MaxLength int       `json:"max_length,omitempty" validate:"min=0"`
+	Pattern   string    `json:"pattern,omitempty"`
+	Enum      []string  `json:"enum,omitempty"`
+}
+
+func FindFieldRule(rules []FieldRule, name string) (FieldRule, bool) {
+	for _, rule := range rules {
+		if rule.Name == name {
+			return rule, true
+		}
+	}
+	return FieldRule{}, false
+}
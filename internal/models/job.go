@@ -0,0 +1,87 @@
+package models
+
+import "time"
+
+type JobKind string
+
+const (
+	JobExportUsers     JobKind = "export_users"
+	JobExportAuditLogs JobKind = "export_audit_logs"
+	JobImportUsers     JobKind = "import_users"
+	JobReencrypt       JobKind = "reencrypt"
+)
+
+// AdminScope is the scope an admin needs to follow a job of the kind.
+func (k JobKind) AdminScope() AdminScope {
+	switch k {
+	case JobExportAuditLogs:
+		return AdminScopeAudit
+	case JobReencrypt:
+		return AdminScopeConfig
+	default:
+		return AdminScopeUsers
+	}
+}
+
+type JobStatus string
+
+const (
+	JobPending   JobStatus = "pending"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// Job is a long-running operation of a tenant, such as an export, a bulk
+// import, or the re-encryption after a key rotation. Clients poll it until
+// it is done.
+type Job struct {
+	ID       string    `json:"id" gorm:"primaryKey"`
+	TenantID string    `json:"tenant_id" gorm:"not null;index"`
+	Kind     JobKind   `json:"kind" gorm:"not null"`
+	Status   JobStatus `json:"status" gorm:"not null;index"`
+	// Input is the JSON the job runs with, such as the filter of an export.
+	Input       string `json:"-"`
+	RequestedBy string `json:"requested_by,omitempty"`
+	// Processed counts the items done so far, out of Total when it is
+	// known. Progress is the percentage done.
+	Processed int64  `json:"processed"`
+	Total     int64  `json:"total,omitempty"`
+	Progress  int    `json:"progress"`
+	Error     string `json:"error,omitempty"`
+	// Key and Size locate the file an export wrote in the blob store.
+	Key        string     `json:"-"`
+	Size       int64      `json:"size,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Done reports whether the job will not change anymore.
+func (j *Job) Done() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed
+}
+
+// Advance records processed items. Progress stays below 100 until the job
+// finishes, and at 0 while Total is unknown.
+func (j *Job) Advance(processed int64) {
+	j.Processed = processed
+	if j.Total > 0 {
+		j.Progress = min(int(processed*100/j.Total), 99)
+	}
+}
+
+// Finish ends the job, failed with message when err is set. The message is
+// shown to clients, so it should not carry err's details unless they are
+// meant for them.
+func (j *Job) Finish(err error, message string) {
+	now := time.Now()
+	j.FinishedAt = &now
+	if err != nil {
+		j.Status = JobFailed
+		j.Error = message
+		return
+	}
+	j.Status = JobSucceeded
+	j.Progress = 100
+}
@@ -0,0 +1,25 @@
+package models
+
+type MappingAction string
+
+const (
+	MappingSetRole   MappingAction = "set_role"
+	MappingCopyClaim MappingAction = "copy_claim"
+)
+
+// MappingRule applies an action when an external identity attribute matches.
+// An empty Equals matches whenever the attribute is present; list attributes
+// (such as groups) match when any element equals the value.
+type MappingRule struct {
+	Attribute string        `json:"attribute" validate:"required,max=64"`
+	Equals    string        `json:"equals,omitempty"`
+	Action    MappingAction `json:"action" validate:"required,oneof=set_role copy_claim"`
+	Role      Role          `json:"role,omitempty" validate:"omitempty,oneof=admin user read_only"`
+	Claim     string        `json:"claim,omitempty" validate:"max=64"`
+}
+
+// MappingResult is the outcome of evaluating mapping rules for an identity.
+type MappingResult struct {
+	Role   Role                   `json:"role,omitempty"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+)
+
+// PluginModule is one uploaded version of a tenant's WASM login plugin.
+// Versions of a plugin share its name, and at most one of them is active.
+type PluginModule struct {
+	ID            string            `json:"id" gorm:"primaryKey"`
+	TenantID      string            `json:"tenant_id" gorm:"not null;uniqueIndex:idx_plugin_modules_version"`
+	Name          string            `json:"name" gorm:"not null;uniqueIndex:idx_plugin_modules_version"`
+	Version       int               `json:"version" gorm:"not null;uniqueIndex:idx_plugin_modules_version"`
+	Stages        []LoginHookStage  `json:"stages" gorm:"type:jsonb;serializer:json"`
+	SHA256        string            `json:"sha256" gorm:"not null"`
+	Size          int               `json:"size" gorm:"not null"`
+	Module        []byte            `json:"-" gorm:"not null"`
+	TimeoutMS     int               `json:"timeout_ms" gorm:"not null;default:0"`
+	FailurePolicy HookFailurePolicy `json:"failure_policy" gorm:"not null;default:open"`
+	Active        bool              `json:"active" gorm:"not null;default:false"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+)
+
+type PolicyKind string
+
+const (
+	PolicyTermsOfService PolicyKind = "terms_of_service"
+	PolicyPrivacy        PolicyKind = "privacy_policy"
+)
+
+type PolicyVersion struct {
+	ID          string     `json:"id" gorm:"primaryKey"`
+	TenantID    string     `json:"tenant_id" gorm:"not null;uniqueIndex:idx_policy_versions_tenant_kind_version"`
+	Kind        PolicyKind `json:"kind" gorm:"not null;uniqueIndex:idx_policy_versions_tenant_kind_version"`
+	Version     string     `json:"version" gorm:"not null;uniqueIndex:idx_policy_versions_tenant_kind_version"`
+	URL         string     `json:"url"`
+	Required    bool       `json:"required"`
+	PublishedAt time.Time  `json:"published_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+type PolicyAcceptance struct {
+	ID              string    `json:"id" gorm:"primaryKey"`
+	TenantID        string    `json:"tenant_id" gorm:"not null;index"`
+	UserID          string    `json:"user_id" gorm:"not null;uniqueIndex:idx_policy_acceptances_user_version"`
+	PolicyVersionID string    `json:"policy_version_id" gorm:"not null;uniqueIndex:idx_policy_acceptances_user_version"`
+	Version         string    `json:"version" gorm:"not null"`
+	IP              string    `json:"ip"`
+	AcceptedAt      time.Time `json:"accepted_at"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+// SigningKey lets a server call a tenant's admin API by signing each request
+// with a shared secret instead of presenting a bearer token. Requests signed
+// with it act as an admin of the tenant holding AdminScopes.
+type SigningKey struct {
+	ID       string `json:"id" gorm:"primaryKey"`
+	TenantID string `json:"tenant_id" gorm:"not null;index"`
+	Name     string `json:"name" gorm:"not null"`
+	// Secret is the HMAC key, sealed with the tenant's data key when
+	// encryption is on. It is only returned when the key is created.
+	Secret      string       `json:"-" gorm:"not null"`
+	AdminScopes []AdminScope `json:"admin_scopes,omitempty" gorm:"type:jsonb;serializer:json"`
+	// ExpiresAt is set on a key that was rotated, to keep it valid while
+	// its callers move to the successor.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+func (k *SigningKey) Expired() bool {
+	return k.ExpiresAt != nil && !time.Now().Before(*k.ExpiresAt)
+}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// SSOConfig lets the tenant's applications share one login: signing in
+// starts an SSO session, kept in a cookie on the tenant's auth domain, that
+// any of the applications trades for a token without asking for
+// credentials again.
+type SSOConfig struct {
+	// SessionLifetime is how many minutes an SSO session lasts from login.
+	SessionLifetime int `json:"session_lifetime" validate:"required,min=1,max=43200"`
+	// AllowedOrigins are the web origins of the tenant's applications, which
+	// may trade the session for a token from the browser.
+	AllowedOrigins []string `json:"allowed_origins" validate:"max=50,dive,url"`
+}
+
+// SSOSession is a login a user's browser holds for the tenant's
+// applications.
+type SSOSession struct {
+	ID       string `json:"id" gorm:"primaryKey"`
+	TenantID string `json:"tenant_id" gorm:"not null;index"`
+	// TokenHash is the SHA-256 of the cookie value, which is as good as a
+	// password until the session expires.
+	TokenHash     string `json:"-" gorm:"not null;uniqueIndex"`
+	UserID        string `json:"user_id" gorm:"not null"`
+	EnvironmentID string `json:"environment_id,omitempty"`
+	// ClientIDs are the registered clients issued a token through the
+	// session, which are told when it ends.
+	ClientIDs []string  `json:"client_ids,omitempty" gorm:"type:jsonb;serializer:json"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"not null;index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *SSOSession) Expired() bool {
+	return !time.Now().Before(s.ExpiresAt)
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"slices"
 	"time"
 )
 
@@ -8,26 +9,174 @@ type AuthMethod string
 
 const (
 	UsernamePassword AuthMethod = "username_password"
+	Delegated        AuthMethod = "delegated"
+	// ClientCertificate signs in clients presenting an X.509 certificate
+	// issued by one of the tenant's CAs.
+	ClientCertificate AuthMethod = "client_certificate"
+)
+
+type DelegatedAuthConfig struct {
+	URL       string `json:"url" validate:"required,url,startswith=https://"`
+	TimeoutMS int    `json:"timeout_ms" validate:"min=0,max=30000"`
+}
+
+// Certificate fields a client certificate can be mapped to a user by.
+const (
+	CertSubjectCN = "subject_cn"
+	CertSANEmail  = "san_email"
+	CertSANDNS    = "san_dns"
+	CertSANURI    = "san_uri"
+)
+
+// ClientCertConfig trusts client certificates issued by the CAs in
+// CACertificates and maps them to users by the field MapBy names: the email
+// SAN to the user's email, any other field to the username. Certificates
+// matching no user sign in as a service account with ServiceAccountRole, or
+// are refused when it is empty.
+type ClientCertConfig struct {
+	CACertificates     string `json:"ca_certificates" validate:"required"`
+	MapBy              string `json:"map_by" validate:"required,oneof=subject_cn san_email san_dns san_uri"`
+	ServiceAccountRole Role   `json:"service_account_role,omitempty" validate:"omitempty,oneof=admin user read_only"`
+}
+
+// LoginHookStage is the point of a login at which a hook runs.
+type LoginHookStage string
+
+const (
+	PreLogin  LoginHookStage = "pre_login"
+	PostLogin LoginHookStage = "post_login"
+)
+
+// HookFailurePolicy decides what a login does when a hook errors or times
+// out: open lets it through, closed refuses it.
+type HookFailurePolicy string
+
+const (
+	FailOpen   HookFailurePolicy = "open"
+	FailClosed HookFailurePolicy = "closed"
+)
+
+// LoginHook is a tenant webhook called at a login stage.
+type LoginHook struct {
+	Stage         LoginHookStage    `json:"stage" validate:"required,oneof=pre_login post_login"`
+	URL           string            `json:"url" validate:"required,url,startswith=https://"`
+	TimeoutMS     int               `json:"timeout_ms" validate:"min=0,max=10000"`
+	FailurePolicy HookFailurePolicy `json:"failure_policy" validate:"omitempty,oneof=open closed"`
+}
+
+// ProvisioningConfig controls just-in-time creation of local users for
+// identities authenticated by an external provider. AttributeMapping maps
+// provider attribute names to attribute schema field names.
+type ProvisioningConfig struct {
+	Enabled          bool              `json:"enabled"`
+	DefaultRole      Role              `json:"default_role" validate:"omitempty,oneof=admin user read_only"`
+	AttributeMapping map[string]string `json:"attribute_mapping"`
+}
+
+// LoginIdentifier names a user field that identifies the account at login.
+type LoginIdentifier string
+
+const (
+	IdentifierUsername LoginIdentifier = "username"
+	IdentifierEmail    LoginIdentifier = "email"
+	IdentifierPhone    LoginIdentifier = "phone"
+)
+
+// UsernamePolicy normalizes usernames before they are stored or looked up
+// and reserves names users may not register, so that look-alike accounts
+// cannot impersonate staff.
+type UsernamePolicy struct {
+	Trim      bool     `json:"trim"`
+	Lowercase bool     `json:"lowercase"`
+	NFKC      bool     `json:"nfkc"`
+	Reserved  []string `json:"reserved,omitempty" validate:"max=1000,dive,min=1,max=64"`
+}
+
+type TenantStatus string
+
+const (
+	TenantActive    TenantStatus = "active"
+	TenantSuspended TenantStatus = "suspended"
 )
 
 type Tenant struct {
-	ID        string       `json:"id" gorm:"primaryKey"`
-	Name      string       `json:"name" gorm:"not null"`
+	ID     string       `json:"id" gorm:"primaryKey"`
+	Name   string       `json:"name" gorm:"not null"`
+	Status TenantStatus `json:"status" gorm:"not null;default:active"`
+	// Region names the database the tenant's data is kept in; empty is the
+	// default database. It is fixed when the tenant is created.
+	Region string `json:"region,omitempty" gorm:"not null;default:''"`
+	// Shard numbers the database a tenant of the default region is kept in
+	// when they are spread over several; 0 is the main database.
+	Shard     int          `json:"shard,omitempty" gorm:"not null;default:0"`
 	Config    TenantConfig `json:"config" gorm:"foreignKey:TenantID"`
 	CreatedAt time.Time    `json:"created_at"`
 	UpdatedAt time.Time    `json:"updated_at"`
 }
 
 type TenantConfig struct {
-	ID              string     `json:"id" gorm:"primaryKey"`
-	TenantID        string     `json:"tenant_id" gorm:"not null;uniqueIndex"`
-	AuthMethod      AuthMethod `json:"auth_method" gorm:"not null"`
-	JWTDuration     int        `json:"jwt_duration" gorm:"not null"`
-	RateLimitIP     int        `json:"rate_limit_ip" gorm:"not null"`
-	RateLimitUser   int        `json:"rate_limit_user" gorm:"not null"`
-	RateLimitWindow int        `json:"rate_limit_window" gorm:"not null"`
-	CreatedAt       time.Time  `json:"created_at"`
-	UpdatedAt       time.Time  `json:"updated_at"`
+	ID                  string               `json:"id" gorm:"primaryKey"`
+	TenantID            string               `json:"tenant_id" gorm:"not null;uniqueIndex"`
+	AuthMethod          AuthMethod           `json:"auth_method" gorm:"not null"`
+	JWTDuration         int                  `json:"jwt_duration" gorm:"not null"`
+	RateLimitIP         int                  `json:"rate_limit_ip" gorm:"not null"`
+	RateLimitUser       int                  `json:"rate_limit_user" gorm:"not null"`
+	RateLimitWindow     int                  `json:"rate_limit_window" gorm:"not null"`
+	AttributeSchema     []FieldRule          `json:"attribute_schema" gorm:"type:jsonb;serializer:json"`
+	DelegatedAuth       *DelegatedAuthConfig `json:"delegated_auth,omitempty" gorm:"type:jsonb;serializer:json"`
+	DelegatedAuthSecret string               `json:"-"`
+	ClientCertAuth      *ClientCertConfig    `json:"client_cert_auth,omitempty" gorm:"type:jsonb;serializer:json"`
+	Provisioning        *ProvisioningConfig  `json:"provisioning,omitempty" gorm:"type:jsonb;serializer:json"`
+	MappingRules        []MappingRule        `json:"mapping_rules,omitempty" gorm:"type:jsonb;serializer:json"`
+	Features            map[string]bool      `json:"features,omitempty" gorm:"type:jsonb;serializer:json"`
+	LoginIdentifiers    []LoginIdentifier    `json:"login_identifiers,omitempty" gorm:"type:jsonb;serializer:json"`
+	UsernamePolicy      *UsernamePolicy      `json:"username_policy,omitempty" gorm:"type:jsonb;serializer:json"`
+	LoginHooks          []LoginHook          `json:"login_hooks,omitempty" gorm:"type:jsonb;serializer:json"`
+	LoginHookSecret     string               `json:"-"`
+	// TokenSigningKey signs the tenant's HMAC tokens that belong to no
+	// environment, in place of the global JWT secret. It is sealed with
+	// the tenant's data key.
+	TokenSigningKey string `json:"-"`
+	// TokenAlgorithm is EdDSA for a tenant whose tokens are signed with the
+	// deployment's Ed25519 key rather than its token signing key. Tokens of
+	// its environments are still signed with their own keys.
+	TokenAlgorithm string `json:"token_algorithm,omitempty" gorm:"not null;default:''"`
+	// EnumerationProtection makes login and registration answer alike,
+	// in content and timing, whether or not the account exists.
+	EnumerationProtection bool `json:"enumeration_protection" gorm:"not null;default:false"`
+	// PrivacyMode keeps usernames, emails, and phone numbers out of the
+	// tenant's tokens and token validations, which identify users by their
+	// opaque IDs only.
+	PrivacyMode bool `json:"privacy_mode" gorm:"not null;default:false"`
+	// RejectBreachedPasswords refuses new passwords that appear in known
+	// data breaches.
+	RejectBreachedPasswords bool `json:"reject_breached_passwords" gorm:"not null;default:false"`
+	// MinPasswordScore is the lowest strength score, from 0 to 4, accepted
+	// for new passwords.
+	MinPasswordScore int `json:"min_password_score" gorm:"not null;default:0"`
+	// RestrictEmailDomains only lets users sign up with an email address
+	// on a domain the tenant has verified.
+	RestrictEmailDomains bool `json:"restrict_email_domains" gorm:"not null;default:false"`
+	// APIQuota caps the tenant's requests per minute across all endpoints;
+	// 0 means unlimited.
+	APIQuota int `json:"api_quota" gorm:"not null;default:0"`
+	// OneTimeTokenTypes are the token types that validate only once; a
+	// second presentation of the same token is refused.
+	OneTimeTokenTypes []TokenType `json:"one_time_token_types,omitempty" gorm:"type:jsonb;serializer:json"`
+	// DeviceVerificationURI is the page of the tenant's app where users
+	// enter the code a device shows them.
+	DeviceVerificationURI string `json:"device_verification_uri,omitempty"`
+	// AllowUnregisteredDeviceClients lets devices of clients the tenant has
+	// not registered sign in, under the tenant's token policy.
+	AllowUnregisteredDeviceClients bool `json:"allow_unregistered_device_clients" gorm:"not null;default:false"`
+	// Digest, when set, emails the tenant's admins a periodic summary.
+	Digest *DigestConfig `json:"digest,omitempty" gorm:"type:jsonb;serializer:json"`
+	// SSO, when set, keeps users signed in across the tenant's applications.
+	SSO *SSOConfig `json:"sso,omitempty" gorm:"type:jsonb;serializer:json"`
+	// TokenResponse, when set, reshapes the tenant's login responses.
+	TokenResponse *TokenResponseConfig `json:"token_response,omitempty" gorm:"type:jsonb;serializer:json"`
+	CreatedAt     time.Time            `json:"created_at"`
+	UpdatedAt     time.Time            `json:"updated_at"`
 }
 
 func (c *TenantConfig) Update(authMethod AuthMethod, jwtDuration, rateLimitIP, rateLimitUser, rateLimitWindow int) {
@@ -38,6 +187,26 @@ func (c *TenantConfig) Update(authMethod AuthMethod, jwtDuration, rateLimitIP, r
 	c.RateLimitWindow = rateLimitWindow
 }
 
+// IsOneTime reports whether tokens of type validate only once. Access tokens
+// never do.
+func (c *TenantConfig) IsOneTime(tokenType TokenType) bool {
+	return tokenType != TokenAccess && slices.Contains(c.OneTimeTokenTypes, tokenType)
+}
+
+// AcceptsIdentifier reports whether users may log in with the identifier.
+// Tenants that accept nothing explicitly accept usernames only.
+func (c *TenantConfig) AcceptsIdentifier(identifier LoginIdentifier) bool {
+	if len(c.LoginIdentifiers) == 0 {
+		return identifier == IdentifierUsername
+	}
+	for _, accepted := range c.LoginIdentifiers {
+		if accepted == identifier {
+			return true
+		}
+	}
+	return false
+}
+
 func DefaultConfig(tenantID string) *TenantConfig {
 	return &TenantConfig{
 		TenantID:        tenantID,
@@ -48,3 +217,7 @@ func DefaultConfig(tenantID string) *TenantConfig {
 		RateLimitWindow: 60,
 	}
 }
+
+func (t *Tenant) IsSuspended() bool {
+	return t.Status == TenantSuspended
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+// TenantKey is a version of a tenant's data encryption key, which seals the
+// tenant's secrets. It is stored wrapped by the master key. Only the active
+// version seals new values; retired versions are kept to open values sealed
+// before a rotation until they have been sealed again.
+type TenantKey struct {
+	ID         string    `json:"id" gorm:"primaryKey"`
+	TenantID   string    `json:"tenant_id" gorm:"not null;uniqueIndex:idx_tenant_keys_version"`
+	Version    int       `json:"version" gorm:"not null;uniqueIndex:idx_tenant_keys_version"`
+	WrappedKey string    `json:"-" gorm:"not null"`
+	Active     bool      `json:"active" gorm:"not null"`
+	CreatedAt  time.Time `json:"created_at"`
+}
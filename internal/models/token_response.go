@@ -0,0 +1,35 @@
+package models
+
+// LoginResponseFields are the fields of LoginResponse a TokenResponseConfig
+// can rename.
+var LoginResponseFields = []string{"token", "expires_in", "user"}
+
+// TokenResponseConfig reshapes the tenant's login responses for clients
+// written against another provider, which expect for example access_token
+// and token_type rather than token.
+type TokenResponseConfig struct {
+	// Rename maps fields of the response to the names clients expect.
+	Rename map[string]string `json:"rename,omitempty" validate:"max=3,dive,keys,oneof=token expires_in user,endkeys,required,max=64"`
+	// Extra are fields added to the response as they are.
+	Extra map[string]interface{} `json:"extra,omitempty" validate:"max=20,dive,keys,required,max=64,endkeys"`
+}
+
+// Shape lays out resp the way the tenant's clients expect.
+func (c *TokenResponseConfig) Shape(resp LoginResponse) map[string]interface{} {
+	shaped := map[string]interface{}{
+		"token":      resp.Token,
+		"expires_in": resp.ExpiresIn,
+		"user":       resp.User,
+	}
+	for _, field := range LoginResponseFields {
+		if name, ok := c.Rename[field]; ok {
+			value := shaped[field]
+			delete(shaped, field)
+			shaped[name] = value
+		}
+	}
+	for name, value := range c.Extra {
+		shaped[name] = value
+	}
+	return shaped
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"slices"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -14,29 +15,112 @@ const (
 	RoleReadOnly Role = "read_only"
 )
 
+// AdminScope narrows what an admin may manage. An admin without scopes holds
+// all of them.
+type AdminScope string
+
+const (
+	AdminScopeUsers  AdminScope = "users:manage"
+	AdminScopeConfig AdminScope = "config:manage"
+	AdminScopeAudit  AdminScope = "audit:view"
+)
+
+type UserStatus string
+
+const (
+	UserActive    UserStatus = "active"
+	UserSuspended UserStatus = "suspended"
+)
+
+// TokenType tells tokens that stand for a single action apart from access
+// tokens, which have none.
+type TokenType string
+
+const (
+	TokenAccess    TokenType = ""
+	TokenAction    TokenType = "action"
+	TokenMagicLink TokenType = "magic_link"
+	// TokenLogout tells a client that an SSO session it was issued tokens
+	// through has ended.
+	TokenLogout TokenType = "logout"
+)
+
 type Claims struct {
-	UserID   string `json:"user_id"`
-	TenantID string `json:"tenant_id"`
-	Role     Role   `json:"role"`
+	UserID        string                 `json:"user_id"`
+	TenantID      string                 `json:"tenant_id"`
+	EnvironmentID string                 `json:"environment_id,omitempty"`
+	Role          Role                   `json:"role"`
+	AdminScopes   []AdminScope           `json:"admin_scopes,omitempty"`
+	Scopes        []string               `json:"scopes,omitempty"`
+	Synthetic     bool                   `json:"synthetic,omitempty"`
+	Attributes    map[string]interface{} `json:"attrs,omitempty"`
+	Type          TokenType              `json:"token_type,omitempty"`
+	// SessionID and Events are set on logout tokens only.
+	SessionID string                 `json:"sid,omitempty"`
+	Events    map[string]interface{} `json:"events,omitempty"`
 	jwt.RegisteredClaims
 }
 
 type User struct {
-	ID        string    `json:"id" gorm:"primaryKey"`
-	TenantID  string    `json:"tenant_id" gorm:"not null;index"`
-	Username  string    `json:"username" gorm:"not null;uniqueIndex"`
-	Password  string    `json:"-" gorm:"not null"`
-	Phone     string    `json:"phone,omitempty" gorm:"uniqueIndex"`
-	Role      Role      `json:"role" gorm:"not null"`
-	LastLogin time.Time `json:"last_login"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID            string                 `json:"id" gorm:"primaryKey"`
+	TenantID      string                 `json:"tenant_id" gorm:"not null;uniqueIndex:idx_users_pool_username;uniqueIndex:idx_users_pool_email"`
+	EnvironmentID string                 `json:"environment_id,omitempty" gorm:"uniqueIndex:idx_users_pool_username;uniqueIndex:idx_users_pool_email"`
+	Username      string                 `json:"username" gorm:"not null;uniqueIndex:idx_users_pool_username"`
+	Email         string                 `json:"email,omitempty" gorm:"uniqueIndex:idx_users_pool_email,where:email <> ''"`
+	Password      string                 `json:"-" gorm:"not null"`
+	Phone         string                 `json:"phone,omitempty" gorm:"uniqueIndex:idx_users_phone,where:phone <> ''"`
+	Role          Role                   `json:"role" gorm:"not null"`
+	Status        UserStatus             `json:"status" gorm:"not null;default:active"`
+	AdminScopes   []AdminScope           `json:"admin_scopes,omitempty" gorm:"type:jsonb;serializer:json"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty" gorm:"type:jsonb;serializer:json;index:idx_users_attributes,type:gin"`
+	Claims        map[string]interface{} `json:"-" gorm:"-"`
+	LastLogin     time.Time              `json:"last_login"`
+	CreatedAt     time.Time              `json:"created_at"`
+	UpdatedAt     time.Time              `json:"updated_at"`
+}
+
+// HasAdminScope reports whether the token belongs to an admin holding scope.
+func (c *Claims) HasAdminScope(scope AdminScope) bool {
+	return c.Role == RoleAdmin && (len(c.AdminScopes) == 0 || slices.Contains(c.AdminScopes, scope))
+}
+
+// identifierClaims are attribute claims that name who a user is rather than
+// describe them.
+var identifierClaims = []string{"username", "preferred_username", "email", "phone", "phone_number", "name"}
+
+// StripIdentifiers drops the attribute claims that could identify user: the
+// well-known identifier claims and any claim repeating the user's username,
+// email, or phone. The token then names the user by their opaque ID alone.
+func (c *Claims) StripIdentifiers(user *User) {
+	if len(c.Attributes) == 0 {
+		return
+	}
+	kept := make(map[string]interface{}, len(c.Attributes))
+	for name, value := range c.Attributes {
+		if slices.Contains(identifierClaims, name) {
+			continue
+		}
+		if s, ok := value.(string); ok && s != "" && (s == user.Username || s == user.Email || s == user.Phone) {
+			continue
+		}
+		kept[name] = value
+	}
+	c.Attributes = kept
+}
+
+func (u *User) IsSuspended() bool {
+	return u.Status == UserSuspended
 }
 
 type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Phone    string `json:"phone,omitempty"`
+	Username         string   `json:"username"`
+	Email            string   `json:"email,omitempty"`
+	Password         string   `json:"password"`
+	Phone            string   `json:"phone,omitempty"`
+	AcceptedPolicies []string `json:"accepted_policies,omitempty"`
+	// ClientID is the registered client the user signs in to, whose token
+	// policy the token follows.
+	ClientID string `json:"client_id,omitempty"`
 }
 
 type LoginResponse struct {
@@ -44,3 +128,17 @@ type LoginResponse struct {
 	ExpiresIn int    `json:"expires_in"`
 	User      User   `json:"user"`
 }
+
+type RegisterRequest struct {
+	Username   string                 `json:"username" validate:"required,min=3,max=64"`
+	Password   string                 `json:"password" validate:"required,min=8,max=72"`
+	Email      string                 `json:"email,omitempty" validate:"omitempty,email,max=254"`
+	Phone      string                 `json:"phone,omitempty" validate:"omitempty,e164"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+type PasswordStrengthRequest struct {
+	Password string `json:"password" validate:"required,max=72"`
+	Username string `json:"username,omitempty" validate:"max=64"`
+	Email    string `json:"email,omitempty" validate:"max=254"`
+}
@@ -0,0 +1,71 @@
+// Package notify delivers notifications to people, such as the digests
+// emailed to tenant admins.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Message is a plain text notification.
+type Message struct {
+	To      []string
+	Subject string
+	Body    string
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, msg Message) error
+}
+
+// SMTP emails notifications through a mail server, authenticating with
+// PLAIN when a username is set.
+type SMTP struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTP(host, port, username, password, from string) *SMTP {
+	n := &SMTP{
+		addr: net.JoinHostPort(host, port),
+		from: from,
+	}
+	if username != "" {
+		n.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return n
+}
+
+func (n *SMTP) Notify(ctx context.Context, msg Message) error {
+	if len(msg.To) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", n.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	if err := smtp.SendMail(n.addr, n.auth, n.from, msg.To, []byte(b.String())); err != nil {
+		return fmt.Errorf("send mail to %s: %w", strings.Join(msg.To, ", "), err)
+	}
+	return nil
+}
+
+// Log writes notifications to the log instead of sending them, for
+// deployments without a mail server.
+type Log struct{}
+
+func (Log) Notify(ctx context.Context, msg Message) error {
+	log.Printf("notify: %q to %s:\n%s", msg.Subject, strings.Join(msg.To, ", "), msg.Body)
+	return nil
+}
@@ -0,0 +1,124 @@
+// Package offboarding deletes tenants, first keeping an encrypted archive of
+// their users, configuration, and audit log in a blob store when asked to.
+package offboarding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tajious/heimdall/internal/blob"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/transfer"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+// Prefix is where archives are kept in the blob store.
+const Prefix = "tenant-archives/"
+
+var ErrArchivingDisabled = errors.New("tenant archives are not configured")
+
+type Result struct {
+	TenantID string   `json:"tenant_id"`
+	Archive  *Archive `json:"archive,omitempty"`
+}
+
+// Archive describes where the archive of a deleted tenant was kept. It can
+// be restored with the import-tenant command and the archive passphrase.
+type Archive struct {
+	Key       string     `json:"key"`
+	Size      int        `json:"size"`
+	Users     int        `json:"users"`
+	AuditLogs int        `json:"audit_logs"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type Offboarder struct {
+	store      storage.Storage
+	secrets    *vault.Vault
+	blobs      blob.Store
+	passphrase string
+	ttl        time.Duration
+}
+
+// NewOffboarder keeps archives in blobs, sealed with passphrase, for ttl; a
+// negative ttl keeps them forever. Archiving is disabled when blobs is nil
+// or passphrase empty.
+func NewOffboarder(store storage.Storage, secrets *vault.Vault, blobs blob.Store, passphrase string, ttl time.Duration) *Offboarder {
+	return &Offboarder{
+		store:      store,
+		secrets:    secrets,
+		blobs:      blobs,
+		passphrase: passphrase,
+		ttl:        ttl,
+	}
+}
+
+func (o *Offboarder) ArchivingEnabled() bool {
+	return o.blobs != nil && o.passphrase != ""
+}
+
+// Delete deletes a tenant and all of its data. With archive set, the tenant
+// is archived first and is left untouched when that fails.
+func (o *Offboarder) Delete(ctx context.Context, tenantID string, archive bool) (*Result, error) {
+	ctx = storage.WithTenant(ctx, tenantID)
+	result := &Result{TenantID: tenantID}
+	if archive {
+		if !o.ArchivingEnabled() {
+			return nil, ErrArchivingDisabled
+		}
+		var err error
+		if result.Archive, err = o.archive(ctx, tenantID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := o.store.DeleteTenant(ctx, tenantID); err != nil {
+		return nil, err
+	}
+	if result.Archive != nil {
+		log.Printf("Tenant %s deleted, archived to %s", tenantID, result.Archive.Key)
+	} else {
+		log.Printf("Tenant %s deleted", tenantID)
+	}
+	return result, nil
+}
+
+func (o *Offboarder) archive(ctx context.Context, tenantID string) (*Archive, error) {
+	exported, err := transfer.Export(ctx, o.store, o.secrets, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := transfer.AddAuditLogs(ctx, o.store, exported); err != nil {
+		return nil, err
+	}
+	sealed, err := transfer.Seal(exported, o.passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("seal archive: %w", err)
+	}
+
+	key := Prefix + tenantID + "/" + exported.ExportedAt.Format("20060102T150405Z") + ".archive"
+	if err := o.blobs.Put(ctx, key, sealed); err != nil {
+		return nil, fmt.Errorf("upload archive: %w", err)
+	}
+
+	archive := &Archive{
+		Key:       key,
+		Size:      len(sealed),
+		Users:     len(exported.Users),
+		AuditLogs: len(exported.AuditLogs),
+	}
+	if o.ttl >= 0 {
+		expiresAt := exported.ExportedAt.Add(o.ttl)
+		archive.ExpiresAt = &expiresAt
+	}
+	return archive, nil
+}
+
+// Purge deletes the archives kept since before olderThan, for the
+// retention manager.
+func (o *Offboarder) Purge(ctx context.Context, olderThan time.Time) (int64, error) {
+	return blob.PurgeOlder(ctx, o.blobs, Prefix, olderThan)
+}
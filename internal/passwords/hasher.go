@@ -0,0 +1,126 @@
+package passwords
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/tajious/heimdall/internal/metrics"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrQueueTimeout = errors.New("password hashing queue timeout")
+	ErrMismatch     = errors.New("password does not match")
+)
+
+type Hasher struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+	cost         int
+
+	dummyOnce sync.Once
+	dummyHash []byte
+
+	queueDepth *metrics.Gauge
+	inUse      *metrics.Gauge
+	timeouts   *metrics.Counter
+}
+
+func NewHasher(workers int, queueTimeout time.Duration, registry *metrics.Registry) *Hasher {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	return &Hasher{
+		slots:        make(chan struct{}, workers),
+		queueTimeout: queueTimeout,
+		cost:         bcrypt.DefaultCost,
+		queueDepth:   registry.Gauge("heimdall_password_hash_queue_depth", "Password hashing requests waiting for a worker.").WithLabels(),
+		inUse:        registry.Gauge("heimdall_password_hash_workers_busy", "Password hashing workers currently busy.").WithLabels(),
+		timeouts:     registry.Counter("heimdall_password_hash_queue_timeouts_total", "Password hashing requests that timed out waiting for a worker.").WithLabels(),
+	}
+}
+
+// Compare checks password against a bcrypt hash, or against a hash imported
+// from another provider.
+func (h *Hasher) Compare(ctx context.Context, hash, password string) error {
+	return h.run(ctx, func() error {
+		if !isBcrypt(hash) {
+			return compareLegacy(hash, password)
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			return ErrMismatch
+		}
+		return nil
+	})
+}
+
+// CompareDummy spends as long as Compare does against a real hash, so
+// requests for unknown accounts cannot be told apart by their timing. It
+// always reports a mismatch.
+func (h *Hasher) CompareDummy(ctx context.Context, password string) error {
+	h.dummyOnce.Do(func() {
+		h.dummyHash, _ = bcrypt.GenerateFromPassword([]byte("heimdall-dummy-password"), h.cost)
+	})
+	return h.run(ctx, func() error {
+		bcrypt.CompareHashAndPassword(h.dummyHash, []byte(password))
+		return ErrMismatch
+	})
+}
+
+func (h *Hasher) Hash(ctx context.Context, password string) (string, error) {
+	var hash []byte
+	err := h.run(ctx, func() error {
+		var err error
+		hash, err = bcrypt.GenerateFromPassword([]byte(password), h.cost)
+		return err
+	})
+	return string(hash), err
+}
+
+func (h *Hasher) run(ctx context.Context, work func() error) error {
+	if err := h.acquire(ctx); err != nil {
+		return err
+	}
+	defer h.release()
+
+	return work()
+}
+
+func (h *Hasher) acquire(ctx context.Context) error {
+	select {
+	case h.slots <- struct{}{}:
+		h.inUse.Inc()
+		return nil
+	default:
+	}
+
+	h.queueDepth.Inc()
+	defer h.queueDepth.Dec()
+
+	var timeout <-chan time.Time
+	if h.queueTimeout > 0 {
+		timer := time.NewTimer(h.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+		h.inUse.Inc()
+		return nil
+	case <-timeout:
+		h.timeouts.Inc()
+		return ErrQueueTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *Hasher) release() {
+	<-h.slots
+	h.inUse.Dec()
+}
@@ -0,0 +1,209 @@
+package passwords
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Users imported from another provider keep the hash it gave them until
+// they first log in, when their password is checked against it and hashed
+// anew with bcrypt. Such hashes are stored as $<scheme>$<fields>, with
+// binary fields in standard base64; MD5-crypt hashes keep their own $1$
+// form.
+const (
+	SchemePBKDF2SHA1     = "pbkdf2-sha1"
+	SchemePBKDF2SHA256   = "pbkdf2-sha256"
+	SchemePBKDF2SHA512   = "pbkdf2-sha512"
+	SchemeFirebaseScrypt = "firebase-scrypt"
+	SchemeScrypt         = "scrypt"
+	SchemeSHA1           = "sha1"
+	SchemeMD5Crypt       = "1"
+)
+
+var ErrUnknownScheme = errors.New("password hash has an unknown scheme")
+
+var pbkdf2Digests = map[string]func() hash.Hash{
+	SchemePBKDF2SHA1:   sha1.New,
+	SchemePBKDF2SHA256: sha256.New,
+	SchemePBKDF2SHA512: sha512.New,
+}
+
+// PBKDF2Hash encodes a PBKDF2 hash of scheme, one of the SchemePBKDF2
+// constants.
+func PBKDF2Hash(scheme string, iterations int, salt, key []byte) (string, error) {
+	if _, ok := pbkdf2Digests[scheme]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownScheme, scheme)
+	}
+	if iterations < 1 {
+		return "", errors.New("pbkdf2 needs at least one iteration")
+	}
+	return encodeLegacy(scheme, strconv.Itoa(iterations), b64(salt), b64(key)), nil
+}
+
+// ScryptHash encodes a scrypt hash with a cost of 2^logN.
+func ScryptHash(logN, r, p int, salt, key []byte) (string, error) {
+	if logN < 1 || logN > 20 || r < 1 || p < 1 {
+		return "", errors.New("scrypt needs a log2 cost of 1 to 20, and a block size and parallelization of at least 1")
+	}
+	return encodeLegacy(SchemeScrypt, strconv.Itoa(logN), strconv.Itoa(r), strconv.Itoa(p), b64(salt), b64(key)), nil
+}
+
+// SHA1Hash encodes a SHA-1 digest of the salt followed by the password. The
+// salt may be empty, for digests of the password alone.
+func SHA1Hash(salt, digest []byte) (string, error) {
+	if len(digest) != sha1.Size {
+		return "", errors.New("sha1 digest must be 20 bytes")
+	}
+	return encodeLegacy(SchemeSHA1, b64(salt), b64(digest)), nil
+}
+
+// FirebaseScryptParams are the hash parameters of a Firebase project, shown
+// in its console next to the password hash export.
+type FirebaseScryptParams struct {
+	SignerKey     []byte
+	SaltSeparator []byte
+	Rounds        int
+	MemCost       int
+}
+
+// FirebaseScryptHash encodes a hash of Firebase's modified scrypt, which
+// keeps the project's parameters alongside the user's salt.
+func FirebaseScryptHash(params FirebaseScryptParams, salt, key []byte) (string, error) {
+	if len(params.SignerKey) == 0 || params.Rounds < 1 || params.MemCost < 1 || params.MemCost > 20 {
+		return "", errors.New("firebase scrypt needs a signer key, rounds, and a mem cost of 1 to 20")
+	}
+	return encodeLegacy(SchemeFirebaseScrypt, strconv.Itoa(params.Rounds), strconv.Itoa(params.MemCost),
+		b64(params.SignerKey), b64(params.SaltSeparator), b64(salt), b64(key)), nil
+}
+
+// NeedsRehash reports whether hash is not a bcrypt hash, and should be
+// replaced once the password it was made from is known.
+func NeedsRehash(hash string) bool {
+	return !isBcrypt(hash)
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func encodeLegacy(scheme string, fields ...string) string {
+	return "$" + scheme + "$" + strings.Join(fields, "$")
+}
+
+func b64(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// compareLegacy checks password against a hash imported from another
+// provider. A hash it cannot read matches no password, as with bcrypt.
+func compareLegacy(encoded, password string) error {
+	fields := strings.Split(strings.TrimPrefix(encoded, "$"), "$")
+	scheme, fields := fields[0], fields[1:]
+
+	var expected, actual []byte
+	var ok bool
+	switch scheme {
+	case SchemePBKDF2SHA1, SchemePBKDF2SHA256, SchemePBKDF2SHA512:
+		expected, actual, ok = comparePBKDF2(scheme, fields, password)
+	case SchemeFirebaseScrypt:
+		expected, actual, ok = compareFirebaseScrypt(fields, password)
+	case SchemeScrypt:
+		expected, actual, ok = compareScrypt(fields, password)
+	case SchemeSHA1:
+		expected, actual, ok = compareSHA1(fields, password)
+	case SchemeMD5Crypt:
+		expected, actual, ok = []byte(encoded), []byte(md5Crypt(password, encoded)), len(fields) == 2
+	}
+	if !ok || subtle.ConstantTimeCompare(expected, actual) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+func comparePBKDF2(scheme string, fields []string, password string) (expected, actual []byte, ok bool) {
+	if len(fields) != 3 {
+		return nil, nil, false
+	}
+	iterations, iterationsErr := strconv.Atoi(fields[0])
+	salt, saltErr := base64.StdEncoding.DecodeString(fields[1])
+	expected, keyErr := base64.StdEncoding.DecodeString(fields[2])
+	if errors.Join(iterationsErr, saltErr, keyErr) != nil || iterations < 1 || len(expected) == 0 {
+		return nil, nil, false
+	}
+	return expected, pbkdf2.Key([]byte(password), salt, iterations, len(expected), pbkdf2Digests[scheme]), true
+}
+
+func compareScrypt(fields []string, password string) (expected, actual []byte, ok bool) {
+	if len(fields) != 5 {
+		return nil, nil, false
+	}
+	logN, logNErr := strconv.Atoi(fields[0])
+	r, rErr := strconv.Atoi(fields[1])
+	p, pErr := strconv.Atoi(fields[2])
+	salt, saltErr := base64.StdEncoding.DecodeString(fields[3])
+	expected, keyErr := base64.StdEncoding.DecodeString(fields[4])
+	if errors.Join(logNErr, rErr, pErr, saltErr, keyErr) != nil || logN < 1 || logN > 20 || len(expected) == 0 {
+		return nil, nil, false
+	}
+	actual, err := scrypt.Key([]byte(password), salt, 1<<logN, r, p, len(expected))
+	if err != nil {
+		return nil, nil, false
+	}
+	return expected, actual, true
+}
+
+func compareSHA1(fields []string, password string) (expected, actual []byte, ok bool) {
+	if len(fields) != 2 {
+		return nil, nil, false
+	}
+	salt, saltErr := base64.StdEncoding.DecodeString(fields[0])
+	expected, digestErr := base64.StdEncoding.DecodeString(fields[1])
+	if errors.Join(saltErr, digestErr) != nil {
+		return nil, nil, false
+	}
+	digest := sha1.Sum(append(salt, password...))
+	return expected, digest[:], true
+}
+
+// compareFirebaseScrypt derives a key from the password and the salt
+// followed by the project's separator, and encrypts the project's signer key
+// with it in AES-256-CTR under a zero IV; the result is the user's hash.
+func compareFirebaseScrypt(fields []string, password string) (expected, actual []byte, ok bool) {
+	if len(fields) != 6 {
+		return nil, nil, false
+	}
+	rounds, roundsErr := strconv.Atoi(fields[0])
+	memCost, memCostErr := strconv.Atoi(fields[1])
+	signerKey, signerErr := base64.StdEncoding.DecodeString(fields[2])
+	separator, separatorErr := base64.StdEncoding.DecodeString(fields[3])
+	salt, saltErr := base64.StdEncoding.DecodeString(fields[4])
+	expected, keyErr := base64.StdEncoding.DecodeString(fields[5])
+	if errors.Join(roundsErr, memCostErr, signerErr, separatorErr, saltErr, keyErr) != nil || memCost < 1 || memCost > 20 {
+		return nil, nil, false
+	}
+
+	derived, err := scrypt.Key([]byte(password), append(salt, separator...), 1<<memCost, rounds, 1, 32)
+	if err != nil {
+		return nil, nil, false
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, nil, false
+	}
+	actual = make([]byte, len(signerKey))
+	cipher.NewCTR(block, make([]byte, aes.BlockSize)).XORKeyStream(actual, signerKey)
+	return expected, actual, true
+}
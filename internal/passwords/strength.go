@@ -0,0 +1,321 @@
+package passwords
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// MaxScore is the score of the strongest passwords.
+const MaxScore = 4
+
+// Strength is an estimate of how hard a password is to guess, in the spirit
+// of zxcvbn: Score runs from 0 (trivial) to MaxScore (very strong), and the
+// warning and suggestions tell the user what to change.
+type Strength struct {
+	Score        int      `json:"score"`
+	GuessesLog10 float64  `json:"guesses_log10"`
+	Warning      string   `json:"warning,omitempty"`
+	Suggestions  []string `json:"suggestions"`
+}
+
+// Guess counts, as powers of ten, separating the scores.
+var scoreThresholds = []float64{3, 6, 8, 10}
+
+// commonPasswords is ordered by popularity; the rank of a match is roughly
+// how many guesses an attacker needs to reach it.
+var commonPasswords = []string{
+	"password", "123456", "qwerty", "letmein", "welcome", "admin", "dragon",
+	"monkey", "football", "baseball", "iloveyou", "master", "sunshine",
+	"princess", "shadow", "superman", "michael", "trustno", "login",
+	"starwars", "hello", "freedom", "whatever", "charlie", "batman",
+	"passw0rd", "secret", "summer", "winter", "spring", "autumn", "flower",
+	"hunter", "soccer", "hockey", "killer", "george", "jordan", "pepper",
+	"ginger", "cheese", "computer", "internet", "love", "angel", "abc",
+	"test", "guest", "default", "root", "access", "changeme", "mustang",
+	"jessica", "daniel", "thomas", "robert", "matrix", "cookie", "banana",
+	"orange", "purple", "silver", "golden", "diamond", "tiger", "lucky",
+	"family", "forever", "heimdall",
+}
+
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./",
+	"qwertzuiop", "yxcvbnm", "azertyuiop", "qsdfghjklm", "wxcvbn",
+}
+
+var leetSubstitutions = strings.NewReplacer(
+	"@", "a", "4", "a", "8", "b", "(", "c", "3", "e", "6", "g", "1", "i",
+	"!", "i", "|", "l", "0", "o", "$", "s", "5", "s", "7", "t", "+", "t",
+	"2", "z",
+)
+
+type patternKind int
+
+const (
+	patternDictionary patternKind = iota
+	patternUserInput
+	patternRepeat
+	patternSequence
+	patternKeyboard
+)
+
+type match struct {
+	kind   patternKind
+	length int
+	log10  float64
+	leet   bool
+}
+
+// EstimateStrength scores password. userInputs, such as the username and
+// email, are treated as words an attacker would try first.
+func EstimateStrength(password string, userInputs ...string) Strength {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return Strength{
+			Warning:     "Password is empty",
+			Suggestions: []string{"Use a few words, avoid common phrases"},
+		}
+	}
+
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	unleet := []rune(leetSubstitutions.Replace(string(lower)))
+	if len(unleet) != len(lower) {
+		unleet = lower
+	}
+	inputs := normalizeInputs(userInputs)
+	cardinality := charsetCardinality(runes)
+
+	var total float64
+	var matches []match
+	for i := 0; i < len(runes); {
+		m, ok := longestMatch(lower, unleet, i, inputs)
+		if !ok {
+			total += math.Log10(cardinality)
+			i++
+			continue
+		}
+		total += m.log10 + casingLog10(runes[i:i+m.length])
+		matches = append(matches, m)
+		i += m.length
+	}
+
+	score := 0
+	for score < len(scoreThresholds) && total >= scoreThresholds[score] {
+		score++
+	}
+
+	strength := Strength{
+		Score:        score,
+		GuessesLog10: math.Round(total*100) / 100,
+		Suggestions:  []string{},
+	}
+	if score < MaxScore {
+		strength.Warning, strength.Suggestions = feedback(matches, len(runes))
+	}
+	return strength
+}
+
+func longestMatch(lower, unleet []rune, start int, inputs []string) (match, bool) {
+	best := match{}
+	consider := func(m match) {
+		if m.length > best.length || (m.length == best.length && m.log10 < best.log10) {
+			best = m
+		}
+	}
+
+	rest := string(lower[start:])
+	restUnleet := string(unleet[start:])
+	for rank, word := range commonPasswords {
+		if strings.HasPrefix(rest, word) {
+			consider(match{kind: patternDictionary, length: len([]rune(word)), log10: math.Log10(float64(rank + 2))})
+		} else if strings.HasPrefix(restUnleet, word) {
+			consider(match{kind: patternDictionary, length: len([]rune(word)), log10: math.Log10(float64(rank+2)) + 1, leet: true})
+		}
+	}
+	for _, input := range inputs {
+		if strings.HasPrefix(rest, input) || strings.HasPrefix(restUnleet, input) {
+			consider(match{kind: patternUserInput, length: len([]rune(input)), log10: 1})
+		}
+	}
+
+	if n := repeatLength(lower, start); n >= 3 {
+		consider(match{kind: patternRepeat, length: n, log10: math.Log10(float64(26 * n))})
+	}
+	if n := sequenceLength(lower, start); n >= 3 {
+		consider(match{kind: patternSequence, length: n, log10: math.Log10(float64(26 * 2 * n))})
+	}
+	if n := keyboardLength(lower, start); n >= 4 {
+		consider(match{kind: patternKeyboard, length: n, log10: math.Log10(float64(len(keyboardRows) * 2 * 10 * n))})
+	}
+
+	return best, best.length > 0
+}
+
+func repeatLength(s []rune, start int) int {
+	n := 1
+	for start+n < len(s) && s[start+n] == s[start] {
+		n++
+	}
+	return n
+}
+
+// sequenceLength measures runs like abc, 321 or 2468 with a constant step.
+func sequenceLength(s []rune, start int) int {
+	if start+1 >= len(s) {
+		return 1
+	}
+	step := s[start+1] - s[start]
+	if step == 0 || step > 2 || step < -2 {
+		return 1
+	}
+	n := 2
+	for start+n < len(s) && s[start+n]-s[start+n-1] == step {
+		n++
+	}
+	return n
+}
+
+func keyboardLength(s []rune, start int) int {
+	best := 1
+	for _, row := range keyboardRows {
+		for _, r := range []string{row, reverse(row)} {
+			idx := strings.IndexRune(r, s[start])
+			if idx < 0 {
+				continue
+			}
+			row := []rune(r)
+			n := 1
+			for start+n < len(s) && idx+n < len(row) && s[start+n] == row[idx+n] {
+				n++
+			}
+			if n > best {
+				best = n
+			}
+		}
+	}
+	return best
+}
+
+// casingLog10 charges for capitals beyond the obvious first letter.
+func casingLog10(segment []rune) float64 {
+	upper := 0
+	for _, r := range segment {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	switch {
+	case upper == 0, upper == len(segment):
+		return 0
+	case upper == 1 && unicode.IsUpper(segment[0]):
+		return math.Log10(2)
+	}
+	return float64(upper) * math.Log10(2)
+}
+
+func charsetCardinality(runes []rune) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	cardinality := 0.0
+	if lower {
+		cardinality += 26
+	}
+	if upper {
+		cardinality += 26
+	}
+	if digit {
+		cardinality += 10
+	}
+	if symbol {
+		cardinality += 33
+	}
+	if other {
+		cardinality += 100
+	}
+	return cardinality
+}
+
+func normalizeInputs(userInputs []string) []string {
+	var inputs []string
+	for _, input := range userInputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		if local, _, ok := strings.Cut(input, "@"); ok {
+			input = local
+		}
+		if len([]rune(input)) >= 3 {
+			inputs = append(inputs, input)
+		}
+	}
+	return inputs
+}
+
+func feedback(matches []match, length int) (string, []string) {
+	suggestions := []string{"Add another word or two. Uncommon words are better."}
+	warning := ""
+	for _, m := range matches {
+		switch m.kind {
+		case patternDictionary:
+			warning = "This is similar to a commonly used password"
+			if m.leet {
+				suggestions = append(suggestions, "Predictable substitutions like '@' instead of 'a' don't help very much")
+			}
+		case patternUserInput:
+			warning = "Avoid using your username or email in the password"
+		case patternRepeat:
+			if warning == "" {
+				warning = `Repeats like "aaa" are easy to guess`
+			}
+			suggestions = append(suggestions, "Avoid repeated words and characters")
+		case patternSequence:
+			if warning == "" {
+				warning = "Sequences like abc or 6543 are easy to guess"
+			}
+			suggestions = append(suggestions, "Avoid sequences")
+		case patternKeyboard:
+			if warning == "" {
+				warning = "Straight rows of keys are easy to guess"
+			}
+			suggestions = append(suggestions, "Use a longer keyboard pattern with more turns")
+		}
+	}
+	if length < 12 {
+		suggestions = append(suggestions, "Use a longer password")
+	}
+	return warning, dedupe(suggestions)
+}
+
+func dedupe(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	out := values[:0]
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
@@ -0,0 +1,241 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tajious/heimdall/internal/hooks"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"golang.org/x/sync/singleflight"
+)
+
+// A plugin is a WebAssembly module that exports its linear memory as
+// "memory", an "alloc(size i32) i32" function, and a function per login
+// stage it handles, named after the stage:
+//
+//	pre_login(ptr i32, len i32) i64
+//	post_login(ptr i32, len i32) i64
+//
+// Heimdall writes the hooks.Event as JSON into memory obtained from alloc and
+// calls the stage function, which returns the location of a hooks.Result as
+// JSON packed as ptr<<32 | len, or 0 to let the login through unchanged.
+//
+// Modules run sandboxed: they may not import anything, so they have no
+// access to the host, the network or the clock, and every call gets a fresh
+// instance.
+
+const (
+	wasmPageSize = 64 << 10
+	maxOutput    = 64 << 10
+)
+
+var stages = []models.LoginHookStage{models.PreLogin, models.PostLogin}
+
+var ErrInvalidModule = errors.New("invalid plugin module")
+
+// Limits bound what a plugin may use.
+type Limits struct {
+	MaxModuleSize int
+	MaxMemory     int
+}
+
+type Runtime struct {
+	store   storage.PluginRepo
+	runtime wazero.Runtime
+	limits  Limits
+
+	// compiling loads and compiles each module once however many logins
+	// need it at the same time, without holding mu meanwhile.
+	compiling singleflight.Group
+
+	mu       sync.Mutex
+	compiled map[string]wazero.CompiledModule
+}
+
+func NewRuntime(ctx context.Context, store storage.PluginRepo, limits Limits) *Runtime {
+	config := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(limits.MaxMemory / wasmPageSize)).
+		WithCloseOnContextDone(true)
+	return &Runtime{
+		store:    store,
+		runtime:  wazero.NewRuntimeWithConfig(ctx, config),
+		limits:   limits,
+		compiled: make(map[string]wazero.CompiledModule),
+	}
+}
+
+func (r *Runtime) Close(ctx context.Context) error {
+	return r.runtime.Close(ctx)
+}
+
+// Inspect validates a module against the plugin ABI and returns the login
+// stages it handles.
+func (r *Runtime) Inspect(ctx context.Context, wasm []byte) ([]models.LoginHookStage, error) {
+	if len(wasm) > r.limits.MaxModuleSize {
+		return nil, fmt.Errorf("%w: larger than %d bytes", ErrInvalidModule, r.limits.MaxModuleSize)
+	}
+	compiled, err := r.runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidModule, err)
+	}
+	defer compiled.Close(ctx)
+
+	if len(compiled.ImportedFunctions()) > 0 || len(compiled.ImportedMemories()) > 0 {
+		return nil, fmt.Errorf("%w: modules may not import anything", ErrInvalidModule)
+	}
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		return nil, fmt.Errorf("%w: memory is not exported", ErrInvalidModule)
+	}
+
+	exported := compiled.ExportedFunctions()
+	if !hasSignature(exported["alloc"], []api.ValueType{api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}) {
+		return nil, fmt.Errorf("%w: alloc(i32) i32 is not exported", ErrInvalidModule)
+	}
+	var found []models.LoginHookStage
+	for _, stage := range stages {
+		fn, ok := exported[string(stage)]
+		if !ok {
+			continue
+		}
+		if !hasSignature(fn, []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI64}) {
+			return nil, fmt.Errorf("%w: %s must be (i32, i32) i64", ErrInvalidModule, stage)
+		}
+		found = append(found, stage)
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("%w: no login stage is exported", ErrInvalidModule)
+	}
+	return found, nil
+}
+
+// TenantHooks returns the active plugins of the tenant that handle stage.
+func (r *Runtime) TenantHooks(ctx context.Context, tenant *models.Tenant, stage models.LoginHookStage) ([]hooks.Plugin, error) {
+	modules, err := r.store.ListPluginModules(ctx, tenant.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var plugins []hooks.Plugin
+	for _, module := range modules {
+		if !module.Active || !slices.Contains(module.Stages, stage) {
+			continue
+		}
+		tenantID, moduleID := module.TenantID, module.ID
+		plugins = append(plugins, hooks.Plugin{
+			Name:          module.Name + "@" + strconv.Itoa(module.Version),
+			Stage:         stage,
+			Timeout:       time.Duration(module.TimeoutMS) * time.Millisecond,
+			FailurePolicy: module.FailurePolicy,
+			Hook: hooks.HookFunc(func(ctx context.Context, event *hooks.Event) (*hooks.Result, error) {
+				return r.call(ctx, tenantID, moduleID, event)
+			}),
+		})
+	}
+	return plugins, nil
+}
+
+// Forget drops the compiled code of a module that is no longer active.
+func (r *Runtime) Forget(ctx context.Context, moduleID string) {
+	r.mu.Lock()
+	compiled, ok := r.compiled[moduleID]
+	delete(r.compiled, moduleID)
+	r.mu.Unlock()
+	if ok {
+		compiled.Close(ctx)
+	}
+}
+
+func (r *Runtime) call(ctx context.Context, tenantID, moduleID string, event *hooks.Event) (*hooks.Result, error) {
+	compiled, err := r.compile(ctx, tenantID, moduleID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every call gets its own anonymous instance, so plugins cannot keep
+	// state between logins or leak it across tenants.
+	instance, err := r.runtime.InstantiateModule(ctx, compiled, wazero.NewModuleConfig().WithName("").WithStartFunctions())
+	if err != nil {
+		return nil, err
+	}
+	defer instance.Close(ctx)
+
+	input, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	allocated, err := instance.ExportedFunction("alloc").Call(ctx, uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("alloc: %w", err)
+	}
+	ptr := uint32(allocated[0])
+	if !instance.Memory().Write(ptr, input) {
+		return nil, errors.New("alloc returned memory out of range")
+	}
+
+	packed, err := instance.ExportedFunction(string(event.Stage)).Call(ctx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", event.Stage, err)
+	}
+	if packed[0] == 0 {
+		return nil, nil
+	}
+
+	outPtr, outLen := uint32(packed[0]>>32), uint32(packed[0])
+	if outLen > maxOutput {
+		return nil, fmt.Errorf("result larger than %d bytes", maxOutput)
+	}
+	output, ok := instance.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, errors.New("result out of memory range")
+	}
+
+	var result hooks.Result
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("invalid result: %v", err)
+	}
+	return &result, nil
+}
+
+// compile returns the compiled code of a module version. Versions never
+// change once uploaded, so the code is cached by module ID.
+func (r *Runtime) compile(ctx context.Context, tenantID, moduleID string) (wazero.CompiledModule, error) {
+	r.mu.Lock()
+	compiled, ok := r.compiled[moduleID]
+	r.mu.Unlock()
+	if ok {
+		return compiled, nil
+	}
+
+	value, err, _ := r.compiling.Do(tenantID+"/"+moduleID, func() (interface{}, error) {
+		module, err := r.store.GetPluginModule(ctx, tenantID, moduleID)
+		if err != nil {
+			return nil, err
+		}
+		compiled, err := r.runtime.CompileModule(ctx, module.Module)
+		if err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		r.compiled[moduleID] = compiled
+		r.mu.Unlock()
+		return compiled, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(wazero.CompiledModule), nil
+}
+
+func hasSignature(fn api.FunctionDefinition, params, results []api.ValueType) bool {
+	return fn != nil && slices.Equal(fn.ParamTypes(), params) && slices.Equal(fn.ResultTypes(), results)
+}
@@ -0,0 +1,248 @@
+// Package redact strips secrets and personal data from request bodies before
+// they are logged, so no handler has to remember what must stay out of the
+// logs.
+package redact
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+const Redacted = "[REDACTED]"
+
+// maxLogged bounds the length of a logged body.
+const maxLogged = 2048
+
+// DefaultFields are dropped from every body. A field matches when its name,
+// ignoring case, underscores, and dashes, ends with one of them, so
+// new_password, clientSecret, and user_code are covered too.
+var DefaultFields = []string{
+	"password", "passwordhash", "passphrase", "secret", "token", "apikey",
+	"otp", "totp", "code", "recoverycodes", "signingkey", "encryptionkey", "privatekey",
+}
+
+// DefaultMasked keep only their last two characters.
+var DefaultMasked = []string{"phone", "phonenumber"}
+
+// Rule adds fields to redact from the bodies of one route, or omits its
+// bodies altogether.
+type Rule struct {
+	Omit   bool
+	Fields []string
+}
+
+type Redactor struct {
+	fields []string
+	masked []string
+	routes map[string]Rule
+}
+
+// New returns a redactor dropping fields and masking masked on top of the
+// defaults, and applying routes, keyed by "METHOD /path" or "/path" as the
+// route is registered.
+func New(fields, masked []string, routes map[string]Rule) *Redactor {
+	r := &Redactor{routes: routes}
+	for _, field := range append(DefaultFields, fields...) {
+		r.fields = append(r.fields, normalize(field))
+	}
+	for _, field := range append(DefaultMasked, masked...) {
+		r.masked = append(r.masked, normalize(field))
+	}
+	return r
+}
+
+// ParseRoutes reads rules such as
+// "POST /api/v1/tenants/:tenant_id/plugins=*;PATCH /api/v1/tenants/:tenant_id/users/:user_id/attributes=ssn,birthdate":
+// rules are separated by semicolons, and * omits the route's bodies.
+func ParseRoutes(value string) (map[string]Rule, error) {
+	routes := make(map[string]Rule)
+	for _, entry := range strings.Split(value, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		route, fields, ok := strings.Cut(entry, "=")
+		route = strings.Join(strings.Fields(route), " ")
+		if !ok || route == "" || strings.TrimSpace(fields) == "" {
+			return nil, fmt.Errorf("invalid rule %q, expected route=fields or route=*", entry)
+		}
+		rule := routes[route]
+		for _, field := range strings.Split(fields, ",") {
+			switch field = strings.TrimSpace(field); field {
+			case "":
+			case "*":
+				rule.Omit = true
+			default:
+				rule.Fields = append(rule.Fields, normalize(field))
+			}
+		}
+		routes[route] = rule
+	}
+	return routes, nil
+}
+
+// Body returns body as it can be logged for a request to path with method.
+// Bodies that cannot be parsed are never logged, since nothing could be
+// redacted from them.
+func (r *Redactor) Body(method, path, contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	rule, ok := r.routes[method+" "+path]
+	if !ok {
+		rule = r.routes[path]
+	}
+	if rule.Omit {
+		return fmt.Sprintf("[%d bytes not logged for this route]", len(body))
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var logged string
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var value interface{}
+		if err := json.Unmarshal(body, &value); err != nil {
+			return fmt.Sprintf("[%d bytes of invalid JSON not logged]", len(body))
+		}
+		data, err := json.Marshal(r.redact(value, rule.Fields))
+		if err != nil {
+			return fmt.Sprintf("[%d bytes not logged]", len(body))
+		}
+		logged = string(data)
+	case mediaType == "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return fmt.Sprintf("[%d bytes of invalid form not logged]", len(body))
+		}
+		for name, values := range form {
+			for i, value := range values {
+				form[name][i] = r.redactString(name, value, rule.Fields)
+			}
+		}
+		logged = form.Encode()
+	default:
+		return fmt.Sprintf("[%d bytes of %s not logged]", len(body), orUnknown(mediaType))
+	}
+
+	if len(logged) > maxLogged {
+		return logged[:maxLogged] + "...(truncated)"
+	}
+	return logged
+}
+
+// Value returns the value of a named column or field as it can be
+// recorded: dropped or masked by its name, and with the fields of a JSON
+// document redacted. Binary values only keep their size.
+func (r *Redactor) Value(name string, value interface{}) interface{} {
+	if valuer, ok := value.(driver.Valuer); ok {
+		var err error
+		if value, err = valuer.Value(); err != nil {
+			return Redacted
+		}
+	}
+	if value == nil {
+		return nil
+	}
+	switch {
+	case r.drops(name, nil):
+		return Redacted
+	case r.masks(name):
+		if s, ok := value.(string); ok {
+			return mask(s)
+		}
+		return Redacted
+	}
+
+	switch v := value.(type) {
+	case []byte:
+		var document interface{}
+		if json.Unmarshal(v, &document) != nil {
+			return fmt.Sprintf("[%d bytes]", len(v))
+		}
+		return r.redact(document, nil)
+	case string:
+		var document interface{}
+		if strings.HasPrefix(v, "{") || strings.HasPrefix(v, "[") {
+			if json.Unmarshal([]byte(v), &document) == nil {
+				return r.redact(document, nil)
+			}
+		}
+	}
+	return value
+}
+
+func (r *Redactor) redact(value interface{}, extra []string) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, field := range value {
+			switch {
+			case r.drops(name, extra):
+				value[name] = Redacted
+			case r.masks(name):
+				if s, ok := field.(string); ok {
+					value[name] = mask(s)
+				} else {
+					value[name] = Redacted
+				}
+			default:
+				value[name] = r.redact(field, extra)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = r.redact(item, extra)
+		}
+	}
+	return value
+}
+
+func (r *Redactor) redactString(name, value string, extra []string) string {
+	switch {
+	case r.drops(name, extra):
+		return Redacted
+	case r.masks(name):
+		return mask(value)
+	}
+	return value
+}
+
+func (r *Redactor) drops(name string, extra []string) bool {
+	return matches(normalize(name), r.fields) || matches(normalize(name), extra)
+}
+
+func (r *Redactor) masks(name string) bool {
+	return matches(normalize(name), r.masked)
+}
+
+func matches(name string, fields []string) bool {
+	for _, field := range fields {
+		if strings.HasSuffix(name, field) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+}
+
+// mask keeps the last two characters of value, enough to tell two phone
+// numbers apart.
+func mask(value string) string {
+	runes := []rune(value)
+	if len(runes) <= 4 {
+		return strings.Repeat("*", len(runes))
+	}
+	return strings.Repeat("*", len(runes)-2) + string(runes[len(runes)-2:])
+}
+
+func orUnknown(mediaType string) string {
+	if mediaType == "" {
+		return "unknown type"
+	}
+	return mediaType
+}
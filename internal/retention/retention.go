@@ -0,0 +1,88 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tajious/heimdall/internal/metrics"
+)
+
+const (
+	DataSessions             = "sessions"
+	DataOneTimeTokens        = "one_time_tokens"
+	DataDeviceAuthorizations = "device_authorizations"
+	DataAuditLogs            = "audit_logs"
+	DataRateLimits           = "rate_limits"
+
+	DataTenantArchives = "tenant_archives"
+	DataJobs           = "jobs"
+	DataExports        = "exports"
+)
+
+type Purger interface {
+	Purge(ctx context.Context, olderThan time.Time) (int64, error)
+}
+
+type PurgerFunc func(ctx context.Context, olderThan time.Time) (int64, error)
+
+func (f PurgerFunc) Purge(ctx context.Context, olderThan time.Time) (int64, error) {
+	return f(ctx, olderThan)
+}
+
+type policy struct {
+	dataType string
+	maxAge   time.Duration
+	purger   Purger
+}
+
+type Manager struct {
+	policies []policy
+	purged   *metrics.CounterVec
+	failures *metrics.CounterVec
+}
+
+func NewManager(registry *metrics.Registry) *Manager {
+	return &Manager{
+		purged:   registry.Counter("heimdall_retention_purged_total", "Rows purged by retention policies.", "data_type"),
+		failures: registry.Counter("heimdall_retention_failures_total", "Failed retention purge runs.", "data_type"),
+	}
+}
+
+func (m *Manager) Register(dataType string, maxAge time.Duration, purger Purger) {
+	if maxAge < 0 {
+		log.Printf("Retention for %s disabled", dataType)
+		return
+	}
+
+	m.policies = append(m.policies, policy{
+		dataType: dataType,
+		maxAge:   maxAge,
+		purger:   purger,
+	})
+}
+
+func (m *Manager) Run(ctx context.Context) error {
+	var firstErr error
+
+	for _, p := range m.policies {
+		cutoff := time.Now().Add(-p.maxAge)
+
+		count, err := p.purger.Purge(ctx, cutoff)
+		if err != nil {
+			m.failures.WithLabels(p.dataType).Inc()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("purge %s: %w", p.dataType, err)
+			}
+			continue
+		}
+
+		m.purged.WithLabels(p.dataType).Add(float64(count))
+		if count > 0 {
+			log.Printf("Retention purged %d %s older than %s", count, p.dataType, cutoff.Format(time.RFC3339))
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,48 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 10 * time.Second
+)
+
+// Do calls fn until it succeeds, backing off exponentially between attempts.
+// It gives up with the last error once maxWait has elapsed; a maxWait of zero
+// makes a single attempt.
+func Do(ctx context.Context, name string, maxWait time.Duration, fn func(ctx context.Context) error) error {
+	deadline := time.Now().Add(maxWait)
+	backoff := initialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("%s unavailable after %d attempts: %w", name, attempt, err)
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+
+		log.Printf("%s unavailable (attempt %d), retrying in %s: %v", name, attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package search
+
+import (
+	"context"
+	"log"
+
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+// backfillPageSize is how many users Backfill reads per page.
+const backfillPageSize = 500
+
+// IndexWrites keeps index up to date with every user written through store:
+// registrations, imports, batch updates, provisioning, and bootstrap alike.
+// A failure to index is logged and does not fail the write.
+func IndexWrites(store storage.Storage, index UserIndex) {
+	storage.OnUserWritten(store, func(ctx context.Context, user *models.User) {
+		if err := index.IndexUser(ctx, user); err != nil {
+			log.Printf("Failed to index user %s: %v", user.ID, err)
+		}
+	})
+}
+
+// Backfill indexes the users of every tenant whose index holds a different
+// number of users than storage, such as users written before the index was
+// set up. It returns how many users it indexed.
+func Backfill(ctx context.Context, store storage.Storage, index UserIndex) (int, error) {
+	indexed := 0
+	for page := 1; ; page++ {
+		tenants, _, err := store.ListTenants(ctx, page, backfillPageSize)
+		if err != nil {
+			return indexed, err
+		}
+		for _, tenant := range tenants {
+			n, err := backfillTenant(ctx, store, index, tenant.ID)
+			indexed += n
+			if err != nil {
+				return indexed, err
+			}
+		}
+		if len(tenants) < backfillPageSize {
+			return indexed, nil
+		}
+	}
+}
+
+func backfillTenant(ctx context.Context, store storage.Storage, index UserIndex, tenantID string) (int, error) {
+	ctx = storage.WithTenant(ctx, tenantID)
+	filter := storage.UserFilter{TenantID: tenantID, SortBy: "created_at", SortDir: "asc", Page: 1, PageSize: backfillPageSize}
+	users, total, err := store.ListUsers(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	count, err := index.CountUsers(ctx, tenantID)
+	if err != nil {
+		return 0, err
+	}
+	if count == total {
+		return 0, nil
+	}
+
+	indexed := 0
+	for {
+		for i := range users {
+			if err := index.IndexUser(ctx, &users[i]); err != nil {
+				return indexed, err
+			}
+			indexed++
+		}
+		if len(users) < backfillPageSize {
+			return indexed, nil
+		}
+		filter.Page++
+		if users, _, err = store.ListUsers(ctx, filter); err != nil {
+			return indexed, err
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tajious/heimdall/internal/models"
+)
+
+// errNotFound is returned for the 404 of an index or scroll that does not
+// exist.
+var errNotFound = errors.New("opensearch: not found")
+
+// scrollSize is how many hits a search reads per round trip.
+const scrollSize = 1000
+
+// scrollTTL is how long OpenSearch keeps a search open between round trips.
+const scrollTTL = "1m"
+
+type UserIndex interface {
+	IndexUser(ctx context.Context, user *models.User) error
+	// SearchUserIDs returns the IDs of every user of the tenant matching
+	// query, so storage can count and page through all of them.
+	SearchUserIDs(ctx context.Context, tenantID, query string) ([]string, error)
+	// CountUsers returns how many users of the tenant are indexed.
+	CountUsers(ctx context.Context, tenantID string) (int64, error)
+}
+
+type OpenSearch struct {
+	baseURL  string
+	index    string
+	username string
+	password string
+	client   *http.Client
+}
+
+func NewOpenSearch(baseURL, index, username, password string) *OpenSearch {
+	return &OpenSearch{
+		baseURL:  baseURL,
+		index:    index,
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+type userDocument struct {
+	TenantID   string                 `json:"tenant_id"`
+	Username   string                 `json:"username"`
+	Phone      string                 `json:"phone,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+func (o *OpenSearch) IndexUser(ctx context.Context, user *models.User) error {
+	doc := userDocument{
+		TenantID:   user.TenantID,
+		Username:   user.Username,
+		Phone:      user.Phone,
+		Attributes: user.Attributes,
+	}
+
+	path := fmt.Sprintf("/%s/_doc/%s", url.PathEscape(o.index), url.PathEscape(user.ID))
+	return o.do(ctx, http.MethodPut, path, doc, nil)
+}
+
+func (o *OpenSearch) SearchUserIDs(ctx context.Context, tenantID, query string) ([]string, error) {
+	body := map[string]interface{}{
+		"size":    scrollSize,
+		"_source": false,
+		"sort":    []string{"_doc"},
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{tenantFilter(tenantID)},
+				"must": []interface{}{
+					map[string]interface{}{
+						"multi_match": map[string]interface{}{
+							"query":     query,
+							"fields":    []string{"username^3", "phone", "attributes.*"},
+							"fuzziness": "AUTO",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	var result scrollResult
+	path := fmt.Sprintf("/%s/_search?scroll=%s", url.PathEscape(o.index), scrollTTL)
+	if err := o.do(ctx, http.MethodPost, path, body, &result); err != nil {
+		if errors.Is(err, errNotFound) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	defer o.clearScroll(result.ScrollID)
+
+	var ids []string
+	for len(result.Hits.Hits) > 0 {
+		for _, hit := range result.Hits.Hits {
+			ids = append(ids, hit.ID)
+		}
+		next := map[string]string{"scroll": scrollTTL, "scroll_id": result.ScrollID}
+		result = scrollResult{}
+		if err := o.do(ctx, http.MethodPost, "/_search/scroll", next, &result); err != nil {
+			return nil, err
+		}
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	return ids, nil
+}
+
+type scrollResult struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []struct {
+			ID string `json:"_id"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// clearScroll frees a finished search rather than leaving it open until it
+// expires.
+func (o *OpenSearch) clearScroll(scrollID string) {
+	if scrollID == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.client.Timeout)
+	defer cancel()
+	body := map[string][]string{"scroll_id": {scrollID}}
+	if err := o.do(ctx, http.MethodDelete, "/_search/scroll", body, nil); err != nil {
+		log.Printf("Failed to clear OpenSearch scroll: %v", err)
+	}
+}
+
+func (o *OpenSearch) CountUsers(ctx context.Context, tenantID string) (int64, error) {
+	body := map[string]interface{}{
+		"query": tenantFilter(tenantID),
+	}
+
+	var result struct {
+		Count int64 `json:"count"`
+	}
+	path := fmt.Sprintf("/%s/_count", url.PathEscape(o.index))
+	if err := o.do(ctx, http.MethodPost, path, body, &result); err != nil {
+		if errors.Is(err, errNotFound) {
+			// Nothing was indexed yet.
+			return 0, nil
+		}
+		return 0, err
+	}
+	return result.Count, nil
+}
+
+func tenantFilter(tenantID string) map[string]interface{} {
+	return map[string]interface{}{"term": map[string]interface{}{"tenant_id.keyword": tenantID}}
+}
+
+func (o *OpenSearch) do(ctx context.Context, method, path string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, o.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.username != "" {
+		req.SetBasicAuth(o.username, o.password)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && out != nil {
+		return errNotFound
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("opensearch %s %s: %s: %s", method, path, resp.Status, msg)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
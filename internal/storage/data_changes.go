@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/redact"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+)
+
+// ChangeRecorderKey is the context key carrying the ChangeRecorder of an
+// audited request. The audit middleware stores it in the fiber locals, which
+// the request context exposes to storage.
+type ChangeRecorderKey struct{}
+
+// ChangeRecorder collects the rows written for one request.
+type ChangeRecorder struct {
+	mu      sync.Mutex
+	changes []models.DataChange
+}
+
+func NewChangeRecorder() *ChangeRecorder {
+	return &ChangeRecorder{}
+}
+
+// Changes returns the rows written so far, in the order they were written.
+func (r *ChangeRecorder) Changes() []models.DataChange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]models.DataChange(nil), r.changes...)
+}
+
+func (r *ChangeRecorder) add(change models.DataChange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changes = append(r.changes, change)
+}
+
+const dataChangesSetKey = "data_changes:set"
+
+// unrecordedTables are written by the audit itself.
+var unrecordedTables = map[string]bool{
+	"audit_logs":   true,
+	"data_changes": true,
+}
+
+// secretColumns are redacted from recorded values on top of the fields the
+// redactor drops anyway.
+var secretColumns = []string{"hash", "wrappedkey"}
+
+// DataChanges records every row GORM creates, updates, or deletes for a
+// context carrying a ChangeRecorder, with the ID of the database
+// transaction that wrote it.
+type DataChanges struct {
+	redactor *redact.Redactor
+}
+
+// NewDataChanges redacts the fields, and masks the masked ones, from the
+// recorded values, as the request log does.
+func NewDataChanges(fields, masked []string) *DataChanges {
+	return &DataChanges{redactor: redact.New(append(secretColumns, fields...), masked, nil)}
+}
+
+func (p *DataChanges) Name() string {
+	return "data_changes"
+}
+
+// Initialize records each write before its transaction commits, so
+// txid_current() names the transaction that wrote it.
+func (p *DataChanges) Initialize(db *gorm.DB) error {
+	chain := db.Callback()
+	for _, err := range []error{
+		chain.Create().After("gorm:create").Before("gorm:commit_or_rollback_transaction").Register("data_changes:create", p.record("create")),
+		chain.Update().Before("gorm:update").Register("data_changes:assignments", p.assignments),
+		chain.Update().After("gorm:update").Before("gorm:commit_or_rollback_transaction").Register("data_changes:update", p.record("update")),
+		chain.Delete().After("gorm:delete").Before("gorm:commit_or_rollback_transaction").Register("data_changes:delete", p.record("delete")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assignments builds the SET clause of an update the way gorm:update would,
+// which drops its own once the update ran, and keeps it for record.
+func (p *DataChanges) assignments(tx *gorm.DB) {
+	if p.recorder(tx) == nil || tx.Statement.SQL.Len() > 0 {
+		return
+	}
+	if _, ok := tx.Statement.Clauses["SET"]; ok {
+		return
+	}
+	if set := callbacks.ConvertToAssignments(tx.Statement); len(set) > 0 {
+		tx.Statement.AddClause(set)
+		tx.InstanceSet(dataChangesSetKey, true)
+	}
+}
+
+// recorder returns the recorder of the statement, nil when it is not
+// recorded.
+func (p *DataChanges) recorder(tx *gorm.DB) *ChangeRecorder {
+	ctx := tx.Statement.Context
+	if ctx == nil || tx.Error != nil || tx.DryRun || unrecordedTables[tx.Statement.Table] {
+		return nil
+	}
+	recorder, _ := ctx.Value(ChangeRecorderKey{}).(*ChangeRecorder)
+	return recorder
+}
+
+func (p *DataChanges) record(operation string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		if _, ok := tx.InstanceGet(dataChangesSetKey); ok {
+			// The statement may be reused for another update.
+			defer delete(tx.Statement.Clauses, "SET")
+		}
+		recorder := p.recorder(tx)
+		if recorder == nil || (operation != "create" && tx.RowsAffected == 0) {
+			return
+		}
+		ctx := tx.Statement.Context
+
+		change := models.DataChange{
+			TxID:         transactionID(ctx, tx),
+			Operation:    operation,
+			Table:        tx.Statement.Table,
+			RowsAffected: tx.RowsAffected,
+			CreatedAt:    time.Now(),
+		}
+		switch operation {
+		case "create":
+			values, ok := tx.Statement.Clauses["VALUES"].Expression.(clause.Values)
+			if !ok {
+				return
+			}
+			// A batch insert is recorded row by row.
+			change.RowsAffected = 1
+			for _, row := range values.Values {
+				columns := make(map[string]interface{}, len(row))
+				for i, value := range row {
+					columns[values.Columns[i].Name] = value
+				}
+				change.Values = p.values(columns)
+				recorder.add(change)
+			}
+			return
+		case "update":
+			if set, ok := tx.Statement.Clauses["SET"].Expression.(clause.Set); ok {
+				columns := make(map[string]interface{}, len(set))
+				for _, assignment := range set {
+					columns[assignment.Column.Name] = assignment.Value
+				}
+				change.Values = p.values(columns)
+			}
+		}
+		change.Conditions = conditions(tx)
+		recorder.add(change)
+	}
+}
+
+// values encodes the columns written, redacted.
+func (p *DataChanges) values(columns map[string]interface{}) string {
+	for name, value := range columns {
+		if expr, ok := value.(clause.Expr); ok {
+			columns[name] = expr.SQL
+			continue
+		}
+		columns[name] = p.redactor.Value(name, value)
+	}
+	data, err := json.Marshal(columns)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// conditions renders the WHERE clause of an update or delete with its
+// bound values.
+func conditions(tx *gorm.DB) string {
+	where, ok := tx.Statement.Clauses["WHERE"]
+	if !ok || where.Expression == nil {
+		return ""
+	}
+	stmt := &gorm.Statement{DB: tx, Table: tx.Statement.Table, Schema: tx.Statement.Schema, Clauses: map[string]clause.Clause{}}
+	where.Expression.Build(stmt)
+	return tx.Dialector.Explain(stmt.SQL.String(), stmt.Vars...)
+}
+
+// transactionID returns the ID of the transaction tx writes in, 0 when it
+// cannot be read.
+func transactionID(ctx context.Context, tx *gorm.DB) int64 {
+	var id int64
+	if err := tx.Statement.ConnPool.QueryRowContext(ctx, "SELECT txid_current()").Scan(&id); err != nil {
+		log.Printf("Failed to read the transaction of a data change: %v", err)
+		return 0
+	}
+	return id
+}
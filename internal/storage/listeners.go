@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/tajious/heimdall/internal/models"
+)
+
+// UserWritten is told about a user storage created or updated, once the
+// write succeeded.
+type UserWritten func(ctx context.Context, user *models.User)
+
+type userListeners []UserWritten
+
+func (l userListeners) notify(ctx context.Context, users ...*models.User) {
+	for _, written := range l {
+		for _, user := range users {
+			written(ctx, user)
+		}
+	}
+}
+
+// OnUserWritten has store call written after every user it creates or
+// updates, whichever code path wrote it. Listeners are added before the
+// store serves requests.
+func OnUserWritten(store Storage, written UserWritten) {
+	switch s := store.(type) {
+	case *PostgresStorage:
+		s.written = append(s.written, written)
+	case *InMemoryStorage:
+		s.written = append(s.written, written)
+	case *RoutedStorage:
+		for _, db := range s.all() {
+			OnUserWritten(db, written)
+		}
+	}
+}
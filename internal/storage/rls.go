@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/gorm"
+)
+
+// TenantScopeKey is the context key carrying the ID of the tenant a request
+// acts for. The tenant middleware stores it in the fiber locals, which the
+// request context exposes to storage.
+type TenantScopeKey struct{}
+
+// WithTenant scopes ctx to tenantID.
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, TenantScopeKey{}, tenantID)
+}
+
+// unscopedTenant is the scope Unscoped sets. Tenant IDs never take this
+// value, so it cannot be mistaken for one.
+const unscopedTenant = "*"
+
+// Unscoped lifts the tenant scope from ctx, for operator calls, background
+// jobs, and the lookups that look across tenants by design. A context that
+// is neither scoped nor unscoped sees no tenant's rows.
+func Unscoped(ctx context.Context) context.Context {
+	return WithTenant(ctx, unscopedTenant)
+}
+
+// ScopedTenant returns the tenant ctx is scoped to, or "" when it is not
+// scoped.
+func ScopedTenant(ctx context.Context) string {
+	if tenantID := sessionTenant(ctx); tenantID != unscopedTenant {
+		return tenantID
+	}
+	return ""
+}
+
+// sessionTenant returns what app.tenant_id is set to for a query run with
+// ctx: the tenant, unscopedTenant, or "" when ctx carries no scope at all.
+func sessionTenant(ctx context.Context) string {
+	tenantID, _ := ctx.Value(TenantScopeKey{}).(string)
+	return tenantID
+}
+
+// rlsTables are the tables whose rows belong to a tenant.
+var rlsTables = []string{
+	"tenant_configs",
+	"users",
+	"environments",
+	"policy_versions",
+	"policy_acceptances",
+	"access_policies",
+	"plugin_modules",
+	"domain_claims",
+	"audit_logs",
+	"audit_chain_anchors",
+	"data_changes",
+	"device_authorizations",
+	"signing_keys",
+	"tenant_keys",
+	"digest_deliveries",
+	"sso_sessions",
+	"consent_grants",
+	"clients",
+	"jobs",
+}
+
+// The policy shows a session the rows of the tenant in app.tenant_id, or
+// every row when it holds unscopedTenant. A session that never set it, or
+// set it empty, sees nothing.
+var rlsPolicy = fmt.Sprintf(`tenant_id = nullif(current_setting('app.tenant_id', true), '') OR current_setting('app.tenant_id', true) = '%s'`, unscopedTenant)
+
+// openScopedDB opens a database whose connections carry the scope of each
+// query in app.tenant_id, for the policy to check. The scope is set by the
+// connection itself right before every statement and transaction, so it
+// holds however database/sql pools and hands out connections.
+func openScopedDB(dsn string) (*sql.DB, error) {
+	connConfig, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(scopedConnector{stdlib.GetConnector(*connConfig)}), nil
+}
+
+type scopedConnector struct {
+	driver.Connector
+}
+
+func (c scopedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &scopedConn{Conn: conn.(*stdlib.Conn)}, nil
+}
+
+// scopedConn remembers the scope it last set, to skip setting it again for
+// the next query of the same tenant.
+type scopedConn struct {
+	*stdlib.Conn
+	tenantID string
+	known    bool
+}
+
+func (c *scopedConn) scope(ctx context.Context) error {
+	tenantID := sessionTenant(ctx)
+	if c.known && c.tenantID == tenantID {
+		return nil
+	}
+	c.known = false
+	if _, err := c.Conn.Conn().Exec(ctx, "SELECT set_config('app.tenant_id', $1, false)", tenantID); err != nil {
+		if c.Conn.Conn().IsClosed() {
+			return driver.ErrBadConn
+		}
+		return err
+	}
+	c.tenantID, c.known = tenantID, true
+	return nil
+}
+
+func (c *scopedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.scope(ctx); err != nil {
+		return nil, err
+	}
+	// Rolling back to a savepoint also rolls back a scope set after it.
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "ROLLBACK") {
+		defer func() { c.known = false }()
+	}
+	return c.Conn.ExecContext(ctx, query, args)
+}
+
+func (c *scopedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.scope(ctx); err != nil {
+		return nil, err
+	}
+	return c.Conn.QueryContext(ctx, query, args)
+}
+
+func (c *scopedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return scopedStmt{Stmt: stmt.(*stdlib.Stmt), conn: c}, nil
+}
+
+func (c *scopedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := c.scope(ctx); err != nil {
+		return nil, err
+	}
+	tx, err := c.Conn.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return scopedTx{Tx: tx, conn: c}, nil
+}
+
+// scopedStmt sets the scope of each execution, which may come from another
+// request than the one that prepared the statement.
+type scopedStmt struct {
+	*stdlib.Stmt
+	conn *scopedConn
+}
+
+func (s scopedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := s.conn.scope(ctx); err != nil {
+		return nil, err
+	}
+	return s.Stmt.ExecContext(ctx, args)
+}
+
+func (s scopedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := s.conn.scope(ctx); err != nil {
+		return nil, err
+	}
+	return s.Stmt.QueryContext(ctx, args)
+}
+
+// scopedTx forgets the scope on rollback, which undoes a scope set inside
+// the transaction.
+type scopedTx struct {
+	driver.Tx
+	conn *scopedConn
+}
+
+func (t scopedTx) Rollback() error {
+	t.conn.known = false
+	return t.Tx.Rollback()
+}
+
+// migrateRowLevelSecurity forces the tenant policy on every tenant-owned
+// table, table owner included. Superusers and roles with BYPASSRLS still
+// see everything, so the server must not connect as one.
+func migrateRowLevelSecurity(db *gorm.DB) error {
+	for _, table := range rlsTables {
+		statements := []string{
+			fmt.Sprintf(`ALTER TABLE %s ENABLE ROW LEVEL SECURITY`, table),
+			fmt.Sprintf(`ALTER TABLE %s FORCE ROW LEVEL SECURITY`, table),
+			fmt.Sprintf(`DROP POLICY IF EXISTS tenant_isolation ON %s`, table),
+			fmt.Sprintf(`CREATE POLICY tenant_isolation ON %s USING (%s) WITH CHECK (%s)`, table, rlsPolicy, rlsPolicy),
+		}
+		for _, statement := range statements {
+			if err := db.Exec(statement).Error; err != nil {
+				return fmt.Errorf("%s: %w", table, err)
+			}
+		}
+	}
+	return nil
+}
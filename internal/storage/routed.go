@@ -0,0 +1,984 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tajious/heimdall/internal/models"
+)
+
+// ErrUnknownRegion is returned for a tenant routed to a region the backend
+// has no database for.
+var ErrUnknownRegion = errors.New("unknown region")
+
+// RegionRouter is implemented by backends that keep tenants' data in
+// several databases, one per region.
+type RegionRouter interface {
+	// Regions lists the named regions; the default region, "", is left out.
+	Regions() []string
+}
+
+// KnowsRegion reports whether store can keep a tenant's data in region.
+// Every backend knows the default region.
+func KnowsRegion(store Storage, region string) bool {
+	if region == "" {
+		return true
+	}
+	router, ok := store.(RegionRouter)
+	if !ok {
+		return false
+	}
+	for _, name := range router.Regions() {
+		if name == region {
+			return true
+		}
+	}
+	return false
+}
+
+// RoutedStorage keeps each tenant's data in the database of the tenant's
+// region, for data residency, and spreads the tenants of the default region
+// over shards. Tenants and their configs stay in the home database, where
+// the region and shard of each tenant are recorded; the home database is
+// also shard 0.
+//
+// Calls naming a tenant go to its database. Lookups by an ID alone go to
+// the database of the tenant the context is scoped to, or else to every
+// database in turn. A tenant's region is fixed when the tenant is created;
+// its shard only changes through MoveTenant.
+type RoutedStorage struct {
+	home    Storage
+	regions map[string]Storage
+	// shards[0] is home.
+	shards []Storage
+
+	// routes caches the database of each tenant looked up.
+	routes sync.Map
+}
+
+// NewRoutedStorage routes tenants between home, the databases of regions,
+// and the databases of shards 1 and up.
+func NewRoutedStorage(home Storage, regions map[string]Storage, shards []Storage) *RoutedStorage {
+	return &RoutedStorage{
+		home:    home,
+		regions: regions,
+		shards:  append([]Storage{home}, shards...),
+	}
+}
+
+func (s *RoutedStorage) Regions() []string {
+	names := make([]string, 0, len(s.regions))
+	for name := range s.regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *RoutedStorage) region(name string) (Storage, error) {
+	if name == "" {
+		return s.home, nil
+	}
+	db, ok := s.regions[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownRegion, name)
+	}
+	return db, nil
+}
+
+// forTenant returns the database holding the tenant's data.
+func (s *RoutedStorage) forTenant(ctx context.Context, tenantID string) (Storage, error) {
+	if db, ok := s.routes.Load(tenantID); ok {
+		return db.(Storage), nil
+	}
+	tenant, err := s.home.GetTenant(WithTenant(ctx, tenantID), tenantID)
+	if errors.Is(err, ErrTenantNotFound) {
+		// Data of a tenant that does not exist, such as operator audit
+		// entries, stays home.
+		return s.home, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	db, err := s.database(tenant)
+	if err != nil {
+		return nil, err
+	}
+	s.routes.Store(tenantID, db)
+	return db, nil
+}
+
+// database returns the database of the tenant's region or, in the default
+// region, of its shard.
+func (s *RoutedStorage) database(tenant *models.Tenant) (Storage, error) {
+	if tenant.Region != "" {
+		return s.region(tenant.Region)
+	}
+	return s.shard(tenant.Shard)
+}
+
+// all returns every database, home first.
+func (s *RoutedStorage) all() []Storage {
+	dbs := append([]Storage{}, s.shards...)
+	for _, name := range s.Regions() {
+		dbs = append(dbs, s.regions[name])
+	}
+	return dbs
+}
+
+// find runs lookup against the database of the tenant ctx is scoped to, or
+// against every database until one finds the record.
+func find[T any](ctx context.Context, s *RoutedStorage, notFound error, lookup func(Storage) (T, error)) (T, error) {
+	if tenantID := ScopedTenant(ctx); tenantID != "" {
+		db, err := s.forTenant(ctx, tenantID)
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+		return lookup(db)
+	}
+	return findAll(s, notFound, lookup)
+}
+
+// findAll runs lookup against every database until one finds the record.
+func findAll[T any](s *RoutedStorage, notFound error, lookup func(Storage) (T, error)) (T, error) {
+	var zero T
+	for _, db := range s.all() {
+		value, err := lookup(db)
+		if err == nil {
+			return value, nil
+		}
+		if !errors.Is(err, notFound) {
+			return zero, err
+		}
+	}
+	return zero, notFound
+}
+
+// CreateTenant places a tenant of the default region on the shard its ID
+// hashes to.
+func (s *RoutedStorage) CreateTenant(ctx context.Context, tenant *models.Tenant) error {
+	if _, err := s.region(tenant.Region); err != nil {
+		return err
+	}
+	tenant.Shard = 0
+	if tenant.Region == "" {
+		if tenant.ID == "" {
+			tenant.ID = uuid.NewString()
+		}
+		tenant.Shard = ShardFor(tenant.ID, len(s.shards))
+	}
+	return s.home.CreateTenant(ctx, tenant)
+}
+
+func (s *RoutedStorage) GetTenant(ctx context.Context, id string) (*models.Tenant, error) {
+	return s.home.GetTenant(ctx, id)
+}
+
+func (s *RoutedStorage) UpdateTenantConfig(ctx context.Context, config *models.TenantConfig) error {
+	return s.home.UpdateTenantConfig(ctx, config)
+}
+
+func (s *RoutedStorage) UpdateTenant(ctx context.Context, tenant *models.Tenant) error {
+	return s.home.UpdateTenant(ctx, tenant)
+}
+
+func (s *RoutedStorage) ListTenants(ctx context.Context, page, pageSize int) ([]*models.Tenant, int64, error) {
+	return s.home.ListTenants(ctx, page, pageSize)
+}
+
+// DeleteTenant deletes the tenant's records from its database, then the
+// tenant itself from home.
+func (s *RoutedStorage) DeleteTenant(ctx context.Context, id string) error {
+	db, err := s.forTenant(ctx, id)
+	if err != nil {
+		return err
+	}
+	if db != s.home {
+		mover, ok := db.(tenantMover)
+		if !ok {
+			return errors.New("the tenant's database cannot delete its records")
+		}
+		if err := mover.deleteTenantData(ctx, id); err != nil {
+			return err
+		}
+	}
+	if err := s.home.DeleteTenant(ctx, id); err != nil {
+		return err
+	}
+	s.routes.Delete(id)
+	return nil
+}
+
+func (s *RoutedStorage) CreateUser(ctx context.Context, user *models.User) error {
+	db, err := s.forTenant(ctx, user.TenantID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkPhoneUnique(ctx, db, user); err != nil {
+		return err
+	}
+	return db.CreateUser(ctx, user)
+}
+
+func (s *RoutedStorage) GetUser(ctx context.Context, id string) (*models.User, error) {
+	return find(ctx, s, ErrUserNotFound, func(db Storage) (*models.User, error) {
+		return db.GetUser(ctx, id)
+	})
+}
+
+func (s *RoutedStorage) UpdateUser(ctx context.Context, user *models.User) error {
+	db, err := s.forTenant(ctx, user.TenantID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkPhoneUnique(ctx, db, user); err != nil {
+		return err
+	}
+	return db.UpdateUser(ctx, user)
+}
+
+// UpdateUsers saves users of a single tenant, as no transaction spans
+// databases.
+func (s *RoutedStorage) UpdateUsers(ctx context.Context, users []*models.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	for _, user := range users[1:] {
+		if user.TenantID != users[0].TenantID {
+			return errors.New("routed storage: users of several tenants cannot be updated together")
+		}
+	}
+	db, err := s.forTenant(ctx, users[0].TenantID)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := s.checkPhoneUnique(ctx, db, user); err != nil {
+			return err
+		}
+	}
+	return db.UpdateUsers(ctx, users)
+}
+
+func (s *RoutedStorage) FindUserByAttribute(ctx context.Context, tenantID, name string, value interface{}) (*models.User, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.FindUserByAttribute(ctx, tenantID, name, value)
+}
+
+func (s *RoutedStorage) ListUsers(ctx context.Context, filter UserFilter) ([]models.User, int64, error) {
+	db, err := s.forTenant(ctx, filter.TenantID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return db.ListUsers(ctx, filter)
+}
+
+func (s *RoutedStorage) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	return find(ctx, s, ErrUserNotFound, func(db Storage) (*models.User, error) {
+		return db.GetUserByUsername(ctx, username)
+	})
+}
+
+func (s *RoutedStorage) GetPoolUserByUsername(ctx context.Context, tenantID, environmentID, username string) (*models.User, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetPoolUserByUsername(ctx, tenantID, environmentID, username)
+}
+
+func (s *RoutedStorage) GetPoolUserByEmail(ctx context.Context, tenantID, environmentID, email string) (*models.User, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetPoolUserByEmail(ctx, tenantID, environmentID, email)
+}
+
+func (s *RoutedStorage) GetUserByPhone(ctx context.Context, phone string) (*models.User, error) {
+	return find(ctx, s, ErrUserNotFound, func(db Storage) (*models.User, error) {
+		return db.GetUserByPhone(ctx, phone)
+	})
+}
+
+func (s *RoutedStorage) UpdateUserLastLogin(ctx context.Context, userID string) error {
+	_, err := find(ctx, s, ErrUserNotFound, func(db Storage) (struct{}, error) {
+		return struct{}{}, db.UpdateUserLastLogin(ctx, userID)
+	})
+	return err
+}
+
+func (s *RoutedStorage) CreateEnvironment(ctx context.Context, env *models.Environment) error {
+	db, err := s.forTenant(ctx, env.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.CreateEnvironment(ctx, env)
+}
+
+func (s *RoutedStorage) GetEnvironment(ctx context.Context, id string) (*models.Environment, error) {
+	return find(ctx, s, ErrEnvironmentNotFound, func(db Storage) (*models.Environment, error) {
+		return db.GetEnvironment(ctx, id)
+	})
+}
+
+func (s *RoutedStorage) UpdateEnvironment(ctx context.Context, env *models.Environment) error {
+	db, err := s.forTenant(ctx, env.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.UpdateEnvironment(ctx, env)
+}
+
+func (s *RoutedStorage) GetEnvironmentByName(ctx context.Context, tenantID, name string) (*models.Environment, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetEnvironmentByName(ctx, tenantID, name)
+}
+
+func (s *RoutedStorage) GetEnvironmentByAPIKeyHash(ctx context.Context, hash string) (*models.Environment, error) {
+	return find(ctx, s, ErrEnvironmentNotFound, func(db Storage) (*models.Environment, error) {
+		return db.GetEnvironmentByAPIKeyHash(ctx, hash)
+	})
+}
+
+func (s *RoutedStorage) ListEnvironments(ctx context.Context, tenantID string) ([]*models.Environment, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListEnvironments(ctx, tenantID)
+}
+
+func (s *RoutedStorage) CreatePolicyVersion(ctx context.Context, policy *models.PolicyVersion) error {
+	db, err := s.forTenant(ctx, policy.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.CreatePolicyVersion(ctx, policy)
+}
+
+func (s *RoutedStorage) GetPolicyVersion(ctx context.Context, id string) (*models.PolicyVersion, error) {
+	return find(ctx, s, ErrPolicyNotFound, func(db Storage) (*models.PolicyVersion, error) {
+		return db.GetPolicyVersion(ctx, id)
+	})
+}
+
+func (s *RoutedStorage) ListPolicyVersions(ctx context.Context, tenantID string) ([]*models.PolicyVersion, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListPolicyVersions(ctx, tenantID)
+}
+
+func (s *RoutedStorage) CurrentPolicyVersions(ctx context.Context, tenantID string) ([]*models.PolicyVersion, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.CurrentPolicyVersions(ctx, tenantID)
+}
+
+func (s *RoutedStorage) CreatePolicyAcceptance(ctx context.Context, acceptance *models.PolicyAcceptance) error {
+	db, err := s.forTenant(ctx, acceptance.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.CreatePolicyAcceptance(ctx, acceptance)
+}
+
+func (s *RoutedStorage) HasAcceptedPolicy(ctx context.Context, userID, policyVersionID string) (bool, error) {
+	errNotAccepted := errors.New("not accepted")
+	accepted, err := find(ctx, s, errNotAccepted, func(db Storage) (bool, error) {
+		accepted, err := db.HasAcceptedPolicy(ctx, userID, policyVersionID)
+		if err == nil && !accepted {
+			return false, errNotAccepted
+		}
+		return accepted, err
+	})
+	if errors.Is(err, errNotAccepted) {
+		return false, nil
+	}
+	return accepted, err
+}
+
+func (s *RoutedStorage) ListPolicyAcceptances(ctx context.Context, tenantID string) ([]*models.PolicyAcceptance, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListPolicyAcceptances(ctx, tenantID)
+}
+
+func (s *RoutedStorage) CreateAccessPolicy(ctx context.Context, policy *models.AccessPolicy) error {
+	db, err := s.forTenant(ctx, policy.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.CreateAccessPolicy(ctx, policy)
+}
+
+func (s *RoutedStorage) GetAccessPolicy(ctx context.Context, tenantID, id string) (*models.AccessPolicy, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetAccessPolicy(ctx, tenantID, id)
+}
+
+func (s *RoutedStorage) ListAccessPolicies(ctx context.Context, tenantID string) ([]*models.AccessPolicy, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListAccessPolicies(ctx, tenantID)
+}
+
+func (s *RoutedStorage) DeleteAccessPolicy(ctx context.Context, tenantID, id string) error {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	return db.DeleteAccessPolicy(ctx, tenantID, id)
+}
+
+func (s *RoutedStorage) CreatePluginModule(ctx context.Context, module *models.PluginModule) error {
+	db, err := s.forTenant(ctx, module.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.CreatePluginModule(ctx, module)
+}
+
+func (s *RoutedStorage) GetPluginModule(ctx context.Context, tenantID, id string) (*models.PluginModule, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetPluginModule(ctx, tenantID, id)
+}
+
+func (s *RoutedStorage) ListPluginModules(ctx context.Context, tenantID string) ([]*models.PluginModule, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListPluginModules(ctx, tenantID)
+}
+
+func (s *RoutedStorage) SetPluginModuleActive(ctx context.Context, tenantID, id string, active bool) error {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	return db.SetPluginModuleActive(ctx, tenantID, id, active)
+}
+
+// CreateDomainClaim stores the claim in the tenant's database. A domain
+// verified by tenants in two databases cannot be caught by either, so the
+// claim is refused when another database already verified it.
+func (s *RoutedStorage) CreateDomainClaim(ctx context.Context, claim *models.DomainClaim) error {
+	db, err := s.forTenant(ctx, claim.TenantID)
+	if err != nil {
+		return err
+	}
+	if claim.VerifiedAt != nil {
+		if err := s.checkDomainUnverified(ctx, db, claim); err != nil {
+			return err
+		}
+	}
+	return db.CreateDomainClaim(ctx, claim)
+}
+
+func (s *RoutedStorage) GetDomainClaim(ctx context.Context, tenantID, id string) (*models.DomainClaim, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetDomainClaim(ctx, tenantID, id)
+}
+
+func (s *RoutedStorage) ListDomainClaims(ctx context.Context, tenantID string) ([]*models.DomainClaim, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListDomainClaims(ctx, tenantID)
+}
+
+// FindVerifiedDomain looks across tenants by design, so it searches every
+// region whatever the context is scoped to.
+func (s *RoutedStorage) FindVerifiedDomain(ctx context.Context, domain string) (*models.DomainClaim, error) {
+	return findAll(s, ErrDomainClaimNotFound, func(db Storage) (*models.DomainClaim, error) {
+		return db.FindVerifiedDomain(ctx, domain)
+	})
+}
+
+func (s *RoutedStorage) UpdateDomainClaim(ctx context.Context, claim *models.DomainClaim) error {
+	db, err := s.forTenant(ctx, claim.TenantID)
+	if err != nil {
+		return err
+	}
+	if claim.VerifiedAt != nil {
+		if err := s.checkDomainUnverified(ctx, db, claim); err != nil {
+			return err
+		}
+	}
+	return db.UpdateDomainClaim(ctx, claim)
+}
+
+// checkDomainUnverified refuses a verified claim when a tenant in another
+// database verified the domain first; the claim's own database enforces
+// that itself.
+func (s *RoutedStorage) checkDomainUnverified(ctx context.Context, own Storage, claim *models.DomainClaim) error {
+	for _, db := range s.all() {
+		if db == own {
+			continue
+		}
+		verified, err := db.FindVerifiedDomain(ctx, claim.Domain)
+		if errors.Is(err, ErrDomainClaimNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if verified.TenantID != claim.TenantID {
+			return fmt.Errorf("%w: domain %s is verified by another tenant", ErrConflict, claim.Domain)
+		}
+	}
+	return nil
+}
+
+// checkPhoneUnique refuses a user whose phone number a user in another
+// database has; phone numbers are unique across tenants, which the user's
+// own database enforces itself.
+func (s *RoutedStorage) checkPhoneUnique(ctx context.Context, own Storage, user *models.User) error {
+	if user.Phone == "" {
+		return nil
+	}
+	for _, db := range s.all() {
+		if db == own {
+			continue
+		}
+		other, err := db.GetUserByPhone(Unscoped(ctx), user.Phone)
+		if errors.Is(err, ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if other.ID != user.ID {
+			return fmt.Errorf("%w: phone number is taken", ErrConflict)
+		}
+	}
+	return nil
+}
+
+func (s *RoutedStorage) DeleteDomainClaim(ctx context.Context, tenantID, id string) error {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	return db.DeleteDomainClaim(ctx, tenantID, id)
+}
+
+func (s *RoutedStorage) CreateAuditLog(ctx context.Context, entry *models.AuditLog) error {
+	db, err := s.forTenant(ctx, entry.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.CreateAuditLog(ctx, entry)
+}
+
+func (s *RoutedStorage) ListAuditChain(ctx context.Context, tenantID string, afterSequence int64, limit int) ([]*models.AuditLog, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListAuditChain(ctx, tenantID, afterSequence, limit)
+}
+
+func (s *RoutedStorage) ListAuditLogs(ctx context.Context, filter AuditLogFilter) ([]*models.AuditLog, int64, error) {
+	db, err := s.forTenant(ctx, filter.TenantID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return db.ListAuditLogs(ctx, filter)
+}
+
+func (s *RoutedStorage) ListDataChanges(ctx context.Context, tenantID, auditLogID string) ([]*models.DataChange, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListDataChanges(ctx, tenantID, auditLogID)
+}
+
+func (s *RoutedStorage) GetAuditChainAnchor(ctx context.Context, tenantID string) (*models.AuditChainAnchor, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetAuditChainAnchor(ctx, tenantID)
+}
+
+func (s *RoutedStorage) PurgeAuditLogs(ctx context.Context, olderThan time.Time) (int64, error) {
+	var purged int64
+	for _, db := range s.all() {
+		n, err := db.PurgeAuditLogs(ctx, olderThan)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+func (s *RoutedStorage) CreateDeviceAuthorization(ctx context.Context, auth *models.DeviceAuthorization) error {
+	db, err := s.forTenant(ctx, auth.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.CreateDeviceAuthorization(ctx, auth)
+}
+
+func (s *RoutedStorage) GetDeviceAuthorizationByDeviceCode(ctx context.Context, tenantID, deviceCodeHash string) (*models.DeviceAuthorization, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetDeviceAuthorizationByDeviceCode(ctx, tenantID, deviceCodeHash)
+}
+
+func (s *RoutedStorage) GetDeviceAuthorizationByUserCode(ctx context.Context, tenantID, userCode string) (*models.DeviceAuthorization, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetDeviceAuthorizationByUserCode(ctx, tenantID, userCode)
+}
+
+func (s *RoutedStorage) UpdateDeviceAuthorization(ctx context.Context, auth *models.DeviceAuthorization) error {
+	db, err := s.forTenant(ctx, auth.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.UpdateDeviceAuthorization(ctx, auth)
+}
+
+func (s *RoutedStorage) DeleteDeviceAuthorization(ctx context.Context, tenantID, id string) error {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	return db.DeleteDeviceAuthorization(ctx, tenantID, id)
+}
+
+func (s *RoutedStorage) PurgeDeviceAuthorizations(ctx context.Context, olderThan time.Time) (int64, error) {
+	var purged int64
+	for _, db := range s.all() {
+		n, err := db.PurgeDeviceAuthorizations(ctx, olderThan)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+func (s *RoutedStorage) CreateSigningKey(ctx context.Context, key *models.SigningKey) error {
+	db, err := s.forTenant(ctx, key.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.CreateSigningKey(ctx, key)
+}
+
+func (s *RoutedStorage) GetSigningKey(ctx context.Context, tenantID, id string) (*models.SigningKey, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetSigningKey(ctx, tenantID, id)
+}
+
+func (s *RoutedStorage) FindSigningKey(ctx context.Context, id string) (*models.SigningKey, error) {
+	return find(ctx, s, ErrSigningKeyNotFound, func(db Storage) (*models.SigningKey, error) {
+		return db.FindSigningKey(ctx, id)
+	})
+}
+
+func (s *RoutedStorage) ListSigningKeys(ctx context.Context, tenantID string) ([]*models.SigningKey, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListSigningKeys(ctx, tenantID)
+}
+
+func (s *RoutedStorage) UpdateSigningKey(ctx context.Context, key *models.SigningKey) error {
+	db, err := s.forTenant(ctx, key.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.UpdateSigningKey(ctx, key)
+}
+
+func (s *RoutedStorage) DeleteSigningKey(ctx context.Context, tenantID, id string) error {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	return db.DeleteSigningKey(ctx, tenantID, id)
+}
+
+func (s *RoutedStorage) ListTenantKeys(ctx context.Context, tenantID string) ([]*models.TenantKey, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListTenantKeys(ctx, tenantID)
+}
+
+func (s *RoutedStorage) ActivateTenantKey(ctx context.Context, key *models.TenantKey) error {
+	db, err := s.forTenant(ctx, key.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.ActivateTenantKey(ctx, key)
+}
+
+func (s *RoutedStorage) ListRetiredTenantKeys(ctx context.Context) ([]*models.TenantKey, error) {
+	keys := []*models.TenantKey{}
+	for _, db := range s.all() {
+		retired, err := db.ListRetiredTenantKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, retired...)
+	}
+	return keys, nil
+}
+
+func (s *RoutedStorage) DeleteTenantKey(ctx context.Context, tenantID, id string) error {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	return db.DeleteTenantKey(ctx, tenantID, id)
+}
+
+func (s *RoutedStorage) CreateDigestDelivery(ctx context.Context, delivery *models.DigestDelivery) error {
+	db, err := s.forTenant(ctx, delivery.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.CreateDigestDelivery(ctx, delivery)
+}
+
+func (s *RoutedStorage) DeleteDigestDelivery(ctx context.Context, tenantID, id string) error {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	return db.DeleteDigestDelivery(ctx, tenantID, id)
+}
+
+func (s *RoutedStorage) CreateSSOSession(ctx context.Context, session *models.SSOSession) error {
+	db, err := s.forTenant(ctx, session.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.CreateSSOSession(ctx, session)
+}
+
+func (s *RoutedStorage) GetSSOSessionByTokenHash(ctx context.Context, tenantID, tokenHash string) (*models.SSOSession, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetSSOSessionByTokenHash(ctx, tenantID, tokenHash)
+}
+
+func (s *RoutedStorage) AddSSOSessionClient(ctx context.Context, tenantID, id, clientID string) error {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	return db.AddSSOSessionClient(ctx, tenantID, id, clientID)
+}
+
+func (s *RoutedStorage) DeleteSSOSession(ctx context.Context, tenantID, id string) error {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	return db.DeleteSSOSession(ctx, tenantID, id)
+}
+
+func (s *RoutedStorage) PurgeSSOSessions(ctx context.Context, olderThan time.Time) (int64, error) {
+	var purged int64
+	for _, db := range s.all() {
+		n, err := db.PurgeSSOSessions(ctx, olderThan)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+func (s *RoutedStorage) SaveConsentGrant(ctx context.Context, grant *models.ConsentGrant) error {
+	db, err := s.forTenant(ctx, grant.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.SaveConsentGrant(ctx, grant)
+}
+
+func (s *RoutedStorage) GetConsentGrant(ctx context.Context, tenantID, userID, clientID string) (*models.ConsentGrant, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetConsentGrant(ctx, tenantID, userID, clientID)
+}
+
+func (s *RoutedStorage) ListConsentGrants(ctx context.Context, tenantID, userID string) ([]*models.ConsentGrant, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListConsentGrants(ctx, tenantID, userID)
+}
+
+func (s *RoutedStorage) DeleteConsentGrant(ctx context.Context, tenantID, userID, clientID string) error {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	return db.DeleteConsentGrant(ctx, tenantID, userID, clientID)
+}
+
+func (s *RoutedStorage) CreateClient(ctx context.Context, client *models.Client) error {
+	db, err := s.forTenant(ctx, client.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.CreateClient(ctx, client)
+}
+
+func (s *RoutedStorage) GetClient(ctx context.Context, tenantID, id string) (*models.Client, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetClient(ctx, tenantID, id)
+}
+
+func (s *RoutedStorage) ListClients(ctx context.Context, tenantID string) ([]*models.Client, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListClients(ctx, tenantID)
+}
+
+func (s *RoutedStorage) UpdateClient(ctx context.Context, client *models.Client) error {
+	db, err := s.forTenant(ctx, client.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.UpdateClient(ctx, client)
+}
+
+func (s *RoutedStorage) DeleteClient(ctx context.Context, tenantID, id string) error {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	return db.DeleteClient(ctx, tenantID, id)
+}
+
+// Ping reports the first database that is unreachable.
+func (s *RoutedStorage) Ping(ctx context.Context) error {
+	for i, db := range s.shards {
+		if err := db.Ping(ctx); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	for _, name := range s.Regions() {
+		if err := s.regions[name].Ping(ctx); err != nil {
+			return fmt.Errorf("region %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *RoutedStorage) CreateJob(ctx context.Context, job *models.Job) error {
+	db, err := s.forTenant(ctx, job.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.CreateJob(ctx, job)
+}
+
+func (s *RoutedStorage) GetJob(ctx context.Context, tenantID, id string) (*models.Job, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetJob(ctx, tenantID, id)
+}
+
+func (s *RoutedStorage) ListJobs(ctx context.Context, tenantID string, kind models.JobKind) ([]*models.Job, error) {
+	db, err := s.forTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListJobs(ctx, tenantID, kind)
+}
+
+// ClaimJob claims from the first database with a job left.
+func (s *RoutedStorage) ClaimJob(ctx context.Context, kinds []models.JobKind, staleBefore time.Time) (*models.Job, error) {
+	for _, db := range s.all() {
+		job, err := db.ClaimJob(ctx, kinds, staleBefore)
+		if errors.Is(err, ErrJobNotFound) {
+			continue
+		}
+		return job, err
+	}
+	return nil, ErrJobNotFound
+}
+
+func (s *RoutedStorage) UpdateJob(ctx context.Context, job *models.Job) error {
+	db, err := s.forTenant(ctx, job.TenantID)
+	if err != nil {
+		return err
+	}
+	return db.UpdateJob(ctx, job)
+}
+
+func (s *RoutedStorage) PurgeJobs(ctx context.Context, olderThan time.Time) (int64, error) {
+	var purged int64
+	for _, db := range s.all() {
+		n, err := db.PurgeJobs(ctx, olderThan)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
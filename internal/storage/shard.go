@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/tajious/heimdall/internal/models"
+	"gorm.io/gorm"
+)
+
+// ErrUnknownShard is returned for a tenant placed on a shard the backend has
+// no database for.
+var ErrUnknownShard = errors.New("unknown shard")
+
+// ShardFor returns the shard, out of n, a tenant is placed on by the FNV-1a
+// hash of its ID.
+func ShardFor(tenantID string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(tenantID))
+	return int(h.Sum32() % uint32(n))
+}
+
+// Shards returns how many shards tenants of the default region are spread
+// over, counting home.
+func (s *RoutedStorage) Shards() int {
+	return len(s.shards)
+}
+
+func (s *RoutedStorage) shard(n int) (Storage, error) {
+	if n < 0 || n >= len(s.shards) {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownShard, n)
+	}
+	return s.shards[n], nil
+}
+
+// tenantMover is implemented by backends that can hand a tenant's records
+// over to another backend of the same kind.
+type tenantMover interface {
+	// copyTenantData copies the tenant's records, but not the tenant and
+	// its config, to dst.
+	copyTenantData(ctx context.Context, tenantID string, dst Storage) error
+	// deleteTenantData deletes the records copyTenantData copies.
+	deleteTenantData(ctx context.Context, tenantID string) error
+	setTenantShard(ctx context.Context, tenantID string, shard int) error
+}
+
+// MoveTenant moves the records of a tenant of the default region to shard:
+// it copies them over, points the tenant at the shard, and deletes them from
+// the shard they were on. Leftovers of an interrupted move are cleared from
+// the target first, so a failed move can simply be run again.
+//
+// Other instances keep routing the tenant to the shard they cached until
+// restarted, so tenants are moved while the service is stopped.
+func (s *RoutedStorage) MoveTenant(ctx context.Context, tenantID string, shard int) error {
+	ctx = Unscoped(ctx)
+	tenant, err := s.home.GetTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	if tenant.Region != "" {
+		return fmt.Errorf("tenant %s is kept in region %s, not on a shard", tenantID, tenant.Region)
+	}
+	if tenant.Shard == shard {
+		return nil
+	}
+	src, err := s.shard(tenant.Shard)
+	if err != nil {
+		return err
+	}
+	dst, err := s.shard(shard)
+	if err != nil {
+		return err
+	}
+	from, ok := src.(tenantMover)
+	if !ok {
+		return fmt.Errorf("shard %d cannot move tenants", tenant.Shard)
+	}
+	to, ok := dst.(tenantMover)
+	if !ok {
+		return fmt.Errorf("shard %d cannot move tenants", shard)
+	}
+	home, ok := s.home.(tenantMover)
+	if !ok {
+		return errors.New("the home database cannot move tenants")
+	}
+
+	if err := to.deleteTenantData(ctx, tenantID); err != nil {
+		return fmt.Errorf("clear shard %d: %w", shard, err)
+	}
+	if err := from.copyTenantData(ctx, tenantID, dst); err != nil {
+		return fmt.Errorf("copy to shard %d: %w", shard, err)
+	}
+	if err := home.setTenantShard(ctx, tenantID, shard); err != nil {
+		return err
+	}
+	s.routes.Delete(tenantID)
+	if err := from.deleteTenantData(ctx, tenantID); err != nil {
+		return fmt.Errorf("delete from shard %d: %w", tenant.Shard, err)
+	}
+	return nil
+}
+
+// tenantDataTables are the tables a tenant's records are moved across: all
+// tenant-owned tables but tenant_configs, which stays with the tenant.
+func tenantDataTables() []string {
+	tables := make([]string, 0, len(rlsTables))
+	for _, table := range rlsTables {
+		if table != "tenant_configs" {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// copyTenantData has Postgres render each table's rows as JSON and read
+// them back into the same table type on dst, so every column keeps its
+// type whatever order the two schemas were migrated in.
+func (s *PostgresStorage) copyTenantData(ctx context.Context, tenantID string, dst Storage) error {
+	target, ok := dst.(*PostgresStorage)
+	if !ok {
+		return errors.New("tenants can only be moved between PostgreSQL databases")
+	}
+	return target.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, table := range tenantDataTables() {
+			var rows *string
+			query := fmt.Sprintf(`SELECT json_agg(t)::text FROM %s t WHERE tenant_id = ?`, table)
+			if err := s.db.WithContext(ctx).Raw(query, tenantID).Scan(&rows).Error; err != nil {
+				return fmt.Errorf("read %s: %w", table, err)
+			}
+			if rows == nil {
+				continue
+			}
+			insert := fmt.Sprintf(`INSERT INTO %s SELECT * FROM json_populate_recordset(NULL::%s, ?::json)`, table, table)
+			if err := tx.Exec(insert, *rows).Error; err != nil {
+				return fmt.Errorf("write %s: %w", table, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *PostgresStorage) deleteTenantData(ctx context.Context, tenantID string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, table := range tenantDataTables() {
+			if err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE tenant_id = ?`, table), tenantID).Error; err != nil {
+				return fmt.Errorf("delete %s: %w", table, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *PostgresStorage) setTenantShard(ctx context.Context, tenantID string, shard int) error {
+	result := s.db.WithContext(ctx).Exec(`UPDATE tenants SET shard = ? WHERE id = ?`, shard, tenantID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTenantNotFound
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) copyTenantData(ctx context.Context, tenantID string, dst Storage) error {
+	target, ok := dst.(*InMemoryStorage)
+	if !ok {
+		return errors.New("tenants can only be moved between in-memory backends")
+	}
+
+	copyOwned(target.users, s.users, tenantID, func(u *models.User) string { return u.TenantID })
+	copyOwned(target.environments, s.environments, tenantID, func(e *models.Environment) string { return e.TenantID })
+	copyOwned(target.policies, s.policies, tenantID, func(p *models.PolicyVersion) string { return p.TenantID })
+	copyOwned(target.acceptances, s.acceptances, tenantID, func(a *models.PolicyAcceptance) string { return a.TenantID })
+	copyOwned(target.access, s.access, tenantID, func(p *models.AccessPolicy) string { return p.TenantID })
+	copyOwned(target.plugins, s.plugins, tenantID, func(m *models.PluginModule) string { return m.TenantID })
+	copyOwned(target.domains, s.domains, tenantID, func(c *models.DomainClaim) string { return c.TenantID })
+	copyOwned(target.signingKeys, s.signingKeys, tenantID, func(k *models.SigningKey) string { return k.TenantID })
+	copyOwned(target.clients, s.clients, tenantID, func(c *models.Client) string { return c.TenantID })
+
+	s.deviceMu.Lock()
+	target.deviceMu.Lock()
+	copyOwned(target.devices, s.devices, tenantID, func(d *models.DeviceAuthorization) string { return d.TenantID })
+	target.deviceMu.Unlock()
+	s.deviceMu.Unlock()
+
+	s.tenantKeyMu.Lock()
+	target.tenantKeyMu.Lock()
+	copyOwned(target.tenantKeys, s.tenantKeys, tenantID, func(k *models.TenantKey) string { return k.TenantID })
+	target.tenantKeyMu.Unlock()
+	s.tenantKeyMu.Unlock()
+
+	s.digestMu.Lock()
+	target.digestMu.Lock()
+	copyOwned(target.digests, s.digests, tenantID, func(d *models.DigestDelivery) string { return d.TenantID })
+	target.digestMu.Unlock()
+	s.digestMu.Unlock()
+
+	s.ssoMu.Lock()
+	target.ssoMu.Lock()
+	copyOwned(target.ssoSessions, s.ssoSessions, tenantID, func(d *models.SSOSession) string { return d.TenantID })
+	target.ssoMu.Unlock()
+	s.ssoMu.Unlock()
+
+	s.consentMu.Lock()
+	target.consentMu.Lock()
+	copyOwned(target.consents, s.consents, tenantID, func(g *models.ConsentGrant) string { return g.TenantID })
+	target.consentMu.Unlock()
+	s.consentMu.Unlock()
+
+	s.jobMu.Lock()
+	target.jobMu.Lock()
+	copyOwned(target.jobs, s.jobs, tenantID, func(j *models.Job) string { return j.TenantID })
+	target.jobMu.Unlock()
+	s.jobMu.Unlock()
+
+	s.auditMu.Lock()
+	target.auditMu.Lock()
+	for _, entry := range s.auditLogs {
+		if entry.TenantID == tenantID {
+			copied := *entry
+			target.auditLogs = append(target.auditLogs, &copied)
+		}
+	}
+	copyOwned(target.auditAnchors, s.auditAnchors, tenantID, func(a *models.AuditChainAnchor) string { return a.TenantID })
+	target.auditMu.Unlock()
+	s.auditMu.Unlock()
+	return nil
+}
+
+func (s *InMemoryStorage) deleteTenantData(ctx context.Context, tenantID string) error {
+	deleteOwned(s.users, tenantID, func(u *models.User) string { return u.TenantID })
+	deleteOwned(s.environments, tenantID, func(e *models.Environment) string { return e.TenantID })
+	deleteOwned(s.policies, tenantID, func(p *models.PolicyVersion) string { return p.TenantID })
+	deleteOwned(s.acceptances, tenantID, func(a *models.PolicyAcceptance) string { return a.TenantID })
+	deleteOwned(s.access, tenantID, func(p *models.AccessPolicy) string { return p.TenantID })
+	deleteOwned(s.plugins, tenantID, func(m *models.PluginModule) string { return m.TenantID })
+	deleteOwned(s.domains, tenantID, func(c *models.DomainClaim) string { return c.TenantID })
+	deleteOwned(s.signingKeys, tenantID, func(k *models.SigningKey) string { return k.TenantID })
+	deleteOwned(s.clients, tenantID, func(c *models.Client) string { return c.TenantID })
+
+	s.deviceMu.Lock()
+	deleteOwned(s.devices, tenantID, func(d *models.DeviceAuthorization) string { return d.TenantID })
+	s.deviceMu.Unlock()
+
+	s.tenantKeyMu.Lock()
+	deleteOwned(s.tenantKeys, tenantID, func(k *models.TenantKey) string { return k.TenantID })
+	s.tenantKeyMu.Unlock()
+
+	s.digestMu.Lock()
+	deleteOwned(s.digests, tenantID, func(d *models.DigestDelivery) string { return d.TenantID })
+	s.digestMu.Unlock()
+
+	s.ssoMu.Lock()
+	deleteOwned(s.ssoSessions, tenantID, func(d *models.SSOSession) string { return d.TenantID })
+	s.ssoMu.Unlock()
+
+	s.consentMu.Lock()
+	deleteOwned(s.consents, tenantID, func(g *models.ConsentGrant) string { return g.TenantID })
+	s.consentMu.Unlock()
+
+	s.jobMu.Lock()
+	deleteOwned(s.jobs, tenantID, func(j *models.Job) string { return j.TenantID })
+	s.jobMu.Unlock()
+
+	s.auditMu.Lock()
+	kept := s.auditLogs[:0]
+	for _, entry := range s.auditLogs {
+		if entry.TenantID != tenantID {
+			kept = append(kept, entry)
+		}
+	}
+	s.auditLogs = kept
+	delete(s.auditAnchors, tenantID)
+	s.auditMu.Unlock()
+	return nil
+}
+
+func (s *InMemoryStorage) setTenantShard(ctx context.Context, tenantID string, shard int) error {
+	tenant, exists := s.tenants[tenantID]
+	if !exists {
+		return ErrTenantNotFound
+	}
+	tenant.Shard = shard
+	return nil
+}
+
+func copyOwned[T any](dst, src map[string]*T, tenantID string, tenantOf func(*T) string) {
+	for id, record := range src {
+		if tenantOf(record) == tenantID {
+			copied := *record
+			dst[id] = &copied
+		}
+	}
+}
+
+func deleteOwned[T any](records map[string]*T, tenantID string, tenantOf func(*T) string) {
+	for id, record := range records {
+		if tenantOf(record) == tenantID {
+			delete(records, id)
+		}
+	}
+}
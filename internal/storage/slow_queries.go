@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/tajious/heimdall/internal/metrics"
+	"gorm.io/gorm"
+)
+
+// RequestIDKey is the context key carrying the ID of the request a query
+// runs for. The request ID middleware stores it in the fiber locals, which
+// the request context exposes to storage.
+type RequestIDKey struct{}
+
+const slowQueryStartKey = "slow_queries:start"
+
+// SlowQueries times every query and write GORM runs, logging those taking
+// Threshold or longer with the request and tenant they ran for.
+type SlowQueries struct {
+	threshold time.Duration
+	slow      *metrics.CounterVec
+	duration  *metrics.SummaryVec
+}
+
+func NewSlowQueries(threshold time.Duration, registry *metrics.Registry) *SlowQueries {
+	return &SlowQueries{
+		threshold: threshold,
+		slow:      registry.Counter("heimdall_db_slow_queries_total", "Database queries taking at least the slow query threshold.", "operation", "table"),
+		duration:  registry.Summary("heimdall_db_query_seconds", "Time database queries take.", "operation"),
+	}
+}
+
+func (p *SlowQueries) Name() string {
+	return "slow_queries"
+}
+
+func (p *SlowQueries) Initialize(db *gorm.DB) error {
+	start := func(tx *gorm.DB) {
+		tx.InstanceSet(slowQueryStartKey, time.Now())
+	}
+	callbacks := db.Callback()
+	for _, err := range []error{
+		callbacks.Create().Before("gorm:create").Register("slow_queries:start_create", start),
+		callbacks.Create().After("gorm:create").Register("slow_queries:end_create", p.end("create")),
+		callbacks.Query().Before("gorm:query").Register("slow_queries:start_query", start),
+		callbacks.Query().After("gorm:query").Register("slow_queries:end_query", p.end("query")),
+		callbacks.Update().Before("gorm:update").Register("slow_queries:start_update", start),
+		callbacks.Update().After("gorm:update").Register("slow_queries:end_update", p.end("update")),
+		callbacks.Delete().Before("gorm:delete").Register("slow_queries:start_delete", start),
+		callbacks.Delete().After("gorm:delete").Register("slow_queries:end_delete", p.end("delete")),
+		callbacks.Row().Before("gorm:row").Register("slow_queries:start_row", start),
+		callbacks.Row().After("gorm:row").Register("slow_queries:end_row", p.end("row")),
+		callbacks.Raw().Before("gorm:raw").Register("slow_queries:start_raw", start),
+		callbacks.Raw().After("gorm:raw").Register("slow_queries:end_raw", p.end("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *SlowQueries) end(operation string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		started, ok := tx.InstanceGet(slowQueryStartKey)
+		if !ok {
+			return
+		}
+		elapsed := time.Since(started.(time.Time))
+		p.duration.WithLabels(operation).Observe(elapsed.Seconds())
+		if elapsed < p.threshold {
+			return
+		}
+		table := tx.Statement.Table
+		if table == "" {
+			table = "unknown"
+		}
+		p.slow.WithLabels(operation, table).Inc()
+		p.log(tx, operation, table, elapsed)
+	}
+}
+
+// log writes the query as one JSON object. The SQL keeps its placeholders:
+// bound parameters carry passwords, tokens, and personal data, so only
+// their number is logged.
+func (p *SlowQueries) log(tx *gorm.DB, operation, table string, elapsed time.Duration) {
+	entry := map[string]interface{}{
+		"operation":   operation,
+		"table":       table,
+		"duration_ms": float64(elapsed.Microseconds()) / 1000,
+		"sql":         tx.Statement.SQL.String(),
+		"params":      len(tx.Statement.Vars),
+		"rows":        tx.RowsAffected,
+	}
+	if ctx := tx.Statement.Context; ctx != nil {
+		if requestID := requestID(ctx); requestID != "" {
+			entry["request_id"] = requestID
+		}
+		if tenantID := ScopedTenant(ctx); tenantID != "" {
+			entry["tenant_id"] = tenantID
+		}
+	}
+	if tx.Error != nil {
+		entry["error"] = tx.Error.Error()
+	}
+	data, _ := json.Marshal(entry)
+	log.Printf("Slow query: %s", data)
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(RequestIDKey{}).(string)
+	return id
+}
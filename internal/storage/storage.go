@@ -2,65 +2,539 @@ package storage
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/tajious/heimdall/internal/config"
 	"github.com/tajious/heimdall/internal/models"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var (
-	ErrUserNotFound       = errors.New("user not found")
-	ErrTenantNotFound     = errors.New("tenant not found")
-	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrUserNotFound         = errors.New("user not found")
+	ErrTenantNotFound       = errors.New("tenant not found")
+	ErrInvalidCredentials   = errors.New("invalid credentials")
+	ErrEnvironmentNotFound  = errors.New("environment not found")
+	ErrPolicyNotFound       = errors.New("policy version not found")
+	ErrAccessPolicyNotFound = errors.New("access policy not found")
+	ErrPluginModuleNotFound = errors.New("plugin module not found")
+	ErrDomainClaimNotFound  = errors.New("domain claim not found")
+
+	ErrDeviceAuthorizationNotFound = errors.New("device authorization not found")
+	ErrSigningKeyNotFound          = errors.New("signing key not found")
+	ErrTenantKeyNotFound           = errors.New("tenant key not found")
+	ErrSSOSessionNotFound          = errors.New("SSO session not found")
+	ErrConsentGrantNotFound        = errors.New("consent grant not found")
+	ErrJobNotFound                 = errors.New("job not found")
+	ErrClientNotFound              = errors.New("client not found")
+
+	// ErrConflict reports a create or update that would break a uniqueness
+	// rule, such as a second user with the same username in a pool.
+	ErrConflict = errors.New("record already exists")
 )
 
+type UserFilter struct {
+	TenantID   string
+	Search     string
+	Role       string
+	Attributes map[string]interface{}
+	IDs        []string
+	// CreatedSince, when set, leaves out users created before it.
+	CreatedSince time.Time
+	// LastLoginSince, when set, leaves out users who have not logged in
+	// since it.
+	LastLoginSince time.Time
+	SortBy         string
+	SortDir        string
+	Page           int
+	PageSize       int
+}
+
+type AuditLogFilter struct {
+	TenantID  string
+	ActorID   string
+	Action    string
+	EventType string
+	// Since, when set, leaves out entries recorded before it.
+	Since time.Time
+	// Until, when set, leaves out entries recorded after it, so paging
+	// through a snapshot is not shifted by new entries.
+	Until    time.Time
+	Page     int
+	PageSize int
+}
+
+var userSortColumns = map[string]bool{
+	"username":   true,
+	"role":       true,
+	"created_at": true,
+	"last_login": true,
+}
+
+const userSearchDocument = `to_tsvector('simple', coalesce(username, '') || ' ' || coalesce(phone, '') || ' ' || coalesce(attributes::text, ''))`
+
+// Storage is the full contract every backend implements. It is made of
+// narrow repositories so components can depend on just the data they use.
 type Storage interface {
+	TenantRepo
+	UserRepo
+	EnvironmentRepo
+	PolicyRepo
+	AccessPolicyRepo
+	PluginRepo
+	DomainRepo
+	AuditLogRepo
+	DeviceAuthorizationRepo
+	SigningKeyRepo
+	TenantKeyRepo
+	DigestRepo
+	SSOSessionRepo
+	ConsentRepo
+	ClientRepo
+	JobRepo
+
+	// Ping reports whether the backend is reachable.
+	Ping(ctx context.Context) error
+}
+
+type TenantRepo interface {
 	CreateTenant(ctx context.Context, tenant *models.Tenant) error
 	GetTenant(ctx context.Context, id string) (*models.Tenant, error)
 	UpdateTenantConfig(ctx context.Context, config *models.TenantConfig) error
+	UpdateTenant(ctx context.Context, tenant *models.Tenant) error
+	ListTenants(ctx context.Context, page, pageSize int) ([]*models.Tenant, int64, error)
+	// DeleteTenant deletes the tenant, its config, and every record it
+	// owns, audit log included.
+	DeleteTenant(ctx context.Context, id string) error
+}
+
+type UserRepo interface {
 	CreateUser(ctx context.Context, user *models.User) error
+	GetUser(ctx context.Context, id string) (*models.User, error)
+	UpdateUser(ctx context.Context, user *models.User) error
+	// UpdateUsers saves all users or none of them.
+	UpdateUsers(ctx context.Context, users []*models.User) error
+	FindUserByAttribute(ctx context.Context, tenantID, name string, value interface{}) (*models.User, error)
+	ListUsers(ctx context.Context, filter UserFilter) ([]models.User, int64, error)
 	GetUserByUsername(ctx context.Context, username string) (*models.User, error)
+	GetPoolUserByUsername(ctx context.Context, tenantID, environmentID, username string) (*models.User, error)
+	GetPoolUserByEmail(ctx context.Context, tenantID, environmentID, email string) (*models.User, error)
 	GetUserByPhone(ctx context.Context, phone string) (*models.User, error)
 	UpdateUserLastLogin(ctx context.Context, userID string) error
-	GetDB() *gorm.DB
-	ListTenants(ctx context.Context, page, pageSize int) ([]*models.Tenant, int64, error)
+}
+
+type EnvironmentRepo interface {
+	CreateEnvironment(ctx context.Context, env *models.Environment) error
+	GetEnvironment(ctx context.Context, id string) (*models.Environment, error)
+	UpdateEnvironment(ctx context.Context, env *models.Environment) error
+	GetEnvironmentByName(ctx context.Context, tenantID, name string) (*models.Environment, error)
+	GetEnvironmentByAPIKeyHash(ctx context.Context, hash string) (*models.Environment, error)
+	ListEnvironments(ctx context.Context, tenantID string) ([]*models.Environment, error)
+}
+
+type PolicyRepo interface {
+	CreatePolicyVersion(ctx context.Context, policy *models.PolicyVersion) error
+	GetPolicyVersion(ctx context.Context, id string) (*models.PolicyVersion, error)
+	ListPolicyVersions(ctx context.Context, tenantID string) ([]*models.PolicyVersion, error)
+	CurrentPolicyVersions(ctx context.Context, tenantID string) ([]*models.PolicyVersion, error)
+	CreatePolicyAcceptance(ctx context.Context, acceptance *models.PolicyAcceptance) error
+	HasAcceptedPolicy(ctx context.Context, userID, policyVersionID string) (bool, error)
+	ListPolicyAcceptances(ctx context.Context, tenantID string) ([]*models.PolicyAcceptance, error)
+}
+
+type AccessPolicyRepo interface {
+	CreateAccessPolicy(ctx context.Context, policy *models.AccessPolicy) error
+	GetAccessPolicy(ctx context.Context, tenantID, id string) (*models.AccessPolicy, error)
+	ListAccessPolicies(ctx context.Context, tenantID string) ([]*models.AccessPolicy, error)
+	DeleteAccessPolicy(ctx context.Context, tenantID, id string) error
+}
+
+type PluginRepo interface {
+	CreatePluginModule(ctx context.Context, module *models.PluginModule) error
+	GetPluginModule(ctx context.Context, tenantID, id string) (*models.PluginModule, error)
+	// ListPluginModules returns every version of the tenant's plugins
+	// without their module bytes.
+	ListPluginModules(ctx context.Context, tenantID string) ([]*models.PluginModule, error)
+	// SetPluginModuleActive activates a version, deactivating the other
+	// versions of the same plugin, or deactivates it.
+	SetPluginModuleActive(ctx context.Context, tenantID, id string, active bool) error
+}
+
+type DomainRepo interface {
+	CreateDomainClaim(ctx context.Context, claim *models.DomainClaim) error
+	GetDomainClaim(ctx context.Context, tenantID, id string) (*models.DomainClaim, error)
+	ListDomainClaims(ctx context.Context, tenantID string) ([]*models.DomainClaim, error)
+	// FindVerifiedDomain returns the verified claim on domain, whichever
+	// tenant holds it.
+	FindVerifiedDomain(ctx context.Context, domain string) (*models.DomainClaim, error)
+	UpdateDomainClaim(ctx context.Context, claim *models.DomainClaim) error
+	DeleteDomainClaim(ctx context.Context, tenantID, id string) error
+}
+
+type AuditLogRepo interface {
+	// CreateAuditLog appends entry to its tenant's hash chain, setting its
+	// Sequence, PrevHash, and Hash.
+	CreateAuditLog(ctx context.Context, entry *models.AuditLog) error
+	// ListAuditChain returns up to limit chained entries of the tenant with
+	// a Sequence above afterSequence, in chain order.
+	ListAuditChain(ctx context.Context, tenantID string, afterSequence int64, limit int) ([]*models.AuditLog, error)
+	ListAuditLogs(ctx context.Context, filter AuditLogFilter) ([]*models.AuditLog, int64, error)
+	// ListDataChanges returns the rows the request of an audit entry wrote,
+	// in the order they were written.
+	ListDataChanges(ctx context.Context, tenantID, auditLogID string) ([]*models.DataChange, error)
+	// GetAuditChainAnchor returns where the tenant's retained chain starts,
+	// the zero anchor when retention never purged any of it.
+	GetAuditChainAnchor(ctx context.Context, tenantID string) (*models.AuditChainAnchor, error)
+	// PurgeAuditLogs purges each tenant's chain up to its last entry
+	// recorded before olderThan, and anchors the chain after that entry.
+	PurgeAuditLogs(ctx context.Context, olderThan time.Time) (int64, error)
+}
+
+type DeviceAuthorizationRepo interface {
+	CreateDeviceAuthorization(ctx context.Context, auth *models.DeviceAuthorization) error
+	GetDeviceAuthorizationByDeviceCode(ctx context.Context, tenantID, deviceCodeHash string) (*models.DeviceAuthorization, error)
+	GetDeviceAuthorizationByUserCode(ctx context.Context, tenantID, userCode string) (*models.DeviceAuthorization, error)
+	UpdateDeviceAuthorization(ctx context.Context, auth *models.DeviceAuthorization) error
+	// DeleteDeviceAuthorization succeeds for one caller only, so the device
+	// code is exchanged for a single token however often it is polled.
+	DeleteDeviceAuthorization(ctx context.Context, tenantID, id string) error
+	// PurgeDeviceAuthorizations drops authorizations that expired before
+	// olderThan.
+	PurgeDeviceAuthorizations(ctx context.Context, olderThan time.Time) (int64, error)
+}
+
+type SigningKeyRepo interface {
+	CreateSigningKey(ctx context.Context, key *models.SigningKey) error
+	GetSigningKey(ctx context.Context, tenantID, id string) (*models.SigningKey, error)
+	// FindSigningKey returns the key with id, whichever tenant holds it, to
+	// verify a request signed with it.
+	FindSigningKey(ctx context.Context, id string) (*models.SigningKey, error)
+	ListSigningKeys(ctx context.Context, tenantID string) ([]*models.SigningKey, error)
+	UpdateSigningKey(ctx context.Context, key *models.SigningKey) error
+	DeleteSigningKey(ctx context.Context, tenantID, id string) error
+}
+
+type TenantKeyRepo interface {
+	// ListTenantKeys returns every version of the tenant's data key, oldest
+	// first.
+	ListTenantKeys(ctx context.Context, tenantID string) ([]*models.TenantKey, error)
+	// ActivateTenantKey stores key as the tenant's active data key and
+	// retires the previous one. It fails with ErrConflict when the version
+	// exists, as when two rotations race.
+	ActivateTenantKey(ctx context.Context, key *models.TenantKey) error
+	// ListRetiredTenantKeys returns the retired keys of every tenant.
+	ListRetiredTenantKeys(ctx context.Context) ([]*models.TenantKey, error)
+	DeleteTenantKey(ctx context.Context, tenantID, id string) error
+}
+
+type DigestRepo interface {
+	// CreateDigestDelivery records a sent digest, returning ErrConflict when
+	// the tenant's digest for the period was already recorded.
+	CreateDigestDelivery(ctx context.Context, delivery *models.DigestDelivery) error
+	DeleteDigestDelivery(ctx context.Context, tenantID, id string) error
+}
+
+type SSOSessionRepo interface {
+	CreateSSOSession(ctx context.Context, session *models.SSOSession) error
+	GetSSOSessionByTokenHash(ctx context.Context, tenantID, tokenHash string) (*models.SSOSession, error)
+	// AddSSOSessionClient records that the client was issued a token
+	// through the session. Clients already recorded are left alone.
+	AddSSOSessionClient(ctx context.Context, tenantID, id, clientID string) error
+	DeleteSSOSession(ctx context.Context, tenantID, id string) error
+	// PurgeSSOSessions drops sessions that expired before olderThan.
+	PurgeSSOSessions(ctx context.Context, olderThan time.Time) (int64, error)
+}
+
+type ConsentRepo interface {
+	// SaveConsentGrant records the grant, replacing the scopes of the
+	// user's earlier grant to the same client.
+	SaveConsentGrant(ctx context.Context, grant *models.ConsentGrant) error
+	GetConsentGrant(ctx context.Context, tenantID, userID, clientID string) (*models.ConsentGrant, error)
+	ListConsentGrants(ctx context.Context, tenantID, userID string) ([]*models.ConsentGrant, error)
+	DeleteConsentGrant(ctx context.Context, tenantID, userID, clientID string) error
+}
+
+type ClientRepo interface {
+	CreateClient(ctx context.Context, client *models.Client) error
+	GetClient(ctx context.Context, tenantID, id string) (*models.Client, error)
+	ListClients(ctx context.Context, tenantID string) ([]*models.Client, error)
+	UpdateClient(ctx context.Context, client *models.Client) error
+	DeleteClient(ctx context.Context, tenantID, id string) error
+}
+
+type JobRepo interface {
+	CreateJob(ctx context.Context, job *models.Job) error
+	GetJob(ctx context.Context, tenantID, id string) (*models.Job, error)
+	// ListJobs returns the tenant's jobs of kind, newest first.
+	ListJobs(ctx context.Context, tenantID string, kind models.JobKind) ([]*models.Job, error)
+	// ClaimJob marks the oldest pending job of one of kinds running and
+	// returns it, taking over running jobs last updated before staleBefore,
+	// whose runner is presumed gone. Concurrent callers never claim the same
+	// job; it returns ErrJobNotFound when no job is left.
+	ClaimJob(ctx context.Context, kinds []models.JobKind, staleBefore time.Time) (*models.Job, error)
+	UpdateJob(ctx context.Context, job *models.Job) error
+	// PurgeJobs drops jobs created before olderThan.
+	PurgeJobs(ctx context.Context, olderThan time.Time) (int64, error)
 }
 
 type PostgresStorage struct {
-	db *gorm.DB
+	db      *gorm.DB
+	written userListeners
 }
 
 type InMemoryStorage struct {
-	tenants map[string]*models.Tenant
-	users   map[string]*models.User
+	written userListeners
+
+	tenants      map[string]*models.Tenant
+	users        map[string]*models.User
+	environments map[string]*models.Environment
+	policies     map[string]*models.PolicyVersion
+	acceptances  map[string]*models.PolicyAcceptance
+	access       map[string]*models.AccessPolicy
+	plugins      map[string]*models.PluginModule
+	domains      map[string]*models.DomainClaim
+	clients      map[string]*models.Client
+
+	auditMu      sync.Mutex
+	auditLogs    []*models.AuditLog
+	auditAnchors map[string]*models.AuditChainAnchor
+
+	// Devices poll concurrently with the user approving them.
+	deviceMu sync.Mutex
+	devices  map[string]*models.DeviceAuthorization
+
+	signingKeys map[string]*models.SigningKey
+
+	// Secrets are sealed concurrently with rotations.
+	tenantKeyMu sync.Mutex
+	tenantKeys  map[string]*models.TenantKey
+
+	// Instances race to record the same digest.
+	digestMu sync.Mutex
+	digests  map[string]*models.DigestDelivery
+
+	ssoMu       sync.Mutex
+	ssoSessions map[string]*models.SSOSession
+
+	consentMu sync.Mutex
+	consents  map[string]*models.ConsentGrant
+
+	// Runners on every instance claim jobs concurrently.
+	jobMu sync.Mutex
+	jobs  map[string]*models.Job
+}
+
+// PostgresOptions tunes how PostgresStorage talks to the database.
+type PostgresOptions struct {
+	// RowLevelSecurity has Postgres itself hide other tenants' rows from
+	// scoped requests, so a query missing its tenant_id filter cannot leak
+	// them.
+	RowLevelSecurity bool
+
+	// PrepareStatements has GORM keep a prepared statement per query and
+	// connection, sparing the server from parsing and planning the same
+	// login queries over and over.
+	PrepareStatements bool
 }
 
-func NewPostgresStorage(dsn string) (*PostgresStorage, error) {
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+func openPostgres(dsn string, opts PostgresOptions) (*gorm.DB, error) {
+	dialector := postgres.Open(dsn)
+	if opts.RowLevelSecurity {
+		db, err := openScopedDB(dsn)
+		if err != nil {
+			return nil, err
+		}
+		dialector = postgres.New(postgres.Config{Conn: db})
+	}
+	return gorm.Open(dialector, &gorm.Config{TranslateError: true, PrepareStmt: opts.PrepareStatements})
+}
+
+func NewPostgresStorage(dsn string, opts PostgresOptions) (*PostgresStorage, error) {
+	db, err := openPostgres(dsn, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.AutoMigrate(&models.Tenant{}, &models.TenantConfig{}, &models.User{}); err != nil {
+	// Migrations touch every tenant's rows.
+	migrator := db.WithContext(Unscoped(context.Background()))
+
+	if err := migrateRenamedColumns(migrator); err != nil {
+		return nil, fmt.Errorf("rename columns: %w", err)
+	}
+
+	if err := migrator.AutoMigrate(&models.Tenant{}, &models.TenantConfig{}, &models.User{}, &models.Environment{}, &models.PolicyVersion{}, &models.PolicyAcceptance{}, &models.AccessPolicy{}, &models.PluginModule{}, &models.DomainClaim{}, &models.AuditLog{}, &models.DeviceAuthorization{}, &models.SigningKey{}, &models.TenantKey{}, &models.DigestDelivery{}, &models.SSOSession{}, &models.ConsentGrant{}, &models.Client{}, &models.DataChange{}, &models.AuditChainAnchor{}, &models.Job{}); err != nil {
+		return nil, err
+	}
+
+	if err := migrateListIndexes(migrator); err != nil {
+		return nil, fmt.Errorf("create user list indexes: %w", err)
+	}
+
+	if err := migrateSearchIndexes(migrator); err != nil {
+		log.Printf("User search indexes unavailable, falling back to sequential search: %v", err)
+	}
+
+	if opts.RowLevelSecurity {
+		if err := migrateRowLevelSecurity(migrator); err != nil {
+			return nil, fmt.Errorf("enable row level security: %w", err)
+		}
+	}
+
+	return &PostgresStorage{db: db}, nil
+}
+
+// NewPostgresReplicaStorage connects to a read-only replica. It skips the
+// schema migrations, which the primary applies.
+func NewPostgresReplicaStorage(dsn string, opts PostgresOptions) (*PostgresStorage, error) {
+	db, err := openPostgres(dsn, opts)
+	if err != nil {
 		return nil, err
 	}
 
 	return &PostgresStorage{db: db}, nil
 }
 
+// translate maps unique violations to ErrConflict, as the in-memory backend
+// reports them.
+func translate(err error) error {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	return err
+}
+
+// update saves every column of an existing row. Unlike gorm's Save it never
+// inserts, so a missing row is reported as notFound.
+func update(db *gorm.DB, value interface{}, notFound error) error {
+	result := db.Select("*").Save(value)
+	if result.Error != nil {
+		return translate(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return notFound
+	}
+	return nil
+}
+
+// renamedColumns maps tables to the columns renamed in them, old name to new.
+var renamedColumns = map[string]map[string]string{
+	"tenant_configs": {"registration_fields": "attribute_schema"},
+}
+
+// migrateRenamedColumns carries renamed columns over before AutoMigrate
+// would add them empty. A deployment that already added the new column keeps
+// whatever it holds and takes the rest from the old one.
+func migrateRenamedColumns(db *gorm.DB) error {
+	migrator := db.Migrator()
+	for table, columns := range renamedColumns {
+		if !migrator.HasTable(table) {
+			continue
+		}
+		for from, to := range columns {
+			if !migrator.HasColumn(table, from) {
+				continue
+			}
+			if !migrator.HasColumn(table, to) {
+				if err := migrator.RenameColumn(table, from, to); err != nil {
+					return err
+				}
+				continue
+			}
+			copied := fmt.Sprintf(`UPDATE %s SET %s = %s WHERE %s IS NULL OR %s = 'null'`, table, to, from, to, to)
+			if err := db.Exec(copied).Error; err != nil {
+				return err
+			}
+			if err := migrator.DropColumn(table, from); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// userListIndexes serve the ListUsers sort orders within a tenant, with the
+// id tie-break read off the index as well, so a page is an index range scan
+// rather than a sort of every user the tenant has. The single-column
+// tenant_id index they make redundant is dropped.
+var userListIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS idx_users_tenant_created ON users (tenant_id, created_at, id)`,
+	`CREATE INDEX IF NOT EXISTS idx_users_tenant_username ON users (tenant_id, username, id)`,
+	`CREATE INDEX IF NOT EXISTS idx_users_tenant_role_created ON users (tenant_id, role, created_at, id)`,
+	`CREATE INDEX IF NOT EXISTS idx_users_tenant_last_login ON users (tenant_id, last_login, id)`,
+	`DROP INDEX IF EXISTS idx_users_tenant_id`,
+}
+
+func migrateListIndexes(db *gorm.DB) error {
+	for _, statement := range userListIndexes {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateSearchIndexes(db *gorm.DB) error {
+	statements := []string{
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+		`CREATE INDEX IF NOT EXISTS idx_users_username_trgm ON users USING gin (username gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS idx_users_phone_trgm ON users USING gin (phone gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS idx_users_search_fts ON users USING gin (` + userSearchDocument + `)`,
+	}
+
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func NewInMemoryStorage() *InMemoryStorage {
 	return &InMemoryStorage{
-		tenants: make(map[string]*models.Tenant),
-		users:   make(map[string]*models.User),
+		tenants:      make(map[string]*models.Tenant),
+		users:        make(map[string]*models.User),
+		environments: make(map[string]*models.Environment),
+		policies:     make(map[string]*models.PolicyVersion),
+		acceptances:  make(map[string]*models.PolicyAcceptance),
+		access:       make(map[string]*models.AccessPolicy),
+		plugins:      make(map[string]*models.PluginModule),
+		domains:      make(map[string]*models.DomainClaim),
+		clients:      make(map[string]*models.Client),
+		signingKeys:  make(map[string]*models.SigningKey),
+		tenantKeys:   make(map[string]*models.TenantKey),
+		digests:      make(map[string]*models.DigestDelivery),
+		ssoSessions:  make(map[string]*models.SSOSession),
+		consents:     make(map[string]*models.ConsentGrant),
+		jobs:         make(map[string]*models.Job),
+		devices:      make(map[string]*models.DeviceAuthorization),
+		auditAnchors: make(map[string]*models.AuditChainAnchor),
 	}
 }
 
 func (s *PostgresStorage) CreateTenant(ctx context.Context, tenant *models.Tenant) error {
-	return s.db.WithContext(ctx).Create(tenant).Error
+	assignTenantIDs(tenant)
+	return translate(s.db.WithContext(WithTenant(ctx, tenant.ID)).Create(tenant).Error)
+}
+
+func assignTenantIDs(tenant *models.Tenant) {
+	if tenant.ID == "" {
+		tenant.ID = uuid.NewString()
+	}
+	if tenant.Config.ID == "" {
+		tenant.Config.ID = uuid.NewString()
+	}
+	tenant.Config.TenantID = tenant.ID
 }
 
 func (s *PostgresStorage) GetTenant(ctx context.Context, id string) (*models.Tenant, error) {
@@ -75,16 +549,34 @@ func (s *PostgresStorage) GetTenant(ctx context.Context, id string) (*models.Ten
 }
 
 func (s *PostgresStorage) UpdateTenantConfig(ctx context.Context, config *models.TenantConfig) error {
-	return s.db.WithContext(ctx).Save(config).Error
+	return update(s.db.WithContext(ctx), config, ErrTenantNotFound)
+}
+
+func (s *PostgresStorage) UpdateTenant(ctx context.Context, tenant *models.Tenant) error {
+	result := s.db.WithContext(ctx).Model(tenant).Select("name", "status", "updated_at").Updates(tenant)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTenantNotFound
+	}
+	return nil
 }
 
 func (s *PostgresStorage) CreateUser(ctx context.Context, user *models.User) error {
-	return s.db.WithContext(ctx).Create(user).Error
+	if user.ID == "" {
+		user.ID = uuid.NewString()
+	}
+	if err := s.db.WithContext(ctx).Create(user).Error; err != nil {
+		return translate(err)
+	}
+	s.written.notify(ctx, user)
+	return nil
 }
 
-func (s *PostgresStorage) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+func (s *PostgresStorage) GetUser(ctx context.Context, id string) (*models.User, error) {
 	var user models.User
-	if err := s.db.WithContext(ctx).First(&user, "username = ?", username).Error; err != nil {
+	if err := s.db.WithContext(ctx).First(&user, "id = ?", id).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, ErrUserNotFound
 		}
@@ -93,9 +585,38 @@ func (s *PostgresStorage) GetUserByUsername(ctx context.Context, username string
 	return &user, nil
 }
 
-func (s *PostgresStorage) GetUserByPhone(ctx context.Context, phone string) (*models.User, error) {
+func (s *PostgresStorage) UpdateUser(ctx context.Context, user *models.User) error {
+	if err := update(s.db.WithContext(ctx), user, ErrUserNotFound); err != nil {
+		return err
+	}
+	s.written.notify(ctx, user)
+	return nil
+}
+
+func (s *PostgresStorage) UpdateUsers(ctx context.Context, users []*models.User) error {
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, user := range users {
+			if err := update(tx, user, ErrUserNotFound); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.written.notify(ctx, users...)
+	return nil
+}
+
+func (s *PostgresStorage) FindUserByAttribute(ctx context.Context, tenantID, name string, value interface{}) (*models.User, error) {
+	filter, err := json.Marshal(map[string]interface{}{name: value})
+	if err != nil {
+		return nil, err
+	}
+
 	var user models.User
-	if err := s.db.WithContext(ctx).First(&user, "phone = ?", phone).Error; err != nil {
+	if err := s.db.WithContext(ctx).First(&user, "tenant_id = ? AND attributes @> ?", tenantID, string(filter)).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, ErrUserNotFound
 		}
@@ -104,117 +625,2293 @@ func (s *PostgresStorage) GetUserByPhone(ctx context.Context, phone string) (*mo
 	return &user, nil
 }
 
-func (s *PostgresStorage) UpdateUserLastLogin(ctx context.Context, userID string) error {
-	return s.db.WithContext(ctx).Model(&models.User{}).Where("id = ?", userID).Update("last_login", time.Now()).Error
-}
+func (s *PostgresStorage) ListUsers(ctx context.Context, filter UserFilter) ([]models.User, int64, error) {
+	query := s.db.WithContext(ctx).Model(&models.User{}).Where("tenant_id = ?", filter.TenantID)
 
-func (s *PostgresStorage) GetDB() *gorm.DB {
-	return s.db
-}
+	if filter.Search != "" {
+		pattern := "%" + escapeLike(filter.Search) + "%"
+		query = query.Where(
+			"username ILIKE ? OR phone ILIKE ? OR "+userSearchDocument+" @@ plainto_tsquery('simple', ?)",
+			pattern, pattern, filter.Search,
+		)
+	}
 
-func (s *PostgresStorage) ListTenants(ctx context.Context, page, pageSize int) ([]*models.Tenant, int64, error) {
-	var tenants []*models.Tenant
-	var total int64
+	if filter.Role != "" {
+		query = query.Where("role = ?", filter.Role)
+	}
 
-	offset := (page - 1) * pageSize
+	if len(filter.Attributes) > 0 {
+		attributes, err := json.Marshal(filter.Attributes)
+		if err != nil {
+			return nil, 0, err
+		}
+		query = query.Where("attributes @> ?", string(attributes))
+	}
 
-	if err := s.db.WithContext(ctx).Model(&models.Tenant{}).Count(&total).Error; err != nil {
+	if filter.IDs != nil {
+		// One parameter however many IDs a search matched, as Postgres
+		// takes at most 65535 per statement.
+		ids, err := json.Marshal(filter.IDs)
+		if err != nil {
+			return nil, 0, err
+		}
+		query = query.Where("id IN (SELECT jsonb_array_elements_text(?::jsonb))", string(ids))
+	}
+
+	if !filter.CreatedSince.IsZero() {
+		query = query.Where("created_at >= ?", filter.CreatedSince)
+	}
+
+	if !filter.LastLoginSince.IsZero() {
+		query = query.Where("last_login >= ?", filter.LastLoginSince)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
 		return nil, 0, err
 	}
 
-	if err := s.db.WithContext(ctx).Preload("Config").Offset(offset).Limit(pageSize).Find(&tenants).Error; err != nil {
+	var users []models.User
+	if err := query.
+		Order(userOrder(filter)).
+		Offset((filter.Page - 1) * filter.PageSize).
+		Limit(filter.PageSize).
+		Find(&users).Error; err != nil {
 		return nil, 0, err
 	}
 
-	return tenants, total, nil
+	return users, total, nil
 }
 
-func (s *InMemoryStorage) CreateTenant(ctx context.Context, tenant *models.Tenant) error {
-	s.tenants[tenant.ID] = tenant
-	return nil
+func userSort(filter UserFilter) (string, string) {
+	sortBy := filter.SortBy
+	if !userSortColumns[sortBy] {
+		sortBy = "created_at"
+	}
+
+	sortDir := "desc"
+	if filter.SortDir == "asc" {
+		sortDir = "asc"
+	}
+
+	return sortBy, sortDir
 }
 
-func (s *InMemoryStorage) GetTenant(ctx context.Context, id string) (*models.Tenant, error) {
-	tenant, exists := s.tenants[id]
-	if !exists {
-		return nil, ErrTenantNotFound
+// userOrder is the ORDER BY for a user listing. Every order runs in one
+// direction and matches the columns of a userListIndexes entry, so Postgres
+// can walk the index forwards or backwards.
+func userOrder(filter UserFilter) string {
+	sortBy, sortDir := userSort(filter)
+	columns := []string{sortBy}
+	if sortBy == "role" {
+		columns = append(columns, "created_at")
 	}
-	return tenant, nil
+	columns = append(columns, "id")
+
+	for i, column := range columns {
+		columns[i] = column + " " + sortDir
+	}
+	return strings.Join(columns, ", ")
 }
 
-func (s *InMemoryStorage) UpdateTenantConfig(ctx context.Context, config *models.TenantConfig) error {
-	tenant, exists := s.tenants[config.TenantID]
-	if !exists {
-		return ErrTenantNotFound
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+func (s *PostgresStorage) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	var user models.User
+	if err := s.db.WithContext(ctx).First(&user, "username = ?", username).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
 	}
-	tenant.Config = *config
-	return nil
+	return &user, nil
 }
 
-func (s *InMemoryStorage) CreateUser(ctx context.Context, user *models.User) error {
-	s.users[user.ID] = user
-	return nil
+func (s *PostgresStorage) GetPoolUserByUsername(ctx context.Context, tenantID, environmentID, username string) (*models.User, error) {
+	var user models.User
+	if err := s.db.WithContext(ctx).First(&user, "tenant_id = ? AND environment_id = ? AND username = ?", tenantID, environmentID, username).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
 }
 
-func (s *InMemoryStorage) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
-	for _, user := range s.users {
-		if user.Username == username {
-			return user, nil
+func (s *PostgresStorage) GetPoolUserByEmail(ctx context.Context, tenantID, environmentID, email string) (*models.User, error) {
+	var user models.User
+	if err := s.db.WithContext(ctx).First(&user, "tenant_id = ? AND environment_id = ? AND email = ?", tenantID, environmentID, email).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
 		}
+		return nil, err
 	}
-	return nil, ErrUserNotFound
+	return &user, nil
 }
 
-func (s *InMemoryStorage) GetUserByPhone(ctx context.Context, phone string) (*models.User, error) {
-	for _, user := range s.users {
-		if user.Phone == phone {
-			return user, nil
+func (s *PostgresStorage) GetUserByPhone(ctx context.Context, phone string) (*models.User, error) {
+	var user models.User
+	if err := s.db.WithContext(ctx).First(&user, "phone = ?", phone).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
 		}
+		return nil, err
 	}
-	return nil, ErrUserNotFound
+	return &user, nil
 }
 
-func (s *InMemoryStorage) UpdateUserLastLogin(ctx context.Context, userID string) error {
-	user, exists := s.users[userID]
-	if !exists {
+func (s *PostgresStorage) UpdateUserLastLogin(ctx context.Context, userID string) error {
+	result := s.db.WithContext(ctx).Model(&models.User{}).Where("id = ?", userID).Update("last_login", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
 		return ErrUserNotFound
 	}
-	user.LastLogin = time.Now()
 	return nil
 }
 
-func (s *InMemoryStorage) GetDB() *gorm.DB {
-	return nil
+func (s *PostgresStorage) Ping(ctx context.Context) error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
 }
 
-func (s *InMemoryStorage) ListTenants(ctx context.Context, page, pageSize int) ([]*models.Tenant, int64, error) {
+// Use installs a GORM plugin on the connection, such as the callbacks of
+// chaos mode.
+func (s *PostgresStorage) Use(plugin gorm.Plugin) error {
+	return s.db.Use(plugin)
+}
+
+// DBStats reports the connection pool statistics.
+func (s *PostgresStorage) DBStats() sql.DBStats {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return sql.DBStats{}
+	}
+	return sqlDB.Stats()
+}
+
+func (s *PostgresStorage) DeleteTenant(ctx context.Context, id string) error {
+	return s.db.WithContext(WithTenant(ctx, id)).Transaction(func(tx *gorm.DB) error {
+		for _, table := range rlsTables {
+			if err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE tenant_id = ?`, table), id).Error; err != nil {
+				return fmt.Errorf("delete %s: %w", table, err)
+			}
+		}
+		result := tx.Exec(`DELETE FROM tenants WHERE id = ?`, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrTenantNotFound
+		}
+		return nil
+	})
+}
+
+func (s *PostgresStorage) ListTenants(ctx context.Context, page, pageSize int) ([]*models.Tenant, int64, error) {
 	var tenants []*models.Tenant
-	total := int64(len(s.tenants))
+	var total int64
 
 	offset := (page - 1) * pageSize
-	end := offset + pageSize
-	if end > int(total) {
-		end = int(total)
-	}
+	ctx = Unscoped(ctx)
 
-	for _, tenant := range s.tenants {
-		tenants = append(tenants, tenant)
+	if err := s.db.WithContext(ctx).Model(&models.Tenant{}).Count(&total).Error; err != nil {
+		return nil, 0, err
 	}
 
-	if offset >= int(total) {
-		return []*models.Tenant{}, total, nil
+	if err := s.db.WithContext(ctx).Preload("Config").Order("created_at asc, id asc").Offset(offset).Limit(pageSize).Find(&tenants).Error; err != nil {
+		return nil, 0, err
 	}
 
-	return tenants[offset:end], total, nil
+	return tenants, total, nil
 }
 
-func BuildDSN(cfg config.DatabaseConfig) string {
-	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		cfg.Host,
+func (s *PostgresStorage) CreateEnvironment(ctx context.Context, env *models.Environment) error {
+	if env.ID == "" {
+		env.ID = uuid.NewString()
+	}
+	return translate(s.db.WithContext(ctx).Create(env).Error)
+}
+
+func (s *PostgresStorage) UpdateEnvironment(ctx context.Context, env *models.Environment) error {
+	return update(s.db.WithContext(ctx), env, ErrEnvironmentNotFound)
+}
+
+func (s *PostgresStorage) GetEnvironment(ctx context.Context, id string) (*models.Environment, error) {
+	return s.findEnvironment(ctx, "id = ?", id)
+}
+
+func (s *PostgresStorage) GetEnvironmentByName(ctx context.Context, tenantID, name string) (*models.Environment, error) {
+	return s.findEnvironment(ctx, "tenant_id = ? AND name = ?", tenantID, name)
+}
+
+func (s *PostgresStorage) GetEnvironmentByAPIKeyHash(ctx context.Context, hash string) (*models.Environment, error) {
+	return s.findEnvironment(Unscoped(ctx), "api_key_hash = ?", hash)
+}
+
+func (s *PostgresStorage) findEnvironment(ctx context.Context, query string, args ...interface{}) (*models.Environment, error) {
+	var env models.Environment
+	if err := s.db.WithContext(ctx).Where(query, args...).First(&env).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrEnvironmentNotFound
+		}
+		return nil, err
+	}
+	return &env, nil
+}
+
+func (s *PostgresStorage) ListEnvironments(ctx context.Context, tenantID string) ([]*models.Environment, error) {
+	var envs []*models.Environment
+	if err := s.db.WithContext(ctx).Where("tenant_id = ?", tenantID).Order("name asc").Find(&envs).Error; err != nil {
+		return nil, err
+	}
+	return envs, nil
+}
+
+func (s *PostgresStorage) CreatePolicyVersion(ctx context.Context, policy *models.PolicyVersion) error {
+	if policy.ID == "" {
+		policy.ID = uuid.NewString()
+	}
+	return translate(s.db.WithContext(ctx).Create(policy).Error)
+}
+
+func (s *PostgresStorage) GetPolicyVersion(ctx context.Context, id string) (*models.PolicyVersion, error) {
+	var policy models.PolicyVersion
+	if err := s.db.WithContext(ctx).First(&policy, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPolicyNotFound
+		}
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (s *PostgresStorage) ListPolicyVersions(ctx context.Context, tenantID string) ([]*models.PolicyVersion, error) {
+	var policies []*models.PolicyVersion
+	if err := s.db.WithContext(ctx).Where("tenant_id = ?", tenantID).Order("published_at desc").Find(&policies).Error; err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func (s *PostgresStorage) CurrentPolicyVersions(ctx context.Context, tenantID string) ([]*models.PolicyVersion, error) {
+	var policies []*models.PolicyVersion
+	if err := s.db.WithContext(ctx).
+		Raw(`SELECT DISTINCT ON (kind) * FROM policy_versions WHERE tenant_id = ? AND published_at <= ? ORDER BY kind, published_at DESC`, tenantID, time.Now()).
+		Scan(&policies).Error; err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func (s *PostgresStorage) CreatePolicyAcceptance(ctx context.Context, acceptance *models.PolicyAcceptance) error {
+	if acceptance.ID == "" {
+		acceptance.ID = uuid.NewString()
+	}
+	return s.db.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(acceptance).Error
+}
+
+func (s *PostgresStorage) HasAcceptedPolicy(ctx context.Context, userID, policyVersionID string) (bool, error) {
+	var count int64
+	if err := s.db.WithContext(ctx).Model(&models.PolicyAcceptance{}).
+		Where("user_id = ? AND policy_version_id = ?", userID, policyVersionID).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *PostgresStorage) ListPolicyAcceptances(ctx context.Context, tenantID string) ([]*models.PolicyAcceptance, error) {
+	var acceptances []*models.PolicyAcceptance
+	if err := s.db.WithContext(ctx).Where("tenant_id = ?", tenantID).Order("accepted_at").Find(&acceptances).Error; err != nil {
+		return nil, err
+	}
+	return acceptances, nil
+}
+
+func (s *PostgresStorage) CreateAccessPolicy(ctx context.Context, policy *models.AccessPolicy) error {
+	if policy.ID == "" {
+		policy.ID = uuid.NewString()
+	}
+	return translate(s.db.WithContext(ctx).Create(policy).Error)
+}
+
+func (s *PostgresStorage) GetAccessPolicy(ctx context.Context, tenantID, id string) (*models.AccessPolicy, error) {
+	var policy models.AccessPolicy
+	if err := s.db.WithContext(ctx).First(&policy, "tenant_id = ? AND id = ?", tenantID, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAccessPolicyNotFound
+		}
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (s *PostgresStorage) ListAccessPolicies(ctx context.Context, tenantID string) ([]*models.AccessPolicy, error) {
+	var policies []*models.AccessPolicy
+	if err := s.db.WithContext(ctx).Where("tenant_id = ?", tenantID).Order("name asc").Find(&policies).Error; err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func (s *PostgresStorage) CreatePluginModule(ctx context.Context, module *models.PluginModule) error {
+	if module.ID == "" {
+		module.ID = uuid.NewString()
+	}
+	return translate(s.db.WithContext(ctx).Create(module).Error)
+}
+
+func (s *PostgresStorage) GetPluginModule(ctx context.Context, tenantID, id string) (*models.PluginModule, error) {
+	var module models.PluginModule
+	if err := s.db.WithContext(ctx).First(&module, "tenant_id = ? AND id = ?", tenantID, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPluginModuleNotFound
+		}
+		return nil, err
+	}
+	return &module, nil
+}
+
+func (s *PostgresStorage) ListPluginModules(ctx context.Context, tenantID string) ([]*models.PluginModule, error) {
+	var modules []*models.PluginModule
+	if err := s.db.WithContext(ctx).Omit("module").Where("tenant_id = ?", tenantID).Order("name asc, version asc").Find(&modules).Error; err != nil {
+		return nil, err
+	}
+	return modules, nil
+}
+
+func (s *PostgresStorage) SetPluginModuleActive(ctx context.Context, tenantID, id string, active bool) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var module models.PluginModule
+		if err := tx.Omit("module").First(&module, "tenant_id = ? AND id = ?", tenantID, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrPluginModuleNotFound
+			}
+			return err
+		}
+		if active {
+			if err := tx.Model(&models.PluginModule{}).Where("tenant_id = ? AND name = ?", tenantID, module.Name).Update("active", false).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&module).Updates(map[string]interface{}{"active": active, "updated_at": time.Now()}).Error
+	})
+}
+
+func (s *PostgresStorage) CreateDomainClaim(ctx context.Context, claim *models.DomainClaim) error {
+	if claim.ID == "" {
+		claim.ID = uuid.NewString()
+	}
+	return translate(s.db.WithContext(ctx).Create(claim).Error)
+}
+
+func (s *PostgresStorage) GetDomainClaim(ctx context.Context, tenantID, id string) (*models.DomainClaim, error) {
+	var claim models.DomainClaim
+	if err := s.db.WithContext(ctx).First(&claim, "tenant_id = ? AND id = ?", tenantID, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDomainClaimNotFound
+		}
+		return nil, err
+	}
+	return &claim, nil
+}
+
+func (s *PostgresStorage) ListDomainClaims(ctx context.Context, tenantID string) ([]*models.DomainClaim, error) {
+	var claims []*models.DomainClaim
+	if err := s.db.WithContext(ctx).Where("tenant_id = ?", tenantID).Order("domain asc").Find(&claims).Error; err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (s *PostgresStorage) FindVerifiedDomain(ctx context.Context, domain string) (*models.DomainClaim, error) {
+	var claim models.DomainClaim
+	if err := s.db.WithContext(Unscoped(ctx)).First(&claim, "domain = ? AND verified_at IS NOT NULL", domain).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDomainClaimNotFound
+		}
+		return nil, err
+	}
+	return &claim, nil
+}
+
+func (s *PostgresStorage) UpdateDomainClaim(ctx context.Context, claim *models.DomainClaim) error {
+	return update(s.db.WithContext(ctx), claim, ErrDomainClaimNotFound)
+}
+
+func (s *PostgresStorage) DeleteDomainClaim(ctx context.Context, tenantID, id string) error {
+	result := s.db.WithContext(ctx).Where("tenant_id = ? AND id = ?", tenantID, id).Delete(&models.DomainClaim{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrDomainClaimNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStorage) CreateSigningKey(ctx context.Context, key *models.SigningKey) error {
+	if key.ID == "" {
+		key.ID = uuid.NewString()
+	}
+	return translate(s.db.WithContext(ctx).Create(key).Error)
+}
+
+func (s *PostgresStorage) GetSigningKey(ctx context.Context, tenantID, id string) (*models.SigningKey, error) {
+	return s.findSigningKey(ctx, "tenant_id = ? AND id = ?", tenantID, id)
+}
+
+func (s *PostgresStorage) FindSigningKey(ctx context.Context, id string) (*models.SigningKey, error) {
+	return s.findSigningKey(Unscoped(ctx), "id = ?", id)
+}
+
+func (s *PostgresStorage) findSigningKey(ctx context.Context, query string, args ...interface{}) (*models.SigningKey, error) {
+	var key models.SigningKey
+	if err := s.db.WithContext(ctx).Where(query, args...).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSigningKeyNotFound
+		}
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (s *PostgresStorage) ListSigningKeys(ctx context.Context, tenantID string) ([]*models.SigningKey, error) {
+	var keys []*models.SigningKey
+	if err := s.db.WithContext(ctx).Where("tenant_id = ?", tenantID).Order("created_at asc").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *PostgresStorage) UpdateSigningKey(ctx context.Context, key *models.SigningKey) error {
+	return update(s.db.WithContext(ctx), key, ErrSigningKeyNotFound)
+}
+
+func (s *PostgresStorage) DeleteSigningKey(ctx context.Context, tenantID, id string) error {
+	result := s.db.WithContext(ctx).Where("tenant_id = ? AND id = ?", tenantID, id).Delete(&models.SigningKey{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSigningKeyNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStorage) ListTenantKeys(ctx context.Context, tenantID string) ([]*models.TenantKey, error) {
+	var keys []*models.TenantKey
+	if err := s.db.WithContext(ctx).Where("tenant_id = ?", tenantID).Order("version asc").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *PostgresStorage) ActivateTenantKey(ctx context.Context, key *models.TenantKey) error {
+	if key.ID == "" {
+		key.ID = uuid.NewString()
+	}
+	key.Active = true
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.TenantKey{}).Where("tenant_id = ? AND active", key.TenantID).Update("active", false).Error; err != nil {
+			return err
+		}
+		return translate(tx.Create(key).Error)
+	})
+}
+
+func (s *PostgresStorage) ListRetiredTenantKeys(ctx context.Context) ([]*models.TenantKey, error) {
+	var keys []*models.TenantKey
+	if err := s.db.WithContext(Unscoped(ctx)).Where("NOT active").Order("tenant_id asc, version asc").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *PostgresStorage) DeleteTenantKey(ctx context.Context, tenantID, id string) error {
+	result := s.db.WithContext(ctx).Where("tenant_id = ? AND id = ?", tenantID, id).Delete(&models.TenantKey{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTenantKeyNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStorage) DeleteAccessPolicy(ctx context.Context, tenantID, id string) error {
+	result := s.db.WithContext(ctx).Where("tenant_id = ? AND id = ?", tenantID, id).Delete(&models.AccessPolicy{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAccessPolicyNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStorage) CreateClient(ctx context.Context, client *models.Client) error {
+	if client.ID == "" {
+		client.ID = uuid.NewString()
+	}
+	return translate(s.db.WithContext(ctx).Create(client).Error)
+}
+
+func (s *PostgresStorage) GetClient(ctx context.Context, tenantID, id string) (*models.Client, error) {
+	var client models.Client
+	if err := s.db.WithContext(ctx).First(&client, "tenant_id = ? AND id = ?", tenantID, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrClientNotFound
+		}
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (s *PostgresStorage) ListClients(ctx context.Context, tenantID string) ([]*models.Client, error) {
+	var clients []*models.Client
+	if err := s.db.WithContext(ctx).Where("tenant_id = ?", tenantID).Order("name asc").Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (s *PostgresStorage) UpdateClient(ctx context.Context, client *models.Client) error {
+	return update(s.db.WithContext(ctx), client, ErrClientNotFound)
+}
+
+func (s *PostgresStorage) DeleteClient(ctx context.Context, tenantID, id string) error {
+	result := s.db.WithContext(ctx).Where("tenant_id = ? AND id = ?", tenantID, id).Delete(&models.Client{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrClientNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStorage) CreateAuditLog(ctx context.Context, entry *models.AuditLog) error {
+	if entry.ID == "" {
+		entry.ID = uuid.NewString()
+	}
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Entries of one tenant are appended one at a time, so no two link
+		// to the same predecessor.
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('audit_logs:' || ?))", entry.TenantID).Error; err != nil {
+			return err
+		}
+		var last []*models.AuditLog
+		if err := tx.Where("tenant_id = ? AND sequence > 0", entry.TenantID).Order("sequence desc").Limit(1).Find(&last).Error; err != nil {
+			return err
+		}
+		if len(last) > 0 {
+			chain(entry, last[0].Sequence, last[0].Hash)
+		} else {
+			// Retention may have purged the whole chain, which then goes on
+			// from its anchor.
+			anchor, err := auditChainAnchor(tx, entry.TenantID)
+			if err != nil {
+				return err
+			}
+			chain(entry, anchor.Sequence, anchor.Hash)
+		}
+		if err := translate(tx.Create(entry).Error); err != nil {
+			return err
+		}
+		if len(entry.Changes) == 0 {
+			return nil
+		}
+		for i := range entry.Changes {
+			change := &entry.Changes[i]
+			change.ID = uuid.NewString()
+			change.AuditLogID = entry.ID
+			change.TenantID = entry.TenantID
+		}
+		return tx.Create(&entry.Changes).Error
+	})
+}
+
+func (s *PostgresStorage) ListAuditChain(ctx context.Context, tenantID string, afterSequence int64, limit int) ([]*models.AuditLog, error) {
+	entries := []*models.AuditLog{}
+	if err := s.db.WithContext(ctx).
+		Where("tenant_id = ? AND sequence > ?", tenantID, afterSequence).
+		Order("sequence asc").
+		Limit(limit).
+		Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *PostgresStorage) ListAuditLogs(ctx context.Context, filter AuditLogFilter) ([]*models.AuditLog, int64, error) {
+	query := s.db.WithContext(ctx).Model(&models.AuditLog{}).Where("tenant_id = ?", filter.TenantID)
+	if filter.ActorID != "" {
+		query = query.Where("actor_id = ?", filter.ActorID)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.EventType != "" {
+		query = query.Where("event_type = ?", filter.EventType)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at <= ?", filter.Until)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var entries []*models.AuditLog
+	if err := query.
+		Order("created_at desc").
+		Offset((filter.Page - 1) * filter.PageSize).
+		Limit(filter.PageSize).
+		Find(&entries).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return entries, total, nil
+}
+
+func (s *PostgresStorage) ListDataChanges(ctx context.Context, tenantID, auditLogID string) ([]*models.DataChange, error) {
+	changes := []*models.DataChange{}
+	if err := s.db.WithContext(ctx).
+		Where("tenant_id = ? AND audit_log_id = ?", tenantID, auditLogID).
+		Order("created_at asc").
+		Find(&changes).Error; err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func (s *PostgresStorage) GetAuditChainAnchor(ctx context.Context, tenantID string) (*models.AuditChainAnchor, error) {
+	return auditChainAnchor(s.db.WithContext(ctx), tenantID)
+}
+
+func auditChainAnchor(db *gorm.DB, tenantID string) (*models.AuditChainAnchor, error) {
+	var anchors []*models.AuditChainAnchor
+	if err := db.Where("tenant_id = ?", tenantID).Limit(1).Find(&anchors).Error; err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return &models.AuditChainAnchor{TenantID: tenantID}, nil
+	}
+	return anchors[0], nil
+}
+
+// PurgeAuditLogs purges the data changes of the entries too. Changes are
+// written before their entry, so none outlives it.
+func (s *PostgresStorage) PurgeAuditLogs(ctx context.Context, olderThan time.Time) (int64, error) {
+	if err := s.db.WithContext(ctx).Where("created_at < ?", olderThan).Delete(&models.DataChange{}).Error; err != nil {
+		return 0, err
+	}
+	// Entries recorded before chaining are purged by age alone.
+	result := s.db.WithContext(ctx).Where("sequence = 0 AND created_at < ?", olderThan).Delete(&models.AuditLog{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	purged := result.RowsAffected
+
+	var anchors []*models.AuditChainAnchor
+	if err := s.db.WithContext(ctx).Model(&models.AuditLog{}).
+		Select("DISTINCT ON (tenant_id) tenant_id, sequence, hash").
+		Where("sequence > 0 AND created_at < ?", olderThan).
+		Order("tenant_id, sequence desc").
+		Scan(&anchors).Error; err != nil {
+		return purged, err
+	}
+	for _, anchor := range anchors {
+		n, err := s.purgeAuditChain(ctx, anchor)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// purgeAuditChain deletes the entries of the anchor's tenant up to the
+// anchor and records it, in step with entries being appended.
+func (s *PostgresStorage) purgeAuditChain(ctx context.Context, anchor *models.AuditChainAnchor) (int64, error) {
+	var purged int64
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('audit_logs:' || ?))", anchor.TenantID).Error; err != nil {
+			return err
+		}
+		anchor.UpdatedAt = time.Now()
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(anchor).Error; err != nil {
+			return err
+		}
+		result := tx.Where("tenant_id = ? AND sequence > 0 AND sequence <= ?", anchor.TenantID, anchor.Sequence).Delete(&models.AuditLog{})
+		purged = result.RowsAffected
+		return result.Error
+	})
+	return purged, err
+}
+
+func (s *PostgresStorage) CreateDigestDelivery(ctx context.Context, delivery *models.DigestDelivery) error {
+	if delivery.ID == "" {
+		delivery.ID = uuid.NewString()
+	}
+	return translate(s.db.WithContext(ctx).Create(delivery).Error)
+}
+
+func (s *PostgresStorage) DeleteDigestDelivery(ctx context.Context, tenantID, id string) error {
+	return s.db.WithContext(ctx).Where("tenant_id = ? AND id = ?", tenantID, id).Delete(&models.DigestDelivery{}).Error
+}
+
+func (s *PostgresStorage) CreateSSOSession(ctx context.Context, session *models.SSOSession) error {
+	if session.ID == "" {
+		session.ID = uuid.NewString()
+	}
+	return translate(s.db.WithContext(ctx).Create(session).Error)
+}
+
+func (s *PostgresStorage) GetSSOSessionByTokenHash(ctx context.Context, tenantID, tokenHash string) (*models.SSOSession, error) {
+	var session models.SSOSession
+	if err := s.db.WithContext(ctx).Where("tenant_id = ? AND token_hash = ?", tenantID, tokenHash).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSSOSessionNotFound
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *PostgresStorage) AddSSOSessionClient(ctx context.Context, tenantID, id, clientID string) error {
+	return s.db.WithContext(ctx).Model(&models.SSOSession{}).
+		Where("tenant_id = ? AND id = ? AND NOT coalesce(client_ids, '[]') @> jsonb_build_array(?::text)", tenantID, id, clientID).
+		Update("client_ids", gorm.Expr("coalesce(client_ids, '[]') || jsonb_build_array(?::text)", clientID)).Error
+}
+
+func (s *PostgresStorage) DeleteSSOSession(ctx context.Context, tenantID, id string) error {
+	result := s.db.WithContext(ctx).Where("tenant_id = ? AND id = ?", tenantID, id).Delete(&models.SSOSession{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSSOSessionNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStorage) PurgeSSOSessions(ctx context.Context, olderThan time.Time) (int64, error) {
+	result := s.db.WithContext(ctx).Where("expires_at < ?", olderThan).Delete(&models.SSOSession{})
+	return result.RowsAffected, result.Error
+}
+
+func (s *PostgresStorage) SaveConsentGrant(ctx context.Context, grant *models.ConsentGrant) error {
+	if grant.ID == "" {
+		grant.ID = uuid.NewString()
+	}
+	return s.db.WithContext(ctx).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "tenant_id"}, {Name: "user_id"}, {Name: "client_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"scopes", "updated_at"}),
+		}).
+		Create(grant).Error
+}
+
+func (s *PostgresStorage) GetConsentGrant(ctx context.Context, tenantID, userID, clientID string) (*models.ConsentGrant, error) {
+	var grant models.ConsentGrant
+	if err := s.db.WithContext(ctx).Where("tenant_id = ? AND user_id = ? AND client_id = ?", tenantID, userID, clientID).First(&grant).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrConsentGrantNotFound
+		}
+		return nil, err
+	}
+	return &grant, nil
+}
+
+func (s *PostgresStorage) ListConsentGrants(ctx context.Context, tenantID, userID string) ([]*models.ConsentGrant, error) {
+	var grants []*models.ConsentGrant
+	if err := s.db.WithContext(ctx).Where("tenant_id = ? AND user_id = ?", tenantID, userID).Order("client_id").Find(&grants).Error; err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+func (s *PostgresStorage) DeleteConsentGrant(ctx context.Context, tenantID, userID, clientID string) error {
+	result := s.db.WithContext(ctx).Where("tenant_id = ? AND user_id = ? AND client_id = ?", tenantID, userID, clientID).Delete(&models.ConsentGrant{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrConsentGrantNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStorage) CreateJob(ctx context.Context, job *models.Job) error {
+	if job.ID == "" {
+		job.ID = uuid.NewString()
+	}
+	return translate(s.db.WithContext(ctx).Create(job).Error)
+}
+
+func (s *PostgresStorage) GetJob(ctx context.Context, tenantID, id string) (*models.Job, error) {
+	var job models.Job
+	if err := s.db.WithContext(ctx).Where("tenant_id = ? AND id = ?", tenantID, id).First(&job).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrJobNotFound
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *PostgresStorage) ListJobs(ctx context.Context, tenantID string, kind models.JobKind) ([]*models.Job, error) {
+	jobs := []*models.Job{}
+	if err := s.db.WithContext(ctx).Where("tenant_id = ? AND kind = ?", tenantID, kind).Order("created_at desc").Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (s *PostgresStorage) ClaimJob(ctx context.Context, kinds []models.JobKind, staleBefore time.Time) (*models.Job, error) {
+	var job models.Job
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Rows another runner is claiming are skipped rather than waited on.
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("kind IN ? AND (status = ? OR (status = ? AND updated_at < ?))", kinds, models.JobPending, models.JobRunning, staleBefore).
+			Order("created_at").
+			First(&job).Error; err != nil {
+			return err
+		}
+		job.Status = models.JobRunning
+		job.UpdatedAt = time.Now()
+		return tx.Model(&job).Select("status", "updated_at").Updates(&job).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *PostgresStorage) UpdateJob(ctx context.Context, job *models.Job) error {
+	return update(s.db.WithContext(ctx), job, ErrJobNotFound)
+}
+
+func (s *PostgresStorage) PurgeJobs(ctx context.Context, olderThan time.Time) (int64, error) {
+	result := s.db.WithContext(ctx).Where("created_at < ?", olderThan).Delete(&models.Job{})
+	return result.RowsAffected, result.Error
+}
+
+func (s *PostgresStorage) CreateDeviceAuthorization(ctx context.Context, auth *models.DeviceAuthorization) error {
+	if auth.ID == "" {
+		auth.ID = uuid.NewString()
+	}
+	return translate(s.db.WithContext(ctx).Create(auth).Error)
+}
+
+func (s *PostgresStorage) GetDeviceAuthorizationByDeviceCode(ctx context.Context, tenantID, deviceCodeHash string) (*models.DeviceAuthorization, error) {
+	return s.findDeviceAuthorization(ctx, "tenant_id = ? AND device_code_hash = ?", tenantID, deviceCodeHash)
+}
+
+func (s *PostgresStorage) GetDeviceAuthorizationByUserCode(ctx context.Context, tenantID, userCode string) (*models.DeviceAuthorization, error) {
+	return s.findDeviceAuthorization(ctx, "tenant_id = ? AND user_code = ?", tenantID, userCode)
+}
+
+func (s *PostgresStorage) findDeviceAuthorization(ctx context.Context, query string, args ...interface{}) (*models.DeviceAuthorization, error) {
+	var auth models.DeviceAuthorization
+	if err := s.db.WithContext(ctx).Where(query, args...).First(&auth).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDeviceAuthorizationNotFound
+		}
+		return nil, err
+	}
+	return &auth, nil
+}
+
+func (s *PostgresStorage) UpdateDeviceAuthorization(ctx context.Context, auth *models.DeviceAuthorization) error {
+	return update(s.db.WithContext(ctx), auth, ErrDeviceAuthorizationNotFound)
+}
+
+func (s *PostgresStorage) DeleteDeviceAuthorization(ctx context.Context, tenantID, id string) error {
+	result := s.db.WithContext(ctx).Where("tenant_id = ? AND id = ?", tenantID, id).Delete(&models.DeviceAuthorization{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrDeviceAuthorizationNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStorage) PurgeDeviceAuthorizations(ctx context.Context, olderThan time.Time) (int64, error) {
+	result := s.db.WithContext(ctx).Where("expires_at < ?", olderThan).Delete(&models.DeviceAuthorization{})
+	return result.RowsAffected, result.Error
+}
+
+func (s *InMemoryStorage) CreateTenant(ctx context.Context, tenant *models.Tenant) error {
+	assignTenantIDs(tenant)
+	if _, exists := s.tenants[tenant.ID]; exists {
+		return ErrConflict
+	}
+	s.tenants[tenant.ID] = tenant
+	return nil
+}
+
+func (s *InMemoryStorage) GetTenant(ctx context.Context, id string) (*models.Tenant, error) {
+	tenant, exists := s.tenants[id]
+	if !exists {
+		return nil, ErrTenantNotFound
+	}
+	return tenant, nil
+}
+
+func (s *InMemoryStorage) UpdateTenant(ctx context.Context, tenant *models.Tenant) error {
+	existing, exists := s.tenants[tenant.ID]
+	if !exists {
+		return ErrTenantNotFound
+	}
+	existing.Name = tenant.Name
+	existing.Status = tenant.Status
+	existing.UpdatedAt = tenant.UpdatedAt
+	return nil
+}
+
+func (s *InMemoryStorage) UpdateTenantConfig(ctx context.Context, config *models.TenantConfig) error {
+	tenant, exists := s.tenants[config.TenantID]
+	if !exists {
+		return ErrTenantNotFound
+	}
+	tenant.Config = *config
+	return nil
+}
+
+func (s *InMemoryStorage) CreateUser(ctx context.Context, user *models.User) error {
+	if user.ID == "" {
+		user.ID = uuid.NewString()
+	}
+	if _, exists := s.users[user.ID]; exists {
+		return ErrConflict
+	}
+	if err := s.checkUserUnique(user); err != nil {
+		return err
+	}
+	s.users[user.ID] = user
+	s.written.notify(ctx, user)
+	return nil
+}
+
+// checkUserUnique enforces the unique indexes of the users table: username
+// and email within a pool, and phone across all tenants.
+func (s *InMemoryStorage) checkUserUnique(user *models.User) error {
+	for _, other := range s.users {
+		if other.ID == user.ID {
+			continue
+		}
+		samePool := other.TenantID == user.TenantID && other.EnvironmentID == user.EnvironmentID
+		if samePool && other.Username == user.Username {
+			return ErrConflict
+		}
+		if samePool && user.Email != "" && other.Email == user.Email {
+			return ErrConflict
+		}
+		if user.Phone != "" && other.Phone == user.Phone {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) UpdateUsers(ctx context.Context, users []*models.User) error {
+	for _, user := range users {
+		if _, exists := s.users[user.ID]; !exists {
+			return ErrUserNotFound
+		}
+		if err := s.checkUserUnique(user); err != nil {
+			return err
+		}
+	}
+	for _, user := range users {
+		s.users[user.ID] = user
+	}
+	s.written.notify(ctx, users...)
+	return nil
+}
+
+func (s *InMemoryStorage) GetUser(ctx context.Context, id string) (*models.User, error) {
+	user, exists := s.users[id]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *InMemoryStorage) UpdateUser(ctx context.Context, user *models.User) error {
+	if _, exists := s.users[user.ID]; !exists {
+		return ErrUserNotFound
+	}
+	if err := s.checkUserUnique(user); err != nil {
+		return err
+	}
+	s.users[user.ID] = user
+	s.written.notify(ctx, user)
+	return nil
+}
+
+func (s *InMemoryStorage) FindUserByAttribute(ctx context.Context, tenantID, name string, value interface{}) (*models.User, error) {
+	for _, user := range s.users {
+		if user.TenantID != tenantID {
+			continue
+		}
+		if existing, ok := user.Attributes[name]; ok && existing == value {
+			return user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (s *InMemoryStorage) ListUsers(ctx context.Context, filter UserFilter) ([]models.User, int64, error) {
+	var ids map[string]bool
+	if filter.IDs != nil {
+		ids = make(map[string]bool, len(filter.IDs))
+		for _, id := range filter.IDs {
+			ids[id] = true
+		}
+	}
+
+	search := strings.ToLower(filter.Search)
+	matched := []models.User{}
+	for _, user := range s.users {
+		if user.TenantID != filter.TenantID {
+			continue
+		}
+		if filter.Role != "" && string(user.Role) != filter.Role {
+			continue
+		}
+		if ids != nil && !ids[user.ID] {
+			continue
+		}
+		if !filter.CreatedSince.IsZero() && user.CreatedAt.Before(filter.CreatedSince) {
+			continue
+		}
+		if !filter.LastLoginSince.IsZero() && user.LastLogin.Before(filter.LastLoginSince) {
+			continue
+		}
+		if search != "" && !userMatchesSearch(user, search) {
+			continue
+		}
+		if !userMatchesAttributes(user, filter.Attributes) {
+			continue
+		}
+		matched = append(matched, *user)
+	}
+
+	sortBy, sortDir := userSort(filter)
+	sort.Slice(matched, func(i, j int) bool {
+		if sortDir == "desc" {
+			return userLess(matched[j], matched[i], sortBy)
+		}
+		return userLess(matched[i], matched[j], sortBy)
+	})
+
+	total := int64(len(matched))
+	offset := (filter.Page - 1) * filter.PageSize
+	if offset >= len(matched) {
+		return []models.User{}, total, nil
+	}
+	end := offset + filter.PageSize
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	return matched[offset:end], total, nil
+}
+
+func userMatchesSearch(user *models.User, search string) bool {
+	if strings.Contains(strings.ToLower(user.Username), search) || strings.Contains(user.Phone, search) {
+		return true
+	}
+	for _, value := range user.Attributes {
+		if strings.Contains(strings.ToLower(fmt.Sprint(value)), search) {
+			return true
+		}
+	}
+	return false
+}
+
+func userMatchesAttributes(user *models.User, attributes map[string]interface{}) bool {
+	for name, value := range attributes {
+		if existing, ok := user.Attributes[name]; !ok || existing != value {
+			return false
+		}
+	}
+	return true
+}
+
+// userLess orders users like Postgres does, breaking ties by ID so pages
+// never overlap.
+func userLess(a, b models.User, sortBy string) bool {
+	switch sortBy {
+	case "username":
+		if a.Username != b.Username {
+			return a.Username < b.Username
+		}
+	case "role":
+		if a.Role != b.Role {
+			return a.Role < b.Role
+		}
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+	case "last_login":
+		if !a.LastLogin.Equal(b.LastLogin) {
+			return a.LastLogin.Before(b.LastLogin)
+		}
+	default:
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+	}
+	return a.ID < b.ID
+}
+
+func (s *InMemoryStorage) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	for _, user := range s.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (s *InMemoryStorage) GetPoolUserByUsername(ctx context.Context, tenantID, environmentID, username string) (*models.User, error) {
+	for _, user := range s.users {
+		if user.TenantID == tenantID && user.EnvironmentID == environmentID && user.Username == username {
+			return user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (s *InMemoryStorage) GetPoolUserByEmail(ctx context.Context, tenantID, environmentID, email string) (*models.User, error) {
+	for _, user := range s.users {
+		if user.TenantID == tenantID && user.EnvironmentID == environmentID && user.Email != "" && user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (s *InMemoryStorage) GetUserByPhone(ctx context.Context, phone string) (*models.User, error) {
+	for _, user := range s.users {
+		if user.Phone == phone {
+			return user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (s *InMemoryStorage) UpdateUserLastLogin(ctx context.Context, userID string) error {
+	user, exists := s.users[userID]
+	if !exists {
+		return ErrUserNotFound
+	}
+	user.LastLogin = time.Now()
+	return nil
+}
+
+func (s *InMemoryStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteTenant(ctx context.Context, id string) error {
+	if _, exists := s.tenants[id]; !exists {
+		return ErrTenantNotFound
+	}
+	if err := s.deleteTenantData(ctx, id); err != nil {
+		return err
+	}
+	delete(s.tenants, id)
+	return nil
+}
+
+func (s *InMemoryStorage) ListTenants(ctx context.Context, page, pageSize int) ([]*models.Tenant, int64, error) {
+	tenants := make([]*models.Tenant, 0, len(s.tenants))
+	for _, tenant := range s.tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		if !tenants[i].CreatedAt.Equal(tenants[j].CreatedAt) {
+			return tenants[i].CreatedAt.Before(tenants[j].CreatedAt)
+		}
+		return tenants[i].ID < tenants[j].ID
+	})
+
+	total := int64(len(tenants))
+	offset := (page - 1) * pageSize
+	if offset >= len(tenants) {
+		return []*models.Tenant{}, total, nil
+	}
+	end := offset + pageSize
+	if end > len(tenants) {
+		end = len(tenants)
+	}
+
+	return tenants[offset:end], total, nil
+}
+
+func (s *InMemoryStorage) CreateEnvironment(ctx context.Context, env *models.Environment) error {
+	if env.ID == "" {
+		env.ID = uuid.NewString()
+	}
+	if _, exists := s.environments[env.ID]; exists {
+		return ErrConflict
+	}
+	if err := s.checkEnvironmentUnique(env); err != nil {
+		return err
+	}
+	s.environments[env.ID] = env
+	return nil
+}
+
+// checkEnvironmentUnique enforces unique names within a tenant and unique
+// API keys.
+func (s *InMemoryStorage) checkEnvironmentUnique(env *models.Environment) error {
+	for _, other := range s.environments {
+		if other.ID == env.ID {
+			continue
+		}
+		if other.TenantID == env.TenantID && other.Name == env.Name || other.APIKeyHash == env.APIKeyHash {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) UpdateEnvironment(ctx context.Context, env *models.Environment) error {
+	if _, exists := s.environments[env.ID]; !exists {
+		return ErrEnvironmentNotFound
+	}
+	if err := s.checkEnvironmentUnique(env); err != nil {
+		return err
+	}
+	s.environments[env.ID] = env
+	return nil
+}
+
+func (s *InMemoryStorage) GetEnvironment(ctx context.Context, id string) (*models.Environment, error) {
+	env, exists := s.environments[id]
+	if !exists {
+		return nil, ErrEnvironmentNotFound
+	}
+	return env, nil
+}
+
+func (s *InMemoryStorage) GetEnvironmentByName(ctx context.Context, tenantID, name string) (*models.Environment, error) {
+	for _, env := range s.environments {
+		if env.TenantID == tenantID && env.Name == name {
+			return env, nil
+		}
+	}
+	return nil, ErrEnvironmentNotFound
+}
+
+func (s *InMemoryStorage) GetEnvironmentByAPIKeyHash(ctx context.Context, hash string) (*models.Environment, error) {
+	for _, env := range s.environments {
+		if env.APIKeyHash == hash {
+			return env, nil
+		}
+	}
+	return nil, ErrEnvironmentNotFound
+}
+
+func (s *InMemoryStorage) ListEnvironments(ctx context.Context, tenantID string) ([]*models.Environment, error) {
+	envs := []*models.Environment{}
+	for _, env := range s.environments {
+		if env.TenantID == tenantID {
+			envs = append(envs, env)
+		}
+	}
+	sort.Slice(envs, func(i, j int) bool {
+		return envs[i].Name < envs[j].Name
+	})
+	return envs, nil
+}
+
+func (s *InMemoryStorage) CreatePolicyVersion(ctx context.Context, policy *models.PolicyVersion) error {
+	if policy.ID == "" {
+		policy.ID = uuid.NewString()
+	}
+	for id, existing := range s.policies {
+		if id == policy.ID || existing.TenantID == policy.TenantID && existing.Kind == policy.Kind && existing.Version == policy.Version {
+			return ErrConflict
+		}
+	}
+	s.policies[policy.ID] = policy
+	return nil
+}
+
+func (s *InMemoryStorage) GetPolicyVersion(ctx context.Context, id string) (*models.PolicyVersion, error) {
+	policy, exists := s.policies[id]
+	if !exists {
+		return nil, ErrPolicyNotFound
+	}
+	return policy, nil
+}
+
+func (s *InMemoryStorage) ListPolicyVersions(ctx context.Context, tenantID string) ([]*models.PolicyVersion, error) {
+	policies := []*models.PolicyVersion{}
+	for _, policy := range s.policies {
+		if policy.TenantID == tenantID {
+			policies = append(policies, policy)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].PublishedAt.After(policies[j].PublishedAt)
+	})
+	return policies, nil
+}
+
+func (s *InMemoryStorage) CurrentPolicyVersions(ctx context.Context, tenantID string) ([]*models.PolicyVersion, error) {
+	now := time.Now()
+	current := make(map[models.PolicyKind]*models.PolicyVersion)
+	for _, policy := range s.policies {
+		if policy.TenantID != tenantID || policy.PublishedAt.After(now) {
+			continue
+		}
+		if existing, ok := current[policy.Kind]; !ok || policy.PublishedAt.After(existing.PublishedAt) {
+			current[policy.Kind] = policy
+		}
+	}
+
+	policies := make([]*models.PolicyVersion, 0, len(current))
+	for _, policy := range current {
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Kind < policies[j].Kind
+	})
+	return policies, nil
+}
+
+func (s *InMemoryStorage) CreatePolicyAcceptance(ctx context.Context, acceptance *models.PolicyAcceptance) error {
+	for _, existing := range s.acceptances {
+		if existing.UserID == acceptance.UserID && existing.PolicyVersionID == acceptance.PolicyVersionID {
+			return nil
+		}
+	}
+	if acceptance.ID == "" {
+		acceptance.ID = uuid.NewString()
+	}
+	s.acceptances[acceptance.ID] = acceptance
+	return nil
+}
+
+func (s *InMemoryStorage) HasAcceptedPolicy(ctx context.Context, userID, policyVersionID string) (bool, error) {
+	for _, acceptance := range s.acceptances {
+		if acceptance.UserID == userID && acceptance.PolicyVersionID == policyVersionID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *InMemoryStorage) ListPolicyAcceptances(ctx context.Context, tenantID string) ([]*models.PolicyAcceptance, error) {
+	acceptances := []*models.PolicyAcceptance{}
+	for _, acceptance := range s.acceptances {
+		if acceptance.TenantID == tenantID {
+			acceptances = append(acceptances, acceptance)
+		}
+	}
+	sort.Slice(acceptances, func(i, j int) bool {
+		return acceptances[i].AcceptedAt.Before(acceptances[j].AcceptedAt)
+	})
+	return acceptances, nil
+}
+
+func (s *InMemoryStorage) CreateAccessPolicy(ctx context.Context, policy *models.AccessPolicy) error {
+	if policy.ID == "" {
+		policy.ID = uuid.NewString()
+	}
+	for id, existing := range s.access {
+		if id == policy.ID || existing.TenantID == policy.TenantID && existing.Name == policy.Name {
+			return ErrConflict
+		}
+	}
+	s.access[policy.ID] = policy
+	return nil
+}
+
+func (s *InMemoryStorage) GetAccessPolicy(ctx context.Context, tenantID, id string) (*models.AccessPolicy, error) {
+	policy, exists := s.access[id]
+	if !exists || policy.TenantID != tenantID {
+		return nil, ErrAccessPolicyNotFound
+	}
+	return policy, nil
+}
+
+func (s *InMemoryStorage) ListAccessPolicies(ctx context.Context, tenantID string) ([]*models.AccessPolicy, error) {
+	policies := []*models.AccessPolicy{}
+	for _, policy := range s.access {
+		if policy.TenantID == tenantID {
+			policies = append(policies, policy)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+	return policies, nil
+}
+
+func (s *InMemoryStorage) DeleteAccessPolicy(ctx context.Context, tenantID, id string) error {
+	policy, exists := s.access[id]
+	if !exists || policy.TenantID != tenantID {
+		return ErrAccessPolicyNotFound
+	}
+	delete(s.access, id)
+	return nil
+}
+
+func (s *InMemoryStorage) CreateClient(ctx context.Context, client *models.Client) error {
+	if client.ID == "" {
+		client.ID = uuid.NewString()
+	}
+	if _, exists := s.clients[client.ID]; exists {
+		return ErrConflict
+	}
+	if err := s.checkClientUnique(client); err != nil {
+		return err
+	}
+	s.clients[client.ID] = client
+	return nil
+}
+
+func (s *InMemoryStorage) GetClient(ctx context.Context, tenantID, id string) (*models.Client, error) {
+	client, exists := s.clients[id]
+	if !exists || client.TenantID != tenantID {
+		return nil, ErrClientNotFound
+	}
+	return client, nil
+}
+
+func (s *InMemoryStorage) ListClients(ctx context.Context, tenantID string) ([]*models.Client, error) {
+	clients := []*models.Client{}
+	for _, client := range s.clients {
+		if client.TenantID == tenantID {
+			clients = append(clients, client)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Name < clients[j].Name
+	})
+	return clients, nil
+}
+
+func (s *InMemoryStorage) UpdateClient(ctx context.Context, client *models.Client) error {
+	if _, exists := s.clients[client.ID]; !exists {
+		return ErrClientNotFound
+	}
+	if err := s.checkClientUnique(client); err != nil {
+		return err
+	}
+	s.clients[client.ID] = client
+	return nil
+}
+
+func (s *InMemoryStorage) checkClientUnique(client *models.Client) error {
+	for id, existing := range s.clients {
+		if id != client.ID && existing.TenantID == client.TenantID && existing.Name == client.Name {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteClient(ctx context.Context, tenantID, id string) error {
+	client, exists := s.clients[id]
+	if !exists || client.TenantID != tenantID {
+		return ErrClientNotFound
+	}
+	delete(s.clients, id)
+	return nil
+}
+
+func (s *InMemoryStorage) CreatePluginModule(ctx context.Context, module *models.PluginModule) error {
+	if module.ID == "" {
+		module.ID = uuid.NewString()
+	}
+	for id, existing := range s.plugins {
+		if id == module.ID || existing.TenantID == module.TenantID && existing.Name == module.Name && existing.Version == module.Version {
+			return ErrConflict
+		}
+	}
+	s.plugins[module.ID] = module
+	return nil
+}
+
+func (s *InMemoryStorage) GetPluginModule(ctx context.Context, tenantID, id string) (*models.PluginModule, error) {
+	module, exists := s.plugins[id]
+	if !exists || module.TenantID != tenantID {
+		return nil, ErrPluginModuleNotFound
+	}
+	return module, nil
+}
+
+func (s *InMemoryStorage) ListPluginModules(ctx context.Context, tenantID string) ([]*models.PluginModule, error) {
+	modules := []*models.PluginModule{}
+	for _, module := range s.plugins {
+		if module.TenantID == tenantID {
+			listed := *module
+			listed.Module = nil
+			modules = append(modules, &listed)
+		}
+	}
+	sort.Slice(modules, func(i, j int) bool {
+		if modules[i].Name != modules[j].Name {
+			return modules[i].Name < modules[j].Name
+		}
+		return modules[i].Version < modules[j].Version
+	})
+	return modules, nil
+}
+
+func (s *InMemoryStorage) SetPluginModuleActive(ctx context.Context, tenantID, id string, active bool) error {
+	module, exists := s.plugins[id]
+	if !exists || module.TenantID != tenantID {
+		return ErrPluginModuleNotFound
+	}
+	if active {
+		for _, other := range s.plugins {
+			if other.TenantID == tenantID && other.Name == module.Name {
+				other.Active = false
+			}
+		}
+	}
+	module.Active = active
+	module.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *InMemoryStorage) CreateDomainClaim(ctx context.Context, claim *models.DomainClaim) error {
+	if claim.ID == "" {
+		claim.ID = uuid.NewString()
+	}
+	if _, exists := s.domains[claim.ID]; exists {
+		return ErrConflict
+	}
+	if err := s.checkDomainClaimUnique(claim); err != nil {
+		return err
+	}
+	s.domains[claim.ID] = claim
+	return nil
+}
+
+func (s *InMemoryStorage) GetDomainClaim(ctx context.Context, tenantID, id string) (*models.DomainClaim, error) {
+	claim, exists := s.domains[id]
+	if !exists || claim.TenantID != tenantID {
+		return nil, ErrDomainClaimNotFound
+	}
+	return claim, nil
+}
+
+func (s *InMemoryStorage) ListDomainClaims(ctx context.Context, tenantID string) ([]*models.DomainClaim, error) {
+	claims := []*models.DomainClaim{}
+	for _, claim := range s.domains {
+		if claim.TenantID == tenantID {
+			claims = append(claims, claim)
+		}
+	}
+	sort.Slice(claims, func(i, j int) bool {
+		return claims[i].Domain < claims[j].Domain
+	})
+	return claims, nil
+}
+
+func (s *InMemoryStorage) FindVerifiedDomain(ctx context.Context, domain string) (*models.DomainClaim, error) {
+	for _, claim := range s.domains {
+		if claim.Domain == domain && claim.Verified() {
+			return claim, nil
+		}
+	}
+	return nil, ErrDomainClaimNotFound
+}
+
+// checkDomainClaimUnique enforces one claim per domain within a tenant and
+// one verified claim per domain across tenants.
+func (s *InMemoryStorage) checkDomainClaimUnique(claim *models.DomainClaim) error {
+	for _, other := range s.domains {
+		if other.ID == claim.ID || other.Domain != claim.Domain {
+			continue
+		}
+		if other.TenantID == claim.TenantID || other.Verified() && claim.Verified() {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) UpdateDomainClaim(ctx context.Context, claim *models.DomainClaim) error {
+	if _, exists := s.domains[claim.ID]; !exists {
+		return ErrDomainClaimNotFound
+	}
+	if err := s.checkDomainClaimUnique(claim); err != nil {
+		return err
+	}
+	s.domains[claim.ID] = claim
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteDomainClaim(ctx context.Context, tenantID, id string) error {
+	claim, exists := s.domains[id]
+	if !exists || claim.TenantID != tenantID {
+		return ErrDomainClaimNotFound
+	}
+	delete(s.domains, id)
+	return nil
+}
+
+func (s *InMemoryStorage) CreateSigningKey(ctx context.Context, key *models.SigningKey) error {
+	if key.ID == "" {
+		key.ID = uuid.NewString()
+	}
+	if _, exists := s.signingKeys[key.ID]; exists {
+		return ErrConflict
+	}
+	s.signingKeys[key.ID] = key
+	return nil
+}
+
+func (s *InMemoryStorage) GetSigningKey(ctx context.Context, tenantID, id string) (*models.SigningKey, error) {
+	key, exists := s.signingKeys[id]
+	if !exists || key.TenantID != tenantID {
+		return nil, ErrSigningKeyNotFound
+	}
+	return key, nil
+}
+
+func (s *InMemoryStorage) FindSigningKey(ctx context.Context, id string) (*models.SigningKey, error) {
+	key, exists := s.signingKeys[id]
+	if !exists {
+		return nil, ErrSigningKeyNotFound
+	}
+	return key, nil
+}
+
+func (s *InMemoryStorage) ListSigningKeys(ctx context.Context, tenantID string) ([]*models.SigningKey, error) {
+	keys := []*models.SigningKey{}
+	for _, key := range s.signingKeys {
+		if key.TenantID == tenantID {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (s *InMemoryStorage) UpdateSigningKey(ctx context.Context, key *models.SigningKey) error {
+	if _, exists := s.signingKeys[key.ID]; !exists {
+		return ErrSigningKeyNotFound
+	}
+	s.signingKeys[key.ID] = key
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteSigningKey(ctx context.Context, tenantID, id string) error {
+	key, exists := s.signingKeys[id]
+	if !exists || key.TenantID != tenantID {
+		return ErrSigningKeyNotFound
+	}
+	delete(s.signingKeys, id)
+	return nil
+}
+
+func (s *InMemoryStorage) ListTenantKeys(ctx context.Context, tenantID string) ([]*models.TenantKey, error) {
+	s.tenantKeyMu.Lock()
+	defer s.tenantKeyMu.Unlock()
+
+	keys := []*models.TenantKey{}
+	for _, key := range s.tenantKeys {
+		if key.TenantID == tenantID {
+			copied := *key
+			keys = append(keys, &copied)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Version < keys[j].Version
+	})
+	return keys, nil
+}
+
+func (s *InMemoryStorage) ActivateTenantKey(ctx context.Context, key *models.TenantKey) error {
+	if key.ID == "" {
+		key.ID = uuid.NewString()
+	}
+	key.Active = true
+
+	s.tenantKeyMu.Lock()
+	defer s.tenantKeyMu.Unlock()
+
+	for _, other := range s.tenantKeys {
+		if other.ID == key.ID || other.TenantID == key.TenantID && other.Version == key.Version {
+			return ErrConflict
+		}
+	}
+	for _, other := range s.tenantKeys {
+		if other.TenantID == key.TenantID {
+			other.Active = false
+		}
+	}
+	copied := *key
+	s.tenantKeys[key.ID] = &copied
+	return nil
+}
+
+func (s *InMemoryStorage) ListRetiredTenantKeys(ctx context.Context) ([]*models.TenantKey, error) {
+	s.tenantKeyMu.Lock()
+	defer s.tenantKeyMu.Unlock()
+
+	keys := []*models.TenantKey{}
+	for _, key := range s.tenantKeys {
+		if !key.Active {
+			copied := *key
+			keys = append(keys, &copied)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].TenantID != keys[j].TenantID {
+			return keys[i].TenantID < keys[j].TenantID
+		}
+		return keys[i].Version < keys[j].Version
+	})
+	return keys, nil
+}
+
+func (s *InMemoryStorage) DeleteTenantKey(ctx context.Context, tenantID, id string) error {
+	s.tenantKeyMu.Lock()
+	defer s.tenantKeyMu.Unlock()
+
+	key, exists := s.tenantKeys[id]
+	if !exists || key.TenantID != tenantID {
+		return ErrTenantKeyNotFound
+	}
+	delete(s.tenantKeys, id)
+	return nil
+}
+
+func (s *InMemoryStorage) CreateDigestDelivery(ctx context.Context, delivery *models.DigestDelivery) error {
+	if delivery.ID == "" {
+		delivery.ID = uuid.NewString()
+	}
+
+	s.digestMu.Lock()
+	defer s.digestMu.Unlock()
+
+	for _, other := range s.digests {
+		if other.TenantID == delivery.TenantID && other.PeriodEnd.Equal(delivery.PeriodEnd) {
+			return ErrConflict
+		}
+	}
+	copied := *delivery
+	s.digests[delivery.ID] = &copied
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteDigestDelivery(ctx context.Context, tenantID, id string) error {
+	s.digestMu.Lock()
+	defer s.digestMu.Unlock()
+
+	if delivery, exists := s.digests[id]; exists && delivery.TenantID == tenantID {
+		delete(s.digests, id)
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) CreateSSOSession(ctx context.Context, session *models.SSOSession) error {
+	if session.ID == "" {
+		session.ID = uuid.NewString()
+	}
+
+	s.ssoMu.Lock()
+	defer s.ssoMu.Unlock()
+	for _, other := range s.ssoSessions {
+		if other.ID == session.ID || other.TokenHash == session.TokenHash {
+			return ErrConflict
+		}
+	}
+	stored := *session
+	stored.ClientIDs = slices.Clone(session.ClientIDs)
+	s.ssoSessions[session.ID] = &stored
+	return nil
+}
+
+func (s *InMemoryStorage) GetSSOSessionByTokenHash(ctx context.Context, tenantID, tokenHash string) (*models.SSOSession, error) {
+	s.ssoMu.Lock()
+	defer s.ssoMu.Unlock()
+	for _, session := range s.ssoSessions {
+		if session.TenantID == tenantID && session.TokenHash == tokenHash {
+			found := *session
+			found.ClientIDs = slices.Clone(session.ClientIDs)
+			return &found, nil
+		}
+	}
+	return nil, ErrSSOSessionNotFound
+}
+
+func (s *InMemoryStorage) AddSSOSessionClient(ctx context.Context, tenantID, id, clientID string) error {
+	s.ssoMu.Lock()
+	defer s.ssoMu.Unlock()
+	session, exists := s.ssoSessions[id]
+	if exists && session.TenantID == tenantID && !slices.Contains(session.ClientIDs, clientID) {
+		session.ClientIDs = append(session.ClientIDs, clientID)
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteSSOSession(ctx context.Context, tenantID, id string) error {
+	s.ssoMu.Lock()
+	defer s.ssoMu.Unlock()
+	session, exists := s.ssoSessions[id]
+	if !exists || session.TenantID != tenantID {
+		return ErrSSOSessionNotFound
+	}
+	delete(s.ssoSessions, id)
+	return nil
+}
+
+func (s *InMemoryStorage) PurgeSSOSessions(ctx context.Context, olderThan time.Time) (int64, error) {
+	s.ssoMu.Lock()
+	defer s.ssoMu.Unlock()
+
+	var purged int64
+	for id, session := range s.ssoSessions {
+		if session.ExpiresAt.Before(olderThan) {
+			delete(s.ssoSessions, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (s *InMemoryStorage) SaveConsentGrant(ctx context.Context, grant *models.ConsentGrant) error {
+	if grant.ID == "" {
+		grant.ID = uuid.NewString()
+	}
+
+	s.consentMu.Lock()
+	defer s.consentMu.Unlock()
+	for _, existing := range s.consents {
+		if existing.TenantID == grant.TenantID && existing.UserID == grant.UserID && existing.ClientID == grant.ClientID {
+			existing.Scopes = slices.Clone(grant.Scopes)
+			existing.UpdatedAt = grant.UpdatedAt
+			return nil
+		}
+	}
+	stored := *grant
+	stored.Scopes = slices.Clone(grant.Scopes)
+	s.consents[grant.ID] = &stored
+	return nil
+}
+
+func (s *InMemoryStorage) GetConsentGrant(ctx context.Context, tenantID, userID, clientID string) (*models.ConsentGrant, error) {
+	s.consentMu.Lock()
+	defer s.consentMu.Unlock()
+	for _, grant := range s.consents {
+		if grant.TenantID == tenantID && grant.UserID == userID && grant.ClientID == clientID {
+			found := *grant
+			found.Scopes = slices.Clone(grant.Scopes)
+			return &found, nil
+		}
+	}
+	return nil, ErrConsentGrantNotFound
+}
+
+func (s *InMemoryStorage) ListConsentGrants(ctx context.Context, tenantID, userID string) ([]*models.ConsentGrant, error) {
+	s.consentMu.Lock()
+	defer s.consentMu.Unlock()
+	grants := []*models.ConsentGrant{}
+	for _, grant := range s.consents {
+		if grant.TenantID == tenantID && grant.UserID == userID {
+			found := *grant
+			found.Scopes = slices.Clone(grant.Scopes)
+			grants = append(grants, &found)
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].ClientID < grants[j].ClientID
+	})
+	return grants, nil
+}
+
+func (s *InMemoryStorage) DeleteConsentGrant(ctx context.Context, tenantID, userID, clientID string) error {
+	s.consentMu.Lock()
+	defer s.consentMu.Unlock()
+	for id, grant := range s.consents {
+		if grant.TenantID == tenantID && grant.UserID == userID && grant.ClientID == clientID {
+			delete(s.consents, id)
+			return nil
+		}
+	}
+	return ErrConsentGrantNotFound
+}
+
+func (s *InMemoryStorage) CreateJob(ctx context.Context, job *models.Job) error {
+	if job.ID == "" {
+		job.ID = uuid.NewString()
+	}
+
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+	if _, exists := s.jobs[job.ID]; exists {
+		return ErrConflict
+	}
+	stored := *job
+	s.jobs[job.ID] = &stored
+	return nil
+}
+
+func (s *InMemoryStorage) GetJob(ctx context.Context, tenantID, id string) (*models.Job, error) {
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+	job, exists := s.jobs[id]
+	if !exists || job.TenantID != tenantID {
+		return nil, ErrJobNotFound
+	}
+	found := *job
+	return &found, nil
+}
+
+func (s *InMemoryStorage) ListJobs(ctx context.Context, tenantID string, kind models.JobKind) ([]*models.Job, error) {
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+	jobs := []*models.Job{}
+	for _, job := range s.jobs {
+		if job.TenantID == tenantID && job.Kind == kind {
+			found := *job
+			jobs = append(jobs, &found)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	return jobs, nil
+}
+
+func (s *InMemoryStorage) ClaimJob(ctx context.Context, kinds []models.JobKind, staleBefore time.Time) (*models.Job, error) {
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+	var claimed *models.Job
+	for _, job := range s.jobs {
+		claimable := slices.Contains(kinds, job.Kind) &&
+			(job.Status == models.JobPending || (job.Status == models.JobRunning && job.UpdatedAt.Before(staleBefore)))
+		if claimable && (claimed == nil || job.CreatedAt.Before(claimed.CreatedAt)) {
+			claimed = job
+		}
+	}
+	if claimed == nil {
+		return nil, ErrJobNotFound
+	}
+	claimed.Status = models.JobRunning
+	claimed.UpdatedAt = time.Now()
+	found := *claimed
+	return &found, nil
+}
+
+func (s *InMemoryStorage) UpdateJob(ctx context.Context, job *models.Job) error {
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+	if _, exists := s.jobs[job.ID]; !exists {
+		return ErrJobNotFound
+	}
+	stored := *job
+	stored.UpdatedAt = time.Now()
+	s.jobs[job.ID] = &stored
+	return nil
+}
+
+func (s *InMemoryStorage) PurgeJobs(ctx context.Context, olderThan time.Time) (int64, error) {
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+	var purged int64
+	for id, job := range s.jobs {
+		if job.CreatedAt.Before(olderThan) {
+			delete(s.jobs, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (s *InMemoryStorage) CreateAuditLog(ctx context.Context, entry *models.AuditLog) error {
+	if entry.ID == "" {
+		entry.ID = uuid.NewString()
+	}
+
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	prev := s.auditChainAnchor(entry.TenantID)
+	for i := len(s.auditLogs) - 1; i >= 0; i-- {
+		if s.auditLogs[i].TenantID == entry.TenantID && s.auditLogs[i].Sequence > 0 {
+			prev = &models.AuditChainAnchor{Sequence: s.auditLogs[i].Sequence, Hash: s.auditLogs[i].Hash}
+			break
+		}
+	}
+	chain(entry, prev.Sequence, prev.Hash)
+	for i := range entry.Changes {
+		change := &entry.Changes[i]
+		change.ID = uuid.NewString()
+		change.AuditLogID = entry.ID
+		change.TenantID = entry.TenantID
+	}
+	s.auditLogs = append(s.auditLogs, entry)
+	return nil
+}
+
+func (s *InMemoryStorage) ListAuditChain(ctx context.Context, tenantID string, afterSequence int64, limit int) ([]*models.AuditLog, error) {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	entries := []*models.AuditLog{}
+	for _, entry := range s.auditLogs {
+		if len(entries) == limit {
+			break
+		}
+		if entry.TenantID == tenantID && entry.Sequence > afterSequence {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (s *InMemoryStorage) ListAuditLogs(ctx context.Context, filter AuditLogFilter) ([]*models.AuditLog, int64, error) {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	matched := []*models.AuditLog{}
+	for i := len(s.auditLogs) - 1; i >= 0; i-- {
+		entry := s.auditLogs[i]
+		if entry.TenantID != filter.TenantID {
+			continue
+		}
+		if filter.ActorID != "" && entry.ActorID != filter.ActorID {
+			continue
+		}
+		if filter.Action != "" && entry.Action != filter.Action {
+			continue
+		}
+		if filter.EventType != "" && entry.EventType != filter.EventType {
+			continue
+		}
+		if !filter.Since.IsZero() && entry.CreatedAt.Before(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && entry.CreatedAt.After(filter.Until) {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+
+	total := int64(len(matched))
+	offset := (filter.Page - 1) * filter.PageSize
+	if offset >= len(matched) {
+		return []*models.AuditLog{}, total, nil
+	}
+	end := offset + filter.PageSize
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	return matched[offset:end], total, nil
+}
+
+// ListDataChanges returns the changes kept with the entry; in-memory storage
+// records none itself.
+func (s *InMemoryStorage) ListDataChanges(ctx context.Context, tenantID, auditLogID string) ([]*models.DataChange, error) {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	changes := []*models.DataChange{}
+	for _, entry := range s.auditLogs {
+		if entry.TenantID != tenantID || entry.ID != auditLogID {
+			continue
+		}
+		for i := range entry.Changes {
+			change := entry.Changes[i]
+			changes = append(changes, &change)
+		}
+	}
+	return changes, nil
+}
+
+func (s *InMemoryStorage) GetAuditChainAnchor(ctx context.Context, tenantID string) (*models.AuditChainAnchor, error) {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	anchor := *s.auditChainAnchor(tenantID)
+	return &anchor, nil
+}
+
+func (s *InMemoryStorage) auditChainAnchor(tenantID string) *models.AuditChainAnchor {
+	if anchor, ok := s.auditAnchors[tenantID]; ok {
+		return anchor
+	}
+	return &models.AuditChainAnchor{TenantID: tenantID}
+}
+
+func (s *InMemoryStorage) PurgeAuditLogs(ctx context.Context, olderThan time.Time) (int64, error) {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	now := time.Now()
+	for _, entry := range s.auditLogs {
+		if entry.Sequence > 0 && entry.CreatedAt.Before(olderThan) && entry.Sequence > s.auditChainAnchor(entry.TenantID).Sequence {
+			s.auditAnchors[entry.TenantID] = &models.AuditChainAnchor{TenantID: entry.TenantID, Sequence: entry.Sequence, Hash: entry.Hash, UpdatedAt: now}
+		}
+	}
+
+	kept := s.auditLogs[:0]
+	for _, entry := range s.auditLogs {
+		if entry.Sequence == 0 && entry.CreatedAt.Before(olderThan) {
+			continue
+		}
+		if entry.Sequence > 0 && entry.Sequence <= s.auditChainAnchor(entry.TenantID).Sequence {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	purged := int64(len(s.auditLogs) - len(kept))
+	s.auditLogs = kept
+	return purged, nil
+}
+
+// chain links entry after the entry numbered sequence, whose hash is hash;
+// the first entry of a chain follows sequence 0 and no hash. The creation
+// time is cut to the microseconds PostgreSQL keeps, which would otherwise
+// round it and change the hash.
+func chain(entry *models.AuditLog, sequence int64, hash string) {
+	entry.CreatedAt = entry.CreatedAt.Truncate(time.Microsecond)
+	entry.Sequence = sequence + 1
+	entry.PrevHash = hash
+	entry.ChainVersion = models.AuditChainVersion
+	entry.Hash = entry.ChainHash()
+}
+
+func BuildDSN(cfg config.DatabaseConfig) string {
+	dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		cfg.Host,
 		cfg.Port,
 		cfg.User,
 		cfg.Password,
 		cfg.DBName,
 		cfg.SSLMode,
 	)
+	if cfg.QueryExecMode != "" {
+		dsn += " default_query_exec_mode=" + cfg.QueryExecMode
+	}
+	if cfg.StatementCacheCapacity > 0 {
+		dsn += fmt.Sprintf(" statement_cache_capacity=%d", cfg.StatementCacheCapacity)
+	}
+	return dsn
+}
+
+// PostgresOptionsFrom picks the PostgresStorage options out of the database
+// configuration; the connection settings go through BuildDSN.
+func PostgresOptionsFrom(cfg config.DatabaseConfig) PostgresOptions {
+	return PostgresOptions{
+		RowLevelSecurity:  cfg.RowLevelSecurity,
+		PrepareStatements: cfg.PrepareStatements,
+	}
+}
+
+func (s *InMemoryStorage) CreateDeviceAuthorization(ctx context.Context, auth *models.DeviceAuthorization) error {
+	if auth.ID == "" {
+		auth.ID = uuid.NewString()
+	}
+
+	s.deviceMu.Lock()
+	defer s.deviceMu.Unlock()
+	for _, other := range s.devices {
+		if other.ID == auth.ID || other.DeviceCodeHash == auth.DeviceCodeHash ||
+			other.TenantID == auth.TenantID && other.UserCode == auth.UserCode {
+			return ErrConflict
+		}
+	}
+	stored := *auth
+	s.devices[auth.ID] = &stored
+	return nil
+}
+
+func (s *InMemoryStorage) GetDeviceAuthorizationByDeviceCode(ctx context.Context, tenantID, deviceCodeHash string) (*models.DeviceAuthorization, error) {
+	return s.findDeviceAuthorization(func(auth *models.DeviceAuthorization) bool {
+		return auth.TenantID == tenantID && auth.DeviceCodeHash == deviceCodeHash
+	})
+}
+
+func (s *InMemoryStorage) GetDeviceAuthorizationByUserCode(ctx context.Context, tenantID, userCode string) (*models.DeviceAuthorization, error) {
+	return s.findDeviceAuthorization(func(auth *models.DeviceAuthorization) bool {
+		return auth.TenantID == tenantID && auth.UserCode == userCode
+	})
+}
+
+// findDeviceAuthorization returns a copy, so that callers changing it do not
+// race with pollers reading it.
+func (s *InMemoryStorage) findDeviceAuthorization(match func(*models.DeviceAuthorization) bool) (*models.DeviceAuthorization, error) {
+	s.deviceMu.Lock()
+	defer s.deviceMu.Unlock()
+	for _, auth := range s.devices {
+		if match(auth) {
+			found := *auth
+			return &found, nil
+		}
+	}
+	return nil, ErrDeviceAuthorizationNotFound
+}
+
+func (s *InMemoryStorage) UpdateDeviceAuthorization(ctx context.Context, auth *models.DeviceAuthorization) error {
+	s.deviceMu.Lock()
+	defer s.deviceMu.Unlock()
+	if _, exists := s.devices[auth.ID]; !exists {
+		return ErrDeviceAuthorizationNotFound
+	}
+	stored := *auth
+	s.devices[auth.ID] = &stored
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteDeviceAuthorization(ctx context.Context, tenantID, id string) error {
+	s.deviceMu.Lock()
+	defer s.deviceMu.Unlock()
+	auth, exists := s.devices[id]
+	if !exists || auth.TenantID != tenantID {
+		return ErrDeviceAuthorizationNotFound
+	}
+	delete(s.devices, id)
+	return nil
+}
+
+func (s *InMemoryStorage) PurgeDeviceAuthorizations(ctx context.Context, olderThan time.Time) (int64, error) {
+	s.deviceMu.Lock()
+	defer s.deviceMu.Unlock()
+
+	var purged int64
+	for id, auth := range s.devices {
+		if auth.ExpiresAt.Before(olderThan) {
+			delete(s.devices, id)
+			purged++
+		}
+	}
+	return purged, nil
 }
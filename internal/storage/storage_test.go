@@ -0,0 +1,114 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/pkg/heimdalltest"
+)
+
+func TestInMemoryStorageConformance(t *testing.T) {
+	heimdalltest.RunStorageSuite(t, func(t *testing.T) storage.Storage {
+		return storage.NewInMemoryStorage()
+	})
+}
+
+func TestShardedStorageConformance(t *testing.T) {
+	heimdalltest.RunStorageSuite(t, func(t *testing.T) storage.Storage {
+		// Tenants hash across three in-memory shards.
+		shards := []storage.Storage{storage.NewInMemoryStorage(), storage.NewInMemoryStorage()}
+		return storage.NewRoutedStorage(storage.NewInMemoryStorage(), nil, shards)
+	})
+}
+
+// TestPostgresStorageConformance runs against the scratch database at
+// HEIMDALL_TEST_POSTGRES_DSN, which make test-postgres starts in a container,
+// and is skipped without it. The suite leaves its tenants behind.
+func TestPostgresStorageConformance(t *testing.T) {
+	dsn := os.Getenv("HEIMDALL_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("HEIMDALL_TEST_POSTGRES_DSN is not set")
+	}
+	store, err := storage.NewPostgresStorage(dsn, storage.PostgresOptions{})
+	if err != nil {
+		t.Fatalf("connect to PostgreSQL: %v", err)
+	}
+
+	heimdalltest.RunStorageSuite(t, func(t *testing.T) storage.Storage {
+		return store
+	})
+}
+
+// TestPostgresRowLevelSecurity runs against HEIMDALL_TEST_POSTGRES_RLS_DSN,
+// which must connect as a role that is neither a superuser nor BYPASSRLS,
+// as make test-postgres sets up, and is skipped without it.
+func TestPostgresRowLevelSecurity(t *testing.T) {
+	dsn := os.Getenv("HEIMDALL_TEST_POSTGRES_RLS_DSN")
+	if dsn == "" {
+		t.Skip("HEIMDALL_TEST_POSTGRES_RLS_DSN is not set")
+	}
+	store, err := storage.NewPostgresStorage(dsn, storage.PostgresOptions{RowLevelSecurity: true})
+	if err != nil {
+		t.Fatalf("connect to PostgreSQL: %v", err)
+	}
+
+	ctx := context.Background()
+	users := map[string]*models.User{}
+	for _, name := range []string{"acme", "globex"} {
+		tenant := &models.Tenant{ID: name + "-" + uuid.NewString(), Name: name, Status: models.TenantActive}
+		if err := store.CreateTenant(ctx, tenant); err != nil {
+			t.Fatalf("create tenant %s: %v", name, err)
+		}
+		user := &models.User{
+			TenantID:  tenant.ID,
+			Username:  "alice",
+			Role:      models.RoleUser,
+			Status:    models.UserActive,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		if err := store.CreateUser(storage.WithTenant(ctx, tenant.ID), user); err != nil {
+			t.Fatalf("create user in %s: %v", name, err)
+		}
+		users[name] = user
+	}
+	acme, globex := users["acme"], users["globex"]
+
+	// The cases alternate scopes, so connections are reused across them.
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		found bool
+	}{
+		{"own tenant", storage.WithTenant(ctx, acme.TenantID), true},
+		{"other tenant", storage.WithTenant(ctx, globex.TenantID), false},
+		{"no scope", ctx, false},
+		{"empty scope", storage.WithTenant(ctx, ""), false},
+		{"unscoped", storage.Unscoped(ctx), true},
+		{"own tenant again", storage.WithTenant(ctx, acme.TenantID), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := store.GetUser(tt.ctx, acme.ID)
+			switch {
+			case tt.found && err != nil:
+				t.Fatalf("GetUser: %v", err)
+			case !tt.found && !errors.Is(err, storage.ErrUserNotFound):
+				t.Fatalf("GetUser = %v, want ErrUserNotFound", err)
+			}
+		})
+	}
+
+	t.Run("insert into another tenant", func(t *testing.T) {
+		user := &models.User{TenantID: globex.TenantID, Username: "mallory", Role: models.RoleUser, Status: models.UserActive}
+		if err := store.CreateUser(storage.WithTenant(ctx, acme.TenantID), user); err == nil {
+			t.Fatal("CreateUser wrote a row of another tenant")
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Archives are gzipped JSON sealed with AES-256-GCM under a key derived from
+// a passphrase with scrypt, laid out as magic | salt | nonce | ciphertext.
+var magic = []byte("HEIMDALL-TENANT-1\n")
+
+const (
+	saltSize = 16
+	keySize  = 32
+)
+
+var ErrDecrypt = errors.New("archive cannot be decrypted: wrong passphrase or corrupted file")
+
+func Seal(archive *Archive, passphrase string) ([]byte, error) {
+	var plain bytes.Buffer
+	zw := gzip.NewWriter(&plain)
+	if err := json.NewEncoder(zw).Encode(archive); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, magic...)
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plain.Bytes(), magic), nil
+}
+
+func Open(data []byte, passphrase string) (*Archive, error) {
+	if !bytes.HasPrefix(data, magic) {
+		return nil, errors.New("not a tenant archive")
+	}
+	data = data[len(magic):]
+	if len(data) < saltSize {
+		return nil, ErrDecrypt
+	}
+
+	gcm, err := newGCM(passphrase, data[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	data = data[saltSize:]
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], magic)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var archive Archive
+	if err := json.NewDecoder(zr).Decode(&archive); err != nil {
+		return nil, err
+	}
+	return &archive, nil
+}
+
+func newGCM(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
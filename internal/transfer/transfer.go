@@ -0,0 +1,320 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+// FormatVersion is bumped whenever the archive layout changes incompatibly.
+const FormatVersion = 1
+
+const exportPageSize = 500
+
+var ErrTenantExists = errors.New("tenant already exists")
+
+// Archive holds everything needed to recreate a tenant on another cluster,
+// including the secrets the API never returns: password hashes, API key
+// hashes, signing and token encryption keys, and the delegated
+// authentication and login hook secrets.
+type Archive struct {
+	Version             int                        `json:"version"`
+	ExportedAt          time.Time                  `json:"exported_at"`
+	Tenant              models.Tenant              `json:"tenant"`
+	DelegatedAuthSecret string                     `json:"delegated_auth_secret,omitempty"`
+	LoginHookSecret     string                     `json:"login_hook_secret,omitempty"`
+	TokenSigningKey     string                     `json:"token_signing_key,omitempty"`
+	Environments        []Environment              `json:"environments"`
+	Users               []User                     `json:"users"`
+	PolicyVersions      []*models.PolicyVersion    `json:"policy_versions"`
+	PolicyAcceptances   []*models.PolicyAcceptance `json:"policy_acceptances"`
+	AccessPolicies      []*models.AccessPolicy     `json:"access_policies"`
+	Plugins             []Plugin                   `json:"plugins,omitempty"`
+	Domains             []*models.DomainClaim      `json:"domains,omitempty"`
+	Clients             []Client                   `json:"clients,omitempty"`
+	// AuditLogs are kept by the archives of deleted tenants, as a record;
+	// Import leaves them out.
+	AuditLogs []*models.AuditLog `json:"audit_logs,omitempty"`
+}
+
+type Environment struct {
+	models.Environment
+	APIKeyHash string `json:"api_key_hash"`
+	SigningKey string `json:"signing_key"`
+}
+
+type Client struct {
+	models.Client
+	EncryptionKey string `json:"encryption_key,omitempty"`
+}
+
+type Plugin struct {
+	models.PluginModule
+	Module []byte `json:"module"`
+}
+
+type User struct {
+	models.User
+	PasswordHash string `json:"password_hash"`
+}
+
+// Export reads a tenant and all of its data into an archive. The tenant's
+// secrets are opened, as the target cluster seals them with its own keys.
+func Export(ctx context.Context, store storage.Storage, secrets *vault.Vault, tenantID string) (*Archive, error) {
+	tenant, err := store.GetTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	delegatedAuthSecret, err := secrets.Open(ctx, tenantID, tenant.Config.DelegatedAuthSecret)
+	if err != nil {
+		return nil, fmt.Errorf("open delegated auth secret: %w", err)
+	}
+	loginHookSecret, err := secrets.Open(ctx, tenantID, tenant.Config.LoginHookSecret)
+	if err != nil {
+		return nil, fmt.Errorf("open login hook secret: %w", err)
+	}
+	tokenSigningKey, err := secrets.Open(ctx, tenantID, tenant.Config.TokenSigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("open token signing key: %w", err)
+	}
+
+	archive := &Archive{
+		Version:             FormatVersion,
+		ExportedAt:          time.Now().UTC(),
+		Tenant:              *tenant,
+		DelegatedAuthSecret: delegatedAuthSecret,
+		LoginHookSecret:     loginHookSecret,
+		TokenSigningKey:     tokenSigningKey,
+	}
+
+	envs, err := store.ListEnvironments(ctx, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("list environments: %w", err)
+	}
+	for _, env := range envs {
+		signingKey, err := secrets.Open(ctx, tenantID, env.SigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("open environment %s signing key: %w", env.ID, err)
+		}
+		archive.Environments = append(archive.Environments, Environment{
+			Environment: *env,
+			APIKeyHash:  env.APIKeyHash,
+			SigningKey:  signingKey,
+		})
+	}
+
+	for page := 1; ; page++ {
+		users, total, err := store.ListUsers(ctx, storage.UserFilter{
+			TenantID: tenantID,
+			SortBy:   "created_at",
+			SortDir:  "asc",
+			Page:     page,
+			PageSize: exportPageSize,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("list users: %w", err)
+		}
+		for _, user := range users {
+			archive.Users = append(archive.Users, User{
+				User:         user,
+				PasswordHash: user.Password,
+			})
+		}
+		if len(users) == 0 || int64(len(archive.Users)) >= total {
+			break
+		}
+	}
+
+	if archive.PolicyVersions, err = store.ListPolicyVersions(ctx, tenantID); err != nil {
+		return nil, fmt.Errorf("list policy versions: %w", err)
+	}
+	if archive.PolicyAcceptances, err = store.ListPolicyAcceptances(ctx, tenantID); err != nil {
+		return nil, fmt.Errorf("list policy acceptances: %w", err)
+	}
+	if archive.AccessPolicies, err = store.ListAccessPolicies(ctx, tenantID); err != nil {
+		return nil, fmt.Errorf("list access policies: %w", err)
+	}
+
+	plugins, err := store.ListPluginModules(ctx, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("list plugins: %w", err)
+	}
+	for _, listed := range plugins {
+		module, err := store.GetPluginModule(ctx, tenantID, listed.ID)
+		if err != nil {
+			return nil, fmt.Errorf("get plugin %s: %w", listed.ID, err)
+		}
+		archive.Plugins = append(archive.Plugins, Plugin{
+			PluginModule: *module,
+			Module:       module.Module,
+		})
+	}
+
+	if archive.Domains, err = store.ListDomainClaims(ctx, tenantID); err != nil {
+		return nil, fmt.Errorf("list domains: %w", err)
+	}
+	clients, err := store.ListClients(ctx, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("list clients: %w", err)
+	}
+	for _, client := range clients {
+		encryptionKey, err := secrets.Open(ctx, tenantID, client.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("open client %s encryption key: %w", client.ID, err)
+		}
+		archive.Clients = append(archive.Clients, Client{
+			Client:        *client,
+			EncryptionKey: encryptionKey,
+		})
+	}
+
+	return archive, nil
+}
+
+// AddAuditLogs adds the tenant's audit log, oldest entry first, to an
+// archive, up to the moment it was exported.
+func AddAuditLogs(ctx context.Context, store storage.Storage, archive *Archive) error {
+	var entries []*models.AuditLog
+	for page := 1; ; page++ {
+		logs, total, err := store.ListAuditLogs(ctx, storage.AuditLogFilter{
+			TenantID: archive.Tenant.ID,
+			Until:    archive.ExportedAt,
+			Page:     page,
+			PageSize: exportPageSize,
+		})
+		if err != nil {
+			return fmt.Errorf("list audit logs: %w", err)
+		}
+		entries = append(entries, logs...)
+		if len(logs) == 0 || int64(len(entries)) >= total {
+			break
+		}
+	}
+	// Listed newest first.
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	archive.AuditLogs = entries
+	return nil
+}
+
+// Import recreates an archived tenant with its original IDs. It refuses to
+// touch a tenant that already exists on the target cluster.
+func Import(ctx context.Context, store storage.Storage, secrets *vault.Vault, archive *Archive) error {
+	if archive.Version != FormatVersion {
+		return fmt.Errorf("unsupported archive version %d", archive.Version)
+	}
+
+	tenantID := archive.Tenant.ID
+	if _, err := store.GetTenant(ctx, tenantID); err == nil {
+		return fmt.Errorf("%w: %s", ErrTenantExists, tenantID)
+	} else if err != storage.ErrTenantNotFound {
+		return err
+	}
+
+	tenant := archive.Tenant
+	if !storage.KnowsRegion(store, tenant.Region) {
+		return fmt.Errorf("%w: %s", storage.ErrUnknownRegion, tenant.Region)
+	}
+	// The tenant is created before its secrets are sealed, so that its data
+	// key is stored in the tenant's region.
+	if err := store.CreateTenant(ctx, &tenant); err != nil {
+		return fmt.Errorf("create tenant: %w", err)
+	}
+	var err error
+	if tenant.Config.DelegatedAuthSecret, err = secrets.Seal(ctx, tenantID, archive.DelegatedAuthSecret); err != nil {
+		return fmt.Errorf("seal delegated auth secret: %w", err)
+	}
+	if tenant.Config.LoginHookSecret, err = secrets.Seal(ctx, tenantID, archive.LoginHookSecret); err != nil {
+		return fmt.Errorf("seal login hook secret: %w", err)
+	}
+	if tenant.Config.TokenSigningKey, err = secrets.Seal(ctx, tenantID, archive.TokenSigningKey); err != nil {
+		return fmt.Errorf("seal token signing key: %w", err)
+	}
+	if err := store.UpdateTenantConfig(ctx, &tenant.Config); err != nil {
+		return fmt.Errorf("store sealed secrets: %w", err)
+	}
+
+	for _, record := range archive.Environments {
+		env := record.Environment
+		env.TenantID = tenantID
+		env.APIKeyHash = record.APIKeyHash
+		if env.SigningKey, err = secrets.Seal(ctx, tenantID, record.SigningKey); err != nil {
+			return fmt.Errorf("seal environment %s signing key: %w", env.ID, err)
+		}
+		if err := store.CreateEnvironment(ctx, &env); err != nil {
+			return fmt.Errorf("create environment %s: %w", env.ID, err)
+		}
+	}
+
+	for _, record := range archive.Users {
+		user := record.User
+		user.TenantID = tenantID
+		user.Password = record.PasswordHash
+		if err := store.CreateUser(ctx, &user); err != nil {
+			return fmt.Errorf("create user %s: %w", user.ID, err)
+		}
+	}
+
+	for _, policy := range archive.PolicyVersions {
+		policy.TenantID = tenantID
+		if err := store.CreatePolicyVersion(ctx, policy); err != nil {
+			return fmt.Errorf("create policy version %s: %w", policy.ID, err)
+		}
+	}
+
+	for _, acceptance := range archive.PolicyAcceptances {
+		acceptance.TenantID = tenantID
+		if err := store.CreatePolicyAcceptance(ctx, acceptance); err != nil {
+			return fmt.Errorf("create policy acceptance %s: %w", acceptance.ID, err)
+		}
+	}
+
+	for _, policy := range archive.AccessPolicies {
+		policy.TenantID = tenantID
+		if err := store.CreateAccessPolicy(ctx, policy); err != nil {
+			return fmt.Errorf("create access policy %s: %w", policy.ID, err)
+		}
+	}
+
+	for _, record := range archive.Plugins {
+		module := record.PluginModule
+		module.TenantID = tenantID
+		module.Module = record.Module
+		if err := store.CreatePluginModule(ctx, &module); err != nil {
+			return fmt.Errorf("create plugin %s: %w", module.ID, err)
+		}
+	}
+
+	for _, claim := range archive.Domains {
+		claim.TenantID = tenantID
+		// A domain another tenant verified on the target cluster stays
+		// theirs; the imported claim has to be verified again.
+		if claim.Verified() {
+			if owner, err := store.FindVerifiedDomain(ctx, claim.Domain); err == nil && owner.TenantID != tenantID {
+				claim.VerifiedAt = nil
+			}
+		}
+		if err := store.CreateDomainClaim(ctx, claim); err != nil {
+			return fmt.Errorf("create domain %s: %w", claim.Domain, err)
+		}
+	}
+
+	for _, record := range archive.Clients {
+		client := record.Client
+		client.TenantID = tenantID
+		if client.EncryptionKey, err = secrets.Seal(ctx, tenantID, record.EncryptionKey); err != nil {
+			return fmt.Errorf("seal client %s encryption key: %w", client.ID, err)
+		}
+		if err := store.CreateClient(ctx, &client); err != nil {
+			return fmt.Errorf("create client %s: %w", client.ID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package validation
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tajious/heimdall/internal/models"
+)
+
+const dateLayout = "2006-01-02"
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fe := range e {
+		messages[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func ValidateFieldRules(rules []models.FieldRule) error {
+	seen := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if err := ValidateStruct(rule); err != nil {
+			return err
+		}
+		if seen[rule.Name] {
+			return fmt.Errorf("duplicate field %q", rule.Name)
+		}
+		seen[rule.Name] = true
+
+		if rule.Pattern != "" {
+			if _, err := regexp.Compile(rule.Pattern); err != nil {
+				return fmt.Errorf("field %q has an invalid pattern: %w", rule.Name, err)
+			}
+		}
+		if rule.MinAge > 0 && rule.Type != models.FieldDate {
+			return fmt.Errorf("field %q: min_age only applies to date fields", rule.Name)
+		}
+	}
+	return nil
+}
+
+func ValidateFields(rules []models.FieldRule, values map[string]interface{}) error {
+	var errs FieldErrors
+
+	known := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		known[rule.Name] = true
+
+		value, present := values[rule.Name]
+		if !present || value == nil || value == "" {
+			if rule.Required {
+				errs = append(errs, FieldError{Field: rule.Name, Message: "is required"})
+			}
+			continue
+		}
+
+		if msg := validateField(rule, value); msg != "" {
+			errs = append(errs, FieldError{Field: rule.Name, Message: msg})
+		}
+	}
+
+	for name := range values {
+		if !known[name] {
+			errs = append(errs, FieldError{Field: name, Message: "is not a recognized field"})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateField(rule models.FieldRule, value interface{}) string {
+	switch rule.Type {
+	case models.FieldNumber:
+		if _, ok := value.(float64); !ok {
+			return "must be a number"
+		}
+		return ""
+	case models.FieldBoolean:
+		if _, ok := value.(bool); !ok {
+			return "must be a boolean"
+		}
+		return ""
+	}
+
+	str, ok := value.(string)
+	if !ok {
+		return "must be a string"
+	}
+
+	if rule.MaxLength > 0 && len(str) > rule.MaxLength {
+		return fmt.Sprintf("must be at most %d characters", rule.MaxLength)
+	}
+
+	if len(rule.Enum) > 0 && !contains(rule.Enum, str) {
+		return "must be one of " + strings.Join(rule.Enum, ", ")
+	}
+
+	if rule.Pattern != "" {
+		if matched, _ := regexp.MatchString(rule.Pattern, str); !matched {
+			return "has an invalid format"
+		}
+	}
+
+	switch rule.Type {
+	case models.FieldDate:
+		date, err := time.Parse(dateLayout, str)
+		if err != nil {
+			return "must be a date in YYYY-MM-DD format"
+		}
+		if rule.MinAge > 0 && ageAt(date, time.Now()) < rule.MinAge {
+			return fmt.Sprintf("must be at least %d years ago", rule.MinAge)
+		}
+	case models.FieldCountry:
+		if err := Validator.Var(str, "iso3166_1_alpha2"); err != nil {
+			return "must be an ISO 3166-1 alpha-2 country code"
+		}
+	}
+
+	return ""
+}
+
+func ageAt(birth, now time.Time) int {
+	age := now.Year() - birth.Year()
+	if now.Month() < birth.Month() || (now.Month() == birth.Month() && now.Day() < birth.Day()) {
+		age--
+	}
+	return age
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
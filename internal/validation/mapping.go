@@ -0,0 +1,26 @@
+package validation
+
+import (
+	"fmt"
+
+	"github.com/tajious/heimdall/internal/models"
+)
+
+func ValidateMappingRules(rules []models.MappingRule) error {
+	for i, rule := range rules {
+		if err := ValidateStruct(rule); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		switch rule.Action {
+		case models.MappingSetRole:
+			if rule.Role == "" {
+				return fmt.Errorf("rule %d: set_role requires a role", i)
+			}
+		case models.MappingCopyClaim:
+			if rule.Role != "" {
+				return fmt.Errorf("rule %d: copy_claim does not take a role", i)
+			}
+		}
+	}
+	return nil
+}
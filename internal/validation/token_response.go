@@ -0,0 +1,32 @@
+package validation
+
+import (
+	"fmt"
+
+	"github.com/tajious/heimdall/internal/models"
+)
+
+// ValidateTokenResponse refuses response shapes in which two fields end up
+// with the same name, one hiding the other.
+func ValidateTokenResponse(config *models.TokenResponseConfig) error {
+	if err := ValidateStruct(config); err != nil {
+		return err
+	}
+	names := make(map[string]string, len(models.LoginResponseFields)+len(config.Extra))
+	for _, field := range models.LoginResponseFields {
+		name := field
+		if renamed, ok := config.Rename[field]; ok {
+			name = renamed
+		}
+		if other, taken := names[name]; taken {
+			return fmt.Errorf("token_response: %s and %s would both be named %s", other, field, name)
+		}
+		names[name] = field
+	}
+	for name := range config.Extra {
+		if field, taken := names[name]; taken {
+			return fmt.Errorf("token_response: extra field %s would replace %s", name, field)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package validation
+
+import (
+	"strings"
+
+	"github.com/tajious/heimdall/internal/models"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeUsername applies the tenant's username policy. Registration and
+// login both normalize, so users can type their name the way they like.
+func NormalizeUsername(policy *models.UsernamePolicy, username string) string {
+	if policy == nil {
+		return username
+	}
+	if policy.NFKC {
+		username = norm.NFKC.String(username)
+	}
+	if policy.Trim {
+		username = strings.TrimSpace(username)
+	}
+	if policy.Lowercase {
+		username = strings.ToLower(username)
+	}
+	return username
+}
+
+// IsReservedUsername reports whether the username matches a reserved name.
+// Names are compared in their folded NFKC form regardless of the policy's
+// normalization settings, so "Ａdmin" and " ADMIN" match "admin".
+func IsReservedUsername(policy *models.UsernamePolicy, username string) bool {
+	if policy == nil {
+		return false
+	}
+	folded := foldUsername(username)
+	for _, reserved := range policy.Reserved {
+		if foldUsername(reserved) == folded {
+			return true
+		}
+	}
+	return false
+}
+
+func foldUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(norm.NFKC.String(username)))
+}
@@ -1,13 +1,25 @@
 package validation
 
 import (
+	"regexp"
+
 	"github.com/go-playground/validator/v10"
 )
 
 var (
 	Validator = validator.New()
+
+	// resourceIDPattern accepts client-supplied IDs that are safe in URL paths
+	// and as a DNS label for host-based tenant resolution; UUIDs qualify.
+	resourceIDPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
 )
 
+func init() {
+	Validator.RegisterValidation("resource_id", func(fl validator.FieldLevel) bool {
+		return resourceIDPattern.MatchString(fl.Field().String())
+	})
+}
+
 func ValidateStruct(s interface{}) error {
 	return Validator.Struct(s)
 }
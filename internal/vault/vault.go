@@ -0,0 +1,443 @@
+// Package vault seals tenant secrets with envelope encryption: each tenant
+// has its own data key, stored wrapped by the master key, so a tenant's key
+// can be rotated without touching the others and the master key never
+// encrypts tenant data itself.
+package vault
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+// Prefix marks a value sealed under a tenant data key, laid out as
+// "vault:v<version>:" + base64(nonce | ciphertext).
+const Prefix = "vault:v"
+
+const dataKeySize = 32
+
+// reencryptStaleAfter is how long a claimed re-encryption job may run before
+// another instance takes it over.
+const reencryptStaleAfter = 10 * time.Minute
+
+var (
+	ErrDisabled    = errors.New("tenant encryption needs CONFIG_MASTER_KEY_FILE or CONFIG_MASTER_KEY_COMMAND")
+	ErrMalformed   = errors.New("malformed sealed value")
+	ErrKeyNotFound = errors.New("the tenant data key that sealed the value is gone")
+)
+
+// Vault seals and opens tenant secrets. Without a master key it is
+// disabled: secrets are stored as given, and only values that were never
+// sealed can be opened.
+type Vault struct {
+	storage storage.Storage
+	master  cipher.AEAD
+
+	mu       sync.Mutex
+	dataKeys map[string]cipher.AEAD
+}
+
+// New returns a vault wrapping data keys with masterKey, or a disabled one
+// when masterKey is nil.
+func New(storage storage.Storage, masterKey []byte) (*Vault, error) {
+	v := &Vault{
+		storage:  storage,
+		dataKeys: make(map[string]cipher.AEAD),
+	}
+	if masterKey != nil {
+		master, err := newGCM(masterKey)
+		if err != nil {
+			return nil, fmt.Errorf("master key: %w", err)
+		}
+		v.master = master
+	}
+	return v, nil
+}
+
+// Enabled reports whether secrets are sealed.
+func (v *Vault) Enabled() bool {
+	return v.master != nil
+}
+
+// Seal encrypts plaintext under the tenant's active data key, creating the
+// first one if the tenant has none. The ciphertext is bound to the tenant,
+// so it cannot be moved to another tenant's records.
+func (v *Vault) Seal(ctx context.Context, tenantID, plaintext string) (string, error) {
+	if v.master == nil || plaintext == "" {
+		return plaintext, nil
+	}
+
+	// The data keys belong to the tenant, whoever's request seals with them.
+	key, err := v.activeKey(storage.WithTenant(ctx, tenantID), tenantID)
+	if err != nil {
+		return "", err
+	}
+	aead, err := v.dataKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(tenantID))
+	return Prefix + strconv.Itoa(key.Version) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal. Values that were never sealed are
+// returned as they are, so secrets stored before encryption was turned on
+// keep working until they are sealed.
+func (v *Vault) Open(ctx context.Context, tenantID, value string) (string, error) {
+	version, data, sealed, err := parse(value)
+	if err != nil || !sealed {
+		return value, err
+	}
+	if v.master == nil {
+		return "", ErrDisabled
+	}
+
+	aead, err := v.versionKey(storage.WithTenant(ctx, tenantID), tenantID, version)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", ErrMalformed
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(tenantID))
+	if err != nil {
+		return "", errors.New("sealed value cannot be decrypted: wrong tenant or corrupted value")
+	}
+	return string(plain), nil
+}
+
+// Rotate makes a new version of the tenant's data key the active one.
+// Values sealed under older versions stay readable until Reencrypt seals
+// them again.
+func (v *Vault) Rotate(ctx context.Context, tenantID string) (*models.TenantKey, error) {
+	if v.master == nil {
+		return nil, ErrDisabled
+	}
+	keys, err := v.storage.ListTenantKeys(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	version := 1
+	if len(keys) > 0 {
+		version = keys[len(keys)-1].Version + 1
+	}
+	return v.newKey(ctx, tenantID, version)
+}
+
+// Keys lists the versions of the tenant's data key.
+func (v *Vault) Keys(ctx context.Context, tenantID string) ([]*models.TenantKey, error) {
+	return v.storage.ListTenantKeys(ctx, tenantID)
+}
+
+// Reencrypt seals the tenant's secrets again under its active data key,
+// including secrets stored before encryption was turned on, then drops the
+// retired versions of the key. It returns how many secrets it sealed.
+func (v *Vault) Reencrypt(ctx context.Context, tenantID string) (int, error) {
+	if v.master == nil {
+		return 0, ErrDisabled
+	}
+	active, err := v.activeKey(ctx, tenantID)
+	if err != nil {
+		return 0, err
+	}
+
+	resealed := 0
+	reseal := func(value *string) (bool, error) {
+		if *value == "" {
+			return false, nil
+		}
+		version, _, sealed, err := parse(*value)
+		if err != nil {
+			return false, err
+		}
+		if sealed && version == active.Version {
+			return false, nil
+		}
+		plain, err := v.Open(ctx, tenantID, *value)
+		if err != nil {
+			return false, err
+		}
+		if *value, err = v.Seal(ctx, tenantID, plain); err != nil {
+			return false, err
+		}
+		resealed++
+		return true, nil
+	}
+
+	tenant, err := v.storage.GetTenant(ctx, tenantID)
+	if err != nil {
+		return 0, err
+	}
+	config := tenant.Config
+	changed := false
+	for _, secret := range []*string{&config.DelegatedAuthSecret, &config.LoginHookSecret, &config.TokenSigningKey} {
+		ok, err := reseal(secret)
+		if err != nil {
+			return resealed, err
+		}
+		changed = changed || ok
+	}
+	if changed {
+		config.UpdatedAt = time.Now()
+		if err := v.storage.UpdateTenantConfig(ctx, &config); err != nil {
+			return resealed, err
+		}
+	}
+
+	signingKeys, err := v.storage.ListSigningKeys(ctx, tenantID)
+	if err != nil {
+		return resealed, err
+	}
+	for _, signingKey := range signingKeys {
+		ok, err := reseal(&signingKey.Secret)
+		if err != nil {
+			return resealed, err
+		}
+		if ok {
+			signingKey.UpdatedAt = time.Now()
+			if err := v.storage.UpdateSigningKey(ctx, signingKey); err != nil {
+				return resealed, err
+			}
+		}
+	}
+
+	envs, err := v.storage.ListEnvironments(ctx, tenantID)
+	if err != nil {
+		return resealed, err
+	}
+	for _, env := range envs {
+		ok, err := reseal(&env.SigningKey)
+		if err != nil {
+			return resealed, err
+		}
+		if ok {
+			env.UpdatedAt = time.Now()
+			if err := v.storage.UpdateEnvironment(ctx, env); err != nil {
+				return resealed, err
+			}
+		}
+	}
+
+	clients, err := v.storage.ListClients(ctx, tenantID)
+	if err != nil {
+		return resealed, err
+	}
+	for _, client := range clients {
+		ok, err := reseal(&client.EncryptionKey)
+		if err != nil {
+			return resealed, err
+		}
+		if ok {
+			client.UpdatedAt = time.Now()
+			if err := v.storage.UpdateClient(ctx, client); err != nil {
+				return resealed, err
+			}
+		}
+	}
+
+	keys, err := v.storage.ListTenantKeys(ctx, tenantID)
+	if err != nil {
+		return resealed, err
+	}
+	for _, key := range keys {
+		if key.Active {
+			continue
+		}
+		if err := v.storage.DeleteTenantKey(ctx, tenantID, key.ID); err != nil && !errors.Is(err, storage.ErrTenantKeyNotFound) {
+			return resealed, err
+		}
+		v.forget(key)
+	}
+	return resealed, nil
+}
+
+// ReencryptRetired re-encrypts the secrets of every tenant holding retired
+// data keys. It runs as a background job, so that rotating a key returns at
+// once and the re-encryption happens lazily. Rotations that queued a job
+// are done first, finishing their job.
+func (v *Vault) ReencryptRetired(ctx context.Context) error {
+	if v.master == nil {
+		return nil
+	}
+
+	var errs []error
+	for {
+		job, err := v.storage.ClaimJob(ctx, []models.JobKind{models.JobReencrypt}, time.Now().Add(-reencryptStaleAfter))
+		if errors.Is(err, storage.ErrJobNotFound) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		resealed, err := v.Reencrypt(storage.WithTenant(ctx, job.TenantID), job.TenantID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", job.TenantID, err))
+		}
+		job.Advance(int64(resealed))
+		job.Finish(err, "Re-encryption failed, the retired keys are retried in the background")
+		if err := v.storage.UpdateJob(ctx, job); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+	}
+
+	retired, err := v.storage.ListRetiredTenantKeys(ctx)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range retired {
+		if seen[key.TenantID] {
+			continue
+		}
+		seen[key.TenantID] = true
+		if _, err := v.Reencrypt(storage.WithTenant(ctx, key.TenantID), key.TenantID); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", key.TenantID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (v *Vault) activeKey(ctx context.Context, tenantID string) (*models.TenantKey, error) {
+	keys, err := v.storage.ListTenantKeys(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.Active {
+			return key, nil
+		}
+	}
+
+	key, err := v.newKey(ctx, tenantID, 1)
+	if errors.Is(err, storage.ErrConflict) {
+		// Another request created the first key in the meantime.
+		return v.activeKey(ctx, tenantID)
+	}
+	return key, err
+}
+
+// versionKey returns the data key of version, from the cache when it was
+// unwrapped before, so that opening secrets does not reach storage.
+func (v *Vault) versionKey(ctx context.Context, tenantID string, version int) (cipher.AEAD, error) {
+	v.mu.Lock()
+	aead, ok := v.dataKeys[cacheKey(tenantID, version)]
+	v.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+
+	keys, err := v.storage.ListTenantKeys(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.Version == version {
+			return v.dataKey(key)
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+func (v *Vault) newKey(ctx context.Context, tenantID string, version int) (*models.TenantKey, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, v.master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	wrapped := v.master.Seal(nonce, nonce, dataKey, []byte(tenantID))
+
+	key := &models.TenantKey{
+		TenantID:   tenantID,
+		Version:    version,
+		WrappedKey: base64.StdEncoding.EncodeToString(wrapped),
+		CreatedAt:  time.Now(),
+	}
+	if err := v.storage.ActivateTenantKey(ctx, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// dataKey unwraps key, caching the result: a version's key never changes.
+func (v *Vault) dataKey(key *models.TenantKey) (cipher.AEAD, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if aead, ok := v.dataKeys[cacheKey(key.TenantID, key.Version)]; ok {
+		return aead, nil
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(key.WrappedKey)
+	if err != nil || len(wrapped) < v.master.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := wrapped[:v.master.NonceSize()], wrapped[v.master.NonceSize():]
+	dataKey, err := v.master.Open(nil, nonce, ciphertext, []byte(key.TenantID))
+	if err != nil {
+		return nil, errors.New("tenant data key cannot be unwrapped: wrong master key")
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	v.dataKeys[cacheKey(key.TenantID, key.Version)] = aead
+	return aead, nil
+}
+
+func (v *Vault) forget(key *models.TenantKey) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.dataKeys, cacheKey(key.TenantID, key.Version))
+}
+
+func cacheKey(tenantID string, version int) string {
+	return tenantID + "/" + strconv.Itoa(version)
+}
+
+// parse splits a sealed value into the version of the key that sealed it and
+// the sealed bytes. sealed is false for values that were never sealed.
+func parse(value string) (version int, data []byte, sealed bool, err error) {
+	rest, ok := strings.CutPrefix(value, Prefix)
+	if !ok {
+		return 0, nil, false, nil
+	}
+	encodedVersion, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return 0, nil, true, ErrMalformed
+	}
+	if version, err = strconv.Atoi(encodedVersion); err != nil {
+		return 0, nil, true, ErrMalformed
+	}
+	if data, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+		return 0, nil, true, ErrMalformed
+	}
+	return version, data, true, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,100 @@
+// Package warmup loads what the first requests of tenants would otherwise
+// read from the database into the in-process caches at startup, so the
+// first logins after a deploy are not slowed by cold caches.
+package warmup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+const (
+	tenantPageSize = 100
+	// activityWindow is how far back logins count towards how active a
+	// tenant is.
+	activityWindow = 7 * 24 * time.Hour
+)
+
+// Tenants warms the caches for the top most active tenants, or for every
+// tenant when top is zero, and returns how many it warmed. A tenant's
+// activity is how many of its users logged in over the past week.
+//
+// Warming a tenant looks up its environments, which caches the database it
+// is routed to, and caches its token signing key and the verification keys
+// of its environments in resolver.
+func Tenants(ctx context.Context, store storage.Storage, resolver *keys.Resolver, top int) (int, error) {
+	ctx = storage.Unscoped(ctx)
+	tenants, err := listTenants(ctx, store)
+	if err != nil {
+		return 0, err
+	}
+	if top > 0 && len(tenants) > top {
+		if tenants, err = mostActive(ctx, store, tenants, top); err != nil {
+			return 0, err
+		}
+	}
+
+	for i, tenant := range tenants {
+		if err := resolver.PreloadTenant(ctx, tenant); err != nil {
+			return i, fmt.Errorf("token signing key of tenant %s: %w", tenant.ID, err)
+		}
+		envs, err := store.ListEnvironments(storage.WithTenant(ctx, tenant.ID), tenant.ID)
+		if err != nil {
+			return i, fmt.Errorf("environments of tenant %s: %w", tenant.ID, err)
+		}
+		for _, env := range envs {
+			if err := resolver.Preload(ctx, env); err != nil {
+				return i, fmt.Errorf("signing key of environment %s: %w", env.ID, err)
+			}
+		}
+	}
+	return len(tenants), nil
+}
+
+// listTenants returns the tenants that can take requests.
+func listTenants(ctx context.Context, store storage.TenantRepo) ([]*models.Tenant, error) {
+	var tenants []*models.Tenant
+	for page := 1; ; page++ {
+		batch, total, err := store.ListTenants(ctx, page, tenantPageSize)
+		if err != nil {
+			return nil, fmt.Errorf("list tenants: %w", err)
+		}
+		for _, tenant := range batch {
+			if !tenant.IsSuspended() {
+				tenants = append(tenants, tenant)
+			}
+		}
+		if int64(page*tenantPageSize) >= total {
+			return tenants, nil
+		}
+	}
+}
+
+// mostActive returns the top tenants by users logged in over the
+// activityWindow, most active first.
+func mostActive(ctx context.Context, store storage.UserRepo, tenants []*models.Tenant, top int) ([]*models.Tenant, error) {
+	since := time.Now().Add(-activityWindow)
+	active := make(map[string]int64, len(tenants))
+	for _, tenant := range tenants {
+		_, total, err := store.ListUsers(storage.WithTenant(ctx, tenant.ID), storage.UserFilter{
+			TenantID:       tenant.ID,
+			LastLoginSince: since,
+			Page:           1,
+			PageSize:       1,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("count active users of tenant %s: %w", tenant.ID, err)
+		}
+		active[tenant.ID] = total
+	}
+	sort.SliceStable(tenants, func(i, j int) bool {
+		return active[tenants[i].ID] > active[tenants[j].ID]
+	})
+	return tenants[:top], nil
+}
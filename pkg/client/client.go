@@ -0,0 +1,165 @@
+// Package client calls the auth API of a Heimdall instance: login, token
+// validation, and SSO token exchange.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+)
+
+// Client talks to one instance. It keeps the SSO session cookie a login
+// sets, so SSOToken can get fresh tokens for the user that logged in; use a
+// Client per user.
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+// New returns a client for the instance at baseURL, such as
+// https://auth.example.com, sending requests through httpClient, or a client
+// of its own when it is nil. A client without a cookie jar gets one.
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	if httpClient.Jar == nil {
+		jar, _ := cookiejar.New(nil)
+		copied := *httpClient
+		copied.Jar = jar
+		httpClient = &copied
+	}
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/") + "/api/v1",
+		http:    httpClient,
+	}
+}
+
+// Error is a response with an error status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("heimdall: %d %s", e.StatusCode, e.Message)
+}
+
+type LoginRequest struct {
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Phone    string `json:"phone,omitempty"`
+	Password string `json:"password"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+type User struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type Token struct {
+	Token     string `json:"token"`
+	ExpiresIn int    `json:"expires_in"`
+	User      User   `json:"user"`
+}
+
+type Validation struct {
+	Valid  bool `json:"valid"`
+	User   User `json:"user"`
+	Tenant struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"tenant"`
+	ExpiresAt *int64 `json:"expires_at"`
+	// Degraded is set when the instance answered without its database.
+	Degraded bool `json:"degraded"`
+}
+
+// Login signs a user in to the tenant, or to the user pool of environment
+// when it is not empty.
+func (c *Client) Login(ctx context.Context, tenantID, environment string, req LoginRequest) (*Token, error) {
+	path := "/" + url.PathEscape(tenantID)
+	if environment != "" {
+		path += "/" + url.PathEscape(environment)
+	}
+	var token Token
+	if err := c.do(ctx, http.MethodPost, path+"/login", "", req, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ValidateToken checks a token issued by the instance.
+func (c *Client) ValidateToken(ctx context.Context, token string) (*Validation, error) {
+	var validation Validation
+	if err := c.do(ctx, http.MethodPost, "/validate-token", token, nil, &validation); err != nil {
+		return nil, err
+	}
+	return &validation, nil
+}
+
+// SSOToken gets a fresh token for the SSO session of the last login to the
+// tenant, which the instance only starts for tenants with SSO configured.
+// The session cookie is only sent back over HTTPS.
+func (c *Client) SSOToken(ctx context.Context, tenantID, clientID string) (*Token, error) {
+	var body interface{}
+	if clientID != "" {
+		body = map[string]string{"client_id": clientID}
+	}
+	var token Token
+	if err := c.do(ctx, http.MethodPost, "/"+url.PathEscape(tenantID)+"/sso/token", "", body, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path, token string, body, out interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var problem struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &problem) != nil || problem.Error == "" {
+			problem.Error = http.StatusText(resp.StatusCode)
+		}
+		return &Error{StatusCode: resp.StatusCode, Message: problem.Error}
+	}
+	return json.Unmarshal(data, out)
+}
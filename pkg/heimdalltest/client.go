@@ -0,0 +1,124 @@
+package heimdalltest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Client sends requests to a fiber app in-process and fails the test on
+// transport errors.
+type Client struct {
+	tb      testing.TB
+	app     *fiber.App
+	headers map[string]string
+}
+
+func NewClient(tb testing.TB, app *fiber.App) *Client {
+	return &Client{tb: tb, app: app, headers: make(map[string]string)}
+}
+
+// WithToken returns a copy of the client that sends token as a bearer token.
+func (c *Client) WithToken(token string) *Client {
+	return c.WithHeader("Authorization", "Bearer "+token)
+}
+
+// WithHeader returns a copy of the client that sends the header.
+func (c *Client) WithHeader(name, value string) *Client {
+	headers := make(map[string]string, len(c.headers)+1)
+	for k, v := range c.headers {
+		headers[k] = v
+	}
+	headers[name] = value
+	return &Client{tb: c.tb, app: c.app, headers: headers}
+}
+
+func (c *Client) Get(path string) *Response {
+	return c.Do(http.MethodGet, path, nil)
+}
+
+func (c *Client) Post(path string, body interface{}) *Response {
+	return c.Do(http.MethodPost, path, body)
+}
+
+func (c *Client) Put(path string, body interface{}) *Response {
+	return c.Do(http.MethodPut, path, body)
+}
+
+func (c *Client) Patch(path string, body interface{}) *Response {
+	return c.Do(http.MethodPatch, path, body)
+}
+
+func (c *Client) Delete(path string) *Response {
+	return c.Do(http.MethodDelete, path, nil)
+}
+
+// Do sends a request. A body that is not a string or []byte is encoded as
+// JSON.
+func (c *Client) Do(method, path string, body interface{}) *Response {
+	c.tb.Helper()
+
+	var payload []byte
+	switch b := body.(type) {
+	case nil:
+	case string:
+		payload = []byte(b)
+	case []byte:
+		payload = b
+	default:
+		var err error
+		if payload, err = json.Marshal(b); err != nil {
+			c.tb.Fatalf("heimdalltest: encode request body: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range c.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := c.app.Test(req, -1)
+	if err != nil {
+		c.tb.Fatalf("heimdalltest: %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.tb.Fatalf("heimdalltest: read response of %s %s: %v", method, path, err)
+	}
+	return &Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: data, tb: c.tb}
+}
+
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	tb testing.TB
+}
+
+// JSON decodes the body into v.
+func (r *Response) JSON(v interface{}) {
+	r.tb.Helper()
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		r.tb.Fatalf("heimdalltest: decode response %q: %v", r.Body, err)
+	}
+}
+
+// Expect fails the test unless the response has the status code.
+func (r *Response) Expect(status int) *Response {
+	r.tb.Helper()
+	if r.StatusCode != status {
+		r.tb.Fatalf("heimdalltest: got status %d, want %d: %s", r.StatusCode, status, r.Body)
+	}
+	return r
+}
@@ -0,0 +1,215 @@
+// Package heimdalltest runs Heimdall in-process for integration tests. Every
+// component keeps its state in memory, so tests need neither PostgreSQL nor
+// Redis:
+//
+//	srv := heimdalltest.NewServer(t)
+//	tenant := srv.Tenant("acme")
+//	admin := srv.User(tenant.ID, "root", "a long password", models.RoleAdmin)
+//	resp := srv.Client().WithToken(srv.Tokens.For(admin)).Get("/api/v2/tenants/acme/users")
+package heimdalltest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tajious/heimdall/internal/api/handlers"
+	"github.com/tajious/heimdall/internal/api/router"
+	"github.com/tajious/heimdall/internal/api/versioning"
+	"github.com/tajious/heimdall/internal/authn"
+	"github.com/tajious/heimdall/internal/authz"
+	"github.com/tajious/heimdall/internal/blob"
+	"github.com/tajious/heimdall/internal/coordination"
+	"github.com/tajious/heimdall/internal/domains"
+	"github.com/tajious/heimdall/internal/events"
+	"github.com/tajious/heimdall/internal/exports"
+	"github.com/tajious/heimdall/internal/hooks"
+	"github.com/tajious/heimdall/internal/keys"
+	"github.com/tajious/heimdall/internal/metrics"
+	"github.com/tajious/heimdall/internal/middleware"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/offboarding"
+	"github.com/tajious/heimdall/internal/passwords"
+	"github.com/tajious/heimdall/internal/vault"
+)
+
+const (
+	// Secret signs the tokens of users outside environments.
+	Secret = "heimdalltest-secret"
+	// OperatorToken authorizes the operator endpoints.
+	OperatorToken = "heimdalltest-operator"
+	// ClientCertHeader carries the URL escaped PEM client certificate chain,
+	// as a TLS-terminating proxy would forward it.
+	ClientCertHeader = "X-Client-Cert"
+)
+
+// masterKey wraps the tenant data keys, so tenant secrets are stored sealed
+// as they are in production.
+var masterKey = []byte("heimdalltest-master-key-32-bytes")
+
+// ArchivePassphrase seals the archives of tenants deleted with archive=true.
+const ArchivePassphrase = "heimdalltest-archive-passphrase"
+
+// Server is a fully wired Heimdall serving the public API and the
+// management plane from one fiber app.
+type Server struct {
+	App        *fiber.App
+	Storage    *Storage
+	Tokens     *Tokens
+	LoginHooks *hooks.Registry
+	Secrets    *vault.Vault
+	Events     *events.Broker
+	// Blobs keeps exports and tenant archives in a temporary directory.
+	Blobs *blob.DiskStore
+
+	tb      testing.TB
+	hasher  *passwords.Hasher
+	exports *exports.Runner
+}
+
+// NewServer returns a server with rate limiting and load shedding off. Login
+// hooks registered on LoginHooks apply to every tenant.
+func NewServer(tb testing.TB) *Server {
+	tb.Helper()
+
+	registry := metrics.NewRegistry()
+	store := NewStorage()
+	secrets, err := vault.New(store, masterKey)
+	if err != nil {
+		tb.Fatalf("heimdalltest: set up tenant encryption: %v", err)
+	}
+	resolver := keys.NewResolver(Secret, store, secrets, time.Minute, registry)
+	hasher := passwords.NewHasher(0, 0, registry)
+	engine := authz.NewEngine(store, time.Minute, registry)
+	blobs, err := blob.NewDiskStore(tb.TempDir())
+	if err != nil {
+		tb.Fatalf("heimdalltest: set up blob store: %v", err)
+	}
+	loginHooks := hooks.NewRegistry(time.Second, secrets)
+
+	authenticators := authn.NewRegistry()
+	authenticators.Register(models.UsernamePassword, authn.NewPasswordAuthenticator(store, hasher))
+	authenticators.Register(models.Delegated, authn.NewDelegatedAuthenticator(authn.NewProvisioner(store, engine), secrets))
+	authenticators.Register(models.ClientCertificate, authn.NewClientCertificateAuthenticator(store))
+
+	rateLimitStore := middleware.NewMemoryStore()
+	rateLimiter := middleware.NewRateLimiter(rateLimitStore, false, middleware.AbusePenaltyConfig{})
+	killSwitches := middleware.NewKillSwitches()
+	maintenance := middleware.NewMaintenance()
+	consumedTokens := middleware.NewMemoryConsumedTokens()
+	oneTimeTokens := middleware.NewOneTimeTokens(store, consumedTokens)
+	broker := events.NewBroker()
+
+	app := fiber.New()
+	app.Use(middleware.ClientCertificates(ClientCertHeader))
+	apiRouter := router.NewRouter(
+		app,
+		app,
+		handlers.NewAuthHandler(store, resolver, oneTimeTokens, hasher, nil, authenticators, loginHooks, nil, broker, time.Hour),
+		handlers.NewTenantHandler(store, secrets, resolver),
+		handlers.NewEnvironmentHandler(store, secrets),
+		handlers.NewPolicyHandler(store),
+		handlers.NewAccessPolicyHandler(store, engine),
+		handlers.NewAuditHandler(store),
+		handlers.NewRateLimitHandler(rateLimitStore, rateLimiter),
+		handlers.NewHealthHandler(store),
+		handlers.NewDiagnosticsHandler(store, rateLimitStore),
+		handlers.NewKillSwitchHandler(killSwitches, coordination.Local{}),
+		handlers.NewMaintenanceHandler(maintenance, coordination.Local{}),
+		handlers.NewOffboardingHandler(offboarding.NewOffboarder(store, secrets, blobs, ArchivePassphrase, time.Hour)),
+		handlers.NewExportHandler(store, blobs, nil, time.Minute),
+		handlers.NewJobHandler(store, blobs, time.Minute),
+		handlers.NewPluginHandler(store, nil),
+		handlers.NewDomainHandler(store, domains.NewVerifier(store.DNS)),
+		handlers.NewSigningKeyHandler(store, secrets),
+		handlers.NewEventHandler(broker),
+		handlers.NewClientHandler(store, secrets, resolver),
+		middleware.NewAuthMiddleware(resolver, middleware.NewSignedRequests(store, secrets, consumedTokens, 0)),
+		middleware.NewAuditor(store, broker),
+		middleware.NewAuthorizer(engine),
+		middleware.NewTenantResolver(store, ""),
+		rateLimiter,
+		middleware.NewLoadShedder(middleware.LoadSheddingConfig{}, registry),
+		killSwitches,
+		maintenance,
+		middleware.NewLoginLatency(0, registry),
+		OperatorToken,
+		[]versioning.Version{{Name: "v1", Successor: "v2"}, {Name: "v2"}},
+	)
+	if err := apiRouter.SetupRoutes(); err != nil {
+		tb.Fatalf("heimdalltest: set up routes: %v", err)
+	}
+
+	return &Server{
+		App:        app,
+		Storage:    store,
+		Tokens:     &Tokens{resolver: resolver, tb: tb},
+		LoginHooks: loginHooks,
+		Secrets:    secrets,
+		Events:     broker,
+		Blobs:      blobs,
+		tb:         tb,
+		hasher:     hasher,
+		exports:    exports.NewRunner(store, blobs),
+	}
+}
+
+// RunExports runs the queued exports, as the job runner would, so their
+// download URLs can be fetched.
+func (s *Server) RunExports() {
+	s.tb.Helper()
+	if err := s.exports.Run(context.Background()); err != nil {
+		s.tb.Fatalf("heimdalltest: run exports: %v", err)
+	}
+}
+
+// Client returns a client for the server's app.
+func (s *Server) Client() *Client {
+	return NewClient(s.tb, s.App)
+}
+
+// Tenant creates a tenant with the default config, adjusted by configure.
+func (s *Server) Tenant(id string, configure ...func(*models.TenantConfig)) *models.Tenant {
+	s.tb.Helper()
+
+	config := models.DefaultConfig(id)
+	for _, fn := range configure {
+		fn(config)
+	}
+	tenant := &models.Tenant{
+		ID:        id,
+		Name:      id,
+		Status:    models.TenantActive,
+		Config:    *config,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := s.Storage.CreateTenant(context.Background(), tenant); err != nil {
+		s.tb.Fatalf("heimdalltest: create tenant %s: %v", id, err)
+	}
+	return tenant
+}
+
+// User creates an active user in the tenant's default user pool.
+func (s *Server) User(tenantID, username, password string, role models.Role) *models.User {
+	s.tb.Helper()
+
+	hash, err := s.hasher.Hash(context.Background(), password)
+	if err != nil {
+		s.tb.Fatalf("heimdalltest: hash password: %v", err)
+	}
+	user := &models.User{
+		TenantID:  tenantID,
+		Username:  username,
+		Password:  hash,
+		Role:      role,
+		Status:    models.UserActive,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := s.Storage.CreateUser(context.Background(), user); err != nil {
+		s.tb.Fatalf("heimdalltest: create user %s: %v", username, err)
+	}
+	return user
+}
@@ -0,0 +1,186 @@
+package heimdalltest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RateLimitStore is the interface rate limit counters are kept behind,
+// restated so stores outside this module can be checked too.
+type RateLimitStore interface {
+	Increment(ctx context.Context, key string, window time.Duration) (int, error)
+	GetCount(ctx context.Context, key string) (int, error)
+}
+
+// RateLimitCase checks one behavior every rate limit store must share. Cases
+// use keys of their own, so they can run against a shared server.
+type RateLimitCase struct {
+	Name string
+	Run  func(ctx context.Context, store RateLimitStore) error
+}
+
+// Expiry is checked with whole-second windows, the finest memcached and
+// DynamoDB support.
+const conformanceWindow = 2 * time.Second
+
+// RateLimitStoreCases is the conformance suite for rate limit stores.
+func RateLimitStoreCases() []RateLimitCase {
+	return []RateLimitCase{
+		{Name: "UnknownKeyCountsZero", Run: unknownKeyCountsZero},
+		{Name: "IncrementCountsFromOne", Run: incrementCountsFromOne},
+		{Name: "KeysAreIndependent", Run: keysAreIndependent},
+		{Name: "ConcurrentIncrementsAreAtomic", Run: concurrentIncrementsAreAtomic},
+		{Name: "CounterExpiresAfterWindow", Run: counterExpiresAfterWindow},
+		{Name: "IncrementExtendsWindow", Run: incrementExtendsWindow},
+	}
+}
+
+// RunRateLimitStoreSuite runs every conformance case as a subtest against a
+// store from newStore:
+//
+//	func TestMyStore(t *testing.T) {
+//		heimdalltest.RunRateLimitStoreSuite(t, func(t *testing.T) heimdalltest.RateLimitStore {
+//			return mystore.New(...)
+//		})
+//	}
+func RunRateLimitStoreSuite(t *testing.T, newStore func(t *testing.T) RateLimitStore) {
+	for _, c := range RateLimitStoreCases() {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			if err := c.Run(context.Background(), newStore(t)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func conformanceKey(name string) string {
+	return "rate_limit:conformance:" + name + ":" + uuid.NewString()
+}
+
+func expectCount(ctx context.Context, store RateLimitStore, key string, want int) error {
+	got, err := store.GetCount(ctx, key)
+	if err != nil {
+		return fmt.Errorf("GetCount: %w", err)
+	}
+	if got != want {
+		return fmt.Errorf("GetCount = %d, want %d", got, want)
+	}
+	return nil
+}
+
+func unknownKeyCountsZero(ctx context.Context, store RateLimitStore) error {
+	return expectCount(ctx, store, conformanceKey("unknown"), 0)
+}
+
+func incrementCountsFromOne(ctx context.Context, store RateLimitStore) error {
+	key := conformanceKey("count")
+	for want := 1; want <= 3; want++ {
+		got, err := store.Increment(ctx, key, time.Minute)
+		if err != nil {
+			return fmt.Errorf("Increment: %w", err)
+		}
+		if got != want {
+			return fmt.Errorf("Increment = %d, want %d", got, want)
+		}
+	}
+	return expectCount(ctx, store, key, 3)
+}
+
+func keysAreIndependent(ctx context.Context, store RateLimitStore) error {
+	first, second := conformanceKey("first"), conformanceKey("second")
+	for i := 0; i < 2; i++ {
+		if _, err := store.Increment(ctx, first, time.Minute); err != nil {
+			return fmt.Errorf("Increment: %w", err)
+		}
+	}
+	if _, err := store.Increment(ctx, second, time.Minute); err != nil {
+		return fmt.Errorf("Increment: %w", err)
+	}
+	if err := expectCount(ctx, store, first, 2); err != nil {
+		return err
+	}
+	return expectCount(ctx, store, second, 1)
+}
+
+// concurrentIncrementsAreAtomic requires every concurrent increment to see a
+// distinct count, so no two requests can both claim the last slot.
+func concurrentIncrementsAreAtomic(ctx context.Context, store RateLimitStore) error {
+	const increments = 100
+	key := conformanceKey("concurrent")
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		counts []int
+		errs   []error
+	)
+	for i := 0; i < increments; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			count, err := store.Increment(ctx, key, time.Minute)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			counts = append(counts, count)
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Increment: %w", errs[0])
+	}
+	sort.Ints(counts)
+	for i, count := range counts {
+		if count != i+1 {
+			return fmt.Errorf("concurrent increments returned %v, want 1 to %d once each", counts, increments)
+		}
+	}
+	return expectCount(ctx, store, key, increments)
+}
+
+func counterExpiresAfterWindow(ctx context.Context, store RateLimitStore) error {
+	key := conformanceKey("expiry")
+	for i := 0; i < 2; i++ {
+		if _, err := store.Increment(ctx, key, conformanceWindow); err != nil {
+			return fmt.Errorf("Increment: %w", err)
+		}
+	}
+	time.Sleep(conformanceWindow + time.Second)
+
+	if err := expectCount(ctx, store, key, 0); err != nil {
+		return fmt.Errorf("after the window: %w", err)
+	}
+	count, err := store.Increment(ctx, key, conformanceWindow)
+	if err != nil {
+		return fmt.Errorf("Increment: %w", err)
+	}
+	if count != 1 {
+		return fmt.Errorf("Increment after the window = %d, want 1", count)
+	}
+	return nil
+}
+
+// incrementExtendsWindow pins down the Redis semantics every store shares:
+// a counter expires a full window after its latest hit, not its first.
+func incrementExtendsWindow(ctx context.Context, store RateLimitStore) error {
+	key := conformanceKey("extend")
+	for i := 0; i < 2; i++ {
+		if _, err := store.Increment(ctx, key, conformanceWindow); err != nil {
+			return fmt.Errorf("Increment: %w", err)
+		}
+		time.Sleep(conformanceWindow * 6 / 10)
+	}
+	return expectCount(ctx, store, key, 2)
+}
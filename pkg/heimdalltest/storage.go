@@ -0,0 +1,64 @@
+package heimdalltest
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+// Storage is the in-memory backend with knobs for tests: an outage switch
+// for the readiness probe and the DNS records domain verification sees.
+type Storage struct {
+	*storage.InMemoryStorage
+
+	// DNS holds the TXT records domain verification looks up.
+	DNS *DNS
+
+	mu          sync.Mutex
+	unavailable error
+}
+
+func NewStorage() *Storage {
+	return &Storage{
+		InMemoryStorage: storage.NewInMemoryStorage(),
+		DNS:             &DNS{records: make(map[string][]string)},
+	}
+}
+
+// SetUnavailable makes Ping fail with err until it is called with nil.
+func (s *Storage) SetUnavailable(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unavailable = err
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unavailable
+}
+
+// DNS is a fake resolver for domain verification.
+type DNS struct {
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+// SetTXT replaces the TXT records of name.
+func (d *DNS) SetTXT(name string, records ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.records[name] = records
+}
+
+func (d *DNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	records, ok := d.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
@@ -0,0 +1,860 @@
+package heimdalltest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tajious/heimdall/internal/models"
+	"github.com/tajious/heimdall/internal/storage"
+)
+
+// StorageCase checks one behavior every storage backend must share. Cases
+// create tenants of their own, so they can run against a shared database.
+type StorageCase struct {
+	Name string
+	Run  func(ctx context.Context, store storage.Storage) error
+}
+
+// StorageCases is the conformance suite for storage backends.
+func StorageCases() []StorageCase {
+	return []StorageCase{
+		{Name: "MissingRecordsAreNotFound", Run: missingRecordsAreNotFound},
+		{Name: "OtherTenantsRecordsAreNotFound", Run: otherTenantsRecordsAreNotFound},
+		{Name: "UpdatingMissingRecordsIsNotFound", Run: updatingMissingRecordsIsNotFound},
+		{Name: "DuplicatesConflict", Run: duplicatesConflict},
+		{Name: "UpdatesIntoDuplicatesConflict", Run: updatesIntoDuplicatesConflict},
+		{Name: "UserPagesDoNotOverlap", Run: userPagesDoNotOverlap},
+		{Name: "TenantPagesDoNotOverlap", Run: tenantPagesDoNotOverlap},
+		{Name: "EmptyListsAreEmpty", Run: emptyListsAreEmpty},
+		{Name: "AuditLogsAreChained", Run: auditLogsAreChained},
+		{Name: "PurgedAuditChainsAreAnchored", Run: purgedAuditChainsAreAnchored},
+		{Name: "DataChangesFollowTheirAuditLog", Run: dataChangesFollowTheirAuditLog},
+		{Name: "ConsentGrantsAreReplaced", Run: consentGrantsAreReplaced},
+		{Name: "SSOSessionsTrackTheirClients", Run: ssoSessionsTrackTheirClients},
+		{Name: "DeletedTenantsLeaveNothing", Run: deletedTenantsLeaveNothing},
+		{Name: "JobsAreClaimedOnce", Run: jobsAreClaimedOnce},
+	}
+}
+
+// RunStorageSuite runs every conformance case as a subtest against a store
+// from newStore.
+func RunStorageSuite(t *testing.T, newStore func(t *testing.T) storage.Storage) {
+	for _, c := range StorageCases() {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			if err := c.Run(context.Background(), newStore(t)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// check collects the first failed expectation of a case.
+type check struct {
+	err error
+}
+
+func (c *check) is(what string, got, want error) {
+	if c.err == nil && !errors.Is(got, want) {
+		c.err = fmt.Errorf("%s: got error %v, want %v", what, got, want)
+	}
+}
+
+func (c *check) ok(what string, err error) {
+	if c.err == nil && err != nil {
+		c.err = fmt.Errorf("%s: %w", what, err)
+	}
+}
+
+func newConformanceTenant(ctx context.Context, store storage.Storage) (*models.Tenant, error) {
+	now := time.Now()
+	tenant := &models.Tenant{
+		ID:        "conformance-" + uuid.NewString(),
+		Name:      "Conformance",
+		Status:    models.TenantActive,
+		Config:    models.TenantConfig{AuthMethod: models.UsernamePassword, CreatedAt: now, UpdatedAt: now},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	return tenant, store.CreateTenant(ctx, tenant)
+}
+
+func newConformanceUser(tenantID, username string) *models.User {
+	now := time.Now()
+	return &models.User{
+		TenantID:  tenantID,
+		Username:  username,
+		Password:  "hash",
+		Role:      models.RoleUser,
+		Status:    models.UserActive,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+func newConformanceDeviceAuthorization(tenantID, userCode string) *models.DeviceAuthorization {
+	now := time.Now()
+	return &models.DeviceAuthorization{
+		TenantID:       tenantID,
+		DeviceCodeHash: uuid.NewString(),
+		UserCode:       userCode,
+		ClientID:       "tv",
+		Status:         models.DevicePending,
+		Interval:       5,
+		ExpiresAt:      now.Add(time.Minute),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+}
+
+func newConformanceEnvironment(tenantID, name string) *models.Environment {
+	now := time.Now()
+	return &models.Environment{
+		TenantID:   tenantID,
+		Name:       name,
+		APIKeyHash: uuid.NewString(),
+		SigningKey: "key",
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+}
+
+func newConformanceSSOSession(tenantID string) *models.SSOSession {
+	now := time.Now()
+	return &models.SSOSession{
+		TenantID:  tenantID,
+		TokenHash: uuid.NewString(),
+		UserID:    uuid.NewString(),
+		ExpiresAt: now.Add(time.Hour),
+		CreatedAt: now,
+	}
+}
+
+func missingRecordsAreNotFound(ctx context.Context, store storage.Storage) error {
+	missing := uuid.NewString()
+	var c check
+
+	_, err := store.GetTenant(ctx, missing)
+	c.is("GetTenant", err, storage.ErrTenantNotFound)
+	_, err = store.GetUser(ctx, missing)
+	c.is("GetUser", err, storage.ErrUserNotFound)
+	_, err = store.GetPoolUserByUsername(ctx, missing, "", "nobody")
+	c.is("GetPoolUserByUsername", err, storage.ErrUserNotFound)
+	_, err = store.GetPoolUserByEmail(ctx, missing, "", "nobody@example.com")
+	c.is("GetPoolUserByEmail", err, storage.ErrUserNotFound)
+	_, err = store.FindUserByAttribute(ctx, missing, "employee_id", "42")
+	c.is("FindUserByAttribute", err, storage.ErrUserNotFound)
+	_, err = store.GetEnvironment(ctx, missing)
+	c.is("GetEnvironment", err, storage.ErrEnvironmentNotFound)
+	_, err = store.GetEnvironmentByName(ctx, missing, "prod")
+	c.is("GetEnvironmentByName", err, storage.ErrEnvironmentNotFound)
+	_, err = store.GetEnvironmentByAPIKeyHash(ctx, missing)
+	c.is("GetEnvironmentByAPIKeyHash", err, storage.ErrEnvironmentNotFound)
+	_, err = store.GetPolicyVersion(ctx, missing)
+	c.is("GetPolicyVersion", err, storage.ErrPolicyNotFound)
+	_, err = store.GetAccessPolicy(ctx, missing, missing)
+	c.is("GetAccessPolicy", err, storage.ErrAccessPolicyNotFound)
+	_, err = store.GetPluginModule(ctx, missing, missing)
+	c.is("GetPluginModule", err, storage.ErrPluginModuleNotFound)
+	_, err = store.GetDomainClaim(ctx, missing, missing)
+	c.is("GetDomainClaim", err, storage.ErrDomainClaimNotFound)
+	_, err = store.FindVerifiedDomain(ctx, missing+".example.com")
+	c.is("FindVerifiedDomain", err, storage.ErrDomainClaimNotFound)
+	_, err = store.GetDeviceAuthorizationByDeviceCode(ctx, missing, missing)
+	c.is("GetDeviceAuthorizationByDeviceCode", err, storage.ErrDeviceAuthorizationNotFound)
+	_, err = store.GetDeviceAuthorizationByUserCode(ctx, missing, "BCDFGHJK")
+	c.is("GetDeviceAuthorizationByUserCode", err, storage.ErrDeviceAuthorizationNotFound)
+	_, err = store.GetSigningKey(ctx, missing, missing)
+	c.is("GetSigningKey", err, storage.ErrSigningKeyNotFound)
+	_, err = store.FindSigningKey(ctx, missing)
+	c.is("FindSigningKey", err, storage.ErrSigningKeyNotFound)
+	_, err = store.GetSSOSessionByTokenHash(ctx, missing, missing)
+	c.is("GetSSOSessionByTokenHash", err, storage.ErrSSOSessionNotFound)
+	_, err = store.GetConsentGrant(ctx, missing, missing, missing)
+	c.is("GetConsentGrant", err, storage.ErrConsentGrantNotFound)
+	_, err = store.GetClient(ctx, missing, missing)
+	c.is("GetClient", err, storage.ErrClientNotFound)
+	return c.err
+}
+
+// otherTenantsRecordsAreNotFound makes sure tenant-scoped lookups never
+// reach into another tenant, whatever the backend.
+func otherTenantsRecordsAreNotFound(ctx context.Context, store storage.Storage) error {
+	owner, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+	other, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	var c check
+	policy := &models.AccessPolicy{TenantID: owner.ID, Name: "policy"}
+	c.ok("CreateAccessPolicy", store.CreateAccessPolicy(ctx, policy))
+	module := &models.PluginModule{TenantID: owner.ID, Name: "plugin", Version: 1, SHA256: "sum", Module: []byte{0}}
+	c.ok("CreatePluginModule", store.CreatePluginModule(ctx, module))
+	claim := &models.DomainClaim{TenantID: owner.ID, Domain: uuid.NewString() + ".example.com", Token: "token"}
+	c.ok("CreateDomainClaim", store.CreateDomainClaim(ctx, claim))
+	c.ok("CreateUser", store.CreateUser(ctx, newConformanceUser(owner.ID, "alice")))
+	c.ok("CreateEnvironment", store.CreateEnvironment(ctx, newConformanceEnvironment(owner.ID, "prod")))
+	device := newConformanceDeviceAuthorization(owner.ID, "BCDFGHJK")
+	c.ok("CreateDeviceAuthorization", store.CreateDeviceAuthorization(ctx, device))
+	key := &models.SigningKey{TenantID: owner.ID, Name: "ci", Secret: "secret"}
+	c.ok("CreateSigningKey", store.CreateSigningKey(ctx, key))
+	tenantKey := &models.TenantKey{TenantID: owner.ID, Version: 1, WrappedKey: "wrapped", CreatedAt: time.Now()}
+	c.ok("ActivateTenantKey", store.ActivateTenantKey(ctx, tenantKey))
+	session := newConformanceSSOSession(owner.ID)
+	c.ok("CreateSSOSession", store.CreateSSOSession(ctx, session))
+	grant := &models.ConsentGrant{TenantID: owner.ID, UserID: "alice", ClientID: "tv", Scopes: []string{"read"}}
+	c.ok("SaveConsentGrant", store.SaveConsentGrant(ctx, grant))
+	client := &models.Client{TenantID: owner.ID, Name: "app"}
+	c.ok("CreateClient", store.CreateClient(ctx, client))
+	if c.err != nil {
+		return c.err
+	}
+
+	_, err = store.GetAccessPolicy(ctx, other.ID, policy.ID)
+	c.is("GetAccessPolicy", err, storage.ErrAccessPolicyNotFound)
+	c.is("DeleteAccessPolicy", store.DeleteAccessPolicy(ctx, other.ID, policy.ID), storage.ErrAccessPolicyNotFound)
+	_, err = store.GetPluginModule(ctx, other.ID, module.ID)
+	c.is("GetPluginModule", err, storage.ErrPluginModuleNotFound)
+	c.is("SetPluginModuleActive", store.SetPluginModuleActive(ctx, other.ID, module.ID, true), storage.ErrPluginModuleNotFound)
+	_, err = store.GetDomainClaim(ctx, other.ID, claim.ID)
+	c.is("GetDomainClaim", err, storage.ErrDomainClaimNotFound)
+	c.is("DeleteDomainClaim", store.DeleteDomainClaim(ctx, other.ID, claim.ID), storage.ErrDomainClaimNotFound)
+	_, err = store.GetPoolUserByUsername(ctx, other.ID, "", "alice")
+	c.is("GetPoolUserByUsername", err, storage.ErrUserNotFound)
+	_, err = store.GetEnvironmentByName(ctx, other.ID, "prod")
+	c.is("GetEnvironmentByName", err, storage.ErrEnvironmentNotFound)
+	_, err = store.GetDeviceAuthorizationByDeviceCode(ctx, other.ID, device.DeviceCodeHash)
+	c.is("GetDeviceAuthorizationByDeviceCode", err, storage.ErrDeviceAuthorizationNotFound)
+	_, err = store.GetDeviceAuthorizationByUserCode(ctx, other.ID, device.UserCode)
+	c.is("GetDeviceAuthorizationByUserCode", err, storage.ErrDeviceAuthorizationNotFound)
+	c.is("DeleteDeviceAuthorization", store.DeleteDeviceAuthorization(ctx, other.ID, device.ID), storage.ErrDeviceAuthorizationNotFound)
+	_, err = store.GetSigningKey(ctx, other.ID, key.ID)
+	c.is("GetSigningKey", err, storage.ErrSigningKeyNotFound)
+	c.is("DeleteSigningKey", store.DeleteSigningKey(ctx, other.ID, key.ID), storage.ErrSigningKeyNotFound)
+	c.is("DeleteTenantKey", store.DeleteTenantKey(ctx, other.ID, tenantKey.ID), storage.ErrTenantKeyNotFound)
+	if tenantKeys, err := store.ListTenantKeys(ctx, other.ID); c.err == nil && (err != nil || len(tenantKeys) != 0) {
+		c.err = fmt.Errorf("ListTenantKeys = %d keys, %v; want none", len(tenantKeys), err)
+	}
+	_, err = store.GetSSOSessionByTokenHash(ctx, other.ID, session.TokenHash)
+	c.is("GetSSOSessionByTokenHash", err, storage.ErrSSOSessionNotFound)
+	c.is("DeleteSSOSession", store.DeleteSSOSession(ctx, other.ID, session.ID), storage.ErrSSOSessionNotFound)
+	_, err = store.GetConsentGrant(ctx, other.ID, grant.UserID, grant.ClientID)
+	c.is("GetConsentGrant", err, storage.ErrConsentGrantNotFound)
+	c.is("DeleteConsentGrant", store.DeleteConsentGrant(ctx, other.ID, grant.UserID, grant.ClientID), storage.ErrConsentGrantNotFound)
+	if grants, err := store.ListConsentGrants(ctx, other.ID, grant.UserID); c.err == nil && (err != nil || len(grants) != 0) {
+		c.err = fmt.Errorf("ListConsentGrants = %d grants, %v; want none", len(grants), err)
+	}
+	_, err = store.GetClient(ctx, other.ID, client.ID)
+	c.is("GetClient", err, storage.ErrClientNotFound)
+	c.is("DeleteClient", store.DeleteClient(ctx, other.ID, client.ID), storage.ErrClientNotFound)
+	return c.err
+}
+
+// updatingMissingRecordsIsNotFound guards against updates that quietly
+// insert the record, or quietly do nothing.
+func updatingMissingRecordsIsNotFound(ctx context.Context, store storage.Storage) error {
+	missing := uuid.NewString()
+	var c check
+
+	user := newConformanceUser(missing, "ghost")
+	user.ID = missing
+	c.is("UpdateUser", store.UpdateUser(ctx, user), storage.ErrUserNotFound)
+	c.is("UpdateUsers", store.UpdateUsers(ctx, []*models.User{user}), storage.ErrUserNotFound)
+	c.is("UpdateUserLastLogin", store.UpdateUserLastLogin(ctx, missing), storage.ErrUserNotFound)
+	_, err := store.GetUser(ctx, missing)
+	c.is("GetUser after the updates", err, storage.ErrUserNotFound)
+
+	c.is("UpdateTenant", store.UpdateTenant(ctx, &models.Tenant{ID: missing, Name: "Ghost", Status: models.TenantActive}), storage.ErrTenantNotFound)
+	c.is("UpdateTenantConfig", store.UpdateTenantConfig(ctx, &models.TenantConfig{ID: missing, TenantID: missing}), storage.ErrTenantNotFound)
+
+	env := newConformanceEnvironment(missing, "ghost")
+	env.ID = missing
+	c.is("UpdateEnvironment", store.UpdateEnvironment(ctx, env), storage.ErrEnvironmentNotFound)
+
+	claim := &models.DomainClaim{ID: missing, TenantID: missing, Domain: missing + ".example.com", Token: "token"}
+	c.is("UpdateDomainClaim", store.UpdateDomainClaim(ctx, claim), storage.ErrDomainClaimNotFound)
+	c.is("DeleteDomainClaim", store.DeleteDomainClaim(ctx, missing, missing), storage.ErrDomainClaimNotFound)
+	c.is("DeleteAccessPolicy", store.DeleteAccessPolicy(ctx, missing, missing), storage.ErrAccessPolicyNotFound)
+	c.is("SetPluginModuleActive", store.SetPluginModuleActive(ctx, missing, missing, true), storage.ErrPluginModuleNotFound)
+
+	device := newConformanceDeviceAuthorization(missing, "BCDFGHJK")
+	device.ID = missing
+	c.is("UpdateDeviceAuthorization", store.UpdateDeviceAuthorization(ctx, device), storage.ErrDeviceAuthorizationNotFound)
+	c.is("DeleteDeviceAuthorization", store.DeleteDeviceAuthorization(ctx, missing, missing), storage.ErrDeviceAuthorizationNotFound)
+
+	key := &models.SigningKey{ID: missing, TenantID: missing, Name: "ghost", Secret: "secret"}
+	c.is("UpdateSigningKey", store.UpdateSigningKey(ctx, key), storage.ErrSigningKeyNotFound)
+	c.is("DeleteSigningKey", store.DeleteSigningKey(ctx, missing, missing), storage.ErrSigningKeyNotFound)
+	c.is("DeleteTenantKey", store.DeleteTenantKey(ctx, missing, missing), storage.ErrTenantKeyNotFound)
+	c.is("DeleteSSOSession", store.DeleteSSOSession(ctx, missing, missing), storage.ErrSSOSessionNotFound)
+	c.is("DeleteConsentGrant", store.DeleteConsentGrant(ctx, missing, missing, missing), storage.ErrConsentGrantNotFound)
+	c.is("UpdateClient", store.UpdateClient(ctx, &models.Client{ID: missing, TenantID: missing, Name: "ghost"}), storage.ErrClientNotFound)
+	c.is("DeleteClient", store.DeleteClient(ctx, missing, missing), storage.ErrClientNotFound)
+	return c.err
+}
+
+func duplicatesConflict(ctx context.Context, store storage.Storage) error {
+	tenant, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	var c check
+	again := &models.Tenant{ID: tenant.ID, Name: "Again", Status: models.TenantActive}
+	c.is("CreateTenant with a taken ID", store.CreateTenant(ctx, again), storage.ErrConflict)
+
+	first := newConformanceUser(tenant.ID, "alice")
+	first.Email = "alice@example.com"
+	first.Phone = "+1555" + uuid.NewString()[:8]
+	c.ok("CreateUser", store.CreateUser(ctx, first))
+	c.is("CreateUser with a taken username", store.CreateUser(ctx, newConformanceUser(tenant.ID, "alice")), storage.ErrConflict)
+	sameEmail := newConformanceUser(tenant.ID, "alice2")
+	sameEmail.Email = first.Email
+	c.is("CreateUser with a taken email", store.CreateUser(ctx, sameEmail), storage.ErrConflict)
+	other, err := newConformanceTenant(ctx, store)
+	c.ok("CreateTenant", err)
+	samePhone := newConformanceUser(other.ID, "bob")
+	samePhone.Phone = first.Phone
+	c.is("CreateUser with a taken phone in another tenant", store.CreateUser(ctx, samePhone), storage.ErrConflict)
+	c.ok("CreateUser with a taken username in another tenant", store.CreateUser(ctx, newConformanceUser(other.ID, "alice")))
+
+	c.ok("CreateEnvironment", store.CreateEnvironment(ctx, newConformanceEnvironment(tenant.ID, "prod")))
+	c.is("CreateEnvironment with a taken name", store.CreateEnvironment(ctx, newConformanceEnvironment(tenant.ID, "prod")), storage.ErrConflict)
+
+	version := func() *models.PolicyVersion {
+		return &models.PolicyVersion{TenantID: tenant.ID, Kind: models.PolicyTermsOfService, Version: "1", PublishedAt: time.Now()}
+	}
+	c.ok("CreatePolicyVersion", store.CreatePolicyVersion(ctx, version()))
+	c.is("CreatePolicyVersion with a taken version", store.CreatePolicyVersion(ctx, version()), storage.ErrConflict)
+
+	c.ok("CreateAccessPolicy", store.CreateAccessPolicy(ctx, &models.AccessPolicy{TenantID: tenant.ID, Name: "policy"}))
+	c.is("CreateAccessPolicy with a taken name", store.CreateAccessPolicy(ctx, &models.AccessPolicy{TenantID: tenant.ID, Name: "policy"}), storage.ErrConflict)
+
+	module := func() *models.PluginModule {
+		return &models.PluginModule{TenantID: tenant.ID, Name: "plugin", Version: 1, SHA256: "sum", Module: []byte{0}}
+	}
+	c.ok("CreatePluginModule", store.CreatePluginModule(ctx, module()))
+	c.is("CreatePluginModule with a taken version", store.CreatePluginModule(ctx, module()), storage.ErrConflict)
+
+	domain := uuid.NewString() + ".example.com"
+	c.ok("CreateDomainClaim", store.CreateDomainClaim(ctx, &models.DomainClaim{TenantID: tenant.ID, Domain: domain, Token: "token"}))
+	c.is("CreateDomainClaim with a claimed domain", store.CreateDomainClaim(ctx, &models.DomainClaim{TenantID: tenant.ID, Domain: domain, Token: "token"}), storage.ErrConflict)
+
+	c.ok("CreateDeviceAuthorization", store.CreateDeviceAuthorization(ctx, newConformanceDeviceAuthorization(tenant.ID, "BCDFGHJK")))
+	c.is("CreateDeviceAuthorization with a taken user code", store.CreateDeviceAuthorization(ctx, newConformanceDeviceAuthorization(tenant.ID, "BCDFGHJK")), storage.ErrConflict)
+	c.ok("CreateDeviceAuthorization with a taken user code in another tenant", store.CreateDeviceAuthorization(ctx, newConformanceDeviceAuthorization(other.ID, "BCDFGHJK")))
+
+	tenantKey := func() *models.TenantKey {
+		return &models.TenantKey{TenantID: tenant.ID, Version: 1, WrappedKey: "wrapped", CreatedAt: time.Now()}
+	}
+	c.ok("ActivateTenantKey", store.ActivateTenantKey(ctx, tenantKey()))
+	c.is("ActivateTenantKey with a taken version", store.ActivateTenantKey(ctx, tenantKey()), storage.ErrConflict)
+	if tenantKeys, err := store.ListTenantKeys(ctx, tenant.ID); c.err == nil && (err != nil || len(tenantKeys) != 1 || !tenantKeys[0].Active) {
+		c.err = fmt.Errorf("ListTenantKeys after a conflicting activation = %d keys, %v; want the first key, still active", len(tenantKeys), err)
+	}
+
+	periodEnd := time.Now().UTC().Truncate(time.Hour)
+	c.ok("CreateDigestDelivery", store.CreateDigestDelivery(ctx, &models.DigestDelivery{TenantID: tenant.ID, PeriodEnd: periodEnd}))
+	c.is("CreateDigestDelivery for a recorded period", store.CreateDigestDelivery(ctx, &models.DigestDelivery{TenantID: tenant.ID, PeriodEnd: periodEnd}), storage.ErrConflict)
+	c.ok("CreateDigestDelivery for the period in another tenant", store.CreateDigestDelivery(ctx, &models.DigestDelivery{TenantID: other.ID, PeriodEnd: periodEnd}))
+
+	session := newConformanceSSOSession(tenant.ID)
+	c.ok("CreateSSOSession", store.CreateSSOSession(ctx, session))
+	sameToken := newConformanceSSOSession(tenant.ID)
+	sameToken.TokenHash = session.TokenHash
+	c.is("CreateSSOSession with a taken token", store.CreateSSOSession(ctx, sameToken), storage.ErrConflict)
+
+	c.ok("CreateClient", store.CreateClient(ctx, &models.Client{TenantID: tenant.ID, Name: "app"}))
+	c.is("CreateClient with a taken name", store.CreateClient(ctx, &models.Client{TenantID: tenant.ID, Name: "app"}), storage.ErrConflict)
+	c.ok("CreateClient with a taken name in another tenant", store.CreateClient(ctx, &models.Client{TenantID: other.ID, Name: "app"}))
+	return c.err
+}
+
+func updatesIntoDuplicatesConflict(ctx context.Context, store storage.Storage) error {
+	tenant, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+	other, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	var c check
+	alice := newConformanceUser(tenant.ID, "alice")
+	bob := newConformanceUser(tenant.ID, "bob")
+	c.ok("CreateUser", store.CreateUser(ctx, alice))
+	c.ok("CreateUser", store.CreateUser(ctx, bob))
+	if c.err != nil {
+		return c.err
+	}
+	renamed := *bob
+	renamed.Username = "alice"
+	c.is("UpdateUser to a taken username", store.UpdateUser(ctx, &renamed), storage.ErrConflict)
+
+	web := &models.Client{TenantID: tenant.ID, Name: "web"}
+	mobile := &models.Client{TenantID: tenant.ID, Name: "mobile"}
+	c.ok("CreateClient", store.CreateClient(ctx, web))
+	c.ok("CreateClient", store.CreateClient(ctx, mobile))
+	if c.err != nil {
+		return c.err
+	}
+	renamedClient := *mobile
+	renamedClient.Name = "web"
+	c.is("UpdateClient to a taken name", store.UpdateClient(ctx, &renamedClient), storage.ErrConflict)
+
+	// Verifying a domain another tenant verified first must fail, however
+	// the two verifications interleave.
+	domain := uuid.NewString() + ".example.com"
+	verified := time.Now()
+	first := &models.DomainClaim{TenantID: tenant.ID, Domain: domain, Token: "token", VerifiedAt: &verified}
+	second := &models.DomainClaim{TenantID: other.ID, Domain: domain, Token: "token"}
+	c.ok("CreateDomainClaim", store.CreateDomainClaim(ctx, first))
+	c.ok("CreateDomainClaim", store.CreateDomainClaim(ctx, second))
+	if c.err != nil {
+		return c.err
+	}
+	second.VerifiedAt = &verified
+	c.is("UpdateDomainClaim to a second verified claim", store.UpdateDomainClaim(ctx, second), storage.ErrConflict)
+	return c.err
+}
+
+// userPagesDoNotOverlap pages through users created in the same instant, so
+// only the tie-break keeps pages apart.
+func userPagesDoNotOverlap(ctx context.Context, store storage.Storage) error {
+	tenant, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	const users = 7
+	createdAt := time.Now().Truncate(time.Second)
+	for i := 0; i < users; i++ {
+		user := newConformanceUser(tenant.ID, fmt.Sprintf("user%d", i))
+		user.CreatedAt = createdAt
+		if err := store.CreateUser(ctx, user); err != nil {
+			return fmt.Errorf("CreateUser: %w", err)
+		}
+	}
+
+	for _, dir := range []string{"asc", "desc"} {
+		seen := make(map[string]bool)
+		for page := 1; page <= 4; page++ {
+			listed, total, err := store.ListUsers(ctx, storage.UserFilter{TenantID: tenant.ID, SortBy: "created_at", SortDir: dir, Page: page, PageSize: 3})
+			if err != nil {
+				return fmt.Errorf("ListUsers: %w", err)
+			}
+			if total != users {
+				return fmt.Errorf("ListUsers total = %d, want %d", total, users)
+			}
+			if page == 4 && len(listed) != 0 {
+				return fmt.Errorf("ListUsers past the last page returned %d users", len(listed))
+			}
+			for _, user := range listed {
+				if seen[user.ID] {
+					return fmt.Errorf("ListUsers %s returned %s on two pages", dir, user.Username)
+				}
+				seen[user.ID] = true
+			}
+		}
+		if len(seen) != users {
+			return fmt.Errorf("ListUsers %s pages held %d users, want %d", dir, len(seen), users)
+		}
+	}
+	return nil
+}
+
+func tenantPagesDoNotOverlap(ctx context.Context, store storage.Storage) error {
+	created := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		tenant, err := newConformanceTenant(ctx, store)
+		if err != nil {
+			return fmt.Errorf("CreateTenant: %w", err)
+		}
+		created[tenant.ID] = true
+	}
+
+	// The store may hold tenants of other cases, so page through all of
+	// them.
+	const pageSize = 2
+	seen := make(map[string]bool)
+	for page := 1; ; page++ {
+		tenants, total, err := store.ListTenants(ctx, page, pageSize)
+		if err != nil {
+			return fmt.Errorf("ListTenants: %w", err)
+		}
+		for _, tenant := range tenants {
+			if seen[tenant.ID] {
+				return fmt.Errorf("ListTenants returned %s on two pages", tenant.ID)
+			}
+			seen[tenant.ID] = true
+		}
+		if int64(page*pageSize) >= total {
+			break
+		}
+	}
+	for id := range created {
+		if !seen[id] {
+			return fmt.Errorf("ListTenants pages missed %s", id)
+		}
+	}
+	return nil
+}
+
+// emptyListsAreEmpty requires empty, non-nil results, which encode as []
+// rather than null.
+func emptyListsAreEmpty(ctx context.Context, store storage.Storage) error {
+	missing := uuid.NewString()
+
+	users, _, err := store.ListUsers(ctx, storage.UserFilter{TenantID: missing, Page: 1, PageSize: 10})
+	if err != nil || users == nil {
+		return fmt.Errorf("ListUsers = %v, %v; want an empty list", users, err)
+	}
+	envs, err := store.ListEnvironments(ctx, missing)
+	if err != nil || envs == nil {
+		return fmt.Errorf("ListEnvironments = %v, %v; want an empty list", envs, err)
+	}
+	policies, err := store.ListAccessPolicies(ctx, missing)
+	if err != nil || policies == nil {
+		return fmt.Errorf("ListAccessPolicies = %v, %v; want an empty list", policies, err)
+	}
+	claims, err := store.ListDomainClaims(ctx, missing)
+	if err != nil || claims == nil {
+		return fmt.Errorf("ListDomainClaims = %v, %v; want an empty list", claims, err)
+	}
+	entries, _, err := store.ListAuditLogs(ctx, storage.AuditLogFilter{TenantID: missing, Page: 1, PageSize: 10})
+	if err != nil || entries == nil {
+		return fmt.Errorf("ListAuditLogs = %v, %v; want an empty list", entries, err)
+	}
+	tenantKeys, err := store.ListTenantKeys(ctx, missing)
+	if err != nil || tenantKeys == nil {
+		return fmt.Errorf("ListTenantKeys = %v, %v; want an empty list", tenantKeys, err)
+	}
+	grants, err := store.ListConsentGrants(ctx, missing, missing)
+	if err != nil || grants == nil {
+		return fmt.Errorf("ListConsentGrants = %v, %v; want an empty list", grants, err)
+	}
+	clients, err := store.ListClients(ctx, missing)
+	if err != nil || clients == nil {
+		return fmt.Errorf("ListClients = %v, %v; want an empty list", clients, err)
+	}
+	return nil
+}
+
+// auditLogsAreChained requires each tenant's audit entries to link to the
+// entry before them, even when they are recorded concurrently.
+func auditLogsAreChained(ctx context.Context, store storage.Storage) error {
+	tenant, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+	other, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	const entries = 20
+	errs := make(chan error, entries)
+	for i := 0; i < entries; i++ {
+		go func(i int) {
+			tenantID := tenant.ID
+			if i%4 == 0 {
+				tenantID = other.ID
+			}
+			errs <- store.CreateAuditLog(ctx, &models.AuditLog{TenantID: tenantID, Action: "POST /conformance", Resource: "/conformance", Status: 200, CreatedAt: time.Now()})
+		}(i)
+	}
+	for i := 0; i < entries; i++ {
+		if err := <-errs; err != nil {
+			return fmt.Errorf("CreateAuditLog: %w", err)
+		}
+	}
+
+	for id, want := range map[string]int{tenant.ID: entries - entries/4, other.ID: entries / 4} {
+		chain, err := store.ListAuditChain(ctx, id, 0, entries)
+		if err != nil {
+			return fmt.Errorf("ListAuditChain: %w", err)
+		}
+		if len(chain) != want {
+			return fmt.Errorf("ListAuditChain returned %d entries, want %d", len(chain), want)
+		}
+		prevHash := ""
+		for i, entry := range chain {
+			if entry.Sequence != int64(i+1) || entry.PrevHash != prevHash || entry.ChainVersion != models.AuditChainVersion || entry.Hash != entry.ChainHash() {
+				return fmt.Errorf("ListAuditChain entry %d has sequence %d and does not link to the entry before it", i, entry.Sequence)
+			}
+			prevHash = entry.Hash
+		}
+		rest, err := store.ListAuditChain(ctx, id, 2, entries)
+		if err != nil || len(rest) != want-2 {
+			return fmt.Errorf("ListAuditChain after sequence 2 = %d entries, %v; want %d", len(rest), err, want-2)
+		}
+	}
+	return nil
+}
+
+// purgedAuditChainsAreAnchored requires retention to record the last entry
+// it purged from a chain, and the chain to go on from it once emptied.
+func purgedAuditChainsAreAnchored(ctx context.Context, store storage.Storage) error {
+	tenant, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	old := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := make([]*models.AuditLog, 4)
+	for i := range entries {
+		createdAt := time.Now()
+		if i < 2 {
+			createdAt = old.Add(time.Duration(i) * time.Second)
+		}
+		entries[i] = &models.AuditLog{TenantID: tenant.ID, Action: "POST /conformance", Resource: "/conformance", Status: 200, CreatedAt: createdAt}
+		if err := store.CreateAuditLog(ctx, entries[i]); err != nil {
+			return fmt.Errorf("CreateAuditLog: %w", err)
+		}
+	}
+
+	if _, err := store.PurgeAuditLogs(ctx, old.Add(time.Hour)); err != nil {
+		return fmt.Errorf("PurgeAuditLogs: %w", err)
+	}
+	anchor, err := store.GetAuditChainAnchor(ctx, tenant.ID)
+	if err != nil {
+		return fmt.Errorf("GetAuditChainAnchor: %w", err)
+	}
+	if anchor.Sequence != 2 || anchor.Hash != entries[1].Hash {
+		return fmt.Errorf("anchor after the first purge is sequence %d, want 2 with the hash of the entry purged last", anchor.Sequence)
+	}
+	chain, err := store.ListAuditChain(ctx, tenant.ID, 0, len(entries))
+	if err != nil || len(chain) != 2 || chain[0].Sequence != 3 {
+		return fmt.Errorf("ListAuditChain after the first purge = %d entries, %v; want sequences 3 and 4", len(chain), err)
+	}
+
+	if _, err := store.PurgeAuditLogs(ctx, time.Now().Add(time.Hour)); err != nil {
+		return fmt.Errorf("PurgeAuditLogs: %w", err)
+	}
+	next := &models.AuditLog{TenantID: tenant.ID, Action: "POST /conformance", Resource: "/conformance", Status: 200, CreatedAt: time.Now()}
+	if err := store.CreateAuditLog(ctx, next); err != nil {
+		return fmt.Errorf("CreateAuditLog: %w", err)
+	}
+	if next.Sequence != 5 || next.PrevHash != entries[3].Hash {
+		return fmt.Errorf("entry after an emptied chain has sequence %d, want 5 linking to the entry purged last", next.Sequence)
+	}
+	return nil
+}
+
+// ssoSessionsTrackTheirClients requires the clients added to a session to be
+// kept once each, and only through the session's tenant.
+func ssoSessionsTrackTheirClients(ctx context.Context, store storage.Storage) error {
+	tenant, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+	other, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	session := newConformanceSSOSession(tenant.ID)
+	session.ClientIDs = []string{"portal"}
+	if err := store.CreateSSOSession(ctx, session); err != nil {
+		return fmt.Errorf("CreateSSOSession: %w", err)
+	}
+	for _, add := range []struct{ tenantID, clientID string }{{tenant.ID, "portal"}, {tenant.ID, "shop"}, {other.ID, "intruder"}} {
+		if err := store.AddSSOSessionClient(ctx, add.tenantID, session.ID, add.clientID); err != nil {
+			return fmt.Errorf("AddSSOSessionClient: %w", err)
+		}
+	}
+
+	got, err := store.GetSSOSessionByTokenHash(ctx, tenant.ID, session.TokenHash)
+	if err != nil {
+		return fmt.Errorf("GetSSOSessionByTokenHash: %w", err)
+	}
+	if !slices.Equal(got.ClientIDs, []string{"portal", "shop"}) {
+		return fmt.Errorf("session clients = %v, want [portal shop]", got.ClientIDs)
+	}
+	return nil
+}
+
+// dataChangesFollowTheirAuditLog requires the changes saved with an entry to
+// be listed for it, in order, and for its tenant only.
+func dataChangesFollowTheirAuditLog(ctx context.Context, store storage.Storage) error {
+	tenant, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entry := &models.AuditLog{
+		TenantID: tenant.ID, Action: "PATCH /conformance", Resource: "/conformance", Status: 200, CreatedAt: now,
+		Changes: []models.DataChange{
+			{TxID: 7, Operation: "create", Table: "users", Values: `{"username":"alice"}`, RowsAffected: 1, CreatedAt: now.Add(-2 * time.Millisecond)},
+			{TxID: 8, Operation: "update", Table: "users", Values: `{"role":"admin"}`, Conditions: `username = 'alice'`, RowsAffected: 1, CreatedAt: now.Add(-time.Millisecond)},
+		},
+	}
+	if err := store.CreateAuditLog(ctx, entry); err != nil {
+		return fmt.Errorf("CreateAuditLog: %w", err)
+	}
+
+	changes, err := store.ListDataChanges(ctx, tenant.ID, entry.ID)
+	if err != nil {
+		return fmt.Errorf("ListDataChanges: %w", err)
+	}
+	if len(changes) != 2 || changes[0].Operation != "create" || changes[1].Operation != "update" {
+		return fmt.Errorf("ListDataChanges returned %d changes, want the create then the update", len(changes))
+	}
+	for _, change := range changes {
+		if change.ID == "" || change.AuditLogID != entry.ID || change.TenantID != tenant.ID {
+			return fmt.Errorf("ListDataChanges returned change %+v, not linked to its entry", change)
+		}
+	}
+
+	other, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+	if changes, err := store.ListDataChanges(ctx, other.ID, entry.ID); err != nil || len(changes) != 0 {
+		return fmt.Errorf("ListDataChanges for another tenant = %d changes, %v; want an empty list", len(changes), err)
+	}
+	return nil
+}
+
+// consentGrantsAreReplaced requires saving a user's consent to a client
+// again to replace its scopes rather than add a second grant.
+func consentGrantsAreReplaced(ctx context.Context, store storage.Storage) error {
+	tenant, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	var c check
+	now := time.Now()
+	c.ok("SaveConsentGrant", store.SaveConsentGrant(ctx, &models.ConsentGrant{
+		TenantID: tenant.ID, UserID: "alice", ClientID: "tv", Scopes: []string{"read"}, CreatedAt: now, UpdatedAt: now,
+	}))
+	c.ok("SaveConsentGrant again", store.SaveConsentGrant(ctx, &models.ConsentGrant{
+		TenantID: tenant.ID, UserID: "alice", ClientID: "tv", Scopes: []string{"read", "write"}, CreatedAt: now, UpdatedAt: now,
+	}))
+	c.ok("SaveConsentGrant for another client", store.SaveConsentGrant(ctx, &models.ConsentGrant{
+		TenantID: tenant.ID, UserID: "alice", ClientID: "cli", Scopes: []string{}, CreatedAt: now, UpdatedAt: now,
+	}))
+	if c.err != nil {
+		return c.err
+	}
+
+	grant, err := store.GetConsentGrant(ctx, tenant.ID, "alice", "tv")
+	if err != nil {
+		return fmt.Errorf("GetConsentGrant: %w", err)
+	}
+	if len(grant.Scopes) != 2 || grant.Scopes[0] != "read" || grant.Scopes[1] != "write" {
+		return fmt.Errorf("GetConsentGrant scopes = %v; want [read write]", grant.Scopes)
+	}
+	grants, err := store.ListConsentGrants(ctx, tenant.ID, "alice")
+	if err != nil || len(grants) != 2 {
+		return fmt.Errorf("ListConsentGrants = %d grants, %v; want 2", len(grants), err)
+	}
+	return nil
+}
+
+// deletedTenantsLeaveNothing requires deleting a tenant to delete its users
+// and audit log with it, and no other tenant's.
+func deletedTenantsLeaveNothing(ctx context.Context, store storage.Storage) error {
+	tenant, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+	other, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	var c check
+	user := newConformanceUser(tenant.ID, "alice")
+	kept := newConformanceUser(other.ID, "alice")
+	c.ok("CreateUser", store.CreateUser(ctx, user))
+	c.ok("CreateUser for another tenant", store.CreateUser(ctx, kept))
+	c.ok("CreateAuditLog", store.CreateAuditLog(ctx, &models.AuditLog{
+		TenantID: tenant.ID, Action: "POST /conformance", Resource: "/conformance", Status: 201, CreatedAt: time.Now(),
+	}))
+	if c.err != nil {
+		return c.err
+	}
+
+	c.ok("DeleteTenant", store.DeleteTenant(ctx, tenant.ID))
+	_, err = store.GetTenant(ctx, tenant.ID)
+	c.is("GetTenant after DeleteTenant", err, storage.ErrTenantNotFound)
+	_, err = store.GetUser(ctx, user.ID)
+	c.is("GetUser after DeleteTenant", err, storage.ErrUserNotFound)
+	c.is("DeleteTenant again", store.DeleteTenant(ctx, tenant.ID), storage.ErrTenantNotFound)
+	_, err = store.GetUser(ctx, kept.ID)
+	c.ok("GetUser for another tenant", err)
+	if c.err != nil {
+		return c.err
+	}
+
+	if logs, total, err := store.ListAuditLogs(ctx, storage.AuditLogFilter{TenantID: tenant.ID, Page: 1, PageSize: 10}); err != nil || total != 0 {
+		return fmt.Errorf("ListAuditLogs after DeleteTenant = %d entries, %v; want none", len(logs), err)
+	}
+	return nil
+}
+
+// jobsAreClaimedOnce requires pending jobs of the kinds asked for to be
+// claimed oldest first and once each, and running ones again only once they
+// went stale.
+func jobsAreClaimedOnce(ctx context.Context, store storage.Storage) error {
+	tenant, err := newConformanceTenant(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	var c check
+	now := time.Now()
+	older := &models.Job{TenantID: tenant.ID, Kind: models.JobExportUsers, Status: models.JobPending, CreatedAt: now.Add(-time.Minute), UpdatedAt: now}
+	newer := &models.Job{TenantID: tenant.ID, Kind: models.JobExportUsers, Status: models.JobPending, CreatedAt: now, UpdatedAt: now}
+	other := &models.Job{TenantID: tenant.ID, Kind: models.JobReencrypt, Status: models.JobPending, CreatedAt: now.Add(-time.Hour), UpdatedAt: now}
+	c.ok("CreateJob", store.CreateJob(ctx, older))
+	c.ok("CreateJob", store.CreateJob(ctx, newer))
+	c.ok("CreateJob of another kind", store.CreateJob(ctx, other))
+	if c.err != nil {
+		return c.err
+	}
+
+	// Jobs left by other runs against the database are claimed as well.
+	kinds := []models.JobKind{models.JobExportUsers}
+	var claimed []string
+	for {
+		job, err := store.ClaimJob(ctx, kinds, now.Add(-time.Hour))
+		if errors.Is(err, storage.ErrJobNotFound) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("ClaimJob: %w", err)
+		}
+		if job.Status != models.JobRunning || job.Kind != models.JobExportUsers {
+			return fmt.Errorf("ClaimJob = %s job %s; want %s job %s", job.Kind, job.Status, models.JobExportUsers, models.JobRunning)
+		}
+		if job.TenantID == tenant.ID {
+			claimed = append(claimed, job.ID)
+		}
+	}
+	if len(claimed) != 2 || claimed[0] != older.ID || claimed[1] != newer.ID {
+		return fmt.Errorf("ClaimJob claimed %v; want [%s %s]", claimed, older.ID, newer.ID)
+	}
+
+	job, err := store.ClaimJob(ctx, kinds, time.Now().Add(time.Hour))
+	if err != nil {
+		return fmt.Errorf("ClaimJob of a stale job: %w", err)
+	}
+	if job.TenantID == tenant.ID && job.ID != older.ID {
+		return fmt.Errorf("ClaimJob of a stale job = %s; want %s", job.ID, older.ID)
+	}
+	return nil
+}